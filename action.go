@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// ACTION_TIMEOUT bounds how long a command or HTTP request may take
+	ACTION_TIMEOUT = 10 * time.Second
+
+	// ACTION_OUTPUT_LIMIT caps how much command output or response body is
+	// logged
+	ACTION_OUTPUT_LIMIT = 200
+
+	// Default prompts: three quick high beeps for success, reorder tone
+	// for failure
+	SUCCESS_FREQ     = 880.0 // Hz
+	SUCCESS_BEEP     = 100 * time.Millisecond
+	SUCCESS_DURATION = 600 * time.Millisecond
+	FAILURE_DURATION = 3 * time.Second
+)
+
+// actionData is what command, URL and body templates can refer to, e.g.
+// "http://plug.local/toggle?by={{.Caller}}"
+type actionData struct {
+	Number      string // Canonical dialed number
+	Digits      string // Digits as dialed
+	Caller      string // Caller ID, if known
+	Exchange    string
+	Destination string
+}
+
+// escaped is the data with every value escaped for where a template puts
+// it, since the caller ID is whatever the phone sent
+func (d actionData) escaped(escape func(string) string) actionData {
+	return actionData{
+		Number:      escape(d.Number),
+		Digits:      escape(d.Digits),
+		Caller:      escape(d.Caller),
+		Exchange:    escape(d.Exchange),
+		Destination: escape(d.Destination),
+	}
+}
+
+// escapeJSONString escapes s to go between the quotes of a JSON string
+func escapeJSONString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted[1 : len(quoted)-1])
+}
+
+// actionContentType is the Content-Type of an action's request body: the
+// one configured, or else JSON for a body that starts like an object or
+// array and plain text for any other
+func actionContentType(dest DestinationConfig) string {
+	switch {
+	case dest.ContentType != "":
+		return dest.ContentType
+	case strings.HasPrefix(strings.TrimSpace(dest.Body), "{"), strings.HasPrefix(strings.TrimSpace(dest.Body), "["):
+		return "application/json"
+	}
+	return "text/plain"
+}
+
+// bodyEscaper is how values are escaped in a body of contentType: as form
+// values, or to go inside a JSON string. Other types have no escaping,
+// so values can't be put in them.
+func bodyEscaper(contentType string) (func(string) string, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("content type %q: %v", contentType, err)
+	case mediaType == "application/x-www-form-urlencoded":
+		return neturl.QueryEscape, nil
+	case strings.HasSuffix(mediaType, "/json"), strings.HasSuffix(mediaType, "+json"):
+		return escapeJSONString, nil
+	}
+	return nil, fmt.Errorf("values can't be escaped for a %s body; use JSON or a form", mediaType)
+}
+
+// checkActionTemplates parses every template in an action destination,
+// and checks a body with values in it is of a type they can be escaped for
+func checkActionTemplates(dest DestinationConfig) error {
+	for _, source := range append([]string{dest.URL, dest.Body}, dest.Command...) {
+		if _, err := template.New("").Parse(source); err != nil {
+			return err
+		}
+	}
+	if strings.Contains(dest.Body, "{{") {
+		if _, err := bodyEscaper(actionContentType(dest)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderActionTemplate fills in a template string
+func renderActionTemplate(source string, data any) (string, error) {
+	tmpl, err := template.New("").Parse(source)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// renderActionURL fills in a URL template, escaping values in the path as
+// path segments and values in the query as query values
+func renderActionURL(source string, data actionData) (string, error) {
+	path, query, hasQuery := cutOutsideActions(source, '?')
+	url, err := renderActionTemplate(path, data.escaped(neturl.PathEscape))
+	if err != nil || !hasQuery {
+		return url, err
+	}
+	rendered, err := renderActionTemplate(query, data.escaped(neturl.QueryEscape))
+	if err != nil {
+		return "", err
+	}
+	return url + "?" + rendered, nil
+}
+
+// cutOutsideActions cuts a template around the first sep that isn't inside
+// a {{...}} action
+func cutOutsideActions(source string, sep byte) (before, after string, found bool) {
+	depth := 0
+	for i := 0; i < len(source); i++ {
+		switch {
+		case strings.HasPrefix(source[i:], "{{"):
+			depth++
+			i++
+		case strings.HasPrefix(source[i:], "}}") && depth > 0:
+			depth--
+			i++
+		case source[i] == sep && depth == 0:
+			return source[:i], source[i+1:], true
+		}
+	}
+	return source, "", false
+}
+
+// renderCommand fills in the templates of a command's arguments. An
+// argument that only starts with "-" once filled in is refused, so that a
+// caller ID can't pass the program an option.
+func renderCommand(command []string, data any) ([]string, error) {
+	args := make([]string, len(command))
+	for i, arg := range command {
+		rendered, err := renderActionTemplate(arg, data)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && strings.HasPrefix(rendered, "-") && !strings.HasPrefix(arg, "-") {
+			return nil, fmt.Errorf("argument %q would start with \"-\"", rendered)
+		}
+		args[i] = rendered
+	}
+	return args, nil
+}
+
+// runAction performs an action destination's command or HTTP request,
+// logs the result and plays the success or failure prompt
+func (s *SIPServer) runAction(session *CallSession, res resolution, dest DestinationConfig) {
+	data := actionData{
+		Number:      res.number,
+		Digits:      session.digits,
+		Exchange:    session.exchange.name,
+		Destination: res.destination,
+		Caller:      session.caller(),
+	}
+
+	ctx, cancel := context.WithTimeout(session.ctx, ACTION_TIMEOUT)
+	output, err := performAction(ctx, dest, data)
+	cancel()
+
+	if len(output) > ACTION_OUTPUT_LIMIT {
+		output = output[:ACTION_OUTPUT_LIMIT] + "…"
+	}
+	prompt := dest.Success
+	if err != nil {
+		log.Printf("❌ Action %q failed: %v %s", res.destination, err, output)
+		prompt = dest.Failure
+	} else {
+		fmt.Printf("⚙️  Action %q succeeded %s\n", res.destination, output)
+	}
+	if session.ctx.Err() != nil {
+		return
+	}
+
+	source := defaultActionPrompt(err == nil)
+	if prompt != "" {
+		cfg := session.exchange.config
+		if opened, openErr := openDestination(cfg, cfg.Destinations[prompt]); openErr != nil {
+			log.Printf("⚠️  Prompt %q unavailable: %v", prompt, openErr)
+		} else {
+			source = opened
+		}
+	}
+	s.playTone(session.ctx, session, source)
+}
+
+// performAction runs the command or makes the HTTP request, returning its
+// output for the log
+func performAction(ctx context.Context, dest DestinationConfig, data actionData) (string, error) {
+	if len(dest.Command) > 0 {
+		// Arguments are passed straight to the program; no shell is involved
+		args, err := renderCommand(dest.Command, data)
+		if err != nil {
+			return "", err
+		}
+		output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		return strings.TrimSpace(string(output)), err
+	}
+
+	url, err := renderActionURL(dest.URL, data)
+	if err != nil {
+		return "", err
+	}
+	contentType := actionContentType(dest)
+	body := dest.Body
+	if strings.Contains(body, "{{") {
+		escape, err := bodyEscaper(contentType)
+		if err != nil {
+			return "", err
+		}
+		if body, err = renderActionTemplate(body, data.escaped(escape)); err != nil {
+			return "", err
+		}
+	}
+	method := dest.Method
+	if method == "" {
+		method = http.MethodGet
+		if body != "" {
+			method = http.MethodPost
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	if body != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	var output bytes.Buffer
+	io.Copy(&output, io.LimitReader(response.Body, ACTION_OUTPUT_LIMIT+1))
+	result := fmt.Sprintf("(%s) %s", response.Status, strings.TrimSpace(output.String()))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return result, fmt.Errorf("%s %s answered %s", method, url, response.Status)
+	}
+	return result, nil
+}
+
+// defaultActionPrompt is played when an action has no prompt configured
+func defaultActionPrompt(success bool) MediaSource {
+	if success {
+		return newLimitedSource(newCadenceSource(SUCCESS_BEEP, SUCCESS_BEEP, SUCCESS_FREQ), SUCCESS_DURATION)
+	}
+	return newLimitedSource(newCadenceSource(REORDER_ON, REORDER_OFF, BUSY_FREQ1, BUSY_FREQ2), FAILURE_DURATION)
+}
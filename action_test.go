@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"testing"
+)
+
+// HOSTILE_CALLER is a caller ID made to break out of where templates put it
+const HOSTILE_CALLER = `--x&admin=1#"},"evil":"1`
+
+func TestActionEscapesURLAndBody(t *testing.T) {
+	var query, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("by")
+		if len(r.URL.Query()) != 1 {
+			t.Errorf("query has parameters the caller ID added: %v", r.URL.Query())
+		}
+		raw, _ := io.ReadAll(r.Body)
+		body = string(raw)
+	}))
+	defer server.Close()
+
+	dest := DestinationConfig{
+		Type: "action",
+		URL:  server.URL + "/toggle?by={{.Caller}}",
+		Body: `{"caller": "{{.Caller}}", "number": "{{.Number}}"}`,
+	}
+	data := actionData{Number: "#42", Caller: HOSTILE_CALLER}
+	if _, err := performAction(context.Background(), dest, data); err != nil {
+		t.Fatal(err)
+	}
+
+	if query != HOSTILE_CALLER {
+		t.Errorf("query by = %q, want %q", query, HOSTILE_CALLER)
+	}
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(body), &fields); err != nil {
+		t.Fatalf("body %s isn't JSON: %v", body, err)
+	}
+	want := map[string]string{"caller": HOSTILE_CALLER, "number": "#42"}
+	if len(fields) != len(want) || fields["caller"] != want["caller"] || fields["number"] != want["number"] {
+		t.Errorf("body = %v, want %v", fields, want)
+	}
+}
+
+func TestActionEscapesFormBody(t *testing.T) {
+	var form neturl.Values
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		r.ParseForm()
+		form = r.PostForm
+	}))
+	defer server.Close()
+
+	dest := DestinationConfig{
+		Type:        "action",
+		URL:         server.URL,
+		Body:        "caller={{.Caller}}&number={{.Number}}",
+		ContentType: "application/x-www-form-urlencoded",
+	}
+	if _, err := performAction(context.Background(), dest, actionData{Number: "#42", Caller: HOSTILE_CALLER}); err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType != dest.ContentType {
+		t.Errorf("Content-Type = %q, want %q", contentType, dest.ContentType)
+	}
+	if len(form) != 2 || form.Get("caller") != HOSTILE_CALLER || form.Get("number") != "#42" {
+		t.Errorf("form = %v, want caller %q and number #42", form, HOSTILE_CALLER)
+	}
+}
+
+func TestActionEscapesJSONArrayBody(t *testing.T) {
+	var body, contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		raw, _ := io.ReadAll(r.Body)
+		body = string(raw)
+	}))
+	defer server.Close()
+
+	dest := DestinationConfig{Type: "action", URL: server.URL, Body: `["{{.Caller}}", "{{.Number}}"]`}
+	if _, err := performAction(context.Background(), dest, actionData{Number: "#42", Caller: HOSTILE_CALLER}); err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", contentType)
+	}
+	var values []string
+	if err := json.Unmarshal([]byte(body), &values); err != nil {
+		t.Fatalf("body %s isn't JSON: %v", body, err)
+	}
+	if len(values) != 2 || values[0] != HOSTILE_CALLER || values[1] != "#42" {
+		t.Errorf("body = %q, want [%q #42]", values, HOSTILE_CALLER)
+	}
+}
+
+func TestActionBodyTypes(t *testing.T) {
+	tests := []struct {
+		body, contentType string
+		ok                bool
+	}{
+		{`{"caller": "{{.Caller}}"}`, "", true},
+		{`{"caller": "{{.Caller}}"}`, "application/vnd.api+json; charset=utf-8", true},
+		{"caller={{.Caller}}", "application/x-www-form-urlencoded", true},
+		{"Call from {{.Caller}}", "", false},
+		{"<caller>{{.Caller}}</caller>", "application/xml", false},
+		{"Doorbell", "", true},
+	}
+	for _, test := range tests {
+		dest := DestinationConfig{Type: "action", URL: "http://plug.local/", Body: test.body, ContentType: test.contentType}
+		if err := checkActionTemplates(dest); (err == nil) != test.ok {
+			t.Errorf("body %q of type %q: %v, want ok=%v", test.body, test.contentType, err, test.ok)
+		}
+	}
+}
+
+func TestActionEscapesURLPath(t *testing.T) {
+	var path, query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, query = r.URL.Path, r.URL.Query().Get("by")
+	}))
+	defer server.Close()
+
+	dest := DestinationConfig{Type: "action", URL: server.URL + "/calls/{{.Caller}}?by={{.Caller}}"}
+	caller := "Jane Doe/+1"
+	if _, err := performAction(context.Background(), dest, actionData{Caller: caller}); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/calls/"+caller {
+		t.Errorf("path = %q, want %q", path, "/calls/"+caller)
+	}
+	if query != caller {
+		t.Errorf("query by = %q, want %q", query, caller)
+	}
+}
+
+func TestRenderCommandRefusesOptions(t *testing.T) {
+	tests := []struct {
+		command []string
+		caller  string
+		ok      bool
+	}{
+		{[]string{"open-door", "--by={{.Caller}}"}, "--help", true},
+		{[]string{"open-door", "--by", "{{.Caller}}"}, "1001", true},
+		{[]string{"open-door", "--by", "{{.Caller}}"}, "--help", false},
+		{[]string{"open-door", "{{.Caller}}"}, "-rf", false},
+		{[]string{"open-door", "-v", "{{.Number}}"}, "", true},
+	}
+	for _, test := range tests {
+		_, err := renderCommand(test.command, actionData{Number: "42", Caller: test.caller})
+		if (err == nil) != test.ok {
+			t.Errorf("renderCommand(%q) with caller %q: %v, want ok=%v", test.command, test.caller, err, test.ok)
+		}
+	}
+}
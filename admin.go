@@ -0,0 +1,277 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ADMIN_PIN_ATTEMPTS is how many wrong PINs hang up the admin line
+	ADMIN_PIN_ATTEMPTS = 3
+
+	// Without a speech synthesizer the admin line answers in beeps, and
+	// reads the server's address out as a group of beeps per digit (ten
+	// for 0) with a low tone for each dot
+	ADMIN_BEEP_FREQ  = 1000.0 // Hz
+	ADMIN_LOW_FREQ   = 500.0  // Hz
+	ADMIN_DOT        = 400 * time.Millisecond
+	ADMIN_DIGIT_GAP  = 700 * time.Millisecond
+	ADMIN_MENU_BEEPS = 3
+
+	// The master volume moves in steps between its limits
+	VOLUME_STEP_DB = 3
+	MIN_VOLUME_DB  = -18
+	MAX_VOLUME_DB  = 9
+)
+
+// Runtime settings shared by every server. They start out as configured
+// and the admin menu changes them while the server runs.
+var (
+	masterVolumeDB atomic.Int32 // Gain applied to everything played to callers
+	sipTrace       atomic.Bool  // Print every SIP message sent and received
+)
+
+// applyRuntimeSettings sets the runtime settings from the config, at
+// startup and again on each reload
+func applyRuntimeSettings(cfg *Config) {
+	masterVolumeDB.Store(int32(cfg.VolumeDB))
+	sipTrace.Store(cfg.SIPTrace)
+}
+
+// adjustMasterVolume moves the master volume by step dB, within its
+// limits, reporting the new level and whether it moved
+func adjustMasterVolume(step int) (int, bool) {
+	old := int(masterVolumeDB.Load())
+	db := min(max(old+step, MIN_VOLUME_DB), MAX_VOLUME_DB)
+	masterVolumeDB.Store(int32(db))
+	return db, db != old
+}
+
+// withMasterVolume applies the master volume to the audio fill produces
+func withMasterVolume(fill func(samples []int16) bool) func(samples []int16) bool {
+	return func(samples []int16) bool {
+		if !fill(samples) {
+			return false
+		}
+		if db := masterVolumeDB.Load(); db != 0 {
+			gain := math.Pow(10, float64(db)/20)
+			for i, sample := range samples {
+				samples[i] = clampSample(float64(sample) * gain)
+			}
+		}
+		return true
+	}
+}
+
+// spellAddress is an address as it is read out: one character at a time,
+// with "point" for each dot
+func spellAddress(ip string) string {
+	var words []string
+	for _, c := range ip {
+		switch c {
+		case '.':
+			words = append(words, "point")
+		case ':':
+			words = append(words, "colon")
+		default:
+			words = append(words, string(c))
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// addressBeeps reads an address out without a speech synthesizer: a group
+// of beeps per digit, ten for 0, and a low tone for anything else
+func addressBeeps(ip string) MediaSource {
+	gap := func() MediaSource {
+		return newPCMSource(make([]int16, int(ADMIN_DIGIT_GAP.Seconds()*SAMPLE_RATE)), false)
+	}
+	var sources []MediaSource
+	for _, c := range ip {
+		if c >= '0' && c <= '9' {
+			count := int(c - '0')
+			if count == 0 {
+				count = 10
+			}
+			sources = append(sources, newBeeps(count, ADMIN_BEEP_FREQ), gap())
+		} else {
+			sources = append(sources, newLimitedSource(newToneSource(ADMIN_LOW_FREQ), ADMIN_DOT), gap())
+		}
+	}
+	return newSequenceSource(sources...)
+}
+
+// adminMenuText is what the admin line says once the PIN is accepted
+const adminMenuText = "Admin menu. 1 reloads the config. 2 and 8 turn the volume up and down. " +
+	"3 turns SIP tracing on or off. 5 reads the server address. "
+
+// adminMenuKeys are the keys that repeat the admin menu and hang up: * and
+// #, or 9 and 0 on a rotary installation
+func adminMenuKeys(cfg *Config) (repeat, hangup, text string) {
+	if cfg.rotary() {
+		return "9", "0", adminMenuText + "9 repeats this menu, 0 hangs up."
+	}
+	return "*", "#", adminMenuText + "Star repeats this menu, pound hangs up."
+}
+
+// runAdmin is the admin line, for looking after a kiosk with nothing but
+// its handset. The caller enters the destination's PIN followed by #;
+// after too many wrong PINs the line hangs up. Then 1 reloads the config,
+// 2 and 8 turn the master volume up and down, 3 toggles SIP tracing, 5
+// reads out the server's address, * repeats the menu and # hangs up. On a
+// rotary installation the PIN ends with a pause, 9 and 0 stand in for *
+// and #, and a reload must be confirmed. With barge_in, whatever is being
+// read out stops when the caller talks over it.
+func (s *SIPServer) runAdmin(session *CallSession, name string, dest DestinationConfig) {
+	digits, release := session.captureDigits()
+	defer release()
+	voice, quiet := session.watchVoice()
+	defer quiet()
+
+	playing, stop := context.WithCancel(session.ctx)
+	defer stop()
+	player := newPlayerSource()
+	stream := s.newCallStream(session, func(samples []int16) bool {
+		return playing.Err() == nil && player.ReadFrame(samples)
+	})
+	stream.markTalkspurts(player)
+	s.scheduler.Add(stream)
+
+	say := func(text string, fallback MediaSource) {
+		player.Play(speech(session, text, fallback))
+	}
+
+	reload := func() {
+		if err := s.reload.Reload(); err != nil {
+			log.Printf("❌ Admin %q: reload failed: %v", name, err)
+			say("Reload failed.", defaultActionPrompt(false))
+			return
+		}
+		say("Config reloaded.", defaultActionPrompt(true))
+	}
+
+	cfg := session.exchange.config
+	repeat, hangup, menu := adminMenuKeys(cfg)
+	entries := menuEntries(playing, cfg, digits)
+
+	who := cmp.Or(session.caller(), "anonymous")
+	fmt.Printf("🔐 Admin %q: waiting for PIN from %s\n", name, who)
+	if cfg.rotary() {
+		say("Dial your PIN.", newBeeps(1, ADMIN_BEEP_FREQ))
+	} else {
+		say("Enter PIN, then pound.", newBeeps(1, ADMIN_BEEP_FREQ))
+	}
+	unlocked := false
+	confirming := false // A rotary reload waiting for its 1
+	attempts := 0
+	var pin strings.Builder
+
+	for {
+		select {
+		case entry := <-entries:
+			if !unlocked {
+				attempt := entry
+				if !cfg.rotary() {
+					switch entry {
+					case "*":
+						pin.Reset()
+						continue
+					case "#":
+						attempt = pin.String()
+						pin.Reset()
+					default:
+						pin.WriteString(entry)
+						continue
+					}
+				}
+				if subtle.ConstantTimeCompare([]byte(attempt), []byte(dest.PIN)) == 1 {
+					unlocked = true
+					fmt.Printf("🔓 Admin %q opened by %s\n", name, who)
+					say(menu, newBeeps(ADMIN_MENU_BEEPS, ADMIN_BEEP_FREQ))
+					continue
+				}
+				attempts++
+				log.Printf("🚫 Admin %q: wrong PIN from %s (%d of %d)", name, who, attempts, ADMIN_PIN_ATTEMPTS)
+				if attempts == ADMIN_PIN_ATTEMPTS {
+					player.Play(defaultActionPrompt(false))
+					select {
+					case <-player.Ended():
+						s.hangupCall(session)
+					case <-session.ctx.Done():
+					}
+					return
+				}
+				say("Wrong PIN. Try again.", defaultActionPrompt(false))
+				continue
+			}
+
+			if confirming {
+				confirming = false
+				if entry == "1" {
+					reload()
+				} else {
+					fmt.Printf("🔐 Admin %q: reload not confirmed\n", name)
+					say("Reload cancelled.", defaultActionPrompt(false))
+				}
+				continue
+			}
+
+			switch entry {
+			case "1":
+				if s.reload == nil {
+					log.Printf("❌ Admin %q: can't reload a server started without -config", name)
+					say("Reload is not available.", defaultActionPrompt(false))
+				} else if cfg.rotary() {
+					confirming = true
+					player.Play(confirmPrompt(session, "Reload the config?"))
+				} else {
+					reload()
+				}
+			case "2", "8":
+				step := VOLUME_STEP_DB
+				if entry == "8" {
+					step = -step
+				}
+				db, moved := adjustMasterVolume(step)
+				fmt.Printf("🔊 Master volume %+d dB\n", db)
+				say(fmt.Sprintf("Volume %+d decibels.", db), defaultActionPrompt(moved))
+			case "3":
+				on := !sipTrace.Load()
+				sipTrace.Store(on)
+				if on {
+					fmt.Println("🔍 SIP trace on")
+					say("SIP trace on.", newBeeps(1, ADMIN_BEEP_FREQ))
+				} else {
+					fmt.Println("🔍 SIP trace off")
+					say("SIP trace off.", newBeeps(1, ADMIN_LOW_FREQ))
+				}
+			case "5":
+				ip := s.localIPFor(session.RemoteAddr)
+				fmt.Printf("🌐 Reading out server address %s\n", ip)
+				say("Server address: "+spellAddress(ip)+".", addressBeeps(ip))
+			case repeat:
+				say(menu, newBeeps(ADMIN_MENU_BEEPS, ADMIN_BEEP_FREQ))
+			case hangup:
+				fmt.Printf("🔐 Admin %q closed\n", name)
+				s.hangupCall(session)
+				return
+			}
+
+		case talking := <-voice:
+			if talking && cfg.BargeIn {
+				player.Play(nil)
+			}
+		case <-stream.Done():
+			return
+		case <-session.ctx.Done():
+			return
+		}
+	}
+}
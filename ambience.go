@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+const (
+	// AMBIENCE_TRUNK_HUNT is how long the other side of the world takes to
+	// find a free trunk; nearer destinations take a fraction of it
+	AMBIENCE_TRUNK_HUNT = 1500 * time.Millisecond
+
+	// AMBIENCE_CLICK is the length of one switch click
+	AMBIENCE_CLICK = 25 * time.Millisecond
+)
+
+// hasAmbience reports whether calls to the destination are put through
+// with call setup ambience. Phones ring for real, and menus and readouts
+// aren't anywhere to be put through to.
+func (d DestinationConfig) hasAmbience() bool {
+	switch d.Type {
+	case "phone", "action", "passport", "stats", "admin":
+		return false
+	}
+	return true
+}
+
+// ambienceDistance is how far away a destination sounds, from 0 (across
+// town) to 1 (the other side of the world). It is the destination's own
+// distance if set, otherwise worked out from its country: untagged
+// destinations are local, then the home country, its neighbors, its
+// calling code zone and everywhere else are successively further.
+func ambienceDistance(cfg AmbienceConfig, dest DestinationConfig) float64 {
+	if dest.Distance > 0 {
+		return dest.Distance
+	}
+	if dest.Country == "" {
+		return 0
+	}
+	home, there := countryByISO(cfg.Home), countryByISO(dest.Country)
+	switch {
+	case home == nil || there == nil:
+		return 0.5
+	case home.iso == there.iso:
+		return 0.25
+	case slices.Contains(neighbors[home.iso], there.iso):
+		return 0.5
+	case countryCallingCode(home)[0] == countryCallingCode(there)[0]:
+		return 0.75
+	}
+	return 1
+}
+
+// newAmbience generates the sound of a call being put through: the local
+// switch clicking, a pause while trunks are found, the far end ringing
+// faintly and picking up. The line hisses and crackles throughout, and
+// longer distances add a narrower channel and someone else's call
+// bleeding through. Every call sounds a little different.
+func newAmbience(distance float64) MediaSource {
+	rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	pause := func(least, spread time.Duration) MediaSource {
+		d := least + time.Duration(rng.Int64N(int64(spread)+1))
+		return newPCMSource(make([]int16, int(d.Seconds()*SAMPLE_RATE)), false)
+	}
+
+	var stages []MediaSource
+	for range 2 + int(distance*4) {
+		stages = append(stages, switchClick(rng), pause(60*time.Millisecond, 200*time.Millisecond))
+	}
+	if distance > 0 {
+		hunt := time.Duration(distance * float64(AMBIENCE_TRUNK_HUNT))
+		stages = append(stages, pause(hunt, hunt/2), switchClick(rng), pause(100*time.Millisecond, 100*time.Millisecond))
+	}
+
+	rings := 1
+	if distance >= 0.75 {
+		rings = 2
+	}
+	ringing := time.Duration(rings-1)*(RINGBACK_ON+RINGBACK_OFF) + RINGBACK_ON
+	ringback := newLimitedSource(newCadenceSource(RINGBACK_ON, RINGBACK_OFF, RINGBACK_FREQ1, RINGBACK_FREQ2), ringing)
+	stages = append(stages,
+		&quietSource{source: ringback, gain: 0.5 - 0.3*distance},
+		pause(200*time.Millisecond, 600*time.Millisecond),
+		switchClick(rng), // Answered
+	)
+
+	effects := []effect{
+		&hiss{level: 0.1 + 0.5*distance, rng: rng},
+		&crackle{level: 0.05 + 0.3*distance, rng: rng},
+	}
+	if distance > 0 {
+		effects = append([]effect{newLongDistance(distance)}, effects...)
+	}
+	if distance >= 0.5 {
+		effects = append(effects, newCrosstalk(distance, rng))
+	}
+	return &effectSource{source: newSequenceSource(stages...), effects: effects, buffer: make([]float64, MAX_FRAME_SIZE)}
+}
+
+// switchClick is a relay pulling in: a sharp snap over a dull thump
+func switchClick(rng *rand.Rand) MediaSource {
+	samples := make([]int16, int(AMBIENCE_CLICK.Seconds()*SAMPLE_RATE))
+	loudness := 0.3 + 0.4*rng.Float64()
+	for i := range samples {
+		t := float64(i) / SAMPLE_RATE
+		snap := (rng.Float64()*2 - 1) * math.Exp(-t*900)
+		thump := math.Sin(2*math.Pi*120*t) * math.Exp(-t*150)
+		samples[i] = clampSample((0.7*snap + 0.5*thump) * loudness * 32767)
+	}
+	return newPCMSource(samples, false)
+}
+
+// quietSource plays a source at a fraction of its level
+type quietSource struct {
+	source MediaSource
+	gain   float64
+}
+
+func (q *quietSource) ReadFrame(samples []int16) bool {
+	if !q.source.ReadFrame(samples) {
+		return false
+	}
+	for i, sample := range samples {
+		samples[i] = int16(float64(sample) * q.gain)
+	}
+	return true
+}
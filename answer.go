@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// MAX_ANSWER_DELAY_MS bounds answer.delay_ms; phones give up on an
+// INVITE that rings much longer
+const MAX_ANSWER_DELAY_MS = 60000
+
+// ringBeforeAnswer holds a call the phone placed until it is time to
+// answer: it sends 180 Ringing if asked, with ringback as early media
+// if asked and the INVITE made an offer to answer, and waits out the
+// delay. It reports false if the phone
+// cancelled meanwhile.
+func (s *SIPServer) ringBeforeAnswer(cfg AnswerConfig, ringback MediaSource, headers map[string]string, d *dialog, offer *sessionDescription, remoteRTPAddr *net.UDPAddr, formats audioFormats) bool {
+	if cfg.Ringing {
+		sdp := ""
+		if cfg.EarlyMedia && offer != nil {
+			sdp = s.answerSDP(offer, formats, SDP_SENDRECV, d)
+		}
+		s.sendProvisional(d, s.inviteResponse(headers, d, "180 Ringing", sdp))
+	}
+
+	if cfg.EarlyMedia && remoteRTPAddr != nil {
+		ringing, stopRinging := context.WithCancel(s.ctx)
+		defer stopRinging()
+		stream := newRTPStream(d.media.conn, remoteRTPAddr, withMasterVolume(func(samples []int16) bool {
+			return ringing.Err() == nil && ringback.ReadFrame(samples)
+		}))
+		stream.useCodec(formats.primary())
+		stream.usePacketTime(formats.packetTime())
+		stream.session = d.media.session
+		if formats.crypto != nil {
+			stream.keys = func() *srtpKeys { return &formats.crypto.srtpKeys }
+		}
+		s.scheduler.Add(stream)
+	}
+
+	delay := time.NewTimer(time.Duration(cfg.DelayMs) * time.Millisecond)
+	defer delay.Stop()
+	select {
+	case <-delay.C:
+		return true
+	case <-d.cancelled:
+		return false
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// sendProvisional sends a response to the phone's INVITE before its
+// answer, keeping it to resend if the INVITE is
+func (s *SIPServer) sendProvisional(d *dialog, response string) {
+	d.mu.Lock()
+	d.answer = response
+	d.mu.Unlock()
+	s.sendResponse(response, d.remoteAddr)
+}
+
+// inviteResponse builds a response to an INVITE other than its 200 OK.
+// Without a dialog (100 Trying) the To header is left without our tag;
+// with one it carries it and our Contact. sdp is an optional body; any
+// extra header lines given are added.
+func (s *SIPServer) inviteResponse(headers map[string]string, d *dialog, status, sdp string, extra ...string) string {
+	var response strings.Builder
+	fmt.Fprintf(&response, "SIP/2.0 %s\r\n", status)
+	fmt.Fprintf(&response, "Via: %s\r\n", headers["Via"])
+	fmt.Fprintf(&response, "From: %s\r\n", headers["From"])
+	if d == nil {
+		fmt.Fprintf(&response, "To: %s\r\n", headers["To"])
+	} else {
+		d.mu.Lock()
+		fmt.Fprintf(&response, "To: %s\r\n", d.from) // Our side, with our tag
+		d.mu.Unlock()
+	}
+	fmt.Fprintf(&response, "Call-ID: %s\r\n", headers["Call-ID"])
+	fmt.Fprintf(&response, "CSeq: %s\r\n", headers["CSeq"])
+	if d != nil {
+		fmt.Fprintf(&response, "Contact: <%s>\r\n", s.contactURI(d.remoteAddr))
+	}
+	for _, header := range extra {
+		response.WriteString(header + "\r\n")
+	}
+	if sdp != "" {
+		fmt.Fprintf(&response, "Content-Type: application/sdp\r\n")
+	}
+	fmt.Fprintf(&response, "Content-Length: %d\r\n\r\n%s", len(sdp), sdp)
+	return response.String()
+}
+
+// refuseInvite sends a final error response to the phone's INVITE and
+// resends it until the phone acknowledges it. The dialog is kept until
+// then, so a retransmitted INVITE gets the same response and not a new
+// call.
+func (s *SIPServer) refuseInvite(d *dialog, response string) {
+	d.mu.Lock()
+	d.answer = response
+	d.acked = false
+	d.mu.Unlock()
+	s.sendResponse(response, d.remoteAddr)
+	d.media.Close() // No call to carry
+
+	s.spawn(func() {
+		defer s.removeDialog(d)
+		interval := INVITE_RETRANSMIT
+		deadline := time.NewTimer(ACK_TIMEOUT)
+		defer deadline.Stop()
+		for {
+			select {
+			case <-time.After(interval):
+			case <-deadline.C:
+				return
+			case <-s.ctx.Done():
+				return
+			}
+
+			d.mu.Lock()
+			acked := d.acked
+			d.mu.Unlock()
+			if acked {
+				return
+			}
+			s.sendResponse(response, d.remoteAddr)
+			interval = min(2*interval, ANSWER_RETRANSMIT_MAX)
+		}
+	})
+}
+
+// handleCancel processes SIP CANCEL requests: the phone hanging up before
+// its call was answered. The CANCEL must match the INVITE it cancels by
+// Via branch and CSeq number; the INVITE is then refused with 487 and
+// the call torn down before it starts. A CANCEL that comes too late
+// changes nothing.
+func (s *SIPServer) handleCancel(message string, remoteAddr *net.UDPAddr) {
+	headers := parseHeaders(message)
+	d := s.findDialog(headers["Call-ID"], "", headerTag(headers["From"]))
+
+	var branch string
+	if via := headerValues(message, "Via"); len(via) > 0 {
+		branch = headerParam(via[0], "branch")
+	}
+	if d != nil {
+		d.mu.Lock()
+		matches := d.branch == branch && d.remoteCSeq == cseqNumber(headers["CSeq"])
+		d.mu.Unlock()
+		if !matches {
+			d = nil
+		}
+	}
+	if d == nil {
+		s.sendResponse(dialogResponse(headers, "481 Call/Transaction Does Not Exist"), remoteAddr)
+		return
+	}
+
+	fmt.Printf("🚫 Handling CANCEL request for Call-ID: %s\n", d.callID)
+	d.mu.Lock()
+	if d.state == dialogRinging {
+		d.state = dialogTerminating
+		close(d.cancelled)
+	}
+	d.mu.Unlock()
+	s.sendResponse(dialogResponse(headers, "200 OK"), remoteAddr)
+}
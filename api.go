@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// API_MAX_BODY caps the size of a request body
+const API_MAX_BODY = 64 * 1024
+
+// apiServer is the HTTP API for changing settings while the server runs.
+// It covers every exchange on every socket, by exchange name.
+type apiServer struct {
+	config  APIConfig
+	servers []*SIPServer
+	server  *http.Server
+}
+
+// startAPI starts serving the API on cfg.Listen
+func startAPI(cfg APIConfig, servers []*SIPServer) (*apiServer, error) {
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for API requests: %v", err)
+	}
+
+	api := &apiServer{config: cfg, servers: servers}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/forwarding", api.listForwarding)
+	mux.HandleFunc("GET /api/forwarding/{exchange}/{user}", api.getForwarding)
+	mux.HandleFunc("PUT /api/forwarding/{exchange}/{user}", api.putForwarding)
+	mux.HandleFunc("DELETE /api/forwarding/{exchange}/{user}", api.deleteForwarding)
+	mux.HandleFunc("GET /api/screening", api.listScreening)
+	mux.HandleFunc("PUT /api/screening/{exchange}/{list}/{pattern}", api.addScreening)
+	mux.HandleFunc("DELETE /api/screening/{exchange}/{list}/{pattern}", api.removeScreening)
+	mux.HandleFunc("GET /api/mailboxes", api.listMailboxes)
+	mux.HandleFunc("PUT /api/mailboxes/{exchange}/{user}", api.putMailbox)
+	mux.HandleFunc("GET /api/calls", api.listCalls)
+	mux.HandleFunc("GET /api/calls/{call_id}", api.getCall)
+	mux.HandleFunc("POST /api/calls/{exchange}/{user}", api.placeCall)
+	api.server = &http.Server{
+		Handler:           api.authenticate(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	fmt.Printf("🛠️  API listening on %s\n", listener.Addr())
+	go func() {
+		if err := api.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("❌ API server stopped: %v", err)
+		}
+	}()
+	return api, nil
+}
+
+// Close stops the API
+func (a *apiServer) Close() {
+	a.server.Close()
+}
+
+// authenticate requires the configured bearer token, if there is one
+func (a *apiServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.config.Token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.config.Token)) != 1 {
+				writeAPIError(w, http.StatusUnauthorized, "missing or wrong token")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// exchanges returns every exchange by name. They are looked up on each
+// request, since reloading the config replaces them.
+func (a *apiServer) exchanges() map[string]*exchange {
+	exchanges := make(map[string]*exchange)
+	for _, server := range a.servers {
+		for _, ex := range server.Exchanges() {
+			exchanges[ex.name] = ex
+		}
+	}
+	return exchanges
+}
+
+// exchange looks up the exchange named in the request path
+func (a *apiServer) exchange(w http.ResponseWriter, r *http.Request) (*exchange, bool) {
+	ex, ok := a.exchanges()[r.PathValue("exchange")]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("no exchange %q", r.PathValue("exchange")))
+	}
+	return ex, ok
+}
+
+// listForwarding returns every exchange's forwarding rules, by user
+func (a *apiServer) listForwarding(w http.ResponseWriter, r *http.Request) {
+	all := make(map[string]map[string]ForwardingConfig)
+	for name, ex := range a.exchanges() {
+		all[name] = ex.forwarding.Snapshot()
+	}
+	writeAPIResponse(w, http.StatusOK, all)
+}
+
+// getForwarding returns one user's forwarding rules
+func (a *apiServer) getForwarding(w http.ResponseWriter, r *http.Request) {
+	if ex, ok := a.exchange(w, r); ok {
+		writeAPIResponse(w, http.StatusOK, ex.forwarding.Get(r.PathValue("user")))
+	}
+}
+
+// putForwarding replaces one user's forwarding rules
+func (a *apiServer) putForwarding(w http.ResponseWriter, r *http.Request) {
+	ex, ok := a.exchange(w, r)
+	if !ok {
+		return
+	}
+
+	var rules ForwardingConfig
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, API_MAX_BODY))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid forwarding rules: %v", err))
+		return
+	}
+	if err := rules.Validate(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, number := range []string{rules.Always, rules.NoAnswer, rules.DND} {
+		if _, resolved := ex.dialPlan.Resolve(number); number != "" && !resolved {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("no destination for %s", number))
+			return
+		}
+	}
+
+	user := r.PathValue("user")
+	ex.forwarding.Set(user, rules)
+	fmt.Printf("↪️  Forwarding for %s on %s set through the API\n", user, ex.name)
+	writeAPIResponse(w, http.StatusOK, rules)
+}
+
+// deleteForwarding removes one user's forwarding rules
+func (a *apiServer) deleteForwarding(w http.ResponseWriter, r *http.Request) {
+	if ex, ok := a.exchange(w, r); ok {
+		user := r.PathValue("user")
+		ex.forwarding.Set(user, ForwardingConfig{})
+		fmt.Printf("↪️  Forwarding for %s on %s cleared through the API\n", user, ex.name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listScreening returns every exchange's screening settings and lists
+func (a *apiServer) listScreening(w http.ResponseWriter, r *http.Request) {
+	all := make(map[string]ScreeningConfig)
+	for name, ex := range a.exchanges() {
+		all[name] = ex.screen.Config()
+	}
+	writeAPIResponse(w, http.StatusOK, all)
+}
+
+// screeningList looks up the exchange and checks the list named in the
+// request path
+func (a *apiServer) screeningList(w http.ResponseWriter, r *http.Request) (*exchange, string, bool) {
+	ex, ok := a.exchange(w, r)
+	if !ok {
+		return nil, "", false
+	}
+	list := r.PathValue("list")
+	if list != "allow" && list != "block" {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("no list %q; use allow or block", list))
+		return nil, "", false
+	}
+	return ex, list, true
+}
+
+// addScreening puts a caller ID pattern on a list
+func (a *apiServer) addScreening(w http.ResponseWriter, r *http.Request) {
+	ex, list, ok := a.screeningList(w, r)
+	if !ok {
+		return
+	}
+	pattern := r.PathValue("pattern")
+	if err := ex.screen.Add(list, pattern); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fmt.Printf("🚫 %s added to the %slist on %s through the API\n", pattern, list, ex.name)
+	writeAPIResponse(w, http.StatusOK, ex.screen.Config())
+}
+
+// removeScreening takes a caller ID pattern off a list
+func (a *apiServer) removeScreening(w http.ResponseWriter, r *http.Request) {
+	ex, list, ok := a.screeningList(w, r)
+	if !ok {
+		return
+	}
+	pattern := r.PathValue("pattern")
+	if !ex.screen.Remove(list, pattern) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("%s is not on the %slist", pattern, list))
+		return
+	}
+	fmt.Printf("🚫 %s removed from the %slist on %s through the API\n", pattern, list, ex.name)
+	writeAPIResponse(w, http.StatusOK, ex.screen.Config())
+}
+
+// listMailboxes returns every exchange's mailboxes that hold messages, by
+// user
+func (a *apiServer) listMailboxes(w http.ResponseWriter, r *http.Request) {
+	all := make(map[string]map[string]Mailbox)
+	for name, ex := range a.exchanges() {
+		all[name] = ex.mailboxes.Snapshot()
+	}
+	writeAPIResponse(w, http.StatusOK, all)
+}
+
+// putMailbox sets how many messages a user has waiting and tells the
+// phones watching the mailbox
+func (a *apiServer) putMailbox(w http.ResponseWriter, r *http.Request) {
+	ex, ok := a.exchange(w, r)
+	if !ok {
+		return
+	}
+
+	var box Mailbox
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, API_MAX_BODY))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&box); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid mailbox: %v", err))
+		return
+	}
+	if box.New < 0 || box.Old < 0 {
+		writeAPIError(w, http.StatusBadRequest, "message counts can't be negative")
+		return
+	}
+
+	user := r.PathValue("user")
+	if err := ex.mailboxes.Set(user, box); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	fmt.Printf("📬 Mailbox of %s on %s set to %d new, %d old through the API\n", user, ex.name, box.New, box.Old)
+	for _, server := range a.servers {
+		server.notifyMailbox(ex, user)
+	}
+	writeAPIResponse(w, http.StatusOK, box)
+}
+
+// listCalls describes every call in progress and how its audio is faring
+func (a *apiServer) listCalls(w http.ResponseWriter, r *http.Request) {
+	all := []CallStats{}
+	for _, server := range a.servers {
+		all = append(all, server.CallStats()...)
+	}
+	writeAPIResponse(w, http.StatusOK, all)
+}
+
+// getCall describes one call in progress, by Call-ID
+func (a *apiServer) getCall(w http.ResponseWriter, r *http.Request) {
+	callID := r.PathValue("call_id")
+	for _, server := range a.servers {
+		for _, call := range server.CallStats() {
+			if call.CallID == callID {
+				writeAPIResponse(w, http.StatusOK, call)
+				return
+			}
+		}
+	}
+	writeAPIError(w, http.StatusNotFound, fmt.Sprintf("no call %q", callID))
+}
+
+// CallRequest asks for a phone to be rung and connected to a destination
+// once answered
+type CallRequest struct {
+	Destination string `json:"destination"`
+	RingSeconds int    `json:"ring_seconds,omitempty"` // How long to ring; 30 if 0
+}
+
+// placeCall rings a user's phone and connects it to the destination in
+// the JSON body when it is picked up. It answers as soon as the phone is
+// ringing.
+func (a *apiServer) placeCall(w http.ResponseWriter, r *http.Request) {
+	ex, ok := a.exchange(w, r)
+	if !ok {
+		return
+	}
+
+	var call CallRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, API_MAX_BODY))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&call); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid call: %v", err))
+		return
+	}
+	if call.Destination == "" || call.RingSeconds < 0 {
+		writeAPIError(w, http.StatusBadRequest, "a destination is required, and ring_seconds can't be negative")
+		return
+	}
+
+	user := r.PathValue("user")
+	for _, server := range a.servers {
+		if !slices.Contains(server.Exchanges(), ex) {
+			continue
+		}
+		if err := server.RingPhone(ex, user, call.Destination, time.Duration(call.RingSeconds)*time.Second); err != nil {
+			writeAPIError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeAPIResponse(w, http.StatusAccepted, call)
+		return
+	}
+	writeAPIError(w, http.StatusNotFound, fmt.Sprintf("no exchange %q", ex.name))
+}
+
+// writeAPIResponse sends value as JSON
+func writeAPIResponse(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeAPIError sends an error as {"error": message}
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIResponse(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// AUDIOBOOK_SKIP is how far 4 and 6 jump back and forward
+	AUDIOBOOK_SKIP = 30 * time.Second
+
+	// AUDIOBOOK_RESTART_THRESHOLD: * within this long of a chapter's start
+	// goes to the previous chapter; later, it restarts the current one
+	AUDIOBOOK_RESTART_THRESHOLD = 5 * time.Second
+
+	// Feedback beeps for speed and sleep timer changes
+	AUDIOBOOK_BEEP_FREQ = 1000.0 // Hz
+	AUDIOBOOK_OFF_FREQ  = 400.0  // Hz, for "off"
+	AUDIOBOOK_BEEP      = 120 * time.Millisecond
+)
+
+var (
+	// AUDIOBOOK_SPEEDS are the speeds 7 and 9 step through
+	AUDIOBOOK_SPEEDS = []float64{0.75, 1, 1.25, 1.5, 2}
+
+	// AUDIOBOOK_SLEEP_TIMERS are the settings 0 cycles through
+	AUDIOBOOK_SLEEP_TIMERS = []time.Duration{0, 15 * time.Minute, 30 * time.Minute, 60 * time.Minute}
+)
+
+// bookChapter is one chapter of an audiobook: a file, or the stretch of one
+// between two cue points
+type bookChapter struct {
+	path  string
+	title string
+	start int // In samples at 8kHz
+	end   int // 0 for the end of the file
+}
+
+// scanAudiobook finds the chapters of the book in dir. Files are read in
+// track number order, then by name; a file with cue points is split into a
+// chapter at each one.
+func scanAudiobook(dir string) ([]bookChapter, error) {
+	type bookFile struct {
+		path string
+		tags wavTags
+	}
+	var files []bookFile
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(path), ".wav") {
+			return nil
+		}
+		tags, err := readWAVTags(path)
+		if err != nil {
+			log.Printf("⚠️  Skipping %s: %v", path, err)
+			return nil
+		}
+		files = append(files, bookFile{path, tags})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan audiobook: %v", err)
+	}
+	slices.SortFunc(files, func(a, b bookFile) int {
+		return cmp.Or(cmp.Compare(a.tags.Track, b.tags.Track), strings.Compare(a.path, b.path))
+	})
+
+	var chapters []bookChapter
+	for _, file := range files {
+		title := file.tags.Title
+		if title == "" {
+			title = strings.TrimSuffix(filepath.Base(file.path), filepath.Ext(file.path))
+		}
+
+		cues := file.tags.Cues
+		if len(cues) == 0 || cues[0].Offset > 0 {
+			cues = append([]wavCue{{Offset: 0}}, cues...) // Audio before the first cue
+		}
+		for i, cue := range cues {
+			chapter := bookChapter{path: file.path, title: title, start: cue.Offset}
+			if i+1 < len(cues) {
+				chapter.end = cues[i+1].Offset
+				if chapter.end == chapter.start {
+					continue
+				}
+			}
+			if cue.Label != "" {
+				chapter.title = cue.Label
+			} else if len(cues) > 1 {
+				chapter.title = fmt.Sprintf("%s (%d/%d)", title, i+1, len(cues))
+			}
+			chapters = append(chapters, chapter)
+		}
+	}
+	return chapters, nil
+}
+
+// newBeeps plays count short beeps at freq
+func newBeeps(count int, freq float64) MediaSource {
+	return newLimitedSource(newCadenceSource(AUDIOBOOK_BEEP, AUDIOBOOK_BEEP, freq), time.Duration(count)*2*AUDIOBOOK_BEEP)
+}
+
+// runAudiobook reads an audiobook to the caller, chapter after chapter.
+// While it plays: # and * move between chapters, 4 and 6 skip back and
+// forward, 5 pauses, 7 and 9 slow down and speed up (8 goes back to normal)
+// and 0 sets a sleep timer that hangs up when it runs out. On a rotary
+// installation 1 and 3 move between chapters instead.
+func (s *SIPServer) runAudiobook(session *CallSession, name string, dest DestinationConfig) {
+	chapters, err := scanAudiobook(session.exchange.config.ResolvePath(dest.Directory))
+	if err == nil && len(chapters) == 0 {
+		err = fmt.Errorf("no WAV files in %s", dest.Directory)
+	}
+	if err != nil {
+		log.Printf("❌ Audiobook %q: %v", name, err)
+		s.playTone(session.ctx, session, session.progressTone(progressReorder))
+		return
+	}
+	fmt.Printf("📖 Audiobook %q: %d chapters\n", name, len(chapters))
+
+	digits, release := session.captureDigits()
+	defer release()
+
+	playing, stop := context.WithCancel(session.ctx)
+	defer stop()
+	player := newPlayerSource()
+	stream := s.newCallStream(session, func(samples []int16) bool {
+		return playing.Err() == nil && player.ReadFrame(samples)
+	})
+	stream.markTalkspurts(player)
+	s.scheduler.Add(stream)
+
+	// Consecutive chapters often share a file; keep the last one decoded
+	var loadedPath string
+	var loaded []int16
+
+	chapter := 0
+	speedIndex := slices.Index(AUDIOBOOK_SPEEDS, 1)
+	var text SeekableSource
+	var stretched *speedSource
+	open := func() {
+		ch := chapters[chapter]
+		if ch.path != loadedPath {
+			samples, err := loadWAV(ch.path)
+			if err != nil {
+				log.Printf("⚠️  Audiobook %q: %v", name, err)
+			}
+			loadedPath, loaded = ch.path, samples
+		}
+		start, end := min(ch.start, len(loaded)), len(loaded)
+		if ch.end > 0 {
+			end = max(start, min(ch.end, end))
+		}
+
+		fmt.Printf("📖 Chapter %d/%d: %s\n", chapter+1, len(chapters), ch.title)
+		text = newPCMSource(loaded[start:end], false)
+		stretched = newSpeedSource(text, AUDIOBOOK_SPEEDS[speedIndex])
+		player.Play(stretched)
+	}
+	open()
+
+	paused := false
+	sleepIndex := 0
+	var sleep <-chan time.Time
+	var sleepTimer *time.Timer
+	defer func() {
+		if sleepTimer != nil {
+			sleepTimer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-player.Ended():
+			if chapter+1 == len(chapters) {
+				fmt.Printf("🏁 Audiobook %q read to the end\n", name)
+				return
+			}
+			chapter++
+			open()
+
+		case digit := <-digits:
+			if session.exchange.config.rotary() {
+				// Without * and #, 1 and 3 move between chapters
+				switch digit {
+				case "1":
+					digit = "*"
+				case "3":
+					digit = "#"
+				}
+			}
+			switch digit {
+			case "#":
+				if chapter+1 < len(chapters) {
+					chapter++
+				}
+				open()
+			case "*":
+				var position time.Duration
+				player.Do(func() { position = text.Position() })
+				if position < AUDIOBOOK_RESTART_THRESHOLD && chapter > 0 {
+					chapter--
+				}
+				open()
+			case "4", "6":
+				skip := AUDIOBOOK_SKIP
+				if digit == "4" {
+					skip = -skip
+				}
+				player.Do(func() {
+					text.Seek(text.Position() + skip)
+					stretched.Reset()
+				})
+			case "5":
+				paused = !paused
+				player.Pause(paused)
+				if paused {
+					fmt.Printf("⏸️  Audiobook %q paused\n", name)
+				}
+			case "7", "8", "9":
+				switch digit {
+				case "7":
+					speedIndex = max(speedIndex-1, 0)
+				case "8":
+					speedIndex = slices.Index(AUDIOBOOK_SPEEDS, 1)
+				case "9":
+					speedIndex = min(speedIndex+1, len(AUDIOBOOK_SPEEDS)-1)
+				}
+				speed := AUDIOBOOK_SPEEDS[speedIndex]
+				player.Do(func() { stretched.SetSpeed(speed) })
+				player.Interrupt(newBeeps(speedIndex+1, AUDIOBOOK_BEEP_FREQ))
+				fmt.Printf("⏩ Audiobook %q at %gx\n", name, speed)
+			case "0":
+				sleepIndex = (sleepIndex + 1) % len(AUDIOBOOK_SLEEP_TIMERS)
+				if sleepTimer != nil {
+					sleepTimer.Stop()
+					sleep = nil
+				}
+				if d := AUDIOBOOK_SLEEP_TIMERS[sleepIndex]; d > 0 {
+					sleepTimer = time.NewTimer(d)
+					sleep = sleepTimer.C
+					player.Interrupt(newBeeps(sleepIndex, AUDIOBOOK_BEEP_FREQ))
+					fmt.Printf("😴 Audiobook %q will hang up in %s\n", name, d)
+				} else {
+					player.Interrupt(newBeeps(1, AUDIOBOOK_OFF_FREQ))
+					fmt.Printf("😴 Audiobook %q sleep timer off\n", name)
+				}
+			}
+
+		case <-sleep:
+			fmt.Printf("😴 Sleep timer ran out; hanging up %s\n", session.CallID)
+			s.hangupCall(session)
+			return
+
+		case <-stream.Done():
+			return
+		case <-session.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_AUTH_REALM is the digest realm of an exchange with no domain
+	DEFAULT_AUTH_REALM = "travel-by-telephone"
+
+	// NONCE_LIFETIME is how long a challenge can be answered. A phone
+	// answering an older one is told it is stale and retries at once
+	// without asking the user.
+	NONCE_LIFETIME = 5 * time.Minute
+
+	// MAX_AUTH_FAILURES wrong answers from one address within
+	// AUTH_LOCKOUT lock it out for AUTH_LOCKOUT: every answer from it,
+	// right or wrong, is refused with 403 until then
+	MAX_AUTH_FAILURES = 5
+	AUTH_LOCKOUT      = 5 * time.Minute
+
+	MAX_TRACKED_NONCES = 4096 // Challenges outstanding at once
+)
+
+// authResult is what checking a REGISTER's credentials found
+type authResult int
+
+const (
+	authMissing   authResult = iota // No credentials, or none for this realm: challenge
+	authOK                          // Credentials are right
+	authStale                       // For a challenge we didn't hand this address, or an expired or used one: challenge again with stale=true
+	authFailed                      // Wrong: challenge again
+	authLockedOut                   // Too many wrong answers from this address lately: refuse
+)
+
+// digestNonce is a challenge handed out to an address, with the highest
+// nonce count used with it so replayed answers are refused
+type digestNonce struct {
+	ip     string
+	issued time.Time
+	count  uint64
+}
+
+// authFailures counts the wrong answers from one address
+type authFailures struct {
+	count  int
+	first  time.Time
+	locked time.Time // When the address was locked out, if it is
+}
+
+// digestAuth checks REGISTERs and SUBSCRIBEs against the registrar's users with HTTP
+// digest authentication (RFC 2617 and RFC 8760): MD5, and SHA-256 when
+// enabled
+type digestAuth struct {
+	realm  string
+	users  map[string]string // Passwords, by user
+	sha256 bool
+
+	mu       sync.Mutex
+	nonces   map[string]*digestNonce
+	failures map[string]*authFailures // By IP
+}
+
+// newDigestAuth creates the authenticator for an exchange, or returns nil
+// if its registrar has no users and anyone may register
+func newDigestAuth(cfg RegistrarConfig, domain string) *digestAuth {
+	if len(cfg.Users) == 0 {
+		return nil
+	}
+	realm := cfg.Realm
+	if realm == "" {
+		realm = domain
+	}
+	if realm == "" {
+		realm = DEFAULT_AUTH_REALM
+	}
+	return &digestAuth{
+		realm:    realm,
+		users:    cfg.Users,
+		sha256:   cfg.SHA256,
+		nonces:   make(map[string]*digestNonce),
+		failures: make(map[string]*authFailures),
+	}
+}
+
+// Challenges returns the WWW-Authenticate header lines for a 401 to addr,
+// strongest algorithm first, each with a fresh nonce
+func (a *digestAuth) Challenges(addr *net.UDPAddr, stale bool) []string {
+	algorithms := []string{"MD5"}
+	if a.sha256 {
+		algorithms = []string{"SHA-256", "MD5"}
+	}
+
+	var challenges []string
+	for _, algorithm := range algorithms {
+		challenge := fmt.Sprintf(`WWW-Authenticate: Digest realm="%s", nonce="%s", algorithm=%s, qop="auth"`, a.realm, a.newNonce(addr.IP.String()), algorithm)
+		if stale {
+			challenge += ", stale=true"
+		}
+		challenges = append(challenges, challenge)
+	}
+	return challenges
+}
+
+// newNonce hands out a challenge to ip, forgetting expired ones
+func (a *digestAuth) newNonce(ip string) string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	nonce := hex.EncodeToString(raw)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if len(a.nonces) >= MAX_TRACKED_NONCES {
+		for n, state := range a.nonces {
+			if now.Sub(state.issued) > NONCE_LIFETIME || len(a.nonces) >= MAX_TRACKED_NONCES {
+				delete(a.nonces, n)
+			}
+		}
+	}
+	a.nonces[nonce] = &digestNonce{ip: ip, issued: now}
+	return nonce
+}
+
+// Check verifies the Authorization header of a REGISTER or SUBSCRIBE for
+// user, sent from addr. An address that is locked out is refused whatever
+// it answers, so guessing passwords from it goes no faster for getting
+// one right. The nonce is checked before the password, so an answer to a
+// challenge we didn't hand out says nothing about whether it was right.
+func (a *digestAuth) Check(method, authorization, user string, addr *net.UDPAddr) authResult {
+	params, ok := parseDigestParams(authorization)
+	if !ok || params["realm"] != a.realm {
+		return authMissing
+	}
+
+	ip := addr.IP.String()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lockedOut(ip) {
+		return authLockedOut
+	}
+
+	state, issued := a.nonces[params["nonce"]]
+	if !issued || state.ip != ip || time.Since(state.issued) > NONCE_LIFETIME {
+		return authStale
+	}
+	var count uint64
+	if params["qop"] != "" {
+		var err error
+		count, err = strconv.ParseUint(params["nc"], 16, 64)
+		if err != nil || count <= state.count {
+			return authStale // Replayed, or out of order
+		}
+	}
+
+	password, known := a.users[params["username"]]
+	if !known || params["username"] != user || !a.verify(method, password, params) {
+		delete(a.nonces, params["nonce"]) // One guess per challenge
+		return a.fail(ip)
+	}
+	state.count = count
+	delete(a.failures, ip)
+	return authOK
+}
+
+// verify checks the response in an Authorization header against password
+func (a *digestAuth) verify(method, password string, params map[string]string) bool {
+	var h func() hash.Hash
+	switch strings.ToUpper(params["algorithm"]) {
+	case "", "MD5":
+		h = md5.New
+	case "SHA-256":
+		if !a.sha256 {
+			return false
+		}
+		h = sha256.New
+	default:
+		return false
+	}
+	digest := func(parts ...string) string {
+		sum := h()
+		sum.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	ha1 := digest(params["username"], a.realm, password)
+	ha2 := digest(method, params["uri"])
+	var want string
+	switch params["qop"] {
+	case "":
+		want = digest(ha1, params["nonce"], ha2)
+	case "auth":
+		want = digest(ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2)
+	default:
+		return false
+	}
+	return strings.EqualFold(want, params["response"])
+}
+
+// lockedOut reports whether ip is locked out, forgetting its wrong answers
+// once they are old enough. Must be called with mu held.
+func (a *digestAuth) lockedOut(ip string) bool {
+	failures := a.failures[ip]
+	if failures == nil {
+		return false
+	}
+	if !failures.locked.IsZero() {
+		if time.Since(failures.locked) <= AUTH_LOCKOUT {
+			return true
+		}
+		delete(a.failures, ip)
+	} else if time.Since(failures.first) > AUTH_LOCKOUT {
+		delete(a.failures, ip)
+	}
+	return false
+}
+
+// fail counts a wrong answer from ip, locking it out if it has given too
+// many lately. Must be called with mu held.
+func (a *digestAuth) fail(ip string) authResult {
+	failures := a.failures[ip]
+	if failures == nil {
+		a.makeRoom()
+		failures = &authFailures{first: time.Now()}
+		a.failures[ip] = failures
+	}
+	failures.count++
+	if failures.count >= MAX_AUTH_FAILURES {
+		failures.locked = time.Now()
+		return authLockedOut
+	}
+	return authFailed
+}
+
+// makeRoom forgets the address whose wrong answers are oldest if the table
+// is full, so answers from many addresses can't grow it without bound or
+// wipe out the counts of the rest. Must be called with mu held.
+func (a *digestAuth) makeRoom() {
+	if len(a.failures) < MAX_TRACKED_SOURCES {
+		return
+	}
+	var oldestIP string
+	var oldest time.Time
+	for ip, failures := range a.failures {
+		seen := failures.first
+		if !failures.locked.IsZero() {
+			seen = failures.locked
+		}
+		if oldestIP == "" || seen.Before(oldest) {
+			oldestIP, oldest = ip, seen
+		}
+	}
+	delete(a.failures, oldestIP)
+}
+
+// authorize checks the credentials of a request from user on an exchange
+// that has users, challenging or refusing it if they aren't right. It
+// reports whether the request may go ahead.
+func (s *SIPServer) authorize(ex *exchange, method string, headers map[string]string, user string, remoteAddr *net.UDPAddr) bool {
+	switch ex.auth.Check(method, headers["Authorization"], user, remoteAddr) {
+	case authOK:
+		return true
+	case authLockedOut:
+		log.Printf("🚫 Refusing %s for %s from %s: too many wrong passwords from there", method, user, remoteAddr)
+		s.sendResponse(registerResponse(headers, "403 Forbidden"), remoteAddr)
+	case authFailed:
+		log.Printf("🔐 Wrong password for %s from %s", user, remoteAddr)
+		s.sendResponse(registerResponse(headers, "401 Unauthorized", ex.auth.Challenges(remoteAddr, false)...), remoteAddr)
+	case authStale:
+		s.sendResponse(registerResponse(headers, "401 Unauthorized", ex.auth.Challenges(remoteAddr, true)...), remoteAddr)
+	default:
+		fmt.Printf("🔐 Challenging %s for %s\n", method, user)
+		s.sendResponse(registerResponse(headers, "401 Unauthorized", ex.auth.Challenges(remoteAddr, false)...), remoteAddr)
+	}
+	return false
+}
+
+// parseDigestParams splits a Digest Authorization header into its
+// parameters, unquoting values
+func parseDigestParams(header string) (map[string]string, bool) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			end := strings.IndexByte(value[1:], '"')
+			if end < 0 {
+				return nil, false
+			}
+			params[key] = value[1 : end+1]
+			value = value[end+2:]
+		} else {
+			v, _, _ := strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(v)
+			value = value[len(v):]
+		}
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(value), ","))
+	}
+	return params, params["username"] != "" && params["nonce"] != "" && params["response"] != ""
+}
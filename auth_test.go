@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// answer has ua answer a fresh challenge from auth, handed to addr, for a
+// REGISTER
+func answer(auth *digestAuth, ua *testUA, addr *net.UDPAddr) string {
+	challenge := strings.TrimPrefix(auth.Challenges(addr, false)[0], "WWW-Authenticate: ")
+	return ua.digestResponse("REGISTER", challenge)
+}
+
+func TestAuthLockout(t *testing.T) {
+	auth := newDigestAuth(RegistrarConfig{Users: map[string]string{"1001": "right", "1002": "other"}}, "")
+	attacker := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 66), Port: 5060}
+	phone := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 5060}
+	server := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 5060}
+	guesser := &testUA{server: server, user: "1001", password: "wrong"}
+	ua := &testUA{server: server, user: "1001", password: "right"}
+
+	// Wrong answers lock the address out, whichever users they are for
+	for i := 1; i <= MAX_AUTH_FAILURES+2; i++ {
+		want := authFailed
+		if i >= MAX_AUTH_FAILURES {
+			want = authLockedOut
+		}
+		guesser.user = fmt.Sprintf("%d", 1000+i)
+		if got := auth.Check("REGISTER", answer(auth, guesser, attacker), guesser.user, attacker); got != want {
+			t.Fatalf("wrong answer %d: %v, want %v", i, got, want)
+		}
+	}
+
+	// and the right answer is refused from there too
+	if got := auth.Check("REGISTER", answer(auth, ua, attacker), "1001", attacker); got != authLockedOut {
+		t.Errorf("right answer during lockout: %v, want %v", got, authLockedOut)
+	}
+
+	// The phone's own address isn't locked out
+	if got := auth.Check("REGISTER", answer(auth, ua, phone), "1001", phone); got != authOK {
+		t.Errorf("right answer from another address: %v, want %v", got, authOK)
+	}
+}
+
+func TestAuthNonceCheckedFirst(t *testing.T) {
+	auth := newDigestAuth(RegistrarConfig{Users: map[string]string{"1001": "right"}}, "")
+	phone := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 5060}
+	other := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 66), Port: 5060}
+	server := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 5060}
+	right := &testUA{server: server, user: "1001", password: "right"}
+	wrong := &testUA{server: server, user: "1001", password: "wrong"}
+
+	// A made-up nonce, or one handed to another address, gets the same
+	// answer whether the password is right or not
+	madeUp := `Digest realm="` + auth.realm + `", nonce="0123456789abcdef", algorithm=MD5, qop="auth"`
+	for _, ua := range []*testUA{right, wrong} {
+		if got := auth.Check("REGISTER", ua.digestResponse("REGISTER", madeUp), "1001", phone); got != authStale {
+			t.Errorf("made-up nonce, password %q: %v, want %v", ua.password, got, authStale)
+		}
+		if got := auth.Check("REGISTER", answer(auth, ua, other), "1001", phone); got != authStale {
+			t.Errorf("another address's nonce, password %q: %v, want %v", ua.password, got, authStale)
+		}
+	}
+
+	// A nonce is spent by a wrong answer, and a replayed right one is stale
+	authorization := answer(auth, right, phone)
+	if got := auth.Check("REGISTER", authorization, "1001", phone); got != authOK {
+		t.Fatalf("right answer: %v, want %v", got, authOK)
+	}
+	if got := auth.Check("REGISTER", authorization, "1001", phone); got != authStale {
+		t.Errorf("replayed answer: %v, want %v", got, authStale)
+	}
+	authorization = answer(auth, wrong, phone)
+	if got := auth.Check("REGISTER", authorization, "1001", phone); got != authFailed {
+		t.Errorf("wrong answer: %v, want %v", got, authFailed)
+	}
+	if got := auth.Check("REGISTER", authorization, "1001", phone); got != authStale {
+		t.Errorf("wrong answer again with the same nonce: %v, want %v", got, authStale)
+	}
+}
+
+func TestAuthFailuresEvictOldest(t *testing.T) {
+	auth := newDigestAuth(RegistrarConfig{Users: map[string]string{"1001": "right"}}, "")
+	for i := 0; i < MAX_TRACKED_SOURCES; i++ {
+		auth.mu.Lock()
+		auth.fail(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		auth.mu.Unlock()
+	}
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	auth.fail("192.168.1.66")
+	if len(auth.failures) != MAX_TRACKED_SOURCES {
+		t.Errorf("tracking %d addresses, want %d", len(auth.failures), MAX_TRACKED_SOURCES)
+	}
+	if auth.failures["192.168.1.66"] == nil {
+		t.Error("newest address not tracked")
+	}
+}
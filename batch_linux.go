@@ -0,0 +1,166 @@
+//go:build !386
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr mirrors struct mmsghdr from <sys/socket.h>
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// mmsgSender sends batches with sendmmsg(2). The raw socket, its address
+// family and the message arrays are set up once and reused for every batch,
+// so steady-state sends don't allocate.
+type mmsgSender struct {
+	conn   *net.UDPConn
+	raw    syscall.RawConn
+	family int
+
+	names  []syscall.RawSockaddrInet6 // Large enough for either family
+	iovecs []syscall.Iovec
+	msgs   []mmsghdr
+
+	// State for the in-flight batch, read by the bound write callback
+	packets  []outgoingPacket
+	sent     int
+	firstErr error
+	writeFn  func(fd uintptr) bool
+}
+
+// newBatchSender creates a sendmmsg-based sender for conn
+func newBatchSender(conn *net.UDPConn) batchSender {
+	sender := &mmsgSender{conn: conn, family: syscall.AF_INET6}
+	sender.writeFn = sender.write
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return sender // Send falls back to WriteToUDP
+	}
+	sender.raw = raw
+
+	// Destination addresses must match the socket's family; sockets bound
+	// to all interfaces are dual-stack IPv6 and need v4-mapped addresses
+	raw.Control(func(fd uintptr) {
+		if sa, err := syscall.Getsockname(int(fd)); err == nil {
+			if _, ok := sa.(*syscall.SockaddrInet4); ok {
+				sender.family = syscall.AF_INET
+			}
+		}
+	})
+
+	return sender
+}
+
+// Send transmits packets using as few sendmmsg calls as possible. A packet
+// that fails is skipped so one unreachable peer doesn't stall the rest of
+// the batch; the first error is returned.
+func (m *mmsgSender) Send(packets []outgoingPacket) error {
+	if m.raw == nil {
+		var firstErr error
+		for _, packet := range packets {
+			if _, err := m.conn.WriteToUDP(packet.data, packet.addr); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	if cap(m.msgs) < len(packets) {
+		m.names = make([]syscall.RawSockaddrInet6, len(packets))
+		m.iovecs = make([]syscall.Iovec, len(packets))
+		m.msgs = make([]mmsghdr, len(packets))
+	}
+	names := m.names[:len(packets)]
+	iovecs := m.iovecs[:len(packets)]
+	msgs := m.msgs[:len(packets)]
+
+	for i, packet := range packets {
+		namelen, err := putSockaddr(&names[i], packet.addr, m.family)
+		if err != nil {
+			return err
+		}
+		iovecs[i].Base = &packet.data[0]
+		iovecs[i].SetLen(len(packet.data))
+		msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		msgs[i].hdr.Namelen = namelen
+		msgs[i].hdr.Iov = &iovecs[i]
+		msgs[i].hdr.Iovlen = 1
+	}
+
+	m.packets = packets
+	m.sent = 0
+	m.firstErr = nil
+	err := m.raw.Write(m.writeFn)
+	runtime.KeepAlive(packets)
+
+	// Drop references to packet buffers until the next batch
+	clear(iovecs)
+	m.packets = nil
+
+	if err != nil {
+		return err
+	}
+	return m.firstErr
+}
+
+// write is the raw.Write callback; it returns false to wait for the socket
+// to become writable again
+func (m *mmsgSender) write(fd uintptr) bool {
+	msgs := m.msgs[:len(m.packets)]
+	for m.sent < len(msgs) {
+		n, _, errno := syscall.Syscall6(sysSendmmsg, fd,
+			uintptr(unsafe.Pointer(&msgs[m.sent])), uintptr(len(msgs)-m.sent), 0, 0, 0)
+		switch errno {
+		case 0:
+			m.sent += int(n)
+		case syscall.EAGAIN:
+			return false
+		case syscall.EINTR:
+			continue
+		default:
+			// sendmmsg only fails when the first message fails
+			if m.firstErr == nil {
+				m.firstErr = fmt.Errorf("sendmmsg to %s: %v", m.packets[m.sent].addr, errno)
+			}
+			m.sent++
+		}
+	}
+	return true
+}
+
+// putSockaddr encodes addr as a raw sockaddr of the given family
+func putSockaddr(sa *syscall.RawSockaddrInet6, addr *net.UDPAddr, family int) (uint32, error) {
+	// The port sits at the same offset in both layouts, in network order
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	port[0] = byte(addr.Port >> 8)
+	port[1] = byte(addr.Port)
+
+	if family == syscall.AF_INET {
+		ip4 := addr.IP.To4()
+		if ip4 == nil {
+			return 0, fmt.Errorf("cannot send to %s from an IPv4 socket", addr)
+		}
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		sa4.Family = syscall.AF_INET
+		copy(sa4.Addr[:], ip4)
+		return syscall.SizeofSockaddrInet4, nil
+	}
+
+	sa.Family = syscall.AF_INET6
+	copy(sa.Addr[:], addr.IP.To16())
+	sa.Scope_id = 0
+	if addr.Zone != "" {
+		if iface, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.Scope_id = uint32(iface.Index)
+		}
+	}
+	return syscall.SizeofSockaddrInet6, nil
+}
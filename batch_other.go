@@ -0,0 +1,26 @@
+//go:build !linux || 386
+
+package main
+
+import "net"
+
+// loopSender sends packets one at a time on platforms without sendmmsg(2)
+type loopSender struct {
+	conn *net.UDPConn
+}
+
+// newBatchSender creates a sender that writes packets individually
+func newBatchSender(conn *net.UDPConn) batchSender {
+	return &loopSender{conn: conn}
+}
+
+// Send writes each packet in turn, returning the first error
+func (l *loopSender) Send(packets []outgoingPacket) error {
+	var firstErr error
+	for _, packet := range packets {
+		if _, err := l.conn.WriteToUDP(packet.data, packet.addr); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,23 @@
+//go:build darwin
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindToInterface has a socket send and receive only on the given
+// interface, so a broadcast service like DHCP stays off every other
+// network the machine is on
+func bindToInterface(iface *net.Interface) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, iface.Index)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
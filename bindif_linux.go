@@ -0,0 +1,23 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindToInterface has a socket send and receive only on the named
+// interface, so a broadcast service like DHCP stays off every other
+// network the machine is on
+func bindToInterface(iface *net.Interface) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = syscall.BindToDevice(int(fd), iface.Name)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
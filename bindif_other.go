@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// bindToInterface is not supported on this platform. Without it DHCP
+// would answer on every network the machine is on, so it refuses.
+func bindToInterface(iface *net.Interface) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return fmt.Errorf("binding to an interface is not supported on this platform")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+const (
+	// BLUEBOX_SEIZE_FREQ is the supervisory tone of an idle in-band trunk.
+	// Sent down a trunk in use, it makes the far end think the call is
+	// over and free the trunk for new routing instructions.
+	BLUEBOX_SEIZE_FREQ = 2600.0 // Hz
+
+	// BLUEBOX_SEIZE is how long 2600 Hz must sound to seize the trunk; the
+	// trunk winks back once it stops
+	BLUEBOX_SEIZE = 500 * time.Millisecond
+
+	// BLUEBOX_WINK is the far end's 2600 Hz reply, heard as a "kerchunk"
+	BLUEBOX_WINK = 150 * time.Millisecond
+
+	// BLUEBOX_MF_MIN is how long an MF tone must last to count; the real
+	// thing sends 60ms tones (100ms for KP)
+	BLUEBOX_MF_MIN = 30 * time.Millisecond
+
+	// BLUEBOX_MF_TIMEOUT is how long a seized trunk waits for KP ... ST
+	// before giving up and going back to the caller
+	BLUEBOX_MF_TIMEOUT = 20 * time.Second
+)
+
+// mfFrequencies are the tones MF signalling pairs up; mfSignals names each
+// pair, in the order of mfFrequencies
+var (
+	mfFrequencies = []float64{700, 900, 1100, 1300, 1500, 1700}
+	mfSignals     = map[[2]float64]string{
+		{700, 900}: "1", {700, 1100}: "2", {900, 1100}: "3",
+		{700, 1300}: "4", {900, 1300}: "5", {1100, 1300}: "6",
+		{700, 1500}: "7", {900, 1500}: "8", {1100, 1500}: "9",
+		{1300, 1500}: "0", {1100, 1700}: "KP", {1500, 1700}: "ST",
+	}
+)
+
+// mfSignal names the MF signal in a block, if there is one: the two
+// strongest MF frequencies, when together they are most of the block
+func mfSignal(block []float64) string {
+	if blockLevel(block) < TONE_MIN_LEVEL {
+		return ""
+	}
+	shares := make([]float64, len(mfFrequencies))
+	for i, freq := range mfFrequencies {
+		shares[i] = toneShare(block, freq)
+	}
+	strongest, next := 0, 1
+	if shares[next] > shares[strongest] {
+		strongest, next = next, strongest
+	}
+	for i := 2; i < len(shares); i++ {
+		if shares[i] > shares[strongest] {
+			strongest, next = i, strongest
+		} else if shares[i] > shares[next] {
+			next = i
+		}
+	}
+	if shares[next] < TONE_MIN_SHARE {
+		return ""
+	}
+	low, high := min(strongest, next), max(strongest, next)
+	return mfSignals[[2]float64{mfFrequencies[low], mfFrequencies[high]}]
+}
+
+// blueBoxDetector listens to a trunk call for a blue box: a sustained 2600
+// Hz tone, reported as "2600" once it stops, then MF signals ("KP", digits
+// and "ST"), each reported once
+type blueBoxDetector struct {
+	events  chan string
+	seize   int    // Blocks of 2600 Hz so far
+	signal  string // MF signal in the last block
+	held    int    // Blocks it has lasted
+	emitted bool   // Reported already
+}
+
+// newBlueBoxDetector creates a detector with room for a burst of signals
+func newBlueBoxDetector() *blueBoxDetector {
+	return &blueBoxDetector{events: make(chan string, 32)}
+}
+
+// Block looks at the next block of received audio
+func (b *blueBoxDetector) Block(block []float64) {
+	blockTime := time.Second / (SAMPLE_RATE / TONE_BLOCK)
+
+	if tonesPresent(block, BLUEBOX_SEIZE_FREQ) {
+		b.seize++
+		return
+	}
+	if time.Duration(b.seize)*blockTime >= BLUEBOX_SEIZE {
+		b.emit("2600")
+	}
+	b.seize = 0
+
+	signal := mfSignal(block)
+	if signal != b.signal {
+		b.signal, b.held, b.emitted = signal, 0, false
+	}
+	b.held++
+	if signal != "" && !b.emitted && time.Duration(b.held)*blockTime >= BLUEBOX_MF_MIN {
+		b.emit(signal)
+		b.emitted = true
+	}
+}
+
+// emit reports a signal, dropping it if the trunk has fallen behind
+func (b *blueBoxDetector) emit(signal string) {
+	select {
+	case b.events <- signal:
+	default:
+	}
+}
+
+// newWink is the far end answering a seized trunk: a burst of 2600 Hz and
+// the clunk of its equipment resetting
+func newWink() MediaSource {
+	rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	return newSequenceSource(newLimitedSource(newToneSource(BLUEBOX_SEIZE_FREQ), BLUEBOX_WINK), switchClick(rng))
+}
+
+// runTrunk connects the caller to an in-band trunk, as when dialing a
+// toll-free number once led to one: the far end rings, or plays the
+// trunk's file. Sending 2600 Hz seizes the trunk, which winks back and
+// waits for a number in MF tones, KP first and ST last; the number is
+// routed through the dial plan like a dialed one.
+func (s *SIPServer) runTrunk(session *CallSession, name string, dest DestinationConfig) {
+	farEnd := MediaSource(newCadenceSource(RINGBACK_ON, RINGBACK_OFF, RINGBACK_FREQ1, RINGBACK_FREQ2))
+	if dest.File != "" {
+		source, err := openDestination(session.exchange.config, DestinationConfig{Type: "audio", File: dest.File, Loop: dest.Loop, Effects: dest.Effects})
+		if err != nil {
+			log.Printf("⚠️  Trunk %q: %v", name, err)
+		} else {
+			farEnd = source
+		}
+	}
+
+	detector := newBlueBoxDetector()
+	stopWatching := session.tones.Watch(detector.Block)
+	defer stopWatching()
+
+	playing, stop := context.WithCancel(session.ctx)
+	defer stop()
+	player := newPlayerSource()
+	player.Play(farEnd)
+	stream := s.newCallStream(session, func(samples []int16) bool {
+		return playing.Err() == nil && player.ReadFrame(samples)
+	})
+	stream.markTalkspurts(player)
+	s.scheduler.Add(stream)
+
+	seized := false
+	collecting := false
+	var number strings.Builder
+	var timeout <-chan time.Time
+
+	for {
+		select {
+		case signal := <-detector.events:
+			switch {
+			case signal == "2600":
+				fmt.Printf("🏴‍☠️ 2600 Hz on trunk %q: seized\n", name)
+				seized, collecting = true, false
+				timeout = time.After(BLUEBOX_MF_TIMEOUT)
+				player.Play(newWink())
+			case !seized:
+				// MF means nothing to a trunk in use
+			case signal == "KP":
+				collecting = true
+				number.Reset()
+			case signal == "ST" && collecting:
+				collecting = false
+				fmt.Printf("🏴‍☠️ MF dialed on trunk %q: KP %s ST\n", name, number.String())
+				res, ok := s.resolveRoute(session, number.String())
+				if !ok {
+					player.Play(newLimitedSource(newCadenceSource(REORDER_ON, REORDER_OFF, BUSY_FREQ1, BUSY_FREQ2), FAILURE_DURATION))
+					continue
+				}
+				stop()
+				select {
+				case <-stream.Done():
+				case <-session.ctx.Done():
+					return
+				}
+				s.playDestination(session, res)
+				return
+			case collecting && signal != "ST":
+				number.WriteString(signal)
+			}
+
+		case <-timeout:
+			if seized {
+				fmt.Printf("⌛ Trunk %q: no MF number; back to the far end\n", name)
+				seized, collecting = false, false
+				player.Play(farEnd)
+			}
+
+		case <-stream.Done():
+			return
+		case <-session.ctx.Done():
+			return
+		}
+	}
+}
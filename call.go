@@ -0,0 +1,1222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CallSession represents an active call session
+type CallSession struct {
+	CallID         string
+	RemoteAddr     *net.UDPAddr
+	DialToneActive atomic.Bool
+	Playout        *playoutBuffer // Received audio, re-clocked for the leg it is bridged to
+	exchange       *exchange      // Whose dial plan routes the call
+
+	// A call leg is either a phone, reached over SIP and RTP, or a peer
+	// installation, reached over a tunnel
+	dialog *dialog // For hanging up the phone; nil if we can't
+	tunnel *tunnel // Set for legs to a peer installation
+
+	// Where the call's media goes, moved by a re-INVITE or latched onto
+	// where the phone's audio comes from; the address its SDP last gave,
+	// and whether media has latched since; and whether the phone has put
+	// the call on hold, when none is sent
+	remoteRTPAddr atomic.Pointer[net.UDPAddr]
+	sdpRTPAddr    atomic.Pointer[net.UDPAddr]
+	latched       atomic.Bool
+	held          atomic.Bool
+
+	// Payload types negotiated with the phone for redundant audio and
+	// telephone events, and what those it sends carry, which a re-INVITE
+	// may renumber
+	formats      audioFormats
+	payloadTypes atomic.Pointer[payloadTable]
+
+	// SRTP, if the call's audio is encrypted: our keys, and what decrypts
+	// the phone's, whose key a re-INVITE may change. Keys agreed by DTLS
+	// arrive after the call starts.
+	srtpOut atomic.Pointer[srtpKeys]
+	srtpIn  atomic.Pointer[srtpContext]
+	dtls    *dtlsServer // Keying a browser's audio; only the RTP reader uses it
+
+	// Addresses a browser has passed an ICE connectivity check from; DTLS
+	// is only taken from them
+	iceChecked sync.Map
+
+	// ctx is cancelled when the call ends (BYE or server shutdown); every
+	// goroutine working on behalf of the call must exit when it is done
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Digit collection state
+	digitsMu   sync.Mutex
+	digits     string
+	digitTimes []time.Time // When each digit was dialed
+	digitTimer *time.Timer
+	routed     bool               // Dialing finished; digits no longer collected
+	digitSink  func(digit string) // Receives digits dialed once routed, if set
+
+	// Times the call has been forwarded, to stop forwarding loops
+	forwards int
+
+	// Caller ID sent by a peer installation for calls it passes on
+	callerID string
+
+	// The leg this one is bridged to, and how to end the bridge without
+	// hanging up either, as a transfer does
+	bridgeMu sync.Mutex
+	peer     *CallSession
+	unbridge context.CancelFunc
+
+	// Key presses the phone sends as telephone events, each reported
+	// once however many packets it takes
+	events eventTracker
+
+	// The stream the phone's audio last came in and its latest sequence
+	// number, to spot packets lost, late or repeated
+	lastSSRC     uint32
+	lastSequence uint16
+	haveSequence bool
+
+	// Decodes the caller's audio, created with the first packet since a
+	// codec such as G.722 keeps state; wideband audio is then brought
+	// down to 8kHz
+	decoder     audioDecoder
+	downsampler downsampler
+
+	// Fills in for lost packets in the caller's audio
+	concealer lossConcealer
+
+	// Watches the caller's audio for in-band tones
+	tones *toneDetector
+
+	// Whether the caller is talking, as far as their audio tells, and the
+	// channels told when they start and stop
+	talking       atomic.Bool
+	voiceMu       sync.Mutex
+	voiceWatchers []chan bool
+
+	// Records the caller's audio, if recording is enabled, from the first
+	// that arrives
+	recordOnce sync.Once
+	recorder   *callRecorder
+
+	// Coin box of a call from a payphone; nil for other phones
+	coins *coinBox
+
+	// Set once the caller turns out to be a TTY: prompts are sent as text
+	tty atomic.Bool
+
+	// Played over whatever the call is hearing, which then picks up again
+	interruptMu  sync.Mutex
+	interruption MediaSource
+	interrupted  chan struct{} // Closed when the interruption has played
+}
+
+// caller is the caller ID of a call: the SIP user of the phone that placed
+// it, or what the peer installation passing it on sent. Empty if unknown.
+func (session *CallSession) caller() string {
+	if session.callerID != "" || session.dialog == nil {
+		return session.callerID
+	}
+	return contactUser(session.dialog.to)
+}
+
+// spawn runs f in a goroutine tracked by the server so that Close can wait
+// for it. Once the server is closing no new goroutines are started.
+func (s *SIPServer) spawn(f func()) {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+
+	if s.closing {
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// startCallSession starts a call session with dial tone and DTMF detection
+func (s *SIPServer) startCallSession(ex *exchange, callID string, remoteAddr *net.UDPAddr, remoteRTPAddr *net.UDPAddr, d *dialog, formats audioFormats) *CallSession {
+	fmt.Printf("🎵 Starting call session for Call-ID: %s (exchange %s)\n", callID, ex.name)
+
+	if remoteRTPAddr != nil {
+		fmt.Printf("🎯 Remote RTP address: %s\n", remoteRTPAddr)
+	}
+
+	session := s.newCallSession(ex, callID, remoteAddr, remoteRTPAddr)
+	session.dialog = d
+	session.setFormats(formats)
+
+	if ex.config.TTY.Enabled {
+		s.startTTY(session)
+	}
+
+	// A payphone only gives dial tone once the caller pays
+	if isPayphone(ex.config.Payphone, session) {
+		s.startPayphone(session)
+		s.addCallSession(session)
+		return session
+	}
+	session.DialToneActive.Store(true)
+	s.addCallSession(session)
+
+	// Start dial tone generation; DTMF arrives via the shared RTP receiver
+	s.spawn(func() { s.generateDialTone(session) })
+	return session
+}
+
+// newCallSession creates a call session that isn't yet active
+func (s *SIPServer) newCallSession(ex *exchange, callID string, remoteAddr *net.UDPAddr, remoteRTPAddr *net.UDPAddr) *CallSession {
+	ctx, cancel := context.WithCancel(s.ctx)
+	session := &CallSession{
+		CallID:     callID,
+		RemoteAddr: remoteAddr,
+		Playout:    newPlayoutBuffer(),
+		tones:      newToneDetector(),
+		exchange:   ex,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	session.remoteRTPAddr.Store(remoteRTPAddr)
+	session.sdpRTPAddr.Store(remoteRTPAddr)
+	s.detectInbandDTMF(session)
+	session.detectVoice()
+	return session
+}
+
+// RemoteRTPAddr is where the call's media goes; nil if the phone gave
+// no usable address
+func (session *CallSession) RemoteRTPAddr() *net.UDPAddr {
+	return session.remoteRTPAddr.Load()
+}
+
+// setFormats settles the formats a call's audio is in
+func (session *CallSession) setFormats(formats audioFormats) {
+	session.formats = formats
+	session.payloadTypes.Store(&formats.received)
+	if formats.crypto != nil {
+		session.useKeys(&formats.crypto.srtpKeys)
+	}
+}
+
+// secure reports whether the call's audio is encrypted, or is to be
+func (session *CallSession) secure() bool {
+	return session.formats.crypto != nil || session.formats.webrtc != nil
+}
+
+// useKeys encrypts the call's audio with keys from here on
+func (session *CallSession) useKeys(keys *srtpKeys) {
+	session.srtpOut.Store(keys)
+	session.rekey(keys.suite, keys.remote)
+}
+
+// renegotiate takes up the payload types and key of a new offer or
+// answer from the phone, which may number them differently from the last
+func (session *CallSession) renegotiate(sd *sessionDescription) {
+	audio := sd.audio()
+	if audio == nil {
+		return
+	}
+	if negotiated, ok := negotiateFormats(audio, session.formats.candidates(), session.formats.red != 0); ok {
+		session.payloadTypes.Store(&negotiated.received)
+	}
+	if crypto, _ := negotiateCrypto(audio); crypto != nil && session.formats.crypto != nil {
+		session.rekey(session.formats.crypto.suite, crypto.remote)
+	}
+}
+
+// rekey decrypts the phone's audio with a master key and salt from here
+// on, unless it is the one already in use
+func (session *CallSession) rekey(suite *srtpSuite, master []byte) {
+	if in := session.srtpIn.Load(); in != nil && bytes.Equal(in.master, master) {
+		return
+	}
+	in, err := newSRTPContext(suite, master)
+	if err != nil {
+		log.Printf("❌ Failed to key SRTP for call %s: %v", session.CallID, err)
+		return
+	}
+	session.srtpIn.Store(in)
+}
+
+// payloadKind is what the phone sends under payload type pt; before any
+// formats are settled, only PCMU is taken
+func (session *CallSession) payloadKind(pt byte) payloadKind {
+	if table := session.payloadTypes.Load(); table != nil {
+		return (*table)[pt]
+	}
+	if pt == PCMU_PAYLOAD_TYPE {
+		return payloadAudio
+	}
+	return payloadUnknown
+}
+
+// latch sends the call's media back to where the phone's first RTP packet
+// came from, if not where its SDP said. Many ATAs behind NAT send from a
+// port other than the one they give, and only the mapping their packets
+// open lets our audio through. A browser's media goes where ICE finds it.
+func (session *CallSession) latch(from *net.UDPAddr) {
+	if session.formats.webrtc != nil || !session.latched.CompareAndSwap(false, true) {
+		return
+	}
+	if previous := session.RemoteRTPAddr(); previous == nil || previous.String() != from.String() {
+		fmt.Printf("📌 Media for Call-ID %s latched to %s, where the phone sends from\n", session.CallID, from)
+		session.remoteRTPAddr.Store(from)
+	}
+}
+
+// mediaTarget is where the call's next frame goes: nowhere while the
+// phone holds the call
+func (session *CallSession) mediaTarget() *net.UDPAddr {
+	if session.held.Load() {
+		return nil
+	}
+	return session.remoteRTPAddr.Load()
+}
+
+// addCallSession makes a call session active
+func (s *SIPServer) addCallSession(session *CallSession) {
+	s.callsMu.Lock()
+	previous := s.calls[session.CallID]
+	s.calls[session.CallID] = session
+	s.callsMu.Unlock()
+
+	// A new INVITE for the same Call-ID replaces the old session rather
+	// than leaving its goroutines running alongside the new ones
+	if previous != nil {
+		previous.cancel()
+		if previous.dialog != nil && previous.dialog != session.dialog {
+			s.removeDialog(previous.dialog)
+		}
+	}
+}
+
+// endCallSession stops all activity for a call. It reports whether the
+// call was known.
+func (s *SIPServer) endCallSession(callID string) bool {
+	s.callsMu.Lock()
+	session, ok := s.calls[callID]
+	delete(s.calls, callID)
+	s.callsMu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	session.digitsMu.Lock()
+	if session.digitTimer != nil {
+		session.digitTimer.Stop()
+	}
+	session.digitsMu.Unlock()
+
+	session.cancel()
+	if session.tunnel != nil {
+		session.tunnel.Hangup()
+	}
+	if session.dialog != nil {
+		s.removeDialog(session.dialog)
+	}
+	fmt.Printf("🧹 Call session ended for Call-ID: %s\n", callID)
+	return true
+}
+
+// hangupCall ends a call from our side, sending the phone a BYE if the
+// call has a SIP dialog
+func (s *SIPServer) hangupCall(session *CallSession) {
+	if !s.endCallSession(session.CallID) {
+		return
+	}
+	if session.dialog != nil {
+		fmt.Printf("📴 Hanging up %s\n", session.dialog.requestURI)
+		s.sendRequest(session.dialog, "BYE", "", "", "")
+	}
+}
+
+// media is the call's RTP port, or nil for a call without one, such as
+// one tunnelled from a peer installation
+func (session *CallSession) media() *mediaPort {
+	if session.dialog == nil {
+		return nil
+	}
+	return session.dialog.media
+}
+
+// sessionForMedia finds the call whose RTP port p is, once it has been
+// answered
+func (s *SIPServer) sessionForMedia(p *mediaPort, callID string) *CallSession {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+
+	if session := s.calls[callID]; session != nil && session.media() == p {
+		return session
+	}
+	return nil
+}
+
+// generateDialTone generates and streams dial tone audio
+func (s *SIPServer) generateDialTone(session *CallSession) {
+	fmt.Println("🎵 Starting dial tone generation...")
+
+	// Dial tone, 350Hz + 440Hz unless the dial plan's tone plan or tones
+	// say otherwise, plays until the first digit, stuttering first if
+	// messages are waiting
+	tone := dialTone(session)
+	stream := s.newCallStream(session, func(samples []int16) bool {
+		if !session.DialToneActive.Load() || session.ctx.Err() != nil {
+			return false
+		}
+		return tone.ReadFrame(samples)
+	})
+
+	s.scheduler.Add(stream)
+
+	// The scheduler may already be stopped during shutdown, so don't rely
+	// on the stream finishing
+	select {
+	case <-stream.Done():
+	case <-session.ctx.Done():
+	}
+
+	fmt.Println("🔇 Dial tone stopped")
+}
+
+// interrupt plays source over whatever the call is hearing, which is held
+// meanwhile and picks up where it left off. The returned channel is closed
+// once source has played. If nothing is playing to the call, source waits
+// for the next thing that does.
+func (session *CallSession) interrupt(source MediaSource) <-chan struct{} {
+	session.interruptMu.Lock()
+	defer session.interruptMu.Unlock()
+
+	if session.interrupted != nil {
+		close(session.interrupted) // Cut short
+	}
+	session.interruption = source
+	session.interrupted = make(chan struct{})
+	return session.interrupted
+}
+
+// withInterruptions plays the call's interruptions in place of fill.
+// talkspurt reports whether the frame last read began one: the first of
+// an interruption, or of fill's audio again after one.
+func (session *CallSession) withInterruptions(fill func(samples []int16) bool) (interrupted func(samples []int16) bool, talkspurt func() bool) {
+	var last MediaSource // The interruption the last frame came from
+	began := false
+	interrupted = func(samples []int16) bool {
+		session.interruptMu.Lock()
+		if session.interruption != nil {
+			if session.interruption.ReadFrame(samples) {
+				began = session.interruption != last || beginsTalkspurt(session.interruption)
+				last = session.interruption
+				session.interruptMu.Unlock()
+				return true
+			}
+			session.interruption = nil
+			close(session.interrupted)
+			session.interrupted = nil
+		}
+		session.interruptMu.Unlock()
+		began, last = last != nil, nil
+		return fill(samples)
+	}
+	return interrupted, func() bool { return began }
+}
+
+// interrupting reports whether an interruption is playing over the call
+func (session *CallSession) interrupting() bool {
+	session.interruptMu.Lock()
+	defer session.interruptMu.Unlock()
+	return session.interruption != nil
+}
+
+// widen lets a stream to a phone on a wideband codec play source at 16kHz
+// when it can, rather than upsampled from 8kHz. Interruptions still play,
+// upsampled.
+func (session *CallSession) widen(stream *rtpStream, source MediaSource) {
+	wide, ok := source.(WidebandSource)
+	if !ok {
+		return
+	}
+	stream.wideband = func() bool {
+		return wide.Wideband() && !session.interrupting()
+	}
+	stream.fillWide = withMasterVolume(func(samples []int16) bool {
+		return session.ctx.Err() == nil && wide.ReadWideFrame(samples)
+	})
+}
+
+// newCallStream creates the stream carrying fill's audio to a call leg:
+// RTP for a phone, following it if a re-INVITE moves or holds the call,
+// audio frames for a tunnel
+func (s *SIPServer) newCallStream(session *CallSession, fill func(samples []int16) bool) *rtpStream {
+	var conn *net.UDPConn
+	if media := session.media(); media != nil {
+		conn = media.conn
+	}
+	fill, talkspurt := session.withInterruptions(fill)
+	stream := newRTPStream(conn, session.RemoteRTPAddr(), withMasterVolume(fill))
+	stream.talkspurt = talkspurt
+	stream.target = session.mediaTarget
+	if media := session.media(); media != nil {
+		stream.session = media.session
+	}
+	if t := session.tunnel; t != nil {
+		stream.sink = func(packet []byte) {
+			t.Send(FRAME_AUDIO, bytes.Clone(packet[RTP_HEADER_SIZE:]))
+		}
+	} else {
+		stream.useCodec(session.formats.primary())
+		stream.usePacketTime(session.formats.packetTime())
+		if session.formats.red != 0 {
+			stream.enableRedundancy(session.formats.red)
+		}
+		if session.secure() {
+			stream.keys = session.srtpOut.Load
+		}
+	}
+	return stream
+}
+
+// receiveRTP reads the media of the call callID from its RTP port p until
+// the port is given back, feeding the call's playout buffer and DTMF
+// detection. Until the call is answered, what arrives is dropped.
+func (s *SIPServer) receiveRTP(p *mediaPort, callID string) {
+	buffer := make([]byte, 1500) // Max UDP packet size
+	pcm := make([]int16, 2*1500) // Room for a wideband codec's two samples a byte
+	readTimeout := time.Duration(s.config.Socket.RTPReadTimeoutMs) * time.Millisecond
+
+	for s.ctx.Err() == nil {
+		// Set read timeout, on a port of the call's own
+		if readTimeout > 0 && p.shared == nil {
+			p.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+
+		n, remoteAddr, err := p.read(buffer)
+		arrival := time.Now()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Check if it's a timeout
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			log.Printf("Error reading RTP packet: %v", err)
+			continue
+		}
+		captureDatagram(p.conn, remoteAddr.AddrPort(), buffer[:n], false)
+
+		session := s.sessionForMedia(p, callID)
+		if session == nil {
+			continue // Not answered yet
+		}
+
+		// Calls from browsers check their path with STUN, key their audio
+		// with DTLS and send their reports on the same port (RFC 7983)
+		switch packet := buffer[:n]; {
+		case isSTUN(packet):
+			s.handleSTUN(session, packet, remoteAddr)
+			continue
+		case isDTLS(packet):
+			s.handleDTLS(session, packet, remoteAddr)
+			continue
+		case isRTCP(packet):
+			s.handleRTCP(session, p, packet, remoteAddr)
+			continue
+		}
+
+		if n < 12 {
+			continue // Too small to be valid RTP
+		}
+
+		// Audio that should be encrypted and isn't, or is forged, is dropped
+		if in := session.srtpIn.Load(); in != nil {
+			packet, err := in.unprotect(buffer[:n])
+			if err != nil {
+				continue
+			}
+			n = len(packet)
+		} else if session.secure() {
+			continue // Not keyed yet
+		}
+
+		// Parse RTP header
+		header := rtpHeaderLength(buffer[:n])
+		if header < 0 {
+			continue // Its CSRCs or extension run past its end
+		}
+		payloadType := buffer[1] & 0x7F
+		kind := session.payloadKind(payloadType)
+		if kind != payloadUnknown {
+			session.latch(remoteAddr)
+		}
+		c, _ := session.formats.primary()
+		p.session.receivedRTP(buffer[:n], arrival, c.clockRate, kind != payloadEvent)
+
+		// Audio arriving after what followed it has been played, or twice,
+		// is too late; telephone events take their own care of repeats
+		var missing int
+		if kind != payloadUnknown {
+			var inOrder bool
+			missing, inOrder = session.sequenced(buffer[:n])
+			if !inOrder && kind != payloadEvent {
+				continue
+			}
+		}
+
+		// Feed received audio into the session's playout buffer
+		switch kind {
+		case payloadAudio:
+			if missing != 1 || !recoverLoss(session, buffer[header:n], pcm) {
+				concealLoss(session, missing, pcm)
+			}
+			pushAudio(session, buffer[header:n], pcm)
+		case payloadRedundant:
+			s.receiveRedundant(session, buffer[header:n], missing, pcm)
+		case payloadEvent:
+			s.detectDTMF(session, buffer[:n], remoteAddr)
+		}
+	}
+}
+
+// receiveRedundant plays the primary frame of an RFC 2198 payload, first
+// recovering the previous frame from its redundant copy if just that
+// packet was lost, and otherwise concealing those missing
+func (s *SIPServer) receiveRedundant(session *CallSession, payload []byte, missing int, pcm []int16) {
+	c, audio := session.formats.primary()
+	primary, redundant, ok := decodeRedundant(payload, audio, c.frameTicks(session.formats.packetTime()))
+	if !ok {
+		return
+	}
+
+	if missing == 1 && redundant != nil {
+		pushAudio(session, redundant, pcm)
+	} else {
+		concealLoss(session, missing, pcm)
+	}
+	pushAudio(session, primary, pcm)
+}
+
+// sequenced follows the sequence numbers of the phone's RTP, reporting
+// how many packets went missing just before packet, and false if it
+// comes no later than one already seen. A new stream, or a jump too far
+// to be loss, starts following again.
+func (session *CallSession) sequenced(packet []byte) (missing int, inOrder bool) {
+	sequence, ssrc := binary.BigEndian.Uint16(packet[2:4]), binary.BigEndian.Uint32(packet[8:12])
+	delta := sequence - session.lastSequence
+	switch {
+	case !session.haveSequence || ssrc != session.lastSSRC:
+	case delta == 0, delta > 1<<16-RTP_MAX_MISORDER:
+		return 0, false
+	case delta < RTP_MAX_DROPOUT:
+		missing = int(delta) - 1
+	}
+	session.lastSSRC, session.lastSequence, session.haveSequence = ssrc, sequence, true
+	return missing, true
+}
+
+// concealLoss fills the gap missing packets of the call's audio left,
+// before the packet after them is played, for its playout buffer and
+// recording. The concealment isn't listened to for tones, where a tone
+// carried on could make a key press out of a lost packet.
+func concealLoss(session *CallSession, missing int, pcm []int16) {
+	if missing <= 0 {
+		return
+	}
+	n := session.concealer.Conceal(pcm[:min(missing*session.concealer.frame, len(pcm))])
+	if n == 0 {
+		return
+	}
+	session.playout(pcm[:n])
+	session.record(pcm[:n])
+}
+
+// recoverLoss recovers the one packet lost before payload from the in-band
+// FEC its codec carries in the next, as Opus does, playing it as audio
+// that arrived, and reports whether it could
+func recoverLoss(session *CallSession, payload []byte, pcm []int16) bool {
+	c, _ := session.formats.primary()
+	fec, ok := session.callDecoder().(fecDecoder)
+	if !ok {
+		return false
+	}
+	rate := SAMPLE_RATE
+	if c.wideband {
+		rate = WIDE_SAMPLE_RATE
+	}
+	n := fec.DecodeFEC(pcm, payload, session.formats.packetTime()*rate/1000)
+	if n == 0 {
+		return false
+	}
+	pushDecoded(session, pcm, n)
+	return true
+}
+
+// callDecoder is the decoder of the call's received audio, in the call's
+// codec, made when first needed
+func (session *CallSession) callDecoder() audioDecoder {
+	if session.decoder == nil {
+		c, _ := session.formats.primary()
+		session.decoder = c.newDecoder()
+	}
+	return session.decoder
+}
+
+// pushAudio decodes audio received on a call, in the call's codec, into
+// its playout buffer, tone detector and recording, using pcm as scratch;
+// the start of audio after a loss is blended with its concealment
+func pushAudio(session *CallSession, payload []byte, pcm []int16) {
+	pushDecoded(session, pcm, session.callDecoder().Decode(pcm, payload))
+}
+
+// pushDecoded plays the first n samples of pcm, just decoded, as audio the
+// call received
+func pushDecoded(session *CallSession, pcm []int16, n int) {
+	c, _ := session.formats.primary()
+	if c.wideband {
+		session.downsampler.downsample(pcm, pcm[:n])
+		n /= 2
+	}
+	session.concealer.Received(pcm[:n])
+	session.playout(pcm[:n])
+	session.tones.Push(pcm[:n])
+	session.record(pcm[:n])
+}
+
+// playout adds received audio to the call's playout buffer while it is
+// bridged, the only time anything drains it; otherwise the buffer would
+// only fill and overflow, and start the next bridge half a second behind
+func (session *CallSession) playout(pcm []int16) {
+	if session.bridgedTo() != nil {
+		session.Playout.Push(pcm)
+	}
+}
+
+// detectDTMF handles RFC 2833 telephone events in a received RTP packet.
+// Each key press is handled once, when it ends.
+func (s *SIPServer) detectDTMF(session *CallSession, packet []byte, remoteAddr *net.UDPAddr) {
+	header := rtpHeaderLength(packet)
+	if header < 0 || len(packet) < header+4 { // RTP header + DTMF event (4)
+		return
+	}
+
+	// All packets for one key press carry the same RTP timestamp
+	timestamp := binary.BigEndian.Uint32(packet[4:8])
+	session.events.receive(packet[header:header+4], timestamp, time.Now(), func(press keyPress) {
+		digit := dtmfEventToDigit(press.event)
+		if digit == "" {
+			return
+		}
+		c, _ := session.formats.primary()
+		length := time.Duration(press.duration) * time.Second / time.Duration(c.clockRate)
+		fmt.Printf("🔢 DTMF Detected: %s (%v, from %s)\n", digit, length, remoteAddr)
+		s.handleDigit(session, digit)
+	})
+}
+
+// handleDigit processes a key pressed on a call, wherever it came from
+func (s *SIPServer) handleDigit(session *CallSession, digit string) {
+	if session.coins != nil && !session.coins.dialable.Load() {
+		s.demandDeposit(session)
+		return
+	}
+
+	// Stop dial tone on first digit
+	if session.DialToneActive.CompareAndSwap(true, false) {
+		fmt.Println("🔇 Stopping dial tone - digit detected")
+	}
+
+	s.collectDigit(session, digit)
+}
+
+// collectDigit adds a dialed digit to the call and checks the digit map.
+// Dialing ends when a pattern is complete, or when the interdigit timer
+// expires: the short timer if the digits already match, the long one if a
+// pattern still needs more.
+func (s *SIPServer) collectDigit(session *CallSession, digit string) {
+	session.digitsMu.Lock()
+	defer session.digitsMu.Unlock()
+
+	if session.routed {
+		if session.digitSink != nil {
+			session.digitSink(digit)
+		}
+		return
+	}
+	session.digits += digit
+	session.digitTimes = append(session.digitTimes, time.Now())
+
+	if session.digitTimer != nil {
+		session.digitTimer.Stop()
+	}
+	if s.collectStarCode(session) || s.collectSecretCode(session) {
+		return
+	}
+
+	result, pattern := session.exchange.dialPlan.Collect(session.digits)
+	switch result {
+	case matchComplete:
+		s.routeCall(session)
+	case matchExtendable:
+		fmt.Printf("⏳ %s matches %s, waiting briefly for more digits\n", session.digits, pattern.source)
+		session.digitTimer = s.startDigitTimer(session, session.exchange.config.DialPlan.ShortTimeoutMs)
+	case matchPartial:
+		session.digitTimer = s.startDigitTimer(session, session.exchange.config.DialPlan.LongTimeoutMs)
+	default:
+		fmt.Printf("❌ %s does not match the digit map\n", session.digits)
+		session.routed = true
+		s.playProgress(session, progressUnassigned)
+	}
+}
+
+// captureDigits sends the digits dialed once the call is routed to the
+// returned channel, for destinations the caller navigates with the keypad,
+// until release is called. Keys mashed faster than they're read are
+// dropped.
+func (session *CallSession) captureDigits() (digits <-chan string, release func()) {
+	ch := make(chan string, 16)
+	session.digitsMu.Lock()
+	session.digitSink = func(digit string) {
+		select {
+		case ch <- digit:
+		default:
+		}
+	}
+	session.digitsMu.Unlock()
+
+	return ch, func() {
+		session.digitsMu.Lock()
+		session.digitSink = nil
+		session.digitsMu.Unlock()
+	}
+}
+
+// startDigitTimer routes whatever has been dialed once the timeout expires
+func (s *SIPServer) startDigitTimer(session *CallSession, timeoutMs int) *time.Timer {
+	return time.AfterFunc(time.Duration(timeoutMs)*time.Millisecond, func() {
+		session.digitsMu.Lock()
+		defer session.digitsMu.Unlock()
+
+		if session.routed || session.ctx.Err() != nil {
+			return
+		}
+
+		if result, _ := session.exchange.dialPlan.Collect(session.digits); result != matchExtendable {
+			fmt.Printf("⌛ Dialing timed out with incomplete number %s\n", session.digits)
+			session.routed = true
+			s.playProgress(session, progressIncomplete)
+			return
+		}
+		s.routeCall(session)
+	})
+}
+
+// routeCall resolves the dialed number and starts the destination. Must be
+// called with digitsMu held.
+func (s *SIPServer) routeCall(session *CallSession) {
+	session.routed = true
+
+	res, ok := s.resolveRoute(session, session.digits)
+	if !ok {
+		s.playProgress(session, progressUnassigned)
+		return
+	}
+	s.spawn(func() { s.playDestination(session, res) })
+}
+
+// resolveRoute finds the destination for a number dialed on a call,
+// reporting false if there is none the caller may reach
+func (s *SIPServer) resolveRoute(session *CallSession, digits string) (resolution, bool) {
+	res, ok := session.exchange.dialPlan.Resolve(digits)
+	if !ok {
+		fmt.Printf("❌ No destination for %s\n", res.number)
+		return res, false
+	}
+
+	if res.extension != "" {
+		fmt.Printf("🧭 Routing %s to extension %s\n", res.number, res.extension)
+		return res, true
+	}
+	if dest := session.exchange.config.Destinations[res.destination]; dest.Hidden && !session.exchange.unlocks.Unlocked(session.caller(), res.destination) {
+		fmt.Printf("🤫 %s leads to hidden destination %q, which the caller hasn't unlocked\n", res.number, res.destination)
+		return res, false
+	}
+	if res.world != nil {
+		fmt.Printf("🌍 %s: %s\n", res.number, res.world)
+	}
+	fmt.Printf("🧭 Routing %s to destination %q\n", res.number, res.destination)
+	return res, true
+}
+
+// dialedNumber is the number in an INVITE's Request-URI from a phone that
+// collects the digits itself before calling, or "" from one that wants
+// dial tone
+func dialedNumber(message string) string {
+	parts := strings.Fields(splitLines(message)[0])
+	if len(parts) < 2 {
+		return ""
+	}
+	uri, err := parseSIPURI(parts[1])
+	if err != nil || uri.User == "" || strings.Trim(uri.User, DIGIT_SYMBOLS) != "" {
+		return ""
+	}
+	return uri.User
+}
+
+// routeDialed decides, before the call is answered, where a number a phone
+// dialed itself leads. It returns the status to refuse the INVITE with if
+// the call can't go anywhere: 404 for a number nothing matches, 403 for a
+// hidden destination the caller hasn't unlocked or a SIP trunk called by
+// anyone but a registered phone at remoteAddr, 480 for a phone that isn't
+// registered and 486 for one that is in do not disturb or already on a
+// call, unless forwarding takes the call elsewhere.
+func (s *SIPServer) routeDialed(ex *exchange, caller, number string, remoteAddr *net.UDPAddr) (resolution, string) {
+	res, ok := ex.dialPlan.Resolve(number)
+	if !ok {
+		return res, "404 Not Found"
+	}
+	user := res.extension
+	if user == "" {
+		dest := ex.config.Destinations[res.destination]
+		if dest.Hidden && !ex.unlocks.Unlocked(caller, res.destination) {
+			return res, "403 Forbidden"
+		}
+		if dest.Type == "sip_trunk" && !s.registeredAt(ex, remoteAddr) {
+			return res, "403 Forbidden" // Calls through the provider cost money
+		}
+		if dest.Type != "phone" || dest.User == "" {
+			return res, ""
+		}
+		user = dest.User
+	}
+
+	rules := ex.forwarding.Get(user)
+	ua, registered := s.registeredPhone(ex, user)
+	switch {
+	case rules.Always != "":
+	case rules.DoNotDisturb && rules.DND == "":
+		return res, "486 Busy Here"
+	case !registered && rules.NoAnswer == "":
+		return res, "480 Temporarily Unavailable"
+	case registered && s.onCall(ua) && rules.DND == "":
+		return res, "486 Busy Here"
+	}
+	return res, ""
+}
+
+// onCall reports whether a registered phone is in a call already
+func (s *SIPServer) onCall(ua RegisteredUA) bool {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	for _, session := range s.calls {
+		if session.RemoteAddr != nil && session.RemoteAddr.String() == ua.RemoteAddr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// playDestination connects the call to its destination: a peer
+// installation, a phone, or audio played after its announcement if there
+// is one, until it ends or the call is hung up
+func (s *SIPServer) playDestination(session *CallSession, res resolution) {
+	cfg := session.exchange.config
+	if res.extension != "" {
+		s.connectPhone(session, DestinationConfig{Type: "phone", User: res.extension})
+		return
+	}
+	dest := cfg.Destinations[res.destination]
+
+	// A full destination puts the caller on hold until it has room
+	if queue := session.exchange.queues[res.destination]; queue != nil {
+		if !s.waitForSlot(session, res.destination, queue) {
+			return
+		}
+		defer queue.Release()
+	}
+	if cfg.Ambience.Enabled && dest.hasAmbience() && !session.tty.Load() {
+		distance := ambienceDistance(cfg.Ambience, dest)
+		fmt.Printf("📶 Putting the call through to %q (distance %.2f)\n", res.destination, distance)
+		s.playTone(session.ctx, session, newAmbience(distance))
+		if session.ctx.Err() != nil {
+			return
+		}
+	}
+	s.startMeter(session)
+	s.stampPassport(session, res.destination, dest)
+	if dest.Type != "stats" && dest.Type != "admin" {
+		session.exchange.stats.Record(res.destination, dest, time.Now())
+	}
+	if dest.Text != "" && session.tty.Load() {
+		fmt.Printf("⌨️  Sending %q to TTY as text\n", res.destination)
+		s.playTone(session.ctx, session, newBaudotSource(dest.Text))
+		return
+	}
+
+	switch dest.Type {
+	case "peer":
+		number := res.number[min(dest.Strip, len(res.number)):]
+		s.callPeer(session, dest, number)
+		return
+	case "phone":
+		s.connectPhone(session, dest)
+		return
+	case "sip_trunk":
+		number := res.number[min(dest.Strip, len(res.number)):]
+		s.callTrunk(session, dest, number)
+		return
+	case "action":
+		s.runAction(session, res, dest)
+		return
+	case "jukebox":
+		s.runJukebox(session, res.destination, dest)
+		return
+	case "audiobook":
+		s.runAudiobook(session, res.destination, dest)
+		return
+	case "passport":
+		s.runPassport(session, res.destination)
+		return
+	case "stats":
+		s.runStats(session)
+		return
+	case "admin":
+		s.runAdmin(session, res.destination, dest)
+		return
+	case "trunk":
+		s.runTrunk(session, res.destination, dest)
+		return
+	}
+
+	source, err := openDestination(cfg, dest)
+	if err != nil {
+		log.Printf("❌ Failed to open destination %q: %v", res.destination, err)
+		return
+	}
+	if res.announcement != "" {
+		announcement, err := openDestination(cfg, cfg.Destinations[res.announcement])
+		if err != nil {
+			log.Printf("⚠️  Skipping announcement %q: %v", res.announcement, err)
+		} else {
+			source = newSequenceSource(announcement, source)
+		}
+	}
+
+	fmt.Printf("🔊 Playing destination %q\n", res.destination)
+	stream := s.newCallStream(session, func(samples []int16) bool {
+		return session.ctx.Err() == nil && source.ReadFrame(samples)
+	})
+	session.widen(stream, source)
+	stream.markTalkspurts(source)
+	s.scheduler.Add(stream)
+
+	select {
+	case <-stream.Done():
+		fmt.Printf("🏁 Destination %q finished\n", res.destination)
+	case <-session.ctx.Done():
+	}
+}
+
+// connectPhone rings a registered phone, playing ringback to the caller
+// meanwhile, and bridges the two once it answers. The phone's forwarding
+// rules may send the call elsewhere instead.
+func (s *SIPServer) connectPhone(session *CallSession, dest DestinationConfig) {
+	ua, registered := s.phoneFor(session, dest.User)
+	user := dest.User
+	if registered {
+		user = ua.AOR
+	}
+	rules := session.exchange.forwarding.Get(user)
+
+	switch {
+	case rules.Always != "":
+		s.forwardCall(session, user, rules.Always, "always")
+		return
+	case rules.DoNotDisturb && rules.DND != "":
+		s.forwardCall(session, user, rules.DND, "do not disturb")
+		return
+	case rules.DoNotDisturb:
+		fmt.Printf("🔕 %s is in do not disturb\n", user)
+		s.playTone(session.ctx, session, session.progressTone(progressBusy))
+		return
+	case !registered && rules.NoAnswer != "":
+		s.forwardCall(session, user, rules.NoAnswer, "not registered")
+		return
+	case !registered:
+		fmt.Printf("📵 No phone registered for %q\n", dest.User)
+		s.playTone(session.ctx, session, session.progressTone(progressBusy))
+		return
+	}
+
+	ringFor := RING_TIMEOUT
+	if rules.NoAnswer != "" {
+		ringFor = time.Duration(rules.NoAnswerSeconds) * time.Second
+		if ringFor == 0 {
+			ringFor = DEFAULT_NO_ANSWER_SECONDS * time.Second
+		}
+	}
+
+	ringing, stopRinging := context.WithCancel(session.ctx)
+	defer stopRinging()
+	s.spawn(func() {
+		s.playTone(ringing, session, session.progressTone(progressRingback))
+	})
+
+	called, err := s.ringPhone(session.ctx, session.exchange, ua, ringFor)
+	stopRinging()
+	switch {
+	case err == nil:
+		s.bridge(session, called)
+	case session.ctx.Err() != nil:
+	case errors.Is(err, errNoAnswer) && rules.NoAnswer != "":
+		s.forwardCall(session, user, rules.NoAnswer, "no answer")
+	case errors.Is(err, errDeclined) && rules.DND != "":
+		s.forwardCall(session, user, rules.DND, "declined")
+	default:
+		fmt.Printf("📵 %s: %v\n", ua.Contact, err)
+		s.playTone(session.ctx, session, session.progressTone(progressBusy))
+	}
+}
+
+// phoneFor picks the registered phone a "phone" destination rings: the
+// most preferred binding of user, or with no user given, any phone but the
+// caller's. Expired bindings, those over a connection that has since
+// closed and those not answering keepalives can't be reached and are
+// passed over.
+func (s *SIPServer) phoneFor(caller *CallSession, user string) (RegisteredUA, bool) {
+	if user != "" {
+		return s.registeredPhone(caller.exchange, user)
+	}
+
+	for _, ua := range caller.exchange.registrar.Snapshot() {
+		if !ua.Expires.After(time.Now()) || ua.Missed > 0 || !s.reachable(ua) {
+			continue
+		}
+		if caller.RemoteAddr == nil || ua.RemoteAddr.String() != caller.RemoteAddr.String() {
+			return ua, true
+		}
+	}
+	return RegisteredUA{}, false
+}
+
+// registeredPhone is the most preferred binding of user on the exchange
+// that can be reached
+func (s *SIPServer) registeredPhone(ex *exchange, user string) (RegisteredUA, bool) {
+	for _, ua := range ex.registrar.Lookup(user) {
+		if ua.Missed == 0 && s.reachable(ua) {
+			return ua, true
+		}
+	}
+	return RegisteredUA{}, false
+}
+
+// registeredAt reports whether a phone is registered on the exchange from
+// addr, as callers must be to send calls through the proxy or out a paid
+// trunk
+func (s *SIPServer) registeredAt(ex *exchange, addr *net.UDPAddr) bool {
+	if addr == nil {
+		return false
+	}
+	for _, ua := range ex.registrar.Snapshot() {
+		if ua.RemoteAddr.Port == addr.Port && ua.RemoteAddr.IP.Equal(addr.IP) && ua.Expires.After(time.Now()) && s.reachable(ua) {
+			return true
+		}
+	}
+	return false
+}
+
+// reachable reports whether a binding can still be sent to: over UDP
+// always, over a stream only while its connection is open
+func (s *SIPServer) reachable(ua RegisteredUA) bool {
+	return ua.Transport == "" || ua.Transport == "UDP" || s.streamFor(ua.RemoteAddr) != nil
+}
+
+// playTone plays a progress tone to a call leg until ctx ends
+func (s *SIPServer) playTone(ctx context.Context, session *CallSession, source MediaSource) {
+	stream := s.newCallStream(session, func(samples []int16) bool {
+		return ctx.Err() == nil && source.ReadFrame(samples)
+	})
+	stream.markTalkspurts(source)
+	s.scheduler.Add(stream)
+
+	select {
+	case <-stream.Done():
+	case <-ctx.Done():
+	}
+}
+
+// bridge connects two call legs: each hears what the other sends. When
+// either hangs up, so does the other, unless the bridge is taken apart
+// first.
+func (s *SIPServer) bridge(a, b *CallSession) {
+	fmt.Printf("🔗 Bridging %s and %s\n", a.CallID, b.CallID)
+
+	bridged, unbridge := context.WithCancel(s.ctx)
+	defer unbridge()
+	a.setPeer(b, unbridge)
+	b.setPeer(a, unbridge)
+	defer a.setPeer(nil, nil)
+	defer b.setPeer(nil, nil)
+	a.Playout.Reset()
+	b.Playout.Reset()
+
+	for _, leg := range [][2]*CallSession{{a, b}, {b, a}} {
+		to, from := leg[0], leg[1]
+		stream := s.newCallStream(to, func(samples []int16) bool {
+			if to.ctx.Err() != nil || from.ctx.Err() != nil || bridged.Err() != nil {
+				return false
+			}
+			from.Playout.Pull(samples)
+			return true
+		})
+		s.scheduler.Add(stream)
+	}
+
+	select {
+	case <-a.ctx.Done():
+		s.hangupCall(b)
+	case <-b.ctx.Done():
+		s.hangupCall(a)
+	case <-bridged.Done():
+	}
+	fmt.Printf("🔗 Bridge between %s and %s ended\n", a.CallID, b.CallID)
+}
+
+// setPeer records the leg a call is bridged to
+func (session *CallSession) setPeer(peer *CallSession, unbridge context.CancelFunc) {
+	session.bridgeMu.Lock()
+	session.peer, session.unbridge = peer, unbridge
+	session.bridgeMu.Unlock()
+}
+
+// bridgedTo is the leg a call is bridged to, or nil
+func (session *CallSession) bridgedTo() *CallSession {
+	session.bridgeMu.Lock()
+	defer session.bridgeMu.Unlock()
+	return session.peer
+}
+
+// detach takes apart the bridge a call is in, leaving both legs up, and
+// returns the other leg; nil if the call isn't bridged
+func (session *CallSession) detach() *CallSession {
+	session.bridgeMu.Lock()
+	peer, unbridge := session.peer, session.unbridge
+	session.bridgeMu.Unlock()
+	if unbridge != nil {
+		unbridge()
+	}
+	return peer
+}
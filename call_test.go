@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// LEAK_TEST_CALLS is how many calls TestCallTeardownLeaks places
+const LEAK_TEST_CALLS = 5
+
+// placeCall dials number from ua, waits to hear the destination and hangs
+// up, checking the server tore the call down
+func placeCall(t *testing.T, server *SIPServer, ua *testUA, number string, frames [][]byte) {
+	t.Helper()
+	if err := ua.Invite(); err != nil {
+		t.Fatalf("go off hook: %v", err)
+	}
+	for i := 0; i < len(number); i++ {
+		if err := ua.SendDigit(number[i]); err != nil {
+			t.Fatalf("dial %s: %v", number, err)
+		}
+	}
+	if err := awaitFrames(ua, frames, 5*time.Second); err != nil {
+		t.Fatalf("hear %s: %v", number, err)
+	}
+	if err := ua.Bye(); err != nil {
+		t.Fatalf("hang up: %v", err)
+	}
+	if err := checkTornDown(server, ua); err != nil {
+		t.Fatalf("tear down: %v", err)
+	}
+}
+
+// openFDs counts the process's open file descriptors, or returns -1 where
+// /proc doesn't list them
+func openFDs() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+// settle waits for the goroutine count to come down to at most want,
+// returning what it is when it does or the wait runs out
+func settle(want int) int {
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return runtime.NumGoroutine()
+}
+
+func TestCallTeardownLeaks(t *testing.T) {
+	cfg := selfTestConfig()
+	cfg.BindIP = "127.0.0.1"
+	cfg.SIPPort = 0
+	frames := expectedFrames(newToneSource(1004), SELFTEST_FRAMES)
+
+	server, err := NewSIPServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Run()
+
+	ua, err := newTestUA(server.SIPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ua.Close()
+	if err := ua.Register(); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	// The first call starts anything the server only starts once
+	placeCall(t, server, ua, SELFTEST_NUMBER, frames)
+	goroutines := runtime.NumGoroutine()
+	fds := openFDs()
+
+	for range LEAK_TEST_CALLS {
+		placeCall(t, server, ua, SELFTEST_NUMBER, frames)
+	}
+
+	if after := settle(goroutines); after > goroutines {
+		buf := make([]byte, 1<<20)
+		t.Errorf("%d goroutine(s) left after %d calls\n%s", after-goroutines, LEAK_TEST_CALLS, buf[:runtime.Stack(buf, true)])
+	}
+	if after := openFDs(); after > fds {
+		t.Errorf("%d file descriptor(s) left open after %d calls", after-fds, LEAK_TEST_CALLS)
+	}
+}
+
+// answerCall waits for the server to ring ua and answers it with PCMU,
+// remembering where to send media, as a phone picking up does
+func answerCall(ua *testUA, timeout time.Duration) error {
+	buffer := make([]byte, SIP_UDP_MAX_MESSAGE)
+	ua.sipConn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, from, err := ua.sipConn.ReadFromUDP(buffer)
+		if err != nil {
+			return fmt.Errorf("not rung: %v", err)
+		}
+		message := string(buffer[:n])
+		if getMethod(splitLines(message)[0]) != "INVITE" {
+			continue
+		}
+
+		headers := parseHeaders(message)
+		ua.callID, ua.remoteTag = headers["Call-ID"], headerTag(headers["From"])
+		ua.serverRTP = parseSDPForRTP(message, from.IP)
+		if ua.serverRTP == nil {
+			return fmt.Errorf("INVITE carried no usable SDP")
+		}
+		rtp := ua.localRTP()
+		sdp := fmt.Sprintf("v=0\r\no=- 1 1 IN IP4 %s\r\ns=callee\r\nc=IN IP4 %s\r\nt=0 0\r\n"+
+			"m=audio %d RTP/AVP 0\r\na=rtpmap:0 PCMU/8000\r\n", rtp.IP, rtp.IP, rtp.Port)
+		var response strings.Builder
+		response.WriteString("SIP/2.0 200 OK\r\n")
+		for _, via := range headerValues(message, "Via") {
+			fmt.Fprintf(&response, "Via: %s\r\n", via)
+		}
+		fmt.Fprintf(&response, "From: %s\r\nTo: %s;tag=%s\r\nCall-ID: %s\r\nCSeq: %s\r\n",
+			headers["From"], headers["To"], ua.tag, ua.callID, headers["CSeq"])
+		fmt.Fprintf(&response, "Contact: <sip:%s@%s>\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\n\r\n%s",
+			ua.user, ua.localSIP(), len(sdp), sdp)
+		_, err = ua.sipConn.WriteToUDP([]byte(response.String()), from)
+		return err
+	}
+}
+
+// awaitRequest waits for the server to send ua a request with method
+func awaitRequest(ua *testUA, method string, timeout time.Duration) error {
+	buffer := make([]byte, SIP_UDP_MAX_MESSAGE)
+	ua.sipConn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, _, err := ua.sipConn.ReadFromUDP(buffer)
+		if err != nil {
+			return fmt.Errorf("no %s: %v", method, err)
+		}
+		if lines := splitLines(string(buffer[:n])); isRequest(lines[0]) && getMethod(lines[0]) == method {
+			return nil
+		}
+	}
+}
+
+// sendTone sends frames of a tone from ua to the server in PCMU, as a
+// phone sends what its microphone hears, until stop is closed
+func sendTone(ua *testUA, frequency float64, stop <-chan struct{}) {
+	source := newToneSource(frequency)
+	samples := make([]int16, FRAME_SIZE)
+	packet := make([]byte, RTP_HEADER_SIZE+FRAME_SIZE)
+	packet[0] = 0x80
+	binary.BigEndian.PutUint32(packet[8:12], 0x0ca11e75)
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		source.ReadFrame(samples)
+		for i, sample := range samples {
+			packet[RTP_HEADER_SIZE+i] = linearToUlaw(sample)
+		}
+		binary.BigEndian.PutUint16(packet[2:4], ua.sequenceNumber)
+		binary.BigEndian.PutUint32(packet[4:8], ua.timestamp)
+		ua.rtpConn.WriteToUDP(packet, ua.serverRTP)
+		ua.sequenceNumber++
+		ua.timestamp += FRAME_SIZE
+	}
+}
+
+func TestPhoneToPhoneBridge(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.BindIP = "127.0.0.1"
+	cfg.SIPPort = 0
+	cfg.DialPlan.DigitMap = "(1xxx)"
+	cfg.DialPlan.Routes = []RouteConfig{{Pattern: "1002", Destination: "callee"}}
+	cfg.Destinations = map[string]DestinationConfig{"callee": {Type: "phone", User: "1002"}}
+
+	server, err := NewSIPServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Run()
+
+	var phones [2]*testUA
+	for i, user := range []string{"1001", "1002"} {
+		ua, err := newTestUA(server.SIPAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ua.Close()
+		ua.user = user
+		if err := ua.Register(); err != nil {
+			t.Fatalf("register %s: %v", user, err)
+		}
+		phones[i] = ua
+	}
+	caller, callee := phones[0], phones[1]
+
+	// The caller dials the callee, who is rung on a dialog of its own
+	if err := caller.Invite(); err != nil {
+		t.Fatalf("go off hook: %v", err)
+	}
+	for _, digit := range []byte("1002") {
+		if err := caller.SendDigit(digit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := answerCall(callee, 5*time.Second); err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+	if err := awaitRequest(callee, "ACK", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	server.callsMu.Lock()
+	calls, dialogs := len(server.calls), len(server.dialogs)
+	server.callsMu.Unlock()
+	if calls != 2 || dialogs != 2 {
+		t.Errorf("%d call(s) and %d dialog(s) while bridged, want 2 of each", calls, dialogs)
+	}
+
+	// What the caller says reaches the callee through the server
+	stop := make(chan struct{})
+	defer close(stop)
+	go sendTone(caller, 1004, stop)
+	heard := 0
+	err = callee.ReadAudio(3*time.Second, func(payload []byte) bool {
+		if bytes.Count(payload, []byte{0xFF}) < len(payload)/2 {
+			heard++
+		} else {
+			heard = 0
+		}
+		return heard == SELFTEST_FRAMES
+	})
+	if err != nil {
+		t.Fatalf("callee didn't hear the caller: %v", err)
+	}
+
+	// and the caller hanging up hangs up the callee
+	if err := caller.Bye(); err != nil {
+		t.Fatalf("hang up: %v", err)
+	}
+	if err := awaitRequest(callee, "BYE", 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// pcap file format, with nanosecond timestamps, of raw IP packets
+	PCAP_MAGIC_NANO    = 0xa1b23c4d
+	PCAP_SNAPLEN       = 65535
+	PCAP_LINKTYPE_RAW  = 101
+	PCAP_FILE_HEADER   = 24
+	PCAP_RECORD_HEADER = 16
+
+	IPV4_HEADER_SIZE = 20
+	IPV6_HEADER_SIZE = 40
+	UDP_HEADER_SIZE  = 8
+
+	// CAPTURE_MAX_PAYLOAD is the most of a datagram written, so the
+	// packet made for it fits an IPv6 payload length
+	CAPTURE_MAX_PAYLOAD = PCAP_SNAPLEN - IPV6_HEADER_SIZE - UDP_HEADER_SIZE
+
+	// CAPTURE_FLUSH_INTERVAL is how long packets may sit in the buffer
+	// before they are written out, so a capture can be read as it grows
+	CAPTURE_FLUSH_INTERVAL = time.Second
+)
+
+// packetCapture is the capture SIP and RTP are written to, shared by
+// every server; nil when not capturing
+var packetCapture atomic.Pointer[pcapWriter]
+
+// pcapWriter writes the datagrams the server sends and receives to a pcap
+// file, each in the IP and UDP headers it would have had on the wire, so
+// the file opens in Wireshark as if tcpdump had taken it. SIP over TCP,
+// TLS and WebSocket is written the same way, a message to a datagram,
+// and decrypted.
+type pcapWriter struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	w       *bufio.Writer // nil once writing has failed
+	header  [PCAP_RECORD_HEADER + IPV6_HEADER_SIZE + UDP_HEADER_SIZE]byte
+	id      uint16    // Of the next IPv4 packet
+	flushed time.Time // When the buffer was last written out
+
+	// The local address each remote address is reached from, for sockets
+	// listening on every interface
+	locals map[netip.Addr]netip.Addr
+}
+
+// startCapture creates a pcap file at path and writes SIP and RTP to it
+// from here on
+func startCapture(path string) (*pcapWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture: %v", err)
+	}
+	w := &pcapWriter{
+		path:    path,
+		file:    file,
+		w:       bufio.NewWriterSize(file, 64*1024),
+		flushed: time.Now(),
+		locals:  make(map[netip.Addr]netip.Addr),
+	}
+
+	var header [PCAP_FILE_HEADER]byte
+	binary.LittleEndian.PutUint32(header[0:4], PCAP_MAGIC_NANO)
+	binary.LittleEndian.PutUint16(header[4:6], 2) // Version 2.4
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], PCAP_SNAPLEN)
+	binary.LittleEndian.PutUint32(header[20:24], PCAP_LINKTYPE_RAW)
+	if _, err := w.w.Write(header[:]); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write capture: %v", err)
+	}
+
+	packetCapture.Store(w)
+	return w, nil
+}
+
+// Close stops capturing and finishes the file
+func (w *pcapWriter) Close() {
+	packetCapture.CompareAndSwap(w, nil)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.w != nil {
+		if err := w.w.Flush(); err != nil {
+			log.Printf("❌ Failed to finish capture %s: %v", w.path, err)
+		}
+		w.w = nil
+	}
+	w.file.Close()
+}
+
+// captureDatagram writes a datagram sent or received on conn, to or from
+// remote, if capturing
+func captureDatagram(conn *net.UDPConn, remote netip.AddrPort, payload []byte, sent bool) {
+	if w := packetCapture.Load(); w != nil {
+		w.datagram(conn.LocalAddr(), remote, payload, sent)
+	}
+}
+
+// captureStream writes a SIP message sent or received on a stream
+// connection, if capturing
+func captureStream(c *streamConn, message string, sent bool) {
+	w := packetCapture.Load()
+	if w == nil {
+		return
+	}
+	remote, ok := c.conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	w.datagram(c.conn.LocalAddr(), remote.AddrPort(), []byte(message), sent)
+}
+
+// datagram writes a packet carrying payload between local and remote
+func (w *pcapWriter) datagram(localAddr net.Addr, remote netip.AddrPort, payload []byte, sent bool) {
+	var local netip.AddrPort
+	switch addr := localAddr.(type) {
+	case *net.UDPAddr:
+		local = addr.AddrPort()
+	case *net.TCPAddr:
+		local = addr.AddrPort()
+	default:
+		return
+	}
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.w == nil {
+		return
+	}
+
+	// A socket on every interface sends from the one that reaches remote
+	localIP := local.Addr().Unmap()
+	if localIP.IsUnspecified() {
+		localIP = w.localFor(remote.Addr())
+	}
+	local = netip.AddrPortFrom(localIP, local.Port())
+	src, dst := remote, local
+	if sent {
+		src, dst = local, remote
+	}
+
+	captured := payload[:min(len(payload), CAPTURE_MAX_PAYLOAD)]
+	packet := w.packetHeader(src, dst, captured)
+	now := time.Now()
+	record := w.header[:PCAP_RECORD_HEADER]
+	binary.LittleEndian.PutUint32(record[0:4], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(now.Nanosecond()))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(packet)+len(captured)))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(len(packet)+len(captured)))
+
+	_, err := w.w.Write(w.header[:PCAP_RECORD_HEADER+len(packet)])
+	if err == nil {
+		_, err = w.w.Write(captured)
+	}
+	if err == nil && now.Sub(w.flushed) >= CAPTURE_FLUSH_INTERVAL {
+		err = w.w.Flush()
+		w.flushed = now
+	}
+	if err != nil {
+		log.Printf("❌ Capture to %s stopped: %v", w.path, err)
+		packetCapture.CompareAndSwap(w, nil)
+		w.w = nil
+	}
+}
+
+// packetHeader fills in the IP and UDP headers of a packet from src to
+// dst carrying payload, after the record header, returning them: IPv4
+// if both ends are, IPv6 otherwise
+func (w *pcapWriter) packetHeader(src, dst netip.AddrPort, payload []byte) []byte {
+	udpLength := UDP_HEADER_SIZE + len(payload)
+	var ip, udp []byte
+	var pseudo uint32
+	if src.Addr().Is4() && dst.Addr().Is4() {
+		ip = w.header[PCAP_RECORD_HEADER : PCAP_RECORD_HEADER+IPV4_HEADER_SIZE]
+		clear(ip)
+		ip[0] = 0x45 // Version 4, 5 words of header
+		binary.BigEndian.PutUint16(ip[2:4], uint16(IPV4_HEADER_SIZE+udpLength))
+		binary.BigEndian.PutUint16(ip[4:6], w.id)
+		w.id++
+		ip[6] = 0x40 // Don't fragment
+		ip[8] = 64   // TTL
+		ip[9] = 17   // UDP
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		copy(ip[12:16], s[:])
+		copy(ip[16:20], d[:])
+		binary.BigEndian.PutUint16(ip[10:12], ^fold(checksum(0, ip)))
+		pseudo = checksum(checksum(0, s[:]), d[:]) + 17 + uint32(udpLength)
+	} else {
+		ip = w.header[PCAP_RECORD_HEADER : PCAP_RECORD_HEADER+IPV6_HEADER_SIZE]
+		clear(ip)
+		ip[0] = 0x60 // Version 6
+		binary.BigEndian.PutUint16(ip[4:6], uint16(udpLength))
+		ip[6] = 17 // UDP
+		ip[7] = 64 // Hop limit
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		copy(ip[8:24], s[:])
+		copy(ip[24:40], d[:])
+		pseudo = checksum(checksum(0, s[:]), d[:]) + 17 + uint32(udpLength)
+	}
+
+	udp = w.header[PCAP_RECORD_HEADER+len(ip) : PCAP_RECORD_HEADER+len(ip)+UDP_HEADER_SIZE]
+	binary.BigEndian.PutUint16(udp[0:2], src.Port())
+	binary.BigEndian.PutUint16(udp[2:4], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLength))
+	binary.BigEndian.PutUint16(udp[6:8], 0)
+	sum := ^fold(checksum(checksum(pseudo, udp), payload))
+	if sum == 0 {
+		sum = 0xffff // Zero means no checksum (RFC 768)
+	}
+	binary.BigEndian.PutUint16(udp[6:8], sum)
+	return w.header[PCAP_RECORD_HEADER : PCAP_RECORD_HEADER+len(ip)+UDP_HEADER_SIZE]
+}
+
+// localFor is the local address remote is reached from, looked up once
+func (w *pcapWriter) localFor(remote netip.Addr) netip.Addr {
+	if local, ok := w.locals[remote]; ok {
+		return local
+	}
+	local, err := netip.ParseAddr(routeLocalIP(net.UDPAddrFromAddrPort(netip.AddrPortFrom(remote, 9))))
+	if err != nil {
+		local = netip.IPv4Unspecified()
+	}
+	local = local.Unmap()
+	w.locals[remote] = local
+	return local
+}
+
+// checksum adds data to a running Internet checksum (RFC 1071), as
+// big-endian 16-bit words
+func checksum(sum uint32, data []byte) uint32 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
+
+// fold folds the carries of a running checksum back into 16 bits
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
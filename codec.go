@@ -0,0 +1,148 @@
+package main
+
+import "strings"
+
+// PCMA_PAYLOAD_TYPE is the static payload type of A-law audio
+const PCMA_PAYLOAD_TYPE = 8
+
+// Packet times (RFC 4566 a=ptime), in milliseconds of audio per RTP
+// packet: what we send unless asked otherwise, and the range we can send,
+// in whole steps of the media scheduler's clock
+const (
+	DEFAULT_PTIME = 20
+	MIN_PTIME     = 10
+	MAX_PTIME     = 60
+	PTIME_STEP    = 10
+
+	// MAX_FRAME_SIZE is the most 8kHz samples a packet carries, at
+	// MAX_PTIME, and the most bytes any codec encodes them to
+	MAX_FRAME_SIZE = MAX_PTIME * SAMPLE_RATE / 1000
+)
+
+// codec is an audio codec the server can send and receive. A frame of
+// 8kHz samples encodes to at most as many bytes; a wideband codec is given
+// twice as many samples of 16kHz audio for it.
+type codec struct {
+	name        string
+	rtpmap      string // Encoding name, clock rate and any channels, as an rtpmap attribute gives them
+	fmtp        string // Format parameters we give it, if any
+	payloadType byte   // Static payload type (RFC 3551), or the one we offer it under
+	clockRate   int    // Of its RTP timestamps
+	wideband    bool
+	ptimes      []int // The packet times it can frame, if not every PTIME_STEP
+	newEncoder  func() audioEncoder
+	newDecoder  func() audioDecoder
+}
+
+// audioEncoder encodes a frame of linear samples into payload, returning
+// the payload's length
+type audioEncoder interface {
+	Encode(payload []byte, samples []int16) int
+}
+
+// audioDecoder decodes a payload into linear samples, returning how many
+type audioDecoder interface {
+	Decode(pcm []int16, payload []byte) int
+}
+
+// fecDecoder is an audioDecoder whose codec can carry a frame again in the
+// packet after it, as in-band forward error correction
+type fecDecoder interface {
+	// DecodeFEC recovers the frame of samples samples lost just before
+	// the packet payload, returning how many it decoded; none if the
+	// packet carried no copy
+	DecodeFEC(pcm []int16, payload []byte, samples int) int
+}
+
+var (
+	// G.722's clock is 8kHz, though it samples at 16kHz
+	g722Codec = &codec{name: "G722", rtpmap: "G722/8000", payloadType: G722_PAYLOAD_TYPE, clockRate: SAMPLE_RATE, wideband: true, newEncoder: newG722Encoder, newDecoder: newG722Decoder}
+	pcmuCodec = &codec{name: "PCMU", rtpmap: "PCMU/8000", payloadType: PCMU_PAYLOAD_TYPE, clockRate: SAMPLE_RATE, newEncoder: func() audioEncoder { return pcmu }, newDecoder: func() audioDecoder { return pcmu }}
+	pcmaCodec = &codec{name: "PCMA", rtpmap: "PCMA/8000", payloadType: PCMA_PAYLOAD_TYPE, clockRate: SAMPLE_RATE, newEncoder: func() audioEncoder { return pcma }, newDecoder: func() audioDecoder { return pcma }}
+)
+
+// codecs are the codecs the server speaks, most preferred first unless
+// qos.codecs says otherwise
+var codecs = []*codec{g722Codec, pcmuCodec, pcmaCodec}
+
+// g711 is μ-law or A-law, a byte per sample with no state between them
+type g711 struct {
+	encode func(sample int16) byte
+	decode func(b byte) int16
+}
+
+var (
+	pcmu = g711{linearToUlaw, ulawToLinear}
+	pcma = g711{linearToAlaw, alawToLinear}
+)
+
+// Encode encodes a sample per byte
+func (law g711) Encode(payload []byte, samples []int16) int {
+	for i, sample := range samples {
+		payload[i] = law.encode(sample)
+	}
+	return len(samples)
+}
+
+// Decode decodes a byte per sample
+func (law g711) Decode(pcm []int16, payload []byte) int {
+	for i, b := range payload {
+		pcm[i] = law.decode(b)
+	}
+	return len(payload)
+}
+
+func newG722Encoder() audioEncoder {
+	return &g722Encoder{newG722State()}
+}
+
+func newG722Decoder() audioDecoder {
+	return &g722Decoder{newG722State()}
+}
+
+// codecNamed is the codec with an encoding name, regardless of case, or
+// nil if the server doesn't speak it
+func codecNamed(name string) *codec {
+	for _, c := range codecs {
+		if strings.EqualFold(c.name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// frameTicks is how far a frame of ptime milliseconds moves the codec's
+// RTP timestamps
+func (c *codec) frameTicks(ptime int) uint32 {
+	return uint32(c.clockRate * ptime / 1000)
+}
+
+// packetTime is the longest packet time the codec can send no longer than
+// ptime milliseconds, within MIN_PTIME and MAX_PTIME
+func (c *codec) packetTime(ptime int) int {
+	ptime = min(max(ptime/PTIME_STEP*PTIME_STEP, MIN_PTIME), MAX_PTIME)
+	if c.ptimes == nil {
+		return ptime
+	}
+	best := c.ptimes[0]
+	for _, p := range c.ptimes {
+		if p <= ptime {
+			best = p
+		}
+	}
+	return best
+}
+
+// preferredCodecs are the codecs an exchange uses, most preferred first
+func (q QoSConfig) preferredCodecs() []*codec {
+	if len(q.Codecs) == 0 {
+		return codecs
+	}
+	var preferred []*codec
+	for _, name := range q.Codecs {
+		if c := codecNamed(name); c != nil {
+			preferred = append(preferred, c)
+		}
+	}
+	return preferred
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// runSubcommand handles "travel-by-telephone <command> ..." invocations. It
+// reports whether args named a subcommand, and the process exit code.
+func runSubcommand(args []string) (exitCode int, handled bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+
+	switch args[0] {
+	case "check":
+		return runCheckCommand(args[1:]), true
+	case "dialplan":
+		return runDialPlanCommand(args[1:]), true
+	case "selftest":
+		return runSelfTestCommand(args[1:]), true
+	case "ring":
+		return runRingCommand(args[1:]), true
+	default:
+		return 0, false
+	}
+}
+
+// loadCommandConfig loads the config file named by -config, or the defaults
+func loadCommandConfig(path string) (*Config, error) {
+	if path == "" {
+		return defaultConfig(), nil
+	}
+	return loadConfig(path)
+}
+
+// selectExchange returns the config of the exchange named by -exchange
+func selectExchange(cfg *Config, name string) (*Config, error) {
+	if name == "" {
+		return cfg, nil
+	}
+	exCfg, ok := cfg.ExchangeConfig(name)
+	if !ok {
+		return nil, fmt.Errorf("no exchange named %q", name)
+	}
+	return exCfg, nil
+}
+
+// runCheckCommand implements "check -config <file>": it validates the
+// config, decodes every audio destination and lints the dial plan. The exit
+// code is nonzero if anything would break at runtime.
+func runCheckCommand(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to JSON config file")
+	flags.Parse(args)
+
+	if *configPath == "" || flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: travel-by-telephone check -config <file>")
+		return 2
+	}
+
+	fmt.Printf("🔍 Checking %s\n", *configPath)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return 1
+	}
+	fmt.Println("✅ Config is valid")
+
+	problems, warnings := 0, 0
+	exchanges := cfg.ExchangeConfigs()
+	for _, exCfg := range exchanges {
+		// Prefix findings with the exchange once there is more than one
+		prefix := ""
+		if len(exchanges) > 1 {
+			prefix = fmt.Sprintf("[%s] ", exCfg.Name)
+		}
+		exProblems, exWarnings := checkExchange(exCfg, prefix)
+		problems += exProblems
+		warnings += exWarnings
+	}
+
+	fmt.Printf("\n%d problem(s), %d warning(s)\n", problems, warnings)
+	if problems > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkExchange decodes an exchange's audio destinations and lints its dial
+// plan, printing each finding. It returns the number of problems and
+// warnings.
+func checkExchange(cfg *Config, prefix string) (problems, warnings int) {
+	for _, name := range slices.Sorted(maps.Keys(cfg.Destinations)) {
+		dest := cfg.Destinations[name]
+		if dest.Type == "playlist" {
+			p, w := checkPlaylist(cfg, prefix, name, dest)
+			problems, warnings = problems+p, warnings+w
+			continue
+		}
+		if dest.Type != "audio" && (dest.Type != "trunk" || dest.File == "") {
+			continue
+		}
+		path := cfg.ResolvePath(dest.File)
+		samples, err := loadWAV(path)
+		if err != nil {
+			fmt.Printf("❌ %sDestination %q: %v\n", prefix, name, err)
+			problems++
+			continue
+		}
+		seconds := float64(len(samples)) / SAMPLE_RATE
+		fmt.Printf("✅ %sDestination %q: %s (%.1fs)\n", prefix, name, path, seconds)
+	}
+
+	// Validate already compiled the plan once, so this can't fail
+	plan, _ := newDialPlan(cfg)
+	lintProblems, lintWarnings := plan.Lint()
+	for _, problem := range lintProblems {
+		fmt.Printf("❌ %s%s\n", prefix, problem)
+	}
+	for _, warning := range lintWarnings {
+		fmt.Printf("⚠️  %s%s\n", prefix, warning)
+	}
+
+	return problems + len(lintProblems), len(lintWarnings)
+}
+
+// runDialPlanCommand implements "dialplan test <digits>"
+func runDialPlanCommand(args []string) int {
+	if len(args) == 0 || args[0] != "test" {
+		fmt.Fprintln(os.Stderr, "Usage: travel-by-telephone dialplan test [-config file] <digits>")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("dialplan test", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to JSON config file")
+	exchangeName := flags.String("exchange", "", "Exchange whose dial plan to use (default: the top-level one)")
+	flags.Parse(args[1:])
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: travel-by-telephone dialplan test [-config file] [-exchange name] <digits>")
+		return 2
+	}
+	digits := flags.Arg(0)
+	for _, char := range digits {
+		if !strings.ContainsRune(DIGIT_SYMBOLS, char) {
+			fmt.Fprintf(os.Stderr, "Invalid key %q: digits may only contain %s\n", char, DIGIT_SYMBOLS)
+			return 2
+		}
+	}
+
+	cfg, err := loadCommandConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	cfg, err = selectExchange(cfg, *exchangeName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	plan, err := newDialPlan(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid dial plan: %v\n", err)
+		return 1
+	}
+
+	if simulateDialing(cfg, plan, digits) {
+		return 0
+	}
+	return 1
+}
+
+// simulateDialing runs digits through the same steps a call goes through
+// and prints every decision. It reports whether a destination was reached.
+func simulateDialing(cfg *Config, plan *DialPlan, digits string) bool {
+	title := fmt.Sprintf("🧪 Dial plan simulation for %s", digits)
+	fmt.Println(title)
+	fmt.Println(strings.Repeat("=", len(title)))
+
+	// Step 1: normalization of the full number
+	fmt.Println("\n1. Normalization")
+	number, steps := plan.Normalize(digits)
+	if len(steps) == 0 {
+		fmt.Println("   no rules changed the number")
+	}
+	for _, step := range steps {
+		rule := cfg.DialPlan.Normalize[step.rule-1]
+		fmt.Printf("   rule %d (%s → %q): %s → %s\n", step.rule, rule.Match, rule.Replace, step.before, step.after)
+	}
+	fmt.Printf("   canonical number: %s\n", number)
+
+	// Step 2: digit collection, one key at a time as the phone sends them
+	fmt.Printf("\n2. Digit map %s\n", cfg.DialPlan.DigitMap)
+	dialed := ""
+	complete := false
+	for i := 0; i < len(digits) && !complete; i++ {
+		dialed += string(digits[i])
+		if n := slices.IndexFunc(plan.secrets, func(s secretCode) bool { return s.code == dialed }); n >= 0 {
+			fmt.Printf("   %-16s → secret code, dialing ends\n", dialed)
+			return simulateSecret(cfg, plan.secrets[n])
+		}
+		normalized, _ := plan.Normalize(dialed)
+		result, pattern := plan.Collect(dialed)
+
+		fmt.Printf("   %-16s", dialed)
+		if normalized != dialed {
+			fmt.Printf(" (as %s)", normalized)
+		}
+
+		switch result {
+		case matchNone:
+			fmt.Printf(" → no match: the caller would hear %s\n", cfg.progressToneName(progressUnassigned))
+			return false
+		case matchComplete:
+			fmt.Printf(" → complete (%s), dialing ends\n", pattern.source)
+			complete = true
+		case matchExtendable:
+			fmt.Printf(" → matches %s, short timer (%dms) running\n", pattern.source, cfg.DialPlan.ShortTimeoutMs)
+		case matchPartial:
+			fmt.Printf(" → partial (%s), long timer (%dms) running\n", pattern.source, cfg.DialPlan.LongTimeoutMs)
+		}
+	}
+
+	if !complete {
+		if result, _ := plan.Collect(dialed); result != matchExtendable {
+			fmt.Printf("   → number incomplete when the long timer expires: the caller would hear %s\n", cfg.progressToneName(progressIncomplete))
+			return false
+		}
+		fmt.Println("   → dialing ends when the short timer expires")
+	}
+	if len(dialed) < len(digits) {
+		fmt.Printf("   remaining keys %q are ignored once dialing has ended\n", digits[len(dialed):])
+	}
+
+	// Step 3: route selection on the canonical form of what was collected
+	fmt.Println("\n3. Route")
+	res, ok := plan.Resolve(dialed)
+	switch {
+	case !ok:
+		fmt.Printf("   no route matches %s\n", res.number)
+		if plan.world != nil {
+			fmt.Printf("   world numbering has nothing for it either\n")
+		}
+		fmt.Printf("   → the caller would hear %s\n", cfg.progressToneName(progressUnassigned))
+		return false
+	case res.extension != "":
+		fmt.Printf("   %s is an extension\n", res.number)
+		fmt.Println("\n4. Destination")
+		fmt.Printf("   extension %s: %s", res.extension, describeDestination(cfg, DestinationConfig{Type: "phone", User: res.extension}))
+		if description := cfg.Extensions[res.extension].Description; description != "" {
+			fmt.Printf(" — %s", description)
+		}
+		fmt.Println()
+		return true
+	case res.world != nil:
+		fmt.Printf("   no route matches %s; world numbering: %s\n", res.number, res.world)
+	default:
+		fmt.Printf("   route %d (%s) matches %s → %s\n", res.route+1, cfg.DialPlan.Routes[res.route].Pattern, res.number, res.destination)
+	}
+
+	// Step 4: the destination the caller would hear
+	fmt.Println("\n4. Destination")
+	if res.announcement != "" {
+		fmt.Printf("   first %s: %s\n", res.announcement, describeDestination(cfg, cfg.Destinations[res.announcement]))
+	}
+	dest := cfg.Destinations[res.destination]
+	printSimulatedDestination(cfg, res.destination)
+	if dest.Hidden {
+		fmt.Println("   hidden: only callers who have unlocked it with a secret code get through")
+	}
+
+	return true
+}
+
+// simulateSecret finishes a simulation that dialed a secret code
+func simulateSecret(cfg *Config, secret secretCode) bool {
+	fmt.Println("\n3. Secret code")
+	if len(secret.rhythm) > 0 {
+		gaps := make([]string, len(secret.rhythm))
+		for i, gap := range secret.rhythm {
+			gaps[i] = gap.String()
+		}
+		fmt.Printf("   %s, if dialed with gaps of %s (±%s)\n", secret.code, strings.Join(gaps, ", "), SECRET_RHYTHM_TOLERANCE)
+	}
+	fmt.Printf("   unlocks %s for the caller, who can dial its routes from then on\n", secret.destination)
+
+	fmt.Println("\n4. Destination")
+	printSimulatedDestination(cfg, secret.destination)
+	return true
+}
+
+// printSimulatedDestination describes the destination a simulated call
+// ends up at
+func printSimulatedDestination(cfg *Config, name string) {
+	dest := cfg.Destinations[name]
+	fmt.Printf("   %s: %s", name, describeDestination(cfg, dest))
+	if dest.Description != "" {
+		fmt.Printf(" — %s", dest.Description)
+	}
+	fmt.Println()
+	if cfg.Ambience.Enabled && dest.hasAmbience() {
+		fmt.Printf("   put through with call setup ambience, distance %.2f\n", ambienceDistance(cfg.Ambience, dest))
+	}
+}
+
+// checkPlaylist decodes every entry of a playlist destination. An entry
+// that can't be played is a warning, since the rest of the playlist still
+// plays; a playlist with nothing playable is a problem.
+func checkPlaylist(cfg *Config, prefix, name string, dest DestinationConfig) (problems, warnings int) {
+	path := cfg.ResolvePath(dest.File)
+	entries, err := parsePlaylist(path)
+	if err != nil {
+		fmt.Printf("❌ %sDestination %q: %v\n", prefix, name, err)
+		return 1, 0
+	}
+
+	playable := 0
+	var seconds float64
+	for _, entry := range entries {
+		samples, err := loadWAV(entry)
+		if err != nil {
+			fmt.Printf("⚠️  %sDestination %q: %v\n", prefix, name, err)
+			warnings++
+			continue
+		}
+		playable++
+		seconds += float64(len(samples)) / SAMPLE_RATE
+	}
+	if playable == 0 {
+		fmt.Printf("❌ %sDestination %q: nothing playable in %s\n", prefix, name, path)
+		return 1, warnings
+	}
+	fmt.Printf("✅ %sDestination %q: %s (%d entries, %.1fs)\n", prefix, name, path, playable, seconds)
+	return 0, warnings
+}
+
+// describeDestination summarizes a destination for display
+func describeDestination(cfg *Config, dest DestinationConfig) string {
+	switch dest.Type {
+	case "audio":
+		description := "audio " + cfg.ResolvePath(dest.File)
+		if dest.Loop {
+			description += " (looping)"
+		}
+		return description + describeEffects(dest.Effects)
+	case "playlist":
+		description := "playlist " + cfg.ResolvePath(dest.File)
+		switch {
+		case dest.Shuffle && dest.Loop:
+			description += " (shuffled, repeating)"
+		case dest.Shuffle:
+			description += " (shuffled)"
+		case dest.Loop:
+			description += " (repeating)"
+		}
+		return description + describeEffects(dest.Effects)
+	case "tone":
+		parts := make([]string, len(dest.Frequencies))
+		for i, freq := range dest.Frequencies {
+			parts[i] = fmt.Sprintf("%gHz", freq)
+		}
+		return "tone " + strings.Join(parts, "+") + describeEffects(dest.Effects)
+	case "peer":
+		if dest.Strip > 0 {
+			return fmt.Sprintf("peer %s (first %d digit(s) stripped)", dest.Peer, dest.Strip)
+		}
+		return "peer " + dest.Peer
+	case "sip_trunk":
+		if dest.Strip > 0 {
+			return fmt.Sprintf("SIP trunk %s (first %d digit(s) stripped)", dest.Trunk, dest.Strip)
+		}
+		return "SIP trunk " + dest.Trunk
+	case "action":
+		if len(dest.Command) > 0 {
+			return "action " + strings.Join(dest.Command, " ")
+		}
+		method := dest.Method
+		if method == "" {
+			method = "GET"
+			if dest.Body != "" {
+				method = "POST"
+			}
+		}
+		return "action " + method + " " + dest.URL
+	case "jukebox", "audiobook":
+		return dest.Type + " " + cfg.ResolvePath(dest.Directory)
+	case "admin":
+		return "admin menu (PIN protected)"
+	case "trunk":
+		if dest.File == "" {
+			return "trunk (ringing; 2600 Hz seizes it)"
+		}
+		return "trunk " + cfg.ResolvePath(dest.File) + " (2600 Hz seizes it)"
+	case "passport", "stats":
+		if len(cfg.TTS.Command) == 0 {
+			return dest.Type + " (beeps only; no tts configured)"
+		}
+		return dest.Type + " (read by " + cfg.TTS.Command[0] + ")"
+	case "phone":
+		if dest.User == "" {
+			return "phone (any registered)"
+		}
+		return "phone " + dest.User
+	default:
+		return dest.Type
+	}
+}
+
+// runSelfTestCommand implements "selftest": a scripted call against an
+// in-process server, exiting nonzero if any step fails
+func runSelfTestCommand(args []string) int {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to JSON config file (default: built-in test tone route)")
+	number := flags.String("number", "", "Number to dial (required with -config)")
+	exchangeName := flags.String("exchange", "", "Exchange to call into (default: the top-level one)")
+	flags.Parse(args)
+
+	cfg := selfTestConfig()
+	if *configPath != "" {
+		if *number == "" {
+			fmt.Fprintln(os.Stderr, "Usage: travel-by-telephone selftest [-config file -number digits]")
+			return 2
+		}
+		loaded, err := loadConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+			return 1
+		}
+		cfg, err = selectExchange(loaded, *exchangeName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+	} else if *number == "" {
+		*number = SELFTEST_NUMBER
+	}
+
+	if err := runSelfTest(cfg, *number); err != nil {
+		fmt.Printf("\n❌ Self-test failed: %v\n", err)
+		return 1
+	}
+	fmt.Println("\n🎉 Self-test passed")
+	return 0
+}
+
+// runRingCommand implements "ring -config <file> <user> <destination>":
+// it asks the running server, through its API, to ring a phone and
+// connect it to a destination once picked up
+func runRingCommand(args []string) int {
+	flags := flag.NewFlagSet("ring", flag.ExitOnError)
+	configPath := flags.String("config", "", "Path to the running server's JSON config file")
+	exchangeName := flags.String("exchange", "", "Exchange the phone is registered with (default: the top-level one)")
+	ringSeconds := flags.Int("ring", 0, "Seconds to ring before giving up (default 30)")
+	flags.Parse(args)
+
+	if *configPath == "" || flags.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "Usage: travel-by-telephone ring -config <file> [-exchange name] [-ring seconds] <user> <destination>")
+		return 2
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		return 1
+	}
+	if cfg.API.Listen == "" {
+		fmt.Fprintln(os.Stderr, "The server's API isn't enabled; set api.listen")
+		return 1
+	}
+	if *exchangeName == "" {
+		*exchangeName = cfg.Name
+	}
+
+	host, port, err := net.SplitHostPort(cfg.API.Listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Bad api.listen: %v\n", err)
+		return 1
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1" // Listening everywhere, so on loopback too
+	}
+	user, destination := flags.Arg(0), flags.Arg(1)
+	endpoint := fmt.Sprintf("http://%s/api/calls/%s/%s", net.JoinHostPort(host, port), url.PathEscape(*exchangeName), url.PathEscape(user))
+
+	body, _ := json.Marshal(CallRequest{Destination: destination, RingSeconds: *ringSeconds})
+	request, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if cfg.API.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+cfg.API.Token)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		fmt.Printf("❌ Failed to reach the server: %v\n", err)
+		return 1
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(response.Body).Decode(&failure)
+		fmt.Printf("❌ Couldn't ring %s: %s\n", user, failure.Error)
+		return 1
+	}
+	fmt.Printf("🛎️  Ringing %s; %q plays when it's picked up\n", user, destination)
+	return 0
+}
+
+// describeEffects lists a destination's effect chain, if any
+func describeEffects(effects []EffectConfig) string {
+	if len(effects) == 0 {
+		return ""
+	}
+	names := make([]string, len(effects))
+	for i, fx := range effects {
+		names[i] = fx.Type
+		if fx.Level != 0 {
+			names[i] += fmt.Sprintf(" %g", fx.Level)
+		}
+	}
+	return " through " + strings.Join(names, ", ")
+}
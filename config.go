@@ -0,0 +1,1089 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Default DSCP code points (RFC 4594)
+	DSCP_EF  = 46 // Expedited Forwarding, for voice media
+	DSCP_CS3 = 24 // Class Selector 3, for call signaling
+
+	// Default read timeout for the RTP receive loop
+	DEFAULT_RTP_READ_TIMEOUT_MS = 1000
+
+	// Default time a call may go without media from the phone
+	DEFAULT_MEDIA_TIMEOUT_SECONDS = 30
+
+	// Where calls are recorded, and their file names, by default
+	DEFAULT_RECORDING_DIRECTORY = "recordings"
+	DEFAULT_RECORDING_FILENAME  = "{timestamp}-{call_id}.wav"
+
+	// Dial plan defaults: any keys, completed by the interdigit timer
+	DEFAULT_DIGIT_MAP        = "[x*#]."
+	DEFAULT_LONG_TIMEOUT_MS  = 10000 // Waiting for digits a pattern still needs
+	DEFAULT_SHORT_TIMEOUT_MS = 3000  // Waiting for optional further digits
+
+	// Payphone defaults: a quarter for three minutes, with half a minute to
+	// find more change
+	DEFAULT_PAYPHONE_DEPOSIT       = 25
+	DEFAULT_PAYPHONE_MINUTES       = 3
+	DEFAULT_PAYPHONE_GRACE_SECONDS = 30
+)
+
+// Config holds the server configuration. It is loaded from an optional JSON
+// file given with -config; command line flags override file values.
+type Config struct {
+	BindIP        string          `json:"bind_ip"`
+	BindInterface string          `json:"bind_interface,omitempty"` // Follows the interface's address; all interfaces until it has one
+	SIPPort       int             `json:"sip_port"`                 // 0 picks any free port
+	MediaPort     int             `json:"media_port,omitempty"`     // One UDP port for every call's RTP and RTCP; 0 gives each a pair from the RTP range
+	QoS           QoSConfig       `json:"qos"`
+	Socket        SocketConfig    `json:"socket"`
+	TLS           TLSConfig       `json:"tls"`
+	Registrar     RegistrarConfig `json:"registrar"`
+	Security      SecurityConfig  `json:"security"`
+	Screening     ScreeningConfig `json:"screening"`
+
+	DialPlan     DialPlanConfig               `json:"dialplan"`
+	Destinations map[string]DestinationConfig `json:"destinations"`
+	Forwarding   map[string]ForwardingConfig  `json:"forwarding,omitempty"` // By phone user
+	Secrets      []SecretConfig               `json:"secrets,omitempty"`
+	Extensions   map[string]ExtensionConfig   `json:"extensions,omitempty"` // By number
+
+	// The top-level dial plan and destinations form the default exchange;
+	// Exchanges adds more, each with its own registrations and dial plan
+	Name      string           `json:"name,omitempty"`   // Default exchange name
+	Domain    string           `json:"domain,omitempty"` // SIP domain it answers for
+	Exchanges []ExchangeConfig `json:"exchanges,omitempty"`
+
+	Federation FederationConfig `json:"federation"`
+	SIPTrunks  []SIPTrunkConfig `json:"sip_trunks,omitempty"` // Provider accounts; their calls come in to the default exchange
+	WebSocket  WebSocketConfig  `json:"websocket"`
+	API        APIConfig        `json:"api"`
+	LAN        LANConfig        `json:"lan"`
+
+	// StateFile keeps what callers have done, such as secrets unlocked,
+	// across restarts. Without it, that is forgotten when the server stops.
+	StateFile string `json:"state_file,omitempty"`
+
+	Passport PassportConfig `json:"passport"`
+	TTS      TTSConfig      `json:"tts"`
+	Ambience AmbienceConfig `json:"ambience"`
+	Payphone PayphoneConfig `json:"payphone"`
+	TTY      TTYConfig      `json:"tty"`
+	Answer   AnswerConfig   `json:"answer"`
+	Messages MessagesConfig `json:"messages"`
+
+	Recording RecordingConfig `json:"recording"`
+
+	// IVRMode is "touchtone" (the default) or "rotary", for installations
+	// whose phones can't dial * or #: menus act on a digit and a pause,
+	// numbers end with a pause and changes are confirmed by dialing 1
+	IVRMode string `json:"ivr_mode,omitempty"`
+
+	// BargeIn stops a menu or question being read out as soon as the
+	// caller starts talking over it
+	BargeIn bool `json:"barge_in,omitempty"`
+
+	// Proxy runs the server as a stateless proxy and registrar: calls
+	// between registered phones are forwarded for them to talk directly,
+	// and nothing is answered with tones or media
+	Proxy bool `json:"proxy,omitempty"`
+
+	// VolumeDB adjusts the level of everything played to callers; the
+	// admin menu changes it while the server runs
+	VolumeDB int  `json:"volume_db"`
+	SIPTrace bool `json:"sip_trace"` // Print every SIP message sent and received
+
+	// MediaTimeoutSeconds is how long a call may go without RTP or RTCP
+	// from the phone, as when it loses power, before it is hung up; 0
+	// never hangs up. Calls on hold aren't timed.
+	MediaTimeoutSeconds int `json:"media_timeout_seconds"`
+
+	// UserAgent names the server in the Server and User-Agent headers of
+	// its messages; Travel-by-Telephone/1.0 if empty
+	UserAgent string `json:"user_agent,omitempty"`
+
+	baseDir string // Directory of the config file, for relative paths
+}
+
+// QoSConfig holds the DSCP values used to mark outgoing packets so that
+// routers with QoS enabled can prioritize voice traffic. Zero leaves the
+// socket's default marking untouched.
+type QoSConfig struct {
+	RTPDSCP int `json:"rtp_dscp"`
+	SIPDSCP int `json:"sip_dscp"`
+
+	// Redundancy sends RFC 2198 redundant audio to phones that offer it
+	Redundancy bool `json:"redundancy"`
+
+	// Codecs are the audio codecs calls may use, most preferred first:
+	// "G722", "PCMU" and "PCMA", in that order, by default
+	Codecs []string `json:"codecs,omitempty"`
+}
+
+// TLSConfig enables SIP over TLS (sips:) with a certificate and key in
+// PEM files. Without a certificate TLS is off.
+type TLSConfig struct {
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	Port     int    `json:"port,omitempty"` // 0 is the port after the SIP port, 5061 for 5060
+}
+
+// WebSocketConfig lets browser softphones connect with SIP over WebSocket
+type WebSocketConfig struct {
+	Listen string `json:"listen,omitempty"` // TCP address, e.g. ":8088"; empty disables
+	TLS    bool   `json:"tls,omitempty"`    // Serve wss: with the tls certificate
+
+	// STUNServer, e.g. "stun.l.google.com:19302", tells us the address
+	// browsers outside the NAT reach our RTP ports at; empty offers them
+	// only the local one
+	STUNServer string `json:"stun_server,omitempty"`
+
+	// AllowedOrigins are the web pages, e.g. "https://phone.example.com",
+	// whose scripts may connect. Empty allows only pages served from the
+	// host the browser reaches the listener at.
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+}
+
+// SocketConfig holds low-level tuning for the SIP and RTP sockets
+type SocketConfig struct {
+	ReusePort  bool `json:"reuse_port"`  // Set SO_REUSEPORT before binding
+	RecvBuffer int  `json:"recv_buffer"` // SO_RCVBUF in bytes, 0 = OS default
+	SendBuffer int  `json:"send_buffer"` // SO_SNDBUF in bytes, 0 = OS default
+
+	// RTPReadTimeoutMs bounds each blocking read in the RTP receive loop.
+	// Longer timeouts mean fewer wakeups; 0 blocks until a packet arrives.
+	RTPReadTimeoutMs int `json:"rtp_read_timeout_ms"`
+
+	// MaxMessage is the largest SIP message accepted over UDP, in bytes,
+	// 0 = SIP_UDP_MAX_MESSAGE; larger requests are refused with 513
+	MaxMessage int `json:"max_message"`
+}
+
+// RegistrarConfig limits the registration table
+type RegistrarConfig struct {
+	MaxRegistrations int `json:"max_registrations"`
+
+	// Bounds on how long a registration lasts, in seconds. Phones asking
+	// for less than MinExpires are refused with 423 and told the minimum;
+	// more than MaxExpires is cut short.
+	MinExpires int `json:"min_expires"`
+	MaxExpires int `json:"max_expires"`
+
+	// Users are the SIP users allowed to register, with their passwords.
+	// Extensions are allowed too; without any of either, every REGISTER is
+	// accepted.
+	Users  map[string]string `json:"users,omitempty"`
+	Realm  string            `json:"realm,omitempty"`  // Digest realm; the exchange's domain by default
+	SHA256 bool              `json:"sha256,omitempty"` // Offer SHA-256 digests as well as MD5, for phones that support them
+
+	Keepalive KeepaliveConfig `json:"keepalive"`
+}
+
+// KeepaliveConfig probes registered phones with OPTIONS, to notice one
+// that has gone offline long before its registration runs out
+type KeepaliveConfig struct {
+	Interval  int `json:"interval"`   // Seconds between probes; 0 disables them
+	MaxMissed int `json:"max_missed"` // Probes left unanswered in a row before a binding is removed
+}
+
+// SecurityConfig controls the defenses against SIP scanners probing
+// internet-exposed servers
+type SecurityConfig struct {
+	ScannerAction      string `json:"scanner_action"`       // "tarpit" (default), "silence" or "off"
+	TarpitDelayMs      int    `json:"tarpit_delay_ms"`      // How long tarpitted requests wait for their fake answer
+	RegisterStormUsers int    `json:"register_storm_users"` // Distinct users one address may REGISTER per minute
+}
+
+// DialPlanConfig describes how dialed digits become a destination
+type DialPlanConfig struct {
+	// Normalize rewrites dialed numbers to canonical form before matching
+	Normalize []NormalizeRuleConfig `json:"normalize"`
+
+	// DigitMap decides when dialing is complete, e.g. "(*xx|00x.|[1-9]xxx)"
+	DigitMap string `json:"digit_map"`
+
+	// Routes map canonical numbers to destinations; the first match wins
+	Routes []RouteConfig `json:"routes"`
+
+	LongTimeoutMs  int `json:"long_timeout_ms"`
+	ShortTimeoutMs int `json:"short_timeout_ms"`
+
+	// World resolves international numbers no route matched
+	World WorldConfig `json:"world"`
+
+	// TonePlan is the country whose dial, ringback, busy and reorder
+	// tones callers hear: "north_america" (the default), "uk", "etsi",
+	// "germany", "france" or "japan"
+	TonePlan string `json:"tone_plan,omitempty"`
+
+	// Tones picks the progress tone callers hear in each call state
+	// ("dial", "ringback", "busy", "reorder", "unassigned",
+	// "incomplete"), by name: "dial", "ringback", "busy", "reorder",
+	// "silence" or one of the "sit_" special information tones
+	Tones map[string]string `json:"tones,omitempty"`
+}
+
+// WorldConfig enables the world numbering plan: an international number
+// (prefix, country code, optional area code) plays a destination tagged
+// with that country, or with one nearby when there is none
+type WorldConfig struct {
+	Enabled      bool                `json:"enabled"`
+	Prefix       string              `json:"prefix"`       // International prefix after normalization, default "00"
+	Fallback     string              `json:"fallback"`     // Destination when nothing is near
+	Announcement string              `json:"announcement"` // Played first when content is from elsewhere
+	Neighbors    map[string][]string `json:"neighbors"`    // ISO code -> nearby countries, overriding the built-in table
+}
+
+// NormalizeRuleConfig is a regular expression rewrite, e.g. ^011 -> 00
+type NormalizeRuleConfig struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// RouteConfig maps a digit pattern to a named destination
+type RouteConfig struct {
+	Pattern     string `json:"pattern"`
+	Destination string `json:"destination"`
+}
+
+// DestinationConfig describes what a caller hears after dialing
+type DestinationConfig struct {
+	Type        string    `json:"type"` // "audio", "playlist", "tone", "peer", "phone", "action", "jukebox", "audiobook", "passport", "stats", "admin", "trunk" or "sip_trunk"
+	Description string    `json:"description,omitempty"`
+	File        string    `json:"file,omitempty"`        // audio, trunk: WAV file to play; playlist: M3U or PLS file
+	Loop        bool      `json:"loop,omitempty"`        // audio, playlist, trunk: restart at the end
+	Shuffle     bool      `json:"shuffle,omitempty"`     // playlist: play entries in random order
+	Frequencies []float64 `json:"frequencies,omitempty"` // tone: Hz, played together
+	Peer        string    `json:"peer,omitempty"`        // peer: installation to connect to
+	Strip       int       `json:"strip,omitempty"`       // peer, sip_trunk: leading digits removed before forwarding
+	Trunk       string    `json:"trunk,omitempty"`       // sip_trunk: SIP trunk to call out through
+	User        string    `json:"user,omitempty"`        // phone: registered user to ring, any if empty
+	Command     []string  `json:"command,omitempty"`     // action: program and arguments to run, templated
+	URL         string    `json:"url,omitempty"`         // action: HTTP request to make instead, templated
+	Method      string    `json:"method,omitempty"`      // action: HTTP method, GET or POST by default
+	Body        string    `json:"body,omitempty"`        // action: HTTP request body, templated
+	Success     string    `json:"success,omitempty"`     // action: prompt played when it worked
+	Failure     string    `json:"failure,omitempty"`     // action: prompt played when it didn't
+	Directory   string    `json:"directory,omitempty"`   // jukebox, audiobook: WAV files to play
+	PIN         string    `json:"pin,omitempty"`         // admin: digits to dial before the menu opens
+	Distance    float64   `json:"distance,omitempty"`    // How far away call setup ambience sounds, 0-1; 0 works it out from the country
+	Text        string    `json:"text,omitempty"`        // Sent instead to callers on a TTY
+
+	// ContentType is the type of an action's body. Without one a body
+	// starting with { or [ is JSON, and any other plain text.
+	ContentType string `json:"content_type,omitempty"`
+
+	// Hidden destinations are left out of world numbering, and their
+	// routes only work for callers who have unlocked them with a secret
+	Hidden bool `json:"hidden,omitempty"`
+
+	// Capacity limits how many callers are connected at once; the rest
+	// queue, hearing Hold, until a slot frees up. 0 means no limit.
+	Capacity int    `json:"capacity,omitempty"`
+	Hold     string `json:"hold,omitempty"` // Audio or tone destination played while queued
+
+	// Effects are applied in order to an audio or tone destination
+	Effects []EffectConfig `json:"effects,omitempty"`
+
+	// Catalog tags for world numbering
+	Country  string `json:"country,omitempty"`   // ISO 3166 code, e.g. "FR"
+	AreaCode string `json:"area_code,omitempty"` // Area code within the country, e.g. "1" for Paris
+	City     string `json:"city,omitempty"`
+}
+
+// playsAudio reports whether the destination is audio played straight
+// through, which can take effects and be used as hold music
+func (d DestinationConfig) playsAudio() bool {
+	return d.Type == "audio" || d.Type == "playlist" || d.Type == "tone"
+}
+
+// PassportConfig stamps a caller's passport for every destination they
+// visit. A passport destination reads the stamps back.
+type PassportConfig struct {
+	Enabled bool   `json:"enabled"`
+	Webhook string `json:"webhook,omitempty"` // URL POSTed a JSON event for each new stamp and each reading
+}
+
+// AmbienceConfig plays the sound of the call being put through before a
+// destination connects, sounding further away the further the destination
+// is from Home
+type AmbienceConfig struct {
+	Enabled bool   `json:"enabled"`
+	Home    string `json:"home,omitempty"` // ISO 3166 code of the country the installation is in
+}
+
+// PayphoneConfig makes phones behave like coin-first payphones: no dial
+// tone until a red box's coin tones pay the deposit, and more money asked
+// for as a call runs on
+type PayphoneConfig struct {
+	Enabled      bool     `json:"enabled"`
+	Phones       []string `json:"phones,omitempty"` // SIP users that are payphones; all phones if empty
+	Deposit      int      `json:"deposit"`          // Cents to pay before dialing
+	Minutes      int      `json:"minutes"`          // Talk time the deposit buys
+	Overtime     int      `json:"overtime"`         // Cents for each further period; 0 means the deposit again
+	GraceSeconds int      `json:"grace_seconds"`    // Time to pay overtime before being cut off
+}
+
+// overtime is what each period after the first costs
+func (p PayphoneConfig) overtime() int {
+	return cmp.Or(p.Overtime, p.Deposit)
+}
+
+// TTYConfig lets deaf and hard-of-hearing callers use the installation
+// from a TTY (TDD): once a caller types, prompts are sent as Baudot text
+// and destinations with text send that instead of their audio
+type TTYConfig struct {
+	Enabled bool     `json:"enabled"`
+	Phones  []string `json:"phones,omitempty"` // SIP users that are always TTYs, sent text from the start
+}
+
+// RecordingConfig records what callers say, each call to a WAV file in
+// Directory named by the Filename template. The template's {call_id},
+// {caller} and {timestamp} are replaced by the call's.
+type RecordingConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Directory string `json:"directory"` // Relative to the config file
+	Filename  string `json:"filename"`
+
+	// TrimSilence leaves out the silences between what callers say,
+	// keeping RECORDING_KEPT_PAUSE of each so that sentences stay apart
+	TrimSilence bool `json:"trim_silence"`
+}
+
+// AnswerConfig is how calls from phones are answered: 100 Trying at
+// once, then, if asked, 180 Ringing, and 200 OK once DelayMs has passed
+type AnswerConfig struct {
+	DelayMs    int  `json:"delay_ms"`    // From the INVITE to 200 OK
+	Ringing    bool `json:"ringing"`     // Send 180 Ringing while waiting to answer
+	EarlyMedia bool `json:"early_media"` // Send SDP with the 180 and play ringback until the answer
+}
+
+// MessagesConfig is what happens to SIP MESSAGE requests, short texts
+// other SIP clients send. Each is logged; the handler can also post it to
+// a webhook or speak it into the call the addressed phone is on.
+type MessagesConfig struct {
+	Handler string `json:"handler,omitempty"` // "log" (the default), "webhook" or "speak"
+	Webhook string `json:"webhook,omitempty"` // Receives each message as JSON, for the webhook handler
+}
+
+// TTSConfig names a speech synthesizer: a program that turns text into a
+// WAV file, e.g. ["espeak-ng", "--stdout", "{{.Text}}"]. Arguments are
+// templates; see synthesizeSpeech.
+type TTSConfig struct {
+	Command []string `json:"command,omitempty"`
+}
+
+// SecretConfig is a key sequence that unlocks a destination for the caller
+// and connects them to it, e.g. a hidden one
+type SecretConfig struct {
+	Code        string `json:"code"`
+	Destination string `json:"destination"`
+	RhythmMs    []int  `json:"rhythm_ms,omitempty"` // Gaps between keys, for codes that must be dialed in time
+}
+
+// ExtensionConfig is a phone of the exchange's own, known by its number:
+// it registers as that number with the password, and dialing the number
+// rings it
+type ExtensionConfig struct {
+	Password    string `json:"password"`
+	Description string `json:"description,omitempty"` // e.g. "Kitchen"
+
+	// AdvertiseIP is the server address given the phone in Contact, Via
+	// and SDP, instead of the one it is reached from; for a phone behind
+	// port forwarding or an adapter the routing table doesn't know
+	AdvertiseIP string `json:"advertise_ip,omitempty"`
+}
+
+// EffectConfig is one stage of a destination's effect chain
+type EffectConfig struct {
+	Type  string  `json:"type"`            // "crackle", "hiss", "longdistance" or "reverb"
+	Level float64 `json:"level,omitempty"` // Strength from 0 to 1; 0 uses the effect's default
+}
+
+// ScreeningConfig decides which callers from outside, such as peer
+// installations, get through. Lists hold caller ID patterns written like
+// digit map patterns.
+type ScreeningConfig struct {
+	Allow          []string `json:"allow,omitempty"`           // If set, only these callers get through
+	Block          []string `json:"block,omitempty"`           // These callers never get through
+	BlockAnonymous bool     `json:"block_anonymous,omitempty"` // Turn away callers without caller ID
+	Action         string   `json:"action,omitempty"`          // "reject" (default), "drop" or "honeypot"
+	Honeypot       string   `json:"honeypot,omitempty"`        // Destination for blocked callers with "honeypot"
+}
+
+// ForwardingConfig is where calls to a phone go instead of ringing it.
+// Numbers are dialed through the exchange's dial plan, so a call can be
+// forwarded to another phone, a peer installation or a recording.
+type ForwardingConfig struct {
+	Always          string `json:"always,omitempty"`            // Forward every call here
+	NoAnswer        string `json:"no_answer,omitempty"`         // Forward here if the phone doesn't answer
+	NoAnswerSeconds int    `json:"no_answer_seconds,omitempty"` // Ring this long first; 0 means 20
+	DoNotDisturb    bool   `json:"do_not_disturb,omitempty"`    // Don't ring the phone at all
+	DND             string `json:"dnd,omitempty"`               // Forward here in do not disturb, or if the phone declines
+}
+
+// Validate checks forwarding numbers are made of keys a phone can dial
+func (f ForwardingConfig) Validate() error {
+	for _, number := range []string{f.Always, f.NoAnswer, f.DND} {
+		if strings.Trim(number, DIGIT_SYMBOLS) != "" {
+			return fmt.Errorf("forwarding number %q may only contain 0-9, * and #", number)
+		}
+	}
+	if f.NoAnswerSeconds < 0 {
+		return fmt.Errorf("no_answer_seconds must not be negative, got %d", f.NoAnswerSeconds)
+	}
+	return nil
+}
+
+// ExchangeConfig describes an additional virtual exchange. Exchanges on the
+// same address are told apart by the domain in the Request-URI; give one
+// its own bind_ip or sip_port to run it on a separate socket. Unset
+// address, registrar and timer settings are inherited from the top level.
+type ExchangeConfig struct {
+	Name         string                       `json:"name"`
+	Domain       string                       `json:"domain"`
+	BindIP       string                       `json:"bind_ip"`
+	SIPPort      int                          `json:"sip_port"`
+	Registrar    RegistrarConfig              `json:"registrar"`
+	DialPlan     DialPlanConfig               `json:"dialplan"`
+	Destinations map[string]DestinationConfig `json:"destinations"`
+	Forwarding   map[string]ForwardingConfig  `json:"forwarding,omitempty"`
+	Secrets      []SecretConfig               `json:"secrets,omitempty"`
+	Extensions   map[string]ExtensionConfig   `json:"extensions,omitempty"`
+}
+
+// FederationConfig lets installations call each other over an
+// authenticated TCP tunnel. Calls from peers are handled by the default
+// exchange.
+type FederationConfig struct {
+	Name   string       `json:"name"`   // How this installation introduces itself to peers
+	Listen string       `json:"listen"` // TCP address for incoming peer calls, e.g. ":5070"; empty disables
+	Peers  []PeerConfig `json:"peers"`
+}
+
+// APIConfig enables the HTTP API for changing settings while the server
+// runs
+type APIConfig struct {
+	Listen string `json:"listen"` // TCP address, e.g. "127.0.0.1:8080"; empty disables
+	Token  string `json:"token"`  // Bearer token required on every request, if set
+}
+
+// LANConfig runs services on an Ethernet port with a phone adapter
+// patched straight into it, so it gets an address, the time and its
+// settings with no router in between. The interface needs a static IPv4
+// address; the services only answer there.
+type LANConfig struct {
+	Interface     string            `json:"interface,omitempty"`  // e.g. "eth1" or "en5"
+	DHCP          bool              `json:"dhcp"`                 // Hand out addresses
+	PoolStart     string            `json:"pool_start,omitempty"` // First address handed out; .100 of the subnet by default
+	PoolSize      int               `json:"pool_size"`            // How many addresses to hand out
+	LeaseSeconds  int               `json:"lease_seconds"`        // How long a lease lasts
+	NTP           bool              `json:"ntp"`                  // Answer time requests, and tell DHCP clients to ask
+	Provision     bool              `json:"provision"`            // Serve a profile and tell DHCP clients where it is
+	ProvisionPort int               `json:"provision_port"`       // HTTP port for the profile
+	Profile       string            `json:"profile,omitempty"`    // Template for the profile; a PAP2 flat profile by default
+	Users         map[string]string `json:"users,omitempty"`      // SIP user for each adapter, by MAC address; 1001 otherwise
+}
+
+// enabled reports whether any service is on
+func (l LANConfig) enabled() bool {
+	return l.DHCP || l.NTP || l.Provision
+}
+
+// userFor is the SIP user for the adapter with the given MAC address
+func (l LANConfig) userFor(mac string) string {
+	for key, user := range l.Users {
+		if hw, err := net.ParseMAC(key); err == nil && hw.String() == mac {
+			return user
+		}
+	}
+	return DEFAULT_PROVISION_USER
+}
+
+// PeerConfig is another installation. Both sides list each other with the
+// same secret.
+type PeerConfig struct {
+	Name    string `json:"name"`
+	Address string `json:"address"` // host:port of the peer's federation listener
+	Secret  string `json:"secret"`
+}
+
+// SIPTrunkConfig is an account with a SIP provider, which the server
+// registers with as a phone would so calls to the account reach it
+type SIPTrunkConfig struct {
+	Name         string `json:"name"`
+	Server       string `json:"server"` // Provider's registrar, host or host:port
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	AuthUsername string `json:"auth_username,omitempty"` // For digest challenges, if not username
+	Domain       string `json:"domain,omitempty"`        // Of the account's address; the server's host by default
+	Expires      int    `json:"expires,omitempty"`       // Registration interval asked for, in seconds; 0 means 600
+	Destination  string `json:"destination,omitempty"`   // Where incoming calls go; any registered phone if empty
+}
+
+// host is the provider's host, without a port
+func (t SIPTrunkConfig) host() string {
+	if host, _, err := net.SplitHostPort(t.Server); err == nil {
+		return host
+	}
+	return strings.Trim(t.Server, "[]")
+}
+
+// address is the provider's host and port, 5060 if not given
+func (t SIPTrunkConfig) address() string {
+	if _, _, err := net.SplitHostPort(t.Server); err == nil {
+		return t.Server
+	}
+	return net.JoinHostPort(t.host(), strconv.Itoa(SIP_PORT))
+}
+
+// domain is the domain of the account's address
+func (t SIPTrunkConfig) domain() string {
+	return cmp.Or(t.Domain, t.host())
+}
+
+// SIPTrunk returns the SIP trunk with the given name
+func (c *Config) SIPTrunk(name string) (SIPTrunkConfig, bool) {
+	for _, trunk := range c.SIPTrunks {
+		if trunk.Name == name {
+			return trunk, true
+		}
+	}
+	return SIPTrunkConfig{}, false
+}
+
+// Peer returns the peer with the given name
+func (f *FederationConfig) Peer(name string) (PeerConfig, bool) {
+	for _, peer := range f.Peers {
+		if peer.Name == name {
+			return peer, true
+		}
+	}
+	return PeerConfig{}, false
+}
+
+// defaultConfig returns the configuration used when no file is given
+func defaultConfig() *Config {
+	return &Config{
+		Name:                "default",
+		SIPPort:             SIP_PORT,
+		SIPTrace:            true,
+		MediaTimeoutSeconds: DEFAULT_MEDIA_TIMEOUT_SECONDS,
+		QoS: QoSConfig{
+			RTPDSCP:    DSCP_EF,
+			SIPDSCP:    DSCP_CS3,
+			Redundancy: true,
+		},
+		Socket: SocketConfig{
+			RTPReadTimeoutMs: DEFAULT_RTP_READ_TIMEOUT_MS,
+			MaxMessage:       SIP_UDP_MAX_MESSAGE,
+		},
+		Registrar: RegistrarConfig{
+			MaxRegistrations: DEFAULT_MAX_REGISTRATIONS,
+			MinExpires:       DEFAULT_MIN_REGISTER_EXPIRES,
+			MaxExpires:       DEFAULT_MAX_REGISTER_EXPIRES,
+			Keepalive: KeepaliveConfig{
+				Interval:  DEFAULT_KEEPALIVE_INTERVAL,
+				MaxMissed: DEFAULT_KEEPALIVE_MAX_MISSED,
+			},
+		},
+		Security: SecurityConfig{
+			ScannerAction:      "tarpit",
+			TarpitDelayMs:      DEFAULT_TARPIT_DELAY_MS,
+			RegisterStormUsers: DEFAULT_REGISTER_STORM_USERS,
+		},
+		Recording: RecordingConfig{
+			Directory: DEFAULT_RECORDING_DIRECTORY,
+			Filename:  DEFAULT_RECORDING_FILENAME,
+		},
+		Payphone: PayphoneConfig{
+			Deposit:      DEFAULT_PAYPHONE_DEPOSIT,
+			Minutes:      DEFAULT_PAYPHONE_MINUTES,
+			GraceSeconds: DEFAULT_PAYPHONE_GRACE_SECONDS,
+		},
+		DialPlan: DialPlanConfig{
+			DigitMap:       DEFAULT_DIGIT_MAP,
+			LongTimeoutMs:  DEFAULT_LONG_TIMEOUT_MS,
+			ShortTimeoutMs: DEFAULT_SHORT_TIMEOUT_MS,
+		},
+		LAN: LANConfig{
+			PoolSize:      DEFAULT_DHCP_POOL_SIZE,
+			LeaseSeconds:  DEFAULT_DHCP_LEASE_SECONDS,
+			ProvisionPort: DEFAULT_PROVISION_PORT,
+		},
+	}
+}
+
+// loadConfig reads a JSON config file on top of the defaults
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	cfg.baseDir = filepath.Dir(path)
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// ResolvePath interprets paths in the config relative to the config file
+func (c *Config) ResolvePath(path string) string {
+	if path == "" || filepath.IsAbs(path) || c.baseDir == "" {
+		return path
+	}
+	return filepath.Join(c.baseDir, path)
+}
+
+// Validate checks the configuration for out-of-range values
+func (c *Config) Validate() error {
+	if c.SIPPort < 0 || c.SIPPort > 65535 {
+		return fmt.Errorf("sip_port must be between 0 and 65535, got %d", c.SIPPort)
+	}
+	if c.MediaPort < 0 || c.MediaPort > 65535 {
+		return fmt.Errorf("media_port must be between 0 and 65535, got %d", c.MediaPort)
+	}
+	if c.MediaPort != 0 && c.MediaPort == c.SIPPort {
+		return fmt.Errorf("media_port can't be the SIP port, %d", c.SIPPort)
+	}
+	if c.BindIP != "" && c.BindInterface != "" {
+		return fmt.Errorf("bind_ip and bind_interface can't both be set")
+	}
+	if c.QoS.RTPDSCP < 0 || c.QoS.RTPDSCP > 63 {
+		return fmt.Errorf("qos.rtp_dscp must be between 0 and 63, got %d", c.QoS.RTPDSCP)
+	}
+	if c.QoS.SIPDSCP < 0 || c.QoS.SIPDSCP > 63 {
+		return fmt.Errorf("qos.sip_dscp must be between 0 and 63, got %d", c.QoS.SIPDSCP)
+	}
+	for _, name := range c.QoS.Codecs {
+		if codecNamed(name) == nil {
+			return fmt.Errorf("qos.codecs: unknown codec %q", name)
+		}
+	}
+	if c.Socket.RecvBuffer < 0 || c.Socket.SendBuffer < 0 {
+		return fmt.Errorf("socket buffer sizes must not be negative")
+	}
+	if c.VolumeDB < MIN_VOLUME_DB || c.VolumeDB > MAX_VOLUME_DB {
+		return fmt.Errorf("volume_db must be between %d and %d, got %d", MIN_VOLUME_DB, MAX_VOLUME_DB, c.VolumeDB)
+	}
+	if c.Answer.DelayMs < 0 || c.Answer.DelayMs > MAX_ANSWER_DELAY_MS {
+		return fmt.Errorf("answer.delay_ms must be between 0 and %d, got %d", MAX_ANSWER_DELAY_MS, c.Answer.DelayMs)
+	}
+	if c.Answer.EarlyMedia && !c.Answer.Ringing {
+		return fmt.Errorf("answer.early_media needs answer.ringing")
+	}
+	if c.LAN.enabled() {
+		if c.LAN.Interface == "" {
+			return fmt.Errorf("lan.interface is required for DHCP, NTP or provisioning")
+		}
+		if c.LAN.PoolStart != "" && net.ParseIP(c.LAN.PoolStart).To4() == nil {
+			return fmt.Errorf("lan.pool_start: %q is not an IPv4 address", c.LAN.PoolStart)
+		}
+		if c.LAN.PoolSize < 1 || c.LAN.PoolSize > 253 {
+			return fmt.Errorf("lan.pool_size must be between 1 and 253, got %d", c.LAN.PoolSize)
+		}
+		if c.LAN.LeaseSeconds < 60 {
+			return fmt.Errorf("lan.lease_seconds must be at least 60, got %d", c.LAN.LeaseSeconds)
+		}
+		for mac := range c.LAN.Users {
+			if _, err := net.ParseMAC(mac); err != nil {
+				return fmt.Errorf("lan.users: %v", err)
+			}
+		}
+		if c.LAN.ProvisionPort < 1 || c.LAN.ProvisionPort > 65535 {
+			return fmt.Errorf("lan.provision_port must be between 1 and 65535, got %d", c.LAN.ProvisionPort)
+		}
+	}
+	if c.Ambience.Home != "" && countryByISO(c.Ambience.Home) == nil {
+		return fmt.Errorf("ambience.home: unknown country %q", c.Ambience.Home)
+	}
+	if strings.ContainsAny(c.UserAgent, "\r\n") {
+		return fmt.Errorf("user_agent must be a single line, got %q", c.UserAgent)
+	}
+	switch c.IVRMode {
+	case "", "touchtone", "rotary":
+	default:
+		return fmt.Errorf("ivr_mode must be \"touchtone\" or \"rotary\", got %q", c.IVRMode)
+	}
+	if c.Payphone.Enabled {
+		if c.Payphone.Deposit < 5 || c.Payphone.Deposit%5 != 0 {
+			return fmt.Errorf("payphone.deposit must be a positive multiple of 5 cents, got %d", c.Payphone.Deposit)
+		}
+		if c.Payphone.Overtime < 0 || c.Payphone.Overtime%5 != 0 {
+			return fmt.Errorf("payphone.overtime must be a multiple of 5 cents, got %d", c.Payphone.Overtime)
+		}
+		if c.Payphone.Minutes < 1 || c.Payphone.GraceSeconds < 1 {
+			return fmt.Errorf("payphone.minutes and payphone.grace_seconds must be positive")
+		}
+	}
+	if c.Recording.Enabled && (c.Recording.Directory == "" || c.Recording.Filename == "") {
+		return fmt.Errorf("recording.directory and recording.filename are required when recording is enabled")
+	}
+	if c.MediaTimeoutSeconds < 0 {
+		return fmt.Errorf("media_timeout_seconds must not be negative, got %d", c.MediaTimeoutSeconds)
+	}
+	if c.Socket.RTPReadTimeoutMs < 0 {
+		return fmt.Errorf("socket.rtp_read_timeout_ms must not be negative, got %d", c.Socket.RTPReadTimeoutMs)
+	}
+	if c.Socket.MaxMessage < 0 || c.Socket.MaxMessage > SIP_UDP_MAX_MESSAGE {
+		return fmt.Errorf("socket.max_message must be between 0 and %d, got %d", SIP_UDP_MAX_MESSAGE, c.Socket.MaxMessage)
+	}
+	if len(c.Federation.Peers) > 0 && c.Federation.Name == "" {
+		return fmt.Errorf("federation.name is required when peers are configured")
+	}
+	for i, peer := range c.Federation.Peers {
+		if peer.Name == "" || peer.Address == "" || peer.Secret == "" {
+			return fmt.Errorf("federation.peers[%d]: name, address and secret are required", i)
+		}
+	}
+	trunks := make(map[string]bool)
+	for i, trunk := range c.SIPTrunks {
+		if trunk.Name == "" || trunk.Server == "" || trunk.Username == "" || trunk.Password == "" {
+			return fmt.Errorf("sip_trunks[%d]: name, server, username and password are required", i)
+		}
+		if trunks[trunk.Name] {
+			return fmt.Errorf("sip trunk %q is defined twice", trunk.Name)
+		}
+		trunks[trunk.Name] = true
+		if trunk.Expires < 0 {
+			return fmt.Errorf("sip trunk %q: expires must not be negative, got %d", trunk.Name, trunk.Expires)
+		}
+		if _, ok := c.Destinations[trunk.Destination]; trunk.Destination != "" && !ok {
+			return fmt.Errorf("sip trunk %q: unknown destination %q", trunk.Name, trunk.Destination)
+		}
+	}
+	switch c.Security.ScannerAction {
+	case "tarpit", "silence", "off":
+	default:
+		return fmt.Errorf("security.scanner_action must be tarpit, silence or off, got %q", c.Security.ScannerAction)
+	}
+	if c.Security.TarpitDelayMs < 0 {
+		return fmt.Errorf("security.tarpit_delay_ms must not be negative, got %d", c.Security.TarpitDelayMs)
+	}
+	if c.Security.RegisterStormUsers < 1 {
+		return fmt.Errorf("security.register_storm_users must be at least 1, got %d", c.Security.RegisterStormUsers)
+	}
+	for user, password := range c.Registrar.Users {
+		if user == "" || password == "" {
+			return fmt.Errorf("registrar.users: every user needs a name and a password")
+		}
+	}
+	for number, ext := range c.Extensions {
+		if number == "" || strings.Trim(number, DIGIT_SYMBOLS) != "" {
+			return fmt.Errorf("extension %q may only contain 0-9, * and #", number)
+		}
+		if ext.Password == "" {
+			return fmt.Errorf("extension %s needs a password", number)
+		}
+		if _, ok := c.Registrar.Users[number]; ok {
+			return fmt.Errorf("extension %s is also in registrar.users", number)
+		}
+		if ext.AdvertiseIP != "" && net.ParseIP(ext.AdvertiseIP) == nil {
+			return fmt.Errorf("extension %s: advertise_ip %q isn't an IP address", number, ext.AdvertiseIP)
+		}
+	}
+	if c.Registrar.MaxRegistrations < 1 {
+		return fmt.Errorf("registrar.max_registrations must be at least 1, got %d", c.Registrar.MaxRegistrations)
+	}
+	if c.Registrar.MinExpires < 1 || c.Registrar.MaxExpires < c.Registrar.MinExpires {
+		return fmt.Errorf("registrar.min_expires must be at least 1 and max_expires no less, got %d and %d", c.Registrar.MinExpires, c.Registrar.MaxExpires)
+	}
+	if c.Registrar.Keepalive.Interval < 0 {
+		return fmt.Errorf("registrar.keepalive.interval must not be negative, got %d", c.Registrar.Keepalive.Interval)
+	}
+	if c.Registrar.Keepalive.MaxMissed < 1 {
+		return fmt.Errorf("registrar.keepalive.max_missed must be at least 1, got %d", c.Registrar.Keepalive.MaxMissed)
+	}
+	if c.DialPlan.LongTimeoutMs <= 0 || c.DialPlan.ShortTimeoutMs <= 0 {
+		return fmt.Errorf("dialplan timeouts must be positive")
+	}
+	if _, ok := tonePlans[c.DialPlan.TonePlan]; !ok && c.DialPlan.TonePlan != "" {
+		return fmt.Errorf("dialplan.tone_plan: unknown tone plan %q", c.DialPlan.TonePlan)
+	}
+	for state, tone := range c.DialPlan.Tones {
+		if _, ok := defaultProgressTones[progressState(state)]; !ok {
+			return fmt.Errorf("dialplan.tones: unknown call state %q", state)
+		}
+		if _, ok := progressTones[tone]; !ok {
+			return fmt.Errorf("dialplan.tones: unknown tone %q for %s", tone, state)
+		}
+	}
+	for name, dest := range c.Destinations {
+		switch dest.Type {
+		case "audio":
+			if dest.File == "" {
+				return fmt.Errorf("destination %q: audio destinations need a file", name)
+			}
+		case "playlist":
+			if dest.File == "" {
+				return fmt.Errorf("destination %q: playlist destinations need a file", name)
+			}
+		case "tone":
+			if len(dest.Frequencies) == 0 {
+				return fmt.Errorf("destination %q: tone destinations need frequencies", name)
+			}
+		case "peer":
+			if _, ok := c.Federation.Peer(dest.Peer); !ok {
+				return fmt.Errorf("destination %q: unknown peer %q", name, dest.Peer)
+			}
+			if dest.Strip < 0 {
+				return fmt.Errorf("destination %q: strip must not be negative", name)
+			}
+		case "sip_trunk":
+			if _, ok := c.SIPTrunk(dest.Trunk); !ok {
+				return fmt.Errorf("destination %q: unknown sip trunk %q", name, dest.Trunk)
+			}
+			if dest.Strip < 0 {
+				return fmt.Errorf("destination %q: strip must not be negative", name)
+			}
+		case "phone", "stats", "trunk":
+		case "passport":
+			if !c.Passport.Enabled {
+				return fmt.Errorf("destination %q: passport destinations need passport.enabled", name)
+			}
+		case "admin":
+			if dest.PIN == "" || strings.Trim(dest.PIN, "0123456789") != "" {
+				return fmt.Errorf("destination %q: admin destinations need a pin of digits", name)
+			}
+		case "jukebox", "audiobook":
+			if dest.Directory == "" {
+				return fmt.Errorf("destination %q: %s destinations need a directory", name, dest.Type)
+			}
+		case "action":
+			if (len(dest.Command) == 0) == (dest.URL == "") {
+				return fmt.Errorf("destination %q: action destinations need either a command or a url", name)
+			}
+			if err := checkActionTemplates(dest); err != nil {
+				return fmt.Errorf("destination %q: %v", name, err)
+			}
+			for _, prompt := range []string{dest.Success, dest.Failure} {
+				if prompt == "" {
+					continue
+				}
+				if p, ok := c.Destinations[prompt]; !ok || (p.Type != "audio" && p.Type != "tone") {
+					return fmt.Errorf("destination %q: prompt %q must be an audio or tone destination", name, prompt)
+				}
+			}
+		default:
+			return fmt.Errorf("destination %q: unknown type %q", name, dest.Type)
+		}
+		if len(dest.Effects) > 0 && !dest.playsAudio() && dest.Type != "trunk" {
+			return fmt.Errorf("destination %q: effects only apply to audio, playlist, tone and trunk destinations", name)
+		}
+		for _, fx := range dest.Effects {
+			if _, ok := defaultEffectLevels[fx.Type]; !ok {
+				return fmt.Errorf("destination %q: unknown effect %q", name, fx.Type)
+			}
+			if fx.Level < 0 || fx.Level > 1 {
+				return fmt.Errorf("destination %q: effect %q level must be between 0 and 1", name, fx.Type)
+			}
+		}
+		if dest.Distance < 0 || dest.Distance > 1 {
+			return fmt.Errorf("destination %q: distance must be between 0 and 1", name)
+		}
+		if dest.Capacity < 0 {
+			return fmt.Errorf("destination %q: capacity must not be negative", name)
+		}
+		if dest.Hold != "" {
+			hold, ok := c.Destinations[dest.Hold]
+			if !ok {
+				return fmt.Errorf("destination %q: unknown hold destination %q", name, dest.Hold)
+			}
+			if !hold.playsAudio() {
+				return fmt.Errorf("destination %q: hold destination %q must be audio, playlist or tone", name, dest.Hold)
+			}
+		}
+	}
+	switch c.Screening.Action {
+	case "", "reject", "drop":
+	case "honeypot":
+		if _, ok := c.Destinations[c.Screening.Honeypot]; !ok {
+			return fmt.Errorf("screening.honeypot: unknown destination %q", c.Screening.Honeypot)
+		}
+	default:
+		return fmt.Errorf("screening.action must be reject, drop or honeypot, got %q", c.Screening.Action)
+	}
+	if _, err := newCallScreen(c.Screening); err != nil {
+		return err
+	}
+	if c.Passport.Webhook != "" {
+		if u, err := url.Parse(c.Passport.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("passport.webhook must be an http or https URL, got %q", c.Passport.Webhook)
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be given together")
+	}
+	if c.TLS.Port < 0 || c.TLS.Port > 65535 {
+		return fmt.Errorf("tls.port must be 0-65535, got %d", c.TLS.Port)
+	}
+	if c.WebSocket.TLS && c.TLS.CertFile == "" {
+		return fmt.Errorf("websocket.tls needs tls.cert_file and tls.key_file")
+	}
+	for _, origin := range c.WebSocket.AllowedOrigins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return fmt.Errorf("websocket.allowed_origins must be origins like https://host[:port], got %q", origin)
+		}
+	}
+	switch c.Messages.Handler {
+	case "", "log", "speak":
+	case "webhook":
+		if u, err := url.Parse(c.Messages.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("messages.webhook must be an http or https URL, got %q", c.Messages.Webhook)
+		}
+	default:
+		return fmt.Errorf("messages.handler must be log, webhook or speak, got %q", c.Messages.Handler)
+	}
+	if err := checkTTSTemplates(c.TTS); err != nil {
+		return fmt.Errorf("tts.command: %v", err)
+	}
+	for user, rules := range c.Forwarding {
+		if err := rules.Validate(); err != nil {
+			return fmt.Errorf("forwarding for %q: %v", user, err)
+		}
+	}
+	if _, err := newDialPlan(c); err != nil {
+		return err
+	}
+
+	if len(c.Exchanges) == 0 {
+		return nil
+	}
+	names := make(map[string]bool)
+	domains := make(map[string]string) // "address domain" -> exchange
+	for _, ex := range c.ExchangeConfigs() {
+		if names[ex.Name] {
+			return fmt.Errorf("exchange %q is defined twice", ex.Name)
+		}
+		names[ex.Name] = true
+
+		key := ex.ListenAddr() + " " + strings.ToLower(ex.Domain)
+		if other, ok := domains[key]; ok {
+			return fmt.Errorf("exchanges %q and %q both answer for domain %q on %s", other, ex.Name, ex.Domain, ex.ListenAddr())
+		}
+		domains[key] = ex.Name
+
+		if ex == c {
+			continue
+		}
+		if ex.Name == "" {
+			return fmt.Errorf("exchanges need a name")
+		}
+		if err := ex.Validate(); err != nil {
+			return fmt.Errorf("exchange %q: %v", ex.Name, err)
+		}
+	}
+	return nil
+}
+
+// SIPUsers are the users allowed to register, with their passwords: the
+// registrar's users and the extensions
+func (c *Config) SIPUsers() map[string]string {
+	if len(c.Extensions) == 0 {
+		return c.Registrar.Users
+	}
+	users := maps.Clone(c.Registrar.Users)
+	if users == nil {
+		users = make(map[string]string)
+	}
+	for number, ext := range c.Extensions {
+		users[number] = ext.Password
+	}
+	return users
+}
+
+// ListenAddr is the SIP address the config binds to
+func (c *Config) ListenAddr() string {
+	return net.JoinHostPort(c.BindIP, strconv.Itoa(c.SIPPort))
+}
+
+// ExchangeConfigs returns a complete config for every exchange, the
+// default exchange (c itself) first
+func (c *Config) ExchangeConfigs() []*Config {
+	configs := []*Config{c}
+
+	for _, ex := range c.Exchanges {
+		derived := *c
+		derived.Name = ex.Name
+		derived.Domain = ex.Domain
+		derived.Exchanges = nil
+
+		// Calls from trunks come in to the default exchange; the others
+		// only call out through them
+		derived.SIPTrunks = nil
+		for _, trunk := range c.SIPTrunks {
+			trunk.Destination = ""
+			derived.SIPTrunks = append(derived.SIPTrunks, trunk)
+		}
+		derived.DialPlan = ex.DialPlan
+		derived.Destinations = ex.Destinations
+		derived.Forwarding = ex.Forwarding
+		derived.Secrets = ex.Secrets
+		derived.Extensions = ex.Extensions
+
+		if ex.BindIP != "" {
+			derived.BindIP = ex.BindIP
+			derived.BindInterface = ""
+		}
+		if ex.SIPPort != 0 {
+			derived.SIPPort = ex.SIPPort
+		}
+		if ex.Registrar.MaxRegistrations != 0 {
+			derived.Registrar.MaxRegistrations = ex.Registrar.MaxRegistrations
+		}
+		if ex.Registrar.Users != nil {
+			derived.Registrar.Users = ex.Registrar.Users
+			derived.Registrar.Realm = ex.Registrar.Realm
+			derived.Registrar.SHA256 = ex.Registrar.SHA256
+		}
+		if derived.DialPlan.DigitMap == "" {
+			derived.DialPlan.DigitMap = DEFAULT_DIGIT_MAP
+		}
+		if derived.DialPlan.LongTimeoutMs == 0 {
+			derived.DialPlan.LongTimeoutMs = c.DialPlan.LongTimeoutMs
+		}
+		if derived.DialPlan.ShortTimeoutMs == 0 {
+			derived.DialPlan.ShortTimeoutMs = c.DialPlan.ShortTimeoutMs
+		}
+		if derived.DialPlan.TonePlan == "" {
+			derived.DialPlan.TonePlan = c.DialPlan.TonePlan
+		}
+		if len(c.DialPlan.Tones) > 0 {
+			tones := maps.Clone(c.DialPlan.Tones)
+			maps.Copy(tones, derived.DialPlan.Tones)
+			derived.DialPlan.Tones = tones
+		}
+		configs = append(configs, &derived)
+	}
+	return configs
+}
+
+// ExchangeConfig returns the config of the named exchange
+func (c *Config) ExchangeConfig(name string) (*Config, bool) {
+	for _, ex := range c.ExchangeConfigs() {
+		if ex.Name == name {
+			return ex, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,448 @@
+package main
+
+// country is an entry in the world numbering plan
+type country struct {
+	code string // E.164 calling code, or a longer prefix within a shared code
+	iso  string // ISO 3166-1 alpha-2
+	name string
+}
+
+// countries lists E.164 calling codes. Codes shared between countries are
+// split by longer prefixes (Canada's area codes within +1, Kazakhstan's
+// within +7); lookups take the longest matching prefix.
+var countries = []country{
+	{"1", "US", "the United States"},
+	{"7", "RU", "Russia"},
+	{"20", "EG", "Egypt"},
+	{"211", "SS", "South Sudan"},
+	{"212", "MA", "Morocco"},
+	{"213", "DZ", "Algeria"},
+	{"216", "TN", "Tunisia"},
+	{"218", "LY", "Libya"},
+	{"220", "GM", "the Gambia"},
+	{"221", "SN", "Senegal"},
+	{"222", "MR", "Mauritania"},
+	{"223", "ML", "Mali"},
+	{"224", "GN", "Guinea"},
+	{"225", "CI", "Côte d'Ivoire"},
+	{"226", "BF", "Burkina Faso"},
+	{"227", "NE", "Niger"},
+	{"228", "TG", "Togo"},
+	{"229", "BJ", "Benin"},
+	{"230", "MU", "Mauritius"},
+	{"231", "LR", "Liberia"},
+	{"232", "SL", "Sierra Leone"},
+	{"233", "GH", "Ghana"},
+	{"234", "NG", "Nigeria"},
+	{"235", "TD", "Chad"},
+	{"236", "CF", "the Central African Republic"},
+	{"237", "CM", "Cameroon"},
+	{"238", "CV", "Cape Verde"},
+	{"239", "ST", "São Tomé and Príncipe"},
+	{"240", "GQ", "Equatorial Guinea"},
+	{"241", "GA", "Gabon"},
+	{"242", "CG", "the Republic of the Congo"},
+	{"243", "CD", "the Democratic Republic of the Congo"},
+	{"244", "AO", "Angola"},
+	{"245", "GW", "Guinea-Bissau"},
+	{"248", "SC", "Seychelles"},
+	{"249", "SD", "Sudan"},
+	{"250", "RW", "Rwanda"},
+	{"251", "ET", "Ethiopia"},
+	{"252", "SO", "Somalia"},
+	{"253", "DJ", "Djibouti"},
+	{"254", "KE", "Kenya"},
+	{"255", "TZ", "Tanzania"},
+	{"256", "UG", "Uganda"},
+	{"257", "BI", "Burundi"},
+	{"258", "MZ", "Mozambique"},
+	{"260", "ZM", "Zambia"},
+	{"261", "MG", "Madagascar"},
+	{"262", "RE", "Réunion"},
+	{"263", "ZW", "Zimbabwe"},
+	{"264", "NA", "Namibia"},
+	{"265", "MW", "Malawi"},
+	{"266", "LS", "Lesotho"},
+	{"267", "BW", "Botswana"},
+	{"268", "SZ", "Eswatini"},
+	{"269", "KM", "the Comoros"},
+	{"27", "ZA", "South Africa"},
+	{"290", "SH", "Saint Helena"},
+	{"291", "ER", "Eritrea"},
+	{"297", "AW", "Aruba"},
+	{"298", "FO", "the Faroe Islands"},
+	{"299", "GL", "Greenland"},
+	{"30", "GR", "Greece"},
+	{"31", "NL", "the Netherlands"},
+	{"32", "BE", "Belgium"},
+	{"33", "FR", "France"},
+	{"34", "ES", "Spain"},
+	{"350", "GI", "Gibraltar"},
+	{"351", "PT", "Portugal"},
+	{"352", "LU", "Luxembourg"},
+	{"353", "IE", "Ireland"},
+	{"354", "IS", "Iceland"},
+	{"355", "AL", "Albania"},
+	{"356", "MT", "Malta"},
+	{"357", "CY", "Cyprus"},
+	{"358", "FI", "Finland"},
+	{"359", "BG", "Bulgaria"},
+	{"36", "HU", "Hungary"},
+	{"370", "LT", "Lithuania"},
+	{"371", "LV", "Latvia"},
+	{"372", "EE", "Estonia"},
+	{"373", "MD", "Moldova"},
+	{"374", "AM", "Armenia"},
+	{"375", "BY", "Belarus"},
+	{"376", "AD", "Andorra"},
+	{"377", "MC", "Monaco"},
+	{"378", "SM", "San Marino"},
+	{"380", "UA", "Ukraine"},
+	{"381", "RS", "Serbia"},
+	{"382", "ME", "Montenegro"},
+	{"383", "XK", "Kosovo"},
+	{"385", "HR", "Croatia"},
+	{"386", "SI", "Slovenia"},
+	{"387", "BA", "Bosnia and Herzegovina"},
+	{"389", "MK", "North Macedonia"},
+	{"39", "IT", "Italy"},
+	{"40", "RO", "Romania"},
+	{"41", "CH", "Switzerland"},
+	{"420", "CZ", "Czechia"},
+	{"421", "SK", "Slovakia"},
+	{"423", "LI", "Liechtenstein"},
+	{"43", "AT", "Austria"},
+	{"44", "GB", "the United Kingdom"},
+	{"45", "DK", "Denmark"},
+	{"46", "SE", "Sweden"},
+	{"47", "NO", "Norway"},
+	{"48", "PL", "Poland"},
+	{"49", "DE", "Germany"},
+	{"500", "FK", "the Falkland Islands"},
+	{"501", "BZ", "Belize"},
+	{"502", "GT", "Guatemala"},
+	{"503", "SV", "El Salvador"},
+	{"504", "HN", "Honduras"},
+	{"505", "NI", "Nicaragua"},
+	{"506", "CR", "Costa Rica"},
+	{"507", "PA", "Panama"},
+	{"508", "PM", "Saint Pierre and Miquelon"},
+	{"509", "HT", "Haiti"},
+	{"51", "PE", "Peru"},
+	{"52", "MX", "Mexico"},
+	{"53", "CU", "Cuba"},
+	{"54", "AR", "Argentina"},
+	{"55", "BR", "Brazil"},
+	{"56", "CL", "Chile"},
+	{"57", "CO", "Colombia"},
+	{"58", "VE", "Venezuela"},
+	{"590", "GP", "Guadeloupe"},
+	{"591", "BO", "Bolivia"},
+	{"592", "GY", "Guyana"},
+	{"593", "EC", "Ecuador"},
+	{"594", "GF", "French Guiana"},
+	{"595", "PY", "Paraguay"},
+	{"596", "MQ", "Martinique"},
+	{"597", "SR", "Suriname"},
+	{"598", "UY", "Uruguay"},
+	{"599", "CW", "Curaçao"},
+	{"60", "MY", "Malaysia"},
+	{"61", "AU", "Australia"},
+	{"62", "ID", "Indonesia"},
+	{"63", "PH", "the Philippines"},
+	{"64", "NZ", "New Zealand"},
+	{"65", "SG", "Singapore"},
+	{"66", "TH", "Thailand"},
+	{"670", "TL", "Timor-Leste"},
+	{"672", "NF", "Norfolk Island"},
+	{"673", "BN", "Brunei"},
+	{"674", "NR", "Nauru"},
+	{"675", "PG", "Papua New Guinea"},
+	{"676", "TO", "Tonga"},
+	{"677", "SB", "the Solomon Islands"},
+	{"678", "VU", "Vanuatu"},
+	{"679", "FJ", "Fiji"},
+	{"680", "PW", "Palau"},
+	{"681", "WF", "Wallis and Futuna"},
+	{"682", "CK", "the Cook Islands"},
+	{"683", "NU", "Niue"},
+	{"685", "WS", "Samoa"},
+	{"686", "KI", "Kiribati"},
+	{"687", "NC", "New Caledonia"},
+	{"688", "TV", "Tuvalu"},
+	{"689", "PF", "French Polynesia"},
+	{"690", "TK", "Tokelau"},
+	{"691", "FM", "Micronesia"},
+	{"692", "MH", "the Marshall Islands"},
+	{"76", "KZ", "Kazakhstan"},
+	{"77", "KZ", "Kazakhstan"},
+	{"81", "JP", "Japan"},
+	{"82", "KR", "South Korea"},
+	{"84", "VN", "Vietnam"},
+	{"850", "KP", "North Korea"},
+	{"852", "HK", "Hong Kong"},
+	{"853", "MO", "Macau"},
+	{"855", "KH", "Cambodia"},
+	{"856", "LA", "Laos"},
+	{"86", "CN", "China"},
+	{"880", "BD", "Bangladesh"},
+	{"886", "TW", "Taiwan"},
+	{"90", "TR", "Turkey"},
+	{"91", "IN", "India"},
+	{"92", "PK", "Pakistan"},
+	{"93", "AF", "Afghanistan"},
+	{"94", "LK", "Sri Lanka"},
+	{"95", "MM", "Myanmar"},
+	{"960", "MV", "the Maldives"},
+	{"961", "LB", "Lebanon"},
+	{"962", "JO", "Jordan"},
+	{"963", "SY", "Syria"},
+	{"964", "IQ", "Iraq"},
+	{"965", "KW", "Kuwait"},
+	{"966", "SA", "Saudi Arabia"},
+	{"967", "YE", "Yemen"},
+	{"968", "OM", "Oman"},
+	{"970", "PS", "Palestine"},
+	{"971", "AE", "the United Arab Emirates"},
+	{"972", "IL", "Israel"},
+	{"973", "BH", "Bahrain"},
+	{"974", "QA", "Qatar"},
+	{"975", "BT", "Bhutan"},
+	{"976", "MN", "Mongolia"},
+	{"977", "NP", "Nepal"},
+	{"98", "IR", "Iran"},
+	{"992", "TJ", "Tajikistan"},
+	{"993", "TM", "Turkmenistan"},
+	{"994", "AZ", "Azerbaijan"},
+	{"995", "GE", "Georgia"},
+	{"996", "KG", "Kyrgyzstan"},
+	{"998", "UZ", "Uzbekistan"},
+
+	// Canadian area codes within the North American Numbering Plan
+	{"1204", "CA", "Canada"}, {"1226", "CA", "Canada"}, {"1236", "CA", "Canada"},
+	{"1249", "CA", "Canada"}, {"1250", "CA", "Canada"}, {"1289", "CA", "Canada"},
+	{"1306", "CA", "Canada"}, {"1343", "CA", "Canada"}, {"1365", "CA", "Canada"},
+	{"1403", "CA", "Canada"}, {"1416", "CA", "Canada"}, {"1418", "CA", "Canada"},
+	{"1431", "CA", "Canada"}, {"1437", "CA", "Canada"}, {"1438", "CA", "Canada"},
+	{"1450", "CA", "Canada"}, {"1506", "CA", "Canada"}, {"1514", "CA", "Canada"},
+	{"1519", "CA", "Canada"}, {"1548", "CA", "Canada"}, {"1579", "CA", "Canada"},
+	{"1581", "CA", "Canada"}, {"1587", "CA", "Canada"}, {"1604", "CA", "Canada"},
+	{"1613", "CA", "Canada"}, {"1639", "CA", "Canada"}, {"1647", "CA", "Canada"},
+	{"1672", "CA", "Canada"}, {"1705", "CA", "Canada"}, {"1709", "CA", "Canada"},
+	{"1778", "CA", "Canada"}, {"1780", "CA", "Canada"}, {"1782", "CA", "Canada"},
+	{"1807", "CA", "Canada"}, {"1819", "CA", "Canada"}, {"1825", "CA", "Canada"},
+	{"1867", "CA", "Canada"}, {"1873", "CA", "Canada"}, {"1902", "CA", "Canada"},
+	{"1905", "CA", "Canada"},
+}
+
+// neighbors lists the countries bordering each country by ISO code, or
+// for islands the nearest ones, nearest first where it matters. Countries
+// not listed fall back to others sharing their calling code zone.
+var neighbors = map[string][]string{
+	// North and Central America, Caribbean
+	"US": {"CA", "MX", "CU"},
+	"CA": {"US", "GL", "PM"},
+	"MX": {"US", "GT", "BZ"},
+	"GT": {"MX", "BZ", "SV", "HN"},
+	"BZ": {"MX", "GT"},
+	"SV": {"GT", "HN"},
+	"HN": {"GT", "SV", "NI"},
+	"NI": {"HN", "CR"},
+	"CR": {"NI", "PA"},
+	"PA": {"CR", "CO"},
+	"CU": {"US", "HT", "MX"},
+	"HT": {"CU"},
+	"GL": {"CA", "IS"},
+	"PM": {"CA"},
+
+	// South America
+	"CO": {"PA", "VE", "EC", "PE", "BR"},
+	"VE": {"CO", "BR", "GY"},
+	"GY": {"VE", "SR", "BR"},
+	"SR": {"GY", "GF", "BR"},
+	"GF": {"SR", "BR"},
+	"EC": {"CO", "PE"},
+	"PE": {"EC", "CO", "BR", "BO", "CL"},
+	"BR": {"AR", "UY", "PY", "BO", "PE", "CO", "VE", "GY", "SR", "GF"},
+	"BO": {"PE", "BR", "PY", "AR", "CL"},
+	"PY": {"BO", "BR", "AR"},
+	"UY": {"AR", "BR"},
+	"AR": {"CL", "BO", "PY", "BR", "UY"},
+	"CL": {"AR", "PE", "BO"},
+	"FK": {"AR"},
+
+	// Europe
+	"IS": {"FO", "GB", "NO"},
+	"FO": {"IS", "GB", "NO"},
+	"IE": {"GB"},
+	"GB": {"IE", "FR", "NL", "BE"},
+	"PT": {"ES"},
+	"ES": {"PT", "FR", "AD", "GI"},
+	"GI": {"ES"},
+	"AD": {"ES", "FR"},
+	"FR": {"BE", "LU", "DE", "CH", "IT", "MC", "ES", "AD"},
+	"MC": {"FR", "IT"},
+	"BE": {"FR", "NL", "LU", "DE"},
+	"NL": {"BE", "DE"},
+	"LU": {"BE", "FR", "DE"},
+	"DE": {"DK", "PL", "CZ", "AT", "CH", "FR", "LU", "BE", "NL"},
+	"CH": {"DE", "FR", "IT", "AT", "LI"},
+	"LI": {"CH", "AT"},
+	"AT": {"DE", "CZ", "SK", "HU", "SI", "IT", "CH", "LI"},
+	"IT": {"FR", "CH", "AT", "SI", "SM", "MT"},
+	"SM": {"IT"},
+	"MT": {"IT"},
+	"DK": {"DE", "SE", "NO"},
+	"NO": {"SE", "FI", "RU", "DK"},
+	"SE": {"NO", "FI", "DK"},
+	"FI": {"SE", "NO", "RU", "EE"},
+	"EE": {"LV", "RU", "FI"},
+	"LV": {"EE", "LT", "BY", "RU"},
+	"LT": {"LV", "BY", "PL"},
+	"PL": {"DE", "CZ", "SK", "UA", "BY", "LT"},
+	"CZ": {"DE", "PL", "SK", "AT"},
+	"SK": {"CZ", "PL", "UA", "HU", "AT"},
+	"HU": {"AT", "SK", "UA", "RO", "RS", "HR", "SI"},
+	"SI": {"IT", "AT", "HU", "HR"},
+	"HR": {"SI", "HU", "RS", "BA", "ME"},
+	"BA": {"HR", "RS", "ME"},
+	"RS": {"HU", "RO", "BG", "MK", "XK", "ME", "BA", "HR"},
+	"ME": {"HR", "BA", "RS", "XK", "AL"},
+	"XK": {"RS", "ME", "AL", "MK"},
+	"AL": {"ME", "XK", "MK", "GR"},
+	"MK": {"RS", "XK", "AL", "GR", "BG"},
+	"GR": {"AL", "MK", "BG", "TR", "CY"},
+	"BG": {"RO", "RS", "MK", "GR", "TR"},
+	"RO": {"HU", "UA", "MD", "BG", "RS"},
+	"MD": {"RO", "UA"},
+	"UA": {"PL", "SK", "HU", "RO", "MD", "BY", "RU"},
+	"BY": {"PL", "LT", "LV", "RU", "UA"},
+	"CY": {"GR", "TR", "LB"},
+	"RU": {"FI", "EE", "LV", "BY", "UA", "GE", "AZ", "KZ", "MN", "CN", "KP", "NO"},
+
+	// Caucasus and Central Asia
+	"GE": {"RU", "AZ", "AM", "TR"},
+	"AM": {"GE", "AZ", "IR", "TR"},
+	"AZ": {"RU", "GE", "AM", "IR"},
+	"KZ": {"RU", "CN", "KG", "UZ", "TM"},
+	"UZ": {"KZ", "KG", "TJ", "AF", "TM"},
+	"TM": {"KZ", "UZ", "AF", "IR"},
+	"KG": {"KZ", "CN", "TJ", "UZ"},
+	"TJ": {"UZ", "KG", "CN", "AF"},
+
+	// Middle East
+	"TR": {"GR", "BG", "GE", "AM", "AZ", "IR", "IQ", "SY"},
+	"SY": {"TR", "IQ", "JO", "IL", "LB"},
+	"LB": {"SY", "IL", "CY"},
+	"IL": {"LB", "SY", "JO", "EG", "PS"},
+	"PS": {"IL", "JO", "EG"},
+	"JO": {"SY", "IQ", "SA", "IL", "PS"},
+	"IQ": {"TR", "IR", "KW", "SA", "JO", "SY"},
+	"IR": {"TR", "AM", "AZ", "TM", "AF", "PK", "IQ"},
+	"KW": {"IQ", "SA"},
+	"SA": {"JO", "IQ", "KW", "QA", "AE", "OM", "YE", "BH"},
+	"BH": {"SA", "QA"},
+	"QA": {"SA", "BH", "AE"},
+	"AE": {"SA", "OM", "QA"},
+	"OM": {"AE", "SA", "YE"},
+	"YE": {"SA", "OM", "DJ"},
+
+	// South Asia
+	"AF": {"IR", "TM", "UZ", "TJ", "CN", "PK"},
+	"PK": {"IN", "AF", "IR", "CN"},
+	"IN": {"PK", "CN", "NP", "BT", "BD", "MM", "LK"},
+	"NP": {"IN", "CN"},
+	"BT": {"IN", "CN", "NP"},
+	"BD": {"IN", "MM"},
+	"LK": {"IN", "MV"},
+	"MV": {"LK", "IN"},
+
+	// East and Southeast Asia
+	"CN": {"MN", "RU", "KP", "VN", "LA", "MM", "IN", "BT", "NP", "PK", "AF", "TJ", "KG", "KZ", "HK", "MO"},
+	"HK": {"CN", "MO"},
+	"MO": {"CN", "HK"},
+	"TW": {"CN", "JP", "PH"},
+	"MN": {"RU", "CN"},
+	"KP": {"CN", "KR", "RU"},
+	"KR": {"KP", "JP"},
+	"JP": {"KR", "CN", "TW"},
+	"MM": {"BD", "IN", "CN", "LA", "TH"},
+	"TH": {"MM", "LA", "KH", "MY"},
+	"LA": {"CN", "VN", "KH", "TH", "MM"},
+	"VN": {"CN", "LA", "KH"},
+	"KH": {"TH", "LA", "VN"},
+	"MY": {"TH", "SG", "BN", "ID"},
+	"SG": {"MY", "ID"},
+	"BN": {"MY"},
+	"ID": {"MY", "TL", "PG", "SG"},
+	"TL": {"ID", "AU"},
+	"PH": {"TW", "MY", "ID"},
+
+	// Oceania
+	"AU": {"NZ", "PG", "ID", "TL"},
+	"NZ": {"AU", "CK", "TO", "FJ"},
+	"PG": {"ID", "AU", "SB"},
+	"SB": {"PG", "VU"},
+	"VU": {"NC", "SB", "FJ"},
+	"NC": {"VU", "AU"},
+	"FJ": {"VU", "TO", "WS"},
+	"TO": {"FJ", "WS", "NU"},
+	"WS": {"TO", "FJ"},
+
+	// Africa
+	"EG": {"LY", "SD", "IL", "PS"},
+	"LY": {"EG", "SD", "TD", "NE", "DZ", "TN"},
+	"TN": {"DZ", "LY"},
+	"DZ": {"MA", "TN", "LY", "NE", "ML", "MR"},
+	"MA": {"DZ", "ES"},
+	"MR": {"MA", "DZ", "ML", "SN"},
+	"SN": {"MR", "ML", "GN", "GW", "GM"},
+	"GM": {"SN"},
+	"GW": {"SN", "GN"},
+	"GN": {"GW", "SN", "ML", "CI", "LR", "SL"},
+	"SL": {"GN", "LR"},
+	"LR": {"SL", "GN", "CI"},
+	"CI": {"LR", "GN", "ML", "BF", "GH"},
+	"ML": {"DZ", "NE", "BF", "CI", "GN", "SN", "MR"},
+	"BF": {"ML", "NE", "BJ", "TG", "GH", "CI"},
+	"GH": {"CI", "BF", "TG"},
+	"TG": {"GH", "BF", "BJ"},
+	"BJ": {"TG", "BF", "NE", "NG"},
+	"NE": {"DZ", "LY", "TD", "NG", "BJ", "BF", "ML"},
+	"NG": {"BJ", "NE", "TD", "CM"},
+	"TD": {"LY", "SD", "CF", "CM", "NG", "NE"},
+	"CM": {"NG", "TD", "CF", "CG", "GA", "GQ"},
+	"CF": {"TD", "SD", "SS", "CD", "CG", "CM"},
+	"GQ": {"CM", "GA"},
+	"GA": {"GQ", "CM", "CG"},
+	"CG": {"GA", "CM", "CF", "CD", "AO"},
+	"CD": {"CG", "CF", "SS", "UG", "RW", "BI", "TZ", "ZM", "AO"},
+	"SD": {"EG", "LY", "TD", "CF", "SS", "ET", "ER"},
+	"SS": {"SD", "ET", "KE", "UG", "CD", "CF"},
+	"ER": {"SD", "ET", "DJ"},
+	"DJ": {"ER", "ET", "SO"},
+	"ET": {"ER", "DJ", "SO", "KE", "SS", "SD"},
+	"SO": {"DJ", "ET", "KE"},
+	"KE": {"ET", "SO", "TZ", "UG", "SS"},
+	"UG": {"SS", "KE", "TZ", "RW", "CD"},
+	"RW": {"UG", "TZ", "BI", "CD"},
+	"BI": {"RW", "TZ", "CD"},
+	"TZ": {"KE", "UG", "RW", "BI", "CD", "ZM", "MW", "MZ"},
+	"AO": {"CG", "CD", "ZM", "NA"},
+	"ZM": {"CD", "TZ", "MW", "MZ", "ZW", "BW", "NA", "AO"},
+	"MW": {"TZ", "MZ", "ZM"},
+	"MZ": {"TZ", "MW", "ZM", "ZW", "ZA", "SZ"},
+	"ZW": {"ZM", "MZ", "ZA", "BW"},
+	"BW": {"NA", "ZM", "ZW", "ZA"},
+	"NA": {"AO", "ZM", "BW", "ZA"},
+	"ZA": {"NA", "BW", "ZW", "MZ", "SZ", "LS"},
+	"SZ": {"ZA", "MZ"},
+	"LS": {"ZA"},
+	"MG": {"MZ", "KM", "RE", "MU"},
+	"KM": {"MG", "MZ"},
+	"RE": {"MU", "MG"},
+	"MU": {"RE", "MG"},
+	"SC": {"KE", "MG"},
+	"CV": {"SN", "MR"},
+	"ST": {"GA", "GQ"},
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DHCP_SERVER_PORT = 67
+	DHCP_CLIENT_PORT = 68
+
+	// DHCP_OFFER_HOLD is how long an address offered to a client is kept
+	// for it to request
+	DHCP_OFFER_HOLD = time.Minute
+
+	// DHCP message types, carried in option 53
+	DHCP_DISCOVER = 1
+	DHCP_OFFER    = 2
+	DHCP_REQUEST  = 3
+	DHCP_DECLINE  = 4
+	DHCP_ACK      = 5
+	DHCP_NAK      = 6
+	DHCP_RELEASE  = 7
+
+	// DHCP options the server reads or sends
+	DHCP_OPT_SUBNET_MASK   = 1
+	DHCP_OPT_ROUTER        = 3
+	DHCP_OPT_NTP_SERVERS   = 42
+	DHCP_OPT_REQUESTED_IP  = 50
+	DHCP_OPT_LEASE_TIME    = 51
+	DHCP_OPT_MESSAGE_TYPE  = 53
+	DHCP_OPT_SERVER_ID     = 54
+	DHCP_OPT_TFTP_SERVER   = 66 // Where phone adapters look for their provisioning profile
+	DHCP_OPT_END           = 255
+	DHCP_OPT_PAD           = 0
+	DHCP_MAGIC_COOKIE      = 0x63825363
+	DHCP_HEADER_LEN        = 240
+	DHCP_HARDWARE_ETHERNET = 1
+)
+
+// dhcpMessage is the part of a client's DHCP message the server uses
+type dhcpMessage struct {
+	xid     [4]byte
+	flags   [2]byte
+	ciaddr  net.IP
+	chaddr  net.HardwareAddr
+	options map[byte][]byte
+}
+
+// parseDHCP decodes a DHCP message sent by a client
+func parseDHCP(packet []byte) (*dhcpMessage, error) {
+	if len(packet) < DHCP_HEADER_LEN {
+		return nil, fmt.Errorf("message too short (%d bytes)", len(packet))
+	}
+	if packet[0] != 1 || packet[1] != DHCP_HARDWARE_ETHERNET || packet[2] != 6 {
+		return nil, fmt.Errorf("not an Ethernet client request")
+	}
+	if binary.BigEndian.Uint32(packet[236:240]) != DHCP_MAGIC_COOKIE {
+		return nil, fmt.Errorf("missing magic cookie")
+	}
+
+	msg := &dhcpMessage{
+		ciaddr:  net.IP(packet[12:16]).To4(),
+		chaddr:  net.HardwareAddr(packet[28:34]),
+		options: make(map[byte][]byte),
+	}
+	copy(msg.xid[:], packet[4:8])
+	copy(msg.flags[:], packet[10:12])
+
+	for i := DHCP_HEADER_LEN; i < len(packet); {
+		code := packet[i]
+		if code == DHCP_OPT_END {
+			break
+		}
+		if code == DHCP_OPT_PAD {
+			i++
+			continue
+		}
+		if i+1 >= len(packet) || i+2+int(packet[i+1]) > len(packet) {
+			return nil, fmt.Errorf("option %d runs past the end", code)
+		}
+		msg.options[code] = packet[i+2 : i+2+int(packet[i+1])]
+		i += 2 + int(packet[i+1])
+	}
+	if t := msg.options[DHCP_OPT_MESSAGE_TYPE]; len(t) != 1 {
+		return nil, fmt.Errorf("missing message type")
+	}
+	return msg, nil
+}
+
+// messageType is the kind of DHCP message
+func (m *dhcpMessage) messageType() byte {
+	return m.options[DHCP_OPT_MESSAGE_TYPE][0]
+}
+
+// ipOption is an address carried in an option, nil if it isn't there
+func (m *dhcpMessage) ipOption(code byte) net.IP {
+	if v := m.options[code]; len(v) == 4 {
+		return net.IP(v)
+	}
+	return nil
+}
+
+// dhcpLease is an address given to, or offered to, a client
+type dhcpLease struct {
+	mac     string
+	expires time.Time
+}
+
+// dhcpServer hands out addresses from a small pool to the devices on one
+// interface, with the server itself as their router, time server and
+// provisioning server
+type dhcpServer struct {
+	conn         *net.UDPConn
+	serverIP     net.IP
+	mask         net.IPMask
+	poolStart    uint32
+	poolSize     int
+	lease        time.Duration
+	ntp          bool
+	provisionURL string // Sent in option 66; empty if not provisioning
+
+	mu     sync.Mutex
+	leases map[uint32]dhcpLease // By address
+}
+
+// ipToUint32 and uint32ToIP convert between IPv4 addresses and numbers,
+// for walking the pool
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
+
+// listenDHCP opens the DHCP server port on iface alone. It must listen on
+// every address to hear clients that have none yet, so it is tied to the
+// interface to keep it off the machine's other networks.
+func listenDHCP(iface *net.Interface) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: bindToInterface(iface)}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", ":"+strconv.Itoa(DHCP_SERVER_PORT))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for DHCP on %s: %v", iface.Name, err)
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// Serve answers DHCP clients until the socket is closed
+func (d *dhcpServer) Serve() {
+	buffer := make([]byte, 1500)
+	for {
+		n, _, err := d.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("❌ DHCP: %v", err)
+			continue
+		}
+		msg, err := parseDHCP(buffer[:n])
+		if err != nil {
+			continue // Not for us, or garbled
+		}
+		d.handle(msg)
+	}
+}
+
+// handle answers one client message
+func (d *dhcpServer) handle(msg *dhcpMessage) {
+	mac := msg.chaddr.String()
+	switch msg.messageType() {
+	case DHCP_DISCOVER:
+		ip := d.allocate(mac, msg.ipOption(DHCP_OPT_REQUESTED_IP), DHCP_OFFER_HOLD)
+		if ip == nil {
+			log.Printf("⚠️  DHCP: no free address for %s", mac)
+			return
+		}
+		fmt.Printf("📡 DHCP: offering %s to %s\n", ip, mac)
+		d.send(msg, DHCP_OFFER, ip)
+
+	case DHCP_REQUEST:
+		if id := msg.ipOption(DHCP_OPT_SERVER_ID); id != nil && !id.Equal(d.serverIP) {
+			d.release(mac) // It took another server's offer
+			return
+		}
+		requested := msg.ipOption(DHCP_OPT_REQUESTED_IP)
+		if requested == nil {
+			requested = msg.ciaddr // Renewing
+		}
+		if requested == nil || !d.claim(mac, requested) {
+			fmt.Printf("📡 DHCP: refusing %s to %s\n", requested, mac)
+			d.send(msg, DHCP_NAK, nil)
+			return
+		}
+		fmt.Printf("📡 DHCP: leased %s to %s for %s\n", requested, mac, d.lease)
+		d.send(msg, DHCP_ACK, requested)
+
+	case DHCP_DECLINE:
+		// Something else on the wire has the address; keep it out of the pool
+		if ip := msg.ipOption(DHCP_OPT_REQUESTED_IP); ip != nil {
+			log.Printf("⚠️  DHCP: %s says %s is already in use", mac, ip)
+			d.mu.Lock()
+			d.leases[ipToUint32(ip)] = dhcpLease{mac: "declined", expires: time.Now().Add(d.lease)}
+			d.mu.Unlock()
+		}
+
+	case DHCP_RELEASE:
+		fmt.Printf("📡 DHCP: %s released its address\n", mac)
+		d.release(mac)
+	}
+}
+
+// allocate finds an address for mac and holds it for hold: the one it
+// already has, else the one it asked for if free, else the first free one
+func (d *dhcpServer) allocate(mac string, requested net.IP, hold time.Duration) net.IP {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	free := func(n uint32) bool {
+		lease, ok := d.leases[n]
+		return !ok || now.After(lease.expires) || lease.mac == mac
+	}
+	take := func(n uint32) net.IP {
+		if lease, ok := d.leases[n]; !ok || lease.mac != mac || lease.expires.Before(now.Add(hold)) {
+			d.leases[n] = dhcpLease{mac: mac, expires: now.Add(hold)}
+		}
+		return uint32ToIP(n)
+	}
+
+	for n, lease := range d.leases {
+		if lease.mac == mac && now.Before(lease.expires) {
+			return take(n)
+		}
+	}
+	if requested != nil && d.inPool(requested) && free(ipToUint32(requested)) {
+		return take(ipToUint32(requested))
+	}
+	for i := range d.poolSize {
+		if n := d.poolStart + uint32(i); d.inPool(uint32ToIP(n)) && free(n) {
+			return take(n)
+		}
+	}
+	return nil
+}
+
+// claim leases ip to mac if it is in the pool and not someone else's
+func (d *dhcpServer) claim(mac string, ip net.IP) bool {
+	if !d.inPool(ip) {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := ipToUint32(ip)
+	if lease, ok := d.leases[n]; ok && lease.mac != mac && time.Now().Before(lease.expires) {
+		return false
+	}
+	for other, lease := range d.leases {
+		if lease.mac == mac && other != n {
+			delete(d.leases, other)
+		}
+	}
+	d.leases[n] = dhcpLease{mac: mac, expires: time.Now().Add(d.lease)}
+	return true
+}
+
+// release frees whatever address mac holds
+func (d *dhcpServer) release(mac string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for n, lease := range d.leases {
+		if lease.mac == mac {
+			delete(d.leases, n)
+		}
+	}
+}
+
+// inPool reports whether ip is one the server hands out: in the pool, on
+// the server's subnet and not the server's own
+func (d *dhcpServer) inPool(ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil || ip.Equal(d.serverIP) || !ip.Mask(d.mask).Equal(d.serverIP.Mask(d.mask)) {
+		return false
+	}
+	n := ipToUint32(ip)
+	return n >= d.poolStart && n < d.poolStart+uint32(d.poolSize)
+}
+
+// MACFor is the hardware address of the device leased ip, if any
+func (d *dhcpServer) MACFor(ip net.IP) string {
+	if ip.To4() == nil {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if lease, ok := d.leases[ipToUint32(ip)]; ok && lease.mac != "declined" {
+		return lease.mac
+	}
+	return ""
+}
+
+// send answers a client. Clients without an address yet are answered by
+// broadcast, on the server's interface alone.
+func (d *dhcpServer) send(req *dhcpMessage, msgType byte, yiaddr net.IP) {
+	packet := make([]byte, DHCP_HEADER_LEN, 512)
+	packet[0] = 2 // BOOTREPLY
+	packet[1] = DHCP_HARDWARE_ETHERNET
+	packet[2] = 6
+	copy(packet[4:8], req.xid[:])
+	copy(packet[10:12], req.flags[:])
+	if yiaddr != nil {
+		copy(packet[16:20], yiaddr.To4())
+	}
+	copy(packet[20:24], d.serverIP)
+	copy(packet[28:34], req.chaddr)
+	binary.BigEndian.PutUint32(packet[236:240], DHCP_MAGIC_COOKIE)
+
+	option := func(code byte, value []byte) {
+		packet = append(packet, code, byte(len(value)))
+		packet = append(packet, value...)
+	}
+	option(DHCP_OPT_MESSAGE_TYPE, []byte{msgType})
+	option(DHCP_OPT_SERVER_ID, d.serverIP)
+	if msgType != DHCP_NAK {
+		option(DHCP_OPT_LEASE_TIME, binary.BigEndian.AppendUint32(nil, uint32(d.lease.Seconds())))
+		option(DHCP_OPT_SUBNET_MASK, d.mask)
+		option(DHCP_OPT_ROUTER, d.serverIP)
+		if d.ntp {
+			option(DHCP_OPT_NTP_SERVERS, d.serverIP)
+		}
+		if d.provisionURL != "" {
+			option(DHCP_OPT_TFTP_SERVER, []byte(d.provisionURL))
+		}
+	}
+	packet = append(packet, DHCP_OPT_END)
+
+	to := &net.UDPAddr{IP: net.IPv4bcast, Port: DHCP_CLIENT_PORT}
+	if req.ciaddr != nil && !req.ciaddr.IsUnspecified() && msgType != DHCP_NAK {
+		to.IP = req.ciaddr
+	}
+	if _, err := d.conn.WriteToUDP(packet, to); err != nil {
+		log.Printf("❌ DHCP: failed to answer %s: %v", req.chaddr, err)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RFC3261_MAGIC_COOKIE begins the Via branch of every request we send
+	// (RFC 3261 section 8.1.1.7)
+	RFC3261_MAGIC_COOKIE = "z9hG4bK"
+
+	// ANSWER_RETRANSMIT_MAX caps the interval between retransmissions of a
+	// 2xx answer that hasn't been acknowledged (RFC 3261 timer T2)
+	ANSWER_RETRANSMIT_MAX = 4 * time.Second
+
+	// ACK_TIMEOUT is how long an answer waits for its ACK before the call
+	// is given up and hung up (64*T1)
+	ACK_TIMEOUT = 32 * time.Second
+)
+
+// dialogState is how far a call's dialog has got
+type dialogState int
+
+const (
+	dialogRinging     dialogState = iota // INVITE sent or received, not answered yet
+	dialogEstablished                    // Answered
+	dialogTerminating                    // BYE sent or received
+)
+
+func (st dialogState) String() string {
+	switch st {
+	case dialogRinging:
+		return "ringing"
+	case dialogEstablished:
+		return "established"
+	default:
+		return "terminating"
+	}
+}
+
+// dialogID identifies a dialog: the Call-ID and the tags of both sides
+type dialogID struct {
+	callID    string
+	localTag  string
+	remoteTag string
+}
+
+// dialog holds what the server needs to send requests within a call, such
+// as a BYE when the other side of a bridge hangs up, and to match the
+// phone's requests to it
+type dialog struct {
+	callID     string
+	localTag   string
+	remoteTag  string       // Empty until the phone answers a call we placed
+	remoteAddr *net.UDPAddr // Where the phone's SIP messages come from
+	branch     string       // Via branch of the phone's INVITE, which its CANCEL repeats
+
+	mu         sync.Mutex
+	requestURI string   // Where in-dialog requests are addressed: the phone's Contact
+	routeSet   []string // Route headers for in-dialog requests, from Record-Route
+	from       string   // Our side, with our tag
+	to         string   // The phone's side, with its tag once known
+	cseq       int      // Our last CSeq
+	remoteCSeq int      // The phone's last CSeq
+	state      dialogState
+
+	// A call the phone placed: our last response to its INVITE, resent
+	// whenever the INVITE is retransmitted, and until the phone
+	// acknowledges it once it is a 2xx
+	answer string
+	acked  bool
+
+	// The call's RFC 4028 session timer: the interval in seconds within
+	// which the session must be refreshed (0 for none), and whether we do
+	// it or the phone
+	sessionExpires int
+	refreshing     bool
+	timerSupported bool          // The phone does session timers
+	allowsUpdate   bool          // The phone takes UPDATE, a refresh without SDP
+	refreshed      chan struct{} // Signalled on each refresh
+
+	// Closed when the phone cancels its INVITE before we answer
+	cancelled chan struct{}
+
+	// The call's RTP port, once it has one; given back with the dialog
+	media *mediaPort
+}
+
+// newTag makes a tag for our side of a dialog, random enough that two
+// calls never share one (RFC 3261 section 19.3)
+func newTag() string {
+	return rand.Text()
+}
+
+// newBranch makes the Via branch of a request we send, starting with the
+// magic cookie that marks it as unique to its transaction
+func newBranch() string {
+	return RFC3261_MAGIC_COOKIE + rand.Text()
+}
+
+// withTag adds our tag to the To header of a response outside any dialog,
+// unless the request's already had one
+func withTag(to string) string {
+	if headerTag(to) != "" {
+		return to
+	}
+	return to + ";tag=" + newTag()
+}
+
+// dialogFromRequest builds our side of a dialog the phone started, with an
+// INVITE for a call it placed or a SUBSCRIBE
+func dialogFromRequest(message string, remoteAddr *net.UDPAddr) *dialog {
+	headers := parseHeaders(message)
+	localTag := newTag()
+	var branch string
+	if via := headerValues(message, "Via"); len(via) > 0 {
+		branch = headerParam(via[0], "branch")
+	}
+	return &dialog{
+		callID:     headers["Call-ID"],
+		localTag:   localTag,
+		remoteTag:  headerTag(headers["From"]),
+		remoteAddr: remoteAddr,
+		branch:     branch,
+		requestURI: uriFromHeader(headers["Contact"], remoteAddr),
+		routeSet:   headerValues(message, "Record-Route"),
+		from:       headers["To"] + ";tag=" + localTag,
+		to:         headers["From"],
+		remoteCSeq: cseqNumber(headers["CSeq"]),
+		state:      dialogRinging,
+		refreshed:  make(chan struct{}, 1),
+		cancelled:  make(chan struct{}),
+	}
+}
+
+// id is the key the dialog is kept under
+func (d *dialog) id() dialogID {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return dialogID{d.callID, d.localTag, d.remoteTag}
+}
+
+// State is how far the dialog has got
+func (d *dialog) State() dialogState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state
+}
+
+// refused reports whether our final answer to the dialog's INVITE turned
+// it down
+func (d *dialog) refused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return parseStatusCode(d.answer) >= 300
+}
+
+// setState moves the dialog on, logging the change
+func (d *dialog) setState(state dialogState) {
+	d.mu.Lock()
+	changed := d.state != state
+	d.state = state
+	d.mu.Unlock()
+	if changed && sipTrace.Load() {
+		fmt.Printf("🔀 Dialog %s now %s\n", d.callID, state)
+	}
+}
+
+// establish answers a call the phone placed, unless it was cancelled
+// first
+func (d *dialog) establish() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state != dialogRinging {
+		return false
+	}
+	d.state = dialogEstablished
+	return true
+}
+
+// confirm completes a dialog we started with the phone's 2xx: its tag,
+// its Contact as the target of later requests, and the route set, which
+// a UAC takes from Record-Route in reverse
+func (d *dialog) confirm(response string) {
+	headers := parseHeaders(response)
+	d.mu.Lock()
+	d.to = headers["To"]
+	d.remoteTag = headerTag(headers["To"])
+	d.requestURI = uriFromHeader(headers["Contact"], d.remoteAddr)
+	d.routeSet = headerValues(response, "Record-Route")
+	slices.Reverse(d.routeSet)
+	d.state = dialogEstablished
+	d.mu.Unlock()
+}
+
+// checkCSeq orders a request from the phone within the dialog: it reports
+// whether it is new, or a retransmission of the last one. Anything older
+// is neither.
+func (d *dialog) checkCSeq(cseq int) (isNew, retransmission bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case cseq > d.remoteCSeq:
+		d.remoteCSeq = cseq
+		return true, false
+	case cseq == d.remoteCSeq:
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// addDialog makes a dialog's requests matchable
+func (s *SIPServer) addDialog(d *dialog) {
+	s.callsMu.Lock()
+	s.dialogs[d.id()] = d
+	s.callsMu.Unlock()
+}
+
+// removeDialog forgets a dialog once its call has ended, giving back its
+// RTP port
+func (s *SIPServer) removeDialog(d *dialog) {
+	s.callsMu.Lock()
+	delete(s.dialogs, d.id())
+	s.callsMu.Unlock()
+	d.media.Close()
+}
+
+// findDialog is the dialog a request from the phone belongs to, matched
+// on Call-ID and both tags. For a request outside a dialog, such as a
+// retransmitted INVITE, localTag is empty and any of ours matches.
+func (s *SIPServer) findDialog(callID, localTag, remoteTag string) *dialog {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	if localTag != "" {
+		return s.dialogs[dialogID{callID, localTag, remoteTag}]
+	}
+	for id, d := range s.dialogs {
+		if id.callID == callID && id.remoteTag == remoteTag {
+			return d
+		}
+	}
+	return nil
+}
+
+// answerInvite sends the phone our 2xx to its INVITE, and resends it with
+// the intervals doubling until the phone's ACK arrives. A phone that never
+// acknowledges is hung up on.
+func (s *SIPServer) answerInvite(session *CallSession, d *dialog, response string) {
+	d.mu.Lock()
+	d.answer = response
+	d.acked = false
+	d.mu.Unlock()
+	s.sendResponse(response, d.remoteAddr)
+
+	s.spawn(func() {
+		interval := INVITE_RETRANSMIT
+		deadline := time.NewTimer(ACK_TIMEOUT)
+		defer deadline.Stop()
+		for {
+			select {
+			case <-time.After(interval):
+			case <-deadline.C:
+				log.Printf("⚠️  No ACK from %s; hanging up", d.remoteAddr)
+				s.hangupCall(session)
+				return
+			case <-session.ctx.Done():
+				return
+			}
+
+			d.mu.Lock()
+			acked, current := d.acked, d.answer == response
+			d.mu.Unlock()
+			if acked || !current {
+				return
+			}
+			s.sendResponse(response, d.remoteAddr)
+			interval = min(2*interval, ANSWER_RETRANSMIT_MAX)
+		}
+	})
+}
+
+// headerTag is the tag parameter of a From or To header
+func headerTag(header string) string {
+	return headerParam(header, "tag")
+}
+
+// headerParam is a parameter of a header value, such as the branch of a
+// Via
+func headerParam(header, name string) string {
+	if end := strings.LastIndexByte(header, '>'); end >= 0 {
+		header = header[end:] // Parameters of the URI itself aren't the header's
+	}
+	for _, param := range strings.Split(header, ";")[1:] {
+		if key, value, _ := strings.Cut(strings.TrimSpace(param), "="); strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// cseqNumber is the sequence number of a CSeq header
+func cseqNumber(header string) int {
+	number, _, _ := strings.Cut(strings.TrimSpace(header), " ")
+	n, _ := strconv.Atoi(number)
+	return n
+}
+
+// validCSeq reports whether a request's CSeq header is a sequence number
+// below 2**31 followed by the request's method (RFC 3261 section 8.1.1.5)
+func validCSeq(method, header string) bool {
+	number, cseqMethod, found := strings.Cut(strings.TrimSpace(header), " ")
+	_, err := strconv.ParseUint(number, 10, 31)
+	return found && err == nil && strings.TrimSpace(cseqMethod) == method
+}
+
+// headerValues is every value of a header that may appear more than once,
+// such as Record-Route, in order, whether given on separate lines or
+// separated by commas
+func headerValues(message, name string) []string {
+	return readHeaders(message).Values(name)
+}
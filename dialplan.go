@@ -0,0 +1,578 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// DIGIT_SYMBOLS are the keys a phone can send, in digit map bit order
+	DIGIT_SYMBOLS = "0123456789*#"
+
+	// MAX_PATTERN_ELEMENTS keeps NFA position sets within a uint64
+	MAX_PATTERN_ELEMENTS = 63
+)
+
+// matchResult is the state of a dialed string against a digit pattern
+type matchResult int
+
+const (
+	matchNone       matchResult = iota // Can never match
+	matchPartial                       // Needs more digits
+	matchExtendable                    // Matches, but more digits could too
+	matchComplete                      // Matches and no more digits are possible
+)
+
+func (m matchResult) String() string {
+	switch m {
+	case matchPartial:
+		return "partial"
+	case matchExtendable:
+		return "complete (more digits possible)"
+	case matchComplete:
+		return "complete"
+	default:
+		return "no match"
+	}
+}
+
+// patternElement is one position in a digit pattern: the set of keys it
+// accepts and whether it may repeat (the '.' modifier)
+type patternElement struct {
+	set    uint16 // Bit i set if DIGIT_SYMBOLS[i] is accepted
+	repeat bool
+}
+
+// digitPattern is a compiled digit map pattern in the Linksys/Cisco style:
+// literal keys, 'x' for any digit 0-9, [1-5*] sets with ranges, and '.' to
+// repeat the previous element zero or more times. "00x." matches any
+// number starting with 00.
+type digitPattern struct {
+	source   string
+	elements []patternElement
+}
+
+// compileDigitPattern parses a single digit map pattern
+func compileDigitPattern(source string) (*digitPattern, error) {
+	pattern := &digitPattern{source: source}
+
+	for i := 0; i < len(source); i++ {
+		char := source[i]
+		switch {
+		case char == 'x' || char == 'X':
+			pattern.elements = append(pattern.elements, patternElement{set: 0x3FF})
+		case char == '.':
+			if len(pattern.elements) == 0 {
+				return nil, fmt.Errorf("pattern %q: '.' must follow a digit or set", source)
+			}
+			pattern.elements[len(pattern.elements)-1].repeat = true
+		case char == '[':
+			end := strings.IndexByte(source[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("pattern %q: unterminated '['", source)
+			}
+			set, err := parseDigitSet(source[i+1 : i+end])
+			if err != nil {
+				return nil, fmt.Errorf("pattern %q: %v", source, err)
+			}
+			pattern.elements = append(pattern.elements, patternElement{set: set})
+			i += end
+		default:
+			index := strings.IndexByte(DIGIT_SYMBOLS, char)
+			if index < 0 {
+				return nil, fmt.Errorf("pattern %q: unexpected character %q", source, char)
+			}
+			pattern.elements = append(pattern.elements, patternElement{set: 1 << index})
+		}
+	}
+
+	if len(pattern.elements) == 0 {
+		return nil, fmt.Errorf("empty digit pattern")
+	}
+	if len(pattern.elements) > MAX_PATTERN_ELEMENTS {
+		return nil, fmt.Errorf("pattern %q: more than %d elements", source, MAX_PATTERN_ELEMENTS)
+	}
+	return pattern, nil
+}
+
+// parseDigitSet parses the inside of a [...] set, e.g. "2-9*" or "x#"
+func parseDigitSet(spec string) (uint16, error) {
+	var set uint16
+	for i := 0; i < len(spec); i++ {
+		if spec[i] == 'x' || spec[i] == 'X' {
+			set |= 0x3FF
+			continue
+		}
+		index := strings.IndexByte(DIGIT_SYMBOLS, spec[i])
+		if index < 0 {
+			return 0, fmt.Errorf("unexpected character %q in set", spec[i])
+		}
+		if i+2 < len(spec) && spec[i+1] == '-' {
+			last := strings.IndexByte(DIGIT_SYMBOLS[:10], spec[i+2])
+			if index > 9 || last < index {
+				return 0, fmt.Errorf("invalid range %q in set", spec[i:i+3])
+			}
+			for d := index; d <= last; d++ {
+				set |= 1 << d
+			}
+			i += 2
+			continue
+		}
+		set |= 1 << index
+	}
+	if set == 0 {
+		return 0, fmt.Errorf("empty set")
+	}
+	return set, nil
+}
+
+// Match reports how digits relate to the pattern. It simulates the pattern
+// as a small NFA whose states are element positions.
+func (p *digitPattern) Match(digits string) matchResult {
+	states := p.start()
+	for i := 0; i < len(digits) && states != 0; i++ {
+		index := strings.IndexByte(DIGIT_SYMBOLS, digits[i])
+		if index < 0 {
+			return matchNone
+		}
+		states = p.step(states, index)
+	}
+
+	accepted := p.accepts(states)
+	extendable := states&^(1<<len(p.elements)) != 0
+
+	switch {
+	case accepted && extendable:
+		return matchExtendable
+	case accepted:
+		return matchComplete
+	case extendable:
+		return matchPartial
+	default:
+		return matchNone
+	}
+}
+
+// patternStates is a set of NFA positions, bit i for element i and bit
+// len(elements) for the accepting position
+type patternStates uint64
+
+// start returns the positions active before any digit is dialed
+func (p *digitPattern) start() patternStates {
+	return p.closure(1)
+}
+
+// step advances the positions by one key, given as its DIGIT_SYMBOLS index
+func (p *digitPattern) step(states patternStates, key int) patternStates {
+	var next patternStates
+	for pos, element := range p.elements {
+		if states&(1<<pos) == 0 || element.set&(1<<key) == 0 {
+			continue
+		}
+		if element.repeat {
+			next |= 1 << pos
+		} else {
+			next |= 1 << (pos + 1)
+		}
+	}
+	return p.closure(next)
+}
+
+// accepts reports whether the positions include the accepting one
+func (p *digitPattern) accepts(states patternStates) bool {
+	return states&(1<<len(p.elements)) != 0
+}
+
+// closure adds the positions reachable by skipping repeatable elements
+func (p *digitPattern) closure(states patternStates) patternStates {
+	for pos, element := range p.elements {
+		if states&(1<<pos) != 0 && element.repeat {
+			states |= 1 << (pos + 1)
+		}
+	}
+	return states
+}
+
+// Covers reports whether every number other accepts is also accepted by p.
+// It explores both patterns in lockstep looking for a number that other
+// accepts and p rejects.
+func (p *digitPattern) Covers(other *digitPattern) bool {
+	found := false
+	explorePatterns(p, other, func(mine, theirs patternStates) bool {
+		if other.accepts(theirs) && !p.accepts(mine) {
+			found = true
+		}
+		return !found
+	})
+	return !found
+}
+
+// Overlaps reports whether some number is accepted by both patterns
+func (p *digitPattern) Overlaps(other *digitPattern) bool {
+	found := false
+	explorePatterns(p, other, func(mine, theirs patternStates) bool {
+		if p.accepts(mine) && other.accepts(theirs) {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// explorePatterns visits every pair of position sets the two patterns can
+// reach on the same input, while visit returns true. Positions are
+// bitmasks of at most MAX_PATTERN_ELEMENTS+1 bits, so the walk is small.
+func explorePatterns(a, b *digitPattern, visit func(aStates, bStates patternStates) bool) {
+	type pair struct{ a, b patternStates }
+
+	first := pair{a.start(), b.start()}
+	seen := map[pair]bool{first: true}
+	queue := []pair{first}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if !visit(current.a, current.b) {
+			return
+		}
+		for key := range len(DIGIT_SYMBOLS) {
+			next := pair{a.step(current.a, key), b.step(current.b, key)}
+			if next.b == 0 && next.a == 0 {
+				continue
+			}
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+}
+
+// digitMap is a set of alternative patterns, written "(pattern|pattern)",
+// that decides when the caller has finished dialing
+type digitMap []*digitPattern
+
+// compileDigitMap parses a digit map; the surrounding parentheses are
+// optional
+func compileDigitMap(source string) (digitMap, error) {
+	source = strings.TrimSpace(source)
+	source = strings.TrimPrefix(source, "(")
+	source = strings.TrimSuffix(source, ")")
+
+	var dm digitMap
+	for _, alternative := range strings.Split(source, "|") {
+		pattern, err := compileDigitPattern(strings.TrimSpace(alternative))
+		if err != nil {
+			return nil, err
+		}
+		dm = append(dm, pattern)
+	}
+	return dm, nil
+}
+
+// Match combines the results of all alternatives. A complete match only
+// ends dialing immediately if no other pattern could still use more digits;
+// otherwise the caller gets the interdigit timer to keep going, as on a PAP2.
+func (dm digitMap) Match(digits string) (matchResult, *digitPattern) {
+	var accepted, waiting *digitPattern
+	moreDigits := false
+
+	for _, pattern := range dm {
+		switch pattern.Match(digits) {
+		case matchComplete:
+			if accepted == nil {
+				accepted = pattern
+			}
+		case matchExtendable:
+			if accepted == nil {
+				accepted = pattern
+			}
+			moreDigits = true
+		case matchPartial:
+			if waiting == nil {
+				waiting = pattern
+			}
+			moreDigits = true
+		}
+	}
+
+	switch {
+	case accepted != nil && moreDigits:
+		return matchExtendable, accepted
+	case accepted != nil:
+		return matchComplete, accepted
+	case waiting != nil:
+		return matchPartial, waiting
+	default:
+		return matchNone, nil
+	}
+}
+
+// normalizeRule rewrites dialed numbers into canonical form, e.g. turning
+// the North American "011" international prefix into "00"
+type normalizeRule struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// route maps canonical numbers matching a pattern to a destination
+type route struct {
+	pattern     *digitPattern
+	destination string
+}
+
+// DialPlan turns dialed digits into a destination: numbers are normalized,
+// the digit map decides when dialing is complete, and an extension's
+// number or else the first route that matches the canonical number selects
+// the destination.
+type DialPlan struct {
+	normalize    []normalizeRule
+	digitMap     digitMap
+	dialable     digitMap // The digit map and extension numbers
+	routes       []route
+	extensions   map[string]ExtensionConfig
+	world        *worldPlan // Nil unless world numbering is enabled
+	destinations map[string]DestinationConfig
+	honeypot     string   // Where screened callers go; reached without a route
+	trunkCalls   []string // Where calls from SIP trunks go, likewise
+	secrets      []secretCode
+}
+
+// newDialPlan compiles the dial plan section of the configuration
+func newDialPlan(cfg *Config) (*DialPlan, error) {
+	plan := &DialPlan{destinations: cfg.Destinations, extensions: cfg.Extensions, honeypot: cfg.Screening.Honeypot}
+	for _, trunk := range cfg.SIPTrunks {
+		plan.trunkCalls = append(plan.trunkCalls, trunk.Destination)
+	}
+
+	for i, rule := range cfg.DialPlan.Normalize {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("dialplan.normalize[%d]: %v", i, err)
+		}
+		plan.normalize = append(plan.normalize, normalizeRule{match: re, replace: rule.Replace})
+	}
+
+	dm, err := compileDigitMap(cfg.DialPlan.DigitMap)
+	if err != nil {
+		return nil, fmt.Errorf("dialplan.digit_map: %v", err)
+	}
+	plan.digitMap = dm
+
+	// Extension numbers can always be dialed, whatever the digit map says
+	plan.dialable = slices.Clone(dm)
+	for _, number := range slices.Sorted(maps.Keys(cfg.Extensions)) {
+		pattern, err := compileDigitPattern(number)
+		if err != nil {
+			return nil, fmt.Errorf("extension %s: %v", number, err)
+		}
+		plan.dialable = append(plan.dialable, pattern)
+	}
+
+	for i, r := range cfg.DialPlan.Routes {
+		pattern, err := compileDigitPattern(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("dialplan.routes[%d]: %v", i, err)
+		}
+		if _, ok := cfg.Destinations[r.Destination]; !ok {
+			return nil, fmt.Errorf("dialplan.routes[%d]: unknown destination %q", i, r.Destination)
+		}
+		plan.routes = append(plan.routes, route{pattern: pattern, destination: r.Destination})
+	}
+
+	world, err := newWorldPlan(cfg)
+	if err != nil {
+		return nil, err
+	}
+	plan.world = world
+
+	if plan.secrets, err = compileSecrets(cfg); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// normalizeStep records one rewrite for the simulator
+type normalizeStep struct {
+	rule   int
+	before string
+	after  string
+}
+
+// Normalize applies every rewrite rule in order
+func (d *DialPlan) Normalize(digits string) (string, []normalizeStep) {
+	var steps []normalizeStep
+	for i, rule := range d.normalize {
+		rewritten := rule.match.ReplaceAllString(digits, rule.replace)
+		if rewritten != digits {
+			steps = append(steps, normalizeStep{rule: i + 1, before: digits, after: rewritten})
+			digits = rewritten
+		}
+	}
+	return digits, steps
+}
+
+// Collect normalizes the digits dialed so far and checks them against the
+// digit map and extension numbers
+func (d *DialPlan) Collect(digits string) (matchResult, *digitPattern) {
+	number, _ := d.Normalize(digits)
+	return d.dialable.Match(number)
+}
+
+// resolution is where a dialed number leads
+type resolution struct {
+	number       string      // Canonical form
+	route        int         // Index of the matching route, or -1
+	world        *worldMatch // Set when world numbering chose the destination
+	destination  string
+	announcement string // Played before the destination, if set
+	extension    string // Set instead of a destination for an extension's number
+}
+
+// Resolve finds the destination for a completely dialed number: the
+// extension with that number, the first matching route, or failing those
+// world numbering. It reports false if none applies; the canonical number
+// is returned either way.
+func (d *DialPlan) Resolve(digits string) (resolution, bool) {
+	number, _ := d.Normalize(digits)
+	res := resolution{number: number, route: -1}
+
+	if _, ok := d.extensions[number]; ok {
+		res.extension = number
+		return res, true
+	}
+
+	for i, r := range d.routes {
+		if result := r.pattern.Match(number); result == matchComplete || result == matchExtendable {
+			res.route = i
+			res.destination = r.destination
+			return res, true
+		}
+	}
+
+	if d.world != nil {
+		if match, ok := d.world.Resolve(number); ok {
+			res.world = match
+			res.destination = match.destination
+			if match.level >= worldNeighbor {
+				res.announcement = d.world.announcement
+			}
+			return res, true
+		}
+	}
+
+	return res, false
+}
+
+// Lint looks for mistakes that compile but can't work as intended. Problems
+// are routes that can never be chosen; warnings are redundant or unused
+// parts of the plan.
+func (d *DialPlan) Lint() (problems, warnings []string) {
+	for i, r := range d.routes {
+		for j, earlier := range d.routes[:i] {
+			if earlier.pattern.Covers(r.pattern) {
+				problems = append(problems, fmt.Sprintf("route %d (%s) is unreachable: route %d (%s) matches every number it does",
+					i+1, r.pattern.source, j+1, earlier.pattern.source))
+				break
+			}
+		}
+
+		dialable := false
+		for _, pattern := range d.digitMap {
+			if pattern.Overlaps(r.pattern) {
+				dialable = true
+				break
+			}
+		}
+		if !dialable {
+			problems = append(problems, fmt.Sprintf("route %d (%s) can never be dialed: no digit map pattern accepts its numbers",
+				i+1, r.pattern.source))
+		}
+
+		for _, number := range slices.Sorted(maps.Keys(d.extensions)) {
+			if result := r.pattern.Match(number); result == matchComplete || result == matchExtendable {
+				warnings = append(warnings, fmt.Sprintf("route %d (%s) matches extension %s, which rings the extension instead",
+					i+1, r.pattern.source, number))
+			}
+		}
+	}
+
+	for i, pattern := range d.digitMap {
+		for j, other := range d.digitMap {
+			// Identical patterns cover each other; only report the later one
+			if i != j && other.Covers(pattern) && (j < i || !pattern.Covers(other)) {
+				warnings = append(warnings, fmt.Sprintf("digit map pattern %s is redundant: %s accepts every number it does",
+					pattern.source, other.source))
+				break
+			}
+		}
+
+		routed := d.world != nil && pattern.Overlaps(d.world.pattern)
+		for number := range d.extensions {
+			if result := pattern.Match(number); result == matchComplete || result == matchExtendable {
+				routed = true
+			}
+		}
+		for _, r := range d.routes {
+			if r.pattern.Overlaps(pattern) {
+				routed = true
+				break
+			}
+		}
+		if !routed {
+			warnings = append(warnings, fmt.Sprintf("numbers accepted by digit map pattern %s have no route", pattern.source))
+		}
+	}
+
+	for _, secret := range d.secrets {
+		for i := 1; i < len(secret.code); i++ {
+			if result, _ := d.Collect(secret.code[:i]); result == matchComplete {
+				problems = append(problems, fmt.Sprintf("secret code %s can never be dialed: the digit map completes at %s",
+					secret.code, secret.code[:i]))
+				break
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(d.destinations)) {
+		unlockable := slices.ContainsFunc(d.secrets, func(s secretCode) bool { return s.destination == name })
+		if d.destinations[name].Hidden && !unlockable {
+			warnings = append(warnings, fmt.Sprintf("hidden destination %q has no secret code to unlock it", name))
+		}
+	}
+
+	used := map[string]bool{d.honeypot: true}
+	for _, secret := range d.secrets {
+		used[secret.destination] = true
+	}
+	for _, name := range d.trunkCalls {
+		used[name] = true
+	}
+	for _, r := range d.routes {
+		used[r.destination] = true
+	}
+	for _, dest := range d.destinations {
+		used[dest.Hold] = true
+		used[dest.Success] = true
+		used[dest.Failure] = true
+	}
+	if d.world != nil {
+		used[d.world.fallback] = true
+		used[d.world.announcement] = true
+		for _, entries := range d.world.catalog {
+			for _, entry := range entries {
+				used[entry.name] = true
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(d.destinations)) {
+		if !used[name] {
+			warnings = append(warnings, fmt.Sprintf("destination %q is not used by any route or by world numbering", name))
+		}
+	}
+
+	return problems, warnings
+}
@@ -0,0 +1,743 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DTLS 1.2 (RFC 6347) is how a browser keys SRTP (RFC 5764): it shakes
+// hands with us over the media path, each side proving it holds the
+// certificate whose fingerprint its SDP gave, and both derive the SRTP
+// keys from the handshake. We are always the server, answering offers
+// with a=setup:passive, and speak one cipher suite,
+// ECDHE-ECDSA-AES128-GCM-SHA256, which every browser offers. ICE has
+// already shown the browser's address is real before it can start a
+// handshake, so no cookie exchange is asked for.
+
+const (
+	DTLS_VERSION = 0xFEFD // 1.2
+
+	DTLS_RECORD_HEADER_SIZE    = 13
+	DTLS_HANDSHAKE_HEADER_SIZE = 12
+	DTLS_EXPLICIT_NONCE_SIZE   = 8
+
+	// DTLS_MAX_HANDSHAKE_SIZE is the longest handshake message we put back
+	// together; a browser's longest, its certificate, is well under it
+	DTLS_MAX_HANDSHAKE_SIZE = 16 * 1024
+
+	// DTLS_CERTIFICATE_LIFETIME is how long our self-signed certificate is
+	// valid; browsers only check it against the fingerprint
+	DTLS_CERTIFICATE_LIFETIME = 365 * 24 * time.Hour
+
+	// DTLS_SRTP_EXPORTER_LABEL derives the SRTP keys (RFC 5764 section 4.2)
+	DTLS_SRTP_EXPORTER_LABEL = "EXTRACTOR-dtls_srtp"
+)
+
+// Record content types
+const (
+	dtlsChangeCipherSpec = 20
+	dtlsAlert            = 21
+	dtlsHandshake        = 22
+)
+
+// Handshake message types
+const (
+	dtlsClientHello        = 1
+	dtlsServerHello        = 2
+	dtlsCertificate        = 11
+	dtlsServerKeyExchange  = 12
+	dtlsCertificateRequest = 13
+	dtlsServerHelloDone    = 14
+	dtlsCertificateVerify  = 15
+	dtlsClientKeyExchange  = 16
+	dtlsFinished           = 20
+)
+
+// dtlsClientFlights are the messages the browser sends, in order of their
+// sequence numbers
+var dtlsClientFlights = []byte{dtlsClientHello, dtlsCertificate, dtlsClientKeyExchange, dtlsCertificateVerify, dtlsFinished}
+
+// Values the handshake negotiates (RFC 5246, 4492, 5764, 7627, 8422)
+const (
+	TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 = 0xC02B
+
+	TLS_EXT_SUPPORTED_GROUPS = 0x000A
+	TLS_EXT_POINT_FORMATS    = 0x000B
+	TLS_EXT_USE_SRTP         = 0x000E
+	TLS_EXT_EXTENDED_MASTER  = 0x0017
+	TLS_EXT_RENEGOTIATION    = 0xFF01
+
+	TLS_GROUP_SECP256R1 = 0x0017
+	TLS_GROUP_X25519    = 0x001D
+
+	TLS_ECDSA_SECP256R1_SHA256 = 0x0403
+	TLS_RSA_PKCS1_SHA256       = 0x0401
+	TLS_ECDSA_SIGN             = 64 // Client certificate types
+	TLS_RSA_SIGN               = 1
+)
+
+// dtlsSRTPProfiles are the SRTP protection profiles we take up, most
+// preferred first, and the suites they are
+var dtlsSRTPProfiles = []struct {
+	id    uint16
+	suite *srtpSuite
+}{
+	{0x0001, srtpSuites[0]}, // SRTP_AES128_CM_HMAC_SHA1_80
+	{0x0002, srtpSuites[1]}, // SRTP_AES128_CM_HMAC_SHA1_32
+}
+
+// dtlsSignatureAlgorithms are the signatures we take on a browser's
+// CertificateVerify
+var dtlsSignatureAlgorithms = map[uint16]x509.SignatureAlgorithm{
+	TLS_ECDSA_SECP256R1_SHA256: x509.ECDSAWithSHA256,
+	TLS_RSA_PKCS1_SHA256:       x509.SHA256WithRSA,
+}
+
+// dtlsIdentity is our certificate and its key, made once per run, and
+// the fingerprint SDP gives for it
+type dtlsIdentity struct {
+	certificate []byte // DER
+	key         *ecdsa.PrivateKey
+	fingerprint string // "sha-256 AB:CD:..."
+}
+
+// ourDTLSIdentity makes our self-signed certificate the first time it is
+// needed
+var ourDTLSIdentity = sync.OnceValues(func() (*dtlsIdentity, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DTLS key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "Travel by Telephone"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(DTLS_CERTIFICATE_LIFETIME),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DTLS certificate: %v", err)
+	}
+	sum := sha256.Sum256(certificate)
+	return &dtlsIdentity{certificate: certificate, key: key, fingerprint: "sha-256 " + colonHex(sum[:])}, nil
+})
+
+// colonHex is bytes as upper-case hex pairs separated by colons, as SDP
+// fingerprints are written
+func colonHex(b []byte) string {
+	pairs := make([]string, len(b))
+	for i, v := range b {
+		pairs[i] = fmt.Sprintf("%02X", v)
+	}
+	return strings.Join(pairs, ":")
+}
+
+// fingerprintHashes are the hash functions an SDP fingerprint may name
+var fingerprintHashes = map[string]crypto.Hash{
+	"sha-1":   crypto.SHA1,
+	"sha-256": crypto.SHA256,
+	"sha-384": crypto.SHA384,
+	"sha-512": crypto.SHA512,
+}
+
+// matchesFingerprint reports whether a certificate is the one an SDP
+// fingerprint attribute, such as "sha-256 AB:CD:...", names
+func matchesFingerprint(certificate []byte, fingerprint string) bool {
+	name, value, _ := strings.Cut(fingerprint, " ")
+	h, ok := fingerprintHashes[strings.ToLower(name)]
+	if !ok || !h.Available() {
+		return false
+	}
+	digest := h.New()
+	digest.Write(certificate)
+	return strings.EqualFold(colonHex(digest.Sum(nil)), strings.TrimSpace(value))
+}
+
+// dtlsMessage is a handshake message being put back together from the
+// pieces it arrives in
+type dtlsMessage struct {
+	data   []byte // With a header as if it came whole, for the transcript
+	length int
+	ranges [][2]int // Of the body that has come, in order and apart
+}
+
+// add records that the body from start to end has come
+func (m *dtlsMessage) add(start, end int) {
+	var ranges [][2]int
+	for _, r := range m.ranges {
+		if r[1] < start || r[0] > end {
+			ranges = append(ranges, r)
+			continue
+		}
+		start, end = min(start, r[0]), max(end, r[1])
+	}
+	ranges = append(ranges, [2]int{start, end})
+	slices.SortFunc(ranges, func(a, b [2]int) int { return a[0] - b[0] })
+	m.ranges = ranges
+}
+
+// received is how much of the body has come
+func (m *dtlsMessage) received() int {
+	n := 0
+	for _, r := range m.ranges {
+		n += r[1] - r[0]
+	}
+	return n
+}
+
+// dtlsServer is our end of one call's DTLS handshake. It is fed the
+// datagrams the browser sends, gives send the ones to go back, and gives
+// keyed the SRTP keys once the handshake is done. Only the RTP reader
+// uses it.
+type dtlsServer struct {
+	identity    *dtlsIdentity
+	fingerprint string // The browser's, from its SDP
+	send        func(datagram []byte)
+	keyed       func(keys *srtpKeys)
+
+	clientRandom, serverRandom [32]byte
+	transcript                 bytes.Buffer
+	ecdhKey                    *ecdh.PrivateKey
+	extendedMaster             bool
+	suite                      *srtpSuite
+	clientCertificate          *x509.Certificate
+	master                     []byte
+
+	receiveSeq uint16                  // Of the browser's next handshake message
+	sendSeq    uint16                  // Of our next
+	pieces     map[uint16]*dtlsMessage // Messages not yet whole, by sequence
+	flight     []byte                  // Our last flight, resent if the browser resends its own
+	done       bool
+	failed     bool
+
+	// Record protection: the browser's once it changes cipher spec, and
+	// ours once we do
+	readAEAD, writeAEAD cipher.AEAD
+	readIV, writeIV     []byte
+	writeEpoch          uint16
+	writeSeq            [2]uint64 // By epoch
+}
+
+// newDTLSServer prepares for a browser's handshake
+func newDTLSServer(identity *dtlsIdentity, fingerprint string, send func([]byte), keyed func(*srtpKeys)) *dtlsServer {
+	return &dtlsServer{identity: identity, fingerprint: fingerprint, send: send, keyed: keyed, pieces: make(map[uint16]*dtlsMessage)}
+}
+
+// isDTLS reports whether a packet on the RTP socket is DTLS rather than
+// RTP or STUN, by its first byte (RFC 7983)
+func isDTLS(packet []byte) bool {
+	return len(packet) >= DTLS_RECORD_HEADER_SIZE && packet[0] >= 20 && packet[0] <= 63
+}
+
+// handle takes a datagram from the browser. A handshake that fails is
+// abandoned, leaving the call without audio.
+func (d *dtlsServer) handle(datagram []byte) error {
+	if d.failed {
+		return nil
+	}
+	resend := false
+	for len(datagram) >= DTLS_RECORD_HEADER_SIZE {
+		contentType := datagram[0]
+		epoch := binary.BigEndian.Uint16(datagram[3:5])
+		length := int(binary.BigEndian.Uint16(datagram[11:13]))
+		if DTLS_RECORD_HEADER_SIZE+length > len(datagram) {
+			break
+		}
+		header, fragment := datagram[:DTLS_RECORD_HEADER_SIZE], datagram[DTLS_RECORD_HEADER_SIZE:DTLS_RECORD_HEADER_SIZE+length]
+		datagram = datagram[DTLS_RECORD_HEADER_SIZE+length:]
+
+		if epoch > 0 {
+			plain, err := d.open(header, fragment)
+			if err != nil {
+				continue // Not yet keyed, or forged
+			}
+			fragment = plain
+		}
+
+		switch contentType {
+		case dtlsHandshake:
+			again, err := d.handleHandshake(fragment, epoch)
+			if err != nil {
+				d.failed = true
+				return err
+			}
+			resend = resend || again
+		case dtlsAlert:
+			if len(fragment) == 2 && fragment[0] == 2 { // Fatal
+				d.failed = true
+				return fmt.Errorf("browser sent DTLS alert %d", fragment[1])
+			}
+		}
+	}
+	if resend && d.flight != nil {
+		d.send(d.flight)
+	}
+	return nil
+}
+
+// handleHandshake takes the handshake messages of a record, reporting
+// whether one was a retransmission, which has our last flight sent again
+func (d *dtlsServer) handleHandshake(fragment []byte, epoch uint16) (resend bool, err error) {
+	for len(fragment) >= DTLS_HANDSHAKE_HEADER_SIZE {
+		msgType := fragment[0]
+		length := int(uint24(fragment[1:4]))
+		seq := binary.BigEndian.Uint16(fragment[4:6])
+		offset := int(uint24(fragment[6:9]))
+		size := int(uint24(fragment[9:12]))
+		if DTLS_HANDSHAKE_HEADER_SIZE+size > len(fragment) || offset+size > length {
+			return false, errors.New("malformed DTLS handshake message")
+		}
+		if length > DTLS_MAX_HANDSHAKE_SIZE {
+			return false, fmt.Errorf("DTLS handshake message of %d bytes is too long", length)
+		}
+		piece := fragment[DTLS_HANDSHAKE_HEADER_SIZE : DTLS_HANDSHAKE_HEADER_SIZE+size]
+		fragment = fragment[DTLS_HANDSHAKE_HEADER_SIZE+size:]
+
+		if seq < d.receiveSeq {
+			resend = true
+			continue
+		}
+		if seq > d.receiveSeq || d.done {
+			continue // Out of order; the browser sends it again
+		}
+
+		m := d.pieces[seq]
+		if m != nil && (m.data[0] != msgType || m.length != length) {
+			continue // Contradicts the fragments before it
+		}
+		if m == nil {
+			m = &dtlsMessage{data: make([]byte, DTLS_HANDSHAKE_HEADER_SIZE+length), length: length}
+			m.data[0] = msgType
+			putUint24(m.data[1:4], uint32(length))
+			binary.BigEndian.PutUint16(m.data[4:6], seq)
+			putUint24(m.data[9:12], uint32(length))
+			d.pieces[seq] = m
+		}
+		copy(m.data[DTLS_HANDSHAKE_HEADER_SIZE+offset:], piece)
+		m.add(offset, offset+size)
+		if m.received() < length {
+			continue
+		}
+		delete(d.pieces, seq)
+
+		if int(seq) >= len(dtlsClientFlights) || msgType != dtlsClientFlights[seq] {
+			return false, fmt.Errorf("unexpected DTLS handshake message %d", msgType)
+		}
+		if msgType == dtlsFinished && epoch == 0 {
+			return false, errors.New("DTLS Finished sent unencrypted")
+		}
+		d.receiveSeq++
+		if err := d.handleMessage(msgType, m.data); err != nil {
+			return false, err
+		}
+	}
+	return resend, nil
+}
+
+// handleMessage acts on a whole handshake message from the browser
+func (d *dtlsServer) handleMessage(msgType byte, message []byte) error {
+	body := &tlsReader{data: message[DTLS_HANDSHAKE_HEADER_SIZE:]}
+	switch msgType {
+	case dtlsClientHello:
+		d.transcript.Write(message)
+		if err := d.readClientHello(body); err != nil {
+			return err
+		}
+		return d.sendServerFlight()
+
+	case dtlsCertificate:
+		d.transcript.Write(message)
+		certificates := &tlsReader{data: body.vector(3)}
+		first := certificates.vector(3)
+		if body.err != nil || certificates.err != nil || len(first) == 0 {
+			return errors.New("browser sent no DTLS certificate")
+		}
+		if !matchesFingerprint(first, d.fingerprint) {
+			return errors.New("browser's DTLS certificate doesn't match its SDP fingerprint")
+		}
+		certificate, err := x509.ParseCertificate(first)
+		if err != nil {
+			return fmt.Errorf("failed to parse browser's DTLS certificate: %v", err)
+		}
+		d.clientCertificate = certificate
+
+	case dtlsClientKeyExchange:
+		d.transcript.Write(message)
+		public := body.vector(1)
+		if body.err != nil {
+			return errors.New("malformed ClientKeyExchange")
+		}
+		peer, err := d.ecdhKey.Curve().NewPublicKey(public)
+		if err != nil {
+			return fmt.Errorf("bad DTLS key share: %v", err)
+		}
+		preMaster, err := d.ecdhKey.ECDH(peer)
+		if err != nil {
+			return fmt.Errorf("failed DTLS key agreement: %v", err)
+		}
+		randoms := append(d.clientRandom[:], d.serverRandom[:]...)
+		if d.extendedMaster {
+			sessionHash := sha256.Sum256(d.transcript.Bytes())
+			d.master = tlsPRF(preMaster, "extended master secret", sessionHash[:], 48)
+		} else {
+			d.master = tlsPRF(preMaster, "master secret", randoms, 48)
+		}
+		return d.deriveRecordKeys()
+
+	case dtlsCertificateVerify:
+		if d.clientCertificate == nil {
+			return errors.New("CertificateVerify without a certificate")
+		}
+		algorithm := body.uint16()
+		signature := body.vector(2)
+		x509Algorithm, ok := dtlsSignatureAlgorithms[algorithm]
+		if body.err != nil || !ok {
+			return fmt.Errorf("unsupported DTLS signature algorithm %04x", algorithm)
+		}
+		if err := d.clientCertificate.CheckSignature(x509Algorithm, d.transcript.Bytes(), signature); err != nil {
+			return fmt.Errorf("browser's DTLS CertificateVerify is wrong: %v", err)
+		}
+		d.transcript.Write(message)
+
+	case dtlsFinished:
+		if d.clientCertificate == nil || d.master == nil {
+			return errors.New("DTLS Finished before the browser proved its certificate")
+		}
+		sum := sha256.Sum256(d.transcript.Bytes())
+		if !hmac.Equal(body.data, tlsPRF(d.master, "client finished", sum[:], 12)) {
+			return errors.New("browser's DTLS Finished is wrong")
+		}
+		d.transcript.Write(message)
+		d.sendFinished()
+		d.done = true
+
+		material := tlsPRF(d.master, DTLS_SRTP_EXPORTER_LABEL, append(d.clientRandom[:], d.serverRandom[:]...), 2*(SRTP_MASTER_KEY_SIZE+SRTP_MASTER_SALT_SIZE))
+		clientKey, serverKey := material[:SRTP_MASTER_KEY_SIZE], material[SRTP_MASTER_KEY_SIZE:2*SRTP_MASTER_KEY_SIZE]
+		salts := material[2*SRTP_MASTER_KEY_SIZE:]
+		clientSalt, serverSalt := salts[:SRTP_MASTER_SALT_SIZE], salts[SRTP_MASTER_SALT_SIZE:]
+		d.keyed(&srtpKeys{
+			suite:  d.suite,
+			remote: append(bytes.Clone(clientKey), clientSalt...),
+			local:  append(bytes.Clone(serverKey), serverSalt...),
+		})
+	}
+	return nil
+}
+
+// readClientHello takes up what the browser offers: our cipher suite, an
+// SRTP profile, a key exchange group, and the extensions we echo
+func (d *dtlsServer) readClientHello(body *tlsReader) error {
+	body.uint16() // Version; ours is the only one we speak
+	copy(d.clientRandom[:], body.bytes(32))
+	body.vector(1) // Session ID
+	body.vector(1) // Cookie
+	suites := &tlsReader{data: body.vector(2)}
+	body.vector(1) // Compression methods
+	extensions := &tlsReader{data: body.vector(2)}
+	if body.err != nil {
+		return errors.New("malformed ClientHello")
+	}
+
+	haveSuite := false
+	for len(suites.data) >= 2 {
+		if suites.uint16() == TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			haveSuite = true
+		}
+	}
+	if !haveSuite {
+		return errors.New("browser doesn't offer ECDHE-ECDSA-AES128-GCM-SHA256")
+	}
+
+	var curve ecdh.Curve
+	for len(extensions.data) >= 4 {
+		kind := extensions.uint16()
+		value := &tlsReader{data: extensions.vector(2)}
+		switch kind {
+		case TLS_EXT_SUPPORTED_GROUPS:
+			groups := &tlsReader{data: value.vector(2)}
+			for len(groups.data) >= 2 {
+				switch groups.uint16() {
+				case TLS_GROUP_X25519:
+					curve = ecdh.X25519()
+				case TLS_GROUP_SECP256R1:
+					if curve == nil {
+						curve = ecdh.P256()
+					}
+				}
+			}
+		case TLS_EXT_USE_SRTP:
+			profiles := &tlsReader{data: value.vector(2)}
+			var offered []uint16
+			for len(profiles.data) >= 2 {
+				offered = append(offered, profiles.uint16())
+			}
+			for _, p := range dtlsSRTPProfiles {
+				if d.suite == nil && slices.Contains(offered, p.id) {
+					d.suite = p.suite
+				}
+			}
+		case TLS_EXT_EXTENDED_MASTER:
+			d.extendedMaster = true
+		}
+	}
+	if extensions.err != nil {
+		return errors.New("malformed ClientHello extensions")
+	}
+	if d.suite == nil {
+		return errors.New("browser offers no SRTP profile we support")
+	}
+	if curve == nil {
+		curve = ecdh.P256() // The default for ECDHE (RFC 8422 section 4)
+	}
+	key, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate DTLS key share: %v", err)
+	}
+	d.ecdhKey = key
+	rand.Read(d.serverRandom[:])
+	return nil
+}
+
+// sendServerFlight answers the ClientHello: ServerHello, our certificate,
+// our key share, a request for the browser's certificate, and ServerHelloDone
+func (d *dtlsServer) sendServerFlight() error {
+	var hello []byte
+	hello = binary.BigEndian.AppendUint16(hello, DTLS_VERSION)
+	hello = append(hello, d.serverRandom[:]...)
+	hello = append(hello, 0) // No session ID: sessions aren't resumed
+	hello = binary.BigEndian.AppendUint16(hello, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)
+	hello = append(hello, 0) // No compression
+	var extensions []byte
+	for _, p := range dtlsSRTPProfiles {
+		if p.suite == d.suite {
+			extensions = appendTLSExtension(extensions, TLS_EXT_USE_SRTP, []byte{0, 2, byte(p.id >> 8), byte(p.id), 0})
+		}
+	}
+	if d.extendedMaster {
+		extensions = appendTLSExtension(extensions, TLS_EXT_EXTENDED_MASTER, nil)
+	}
+	extensions = appendTLSExtension(extensions, TLS_EXT_RENEGOTIATION, []byte{0})
+	extensions = appendTLSExtension(extensions, TLS_EXT_POINT_FORMATS, []byte{1, 0}) // Uncompressed
+	hello = appendTLSVector(hello, 2, extensions)
+
+	certificate := appendTLSVector(nil, 3, appendTLSVector(nil, 3, d.identity.certificate))
+
+	group := uint16(TLS_GROUP_SECP256R1)
+	if d.ecdhKey.Curve() == ecdh.X25519() {
+		group = TLS_GROUP_X25519
+	}
+	params := []byte{3, byte(group >> 8), byte(group)} // A named curve
+	params = appendTLSVector(params, 1, d.ecdhKey.PublicKey().Bytes())
+	signed := sha256.New()
+	signed.Write(d.clientRandom[:])
+	signed.Write(d.serverRandom[:])
+	signed.Write(params)
+	signature, err := ecdsa.SignASN1(rand.Reader, d.identity.key, signed.Sum(nil))
+	if err != nil {
+		return fmt.Errorf("failed to sign DTLS key share: %v", err)
+	}
+	keyExchange := binary.BigEndian.AppendUint16(params, TLS_ECDSA_SECP256R1_SHA256)
+	keyExchange = appendTLSVector(keyExchange, 2, signature)
+
+	request := appendTLSVector(nil, 1, []byte{TLS_ECDSA_SIGN, TLS_RSA_SIGN})
+	request = appendTLSVector(request, 2, []byte{0x04, 0x03, 0x04, 0x01})
+	request = appendTLSVector(request, 2, nil) // Any certificate authority
+
+	var flight []byte
+	for _, m := range []struct {
+		msgType byte
+		body    []byte
+	}{
+		{dtlsServerHello, hello},
+		{dtlsCertificate, certificate},
+		{dtlsServerKeyExchange, keyExchange},
+		{dtlsCertificateRequest, request},
+		{dtlsServerHelloDone, nil},
+	} {
+		flight = d.appendRecord(flight, dtlsHandshake, d.handshakeMessage(m.msgType, m.body))
+	}
+	d.flight = flight
+	d.send(flight)
+	return nil
+}
+
+// sendFinished ends the handshake: ChangeCipherSpec, then our Finished,
+// the first record we encrypt
+func (d *dtlsServer) sendFinished() {
+	sum := sha256.Sum256(d.transcript.Bytes())
+	finished := d.handshakeMessage(dtlsFinished, tlsPRF(d.master, "server finished", sum[:], 12))
+	flight := d.appendRecord(nil, dtlsChangeCipherSpec, []byte{1})
+	d.writeEpoch = 1
+	flight = d.appendRecord(flight, dtlsHandshake, finished)
+	d.flight = flight
+	d.send(flight)
+}
+
+// handshakeMessage frames a handshake message of ours, whole, and adds it
+// to the transcript
+func (d *dtlsServer) handshakeMessage(msgType byte, body []byte) []byte {
+	message := make([]byte, DTLS_HANDSHAKE_HEADER_SIZE, DTLS_HANDSHAKE_HEADER_SIZE+len(body))
+	message[0] = msgType
+	putUint24(message[1:4], uint32(len(body)))
+	binary.BigEndian.PutUint16(message[4:6], d.sendSeq)
+	putUint24(message[9:12], uint32(len(body)))
+	message = append(message, body...)
+	d.sendSeq++
+	d.transcript.Write(message)
+	return message
+}
+
+// appendRecord adds a record in the current write epoch to a datagram,
+// encrypted from epoch 1
+func (d *dtlsServer) appendRecord(datagram []byte, contentType byte, payload []byte) []byte {
+	epoch := d.writeEpoch
+	seq := d.writeSeq[epoch]
+	d.writeSeq[epoch]++
+
+	header := make([]byte, DTLS_RECORD_HEADER_SIZE)
+	header[0] = contentType
+	binary.BigEndian.PutUint16(header[1:3], DTLS_VERSION)
+	binary.BigEndian.PutUint64(header[3:11], uint64(epoch)<<48|seq)
+	if epoch > 0 {
+		explicit := bytes.Clone(header[3:11])
+		nonce := append(bytes.Clone(d.writeIV), explicit...)
+		binary.BigEndian.PutUint16(header[11:13], uint16(len(payload)))
+		additional := append(bytes.Clone(header[3:11]), header[0], header[1], header[2], header[11], header[12])
+		payload = d.writeAEAD.Seal(explicit, nonce, payload, additional)
+	}
+	binary.BigEndian.PutUint16(header[11:13], uint16(len(payload)))
+	return append(append(datagram, header...), payload...)
+}
+
+// open decrypts a record the browser encrypted
+func (d *dtlsServer) open(header, fragment []byte) ([]byte, error) {
+	if d.readAEAD == nil || len(fragment) < DTLS_EXPLICIT_NONCE_SIZE+d.readAEAD.Overhead() {
+		return nil, errors.New("DTLS record can't be decrypted")
+	}
+	nonce := append(bytes.Clone(d.readIV), fragment[:DTLS_EXPLICIT_NONCE_SIZE]...)
+	ciphertext := fragment[DTLS_EXPLICIT_NONCE_SIZE:]
+	length := len(ciphertext) - d.readAEAD.Overhead()
+	additional := append(bytes.Clone(header[3:11]), header[0], header[1], header[2], byte(length>>8), byte(length))
+	return d.readAEAD.Open(nil, nonce, ciphertext, additional)
+}
+
+// deriveRecordKeys makes the AES-GCM keys and implicit nonces each side
+// protects its records with (RFC 5246 section 6.3, RFC 5288)
+func (d *dtlsServer) deriveRecordKeys() error {
+	block := tlsPRF(d.master, "key expansion", append(d.serverRandom[:], d.clientRandom[:]...), 2*16+2*4)
+	clientKey, serverKey, ivs := block[:16], block[16:32], block[32:]
+	var err error
+	if d.readAEAD, err = newGCM(clientKey); err != nil {
+		return err
+	}
+	if d.writeAEAD, err = newGCM(serverKey); err != nil {
+		return err
+	}
+	d.readIV, d.writeIV = ivs[:4], ivs[4:]
+	return nil
+}
+
+// newGCM is AES-GCM with key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DTLS cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// tlsPRF is TLS 1.2's PRF with SHA-256 (RFC 5246 section 5)
+func tlsPRF(secret []byte, label string, seed []byte, n int) []byte {
+	labelSeed := append([]byte(label), seed...)
+	mac := hmac.New(sha256.New, secret)
+	var out []byte
+	a := labelSeed
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelSeed)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+// tlsReader reads TLS's big-endian integers and length-prefixed vectors;
+// reading past the end sets err and gives zeros
+type tlsReader struct {
+	data []byte
+	err  error
+}
+
+// bytes is the next n bytes
+func (r *tlsReader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errors.New("TLS message too short")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// uint16 is the next two bytes
+func (r *tlsReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// vector is the next vector whose length takes size bytes
+func (r *tlsReader) vector(size int) []byte {
+	b := r.bytes(size)
+	n := 0
+	for _, v := range b {
+		n = n<<8 | int(v)
+	}
+	return r.bytes(n)
+}
+
+// appendTLSVector adds data with its length in size bytes
+func appendTLSVector(b []byte, size int, data []byte) []byte {
+	for i := size - 1; i >= 0; i-- {
+		b = append(b, byte(len(data)>>(8*i)))
+	}
+	return append(b, data...)
+}
+
+// appendTLSExtension adds an extension of a kind
+func appendTLSExtension(b []byte, kind uint16, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, kind)
+	return appendTLSVector(b, 2, data)
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+)
+
+// handshakeFragment builds one fragment of a handshake message, as it
+// comes in a record
+func handshakeFragment(msgType byte, length int, seq uint16, offset int, piece []byte) []byte {
+	fragment := make([]byte, DTLS_HANDSHAKE_HEADER_SIZE+len(piece))
+	fragment[0] = msgType
+	putUint24(fragment[1:4], uint32(length))
+	binary.BigEndian.PutUint16(fragment[4:6], seq)
+	putUint24(fragment[6:9], uint32(offset))
+	putUint24(fragment[9:12], uint32(len(piece)))
+	copy(fragment[DTLS_HANDSHAKE_HEADER_SIZE:], piece)
+	return fragment
+}
+
+func TestHandshakeFragmentsThatDisagree(t *testing.T) {
+	d := newDTLSServer(nil, "", func([]byte) {}, func(*srtpKeys) {})
+
+	// The first fragment says the message is 4 bytes; a later one with the
+	// same message_seq claims 64 and writes past the first's buffer
+	if _, err := d.handleHandshake(handshakeFragment(dtlsClientHello, 4, 0, 0, []byte{1, 2}), 0); err != nil {
+		t.Fatalf("first fragment: %v", err)
+	}
+	if _, err := d.handleHandshake(handshakeFragment(dtlsClientHello, 64, 0, 32, make([]byte, 32)), 0); err != nil {
+		t.Fatalf("longer fragment: %v", err)
+	}
+	if _, err := d.handleHandshake(handshakeFragment(dtlsCertificate, 4, 0, 2, []byte{3, 4}), 0); err != nil {
+		t.Fatalf("fragment of another type: %v", err)
+	}
+
+	m := d.pieces[0]
+	if m == nil || m.length != 4 || m.received() != 2 {
+		t.Fatalf("buffered message changed by fragments that contradict it: %+v", m)
+	}
+}
+
+// dtlsRecords splits a datagram into its records' content types and
+// payloads, leaving encrypted ones as they came
+func dtlsRecords(datagram []byte) (types []byte, headers, payloads [][]byte) {
+	for len(datagram) >= DTLS_RECORD_HEADER_SIZE {
+		length := int(binary.BigEndian.Uint16(datagram[11:13]))
+		types = append(types, datagram[0])
+		headers = append(headers, datagram[:DTLS_RECORD_HEADER_SIZE])
+		payloads = append(payloads, datagram[DTLS_RECORD_HEADER_SIZE:DTLS_RECORD_HEADER_SIZE+length])
+		datagram = datagram[DTLS_RECORD_HEADER_SIZE+length:]
+	}
+	return types, headers, payloads
+}
+
+// appendDTLSRecord adds a record to a datagram, sealing it with aead and
+// iv in epoch 1 the way RFC 5288 says, rather than as dtlsServer does
+func appendDTLSRecord(datagram []byte, contentType byte, epoch uint16, seq uint64, payload []byte, aead cipher.AEAD, iv []byte) []byte {
+	header := []byte{contentType, DTLS_VERSION >> 8, DTLS_VERSION & 0xFF}
+	header = binary.BigEndian.AppendUint64(header, uint64(epoch)<<48|seq)
+	if epoch > 0 {
+		explicit := header[3:11]
+		additional := binary.BigEndian.AppendUint16(slices.Concat(explicit, header[:3]), uint16(len(payload)))
+		payload = aead.Seal(slices.Clone(explicit), slices.Concat(iv, explicit), payload, additional)
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(append(datagram, header...), payload...)
+}
+
+// testDTLSIdentity is a browser's certificate and key
+func testDTLSIdentity(t *testing.T) *dtlsIdentity {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(certificate)
+	return &dtlsIdentity{certificate: certificate, key: key, fingerprint: "sha-256 " + colonHex(sum[:])}
+}
+
+func TestTLSPRF(t *testing.T) {
+	// The TLS 1.2 SHA-256 PRF test vector published on the IETF TLS list
+	secret, _ := hex.DecodeString("9bbe436ba940f017b17652849a71db35")
+	seed, _ := hex.DecodeString("a0ba9f936cda311827a6f796ffd5198c")
+	want := "e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a" +
+		"6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab" +
+		"4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff701" +
+		"87347b66"
+	if got := hex.EncodeToString(tlsPRF(secret, "test label", seed, 100)); got != want {
+		t.Errorf("tlsPRF = %s, want %s", got, want)
+	}
+}
+
+func TestDTLSHandshake(t *testing.T) {
+	identity, err := ourDTLSIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := testDTLSIdentity(t)
+	var sent [][]byte
+	var keys *srtpKeys
+	d := newDTLSServer(identity, browser.fingerprint, func(b []byte) { sent = append(sent, b) }, func(k *srtpKeys) { keys = k })
+	var transcript bytes.Buffer
+
+	// ClientHello, in pieces that overlap and come last first
+	var clientRandom [32]byte
+	rand.Read(clientRandom[:])
+	var extensions []byte
+	extensions = appendTLSExtension(extensions, TLS_EXT_SUPPORTED_GROUPS, appendTLSVector(nil, 2, []byte{0, TLS_GROUP_X25519}))
+	extensions = appendTLSExtension(extensions, TLS_EXT_USE_SRTP, []byte{0, 2, 0, 1, 0})
+	extensions = appendTLSExtension(extensions, TLS_EXT_EXTENDED_MASTER, nil)
+	hello := binary.BigEndian.AppendUint16(nil, DTLS_VERSION)
+	hello = append(hello, clientRandom[:]...)
+	hello = append(hello, 0, 0) // No session ID or cookie
+	hello = appendTLSVector(hello, 2, []byte{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 >> 8, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 & 0xFF})
+	hello = append(hello, 1, 0) // No compression
+	hello = appendTLSVector(hello, 2, extensions)
+	transcript.Write(handshakeFragment(dtlsClientHello, len(hello), 0, 0, hello))
+	var datagram []byte
+	for i, piece := range [][2]int{{40, len(hello)}, {10, 50}, {0, 20}} {
+		fragment := handshakeFragment(dtlsClientHello, len(hello), 0, piece[0], hello[piece[0]:piece[1]])
+		datagram = appendDTLSRecord(datagram, dtlsHandshake, 0, uint64(i), fragment, nil, nil)
+	}
+	if err := d.handle(datagram); err != nil {
+		t.Fatalf("ClientHello: %v", err)
+	}
+
+	// The server's flight: hello, certificate, key share, certificate
+	// request and done, whole and in order
+	if len(sent) != 1 {
+		t.Fatalf("server sent %d flights to ClientHello, want 1", len(sent))
+	}
+	types, _, messages := dtlsRecords(sent[0])
+	if !bytes.Equal(types, bytes.Repeat([]byte{dtlsHandshake}, 5)) {
+		t.Fatalf("server flight has records %v, want 5 handshake records", types)
+	}
+	for i, msgType := range []byte{dtlsServerHello, dtlsCertificate, dtlsServerKeyExchange, dtlsCertificateRequest, dtlsServerHelloDone} {
+		if messages[i][0] != msgType {
+			t.Fatalf("server message %d is type %d, want %d", i, messages[i][0], msgType)
+		}
+		transcript.Write(messages[i])
+	}
+	serverHello := &tlsReader{data: messages[0][DTLS_HANDSHAKE_HEADER_SIZE:]}
+	serverHello.uint16()
+	serverRandom := serverHello.bytes(32)
+	keyExchange := &tlsReader{data: messages[2][DTLS_HANDSHAKE_HEADER_SIZE:]}
+	params := keyExchange.bytes(3)
+	serverShare := keyExchange.vector(1)
+	keyExchange.uint16()
+	signature := keyExchange.vector(2)
+	if keyExchange.err != nil || !bytes.Equal(params, []byte{3, 0, TLS_GROUP_X25519}) {
+		t.Fatalf("server key exchange is for %x: %v", params, keyExchange.err)
+	}
+	signed := sha256.Sum256(slices.Concat(clientRandom[:], serverRandom, params, []byte{byte(len(serverShare))}, serverShare))
+	if !ecdsa.VerifyASN1(&identity.key.PublicKey, signed[:], signature) {
+		t.Fatal("server's key share isn't signed by its certificate")
+	}
+
+	// The browser's certificate, key share, proof and Finished
+	share, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	serverKey, err := ecdh.X25519().NewPublicKey(serverShare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preMaster, _ := share.ECDH(serverKey)
+	certificate := handshakeFragment(dtlsCertificate, 0, 1, 0, appendTLSVector(nil, 3, appendTLSVector(nil, 3, browser.certificate)))
+	putUint24(certificate[1:4], uint32(len(certificate)-DTLS_HANDSHAKE_HEADER_SIZE))
+	keyShare := appendTLSVector(nil, 1, share.PublicKey().Bytes())
+	clientKeyExchange := handshakeFragment(dtlsClientKeyExchange, len(keyShare), 2, 0, keyShare)
+	transcript.Write(certificate)
+	transcript.Write(clientKeyExchange)
+	sessionHash := sha256.Sum256(transcript.Bytes())
+	master := tlsPRF(preMaster, "extended master secret", sessionHash[:], 48)
+	proof, _ := ecdsa.SignASN1(rand.Reader, browser.key, sessionHash[:])
+	proof = appendTLSVector(binary.BigEndian.AppendUint16(nil, TLS_ECDSA_SECP256R1_SHA256), 2, proof)
+	certificateVerify := handshakeFragment(dtlsCertificateVerify, len(proof), 3, 0, proof)
+	transcript.Write(certificateVerify)
+	sum := sha256.Sum256(transcript.Bytes())
+	finished := handshakeFragment(dtlsFinished, 12, 4, 0, tlsPRF(master, "client finished", sum[:], 12))
+	transcript.Write(finished)
+
+	block := tlsPRF(master, "key expansion", slices.Concat(serverRandom, clientRandom[:]), 40)
+	clientWrite, _ := newGCM(block[:16])
+	serverWrite, _ := newGCM(block[16:32])
+	datagram = nil
+	for i, message := range [][]byte{certificate, clientKeyExchange, certificateVerify} {
+		datagram = appendDTLSRecord(datagram, dtlsHandshake, 0, uint64(3+i), message, nil, nil)
+	}
+	datagram = appendDTLSRecord(datagram, dtlsChangeCipherSpec, 0, 6, []byte{1}, nil, nil)
+	datagram = appendDTLSRecord(datagram, dtlsHandshake, 1, 0, finished, clientWrite, block[32:36])
+	if err := d.handle(datagram); err != nil {
+		t.Fatalf("browser's second flight: %v", err)
+	}
+
+	// The server's Finished proves it saw the same handshake
+	if len(sent) != 2 {
+		t.Fatalf("server sent %d flights, want 2", len(sent))
+	}
+	types, headers, payloads := dtlsRecords(sent[1])
+	if !bytes.Equal(types, []byte{dtlsChangeCipherSpec, dtlsHandshake}) {
+		t.Fatalf("server's last flight has records %v", types)
+	}
+	explicit := payloads[1][:DTLS_EXPLICIT_NONCE_SIZE]
+	length := len(payloads[1]) - DTLS_EXPLICIT_NONCE_SIZE - serverWrite.Overhead()
+	additional := binary.BigEndian.AppendUint16(slices.Concat(headers[1][3:11], headers[1][:3]), uint16(length))
+	serverFinished, err := serverWrite.Open(nil, slices.Concat(block[36:40], explicit), payloads[1][DTLS_EXPLICIT_NONCE_SIZE:], additional)
+	if err != nil {
+		t.Fatalf("server's Finished can't be decrypted: %v", err)
+	}
+	sum = sha256.Sum256(transcript.Bytes())
+	if want := tlsPRF(master, "server finished", sum[:], 12); !bytes.Equal(serverFinished[DTLS_HANDSHAKE_HEADER_SIZE:], want) {
+		t.Errorf("server's Finished is %x, want %x", serverFinished[DTLS_HANDSHAKE_HEADER_SIZE:], want)
+	}
+
+	// and the SRTP keys are the ones the browser exports (RFC 5764
+	// section 4.2): its key and salt first, then ours
+	if keys == nil {
+		t.Fatal("handshake finished without SRTP keys")
+	}
+	material := tlsPRF(master, DTLS_SRTP_EXPORTER_LABEL, slices.Concat(clientRandom[:], serverRandom), 60)
+	if keys.suite != srtpSuites[0] {
+		t.Errorf("SRTP suite %s, want %s", keys.suite.name, srtpSuites[0].name)
+	}
+	if want := slices.Concat(material[:16], material[32:46]); !bytes.Equal(keys.remote, want) {
+		t.Errorf("browser's SRTP key %x, want %x", keys.remote, want)
+	}
+	if want := slices.Concat(material[16:32], material[46:60]); !bytes.Equal(keys.local, want) {
+		t.Errorf("our SRTP key %x, want %x", keys.local, want)
+	}
+}
+
+func TestHandshakeMessageTooLong(t *testing.T) {
+	d := newDTLSServer(nil, "", func([]byte) {}, func(*srtpKeys) {})
+
+	// A fragment claiming a message of 16 MB is refused before anything is
+	// allocated for it
+	if _, err := d.handleHandshake(handshakeFragment(dtlsClientHello, 1<<24-1, 0, 0, []byte{1}), 0); err == nil {
+		t.Error("handshake message of 16 MB accepted")
+	}
+	if len(d.pieces) != 0 {
+		t.Errorf("%d messages buffered", len(d.pieces))
+	}
+}
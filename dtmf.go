@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// EVENT_END_TIMEOUT is how long a key press sent as telephone events
+	// may go without a packet before it is taken to have ended with its
+	// end packets lost (RFC 4733 section 2.5.2.2); phones send an update
+	// every 50ms or so while a key is held
+	EVENT_END_TIMEOUT = 250 * time.Millisecond
+
+	// DTMF_WINDOW is how much audio each look for a key takes in: two tone
+	// blocks, the last one and the one before, for the resolution to tell
+	// apart rows 73 Hz apart
+	DTMF_WINDOW = 2 * TONE_BLOCK
+
+	// A key's tones may be off their frequencies by up to DTMF_TOLERANCE.
+	// ITU-T Q.24 has receivers take tones 1.5% off and refuse those 3.5%
+	// off; the line is drawn halfway. Each tone is looked for in steps of
+	// DTMF_SEARCH_STEP out to DTMF_SEARCH either side, and where it is
+	// strongest tells how far off it is.
+	DTMF_TOLERANCE   = 0.025
+	DTMF_SEARCH      = 0.04
+	DTMF_SEARCH_STEP = 0.01
+
+	// DTMF_MIN_TONE is how long a key's tones must sound to count; ITU-T
+	// Q.24 has receivers take 40ms and refuse anything under 23ms
+	DTMF_MIN_TONE = 40 * time.Millisecond
+
+	// DTMF_MIN_GAP is the pause that ends a key press, so that a key held
+	// through a dropout counts once but pressed twice counts twice
+	DTMF_MIN_GAP = 30 * time.Millisecond
+
+	// DTMF_MIN_SHARE is how much of the window's energy a key's two tones
+	// need between them; speech and music spread theirs wider
+	DTMF_MIN_SHARE = 0.75
+
+	// The high tone may be up to 8 dB louder than the low one, and the low
+	// up to 4 dB louder than the high, as line losses leave them
+	DTMF_NORMAL_TWIST  = 6.3
+	DTMF_REVERSE_TWIST = 2.5
+
+	// DTMF_PEAK_RATIO is how much stronger each tone must be than the
+	// others of its group, 8 dB
+	DTMF_PEAK_RATIO = 6.3
+)
+
+// dtmfRows and dtmfColumns are the low and high tones of the keypad;
+// dtmfKeys names the key at each pairing
+var (
+	dtmfRows    = [4]float64{697, 770, 852, 941}
+	dtmfColumns = [4]float64{1209, 1336, 1477, 1633}
+	dtmfKeys    = [4][4]string{
+		{"1", "2", "3", "A"},
+		{"4", "5", "6", "B"},
+		{"7", "8", "9", "C"},
+		{"*", "0", "#", "D"},
+	}
+)
+
+// dtmfTaper is the Hann window each window of audio is tapered by, so that
+// a tone's energy stays close to its frequency and where it is strongest
+// shows how far off it is, and dtmfTaperGain makes up the energy the
+// taper takes from a tone
+var dtmfTaper, dtmfTaperGain = func() (taper [DTMF_WINDOW]float64, gain float64) {
+	var sum, squares float64
+	for i := range taper {
+		taper[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(len(taper)))
+		sum += taper[i]
+		squares += taper[i] * taper[i]
+	}
+	return taper, float64(len(taper)) * squares / (sum * sum)
+}()
+
+// dtmfKey names the key whose tones fill a window, if there is one: the
+// strongest tone of each group, well clear of the rest of its group, with
+// little else besides and within the twist allowed between them
+func dtmfKey(window []float64) string {
+	if blockLevel(window) < TONE_MIN_LEVEL {
+		return ""
+	}
+	var tapered [DTMF_WINDOW]float64
+	for i, x := range window {
+		tapered[i] = x * dtmfTaper[i]
+	}
+	row, rowShare, rowNext := strongestTone(tapered[:], dtmfRows)
+	column, columnShare, columnNext := strongestTone(tapered[:], dtmfColumns)
+	switch {
+	case rowShare+columnShare < DTMF_MIN_SHARE,
+		columnShare > rowShare*DTMF_NORMAL_TWIST,
+		rowShare > columnShare*DTMF_REVERSE_TWIST,
+		rowShare < rowNext*DTMF_PEAK_RATIO,
+		columnShare < columnNext*DTMF_PEAK_RATIO:
+		return ""
+	}
+	return dtmfKeys[row][column]
+}
+
+// strongestTone finds which of a group of frequencies holds the most of a
+// tapered window's energy, its share, and the share of the next strongest
+func strongestTone(window []float64, group [4]float64) (strongest int, share, next float64) {
+	for i, freq := range group {
+		s := keyToneShare(window, freq)
+		switch {
+		case s > share:
+			strongest, share, next = i, s, share
+		case s > next:
+			next = s
+		}
+	}
+	return strongest, share, next
+}
+
+// keyToneShare is the share of a tapered window's energy held by a tone
+// near freq, as strong as it is where it is strongest; none if that is
+// further than DTMF_TOLERANCE from freq, as a tone off by more than that
+// is some other sound
+func keyToneShare(window []float64, freq float64) float64 {
+	var share, offset float64
+	steps := int(math.Round(DTMF_SEARCH / DTMF_SEARCH_STEP))
+	for step := -steps; step <= steps; step++ {
+		off := float64(step) * DTMF_SEARCH_STEP
+		if s := toneShare(window, freq*(1+off)); s > share {
+			share, offset = s, off
+		}
+	}
+	if math.Abs(offset) > DTMF_TOLERANCE {
+		return 0
+	}
+	return share * dtmfTaperGain
+}
+
+// dtmfDetector listens to a call for keys pressed on a phone that sends
+// them in-band, as tones in its audio, and reports each press once it has
+// lasted DTMF_MIN_TONE. Each block is looked at with the one before it, so
+// windows overlap by half.
+type dtmfDetector struct {
+	digits   chan string
+	previous [TONE_BLOCK]float64
+	window   [DTMF_WINDOW]float64
+	started  bool   // previous holds a block
+	key      string // Being pressed, as far as can be told
+	held     int    // Windows it has been heard in
+	gap      int    // Windows since it was last heard
+	emitted  bool   // Reported already
+}
+
+// newDTMFDetector creates a detector with room for a burst of digits
+func newDTMFDetector() *dtmfDetector {
+	return &dtmfDetector{digits: make(chan string, 32)}
+}
+
+// Block looks at the next block of received audio
+func (d *dtmfDetector) Block(block []float64) {
+	blockTime := time.Second / (SAMPLE_RATE / TONE_BLOCK)
+
+	copy(d.window[:TONE_BLOCK], d.previous[:])
+	copy(d.window[TONE_BLOCK:], block)
+	copy(d.previous[:], block)
+	if !d.started {
+		d.started = true
+		return
+	}
+
+	key := dtmfKey(d.window[:])
+	switch {
+	case key == "":
+		if d.gap++; time.Duration(d.gap)*blockTime >= DTMF_MIN_GAP {
+			d.key, d.held, d.emitted = "", 0, false
+		}
+		return
+	case key != d.key:
+		d.key, d.held, d.emitted = key, 0, false
+	}
+	d.held++
+	d.gap = 0
+
+	// A window spans a block more than the blocks it moved on by
+	if !d.emitted && time.Duration(d.held+1)*blockTime >= DTMF_MIN_TONE {
+		d.emit(key)
+		d.emitted = true
+	}
+}
+
+// emit reports a digit, dropping it if the call has fallen behind
+func (d *dtmfDetector) emit(digit string) {
+	select {
+	case d.digits <- digit:
+	default:
+	}
+}
+
+// detectInbandDTMF has the keys a call's phone sends as tones handled
+// like those it sends as telephone events. A phone that sends events is
+// taken at its word, in case it leaves the tones in its audio as well.
+func (s *SIPServer) detectInbandDTMF(session *CallSession) {
+	detector := newDTMFDetector()
+	session.tones.Watch(func(block []float64) {
+		if !session.events.sent() {
+			detector.Block(block)
+		}
+	})
+
+	s.spawn(func() {
+		for {
+			select {
+			case digit := <-detector.digits:
+				fmt.Printf("🔢 DTMF Detected: %s (in-band, call %s)\n", digit, session.CallID)
+				s.handleDigit(session, digit)
+			case <-session.ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// keyPress is one press of a key sent as telephone events: the event,
+// and how long the key was held, in RTP timestamp units
+type keyPress struct {
+	event    byte
+	duration uint16
+}
+
+// eventTracker follows the key presses a phone sends as RFC 2833
+// telephone events. A press is sent as a run of packets sharing one
+// timestamp, each with the duration so far, the last three with the end
+// bit; however many arrive, a press is reported once, when it ends. A
+// press whose end never arrives ends when the next begins or, failing
+// that, after EVENT_END_TIMEOUT.
+type eventTracker struct {
+	mu        sync.Mutex
+	started   bool      // An event has arrived
+	pressing  bool      // The latest press is yet to end
+	timestamp uint32    // Of the latest press
+	press     keyPress  // The latest press, its duration so far
+	last      time.Time // When its last packet arrived
+	timer     *time.Timer
+	finish    func(keyPress)
+}
+
+// receive takes in a telephone event payload with the RTP timestamp of
+// its packet, arriving at now, handing finish each press that ends
+func (t *eventTracker) receive(payload []byte, timestamp uint32, now time.Time, finish func(keyPress)) {
+	event, end, duration := payload[0], payload[1]&0x80 != 0, binary.BigEndian.Uint16(payload[2:4])
+
+	t.mu.Lock()
+	var ended []keyPress
+	switch {
+	case t.started && timestamp == t.timestamp:
+		if !t.pressing {
+			t.mu.Unlock()
+			return // A repeat of the end, or a straggler after it
+		}
+		t.press.duration = max(t.press.duration, duration)
+	default:
+		if t.pressing {
+			ended = append(ended, t.press)
+		}
+		t.started, t.pressing, t.timestamp = true, true, timestamp
+		t.press = keyPress{event: event, duration: duration}
+	}
+	t.last, t.finish = now, finish
+	if end {
+		t.pressing = false
+		ended = append(ended, t.press)
+	} else if t.timer == nil {
+		t.timer = time.AfterFunc(EVENT_END_TIMEOUT, t.expire)
+	} else {
+		t.timer.Reset(EVENT_END_TIMEOUT)
+	}
+	t.mu.Unlock()
+
+	for _, press := range ended {
+		finish(press)
+	}
+}
+
+// expire ends a press that has gone EVENT_END_TIMEOUT without a packet
+func (t *eventTracker) expire() {
+	t.mu.Lock()
+	if !t.pressing || time.Since(t.last) < EVENT_END_TIMEOUT {
+		t.mu.Unlock()
+		return
+	}
+	t.pressing = false
+	press, finish := t.press, t.finish
+	t.mu.Unlock()
+
+	finish(press)
+}
+
+// sent reports whether the phone has sent any telephone events
+func (t *eventTracker) sent() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.started
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// keyDigits feeds a detector a key's tones, each off its frequency by the
+// fractions given, for 60ms between stretches of silence, and returns the
+// digits it heard
+func keyDigits(row, column int, rowOff, columnOff float64) []string {
+	detector := newDTMFDetector()
+	low, high := dtmfRows[row]*(1+rowOff), dtmfColumns[column]*(1+columnOff)
+	block := make([]float64, TONE_BLOCK)
+	n := 0
+	for i := range 16 {
+		for j := range block {
+			block[j] = 0
+			if i >= 5 && i < 11 {
+				t := float64(n) / SAMPLE_RATE
+				block[j] = 0.25*math.Sin(2*math.Pi*low*t) + 0.25*math.Sin(2*math.Pi*high*t)
+			}
+			n++
+		}
+		detector.Block(block)
+	}
+
+	var digits []string
+	for len(detector.digits) > 0 {
+		digits = append(digits, <-detector.digits)
+	}
+	return digits
+}
+
+func TestDTMFFrequencyTolerance(t *testing.T) {
+	tests := []struct {
+		rowOff, columnOff float64
+		heard             bool
+	}{
+		{0, 0, true},
+		{0.015, 0.015, true},
+		{-0.015, -0.015, true},
+		{0.015, -0.015, true},
+		{-0.015, 0.015, true},
+		{0.035, 0, false},
+		{-0.035, 0, false},
+		{0, 0.035, false},
+		{0, -0.035, false},
+		{0.035, 0.035, false},
+		{-0.035, -0.035, false},
+	}
+	for _, test := range tests {
+		for row := range dtmfRows {
+			for column := range dtmfColumns {
+				digits := keyDigits(row, column, test.rowOff, test.columnOff)
+				key := dtmfKeys[row][column]
+				switch {
+				case test.heard && (len(digits) != 1 || digits[0] != key):
+					t.Errorf("key %s off by %+.1f%%/%+.1f%%: heard %v, want %s", key, 100*test.rowOff, 100*test.columnOff, digits, key)
+				case !test.heard && len(digits) != 0:
+					t.Errorf("key %s off by %+.1f%%/%+.1f%%: heard %v, want nothing", key, 100*test.rowOff, 100*test.columnOff, digits)
+				}
+			}
+		}
+	}
+}
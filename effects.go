@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+)
+
+// Default effect levels, used when an effect's level is left at 0
+var defaultEffectLevels = map[string]float64{
+	"crackle":      0.3,
+	"crosstalk":    0.3,
+	"hiss":         0.2,
+	"longdistance": 0.5,
+	"reverb":       0.25,
+}
+
+// effect processes a frame of audio in place. Effects keep state between
+// frames (filter memory, delay lines), so each stream needs its own.
+type effect interface {
+	Process(samples []float64)
+}
+
+// effectSource runs a source's audio through a chain of effects
+type effectSource struct {
+	source  MediaSource
+	effects []effect
+	buffer  []float64
+}
+
+// newEffectSource applies the configured effects, in order, to source. The
+// noise they add is seeded the same way every time, so a destination
+// sounds identical on every call.
+func newEffectSource(source MediaSource, configs []EffectConfig) (*effectSource, error) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	effects := make([]effect, 0, len(configs))
+	for _, cfg := range configs {
+		level := cfg.Level
+		if level == 0 {
+			level = defaultEffectLevels[cfg.Type]
+		}
+		switch cfg.Type {
+		case "crackle":
+			effects = append(effects, &crackle{level: level, rng: rng})
+		case "crosstalk":
+			effects = append(effects, newCrosstalk(level, rng))
+		case "hiss":
+			effects = append(effects, &hiss{level: level, rng: rng})
+		case "longdistance":
+			effects = append(effects, newLongDistance(level))
+		case "reverb":
+			effects = append(effects, newReverb(level))
+		default:
+			return nil, fmt.Errorf("unknown effect %q", cfg.Type)
+		}
+	}
+	return &effectSource{source: source, effects: effects, buffer: make([]float64, MAX_FRAME_SIZE)}, nil
+}
+
+// ReadFrame reads the next frame from the source and processes it
+func (e *effectSource) ReadFrame(samples []int16) bool {
+	if !e.source.ReadFrame(samples) {
+		return false
+	}
+
+	buffer := e.buffer[:len(samples)]
+	for i, sample := range samples {
+		buffer[i] = float64(sample) / 32768
+	}
+	for _, fx := range e.effects {
+		fx.Process(buffer)
+	}
+	for i, value := range buffer {
+		samples[i] = int16(max(-1, min(value, 32767.0/32768)) * 32768)
+	}
+	return true
+}
+
+// crackle adds the clicks and pops of a worn record: sparse impulses that
+// die away over a millisecond or so
+type crackle struct {
+	level float64
+	rng   *rand.Rand
+	click float64 // Current click amplitude, decaying
+}
+
+func (c *crackle) Process(samples []float64) {
+	for i := range samples {
+		if c.rng.Float64() < c.level*0.002 {
+			c.click = (c.rng.Float64()*2 - 1) * (0.2 + 0.6*c.rng.Float64()) * c.level
+		}
+		samples[i] += c.click
+		c.click *= 0.7
+	}
+}
+
+// hiss adds tape hiss: white noise tilted toward the high end
+type hiss struct {
+	level float64
+	rng   *rand.Rand
+	last  float64
+}
+
+func (h *hiss) Process(samples []float64) {
+	amplitude := 0.05 * h.level
+	for i := range samples {
+		noise := (h.rng.Float64()*2 - 1) * amplitude
+		samples[i] += noise - 0.5*h.last // First difference favors the highs
+		h.last = noise
+	}
+}
+
+// crosstalk bleeds in someone else's call from a neighboring pair: a faint,
+// muffled voice that comes and goes, too quiet to make out
+type crosstalk struct {
+	level    float64
+	rng      *rand.Rand
+	muffle   *biquad
+	phase    float64 // Of the voice's fundamental, in cycles
+	pitch    float64 // Hz, gliding toward target
+	target   float64
+	envelope float64 // Current loudness, easing toward loud or silent
+	talking  bool
+	left     int // Samples until the next syllable or pause
+	voice    []float64
+}
+
+func newCrosstalk(level float64, rng *rand.Rand) *crosstalk {
+	return &crosstalk{level: level, rng: rng, muffle: newBiquad(false, 900), pitch: 140, target: 140}
+}
+
+func (c *crosstalk) Process(samples []float64) {
+	if cap(c.voice) < len(samples) {
+		c.voice = make([]float64, len(samples))
+	}
+	voice := c.voice[:len(samples)]
+	for i := range voice {
+		if c.left == 0 {
+			// Syllables of 80-250ms, with pauses between words and
+			// sometimes between sentences
+			c.talking = !c.talking || c.rng.Float64() < 0.6
+			if c.talking {
+				c.left = SAMPLE_RATE * (80 + c.rng.IntN(170)) / 1000
+				c.target = 100 + 120*c.rng.Float64()
+			} else {
+				c.left = SAMPLE_RATE * (60 + c.rng.IntN(500)) / 1000
+			}
+		}
+		c.left--
+
+		loudness := 0.0
+		if c.talking {
+			loudness = 1
+		}
+		c.envelope += (loudness - c.envelope) * 0.003
+		c.pitch += (c.target - c.pitch) * 0.0005
+		c.phase += c.pitch / SAMPLE_RATE
+		c.phase -= math.Floor(c.phase)
+
+		// A few harmonics give the buzz of a voice once muffled
+		value := 0.0
+		for harmonic := 1.0; harmonic <= 4; harmonic++ {
+			value += math.Sin(2*math.Pi*c.phase*harmonic) / harmonic
+		}
+		voice[i] = value * c.envelope
+	}
+	c.muffle.Process(voice)
+
+	amplitude := 0.04 * c.level
+	for i := range samples {
+		samples[i] += voice[i] * amplitude
+	}
+}
+
+// biquad is a second-order filter (RBJ Audio EQ Cookbook)
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+// newBiquad designs a low-pass or high-pass filter at cutoff Hz
+func newBiquad(highPass bool, cutoff float64) *biquad {
+	w := 2 * math.Pi * cutoff / SAMPLE_RATE
+	alpha := math.Sin(w) / math.Sqrt2 // sin(w) / 2Q, with Q = 1/√2
+	cos := math.Cos(w)
+
+	var b0, b1, b2 float64
+	if highPass {
+		b0, b1, b2 = (1+cos)/2, -(1 + cos), (1+cos)/2
+	} else {
+		b0, b1, b2 = (1-cos)/2, 1-cos, (1-cos)/2
+	}
+	a0 := 1 + alpha
+	return &biquad{
+		b0: b0 / a0, b1: b1 / a0, b2: b2 / a0,
+		a1: -2 * cos / a0, a2: (1 - alpha) / a0,
+	}
+}
+
+func (f *biquad) Process(samples []float64) {
+	for i, x := range samples {
+		y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+		f.x2, f.x1 = f.x1, x
+		f.y2, f.y1 = f.y1, y
+		samples[i] = y
+	}
+}
+
+// longDistance imitates a 1960s trunk call: a narrow 300-3000 Hz channel,
+// a little overdrive from the line amplifiers and a faint echo of the far
+// end coming back across the hybrid
+type longDistance struct {
+	highPass, lowPass *biquad
+	drive             float64
+	echo              []float64 // Delay line
+	echoPos           int
+	echoGain          float64
+}
+
+func newLongDistance(level float64) *longDistance {
+	return &longDistance{
+		highPass: newBiquad(true, 300+200*level),
+		lowPass:  newBiquad(false, 3000-800*level),
+		drive:    1 + 3*level,
+		echo:     make([]float64, SAMPLE_RATE*180/1000), // 180ms round trip
+		echoGain: 0.35 * level,
+	}
+}
+
+func (l *longDistance) Process(samples []float64) {
+	l.highPass.Process(samples)
+	l.lowPass.Process(samples)
+	for i, x := range samples {
+		x = math.Tanh(x*l.drive) / l.drive // Unity gain when quiet, squashed when loud
+		delayed := l.echo[l.echoPos]
+		l.echo[l.echoPos] = x
+		l.echoPos = (l.echoPos + 1) % len(l.echo)
+		samples[i] = x + delayed*l.echoGain
+	}
+}
+
+// reverb is a small Schroeder reverberator: parallel comb filters into
+// series all-pass filters, mixed in lightly
+type reverb struct {
+	combs     []*delayLine
+	allpasses []*delayLine
+	mix       float64
+}
+
+// delayLine is a feedback delay used by the reverb
+type delayLine struct {
+	buffer   []float64
+	pos      int
+	feedback float64
+}
+
+func newReverb(level float64) *reverb {
+	r := &reverb{mix: level}
+	// Mutually prime lengths (in samples at 8kHz) avoid metallic ringing
+	for _, length := range []int{239, 271, 307, 353} {
+		r.combs = append(r.combs, &delayLine{buffer: make([]float64, length), feedback: 0.78})
+	}
+	for _, length := range []int{43, 13} {
+		r.allpasses = append(r.allpasses, &delayLine{buffer: make([]float64, length), feedback: 0.7})
+	}
+	return r
+}
+
+func (r *reverb) Process(samples []float64) {
+	for i, x := range samples {
+		wet := 0.0
+		for _, comb := range r.combs {
+			delayed := comb.buffer[comb.pos]
+			comb.buffer[comb.pos] = x + delayed*comb.feedback
+			comb.pos = (comb.pos + 1) % len(comb.buffer)
+			wet += delayed
+		}
+		wet /= float64(len(r.combs))
+
+		for _, allpass := range r.allpasses {
+			delayed := allpass.buffer[allpass.pos]
+			out := delayed - wet*allpass.feedback
+			allpass.buffer[allpass.pos] = wet + out*allpass.feedback
+			allpass.pos = (allpass.pos + 1) % len(allpass.buffer)
+			wet = out
+		}
+
+		samples[i] = x*(1-r.mix/2) + wet*r.mix
+	}
+}
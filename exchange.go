@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// exchange is one logical telephone exchange: its own registrations, dial
+// plan and destinations. A SIPServer serves one or more exchanges on its
+// socket and picks between them by the domain a request is addressed to,
+// so one box can host two installations or a prod/test split.
+type exchange struct {
+	name       string
+	domain     string
+	config     *Config // Dial plan and destinations; sockets belong to the server
+	registrar  *registrar
+	auth       *digestAuth // nil if anyone may register
+	dialPlan   *DialPlan
+	queues     map[string]*callQueue // For destinations with a capacity
+	forwarding *forwardingTable
+	screen     *callScreen // For calls coming in from outside
+	unlocks    *unlockTable
+	passports  *passportBook
+	mailboxes  *mailboxTable
+	stats      *callStats
+}
+
+// newExchange compiles an exchange from its config
+func newExchange(cfg *Config) (*exchange, error) {
+	dialPlan, err := newDialPlan(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("exchange %q: %v", cfg.Name, err)
+	}
+
+	screen, err := newCallScreen(cfg.Screening)
+	if err != nil {
+		return nil, fmt.Errorf("exchange %q: %v", cfg.Name, err)
+	}
+
+	store, err := openStateStore(cfg.ResolvePath(cfg.StateFile))
+	if err != nil {
+		return nil, fmt.Errorf("exchange %q: %v", cfg.Name, err)
+	}
+	unlocks, err := newUnlockTable(store, cfg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("exchange %q: %v", cfg.Name, err)
+	}
+	passports, err := newPassportBook(store, cfg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("exchange %q: %v", cfg.Name, err)
+	}
+
+	mailboxes, err := newMailboxTable(store, cfg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("exchange %q: %v", cfg.Name, err)
+	}
+
+	registrar := cfg.Registrar
+	registrar.Users = cfg.SIPUsers()
+
+	queues := make(map[string]*callQueue)
+	for name, dest := range cfg.Destinations {
+		if dest.Capacity > 0 {
+			queues[name] = newCallQueue(dest.Capacity)
+		}
+	}
+
+	return &exchange{
+		name:       cfg.Name,
+		domain:     strings.ToLower(cfg.Domain),
+		config:     cfg,
+		registrar:  newRegistrar(cfg.Registrar.MaxRegistrations),
+		auth:       newDigestAuth(registrar, cfg.Domain),
+		dialPlan:   dialPlan,
+		queues:     queues,
+		forwarding: newForwardingTable(cfg.Forwarding),
+		screen:     screen,
+		unlocks:    unlocks,
+		passports:  passports,
+		mailboxes:  mailboxes,
+		stats:      newCallStats(),
+	}, nil
+}
+
+// AddExchange adds another exchange to the server's socket
+func (s *SIPServer) AddExchange(cfg *Config) error {
+	ex, err := newExchange(cfg)
+	if err != nil {
+		return err
+	}
+	s.exchangesMu.Lock()
+	s.exchanges = append(s.exchanges, ex)
+	s.exchangesMu.Unlock()
+	return nil
+}
+
+// Exchanges returns the exchanges served on the server's socket, the
+// default first
+func (s *SIPServer) Exchanges() []*exchange {
+	s.exchangesMu.RLock()
+	defer s.exchangesMu.RUnlock()
+	return s.exchanges
+}
+
+// exchangeFor picks the exchange a request is addressed to by the host in
+// its Request-URI. Requests for unknown domains go to the exchange without
+// a domain, or failing that the server's first exchange.
+func (s *SIPServer) exchangeFor(message string) *exchange {
+	host := ""
+	if lines := splitLines(message); len(lines) > 0 {
+		host = strings.ToLower(requestURIHost(lines[0]))
+	}
+
+	exchanges := s.Exchanges()
+	fallback := exchanges[0]
+	for _, ex := range exchanges {
+		if ex.domain == host && host != "" {
+			return ex
+		}
+		if ex.domain == "" && fallback.domain != "" {
+			fallback = ex
+		}
+	}
+	return fallback
+}
+
+// requestURIHost extracts the host from a request line such as
+// "INVITE sip:1234@example.com:5060;transport=udp SIP/2.0"
+func requestURIHost(requestLine string) string {
+	parts := strings.Fields(requestLine)
+	if len(parts) < 2 {
+		return ""
+	}
+	uri, err := parseSIPURI(parts[1])
+	if err != nil {
+		return ""
+	}
+	return uri.Host
+}
+
+// newServers creates a SIPServer for every distinct listen address in the
+// config, each serving the exchanges bound to that address
+func newServers(cfg *Config) ([]*SIPServer, error) {
+	var servers []*SIPServer
+	byAddr := make(map[string]*SIPServer)
+
+	for _, exCfg := range cfg.ExchangeConfigs() {
+		if server, ok := byAddr[exCfg.ListenAddr()]; ok {
+			if err := server.AddExchange(exCfg); err != nil {
+				closeServers(servers)
+				return nil, err
+			}
+			continue
+		}
+
+		server, err := NewSIPServer(exCfg)
+		if err != nil {
+			closeServers(servers)
+			return nil, err
+		}
+		servers = append(servers, server)
+		byAddr[exCfg.ListenAddr()] = server
+	}
+	return servers, nil
+}
+
+// closeServers shuts down every server
+func closeServers(servers []*SIPServer) {
+	for _, server := range servers {
+		server.Close()
+	}
+}
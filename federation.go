@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// ListenFederation accepts tunnels from peer installations. Their calls are
+// handled by the server's default exchange.
+func (s *SIPServer) ListenFederation(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for peers: %v", err)
+	}
+	s.federation = listener
+
+	fmt.Printf("🌐 Federation listening on %s as %q\n", listener.Addr(), s.config.Federation.Name)
+	s.spawn(func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Printf("❌ Error accepting peer connection: %v", err)
+				continue
+			}
+			s.spawn(func() { s.handlePeerConnection(conn) })
+		}
+	})
+	return nil
+}
+
+// handlePeerConnection authenticates a peer and answers its call: the
+// number it sends is dialed on the default exchange, or, if empty, the
+// caller gets dial tone and dials themselves.
+func (s *SIPServer) handlePeerConnection(conn net.Conn) {
+	t, err := acceptTunnel(conn, s.config.Federation.Peer)
+	if err != nil {
+		log.Printf("❌ Rejected peer connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(TUNNEL_HANDSHAKE_TIMEOUT))
+	call, err := t.Receive()
+	callerID := ""
+	if err == nil && call.kind == FRAME_CALLER {
+		callerID = string(call.payload)
+		call, err = t.Receive()
+	}
+	if err != nil || call.kind != FRAME_CALL {
+		log.Printf("❌ Peer %s sent no call: %v", t.peer, err)
+		t.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	number := string(call.payload)
+
+	fmt.Printf("🌐 Call from peer %s for %q\n", t.peer, number)
+	session := s.startTunnelLeg(s.Exchanges()[0], t)
+	session.callerID = callerID
+	if !s.screenIncomingCall(session, "peer "+t.peer, number) {
+		s.receiveTunnel(session)
+		return
+	}
+	if number == "" {
+		session.DialToneActive.Store(true)
+		s.spawn(func() { s.generateDialTone(session) })
+	}
+	for i := 0; i < len(number); i++ {
+		s.collectDigit(session, number[i:i+1])
+	}
+
+	s.receiveTunnel(session)
+}
+
+// callPeer connects a call to a peer installation, which dials number on
+// its side. Digits pressed after that are passed along, so the caller can
+// keep dialing the far exchange.
+func (s *SIPServer) callPeer(session *CallSession, dest DestinationConfig, number string) {
+	federation := session.exchange.config.Federation
+	peer, _ := federation.Peer(dest.Peer)
+
+	fmt.Printf("🌐 Calling peer %s for %q\n", peer.Name, number)
+	t, err := dialTunnel(peer, federation.Name)
+	if err != nil {
+		log.Printf("❌ %v", err)
+		s.playTone(session.ctx, session, session.progressTone(progressBusy))
+		return
+	}
+	if caller := session.caller(); caller != "" {
+		t.Send(FRAME_CALLER, []byte(caller))
+	}
+	t.Send(FRAME_CALL, []byte(number))
+
+	leg := s.startTunnelLeg(session.exchange, t)
+	s.spawn(func() { s.receiveTunnel(leg) })
+
+	session.digitsMu.Lock()
+	session.digitSink = func(digit string) { t.Send(FRAME_DIGIT, []byte(digit)) }
+	session.digitsMu.Unlock()
+
+	s.bridge(session, leg)
+}
+
+// startTunnelLeg registers a call leg carried by a tunnel
+func (s *SIPServer) startTunnelLeg(ex *exchange, t *tunnel) *CallSession {
+	callID := fmt.Sprintf("%s-%s", t.peer, hex.EncodeToString(newNonce()[:8]))
+	session := s.newCallSession(ex, callID, nil, nil)
+	session.tunnel = t
+	s.addCallSession(session)
+
+	// Closing the tunnel unblocks receiveTunnel when the call ends here
+	s.spawn(func() {
+		select {
+		case <-session.ctx.Done():
+			t.Hangup()
+		case <-t.Done():
+		}
+	})
+	return session
+}
+
+// receiveTunnel handles frames from the peer until it hangs up or the
+// connection drops, then ends the call leg
+func (s *SIPServer) receiveTunnel(session *CallSession) {
+	pcm := make([]int16, TUNNEL_MAX_FRAME)
+	for {
+		frame, err := session.tunnel.Receive()
+		if err != nil || frame.kind == FRAME_HANGUP {
+			break
+		}
+
+		switch frame.kind {
+		case FRAME_AUDIO:
+			pushAudio(session, frame.payload, pcm)
+		case FRAME_DIGIT:
+			digit := string(frame.payload)
+			fmt.Printf("🔢 Digit from peer %s: %s\n", session.tunnel.peer, digit)
+			s.handleDigit(session, digit)
+		}
+	}
+
+	fmt.Printf("🌐 Peer %s hung up\n", session.tunnel.peer)
+	s.endCallSession(session.CallID)
+}
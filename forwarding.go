@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Star codes for forwarding, dialed from the phone being forwarded:
+	// *72, the number, then # forwards every call; *73 cancels it. Rotary
+	// installations dial 1172, the number and a pause, then confirm.
+	FORWARD_ACTIVATE_CODE = "*72"
+	FORWARD_CANCEL_CODE   = "*73"
+
+	// DEFAULT_NO_ANSWER_SECONDS is how long a phone rings before a call is
+	// forwarded on no answer
+	DEFAULT_NO_ANSWER_SECONDS = 20
+
+	// MAX_FORWARDS stops phones forwarded to each other from passing a
+	// call around forever
+	MAX_FORWARDS = 5
+)
+
+// forwardingTable holds the forwarding rules of each phone on an exchange,
+// by user. The config sets them up; star codes and the API change them
+// while the server runs.
+type forwardingTable struct {
+	mu    sync.Mutex
+	rules map[string]ForwardingConfig
+}
+
+// newForwardingTable creates a table holding the configured rules
+func newForwardingTable(rules map[string]ForwardingConfig) *forwardingTable {
+	return &forwardingTable{rules: maps.Clone(rules)}
+}
+
+// Get returns a user's rules; the zero value forwards nothing
+func (t *forwardingTable) Get(user string) ForwardingConfig {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rules[user]
+}
+
+// Set replaces a user's rules, removing them if they forward nothing
+func (t *forwardingTable) Set(user string, rules ForwardingConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rules == (ForwardingConfig{}) {
+		delete(t.rules, user)
+		return
+	}
+	if t.rules == nil {
+		t.rules = make(map[string]ForwardingConfig)
+	}
+	t.rules[user] = rules
+}
+
+// Snapshot returns a copy of every user's rules
+func (t *forwardingTable) Snapshot() map[string]ForwardingConfig {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return maps.Clone(t.rules)
+}
+
+// collectStarCode takes the forwarding star codes ahead of the dial plan.
+// It reports whether the digits dialed so far are (part of) one. Must be
+// called with digitsMu held.
+func (s *SIPServer) collectStarCode(session *CallSession) bool {
+	cfg := session.exchange.config
+	activate, cancel := cfg.starCode(FORWARD_ACTIVATE_CODE), cfg.starCode(FORWARD_CANCEL_CODE)
+	digits := session.digits
+	switch {
+	case digits == cancel:
+		session.routed = true
+		s.spawn(func() { s.setForwardAlways(session, "") })
+	case strings.HasPrefix(digits, activate) && cfg.rotary():
+		session.digitTimer = s.startForwardNumberTimer(session, digits[len(activate):])
+	case strings.HasPrefix(digits, activate):
+		number, done := strings.CutSuffix(digits[len(activate):], "#")
+		if !done {
+			session.digitTimer = s.startStarCodeTimer(session)
+			return true
+		}
+		session.routed = true
+		s.spawn(func() { s.setForwardAlways(session, number) })
+	case strings.HasPrefix(activate, digits) || strings.HasPrefix(cancel, digits):
+		if cfg.rotary() {
+			// "1" or "11" may just as well begin a number
+			if result, _ := session.exchange.dialPlan.Collect(digits); result != matchNone {
+				return false
+			}
+		}
+		session.digitTimer = s.startStarCodeTimer(session) // "*" or "*7" so far
+	default:
+		return false
+	}
+	return true
+}
+
+// startForwardNumberTimer ends the number a rotary phone is forwarding to
+// with a pause instead of #, then has the caller confirm it
+func (s *SIPServer) startForwardNumberTimer(session *CallSession, number string) *time.Timer {
+	timeout := ROTARY_PAUSE
+	if number == "" {
+		timeout = time.Duration(session.exchange.config.DialPlan.LongTimeoutMs) * time.Millisecond
+	}
+	return time.AfterFunc(timeout, func() {
+		session.digitsMu.Lock()
+		defer session.digitsMu.Unlock()
+
+		if session.routed || session.ctx.Err() != nil {
+			return
+		}
+		session.routed = true
+		if number == "" {
+			fmt.Printf("⌛ Code %s timed out\n", session.digits)
+			s.playProgress(session, progressIncomplete)
+			return
+		}
+		s.spawn(func() {
+			if !s.confirm(session, "Forward your calls to "+spellAddress(number)+"?") {
+				fmt.Printf("↪️  Forwarding to %s not confirmed\n", number)
+				s.playTone(session.ctx, session, defaultActionPrompt(false))
+				return
+			}
+			s.setForwardAlways(session, number)
+		})
+	})
+}
+
+// startStarCodeTimer gives up on a star or secret code the caller didn't
+// finish
+func (s *SIPServer) startStarCodeTimer(session *CallSession) *time.Timer {
+	timeout := time.Duration(session.exchange.config.DialPlan.LongTimeoutMs) * time.Millisecond
+	return time.AfterFunc(timeout, func() {
+		session.digitsMu.Lock()
+		defer session.digitsMu.Unlock()
+
+		if session.routed || session.ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("⌛ Code %s timed out\n", session.digits)
+		session.routed = true
+		s.playProgress(session, progressIncomplete)
+	})
+}
+
+// setForwardAlways turns forward-always on (to number) or off (number
+// empty) for the calling phone, then plays a confirmation
+func (s *SIPServer) setForwardAlways(session *CallSession, number string) {
+	user := ""
+	if session.dialog != nil {
+		user = contactUser(session.dialog.to)
+	}
+
+	ok := user != ""
+	if ok && number != "" {
+		if _, resolved := session.exchange.dialPlan.Resolve(number); !resolved {
+			fmt.Printf("❌ Can't forward %s to %s: no destination\n", user, number)
+			ok = false
+		}
+	}
+	if ok {
+		rules := session.exchange.forwarding.Get(user)
+		rules.Always = number
+		session.exchange.forwarding.Set(user, rules)
+		if number != "" {
+			fmt.Printf("↪️  Forwarding all calls for %s to %s\n", user, number)
+		} else {
+			fmt.Printf("↪️  Forwarding for %s cancelled\n", user)
+		}
+	}
+
+	s.playTone(session.ctx, session, defaultActionPrompt(ok))
+}
+
+// forwardCall sends a call for user on to number through the dial plan,
+// wherever it leads: another phone, a peer installation or a recording
+func (s *SIPServer) forwardCall(session *CallSession, user, number, reason string) {
+	if session.forwards >= MAX_FORWARDS {
+		log.Printf("❌ Not forwarding %s to %s: forwarded %d times already", session.CallID, number, session.forwards)
+		s.playTone(session.ctx, session, session.progressTone(progressReorder))
+		return
+	}
+	session.forwards++
+
+	res, ok := session.exchange.dialPlan.Resolve(number)
+	if !ok {
+		log.Printf("❌ Can't forward %s's call to %s: no destination", user, number)
+		s.playTone(session.ctx, session, session.progressTone(progressReorder))
+		return
+	}
+
+	fmt.Printf("↪️  Forwarding call for %s to %s (%s)\n", user, res.number, reason)
+	s.playDestination(session, res)
+}
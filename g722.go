@@ -0,0 +1,264 @@
+package main
+
+// G.722 (ITU-T G.722) sub-band ADPCM at 64 kbit/s: 16kHz audio is split by
+// a QMF into a low and a high band at 8kHz each, coded with 6 and 2 bits,
+// one byte per pair of samples. Its RTP clock nonetheless runs at 8kHz, an
+// error in the original RFC 1890 kept for compatibility (RFC 3551 section
+// 4.5.2), so a frame still has a byte and a timestamp unit per 8kHz sample.
+
+// G722_PAYLOAD_TYPE is G.722's static payload type
+const G722_PAYLOAD_TYPE = 9
+
+var (
+	g722QMF  = [12]int{3, -11, 12, 32, -210, 951, 3876, -805, 362, -156, 53, -11}
+	g722Q6   = [32]int{0, 35, 72, 110, 150, 190, 233, 276, 323, 370, 422, 473, 530, 587, 650, 714, 786, 858, 940, 1023, 1121, 1219, 1339, 1458, 1612, 1765, 1980, 2195, 2557, 2919, 0, 0}
+	g722ILN  = [32]int{0, 63, 62, 31, 30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 0}
+	g722ILP  = [32]int{0, 61, 60, 59, 58, 57, 56, 55, 54, 53, 52, 51, 50, 49, 48, 47, 46, 45, 44, 43, 42, 41, 40, 39, 38, 37, 36, 35, 34, 33, 32, 0}
+	g722WL   = [8]int{-60, -30, 58, 172, 334, 538, 1198, 3042}
+	g722RL42 = [16]int{0, 7, 6, 5, 4, 3, 2, 1, 7, 6, 5, 4, 3, 2, 1, 0}
+	g722ILB  = [32]int{2048, 2093, 2139, 2186, 2233, 2282, 2332, 2383, 2435, 2489, 2543, 2599, 2656, 2714, 2774, 2834, 2896, 2960, 3025, 3091, 3158, 3228, 3298, 3371, 3444, 3520, 3597, 3676, 3756, 3838, 3922, 4008}
+	g722QM4  = [16]int{0, -20456, -12896, -8968, -6288, -4240, -2584, -1200, 20456, 12896, 8968, 6288, 4240, 2584, 1200, 0}
+	g722QM6  = [64]int{-136, -136, -136, -136, -24808, -21904, -19008, -16704, -14984, -13512, -12280, -11192, -10232, -9360, -8576, -7856, -7192, -6576, -6000, -5456, -4944, -4464, -4008, -3576, -3168, -2776, -2400, -2032, -1688, -1360, -1040, -728, 24808, 21904, 19008, 16704, 14984, 13512, 12280, 11192, 10232, 9360, 8576, 7856, 7192, 6576, 6000, 5456, 4944, 4464, 4008, 3576, 3168, 2776, 2400, 2032, 1688, 1360, 1040, 728, 432, 136, -432, -136}
+	g722QM2  = [4]int{-7408, -1616, 7408, 1616}
+	g722IHN  = [3]int{0, 1, 0}
+	g722IHP  = [3]int{0, 3, 2}
+	g722WH   = [3]int{0, -214, 798}
+	g722RH2  = [4]int{2, 1, 2, 1}
+)
+
+// g722Band is the adaptive predictor and quantizer state of one sub-band
+type g722Band struct {
+	s, sp, sz int
+	r         [3]int
+	a, ap     [3]int
+	p         [3]int
+	d         [7]int
+	b, bp     [7]int
+	sg        [7]int
+	nb, det   int
+}
+
+// g722State is what encoding or decoding carries from one sample pair to
+// the next: both bands and the QMF's delay line
+type g722State struct {
+	band [2]g722Band
+	x    [24]int
+}
+
+func newG722State() g722State {
+	var st g722State
+	st.band[0].det = 32
+	st.band[1].det = 8
+	return st
+}
+
+// g722Encoder encodes 16kHz audio; it keeps state, so each stream needs
+// its own
+type g722Encoder struct{ g722State }
+
+// g722Decoder decodes to 16kHz audio; it keeps state, so each stream needs
+// its own
+type g722Decoder struct{ g722State }
+
+// Encode codes samples, twice as many for a frame as at 8kHz, into half as
+// many bytes of payload
+func (e *g722Encoder) Encode(payload []byte, samples []int16) int {
+	n := 0
+	for j := 0; j+1 < len(samples); j += 2 {
+		// Transmit QMF: split the pair into one low and one high band sample
+		copy(e.x[:22], e.x[2:])
+		e.x[22] = int(samples[j])
+		e.x[23] = int(samples[j+1])
+		sumEven, sumOdd := 0, 0
+		for i := range 12 {
+			sumOdd += e.x[2*i] * g722QMF[i]
+			sumEven += e.x[2*i+1] * g722QMF[11-i]
+		}
+		xlow := (sumEven + sumOdd) >> 14
+		xhigh := (sumEven - sumOdd) >> 14
+
+		// Low band: 6-bit quantizer
+		low := &e.band[0]
+		el := g722Saturate(xlow - low.s)
+		wd := el
+		if el < 0 {
+			wd = -(el + 1)
+		}
+		i := 1
+		for ; i < 30; i++ {
+			if wd < (g722Q6[i]*low.det)>>12 {
+				break
+			}
+		}
+		ilow := g722ILP[i]
+		if el < 0 {
+			ilow = g722ILN[i]
+		}
+		ril := ilow >> 2
+		dlow := (low.det * g722QM4[ril]) >> 15
+		low.scaleLow(g722RL42[ril])
+		low.predict(dlow)
+
+		// High band: 2-bit quantizer
+		high := &e.band[1]
+		eh := g722Saturate(xhigh - high.s)
+		wd = eh
+		if eh < 0 {
+			wd = -(eh + 1)
+		}
+		mih := 1
+		if wd >= (564*high.det)>>12 {
+			mih = 2
+		}
+		ihigh := g722IHP[mih]
+		if eh < 0 {
+			ihigh = g722IHN[mih]
+		}
+		dhigh := (high.det * g722QM2[ihigh]) >> 15
+		high.scaleHigh(g722RH2[ihigh])
+		high.predict(dhigh)
+
+		payload[n] = byte(ihigh<<6 | ilow)
+		n++
+	}
+	return n
+}
+
+// Decode decodes payload into twice as many 16kHz samples
+func (d *g722Decoder) Decode(pcm []int16, payload []byte) int {
+	n := 0
+	for _, code := range payload {
+		ilow, ihigh := int(code&0x3F), int(code>>6)
+
+		low := &d.band[0]
+		rlow := min(max(low.s+(low.det*g722QM6[ilow])>>15, -16384), 16383)
+		ril := ilow >> 2
+		dlow := (low.det * g722QM4[ril]) >> 15
+		low.scaleLow(g722RL42[ril])
+		low.predict(dlow)
+
+		high := &d.band[1]
+		dhigh := (high.det * g722QM2[ihigh]) >> 15
+		rhigh := min(max(high.s+dhigh, -16384), 16383)
+		high.scaleHigh(g722RH2[ihigh])
+		high.predict(dhigh)
+
+		// Receive QMF: recombine the bands into a pair of samples
+		copy(d.x[:22], d.x[2:])
+		d.x[22] = rlow + rhigh
+		d.x[23] = rlow - rhigh
+		out1, out2 := 0, 0
+		for i := range 12 {
+			out2 += d.x[2*i] * g722QMF[i]
+			out1 += d.x[2*i+1] * g722QMF[11-i]
+		}
+		pcm[n] = int16(g722Saturate(out1 >> 11))
+		pcm[n+1] = int16(g722Saturate(out2 >> 11))
+		n += 2
+	}
+	return n
+}
+
+// scaleLow adapts the low band's quantizer step (blocks 3L, LOGSCL and
+// SCALEL)
+func (b *g722Band) scaleLow(il4 int) {
+	b.nb = min(max((b.nb*127)>>7+g722WL[il4], 0), 18432)
+	b.det = g722ScaleFactor(b.nb, 8)
+}
+
+// scaleHigh adapts the high band's quantizer step (blocks 3H, LOGSCH and
+// SCALEH)
+func (b *g722Band) scaleHigh(ih2 int) {
+	b.nb = min(max((b.nb*127)>>7+g722WH[ih2], 0), 22528)
+	b.det = g722ScaleFactor(b.nb, 10)
+}
+
+// g722ScaleFactor converts a log scale factor to a linear quantizer step
+func g722ScaleFactor(nb, shift int) int {
+	wd1 := (nb >> 6) & 31
+	wd2 := shift - (nb >> 11)
+	if wd2 < 0 {
+		return (g722ILB[wd1] << -wd2) << 2
+	}
+	return (g722ILB[wd1] >> wd2) << 2
+}
+
+// predict updates a band's pole-zero predictor with the latest quantized
+// difference d (block 4)
+func (b *g722Band) predict(d int) {
+	// RECONS and PARREC
+	b.d[0] = d
+	b.r[0] = g722Saturate(b.s + d)
+	b.p[0] = g722Saturate(b.sz + d)
+
+	// UPPOL2
+	for i := range 3 {
+		b.sg[i] = b.p[i] >> 15
+	}
+	wd1 := g722Saturate(b.a[1] << 2)
+	wd2 := wd1
+	if b.sg[0] == b.sg[1] {
+		wd2 = -wd1
+	}
+	wd2 = min(wd2, 32767)
+	wd3 := -128
+	if b.sg[0] == b.sg[2] {
+		wd3 = 128
+	}
+	wd3 += wd2 >> 7
+	wd3 += (b.a[2] * 32512) >> 15
+	b.ap[2] = min(max(wd3, -12288), 12288)
+
+	// UPPOL1
+	b.sg[0] = b.p[0] >> 15
+	b.sg[1] = b.p[1] >> 15
+	wd1 = -192
+	if b.sg[0] == b.sg[1] {
+		wd1 = 192
+	}
+	b.ap[1] = g722Saturate(wd1 + (b.a[1]*32640)>>15)
+	limit := g722Saturate(15360 - b.ap[2])
+	b.ap[1] = min(max(b.ap[1], -limit), limit)
+
+	// UPZERO
+	wd1 = 128
+	if d == 0 {
+		wd1 = 0
+	}
+	b.sg[0] = d >> 15
+	for i := 1; i < 7; i++ {
+		b.sg[i] = b.d[i] >> 15
+		wd2 := -wd1
+		if b.sg[i] == b.sg[0] {
+			wd2 = wd1
+		}
+		b.bp[i] = g722Saturate(wd2 + (b.b[i]*32640)>>15)
+	}
+
+	// DELAYA
+	for i := 6; i > 0; i-- {
+		b.d[i] = b.d[i-1]
+		b.b[i] = b.bp[i]
+	}
+	for i := 2; i > 0; i-- {
+		b.r[i] = b.r[i-1]
+		b.p[i] = b.p[i-1]
+		b.a[i] = b.ap[i]
+	}
+
+	// FILTEP, FILTEZ and PREDIC
+	sp := (b.a[1] * g722Saturate(b.r[1]+b.r[1])) >> 15
+	sp += (b.a[2] * g722Saturate(b.r[2]+b.r[2])) >> 15
+	b.sp = g722Saturate(sp)
+	sz := 0
+	for i := 6; i > 0; i-- {
+		sz += (b.b[i] * g722Saturate(b.d[i]+b.d[i])) >> 15
+	}
+	b.sz = g722Saturate(sz)
+	b.s = g722Saturate(b.sp + b.sz)
+}
+
+// g722Saturate clamps to the 16-bit range
+func g722Saturate(v int) int {
+	return min(max(v, -32768), 32767)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// snr is the ratio in dB of a signal's power to that of its difference
+// from got, delayed by lag samples
+func snr(signal, got []int16, lag int) float64 {
+	var power, noise float64
+	for i := range len(signal) - lag {
+		s, d := float64(signal[i]), float64(got[i+lag])-float64(signal[i])
+		power += s * s
+		noise += d * d
+	}
+	return 10 * math.Log10(power/noise)
+}
+
+func TestG722RoundTrip(t *testing.T) {
+	for _, amplitude := range []float64{1000, 8000, 32767} {
+		// A second of a 1kHz tone, at full scale too, where overflow in
+		// the bands or the QMF would wrap round rather than clip
+		tone := make([]int16, WIDE_SAMPLE_RATE)
+		for i := range tone {
+			tone[i] = int16(amplitude * math.Sin(2*math.Pi*1000*float64(i)/WIDE_SAMPLE_RATE))
+		}
+		encoder, decoder := newG722Encoder(), newG722Decoder()
+		payload := make([]byte, len(tone)/2)
+		if n := encoder.Encode(payload, tone); n != len(payload) {
+			t.Fatalf("encoded %d samples into %d bytes, want %d", len(tone), n, len(payload))
+		}
+		decoded := make([]int16, len(tone))
+		if n := decoder.Decode(decoded, payload); n != len(tone) {
+			t.Fatalf("decoded %d bytes into %d samples, want %d", len(payload), n, len(tone))
+		}
+
+		// The QMFs delay the audio 22 samples; once the ADPCM has adapted,
+		// the tone comes back close to how it went in, never wrapped round
+		const delay = 22
+		start := WIDE_SAMPLE_RATE / 10
+		if s := snr(tone[start:], decoded[start:], delay); s < 35 {
+			t.Errorf("amplitude %.0f: SNR %.1f dB, want at least 35", amplitude, s)
+		}
+		for i := start; i < len(tone)-delay; i++ {
+			if d := math.Abs(float64(decoded[i+delay]) - float64(tone[i])); d > amplitude/4 {
+				t.Fatalf("amplitude %.0f: sample %d decoded as %d, want near %d", amplitude, i, decoded[i+delay], tone[i])
+			}
+		}
+	}
+}
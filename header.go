@@ -0,0 +1,152 @@
+package main
+
+import "strings"
+
+// sipHeader is one header field of a SIP message, named as
+// canonicalHeader spells it
+type sipHeader struct {
+	Name  string
+	Value string
+}
+
+// sipHeaders are the header fields of a SIP message, in the order sent.
+// Nothing is merged or dropped: a header given on several lines is a
+// field per line.
+type sipHeaders []sipHeader
+
+// readHeaders reads a message's header fields, up to the blank line before
+// its body. A line starting with a space or tab continues the field before
+// it (line folding, RFC 3261 section 7.3.1), and is joined to it with a
+// single space.
+func readHeaders(message string) sipHeaders {
+	var headers sipHeaders
+	for i, line := range splitLines(message) {
+		if line == "" {
+			break // End of headers
+		}
+		if i == 0 {
+			continue // The request or status line
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(headers) > 0 {
+				last := &headers[len(headers)-1]
+				last.Value = strings.TrimSpace(last.Value + " " + strings.TrimSpace(line))
+			}
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			continue
+		}
+		headers = append(headers, sipHeader{Name: canonicalHeader(name), Value: strings.TrimSpace(value)})
+	}
+	return headers
+}
+
+// Get is the value of the first field of the named header, "" if there is
+// none
+func (h sipHeaders) Get(name string) string {
+	name = canonicalHeader(name)
+	for _, field := range h {
+		if field.Name == name {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Values is every value of the named header, in order, whether given on
+// separate lines or separated by commas. Commas inside <>, or quotes as
+// in a display name, don't separate values, and the authentication
+// headers, whose parameters are comma-separated, are never split.
+func (h sipHeaders) Values(name string) []string {
+	name = canonicalHeader(name)
+	var values []string
+	for _, field := range h {
+		if field.Name != name {
+			continue
+		}
+		if uncombinableHeaders[name] {
+			values = append(values, field.Value)
+			continue
+		}
+		depth, quoted, start := 0, false, 0
+		for j, char := range field.Value {
+			switch {
+			case char == '"' && (j == 0 || field.Value[j-1] != '\\'):
+				quoted = !quoted
+			case quoted:
+			case char == '<':
+				depth++
+			case char == '>':
+				depth--
+			case char == ',' && depth == 0:
+				values = append(values, strings.TrimSpace(field.Value[start:j]))
+				start = j + 1
+			}
+		}
+		values = append(values, strings.TrimSpace(field.Value[start:]))
+	}
+	return values
+}
+
+// compactHeaders are the full names of the single-letter compact header
+// names (RFC 3261 section 7.3.3 and the extensions using them)
+var compactHeaders = map[string]string{
+	"a": "Accept-Contact",
+	"b": "Referred-By",
+	"c": "Content-Type",
+	"e": "Content-Encoding",
+	"f": "From",
+	"i": "Call-ID",
+	"k": "Supported",
+	"l": "Content-Length",
+	"m": "Contact",
+	"o": "Event",
+	"r": "Refer-To",
+	"s": "Subject",
+	"t": "To",
+	"u": "Allow-Events",
+	"v": "Via",
+	"x": "Session-Expires",
+}
+
+// knownHeaders are the headers the server reads, by lower-case name, in
+// the spelling it looks them up by; header names are case-insensitive
+var knownHeaders = func() map[string]string {
+	known := make(map[string]string)
+	for _, name := range []string{
+		"Via", "From", "To", "Call-ID", "CSeq", "Contact", "Max-Forwards",
+		"Route", "Record-Route", "Expires", "Min-Expires", "Content-Type",
+		"Content-Length", "Authorization", "Proxy-Authorization",
+		"WWW-Authenticate", "Proxy-Authenticate", "User-Agent", "Server",
+		"Allow", "Supported", "Require", "Session-Expires", "Min-SE", "Event",
+		"Allow-Events", "Subscription-State", "Refer-To", "Referred-By",
+	} {
+		known[strings.ToLower(name)] = name
+	}
+	return known
+}()
+
+// uncombinableHeaders may appear more than once but, unlike others, not
+// as one comma-separated list (RFC 3261 section 7.3.1)
+var uncombinableHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"WWW-Authenticate":    true,
+	"Proxy-Authenticate":  true,
+}
+
+// canonicalHeader is a header name as the server looks it up: compact
+// forms expanded, and known names in their usual spelling whatever case
+// they arrived in
+func canonicalHeader(name string) string {
+	name = strings.TrimSpace(name)
+	if full, ok := compactHeaders[strings.ToLower(name)]; ok {
+		return full
+	}
+	if known, ok := knownHeaders[strings.ToLower(name)]; ok {
+		return known
+	}
+	return name
+}
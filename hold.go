@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// SDP media directions (RFC 3264). A phone holding a call offers sendonly,
+// or inactive if it was already held from our side.
+const (
+	SDP_SENDRECV = "sendrecv"
+	SDP_SENDONLY = "sendonly"
+	SDP_RECVONLY = "recvonly"
+	SDP_INACTIVE = "inactive"
+)
+
+// parseSDPDirection finds the direction of the audio stream of a
+// message's SDP body (see sessionDescription.direction); sendrecv if it
+// has none
+func parseSDPDirection(message string) string {
+	sd := messageSDP(message)
+	if sd == nil || sd.audio() == nil {
+		return SDP_SENDRECV
+	}
+	return sd.direction(sd.audio())
+}
+
+// answerDirection is the direction our answer takes to an offer
+func answerDirection(offer string) string {
+	switch offer {
+	case SDP_SENDONLY:
+		return SDP_RECVONLY
+	case SDP_RECVONLY:
+		return SDP_SENDONLY
+	case SDP_INACTIVE:
+		return SDP_INACTIVE
+	default:
+		return SDP_SENDRECV
+	}
+}
+
+// updateMedia applies the SDP of a phone's re-INVITE to its call: media
+// moves to the address it gives, if it isn't the one given before, to
+// latch again on the phone's next packet, and stops while the phone holds
+// the call. It returns the direction to answer with. A re-INVITE without
+// SDP leaves the media where it is and offers to resume. A browser's
+// media goes where ICE finds it, not to the address in its SDP.
+func (s *SIPServer) updateMedia(session *CallSession, message string, remoteAddr *net.UDPAddr) string {
+	direction := parseSDPDirection(message)
+	if addr := parseSDPForRTP(message, remoteAddr.IP); addr != nil && !addr.IP.IsUnspecified() && session.formats.webrtc == nil {
+		if previous := session.sdpRTPAddr.Load(); previous == nil || previous.String() != addr.String() {
+			fmt.Printf("🔀 Media for Call-ID %s moved to %s\n", session.CallID, addr)
+			session.sdpRTPAddr.Store(addr)
+			session.remoteRTPAddr.Store(addr)
+			session.latched.Store(false)
+		}
+	}
+
+	// We stop sending when the phone won't take our audio
+	held := direction == SDP_SENDONLY || direction == SDP_INACTIVE
+	if session.held.Swap(held) != held {
+		if held {
+			fmt.Printf("⏸️  Call %s on hold\n", session.CallID)
+		} else {
+			fmt.Printf("▶️  Call %s resumed\n", session.CallID)
+		}
+	}
+	return answerDirection(direction)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// ROTARY_STAR stands in for * on a rotary installation, as 11 did for
+	// rotary subscribers when star codes were new: 1172 for *72
+	ROTARY_STAR = "11"
+
+	// ROTARY_PAUSE is the pause that ends what a rotary caller dials: a
+	// menu choice, a PIN or a number
+	ROTARY_PAUSE = 2 * time.Second
+
+	// ROTARY_CONFIRM_TIMEOUT is how long "dial 1 to confirm" waits before
+	// taking silence as no
+	ROTARY_CONFIRM_TIMEOUT = 10 * time.Second
+
+	// ROTARY_CONFIRM_FREQ is the tone asking for confirmation without a
+	// speech synthesizer
+	ROTARY_CONFIRM_FREQ = 800.0 // Hz
+)
+
+// rotary reports whether the installation's menus are set up for rotary
+// phones, which can't dial * or #
+func (c *Config) rotary() bool {
+	return c.IVRMode == "rotary"
+}
+
+// starCode is a star code as dialed on the installation: unchanged on a
+// touch-tone one, with ROTARY_STAR for the * on a rotary one
+func (c *Config) starCode(code string) string {
+	if c.rotary() {
+		return ROTARY_STAR + code[1:]
+	}
+	return code
+}
+
+// menuEntries turns the keys a caller presses into menu entries until ctx
+// ends. On a touch-tone installation each key is an entry as soon as it
+// is pressed; on a rotary one, the digits dialed run together until a
+// pause, so "0" and "00" are different entries.
+func menuEntries(ctx context.Context, cfg *Config, digits <-chan string) <-chan string {
+	if !cfg.rotary() {
+		return digits
+	}
+
+	entries := make(chan string)
+	go func() {
+		entry := ""
+		pause := time.NewTimer(ROTARY_PAUSE)
+		pause.Stop()
+		defer pause.Stop()
+
+		for {
+			select {
+			case digit := <-digits:
+				entry += digit
+				pause.Reset(ROTARY_PAUSE)
+			case <-pause.C:
+				select {
+				case entries <- entry:
+				case <-ctx.Done():
+					return
+				}
+				entry = ""
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return entries
+}
+
+// confirmPrompt asks a question to be answered by dialing 1
+func confirmPrompt(session *CallSession, question string) MediaSource {
+	return speech(session, question+" Dial 1 to confirm.", newBeeps(2, ROTARY_CONFIRM_FREQ))
+}
+
+// confirm asks the caller to dial 1 to confirm, with question spoken
+// first, and reports whether they did. Anything else, or nothing within
+// ROTARY_CONFIRM_TIMEOUT, is no. The question stops as soon as they
+// answer or, with barge_in, start talking.
+func (s *SIPServer) confirm(session *CallSession, question string) bool {
+	digits, release := session.captureDigits()
+	defer release()
+
+	playing, stop := context.WithCancel(session.ctx)
+	prompt := confirmPrompt(session, question)
+	stream := s.newCallStream(session, func(samples []int16) bool {
+		return playing.Err() == nil && prompt.ReadFrame(samples)
+	})
+	stream.markTalkspurts(prompt)
+	s.scheduler.Add(stream)
+	defer func() {
+		stop()
+		select {
+		case <-stream.Done():
+		case <-session.ctx.Done():
+		}
+	}()
+
+	voice, quiet := session.watchVoice()
+	defer quiet()
+
+	timeout := time.After(ROTARY_CONFIRM_TIMEOUT)
+	for {
+		select {
+		case talking := <-voice:
+			if talking && session.exchange.config.BargeIn {
+				stop()
+			}
+		case digit := <-digits:
+			return digit == "1"
+		case <-timeout:
+			return false
+		case <-session.ctx.Done():
+			return false
+		}
+	}
+}
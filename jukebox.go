@@ -0,0 +1,328 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// JUKEBOX_CODE_TIMEOUT is the pause that ends a dialed selection code
+	JUKEBOX_CODE_TIMEOUT = 2 * time.Second
+
+	// JUKEBOX_ERROR_DURATION is how long reorder tone plays over the music
+	// when a code selects nothing
+	JUKEBOX_ERROR_DURATION = time.Second
+)
+
+// jukeboxTrack is one song in the library
+type jukeboxTrack struct {
+	path   string
+	title  string
+	artist string
+	number int
+}
+
+// jukeboxAlbum is a group of tracks, from the album tag or, failing that,
+// the directory they are in
+type jukeboxAlbum struct {
+	title  string
+	tracks []jukeboxTrack
+}
+
+// scanJukebox builds the library from the WAV files under dir. Albums are
+// sorted by title and tracks by number, then file name.
+func scanJukebox(dir string) ([]jukeboxAlbum, error) {
+	byTitle := make(map[string]*jukeboxAlbum)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(path), ".wav") {
+			return nil
+		}
+
+		tags, err := readWAVTags(path)
+		if err != nil {
+			log.Printf("⚠️  Skipping %s: %v", path, err)
+			return nil
+		}
+		track := jukeboxTrack{path: path, title: tags.Title, artist: tags.Artist, number: tags.Track}
+		if track.title == "" {
+			track.title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+
+		albumTitle := tags.Album
+		if albumTitle == "" {
+			albumTitle = filepath.Base(filepath.Dir(path))
+		}
+		album := byTitle[albumTitle]
+		if album == nil {
+			album = &jukeboxAlbum{title: albumTitle}
+			byTitle[albumTitle] = album
+		}
+		album.tracks = append(album.tracks, track)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan jukebox library: %v", err)
+	}
+
+	albums := make([]jukeboxAlbum, 0, len(byTitle))
+	for _, album := range byTitle {
+		slices.SortFunc(album.tracks, func(a, b jukeboxTrack) int {
+			return cmp.Or(cmp.Compare(a.number, b.number), strings.Compare(a.path, b.path))
+		})
+		albums = append(albums, *album)
+	}
+	slices.SortFunc(albums, func(a, b jukeboxAlbum) int {
+		return strings.Compare(strings.ToLower(a.title), strings.ToLower(b.title))
+	})
+	return albums, nil
+}
+
+// jukeboxCode finds the album and track a dialed code selects: "3" is the
+// first track of album 3, "305" its fifth track
+func jukeboxCode(albums []jukeboxAlbum, code string) (album, track int, ok bool) {
+	number, err := strconv.Atoi(code)
+	if err != nil || number < 1 {
+		return 0, 0, false
+	}
+	album, track = number, 1
+	if len(code) > 2 {
+		album, track = number/100, number%100
+	}
+	if album < 1 || album > len(albums) || track < 1 || track > len(albums[album-1].tracks) {
+		return 0, 0, false
+	}
+	return album - 1, track - 1, true
+}
+
+// playerSource plays whatever it was last given, which can be swapped
+// while the stream runs. Interruptions play over it, after which it picks
+// up where it left off. A talkspurt begins whenever what it plays changes.
+type playerSource struct {
+	mu        sync.Mutex
+	current   MediaSource
+	interrupt MediaSource
+	paused    bool
+	ended     chan struct{} // Signalled when current runs out
+
+	last  MediaSource // What the last frame came from; nil for silence
+	began bool
+}
+
+// newPlayerSource creates a player with nothing to play yet
+func newPlayerSource() *playerSource {
+	return &playerSource{ended: make(chan struct{}, 1)}
+}
+
+// Play replaces what is playing
+func (p *playerSource) Play(source MediaSource) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = source
+	select {
+	case <-p.ended: // The source it replaces ran out meanwhile
+	default:
+	}
+}
+
+// Interrupt plays source, then goes back to what was playing
+func (p *playerSource) Interrupt(source MediaSource) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interrupt = source
+}
+
+// Pause silences the current source, keeping its place, until resumed.
+// Interruptions still play.
+func (p *playerSource) Pause(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = paused
+}
+
+// Do runs f while no frame is being read, so f can seek or adjust the
+// sources being played
+func (p *playerSource) Do(f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f()
+}
+
+// Ended is signalled each time the current source runs out
+func (p *playerSource) Ended() <-chan struct{} {
+	return p.ended
+}
+
+// ReadFrame plays the interruption or current source, or silence. It
+// never ends; the caller stops it.
+func (p *playerSource) ReadFrame(samples []int16) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.interrupt != nil {
+		if p.interrupt.ReadFrame(samples) {
+			p.playedFrom(p.interrupt)
+			return true
+		}
+		p.interrupt = nil
+	}
+	if p.current != nil && !p.paused {
+		if p.current.ReadFrame(samples) {
+			p.playedFrom(p.current)
+			return true
+		}
+		p.current = nil
+		select {
+		case p.ended <- struct{}{}:
+		default:
+		}
+	}
+	clear(samples)
+	p.playedFrom(nil)
+	return true
+}
+
+// playedFrom notes the source of the frame just read, nil for silence.
+// Must be called with mu held.
+func (p *playerSource) playedFrom(source MediaSource) {
+	p.began = source != nil && (source != p.last || beginsTalkspurt(source))
+	p.last = source
+}
+
+// Talkspurt reports whether the last frame began a talkspurt: the first
+// of a track, an interruption, or what was playing before it
+func (p *playerSource) Talkspurt() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.began
+}
+
+// runJukebox plays a music library to the caller. Tracks play one after
+// another through the whole library; # skips to the next track, * goes
+// back one, and dialing a code followed by a pause jumps to an album or
+// track. On a rotary installation 0 and 00 skip instead.
+func (s *SIPServer) runJukebox(session *CallSession, name string, dest DestinationConfig) {
+	albums, err := scanJukebox(session.exchange.config.ResolvePath(dest.Directory))
+	if err == nil && len(albums) == 0 {
+		err = fmt.Errorf("no WAV files in %s", dest.Directory)
+	}
+	if err != nil {
+		log.Printf("❌ Jukebox %q: %v", name, err)
+		s.playTone(session.ctx, session, newCadenceSource(REORDER_ON, REORDER_OFF, BUSY_FREQ1, BUSY_FREQ2))
+		return
+	}
+	tracks := 0
+	for _, album := range albums {
+		tracks += len(album.tracks)
+	}
+	fmt.Printf("🎵 Jukebox %q: %d albums, %d tracks\n", name, len(albums), tracks)
+
+	digits, release := session.captureDigits()
+	defer release()
+
+	// The player never runs out by itself; the stream stops when we return
+	playing, stop := context.WithCancel(session.ctx)
+	defer stop()
+	player := newPlayerSource()
+	stream := s.newCallStream(session, func(samples []int16) bool {
+		return playing.Err() == nil && player.ReadFrame(samples)
+	})
+	stream.markTalkspurts(player)
+	s.scheduler.Add(stream)
+
+	album, track := 0, 0
+	play := func() {
+		selected := albums[album].tracks[track]
+		samples, err := loadWAV(selected.path)
+		if err != nil {
+			log.Printf("⚠️  Jukebox %q: %v", name, err)
+			samples = nil // An empty source ends at once, moving on
+		}
+		if selected.artist != "" {
+			fmt.Printf("🎵 Now playing %d%02d: %s - %s (%s)\n", album+1, track+1, selected.artist, selected.title, albums[album].title)
+		} else {
+			fmt.Printf("🎵 Now playing %d%02d: %s (%s)\n", album+1, track+1, selected.title, albums[album].title)
+		}
+		player.Play(newPCMSource(samples, false))
+	}
+	play()
+
+	rotary := session.exchange.config.rotary()
+	next := func() {
+		track++
+		if track == len(albums[album].tracks) {
+			album, track = (album+1)%len(albums), 0
+		}
+		play()
+	}
+	previous := func() {
+		track--
+		if track < 0 {
+			album = (album + len(albums) - 1) % len(albums)
+			track = len(albums[album].tracks) - 1
+		}
+		play()
+	}
+
+	code := ""
+	codeTimer := time.NewTimer(JUKEBOX_CODE_TIMEOUT)
+	codeTimer.Stop()
+	defer codeTimer.Stop()
+
+	for {
+		select {
+		case <-player.Ended():
+			track++
+			if track == len(albums[album].tracks) {
+				album, track = album+1, 0
+			}
+			if album == len(albums) {
+				fmt.Printf("🏁 Jukebox %q played to the end\n", name)
+				return
+			}
+			play()
+
+		case digit := <-digits:
+			switch digit {
+			case "#":
+				next()
+			case "*":
+				previous()
+			default:
+				code += digit
+				codeTimer.Reset(JUKEBOX_CODE_TIMEOUT)
+			}
+
+		case <-codeTimer.C:
+			if rotary && code == "0" {
+				next()
+			} else if rotary && code == "00" {
+				previous()
+			} else if a, t, ok := jukeboxCode(albums, code); ok {
+				album, track = a, t
+				play()
+			} else {
+				fmt.Printf("❌ Jukebox %q has nothing at %s\n", name, code)
+				reorder := newCadenceSource(REORDER_ON, REORDER_OFF, BUSY_FREQ1, BUSY_FREQ2)
+				player.Interrupt(newLimitedSource(reorder, JUKEBOX_ERROR_DURATION))
+			}
+			code = ""
+
+		case <-stream.Done():
+			return
+		case <-session.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_KEEPALIVE_INTERVAL is how often, in seconds, each registered
+	// phone is sent OPTIONS to check it is still there
+	DEFAULT_KEEPALIVE_INTERVAL = 60
+
+	// DEFAULT_KEEPALIVE_MAX_MISSED is how many probes in a row a phone may
+	// leave unanswered before its binding is removed
+	DEFAULT_KEEPALIVE_MAX_MISSED = 3
+)
+
+// probeRegistrations sends OPTIONS to every registered phone each
+// keepalive interval until the server closes. A phone that stops
+// answering is marked offline, and passed over for calls, until it
+// answers again or registers afresh; after max_missed probes in a row its
+// binding is removed rather than left until it expires. Any response, even
+// an error, shows the phone is there.
+func (s *SIPServer) probeRegistrations() {
+	cfg := s.config.Registrar.Keepalive
+	if cfg.Interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(cfg.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+
+		// Probes of one round finish before the next starts, so a slow
+		// phone is never probed twice at once. They aren't spawned: this
+		// loop already is, and waits for them, while spawn would skip a
+		// probe once the server is closing and leave the round waiting.
+		var wg sync.WaitGroup
+		for _, ex := range s.Exchanges() {
+			for _, ua := range ex.registrar.Snapshot() {
+				if !s.reachable(ua) {
+					continue // Its connection closed; nothing to send over
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s.probe(ex, ua, cfg.MaxMissed)
+				}()
+			}
+		}
+		wg.Wait()
+	}
+}
+
+// probe sends one registered phone OPTIONS and records whether it
+// answered, logging when it goes offline, comes back or is removed
+func (s *SIPServer) probe(ex *exchange, ua RegisteredUA, maxMissed int) {
+	code := s.transactRequest(s.dialogTo(ex, ua), "OPTIONS", "", "")
+	missed, found := ex.registrar.Probed(ua.AOR, ua.contactURI(), code != 0, maxMissed)
+	switch {
+	case !found:
+	case missed >= maxMissed:
+		log.Printf("📵 %s removed: %s missed %d keepalives in a row (exchange %s)", ua.AOR, ua.Contact, missed, ex.name)
+	case missed == 1:
+		log.Printf("📵 %s offline: %s didn't answer a keepalive (exchange %s)", ua.AOR, ua.Contact, ex.name)
+	case missed == 0 && ua.Missed > 0:
+		fmt.Printf("📶 %s back online: %s answered a keepalive (exchange %s)\n", ua.AOR, ua.Contact, ex.name)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// Defaults for a phone adapter patched straight into the machine
+	DEFAULT_DHCP_POOL_OFFSET   = 100 // The pool starts at .100 of the subnet
+	DEFAULT_DHCP_POOL_SIZE     = 50
+	DEFAULT_DHCP_LEASE_SECONDS = 24 * 60 * 60
+	DEFAULT_PROVISION_PORT     = 80
+	DEFAULT_PROVISION_USER     = "1001"
+
+	// PROVISION_PATH is where the profile is served; any path works, so
+	// adapters with their own profile rule find it too
+	PROVISION_PATH = "/spa.xml"
+)
+
+// DEFAULT_PROVISION_PROFILE sets up a PAP2's first line as the README's
+// PAP2 Configuration section describes
+const DEFAULT_PROVISION_PROFILE = `<flat-profile>
+  <Proxy_1_>{{.Server}}:{{.Port}}</Proxy_1_>
+  <Register_1_>Yes</Register_1_>
+  <Make_Call_Without_Reg_1_>No</Make_Call_Without_Reg_1_>
+  <User_ID_1_>{{.User}}</User_ID_1_>
+{{- if .Password}}
+  <Password_1_>{{.Password}}</Password_1_>
+{{- end}}
+  <Display_Name_1_>{{.User}}</Display_Name_1_>
+  <Register_Expires_1_>3600</Register_Expires_1_>
+  <Preferred_Codec_1_>G711u</Preferred_Codec_1_>
+  <Use_Pref_Codec_Only_1_>Yes</Use_Pref_Codec_Only_1_>
+  <DTMF_Tx_Method_1_>AVT</DTMF_Tx_Method_1_>
+  <NAT_Mapping_Enable_1_>No</NAT_Mapping_Enable_1_>
+  <NAT_Keep_Alive_Enable_1_>Yes</NAT_Keep_Alive_Enable_1_>
+{{- if .NTP}}
+  <Primary_NTP_Server>{{.Server}}</Primary_NTP_Server>
+{{- end}}
+</flat-profile>
+`
+
+// provisionData is what a provisioning profile template can refer to
+type provisionData struct {
+	Server   string // The server's address on the adapter's port
+	Port     int    // SIP port
+	MAC      string // The adapter's hardware address, if it got its address by DHCP
+	User     string // SIP user for the adapter
+	Password string // The user's password in the registrar, if it has users
+	NTP      bool   // Whether the server is also the adapter's time server
+}
+
+// lanServices are the DHCP, NTP and provisioning servers on the port a
+// phone adapter is patched into
+type lanServices struct {
+	closers []func()
+}
+
+// startLAN starts the services LANConfig asks for on its interface, which
+// must already have a static IPv4 address. The SIP port goes in the
+// provisioning profile.
+func startLAN(cfg *Config, sipPort int) (*lanServices, error) {
+	lan := cfg.LAN
+	iface, err := net.InterfaceByName(lan.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("lan: %v", err)
+	}
+	serverIP, subnet, err := interfaceSubnet(iface)
+	if err != nil {
+		return nil, err
+	}
+	services := &lanServices{}
+	fail := func(err error) (*lanServices, error) {
+		services.Close()
+		return nil, err
+	}
+
+	var dhcp *dhcpServer
+	if lan.DHCP {
+		conn, err := listenDHCP(iface)
+		if err != nil {
+			return fail(err)
+		}
+		dhcp = &dhcpServer{
+			conn:     conn,
+			serverIP: serverIP,
+			mask:     subnet.Mask,
+			poolSize: lan.PoolSize,
+			lease:    time.Duration(lan.LeaseSeconds) * time.Second,
+			ntp:      lan.NTP,
+			leases:   make(map[uint32]dhcpLease),
+		}
+		dhcp.poolStart = ipToUint32(serverIP.Mask(subnet.Mask)) + DEFAULT_DHCP_POOL_OFFSET
+		if lan.PoolStart != "" {
+			dhcp.poolStart = ipToUint32(net.ParseIP(lan.PoolStart))
+		}
+		if !subnet.Contains(uint32ToIP(dhcp.poolStart)) || !subnet.Contains(uint32ToIP(dhcp.poolStart+uint32(dhcp.poolSize)-1)) {
+			conn.Close()
+			return fail(fmt.Errorf("lan: the DHCP pool doesn't fit in %s", subnet))
+		}
+		if lan.Provision {
+			dhcp.provisionURL = provisionURL(serverIP, lan.ProvisionPort)
+		}
+		services.closers = append(services.closers, func() { conn.Close() })
+		go dhcp.Serve()
+		fmt.Printf("📡 DHCP on %s: %s to %s\n", lan.Interface,
+			uint32ToIP(dhcp.poolStart), uint32ToIP(dhcp.poolStart+uint32(dhcp.poolSize)-1))
+	}
+
+	if lan.NTP {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: serverIP, Port: NTP_PORT})
+		if err != nil {
+			return fail(fmt.Errorf("failed to listen for NTP on %s: %v", serverIP, err))
+		}
+		services.closers = append(services.closers, func() { conn.Close() })
+		go serveNTP(conn)
+		fmt.Printf("🕰️  NTP on %s\n", conn.LocalAddr())
+	}
+
+	if lan.Provision {
+		profile := DEFAULT_PROVISION_PROFILE
+		if lan.Profile != "" {
+			data, err := os.ReadFile(cfg.ResolvePath(lan.Profile))
+			if err != nil {
+				return fail(fmt.Errorf("failed to read provisioning profile: %v", err))
+			}
+			profile = string(data)
+		}
+		tmpl, err := template.New("profile").Parse(profile)
+		if err != nil {
+			return fail(fmt.Errorf("failed to parse provisioning profile: %v", err))
+		}
+
+		listener, err := net.Listen("tcp4", net.JoinHostPort(serverIP.String(), strconv.Itoa(lan.ProvisionPort)))
+		if err != nil {
+			return fail(fmt.Errorf("failed to listen for provisioning: %v", err))
+		}
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				serveProfile(w, r, tmpl, cfg, dhcp, serverIP, sipPort)
+			}),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		services.closers = append(services.closers, func() { server.Close() })
+		go func() {
+			if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("❌ Provisioning server stopped: %v", err)
+			}
+		}()
+		fmt.Printf("📋 Provisioning profile at %s\n", provisionURL(serverIP, lan.ProvisionPort))
+	}
+	return services, nil
+}
+
+// Close stops the services
+func (l *lanServices) Close() {
+	for _, closer := range l.closers {
+		closer()
+	}
+}
+
+// interfaceSubnet is the IPv4 address and subnet of an interface
+func interfaceSubnet(iface *net.Interface) (net.IP, *net.IPNet, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("lan: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4(), &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask[len(ipnet.Mask)-4:]}, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("lan: %s has no IPv4 address; give it a static one, e.g. 10.10.10.1/24", iface.Name)
+}
+
+// provisionURL is where the profile is served, as sent in DHCP option 66
+func provisionURL(serverIP net.IP, port int) string {
+	host := serverIP.String()
+	if port != 80 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	return "http://" + host + PROVISION_PATH
+}
+
+// serveProfile renders the provisioning profile for the adapter asking.
+// It is known by the MAC address it got its lease with, which picks its
+// SIP user and so its password.
+func serveProfile(w http.ResponseWriter, r *http.Request, tmpl *template.Template, cfg *Config, dhcp *dhcpServer, serverIP net.IP, sipPort int) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	data := provisionData{Server: serverIP.String(), Port: sipPort, NTP: cfg.LAN.NTP}
+	if dhcp != nil {
+		data.MAC = dhcp.MACFor(net.ParseIP(host))
+	}
+	data.User = cfg.LAN.userFor(data.MAC)
+	data.Password = cfg.SIPUsers()[data.User]
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		log.Printf("❌ Provisioning profile for %s: %v", host, err)
+		http.Error(w, "profile failed", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("📋 Provisioned %s as %s\n", cmp.Or(data.MAC, host), data.User)
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprint(w, out.String())
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SIP_UDP_MAX_MESSAGE is the largest UDP payload there can be, and so the
+// read buffer for SIP datagrams: nothing that arrives is cut short
+const SIP_UDP_MAX_MESSAGE = 65535
+
+// sipListenIPs is the local addresses a server's SIP sockets belong on:
+// the bind address; the bind interface's address, or every interface
+// ("") until it has one; otherwise every IPv4 and IPv6 address of every
+// interface that is up, and loopback for tools on the same machine
+func sipListenIPs(cfg *Config) []string {
+	switch {
+	case cfg.BindIP != "":
+		return []string{cfg.BindIP}
+	case cfg.BindInterface != "":
+		return []string{interfaceIP(cfg.BindInterface)}
+	}
+
+	ips := []string{"127.0.0.1"}
+	if hasIPv6Loopback() {
+		ips = append(ips, "::1")
+	}
+	snapshot, err := takeNetworkSnapshot()
+	if err != nil {
+		log.Printf("⚠️  %v; listening on every interface", err)
+		return []string{""}
+	}
+	for _, addrs := range snapshot {
+		ips = append(ips, addrs...)
+	}
+	slices.Sort(ips)
+	return slices.Compact(ips)
+}
+
+// syncListeners opens a SIP socket on each address the server should
+// listen on and closes those on addresses that have gone, all on the same
+// port. Sockets no longer wanted are closed first, since one on every
+// interface holds the port on all of them. If nothing can be bound the
+// server falls back to a socket on every interface.
+func (s *SIPServer) syncListeners(port int) error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+
+	want := sipListenIPs(s.config)
+	for ip, conn := range s.conns {
+		if !slices.Contains(want, ip) {
+			conn.Close()
+			delete(s.conns, ip)
+			maps.DeleteFunc(s.arrivals, func(_, local string) bool { return local == ip })
+			if ip != "" {
+				fmt.Printf("🔌 Stopped listening for SIP on %s\n", ip)
+			}
+		}
+	}
+
+	var failed error
+	for _, ip := range want {
+		if s.conns[ip] != nil {
+			continue
+		}
+		addr := net.JoinHostPort(ip, strconv.Itoa(port))
+		conn, err := listenUDP(addr, s.config.Socket)
+		if err != nil {
+			log.Printf("❌ Failed to listen for SIP on %s: %v", addr, err)
+			failed = errors.Join(failed, err)
+			continue
+		}
+		if err := setDSCP(conn, s.config.QoS.SIPDSCP); err != nil {
+			log.Printf("⚠️  Could not mark SIP packets: %v", err)
+		}
+		if port == 0 {
+			port = conn.LocalAddr().(*net.UDPAddr).Port // The rest share the port the OS picked
+		}
+		s.addListener(ip, conn)
+	}
+
+	if len(s.conns) == 0 && !slices.Contains(want, "") {
+		conn, err := listenUDP(net.JoinHostPort("", strconv.Itoa(port)), s.config.Socket)
+		if err != nil {
+			return fmt.Errorf("failed to listen on SIP port: %v", errors.Join(failed, err))
+		}
+		s.addListener("", conn)
+	}
+	if len(s.conns) == 0 {
+		return fmt.Errorf("failed to listen on SIP port: %v", failed)
+	}
+	return nil
+}
+
+// addListener starts using a SIP socket. Must be called with connMu held.
+func (s *SIPServer) addListener(ip string, conn *net.UDPConn) {
+	s.conns[ip] = conn
+	if ip == "" {
+		fmt.Printf("🌐 Listening for SIP on every interface, port %d\n", conn.LocalAddr().(*net.UDPAddr).Port)
+	} else {
+		fmt.Printf("🎯 Listening for SIP on %s\n", conn.LocalAddr())
+	}
+	if s.reading {
+		s.spawn(func() { s.readSIP(ip, conn) })
+	}
+}
+
+// readSIP handles the SIP messages arriving on one socket until it is
+// closed, noting the local address each sender reached it on
+func (s *SIPServer) readSIP(ip string, conn *net.UDPConn) {
+	buffer := make([]byte, SIP_UDP_MAX_MESSAGE)
+	for {
+		n, remoteAddr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("❌ Error reading UDP packet: %v", err)
+			continue
+		}
+		captureDatagram(conn, remoteAddr.AddrPort(), buffer[:n], false)
+
+		// Parse SIP message
+		message := string(buffer[:n])
+		if s.isScanner(message, remoteAddr) {
+			continue
+		}
+		if sipTrace.Load() {
+			fmt.Printf("\n📨 Received SIP Message from %s on %s (%d bytes)\n", remoteAddr, conn.LocalAddr(), n)
+			fmt.Printf("--- Message Content ---\n")
+			fmt.Print(message)
+			fmt.Printf("--- End Message ---\n")
+		}
+		if ip != "" {
+			s.connMu.Lock()
+			s.arrivals[remoteAddr.IP.String()] = ip
+			s.connMu.Unlock()
+		}
+
+		message, refusal := checkDatagram(message, cmp.Or(s.config.Socket.MaxMessage, SIP_UDP_MAX_MESSAGE))
+		if refusal != "" {
+			s.refuseDatagram(message, refusal, remoteAddr)
+			continue
+		}
+
+		// Handle the SIP message
+		s.spawn(func() { s.handleSIPMessage(message, remoteAddr) })
+	}
+}
+
+// checkDatagram checks that a SIP message arrived over UDP whole and no
+// larger than limit bytes, returning it with anything after its body cut
+// off, or the status to refuse it with. A body shorter than its
+// Content-Length means the message was truncated on the way (RFC 3261
+// section 18.3).
+func checkDatagram(message string, limit int) (string, string) {
+	if strings.TrimSpace(message) == "" {
+		return message, "" // Keep-alive
+	}
+	if len(message) > limit {
+		return message, "513 Message Too Large"
+	}
+	sep := "\r\n\r\n"
+	if !strings.Contains(message, sep) {
+		sep = "\n\n" // Bare line feeds, as some devices send
+	}
+	head, body, found := strings.Cut(message, sep)
+	if !found {
+		return message, "400 Incomplete Message"
+	}
+	value, ok := parseHeaders(head)["Content-Length"]
+	if !ok {
+		return message, ""
+	}
+	length, err := strconv.Atoi(strings.TrimSpace(value))
+	switch {
+	case err != nil || length < 0:
+		return message, "400 Bad Content-Length"
+	case length > len(body):
+		return message, "400 Incomplete Message"
+	}
+	return head + sep + body[:length], ""
+}
+
+// refuseDatagram answers a request checkDatagram refused; a refused
+// response, or a request too mangled to answer, is dropped
+func (s *SIPServer) refuseDatagram(message, status string, remoteAddr *net.UDPAddr) {
+	log.Printf("❌ Refusing a %d-byte message from %s: %s", len(message), remoteAddr, status)
+	lines := splitLines(message)
+	if !isRequest(lines[0]) || getMethod(lines[0]) == "ACK" {
+		return
+	}
+	headers := parseHeaders(stampVia(message, remoteAddr))
+	if headers["Via"] == "" || headers["CSeq"] == "" {
+		return
+	}
+	s.sendResponse(registerResponse(headers, status), remoteAddr)
+}
+
+// localIPFor is the address to give remote in Contact, Via and SDP: the
+// advertise_ip of the extension registered from it, else the one it is
+// reached from (see socketIPFor)
+func (s *SIPServer) localIPFor(remote *net.UDPAddr) string {
+	if ip := s.advertiseIPFor(remote); ip != "" {
+		return ip
+	}
+	return s.socketIPFor(remote)
+}
+
+// socketIPFor is the local address remote is reached from: the bind
+// address if there is one, else the address its requests arrive on, else
+// the one the routing table reaches it from
+func (s *SIPServer) socketIPFor(remote *net.UDPAddr) string {
+	if s.config.BindIP != "" {
+		return s.config.BindIP
+	}
+	if remote == nil {
+		return s.advertisedIP()
+	}
+
+	s.connMu.RLock()
+	ip, ok := s.arrivals[remote.IP.String()]
+	s.connMu.RUnlock()
+	if ok {
+		return ip
+	}
+	if ip := routeLocalIP(remote); ip != "" {
+		return ip
+	}
+	return s.advertisedIP()
+}
+
+// advertiseIPFor is the advertise_ip configured for the extension
+// registered from remote, or ""
+func (s *SIPServer) advertiseIPFor(remote *net.UDPAddr) string {
+	if remote == nil {
+		return ""
+	}
+	for _, ex := range s.Exchanges() {
+		for number, ext := range ex.config.Extensions {
+			if ext.AdvertiseIP == "" {
+				continue
+			}
+			for _, ua := range ex.registrar.Lookup(number) {
+				if ua.RemoteAddr.Port == remote.Port && ua.RemoteAddr.IP.Equal(remote.IP) {
+					return ext.AdvertiseIP
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// routeLocalIP is the local address the routing table would send from to
+// reach remote; nothing is sent to find out
+func routeLocalIP(remote *net.UDPAddr) string {
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// connFor is the SIP socket to send to remote from: the one bound to the
+// address it is given, so replies come from where requests went, else one
+// of remote's address family
+func (s *SIPServer) connFor(remote *net.UDPAddr) *net.UDPConn {
+	ip := s.socketIPFor(remote)
+
+	s.connMu.RLock()
+	defer s.connMu.RUnlock()
+	if conn, ok := s.conns[ip]; ok {
+		return conn
+	}
+	if conn, ok := s.conns[""]; ok {
+		return conn
+	}
+	if len(s.conns) == 0 {
+		return nil
+	}
+	ips := slices.Sorted(maps.Keys(s.conns))
+	for _, local := range ips {
+		if remote != nil && isIPv6(local) == (remote.IP.To4() == nil) {
+			return s.conns[local]
+		}
+	}
+	return s.conns[ips[0]]
+}
+
+// isIPv6 reports whether ip is an IPv6 address
+func isIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+// hasIPv6Loopback reports whether ::1 is configured, which it isn't where
+// IPv6 is turned off
+func hasIPv6Loopback() bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(net.IPv6loopback) {
+			return true
+		}
+	}
+	return false
+}
+
+// SIPAddr returns an address the SIP sockets are bound to; they all share
+// its port
+func (s *SIPServer) SIPAddr() *net.UDPAddr {
+	s.connMu.RLock()
+	defer s.connMu.RUnlock()
+	ips := slices.Sorted(maps.Keys(s.conns))
+	if len(ips) == 0 {
+		return &net.UDPAddr{}
+	}
+	return s.conns[ips[0]].LocalAddr().(*net.UDPAddr)
+}
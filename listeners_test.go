@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// awaitRequestFrom waits for the server to send ua a request with method,
+// returning it
+func awaitRequestFrom(ua *testUA, method string, timeout time.Duration) (string, error) {
+	buffer := make([]byte, SIP_UDP_MAX_MESSAGE)
+	ua.sipConn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, _, err := ua.sipConn.ReadFromUDP(buffer)
+		if err != nil {
+			return "", err
+		}
+		message := string(buffer[:n])
+		if lines := splitLines(message); isRequest(lines[0]) && getMethod(lines[0]) == method {
+			return message, nil
+		}
+	}
+}
+
+func TestContactPerListener(t *testing.T) {
+	second := net.IPv4(127, 0, 0, 2)
+	if conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: second}); err != nil {
+		t.Skipf("can't listen on %s: %v", second, err)
+	} else {
+		conn.Close()
+	}
+
+	cfg := selfTestConfig()
+	cfg.BindIP = "127.0.0.1"
+	cfg.SIPPort = 0
+	cfg.Registrar.Keepalive.Interval = 1
+	cfg.Exchanges = []ExchangeConfig{{Name: "second", BindIP: second.String(), DialPlan: cfg.DialPlan, Destinations: cfg.Destinations}}
+	servers, err := newServers(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeServers(servers)
+	if len(servers) != 2 {
+		t.Fatalf("%d servers, want one per listener", len(servers))
+	}
+
+	for _, server := range servers {
+		go server.Run()
+		listener := server.SIPAddr().String()
+
+		ua, err := newTestUA(server.SIPAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ua.Close()
+		if err := ua.Register(); err != nil {
+			t.Fatalf("register through %s: %v", listener, err)
+		}
+
+		// The answer to a call names the listener the phone called
+		ua.callID, ua.cseq, ua.remoteTag = "contact-"+listener, 0, ""
+		code, answer, err := ua.transact("INVITE", "", "")
+		if err != nil || code != 200 {
+			t.Fatalf("INVITE through %s: %d %v", listener, code, err)
+		}
+		if got := uriAddress(uriFromHeader(parseHeaders(answer)["Contact"], nil)); got != listener {
+			t.Errorf("answer through %s has Contact at %s", listener, got)
+		}
+		ua.remoteTag = headerTag(parseHeaders(answer)["To"])
+		ua.send("ACK", "", "")
+		ua.Bye()
+
+		// and so do the server's own requests, in their Via too
+		probe, err := awaitRequestFrom(ua, "OPTIONS", 3*time.Second)
+		if err != nil {
+			t.Fatalf("no keepalive through %s: %v", listener, err)
+		}
+		headers := parseHeaders(probe)
+		if got := uriAddress(uriFromHeader(headers["Contact"], nil)); got != listener {
+			t.Errorf("keepalive through %s has Contact at %s", listener, got)
+		}
+		if got := viaAddress(topVia(splitLines(probe))); got != listener {
+			t.Errorf("keepalive through %s has Via sent-by %s", listener, got)
+		}
+	}
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
-	"encoding/binary"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"math"
+	"maps"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -29,35 +36,94 @@ const (
 	// Dial tone frequencies (North American standard)
 	DIAL_TONE_FREQ1 = 350.0 // Hz
 	DIAL_TONE_FREQ2 = 440.0 // Hz
+
+	// Ringback and busy tones, also North American
+	RINGBACK_FREQ1 = 440.0 // Hz
+	RINGBACK_FREQ2 = 480.0 // Hz
+	RINGBACK_ON    = 2 * time.Second
+	RINGBACK_OFF   = 4 * time.Second
+	BUSY_FREQ1     = 480.0 // Hz
+	BUSY_FREQ2     = 620.0 // Hz
+	BUSY_ON        = 500 * time.Millisecond
+	BUSY_OFF       = 500 * time.Millisecond
+	REORDER_ON     = 250 * time.Millisecond // Busy tone at twice the rate
+	REORDER_OFF    = 250 * time.Millisecond
+
+	// SHUTDOWN_TIMEOUT bounds how long shutting down waits for the phones
+	// to answer the BYEs ending their calls
+	SHUTDOWN_TIMEOUT = 5 * time.Second
 )
 
 // SIPServer represents our SIP server instance
 type SIPServer struct {
-	conn         *net.UDPConn
-	rtpPort      int
-	rtpConn      *net.UDPConn
-	registeredUA map[string]*RegisteredUA // Track registered user agents
-}
-
-// RegisteredUA represents a registered SIP user agent (like our PAP2)
-type RegisteredUA struct {
-	Contact    string
-	Expires    time.Time
-	CallID     string
-	RemoteAddr *net.UDPAddr
-}
-
-// CallSession represents an active call session
-type CallSession struct {
-	CallID         string
-	RemoteAddr     *net.UDPAddr
-	RemoteRTPAddr  *net.UDPAddr
-	DialToneActive bool
+	config    *Config
+	connMu    sync.RWMutex
+	conns     map[string]*net.UDPConn // SIP sockets by local IP, "" for one on every interface; see syncListeners
+	arrivals  map[string]string       // Local IP each remote IP's requests last arrived on
+	reading   bool                    // Run has started reading the SIP sockets
+	scheduler *mediaScheduler         // Paces all outgoing RTP streams
+
+	// Our address outside the NAT, for browsers' ICE; see gatherReflexive
+	reflexive atomic.Pointer[net.UDPAddr]
+
+	// SIP over TCP on the same port, TLS and WebSocket, guarded by connMu;
+	// see listenTCP, listenTLS and ListenWebSocket
+	tcpListener net.Listener           // nil if the port couldn't be had
+	tlsListener net.Listener           // nil without a certificate
+	wsServer    *http.Server           // Browser clients; nil if not listening
+	wsPort      int                    // Its port, for Via and Contact
+	tcpConns    map[string]*streamConn // Open connections by remote address
+
+	exchangesMu sync.RWMutex
+	exchanges   []*exchange // Served on this socket; the first is the default; replaced on reload
+
+	// Server lifetime; every call's context derives from ctx
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // Goroutines started via spawn
+
+	callsMu sync.Mutex
+	calls   map[string]*CallSession // Active calls by Call-ID
+	dialogs map[dialogID]*dialog    // Their SIP dialogs, for matching the phones' requests
+	pending map[string]chan string  // Responses awaited by our own requests, by transactionKey
+	closing bool
+	closed  sync.Once // Close has run, as Shutdown and main's deferred close both call it
+
+	// Set by Shutdown, guarded by callsMu: new calls are turned away
+	draining bool
+
+	// Phones watching mailboxes, guarded by callsMu
+	subscriptions map[dialogID]*subscription
+
+	scanners *scannerGuard  // Spots and tarpits SIP scanners
+	messages recentMessages // MESSAGEs answered lately, for their retransmissions
+
+	federation net.Listener // Tunnels from peer installations; nil if not listening
+	trunks     []*sipTrunk  // Provider accounts registered with; see RegisterTrunks
+
+	started time.Time // For the uptime on the stats line
+
+	reload *configReloader // Used by the admin menu; nil without a config file
 }
 
 func main() {
+	// Subcommands such as "dialplan test" run instead of the server
+	if exitCode, handled := runSubcommand(os.Args[1:]); handled {
+		os.Exit(exitCode)
+	}
+
 	// Parse command line flags
+	configPath := flag.String("config", "", "Path to JSON config file")
 	bindIP := flag.String("ip", "", "IP address to bind to (default: auto-detect)")
+	bindInterface := flag.String("iface", "", "Network interface to bind to, following its address as it changes")
+	sipPort := flag.Int("sip-port", SIP_PORT, "SIP port to listen on, UDP and TCP (0 picks any free port)")
+	mediaPort := flag.Int("media-port", 0, "One UDP port for every call's RTP and RTCP, rather than a pair each from the RTP range")
+	capturePath := flag.String("capture", "", "Write all SIP and RTP sent and received to a pcap file, for Wireshark")
+	rtpDSCP := flag.Int("dscp-rtp", DSCP_EF, "DSCP value for RTP packets (0 disables marking)")
+	sipDSCP := flag.Int("dscp-sip", DSCP_CS3, "DSCP value for SIP packets (0 disables marking)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate for SIP over TLS (enables the sips: listener)")
+	tlsKey := flag.String("tls-key", "", "PEM private key for the TLS certificate")
+	proxy := flag.Bool("proxy", false, "Run as a stateless SIP proxy: phones call each other directly, without media through the server")
 	help := flag.Bool("help", false, "Show help message")
 	flag.Parse()
 
@@ -68,170 +134,419 @@ func main() {
 		fmt.Println("Usage:")
 		fmt.Println("  ./travel-by-telephone                    # Bind to all interfaces")
 		fmt.Println("  ./travel-by-telephone -ip 192.168.1.100 # Bind to specific IP")
+		fmt.Println("  ./travel-by-telephone -iface en5        # Bind to an interface, following its address")
+		fmt.Println("  ./travel-by-telephone -sip-port 5080    # Listen beside other SIP software on 5060")
+		fmt.Println("  ./travel-by-telephone -media-port 10000 # All calls' audio on one port, as in a container")
+		fmt.Println("  ./travel-by-telephone -config tbt.json  # Load settings from a config file")
+		fmt.Println("  ./travel-by-telephone -tls-cert cert.pem -tls-key key.pem")
+		fmt.Println("                                           # Also accept SIP over TLS on port 5061")
+		fmt.Println("  ./travel-by-telephone -proxy            # Just forward calls between registered phones")
+		fmt.Println("  ./travel-by-telephone -capture calls.pcap")
+		fmt.Println("                                           # Save SIP and RTP for Wireshark, without tcpdump")
 		fmt.Println("  ./travel-by-telephone -help             # Show this help")
+		fmt.Println("  ./travel-by-telephone check -config <file>")
+		fmt.Println("                                           # Validate a config before deploying it")
+		fmt.Println("  ./travel-by-telephone selftest [-config file -number digits]")
+		fmt.Println("                                           # Place a scripted test call in-process")
+		fmt.Println("  ./travel-by-telephone dialplan test [-config file] <digits>")
+		fmt.Println("                                           # Trace how a number would be routed")
+		fmt.Println("  ./travel-by-telephone ring -config <file> <user> <destination>")
+		fmt.Println("                                           # Ring a phone and play a destination when answered")
 		fmt.Println()
 		fmt.Println("Network Setup:")
 		fmt.Println("  If your PAP2 is on a different subnet (e.g., 192.168.1.0)")
 		fmt.Println("  and your computer is on WiFi (e.g., 192.168.5.0), you need:")
 		fmt.Println("  1. USB-to-Ethernet adapter connected to PAP2's network")
-		fmt.Println("  2. Run with -ip flag using the adapter's IP address")
+		fmt.Println("  2. Run with -ip flag using the adapter's IP address, or with -iface")
+		fmt.Println("     and the adapter's name if it may be plugged in later")
+		fmt.Println()
+		fmt.Println("QoS:")
+		fmt.Println("  RTP is marked EF (46) and SIP CS3 (24) by default so routers")
+		fmt.Println("  with QoS prioritize voice. Use -dscp-rtp/-dscp-sip to change.")
 		fmt.Println()
 		fmt.Println("See NETWORKING-SOLUTIONS.md for detailed setup instructions.")
 		return
 	}
 
+	// Load configuration, letting explicitly set flags override the file
+	cfg := defaultConfig()
+	if *configPath != "" {
+		var err error
+		cfg, err = loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+	applyFlags := func(cfg *Config) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "ip":
+				cfg.BindIP = *bindIP
+			case "iface":
+				cfg.BindInterface = *bindInterface
+			case "sip-port":
+				cfg.SIPPort = *sipPort
+			case "media-port":
+				cfg.MediaPort = *mediaPort
+			case "dscp-rtp":
+				cfg.QoS.RTPDSCP = *rtpDSCP
+			case "dscp-sip":
+				cfg.QoS.SIPDSCP = *sipDSCP
+			case "tls-cert": // Relative to where we were started, not the config file
+				cfg.TLS.CertFile, _ = filepath.Abs(*tlsCert)
+			case "tls-key":
+				cfg.TLS.KeyFile, _ = filepath.Abs(*tlsKey)
+			case "proxy":
+				cfg.Proxy = *proxy
+			}
+		})
+	}
+	applyFlags(cfg)
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
 	fmt.Println("Starting Travel by Telephone - SIP Server for PAP2")
 	fmt.Println("================================================")
 
 	// Show all available network interfaces
 	showNetworkInterfaces()
 
-	// Create SIP server
-	server, err := NewSIPServer(*bindIP)
+	// Capture from the first packet, before any phone can reach us
+	if *capturePath != "" {
+		capture, err := startCapture(*capturePath)
+		if err != nil {
+			log.Fatalf("Failed to start capture: %v", err)
+		}
+		defer capture.Close()
+		fmt.Printf("📼 Capturing SIP and RTP to %s\n", *capturePath)
+	}
+
+	// Create a SIP server for each address the exchanges listen on
+	servers, err := newServers(cfg)
 	if err != nil {
 		log.Fatalf("Failed to create SIP server: %v", err)
 	}
-	defer server.Close()
+	defer closeServers(servers)
+
+	// The admin menu and SIGHUP reload the config file, flags still on top
+	var reloader *configReloader
+	if *configPath != "" {
+		reloader = &configReloader{servers: servers, load: func() (*Config, error) {
+			cfg, err := loadConfig(*configPath)
+			if err != nil {
+				return nil, err
+			}
+			applyFlags(cfg)
+			if err := cfg.Validate(); err != nil {
+				return nil, fmt.Errorf("invalid configuration: %v", err)
+			}
+			return cfg, nil
+		}}
+		for _, server := range servers {
+			server.reload = reloader
+		}
+	}
+
+	// Peers, trunks and browsers call in through the first server
+	if cfg.Federation.Listen != "" {
+		if err := servers[0].ListenFederation(cfg.Federation.Listen); err != nil {
+			log.Fatalf("Failed to start federation: %v", err)
+		}
+	}
+	if len(cfg.SIPTrunks) > 0 {
+		servers[0].RegisterTrunks(cfg.SIPTrunks)
+	}
+	if cfg.WebSocket.Listen != "" {
+		if err := servers[0].ListenWebSocket(cfg.WebSocket); err != nil {
+			log.Fatalf("Failed to start WebSocket listener: %v", err)
+		}
+	}
+	if cfg.API.Listen != "" {
+		api, err := startAPI(cfg.API, servers)
+		if err != nil {
+			log.Fatalf("Failed to start API: %v", err)
+		}
+		defer api.Close()
+	}
+	if cfg.LAN.enabled() {
+		lan, err := startLAN(cfg, servers[0].SIPAddr().Port)
+		if err != nil {
+			log.Fatalf("Failed to start LAN services: %v", err)
+		}
+		defer lan.Close()
+	}
 
 	// Start the server
-	fmt.Printf("SIP Server listening on port %d\n", SIP_PORT)
-	fmt.Printf("RTP Server listening on port %d\n", server.rtpPort)
+	for _, server := range servers {
+		fmt.Printf("SIP Server listening on port %d\n", server.SIPAddr().Port)
+		for _, ex := range server.Exchanges() {
+			if ex.domain != "" {
+				fmt.Printf("  📇 Exchange %s for domain %s\n", ex.name, ex.domain)
+			} else if len(server.Exchanges()) > 1 || len(servers) > 1 {
+				fmt.Printf("  📇 Exchange %s\n", ex.name)
+			}
+		}
+	}
+	if cfg.MediaPort != 0 {
+		fmt.Printf("RTP and RTCP on port %d, shared by every call\n", cfg.MediaPort)
+	} else {
+		fmt.Printf("RTP ports %d-%d, a pair for each call\n", RTP_PORT_MIN, RTP_PORT_MAX)
+	}
+	if cfg.Proxy {
+		fmt.Println("🔀 Proxy mode: calls between phones are forwarded, media goes phone to phone")
+	}
 	fmt.Println("\nWaiting for PAP2 to register...")
 	fmt.Println("Configure your PAP2 to use this server's IP address")
 
-	// Handle graceful shutdown
+	// Handle graceful shutdown, and SIGHUP to reload
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	// Start server in goroutine
-	go server.Run()
+	// Start servers in goroutines
+	for _, server := range servers {
+		go server.Run()
+	}
+
+	// Follow adapters plugged in and addresses changing after startup
+	watching, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	go watchNetwork(watching, servers)
 
 	// Wait for shutdown signal
-	<-sigChan
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if reloader == nil {
+			log.Printf("⚠️  Ignoring SIGHUP: no -config to reload")
+			continue
+		}
+		if err := reloader.Reload(); err != nil {
+			log.Printf("❌ Reload failed: %v", err)
+		}
+	}
 	fmt.Println("\nShutting down server...")
+	var shutdown sync.WaitGroup
+	for _, server := range servers {
+		shutdown.Add(1)
+		go func() {
+			defer shutdown.Done()
+			server.Shutdown(SHUTDOWN_TIMEOUT)
+		}()
+	}
+	shutdown.Wait()
 }
 
 // NewSIPServer creates a new SIP server instance
-func NewSIPServer(bindIP string) (*SIPServer, error) {
-	// Determine bind address
-	var sipAddrStr string
-	if bindIP != "" {
-		sipAddrStr = fmt.Sprintf("%s:%d", bindIP, SIP_PORT)
-		fmt.Printf("🎯 Binding to specific IP: %s\n", sipAddrStr)
-	} else {
-		sipAddrStr = fmt.Sprintf(":%d", SIP_PORT)
-		fmt.Printf("🌐 Binding to all interfaces on port %d\n", SIP_PORT)
-	}
-
-	// Create UDP connection for SIP
-	sipAddr, err := net.ResolveUDPAddr("udp", sipAddrStr)
+func NewSIPServer(cfg *Config) (*SIPServer, error) {
+	ex, err := newExchange(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve SIP address: %v", err)
+		return nil, err
 	}
 
-	sipConn, err := net.ListenUDP("udp", sipAddr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to listen on SIP port: %v", err)
+	applyRuntimeSettings(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &SIPServer{
+		config:    cfg,
+		conns:     make(map[string]*net.UDPConn),
+		arrivals:  make(map[string]string),
+		scheduler: newMediaScheduler(),
+		exchanges: []*exchange{ex},
+		ctx:       ctx,
+		cancel:    cancel,
+		calls:     make(map[string]*CallSession),
+		dialogs:   make(map[dialogID]*dialog),
+		pending:   make(map[string]chan string),
+		scanners:  newScannerGuard(cfg.Security),
+		started:   time.Now(),
+
+		subscriptions: make(map[dialogID]*subscription),
+		tcpConns:      make(map[string]*streamConn),
 	}
 
-	// Find available RTP port
-	rtpPort, rtpConn, err := findAvailableRTPPort()
-	if err != nil {
-		sipConn.Close()
-		return nil, fmt.Errorf("failed to find available RTP port: %v", err)
+	// Create UDP connections for SIP
+	if cfg.BindInterface != "" && interfaceIP(cfg.BindInterface) == "" {
+		fmt.Printf("🌐 %s has no address yet; listening on every interface until it does\n", cfg.BindInterface)
 	}
-
-	return &SIPServer{
-		conn:         sipConn,
-		rtpPort:      rtpPort,
-		rtpConn:      rtpConn,
-		registeredUA: make(map[string]*RegisteredUA),
-	}, nil
+	if err := s.syncListeners(cfg.SIPPort); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.listenTCP(s.SIPAddr().Port)
+	if err := s.listenTLS(s.SIPAddr().Port); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if cfg.MediaPort != 0 {
+		if _, err := openSharedMedia(cfg.MediaPort, cfg.Socket, cfg.QoS.RTPDSCP); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
-// findAvailableRTPPort finds an available port in the RTP range
-func findAvailableRTPPort() (int, *net.UDPConn, error) {
-	for port := RTP_PORT_MIN; port <= RTP_PORT_MAX; port += 2 { // RTP uses even ports
-		addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
-		if err != nil {
-			continue
-		}
+// Close ends all calls, closes the server connections and waits for every
+// call goroutine to exit. Closing again does nothing.
+func (s *SIPServer) Close() {
+	s.closed.Do(s.close)
+}
 
-		conn, err := net.ListenUDP("udp", addr)
-		if err != nil {
-			continue
-		}
+// close does the work of Close, once
+func (s *SIPServer) close() {
+	s.callsMu.Lock()
+	s.closing = true
+	s.callsMu.Unlock()
 
-		return port, conn, nil
+	s.cancel()
+	s.scheduler.Stop()
+	if s.federation != nil {
+		s.federation.Close()
+	}
+	s.connMu.Lock()
+	for _, conn := range s.conns {
+		conn.Close()
 	}
+	s.connMu.Unlock()
+	s.closeTCP()
 
-	return 0, nil, fmt.Errorf("no available RTP ports in range %d-%d", RTP_PORT_MIN, RTP_PORT_MAX)
+	s.wg.Wait()
 }
 
-// Close closes the server connections
-func (s *SIPServer) Close() {
-	if s.conn != nil {
-		s.conn.Close()
+// Shutdown closes the server gracefully. New calls are turned away with
+// 503, calls still ringing are cancelled, and every active call has its
+// media stopped and is hung up with a BYE; once the phones have answered
+// the BYEs, or timeout has passed, the server is closed.
+func (s *SIPServer) Shutdown(timeout time.Duration) {
+	s.callsMu.Lock()
+	s.draining = true
+	sessions := slices.Collect(maps.Values(s.calls))
+	for _, d := range s.dialogs {
+		d.mu.Lock()
+		if d.state == dialogRinging && d.cancelled != nil {
+			d.state = dialogTerminating
+			close(d.cancelled)
+		}
+		d.mu.Unlock()
 	}
-	if s.rtpConn != nil {
-		s.rtpConn.Close()
+	s.callsMu.Unlock()
+
+	var hangups sync.WaitGroup
+	for _, session := range sessions {
+		hangups.Add(1)
+		go func() {
+			defer hangups.Done()
+			if !s.endCallSession(session.CallID) || session.dialog == nil {
+				return
+			}
+			fmt.Printf("📴 Hanging up %s for shutdown\n", session.dialog.requestURI)
+			s.transactRequest(session.dialog, "BYE", "", "")
+		}()
 	}
+	done := make(chan struct{})
+	go func() {
+		hangups.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("⚠️  Closing with BYEs unanswered after %s", timeout)
+	}
+	s.Close()
 }
 
-// Run starts the main server loop
+// Run starts the server: media, a reader for each SIP socket, the TCP
+// and TLS listeners, the registration reaper and keepalive probes. It
+// returns once the server is closed.
 func (s *SIPServer) Run() {
-	buffer := make([]byte, 4096)
+	go s.scheduler.Run()
+	s.spawn(s.reapRegistrations)
+	s.spawn(s.probeRegistrations)
+
+	s.connMu.Lock()
+	s.reading = true
+	for ip, conn := range s.conns {
+		s.spawn(func() { s.readSIP(ip, conn) })
+	}
+	if listener := s.tcpListener; listener != nil {
+		s.spawn(func() { s.acceptTCP(listener, "TCP") })
+	}
+	if listener := s.tlsListener; listener != nil {
+		s.spawn(func() { s.acceptTCP(listener, "TLS") })
+	}
+	s.connMu.Unlock()
 
 	fmt.Printf("🎧 SIP Server ready and listening for packets...\n")
+	<-s.ctx.Done()
+}
 
-	for {
-		n, remoteAddr, err := s.conn.ReadFromUDP(buffer)
-		if err != nil {
-			log.Printf("❌ Error reading UDP packet: %v", err)
-			continue
-		}
-
-		// Parse SIP message
-		message := string(buffer[:n])
-		fmt.Printf("\n📨 Received SIP Message from %s (%d bytes)\n", remoteAddr, n)
-		fmt.Printf("--- Message Content ---\n")
-		fmt.Print(message)
-		fmt.Printf("--- End Message ---\n")
+// isScanner screens a message for scanning tools before it is logged or
+// handled. Scanners' requests are tarpitted or dropped.
+func (s *SIPServer) isScanner(message string, remoteAddr *net.UDPAddr) bool {
+	lines := splitLines(message)
+	if len(lines) == 0 || !isRequest(lines[0]) {
+		return false
+	}
 
-		// Handle the SIP message
-		go s.handleSIPMessage(message, remoteAddr)
+	method := getMethod(lines[0])
+	headers := parseHeaders(message)
+	scanner, reason := s.scanners.Check(method, headers, remoteAddr)
+	if !scanner {
+		return false
+	}
+	if reason != "" {
+		action := "tarpitting"
+		if s.scanners.config.ScannerAction == "silence" {
+			action = "ignoring"
+		}
+		log.Printf("🕵️  Scanner at %s (%s); %s its requests for %s", remoteAddr.IP, reason, action, SCANNER_BLOCK_DURATION)
 	}
+	s.tarpit(method, headers, remoteAddr)
+	return true
 }
 
 // handleSIPMessage processes incoming SIP messages
 func (s *SIPServer) handleSIPMessage(message string, remoteAddr *net.UDPAddr) {
 	// Parse the SIP message to determine the method
 	lines := splitLines(message)
-	if len(lines) == 0 {
-		return
+	if len(lines) == 0 || lines[0] == "" {
+		return // Empty or CRLF keep-alive
 	}
 
 	requestLine := lines[0]
 
 	if isRequest(requestLine) {
+		message = stampVia(message, remoteAddr)
 		method := getMethod(requestLine)
-		switch method {
-		case "REGISTER":
-			s.handleRegister(message, remoteAddr)
-		case "INVITE":
-			s.handleInvite(message, remoteAddr)
-		case "ACK":
-			s.handleAck(message, remoteAddr)
-		case "BYE":
-			s.handleBye(message, remoteAddr)
-		case "OPTIONS":
-			s.handleOptions(message, remoteAddr)
-		default:
-			log.Printf("Unhandled SIP method: %s", method)
+		if headers := parseHeaders(message); !validCSeq(method, headers["CSeq"]) {
+			log.Printf("❌ Refusing %s from %s with a bad CSeq: %q", method, remoteAddr, headers["CSeq"])
+			if method != "ACK" {
+				s.sendResponse(registerResponse(headers, "400 Bad CSeq"), remoteAddr)
+			}
+			return
+		}
+		if s.config.Proxy && s.proxyRequest(message, remoteAddr) {
+			return
+		}
+		for _, h := range s.handlers() {
+			if h.method == method {
+				h.handle(message, remoteAddr)
+				return
+			}
 		}
+		log.Printf("Unhandled SIP method: %s", method)
+		s.sendResponse(registerResponse(parseHeaders(message), "405 Method Not Allowed", s.allowHeader()), remoteAddr)
 	} else {
 		// This is a response, not a request
-		log.Printf("Received SIP response: %s", requestLine)
+		if s.config.Proxy && s.proxyResponse(message) {
+			return
+		}
+		if !s.deliverResponse(message) {
+			log.Printf("Received SIP response: %s", requestLine)
+		}
 	}
 }
 
@@ -245,10 +560,9 @@ func splitLines(message string) []string {
 			continue
 		}
 		if char == '\n' {
-			if current != "" {
-				lines = append(lines, current)
-				current = ""
-			}
+			// Blank lines are kept: one separates the headers from the body
+			lines = append(lines, current)
+			current = ""
 		} else {
 			current += string(char)
 		}
@@ -262,7 +576,7 @@ func splitLines(message string) []string {
 }
 
 func isRequest(line string) bool {
-	return len(line) > 0 && line[0] != 'S' // SIP responses start with "SIP/"
+	return len(line) > 0 && !strings.HasPrefix(line, "SIP/") // Responses start with "SIP/"; SUBSCRIBE doesn't
 }
 
 func getMethod(requestLine string) string {
@@ -314,78 +628,138 @@ func showNetworkInterfaces() {
 
 		fmt.Printf("Interface: %s\n", iface.Name)
 		for _, addr := range addrs {
-			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-				if ipnet.IP.To4() != nil {
-					fmt.Printf("  IPv4: %s\n", ipnet.IP.String())
-
-					// Determine which subnet this IP is on
-					if ipnet.IP.String()[:10] == "192.168.1." {
-						fmt.Printf("  📍 This interface is on PAP2 subnet (192.168.1.0)!\n")
-					} else if ipnet.IP.String()[:10] == "192.168.5." {
-						fmt.Printf("  📶 This interface is on WiFi subnet (192.168.5.0)\n")
-					}
-				}
+			ipnet, ok := addr.(*net.IPNet)
+			switch {
+			case !ok || ipnet.IP.IsLoopback():
+			case ipnet.IP.To4() != nil:
+				fmt.Printf("  IPv4: %s\n", ipnet)
+			case !ipnet.IP.IsLinkLocalUnicast():
+				fmt.Printf("  IPv6: %s\n", ipnet)
 			}
 		}
 		fmt.Println()
 	}
 
-	fmt.Println("💡 For best results, use an IP address on the same subnet as your PAP2")
-	fmt.Println("   If you don't see a 192.168.1.x address, consider:")
+	fmt.Println("💡 Phones are answered on every interface, each given the address its")
+	fmt.Println("   requests arrive on. If your PAP2's subnet isn't listed, consider:")
 	fmt.Println("   1. Adding a USB-to-Ethernet adapter connected to PAP2's hub")
 	fmt.Println("   2. Using router configuration to bridge subnets")
 	fmt.Println("   3. Moving PAP2 to WiFi network")
 	fmt.Println()
 }
 
-// handleRegister processes SIP REGISTER requests
+// handleRegister processes SIP REGISTER requests: each Contact given is
+// bound to the address of record in To, refreshed, or with an expiry of 0
+// removed, and the response lists every binding the AOR has. A REGISTER
+// without a Contact just asks for that list.
 func (s *SIPServer) handleRegister(message string, remoteAddr *net.UDPAddr) {
 	fmt.Println("📞 Handling REGISTER request")
 
 	// Extract headers
 	headers := parseHeaders(message)
 	callID := headers["Call-ID"]
-	contact := headers["Contact"]
+	aor := contactUser(headers["To"])
+	ex := s.exchangeFor(message)
 
 	// Debug: Print all headers
-	fmt.Println("🔍 Received headers:")
-	for key, value := range headers {
-		fmt.Printf("  %s: %s\n", key, value)
+	if sipTrace.Load() {
+		fmt.Println("🔍 Received headers:")
+		for key, value := range headers {
+			fmt.Printf("  %s: %s\n", key, value)
+		}
 	}
 
-	// Store registration (simplified - no authentication for now)
-	s.registeredUA[callID] = &RegisteredUA{
-		Contact:    contact,
-		Expires:    time.Now().Add(3600 * time.Second), // 1 hour
-		CallID:     callID,
-		RemoteAddr: remoteAddr,
+	// Only users in the registrar's table may register, if it has any
+	if ex.auth != nil && !s.authorize(ex, "REGISTER", headers, aor, remoteAddr) {
+		return
+	}
+
+	bindings, refusal := parseBindings(message, headers, remoteAddr, ex.config.Registrar)
+	switch {
+	case refusal == "423 Interval Too Brief":
+		s.sendResponse(registerResponse(headers, refusal, fmt.Sprintf("Min-Expires: %d", ex.config.Registrar.MinExpires)), remoteAddr)
+		return
+	case refusal != "" || aor == "":
+		s.sendResponse(registerResponse(headers, "400 Bad Request"), remoteAddr)
+		return
 	}
 
-	fmt.Printf("✅ Registered UA: %s\n", contact)
+	// Store registrations; an expiry of 0 removes them, as a phone does
+	// before it reboots
+	transport := s.transportFor(remoteAddr)
+	cseq := cseqNumber(headers["CSeq"])
+	for _, ua := range bindings {
+		if ua.Expires.IsZero() {
+			contact := ua.Contact // "*" for every binding
+			if contact != "*" {
+				contact = ua.contactURI()
+			}
+			for _, old := range ex.registrar.Unregister(aor, contact, callID, cseq) {
+				fmt.Printf("👋 Unregistered UA: %s as %s (exchange %s)\n", old.Contact, aor, ex.name)
+			}
+			continue
+		}
+
+		ua.AOR, ua.CallID, ua.CSeq, ua.Transport = aor, callID, cseq, transport
+		evicted, err := ex.registrar.Register(&ua)
+		for _, old := range evicted {
+			fmt.Printf("🗑️  Evicted expired registration: %s for %s\n", old.Contact, old.AOR)
+		}
+		switch {
+		case errors.Is(err, errStaleRegister):
+			continue // Overtaken by a later REGISTER
+		case err != nil:
+			log.Printf("❌ Rejecting registration from %s: %v", ua.Contact, err)
+			s.sendResponse(registerResponse(headers, "503 Service Unavailable", "Retry-After: 300"), remoteAddr)
+			return
+		}
+		fmt.Printf("✅ Registered UA: %s as %s over %s (exchange %s)\n", ua.Contact, aor, transport, ex.name)
+	}
 
 	// Send 200 OK response with proper To header handling
 	toHeader := headers["To"]
-	if toHeader != "" && !strings.Contains(toHeader, "tag=") {
-		toHeader = toHeader + ";tag=12345"
-	} else if toHeader == "" {
-		toHeader = headers["From"] + ";tag=12345"
+	if toHeader == "" {
+		toHeader = headers["From"]
 	}
+	toHeader = withTag(toHeader)
 
+	var contacts strings.Builder
+	for _, ua := range ex.registrar.Lookup(aor) {
+		fmt.Fprintf(&contacts, "Contact: <%s>;expires=%d;q=%s\r\n", ua.contactURI(),
+			max(int(time.Until(ua.Expires).Round(time.Second).Seconds()), 1), strconv.FormatFloat(ua.Q, 'f', -1, 64))
+	}
 	response := fmt.Sprintf("SIP/2.0 200 OK\r\n"+
 		"Via: %s\r\n"+
 		"From: %s\r\n"+
 		"To: %s\r\n"+
 		"Call-ID: %s\r\n"+
 		"CSeq: %s\r\n"+
-		"Contact: %s\r\n"+
-		"Expires: 3600\r\n"+
-		"Server: Travel-by-Telephone/1.0\r\n"+
+		"%s"+
 		"Content-Length: 0\r\n"+
-		"\r\n", headers["Via"], headers["From"], toHeader, callID, headers["CSeq"], contact)
+		"\r\n", headers["Via"], headers["From"], toHeader, callID, headers["CSeq"], contacts.String())
 
 	s.sendResponse(response, remoteAddr)
 }
 
+// registerResponse builds a final response refusing a REGISTER, SUBSCRIBE,
+// MESSAGE or a method the server doesn't implement, with any extra header
+// lines given
+func registerResponse(headers map[string]string, status string, extra ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "SIP/2.0 %s\r\n"+
+		"Via: %s\r\n"+
+		"From: %s\r\n"+
+		"To: %s\r\n"+
+		"Call-ID: %s\r\n"+
+		"CSeq: %s\r\n", status, headers["Via"], headers["From"], withTag(headers["To"]), headers["Call-ID"], headers["CSeq"])
+	for _, header := range extra {
+		b.WriteString(header + "\r\n")
+	}
+	b.WriteString("Content-Length: 0\r\n" +
+		"\r\n")
+	return b.String()
+}
+
 // handleOptions processes SIP OPTIONS requests (keep-alive)
 func (s *SIPServer) handleOptions(message string, remoteAddr *net.UDPAddr) {
 	fmt.Println("🔄 Handling OPTIONS request")
@@ -395,386 +769,541 @@ func (s *SIPServer) handleOptions(message string, remoteAddr *net.UDPAddr) {
 	response := fmt.Sprintf("SIP/2.0 200 OK\r\n"+
 		"Via: %s\r\n"+
 		"From: %s\r\n"+
-		"To: %s;tag=12345\r\n"+
+		"To: %s\r\n"+
 		"Call-ID: %s\r\n"+
 		"CSeq: %s\r\n"+
-		"Allow: INVITE, ACK, BYE, CANCEL, OPTIONS, REGISTER\r\n"+
+		"Allow-Events: "+MWI_EVENT+"\r\n"+
 		"Content-Length: 0\r\n"+
-		"\r\n", headers["Via"], headers["From"], headers["To"], headers["Call-ID"], headers["CSeq"])
+		"\r\n", headers["Via"], headers["From"], withTag(headers["To"]), headers["Call-ID"], headers["CSeq"])
 
 	s.sendResponse(response, remoteAddr)
 }
 
 // handleInvite processes SIP INVITE requests (incoming calls)
 func (s *SIPServer) handleInvite(message string, remoteAddr *net.UDPAddr) {
-	fmt.Println("📞 Handling INVITE request - Phone going off-hook!")
-
 	headers := parseHeaders(message)
 	callID := headers["Call-ID"]
 
-	// Parse SDP from the INVITE to get remote RTP address
-	remoteRTPAddr := parseSDPForRTP(message, remoteAddr.IP)
-
-	// Create SDP response offering audio
-	localIP := getLocalIP()
-	sdpResponse := fmt.Sprintf("v=0\r\n"+
-		"o=- 123456 654321 IN IP4 %s\r\n"+
-		"s=Travel by Telephone\r\n"+
-		"c=IN IP4 %s\r\n"+
-		"t=0 0\r\n"+
-		"m=audio %d RTP/AVP 0 101\r\n"+
-		"a=rtpmap:0 PCMU/8000\r\n"+
-		"a=rtpmap:101 telephone-event/8000\r\n"+
-		"a=fmtp:101 0-15\r\n"+
-		"a=sendrecv\r\n", localIP, localIP, s.rtpPort)
-
-	// Send 200 OK with SDP
-	response := fmt.Sprintf("SIP/2.0 200 OK\r\n"+
-		"Via: %s\r\n"+
-		"From: %s\r\n"+
-		"To: %s;tag=54321\r\n"+
-		"Call-ID: %s\r\n"+
-		"CSeq: %s\r\n"+
-		"Contact: <sip:server@%s:%d>\r\n"+
-		"Content-Type: application/sdp\r\n"+
-		"Content-Length: %d\r\n"+
-		"\r\n%s", headers["Via"], headers["From"], headers["To"], callID, headers["CSeq"],
-		localIP, SIP_PORT, len(sdpResponse), sdpResponse)
-
-	s.sendResponse(response, remoteAddr)
-
-	// Start dial tone and DTMF detection
-	go s.startCallSession(callID, remoteAddr, remoteRTPAddr)
-}
-
-// handleAck processes SIP ACK requests
-func (s *SIPServer) handleAck(message string, remoteAddr *net.UDPAddr) {
-	fmt.Println("✅ Handling ACK request - Call established!")
-}
-
-// handleBye processes SIP BYE requests (call termination)
-func (s *SIPServer) handleBye(message string, remoteAddr *net.UDPAddr) {
-	fmt.Println("📴 Handling BYE request - Call terminated")
-
-	headers := parseHeaders(message)
+	// A To tag means the phone is changing a call it already has
+	if headerTag(headers["To"]) != "" {
+		s.handleReInvite(message, remoteAddr)
+		return
+	}
 
-	response := fmt.Sprintf("SIP/2.0 200 OK\r\n"+
-		"Via: %s\r\n"+
-		"From: %s\r\n"+
-		"To: %s;tag=54321\r\n"+
-		"Call-ID: %s\r\n"+
-		"CSeq: %s\r\n"+
-		"Content-Length: 0\r\n"+
-		"\r\n", headers["Via"], headers["From"], headers["To"], headers["Call-ID"], headers["CSeq"])
+	// The same INVITE again means our answer was lost. Another one for the
+	// call is out of order unless the first was refused, as a phone tries
+	// again after a 422.
+	if d := s.findDialog(callID, "", headerTag(headers["From"])); d != nil {
+		isNew, retransmission := d.checkCSeq(cseqNumber(headers["CSeq"]))
+		if retransmission {
+			s.resendAnswer(d)
+			return
+		}
+		if !isNew || !d.refused() {
+			log.Printf("❌ Out of order INVITE for Call-ID %s (CSeq %s)", callID, headers["CSeq"])
+			s.sendResponse(registerResponse(headers, "500 Server Internal Error", "Retry-After: 1"), remoteAddr)
+			return
+		}
+	}
 
-	s.sendResponse(response, remoteAddr)
-}
+	// A server shutting down takes no new calls
+	s.callsMu.Lock()
+	draining := s.draining
+	s.callsMu.Unlock()
+	if draining {
+		s.sendResponse(registerResponse(headers, "503 Service Unavailable"), remoteAddr)
+		return
+	}
 
-// Helper functions for SIP message processing
+	fmt.Println("📞 Handling INVITE request - Phone going off-hook!")
 
-// parseHeaders extracts headers from a SIP message
-func parseHeaders(message string) map[string]string {
-	headers := make(map[string]string)
-	lines := splitLines(message)
+	// Calls from a trunk's provider come in to the default exchange
+	ex := s.exchangeFor(message)
+	trunk := s.trunkFrom(remoteAddr)
+	if trunk != nil {
+		ex = s.Exchanges()[0]
+	}
 
-	for _, line := range lines {
-		if line == "" {
-			break // End of headers
+	// The phone's SDP offer says where its media goes and in what formats,
+	// the codec, redundant audio if it can take it, and keys if it wants
+	// SRTP. A browser's media goes where ICE finds it, once the call is
+	// answered. Without an offer, our answer makes one, of plain RTP.
+	offer := messageSDP(message)
+	var remoteRTPAddr *net.UDPAddr
+	formats := offeredFormats(ex.config.QoS)
+	answerable, unkeyed, unconnectable := false, false, false
+	if offer != nil {
+		if audio := offer.audio(); audio != nil {
+			crypto, secure := negotiateCrypto(audio)
+			webrtc, connectable := negotiateWebRTC(offer, audio)
+			unkeyed, unconnectable = !secure, !connectable
+			if negotiated, ok := negotiateFormats(audio, formats.choices, ex.config.QoS.Redundancy); ok && secure && connectable {
+				answerable = true
+				formats = negotiated
+				if crypto != nil {
+					formats.crypto = newSDESCrypto(crypto)
+				}
+				formats.webrtc = webrtc
+				if webrtc == nil {
+					remoteRTPAddr = offer.rtpAddr(audio, remoteAddr.IP)
+				}
+			}
 		}
+	}
 
-		// Skip request line
-		if isRequest(line) || line[:3] == "SIP" {
-			continue
+	d := dialogFromRequest(message, remoteAddr)
+	s.addDialog(d)
+
+	// An offer without audio in one of our codecs, demanding SRTP in a
+	// suite we lack, or from a browser without what ICE and DTLS need,
+	// can't be answered (RFC 3264 section 6)
+	if (offer != nil || isSDP(headers)) && !answerable {
+		reason := "no audio offered in a codec we use"
+		switch {
+		case unkeyed:
+			reason = "SRTP offered only in crypto suites we lack"
+		case unconnectable:
+			reason = "WebRTC offered without ICE credentials or a DTLS fingerprint"
 		}
+		fmt.Printf("📵 Refusing call %s: %s\n", callID, reason)
+		s.refuseInvite(d, s.inviteResponse(headers, d, "488 Not Acceptable Here", ""))
+		return
+	}
+	if formats.crypto != nil {
+		fmt.Printf("🔒 Audio of call %s encrypted with SRTP (%s)\n", callID, formats.crypto.suite.name)
+	}
+	if formats.webrtc != nil {
+		fmt.Printf("🌐 Call %s is from a browser: media by ICE, keyed by DTLS\n", callID)
+	}
 
-		// Parse header
-		colonIndex := -1
-		for i, char := range line {
-			if char == ':' {
-				colonIndex = i
-				break
-			}
-		}
+	// A session interval too short to keep up with is refused (RFC 4028)
+	if !d.acceptSessionTimer(message) {
+		s.refuseInvite(d, s.inviteResponse(headers, d, "422 Session Interval Too Small", "", fmt.Sprintf("Min-SE: %d", MIN_SESSION_EXPIRES)))
+		return
+	}
 
-		if colonIndex > 0 {
-			key := line[:colonIndex]
-			value := ""
-			if colonIndex+1 < len(line) {
-				value = line[colonIndex+1:]
-				// Trim leading space
-				if len(value) > 0 && value[0] == ' ' {
-					value = value[1:]
-				}
-			}
-			headers[key] = value
+	// Let the phone know the INVITE arrived
+	s.sendProvisional(d, s.inviteResponse(headers, nil, "100 Trying", ""))
+
+	// A number the phone dialed itself is routed now, and refused if it
+	// can't go anywhere, rather than answered with dial tone
+	var dialed *resolution
+	if number := dialedNumber(message); number != "" && trunk == nil {
+		res, refusal := s.routeDialed(ex, contactUser(headers["From"]), number, remoteAddr)
+		if refusal != "" {
+			fmt.Printf("📵 Refusing call to %s: %s\n", res.number, refusal)
+			s.refuseInvite(d, s.inviteResponse(headers, d, refusal, ""))
+			return
 		}
+		fmt.Printf("🧭 Routing %s, dialed by the phone\n", res.number)
+		dialed = &res
 	}
 
-	return headers
-}
-
-// sendResponse sends a SIP response to the remote address
-func (s *SIPServer) sendResponse(response string, remoteAddr *net.UDPAddr) {
-	_, err := s.conn.WriteToUDP([]byte(response), remoteAddr)
+	// The call's media comes and goes by a port of its own
+	media, err := s.openMediaPort(callID)
 	if err != nil {
-		log.Printf("Error sending response: %v", err)
+		log.Printf("❌ Refusing call %s: %v", callID, err)
+		s.refuseInvite(d, s.inviteResponse(headers, d, "503 Service Unavailable", ""))
+		return
 	}
+	d.media = media
 
-	fmt.Printf("\n--- Sent SIP Response to %s ---\n", remoteAddr)
-	fmt.Print(response)
-	fmt.Println("--- End Response ---")
-}
+	// Ring if asked to
+	if !s.ringBeforeAnswer(ex.config.Answer, ex.config.progressTone(progressRingback), headers, d, offer, remoteRTPAddr, formats) || !d.establish() {
+		fmt.Printf("🚫 Call %s cancelled before it was answered\n", callID)
+		s.refuseInvite(d, s.inviteResponse(headers, d, "487 Request Terminated", ""))
+		return
+	}
 
-// getLocalIP gets the local IP address
-func getLocalIP() string {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		return "127.0.0.1"
+	// Start dial tone and DTMF detection, unless the call is for us to put
+	// through
+	var session *CallSession
+	if trunk != nil || dialed != nil {
+		session = s.newCallSession(ex, callID, remoteAddr, remoteRTPAddr)
+		session.dialog = d
+		session.setFormats(formats)
+		session.routed = true
+		s.addCallSession(session)
+	} else {
+		session = s.startCallSession(ex, callID, remoteAddr, remoteRTPAddr, d, formats)
 	}
-	defer conn.Close()
 
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP.String()
+	// Answer with audio, unless the phone starts on hold
+	direction := answerDirection(parseSDPDirection(message))
+	session.held.Store(direction == SDP_RECVONLY || direction == SDP_INACTIVE)
+	s.answerInvite(session, d, s.inviteAnswer(headers, d, offer, formats, direction))
+	s.spawn(func() { s.watchSessionTimer(session) })
+	switch {
+	case trunk != nil:
+		s.spawn(func() { s.putThroughTrunkCall(session, trunk) })
+	case dialed != nil:
+		s.spawn(func() {
+			s.playDestination(session, *dialed)
+			s.hangupCall(session)
+		})
+	}
 }
 
-// parseSDPForRTP extracts the RTP address and port from SDP content
-func parseSDPForRTP(message string, defaultIP net.IP) *net.UDPAddr {
-	lines := splitLines(message)
-	inSDP := false
-	var connectionIP net.IP
-	var mediaPort int
+// inviteAnswer is our 200 OK to an INVITE, or an UPDATE offering SDP,
+// with the call's session timer and SDP: the answer to the request's
+// offer, or if it made none our own offer
+func (s *SIPServer) inviteAnswer(headers map[string]string, d *dialog, offer *sessionDescription, formats audioFormats, direction string) string {
+	sdpResponse := s.localSDP(formats, direction, d)
+	if offer != nil {
+		sdpResponse = s.answerSDP(offer, formats, direction, d)
+	}
 
-	for _, line := range lines {
-		if line == "" {
-			inSDP = true
-			continue
-		}
+	var recordRoute strings.Builder
+	d.mu.Lock()
+	for _, route := range d.routeSet {
+		fmt.Fprintf(&recordRoute, "Record-Route: %s\r\n", route)
+	}
+	to := d.from // Our side, with our tag
+	d.mu.Unlock()
 
-		if !inSDP {
-			continue
-		}
+	var timer strings.Builder
+	for _, header := range d.sessionTimerHeaders() {
+		timer.WriteString(header + "\r\n")
+	}
 
-		// Parse connection information: c=IN IP4 <address>
-		if len(line) > 2 && line[:2] == "c=" {
-			parts := []string{}
-			current := ""
-			for _, char := range line {
-				if char == ' ' {
-					if current != "" {
-						parts = append(parts, current)
-						current = ""
-					}
-				} else {
-					current += string(char)
-				}
-			}
-			if current != "" {
-				parts = append(parts, current)
-			}
+	return fmt.Sprintf("SIP/2.0 200 OK\r\n"+
+		"Via: %s\r\n"+
+		"%s"+
+		"From: %s\r\n"+
+		"To: %s\r\n"+
+		"Call-ID: %s\r\n"+
+		"CSeq: %s\r\n"+
+		"Contact: <%s>\r\n"+
+		"%s"+
+		"Content-Type: application/sdp\r\n"+
+		"Content-Length: %d\r\n"+
+		"\r\n%s", headers["Via"], recordRoute.String(), headers["From"], to, headers["Call-ID"], headers["CSeq"],
+		s.contactURI(d.remoteAddr), timer.String(), len(sdpResponse), sdpResponse)
+}
 
-			if len(parts) >= 3 && parts[1] == "IP4" {
-				ip := net.ParseIP(parts[2])
-				if ip != nil {
-					connectionIP = ip
-				}
-			}
-		}
+// handleReInvite answers an INVITE within a call, such as a session
+// refresh, the phone moving its media, or the phone putting the call on
+// hold or taking it off again, as a PAP2 does on a hook flash.
+func (s *SIPServer) handleReInvite(message string, remoteAddr *net.UDPAddr) {
+	headers := parseHeaders(message)
+	callID := headers["Call-ID"]
 
-		// Parse media information: m=audio <port> RTP/AVP ...
-		if len(line) > 2 && line[:2] == "m=" {
-			parts := []string{}
-			current := ""
-			for _, char := range line {
-				if char == ' ' {
-					if current != "" {
-						parts = append(parts, current)
-						current = ""
-					}
-				} else {
-					current += string(char)
-				}
-			}
-			if current != "" {
-				parts = append(parts, current)
-			}
+	d := s.findDialog(callID, headerTag(headers["To"]), headerTag(headers["From"]))
+	s.callsMu.Lock()
+	session := s.calls[callID]
+	s.callsMu.Unlock()
+	if d == nil || session == nil || session.dialog != d || d.State() == dialogTerminating {
+		s.sendResponse(dialogResponse(headers, "481 Call/Transaction Does Not Exist"), remoteAddr)
+		return
+	}
 
-			if len(parts) >= 3 && parts[0] == "m=audio" {
-				// Parse port number
-				port := 0
-				for _, char := range parts[1] {
-					if char >= '0' && char <= '9' {
-						port = port*10 + int(char-'0')
-					} else {
-						break
-					}
-				}
-				if port > 0 {
-					mediaPort = port
-				}
-			}
-		}
+	isNew, retransmission := d.checkCSeq(cseqNumber(headers["CSeq"]))
+	if retransmission {
+		s.resendAnswer(d)
+		return
+	}
+	if !isNew {
+		s.sendResponse(dialogResponse(headers, "500 Server Internal Error"), remoteAddr)
+		return
 	}
 
-	// Use connection IP if found, otherwise use default
-	if connectionIP == nil {
-		connectionIP = defaultIP
+	if !d.acceptSessionTimer(message) {
+		s.sendResponse(dialogResponse(headers, "422 Session Interval Too Small", fmt.Sprintf("Min-SE: %d", MIN_SESSION_EXPIRES)), remoteAddr)
+		return
 	}
 
-	if mediaPort > 0 {
-		return &net.UDPAddr{
-			IP:   connectionIP,
-			Port: mediaPort,
-		}
+	offer := messageSDP(message)
+	if (offer != nil || isSDP(headers)) && (offer == nil || !session.formats.accepts(offer)) {
+		s.sendResponse(dialogResponse(headers, "488 Not Acceptable Here"), remoteAddr)
+		return
 	}
 
-	return nil
+	fmt.Printf("🔁 Re-INVITE for Call-ID: %s\n", callID)
+	if contact := headers["Contact"]; contact != "" {
+		d.mu.Lock()
+		d.requestURI = uriFromHeader(contact, remoteAddr)
+		d.mu.Unlock()
+	}
+	if offer != nil {
+		session.renegotiate(offer)
+	}
+	direction := s.updateMedia(session, message, remoteAddr)
+	s.answerInvite(session, d, s.inviteAnswer(headers, d, offer, session.formats, direction))
 }
 
-// startCallSession starts a call session with dial tone and DTMF detection
-func (s *SIPServer) startCallSession(callID string, remoteAddr *net.UDPAddr, remoteRTPAddr *net.UDPAddr) {
-	fmt.Printf("🎵 Starting call session for Call-ID: %s\n", callID)
+// handleUpdate answers an UPDATE within a call (RFC 3311), which phones
+// send to refresh the session timer without a re-INVITE's offer and
+// answer. One that does carry an SDP offer changes the media like a
+// re-INVITE.
+func (s *SIPServer) handleUpdate(message string, remoteAddr *net.UDPAddr) {
+	headers := parseHeaders(message)
+	callID := headers["Call-ID"]
 
-	if remoteRTPAddr != nil {
-		fmt.Printf("🎯 Remote RTP address: %s\n", remoteRTPAddr)
+	d := s.findDialog(callID, headerTag(headers["To"]), headerTag(headers["From"]))
+	s.callsMu.Lock()
+	session := s.calls[callID]
+	s.callsMu.Unlock()
+	if d == nil || session == nil || session.dialog != d || d.State() == dialogTerminating {
+		s.sendResponse(dialogResponse(headers, "481 Call/Transaction Does Not Exist"), remoteAddr)
+		return
 	}
-
-	session := &CallSession{
-		CallID:         callID,
-		RemoteAddr:     remoteAddr,
-		RemoteRTPAddr:  remoteRTPAddr,
-		DialToneActive: true,
+	if isNew, retransmission := d.checkCSeq(cseqNumber(headers["CSeq"])); !isNew && !retransmission {
+		s.sendResponse(dialogResponse(headers, "500 Server Internal Error"), remoteAddr)
+		return
+	}
+	if !d.acceptSessionTimer(message) {
+		s.sendResponse(dialogResponse(headers, "422 Session Interval Too Small", fmt.Sprintf("Min-SE: %d", MIN_SESSION_EXPIRES)), remoteAddr)
+		return
 	}
 
-	// Start dial tone generation
-	go s.generateDialTone(session)
-
-	// Start DTMF detection
-	go s.detectDTMF(session)
+	if isSDP(headers) {
+		offer := messageSDP(message)
+		if offer == nil || !session.formats.accepts(offer) {
+			s.sendResponse(dialogResponse(headers, "488 Not Acceptable Here"), remoteAddr)
+			return
+		}
+		session.renegotiate(offer)
+		direction := s.updateMedia(session, message, remoteAddr)
+		s.sendResponse(s.inviteAnswer(headers, d, offer, session.formats, direction), remoteAddr)
+		return
+	}
+	s.sendResponse(dialogResponse(headers, "200 OK", d.sessionTimerHeaders()...), remoteAddr)
 }
 
-// generateDialTone generates and streams dial tone audio
-func (s *SIPServer) generateDialTone(session *CallSession) {
-	fmt.Println("🎵 Starting dial tone generation...")
-
-	// Generate dial tone samples (350Hz + 440Hz)
-	samples := make([]int16, FRAME_SIZE)
-	sampleIndex := 0
-
-	// RTP packet structure
-	rtpHeader := make([]byte, 12)
-	rtpHeader[0] = 0x80 // Version 2, no padding, no extension, no CSRC
-	rtpHeader[1] = 0x00 // Payload type 0 (PCMU)
-
-	sequenceNumber := uint16(0)
-	timestamp := uint32(0)
-	ssrc := uint32(0x12345678)
-
-	ticker := time.NewTicker(20 * time.Millisecond) // 20ms frames
-	defer ticker.Stop()
+// resendAnswer sends our last answer to the dialog's INVITE again
+func (s *SIPServer) resendAnswer(d *dialog) {
+	d.mu.Lock()
+	answer := d.answer
+	d.mu.Unlock()
+	if answer != "" {
+		s.sendResponse(answer, d.remoteAddr)
+	}
+}
 
-	for session.DialToneActive {
-		select {
-		case <-ticker.C:
-			// Generate audio samples for this frame
-			for i := 0; i < FRAME_SIZE; i++ {
-				t := float64(sampleIndex) / SAMPLE_RATE
+// dialogResponse builds a response with no body to a request within a
+// dialog, whose To already carries our tag, with any extra header lines
+// given
+func dialogResponse(headers map[string]string, status string, extra ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "SIP/2.0 %s\r\n"+
+		"Via: %s\r\n"+
+		"From: %s\r\n"+
+		"To: %s\r\n"+
+		"Call-ID: %s\r\n"+
+		"CSeq: %s\r\n", status, headers["Via"], headers["From"], headers["To"], headers["Call-ID"], headers["CSeq"])
+	for _, header := range extra {
+		b.WriteString(header + "\r\n")
+	}
+	b.WriteString("Content-Length: 0\r\n" +
+		"\r\n")
+	return b.String()
+}
 
-				// Generate dual-tone (350Hz + 440Hz)
-				sample1 := 0.5 * math.Sin(2*math.Pi*DIAL_TONE_FREQ1*t)
-				sample2 := 0.5 * math.Sin(2*math.Pi*DIAL_TONE_FREQ2*t)
-				combined := sample1 + sample2
+// handleAck processes SIP ACK requests, which confirm our answer to an
+// INVITE. ACKs for refusals belong to their transaction and are dropped.
+func (s *SIPServer) handleAck(message string, remoteAddr *net.UDPAddr) {
+	headers := parseHeaders(message)
+	d := s.findDialog(headers["Call-ID"], headerTag(headers["To"]), headerTag(headers["From"]))
+	if d == nil {
+		return
+	}
 
-				// Convert to 16-bit PCM
-				samples[i] = int16(combined * 16383) // Scale to 14-bit for μ-law
-				sampleIndex++
-			}
+	d.mu.Lock()
+	first := !d.acked && d.state == dialogEstablished // Not the ACK of a refusal
+	d.acked = true
+	d.mu.Unlock()
+	if first {
+		fmt.Println("✅ Handling ACK request - Call established!")
+	}
+}
 
-			// Convert to μ-law
-			ulawData := make([]byte, FRAME_SIZE)
-			for i, sample := range samples {
-				ulawData[i] = linearToUlaw(sample)
-			}
+// handleBye processes SIP BYE requests (call termination)
+func (s *SIPServer) handleBye(message string, remoteAddr *net.UDPAddr) {
+	headers := parseHeaders(message)
+	d := s.findDialog(headers["Call-ID"], headerTag(headers["To"]), headerTag(headers["From"]))
+	if d == nil {
+		s.sendResponse(dialogResponse(headers, "481 Call/Transaction Does Not Exist"), remoteAddr)
+		return
+	}
+	if isNew, retransmission := d.checkCSeq(cseqNumber(headers["CSeq"])); !isNew && !retransmission {
+		s.sendResponse(dialogResponse(headers, "500 Server Internal Error"), remoteAddr)
+		return
+	}
 
-			// Build RTP packet
-			binary.BigEndian.PutUint16(rtpHeader[2:4], sequenceNumber)
-			binary.BigEndian.PutUint32(rtpHeader[4:8], timestamp)
-			binary.BigEndian.PutUint32(rtpHeader[8:12], ssrc)
+	fmt.Println("📴 Handling BYE request - Call terminated")
+	d.setState(dialogTerminating)
+	s.endCallSession(headers["Call-ID"])
+	s.sendResponse(dialogResponse(headers, "200 OK"), remoteAddr)
+}
 
-			// Combine header and payload
-			rtpPacket := append(rtpHeader, ulawData...)
+// Helper functions for SIP message processing
 
-			// Send RTP packet to remote address if available
-			if session.RemoteRTPAddr != nil {
-				_, err := s.rtpConn.WriteToUDP(rtpPacket, session.RemoteRTPAddr)
-				if err != nil {
-					log.Printf("Error sending RTP packet: %v", err)
-				}
+// parseHeaders extracts headers from a SIP message, by name with compact
+// forms expanded (see canonicalHeader). A header given on several lines,
+// such as Via, has its values joined in order with commas, as if sent on
+// one line (RFC 3261 section 7.3.1); headerValues splits them again.
+func parseHeaders(message string) map[string]string {
+	headers := make(map[string]string)
+	for _, field := range readHeaders(message) {
+		if previous, ok := headers[field.Name]; ok {
+			if uncombinableHeaders[field.Name] {
+				continue // The first challenge or credentials are used
 			}
+			field.Value = previous + ", " + field.Value
+		}
+		headers[field.Name] = field.Value
+	}
+	return headers
+}
 
-			sequenceNumber++
-			timestamp += FRAME_SIZE
+// stampVia records where a request really came from in its top Via, so
+// responses copying it name the phone's address as NAT left it: received=
+// if the Via's host isn't the source address, or if the phone asked with
+// rport, which is then given the source port too (RFC 3261 section
+// 18.2.1, RFC 3581). Responses go to the source address whatever the Via
+// says.
+func stampVia(message string, remoteAddr *net.UDPAddr) string {
+	lines := strings.Split(message, "\n")
+	for i := 1; i < len(lines); i++ {
+		line, cr := strings.CutSuffix(lines[i], "\r")
+		if line == "" {
+			break
+		}
+		name, value, found := strings.Cut(line, ":")
+		if name = strings.TrimSpace(name); !found || canonicalHeader(name) != "Via" {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		via, _, _ := strings.Cut(value, ",") // Only the top one
+		lines[i] = name + ": " + stampedVia(via, remoteAddr) + strings.TrimPrefix(value, via)
+		if cr {
+			lines[i] += "\r"
+		}
+		return strings.Join(lines, "\n")
+	}
+	return message
+}
 
+// stampedVia is one Via value with received= and rport= filled in for the
+// address it arrived from
+func stampedVia(via string, remoteAddr *net.UDPAddr) string {
+	sentBy, params, _ := strings.Cut(via, ";")
+	host := sentBy
+	if fields := strings.Fields(sentBy); len(fields) == 2 {
+		host = fields[1]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+
+	var kept []string
+	rport := false
+	for _, param := range strings.Split(params, ";") {
+		key, _, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch {
+		case param == "":
+		case strings.EqualFold(key, "rport"):
+			rport = true
+		case strings.EqualFold(key, "received"):
 		default:
-			// Non-blocking check
+			kept = append(kept, param)
 		}
 	}
-
-	fmt.Println("🔇 Dial tone stopped")
+	source := net.ParseIP(host)
+	if rport || source == nil || !source.Equal(remoteAddr.IP) {
+		kept = append(kept, "received="+remoteAddr.IP.String())
+	}
+	if rport {
+		kept = append(kept, "rport="+strconv.Itoa(remoteAddr.Port))
+	}
+	if len(kept) == 0 {
+		return sentBy
+	}
+	return sentBy + ";" + strings.Join(kept, ";")
 }
 
-// detectDTMF listens for DTMF events on the RTP stream
-func (s *SIPServer) detectDTMF(session *CallSession) {
-	fmt.Println("🎯 Starting DTMF detection...")
-
-	buffer := make([]byte, 1500) // Max UDP packet size
-
-	for {
-		// Set read timeout
-		s.rtpConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+// sendResponse sends a SIP message of ours to the remote address, over its
+// TCP connection if it has one, with the headers describing the server
+func (s *SIPServer) sendResponse(response string, remoteAddr *net.UDPAddr) {
+	s.send(s.withOwnHeaders(response), remoteAddr)
+}
 
-		n, remoteAddr, err := s.rtpConn.ReadFromUDP(buffer)
-		if err != nil {
-			// Check if it's a timeout
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				continue
-			}
-			log.Printf("Error reading RTP packet: %v", err)
-			continue
+// send sends a SIP message to the remote address as it is, over its TCP
+// connection if it has one
+func (s *SIPServer) send(response string, remoteAddr *net.UDPAddr) {
+	if stream := s.streamFor(remoteAddr); stream != nil {
+		if err := stream.write(response); err != nil {
+			log.Printf("Error sending response: %v", err)
 		}
-
-		if n < 12 {
-			continue // Too small to be valid RTP
+		captureStream(stream, response, true)
+	} else if conn := s.connFor(remoteAddr); conn == nil {
+		log.Printf("Error sending response: no SIP socket")
+		return
+	} else {
+		if _, err := conn.WriteToUDP([]byte(response), remoteAddr); err != nil {
+			log.Printf("Error sending response: %v", err)
 		}
+		captureDatagram(conn, remoteAddr.AddrPort(), []byte(response), true)
+	}
 
-		// Parse RTP header
-		payloadType := buffer[1] & 0x7F
-
-		// Check if this is a DTMF event (payload type 101)
-		if payloadType == 101 {
-			if n >= 16 { // RTP header (12) + DTMF event (4)
-				event := buffer[12]
-				//volume := buffer[13]
-				//duration := binary.BigEndian.Uint16(buffer[14:16])
+	if sipTrace.Load() {
+		fmt.Printf("\n--- Sent SIP Response to %s ---\n", remoteAddr)
+		fmt.Print(response)
+		fmt.Println("--- End Response ---")
+	}
+}
 
-				digit := dtmfEventToDigit(event)
-				if digit != "" {
-					fmt.Printf("🔢 DTMF Detected: %s (from %s)\n", digit, remoteAddr)
+// advertisedIP is the server's address when no particular phone is asking
+// (see localIPFor): the bind address if one was given, the bind
+// interface's address if it has one, otherwise the outbound interface
+func (s *SIPServer) advertisedIP() string {
+	if s.config.BindIP != "" {
+		return s.config.BindIP
+	}
+	if s.config.BindInterface != "" {
+		if ip := interfaceIP(s.config.BindInterface); ip != "" {
+			return ip
+		}
+	}
+	return getLocalIP()
+}
 
-					// Stop dial tone on first digit
-					if session.DialToneActive {
-						session.DialToneActive = false
-						fmt.Println("🔇 Stopping dial tone - digit detected")
-					}
-				}
-			}
+// getLocalIP gets the local IP address: the one the default route leaves
+// from, over IPv6 if there is no IPv4 route. Nothing is sent.
+func getLocalIP() string {
+	for _, probe := range []string{"8.8.8.8:80", "[2001:4860:4860::8888]:80"} {
+		conn, err := net.Dial("udp", probe)
+		if err != nil {
+			continue
 		}
+		localAddr := conn.LocalAddr().(*net.UDPAddr)
+		conn.Close()
+		return localAddr.IP.String()
 	}
+	return "127.0.0.1"
 }
 
 // Audio codec helper functions
 
+// ulawEncodeTable maps every 16-bit sample, indexed as uint16, to its
+// μ-law byte. At 64KB it replaces a bit-scanning loop per sample on the
+// hot path of every outgoing stream.
+var ulawEncodeTable = func() (table [65536]byte) {
+	for i := range table {
+		table[i] = encodeUlaw(int16(i))
+	}
+	return table
+}()
+
 // linearToUlaw converts 16-bit linear PCM to μ-law
 func linearToUlaw(sample int16) byte {
+	return ulawEncodeTable[uint16(sample)]
+}
+
+// encodeUlaw computes the μ-law encoding of a sample; it is used to build
+// ulawEncodeTable
+func encodeUlaw(sample int16) byte {
 	// μ-law compression algorithm
 	const BIAS = 0x84
 	const CLIP = 32635
@@ -782,34 +1311,114 @@ func linearToUlaw(sample int16) byte {
 	var sign, expt, mantissa byte
 	var ulawbyte byte
 
-	// Get the sample into sign-magnitude
-	if sample < 0 {
-		sample = -sample
+	// Get the sample into sign-magnitude; widen first so -32768 doesn't
+	// overflow
+	magnitude := int32(sample)
+	if magnitude < 0 {
+		magnitude = -magnitude
 		sign = 0x80
 	} else {
 		sign = 0
 	}
 
 	// Clip the magnitude
-	if sample > CLIP {
-		sample = CLIP
+	if magnitude > CLIP {
+		magnitude = CLIP
 	}
 
 	// Convert from 16 bit linear to μ-law
-	sample = sample + BIAS
+	magnitude = magnitude + BIAS
 	expt = 7
-	for i := int16(0x4000); i != 0; i >>= 1 {
-		if sample&i != 0 {
+	for i := int32(0x4000); i != 0; i >>= 1 {
+		if magnitude&i != 0 {
 			break
 		}
 		expt--
 	}
-	mantissa = byte((sample >> (expt + 3)) & 0x0F)
+	mantissa = byte((magnitude >> (expt + 3)) & 0x0F)
 	ulawbyte = ^(sign | (expt << 4) | mantissa)
 
 	return ulawbyte
 }
 
+// ulawToLinear converts μ-law to 16-bit linear PCM
+func ulawToLinear(ulawbyte byte) int16 {
+	const BIAS = 0x84
+
+	ulawbyte = ^ulawbyte
+	sign := ulawbyte & 0x80
+	expt := (ulawbyte >> 4) & 0x07
+	mantissa := ulawbyte & 0x0F
+
+	sample := ((int16(mantissa) << 3) + BIAS) << expt
+	sample -= BIAS
+	if sign != 0 {
+		return -sample
+	}
+	return sample
+}
+
+// alawToLinear converts A-law to 16-bit linear PCM
+func alawToLinear(alawbyte byte) int16 {
+	alawbyte ^= 0x55
+	sign := alawbyte & 0x80
+	expt := (alawbyte >> 4) & 0x07
+	mantissa := int16(alawbyte & 0x0F)
+
+	var sample int16
+	if expt == 0 {
+		sample = mantissa<<4 + 8
+	} else {
+		sample = (mantissa<<4 + 0x108) << (expt - 1)
+	}
+	if sign == 0 {
+		return -sample
+	}
+	return sample
+}
+
+// alawEncodeTable maps every 16-bit sample to its A-law byte, as
+// ulawEncodeTable does for μ-law
+var alawEncodeTable = func() (table [65536]byte) {
+	for i := range table {
+		table[i] = encodeAlaw(int16(i))
+	}
+	return table
+}()
+
+// linearToAlaw converts 16-bit linear PCM to A-law
+func linearToAlaw(sample int16) byte {
+	return alawEncodeTable[uint16(sample)]
+}
+
+// encodeAlaw computes the A-law encoding of a sample; it is used to build
+// alawEncodeTable
+func encodeAlaw(sample int16) byte {
+	// A-law works on 13 bits; the sign bit is set for positive samples
+	magnitude := int32(sample) >> 3
+	mask := byte(0xD5)
+	if magnitude < 0 {
+		magnitude = -magnitude - 1
+		mask = 0x55
+	}
+
+	// The segment is how far the magnitude reaches past five bits
+	var expt byte
+	for expt < 8 && magnitude > 0x20<<expt-1 {
+		expt++
+	}
+	if expt == 8 {
+		return 0x7F ^ mask // Clipped
+	}
+	var mantissa byte
+	if expt < 2 {
+		mantissa = byte(magnitude>>1) & 0x0F
+	} else {
+		mantissa = byte(magnitude>>expt) & 0x0F
+	}
+	return (expt<<4 | mantissa) ^ mask
+}
+
 // dtmfEventToDigit converts DTMF event code to digit string
 func dtmfEventToDigit(event byte) string {
 	switch event {
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestAlaw(t *testing.T) {
+	// G.711's A-law, as its reference code has it: even bits inverted, the
+	// sign bit set for positive samples
+	for _, test := range []struct {
+		sample  int16
+		encoded byte
+		decoded int16
+	}{
+		{0, 0xD5, 8},
+		{1, 0xD5, 8},
+		{-1, 0x55, -8},
+		{31, 0xD4, 24},
+		{-31, 0x54, -24},
+		{255, 0xDA, 248}, // The top of segment 0
+		{256, 0xC5, 264}, // and the bottom of segment 1
+		{511, 0xCA, 504},
+		{512, 0xF5, 528}, // Segment 2, where steps start doubling
+		{32767, 0xAA, 32256},
+		{-32768, 0x2A, -32256},
+	} {
+		if got := linearToAlaw(test.sample); got != test.encoded {
+			t.Errorf("linearToAlaw(%d) = %#02x, want %#02x", test.sample, got, test.encoded)
+		}
+		if got := alawToLinear(test.encoded); got != test.decoded {
+			t.Errorf("alawToLinear(%#02x) = %d, want %d", test.encoded, got, test.decoded)
+		}
+	}
+
+	// Every sample comes back within half a step of its segment: 16 in the
+	// first two, doubling in each after
+	for i := -32768; i <= 32767; i++ {
+		decoded := alawToLinear(linearToAlaw(int16(i)))
+		segment := int(linearToAlaw(int16(i))^0x55) >> 4 & 0x07
+		step := 16 << max(segment-1, 0)
+		if d := i - int(decoded); d > step/2 || d < -step/2 {
+			t.Fatalf("%d came back as %d, more than half a step of %d away", i, decoded, step)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// MediaSource produces 8kHz 16-bit linear audio one frame at a time. It is
+// what the media scheduler pulls from for every outgoing stream.
+type MediaSource interface {
+	// ReadFrame fills samples with the next frame of audio and reports
+	// false once the source is exhausted
+	ReadFrame(samples []int16) bool
+}
+
+// SeekableSource is a MediaSource whose playback position can be moved,
+// e.g. to skip back in an audiobook. Like ReadFrame, its methods are not
+// safe to call while the source is being played from another goroutine.
+type SeekableSource interface {
+	MediaSource
+	Position() time.Duration
+	Duration() time.Duration
+	Seek(pos time.Duration) // Clamped to the start and end
+}
+
+// TalkspurtSource is a MediaSource that says where new audio starts, such
+// as the next prompt of a sequence, where there may be no silence before
+// it to tell. The RTP packet carrying that frame has its marker bit set
+// (RFC 3551 section 4.1), as does the first after silence, so the phone
+// can reset its jitter buffer there.
+type TalkspurtSource interface {
+	MediaSource
+	// Talkspurt reports whether the frame last read began a talkspurt
+	Talkspurt() bool
+}
+
+// beginsTalkspurt reports whether the frame source last read began a
+// talkspurt, if it is a source that says
+func beginsTalkspurt(source MediaSource) bool {
+	t, ok := source.(TalkspurtSource)
+	return ok && t.Talkspurt()
+}
+
+// pcmSource plays a buffer of decoded samples, optionally looping
+type pcmSource struct {
+	samples []int16
+	wide    []int16 // The same audio at 16kHz, if there is any
+	pos     int
+	loop    bool
+}
+
+// newPCMSource creates a source over already decoded samples
+func newPCMSource(samples []int16, loop bool) *pcmSource {
+	return &pcmSource{samples: samples, loop: loop}
+}
+
+// newWidebandPCMSource creates a source over decoded samples that has
+// them at 16kHz as well, for wideband calls
+func newWidebandPCMSource(samples, wide []int16, loop bool) *pcmSource {
+	return &pcmSource{samples: samples, wide: wide, loop: loop}
+}
+
+// ReadFrame copies the next frame, padding the final one with silence
+func (p *pcmSource) ReadFrame(samples []int16) bool {
+	if len(p.samples) == 0 || (p.pos >= len(p.samples) && !p.loop) {
+		return false
+	}
+
+	for i := range samples {
+		if p.pos >= len(p.samples) {
+			if !p.loop {
+				clear(samples[i:])
+				break
+			}
+			p.pos = 0
+		}
+		samples[i] = p.samples[p.pos]
+		p.pos++
+	}
+	return true
+}
+
+// Wideband reports whether the source has 16kHz audio
+func (p *pcmSource) Wideband() bool {
+	return p.wide != nil
+}
+
+// ReadWideFrame copies the next frame at 16kHz, two samples for each
+// ReadFrame would give
+func (p *pcmSource) ReadWideFrame(samples []int16) bool {
+	if len(p.samples) == 0 || (p.pos >= len(p.samples) && !p.loop) {
+		return false
+	}
+
+	for i := 0; i+1 < len(samples); i += 2 {
+		if p.pos >= len(p.samples) {
+			if !p.loop {
+				clear(samples[i:])
+				break
+			}
+			p.pos = 0
+		}
+		if 2*p.pos+1 < len(p.wide) {
+			samples[i], samples[i+1] = p.wide[2*p.pos], p.wide[2*p.pos+1]
+		} else {
+			samples[i], samples[i+1] = 0, 0 // Rounding left the 16kHz audio a sample short
+		}
+		p.pos++
+	}
+	return true
+}
+
+// Position is how far playback has got
+func (p *pcmSource) Position() time.Duration {
+	return time.Duration(p.pos) * time.Second / SAMPLE_RATE
+}
+
+// Duration is the length of the audio
+func (p *pcmSource) Duration() time.Duration {
+	return time.Duration(len(p.samples)) * time.Second / SAMPLE_RATE
+}
+
+// Seek moves playback to pos
+func (p *pcmSource) Seek(pos time.Duration) {
+	p.pos = max(0, min(int(pos*SAMPLE_RATE/time.Second), len(p.samples)))
+}
+
+// sequenceSource plays several sources one after another, each beginning
+// a talkspurt
+type sequenceSource struct {
+	sources []MediaSource
+	began   bool
+}
+
+// newSequenceSource plays sources in order, e.g. an announcement and then
+// the content it introduces
+func newSequenceSource(sources ...MediaSource) *sequenceSource {
+	return &sequenceSource{sources: sources}
+}
+
+// ReadFrame reads from the current source, moving on when it is exhausted
+func (q *sequenceSource) ReadFrame(samples []int16) bool {
+	moved := false
+	for len(q.sources) > 0 {
+		if q.sources[0].ReadFrame(samples) {
+			q.began = moved || beginsTalkspurt(q.sources[0])
+			return true
+		}
+		q.sources = q.sources[1:]
+		moved = true
+	}
+	return false
+}
+
+// Talkspurt reports whether the last frame was the first of a source, or
+// began a talkspurt within one
+func (q *sequenceSource) Talkspurt() bool {
+	return q.began
+}
+
+// Wideband reports whether the current source can play at 16kHz
+func (q *sequenceSource) Wideband() bool {
+	if len(q.sources) == 0 {
+		return false
+	}
+	wide, ok := q.sources[0].(WidebandSource)
+	return ok && wide.Wideband()
+}
+
+// ReadWideFrame reads from the current source at 16kHz, moving on when it
+// is exhausted. A next source that can't play at 16kHz gets a frame of
+// silence, after which Wideband reports false.
+func (q *sequenceSource) ReadWideFrame(samples []int16) bool {
+	moved := false
+	for q.Wideband() {
+		if q.sources[0].(WidebandSource).ReadWideFrame(samples) {
+			q.began = moved || beginsTalkspurt(q.sources[0])
+			return true
+		}
+		q.sources = q.sources[1:]
+		moved = true
+	}
+	if len(q.sources) == 0 {
+		return false
+	}
+	clear(samples)
+	return true
+}
+
+// MAX_TONE_CYCLE caps the samples cached for one tone. Tones whose
+// waveform repeats over a longer period are computed sample by sample.
+const MAX_TONE_CYCLE = SAMPLE_RATE
+
+// toneCycles caches one period of each tone, keyed by its frequencies, so
+// every call playing dial tone shares the same read-only samples
+var toneCycles sync.Map
+
+// toneSource plays a continuous mix of sine waves, e.g. 350+440 Hz
+type toneSource struct {
+	frequencies []float64
+	sampleIndex int
+	cycle       []int16 // One period of the tone, or nil if too long
+}
+
+// newToneSource creates a continuous tone of the given frequencies
+func newToneSource(frequencies ...float64) *toneSource {
+	return &toneSource{
+		frequencies: frequencies,
+		cycle:       toneCycle(frequencies),
+	}
+}
+
+// toneCycle returns one period of the tone from the cache, generating it
+// on first use. Mixes of whole-number frequencies repeat every
+// SAMPLE_RATE/gcd(SAMPLE_RATE, f1, f2, ...) samples: 800 for dial tone.
+func toneCycle(frequencies []float64) []int16 {
+	key := fmt.Sprint(frequencies)
+	if cycle, ok := toneCycles.Load(key); ok {
+		return cycle.([]int16)
+	}
+
+	divisor := SAMPLE_RATE
+	for _, freq := range frequencies {
+		if freq != math.Trunc(freq) || freq <= 0 {
+			return nil
+		}
+		divisor = gcd(divisor, int(freq))
+	}
+	period := SAMPLE_RATE / divisor
+	if period > MAX_TONE_CYCLE {
+		return nil
+	}
+
+	cycle := make([]int16, period)
+	for i := range cycle {
+		cycle[i] = toneSample(frequencies, i)
+	}
+	actual, _ := toneCycles.LoadOrStore(key, cycle)
+	return actual.([]int16)
+}
+
+// gcd returns the greatest common divisor of a and b
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// toneSample computes sample n of a tone
+func toneSample(frequencies []float64, n int) int16 {
+	// Split the amplitude between components so the mix never clips
+	amplitude := 1.0 / float64(len(frequencies))
+
+	now := float64(n) / SAMPLE_RATE
+	combined := 0.0
+	for _, freq := range frequencies {
+		combined += amplitude * math.Sin(2*math.Pi*freq*now)
+	}
+	return int16(combined * 16383) // Scale to 14-bit for μ-law
+}
+
+// ReadFrame produces the next frame of the tone, copied from the cached
+// cycle when there is one
+func (t *toneSource) ReadFrame(samples []int16) bool {
+	if t.cycle == nil {
+		for i := range samples {
+			samples[i] = toneSample(t.frequencies, t.sampleIndex)
+			t.sampleIndex++
+		}
+		return true
+	}
+
+	for filled := 0; filled < len(samples); {
+		n := copy(samples[filled:], t.cycle[t.sampleIndex:])
+		filled += n
+		t.sampleIndex = (t.sampleIndex + n) % len(t.cycle)
+	}
+	return true
+}
+
+// cadenceStep is one part of a cadence: a tone, or silence if it has no
+// frequencies, held for a time
+type cadenceStep struct {
+	frequencies []float64
+	duration    time.Duration
+}
+
+// cadenceSource plays the steps of a cadence in turn, repeating, as in
+// ringback, busy and the special information tones. Each step's tone
+// picks up where it left off the time before.
+type cadenceSource struct {
+	tones    []*toneSource // Of each step; nil for silence
+	lengths  []int         // Of each step, in samples
+	step     int
+	position int // Within the step
+}
+
+// newCadenceSource creates a tone played for on, then silent for off,
+// repeating
+func newCadenceSource(on, off time.Duration, frequencies ...float64) *cadenceSource {
+	return newCadence([]cadenceStep{{frequencies, on}, {nil, off}})
+}
+
+// newCadence creates a source playing steps, repeating; a single tone
+// step plays continuously. Steps too short to last a sample are left out.
+func newCadence(steps []cadenceStep) *cadenceSource {
+	c := &cadenceSource{}
+	for _, step := range steps {
+		length := int(step.duration * SAMPLE_RATE / time.Second)
+		if length == 0 {
+			continue
+		}
+		var tone *toneSource
+		if len(step.frequencies) > 0 {
+			tone = newToneSource(step.frequencies...)
+		}
+		c.tones = append(c.tones, tone)
+		c.lengths = append(c.lengths, length)
+	}
+	return c
+}
+
+// ReadFrame produces the next frame of tone or silence, switching partway
+// through if the cadence does
+func (c *cadenceSource) ReadFrame(samples []int16) bool {
+	if len(c.lengths) == 0 {
+		return false
+	}
+	for filled := 0; filled < len(samples); {
+		n := min(len(samples)-filled, c.lengths[c.step]-c.position)
+		if tone := c.tones[c.step]; tone != nil {
+			tone.ReadFrame(samples[filled : filled+n])
+		} else {
+			clear(samples[filled : filled+n])
+		}
+		filled += n
+		if c.position += n; c.position == c.lengths[c.step] {
+			c.step, c.position = (c.step+1)%len(c.lengths), 0
+		}
+	}
+	return true
+}
+
+// limitedSource plays a source for at most a fixed number of samples
+type limitedSource struct {
+	source    MediaSource
+	remaining int
+}
+
+// newLimitedSource cuts source off after d, e.g. to make a finite prompt
+// out of a repeating tone
+func newLimitedSource(source MediaSource, d time.Duration) *limitedSource {
+	return &limitedSource{source: source, remaining: int(d * SAMPLE_RATE / time.Second)}
+}
+
+// ReadFrame plays the next frame until the time is up, silencing the
+// rest of the frame it runs out in
+func (l *limitedSource) ReadFrame(samples []int16) bool {
+	if l.remaining <= 0 || !l.source.ReadFrame(samples) {
+		return false
+	}
+	if l.remaining < len(samples) {
+		clear(samples[l.remaining:])
+	}
+	l.remaining -= len(samples)
+	return true
+}
+
+// Time stretching: output is built from overlapping 20ms windows taken
+// from the input every STRETCH_HOP*speed samples, each shifted by up to
+// STRETCH_SEARCH samples to line up with the last, so speech speeds up or
+// slows down without changing pitch (WSOLA)
+const (
+	STRETCH_HOP    = FRAME_SIZE / 2
+	STRETCH_SEARCH = 40
+)
+
+// speedSource plays a source faster or slower than it was recorded
+type speedSource struct {
+	source MediaSource
+	speed  float64
+
+	in      []float64 // Input not yet consumed
+	real    int       // How much of `in` is audio rather than end padding
+	next    float64   // Where in `in` the next window ideally starts
+	prev    int       // Where the last window started; -1 before the first
+	overlap []float64 // Tail of the last window, still to be added to
+	out     []float64 // Finished output not yet read
+	ended   bool      // The source has run out
+	window  []float64
+	frame   []int16
+}
+
+// newSpeedSource plays source at speed times its normal rate
+func newSpeedSource(source MediaSource, speed float64) *speedSource {
+	window := make([]float64, 2*STRETCH_HOP)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(len(window))) // Hann
+	}
+	st := &speedSource{source: source, speed: speed, window: window, frame: make([]int16, FRAME_SIZE)}
+	st.Reset()
+	return st
+}
+
+// SetSpeed changes the playback speed from the next window on
+func (st *speedSource) SetSpeed(speed float64) {
+	st.speed = speed
+}
+
+// Reset forgets buffered audio, for when the source has been seeked
+func (st *speedSource) Reset() {
+	st.in, st.out = st.in[:0], st.out[:0]
+	st.real = 0
+	st.next, st.prev = 0, -1
+	st.overlap = make([]float64, STRETCH_HOP)
+	st.ended = false
+}
+
+// ReadFrame produces the next frame at the current speed
+func (st *speedSource) ReadFrame(samples []int16) bool {
+	if st.speed == 1 && len(st.in) == 0 && len(st.out) == 0 {
+		return st.source.ReadFrame(samples) // Nothing to stretch
+	}
+
+	for len(st.out) < len(samples) && st.fill() {
+		st.stretch()
+	}
+	if len(st.out) == 0 {
+		return false
+	}
+
+	n := min(len(samples), len(st.out))
+	for i := range n {
+		samples[i] = clampSample(st.out[i])
+	}
+	clear(samples[n:])
+	st.out = st.out[n:]
+	return true
+}
+
+// fill reads enough input for the next window and its search range. It
+// reports false once the source is exhausted and no input remains.
+func (st *speedSource) fill() bool {
+	need := int(st.next) + STRETCH_SEARCH + 2*STRETCH_HOP
+	if st.prev >= 0 {
+		need = max(need, st.prev+3*STRETCH_HOP)
+	}
+	for len(st.in) < need && !st.ended {
+		if !st.source.ReadFrame(st.frame) {
+			st.ended = true
+			break
+		}
+		for _, sample := range st.frame {
+			st.in = append(st.in, float64(sample))
+		}
+		st.real = len(st.in)
+	}
+	for len(st.in) < need {
+		st.in = append(st.in, 0) // Pad the end with silence
+	}
+	return !st.ended || int(st.next) < st.real
+}
+
+// stretch adds the next window to the output
+func (st *speedSource) stretch() {
+	start := int(st.next)
+	if st.prev >= 0 {
+		// Pick the window that best continues the last one: the input
+		// that naturally followed it is the template
+		natural := st.in[st.prev+STRETCH_HOP : st.prev+3*STRETCH_HOP]
+		best, bestScore := start, math.Inf(-1)
+		for candidate := max(0, start-STRETCH_SEARCH); candidate <= start+STRETCH_SEARCH; candidate++ {
+			score := 0.0
+			for i := 0; i < STRETCH_HOP; i++ {
+				score += natural[i] * st.in[candidate+i]
+			}
+			if score > bestScore {
+				best, bestScore = candidate, score
+			}
+		}
+		start = best
+	}
+
+	segment := st.in[start : start+2*STRETCH_HOP]
+	for i := 0; i < STRETCH_HOP; i++ {
+		st.out = append(st.out, st.overlap[i]+segment[i]*st.window[i])
+	}
+	for i := 0; i < STRETCH_HOP; i++ {
+		st.overlap[i] = segment[STRETCH_HOP+i] * st.window[STRETCH_HOP+i]
+	}
+	st.prev = start
+	st.next += STRETCH_HOP * st.speed
+
+	// Drop input no window can reach any more
+	if drop := min(st.prev, int(st.next)-STRETCH_SEARCH); drop > FRAME_SIZE {
+		st.in = append(st.in[:0], st.in[drop:]...)
+		st.real -= drop
+		st.prev -= drop
+		st.next -= float64(drop)
+	}
+}
+
+// openDestination creates the media source for a destination, run through
+// its effect chain if it has one
+func openDestination(cfg *Config, dest DestinationConfig) (MediaSource, error) {
+	var source MediaSource
+	switch dest.Type {
+	case "audio":
+		samples, wide, err := loadWidebandWAV(cfg.ResolvePath(dest.File))
+		if err != nil {
+			return nil, err
+		}
+		source = newWidebandPCMSource(samples, wide, dest.Loop)
+	case "playlist":
+		entries, err := parsePlaylist(cfg.ResolvePath(dest.File))
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("playlist %s is empty", dest.File)
+		}
+		source = newPlaylistSource(entries, dest.Shuffle, dest.Loop)
+	case "tone":
+		source = newToneSource(dest.Frequencies...)
+	case "peer", "phone", "sip_trunk":
+		return nil, fmt.Errorf("%s destinations connect calls rather than play audio", dest.Type)
+	case "action":
+		return nil, fmt.Errorf("action destinations run commands rather than play audio")
+	case "passport":
+		return nil, fmt.Errorf("passport destinations read back the caller's travels rather than play audio")
+	case "stats":
+		return nil, fmt.Errorf("stats destinations read out the server's health rather than play audio")
+	case "admin":
+		return nil, fmt.Errorf("admin destinations open a menu rather than play audio")
+	case "trunk":
+		return nil, fmt.Errorf("trunk destinations listen for a blue box rather than play audio")
+	case "jukebox", "audiobook":
+		return nil, fmt.Errorf("%s destinations are navigated by the caller rather than played straight through", dest.Type)
+	default:
+		return nil, fmt.Errorf("unknown destination type %q", dest.Type)
+	}
+
+	if len(dest.Effects) == 0 {
+		return source, nil
+	}
+	return newEffectSource(source, dest.Effects)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// MEDIA_BYE_GRACE is how long a call is kept after the phone's RTCP
+	// BYE says its audio has stopped, for the SIP BYE that should follow,
+	// or new audio from a phone that only changed its SSRC
+	MEDIA_BYE_GRACE = 3 * time.Second
+
+	// SHARED_MEDIA_QUEUE is how many packets from the shared media port
+	// wait for a call that has fallen behind before more are dropped
+	SHARED_MEDIA_QUEUE = 64
+)
+
+// Each call has its own RTP port, and the RTCP port above it, from the
+// RTP range, given in its SDP and given back when its dialog ends. Two
+// calls from the same phone, or from phones behind the same NAT, can't
+// be told apart by their address, but they can by the port their media
+// comes in on. With media_port set, calls share one port instead; see
+// sharedMedia.
+
+// rtpPortsInUse tracks the RTP ports held by servers in this process. With
+// SO_REUSEPORT the OS would let two calls bind the same port and split its
+// packets between them. rtpPortsNext is where the search for a free pair
+// starts, moving on with every call so a port just given back isn't taken
+// again while the last call's packets may still be arriving.
+var (
+	rtpPortsMu    sync.Mutex
+	rtpPortsInUse = make(map[int]bool)
+	rtpPortsNext  = RTP_PORT_MIN
+
+	// rtpMarkingWarning is given once, not for every call
+	rtpMarkingWarning sync.Once
+)
+
+// mediaPort is a call's RTP port, and the RTCP port above it, or its
+// share of the media port every call uses
+type mediaPort struct {
+	port    int
+	conn    *net.UDPConn
+	rtcp    *net.UDPConn // nil on the shared port, where RTCP comes with RTP
+	session *rtpSession
+
+	// On the shared port, the call's packets, and how surely a packet from
+	// a source not yet routed is the call's
+	shared *sharedMedia
+	inbox  chan *mediaPacket
+	claim  func(from netip.AddrPort) mediaClaim
+	routed bool // A source has been routed to the call; guarded by shared.mu
+
+	stop      func() bool // Stops the server's shutdown closing the port
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// openMediaPort takes the next free RTP and RTCP port pair for the call
+// callID, or a share of the media port if there is one, and starts
+// reading the call's media and reports from it, sending reports of our
+// own and watching for the phone going quiet
+func (s *SIPServer) openMediaPort(callID string) (*mediaPort, error) {
+	var p *mediaPort
+	if s.config.MediaPort != 0 {
+		shared, err := openSharedMedia(s.config.MediaPort, s.config.Socket, s.config.QoS.RTPDSCP)
+		if err != nil {
+			return nil, err
+		}
+		p = shared.open(callID, s.claimMedia)
+	} else {
+		var err error
+		if p, err = findAvailableRTPPort(s.config.Socket); err != nil {
+			return nil, err
+		}
+		if err := setDSCP(p.conn, s.config.QoS.RTPDSCP); err != nil {
+			rtpMarkingWarning.Do(func() { log.Printf("⚠️  Could not mark RTP packets: %v", err) })
+		}
+	}
+	p.stop = context.AfterFunc(s.ctx, p.Close)
+	s.spawn(func() { s.receiveRTP(p, callID) })
+	if p.rtcp != nil {
+		s.spawn(func() { s.receiveRTCP(p, callID) })
+	}
+	s.spawn(func() { s.sendRTCP(p, callID) })
+	s.spawn(func() { s.watchMedia(p, callID) })
+	return p, nil
+}
+
+// findAvailableRTPPort binds the next even port in the RTP range that is
+// free along with the one above it
+func findAvailableRTPPort(opts SocketConfig) (*mediaPort, error) {
+	rtpPortsMu.Lock()
+	defer rtpPortsMu.Unlock()
+
+	for range (RTP_PORT_MAX - RTP_PORT_MIN) / 2 {
+		port := rtpPortsNext // RTP uses even ports
+		if rtpPortsNext += 2; rtpPortsNext+1 > RTP_PORT_MAX {
+			rtpPortsNext = RTP_PORT_MIN
+		}
+		if rtpPortsInUse[port] {
+			continue
+		}
+		conn, err := listenUDP(fmt.Sprintf(":%d", port), opts)
+		if err != nil {
+			continue
+		}
+		rtcp, err := listenUDP(fmt.Sprintf(":%d", port+1), opts)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+
+		rtpPortsInUse[port] = true
+		return &mediaPort{port: port, conn: conn, rtcp: rtcp, session: newRTPSession(), closed: make(chan struct{})}, nil
+	}
+
+	return nil, fmt.Errorf("no available RTP ports in range %d-%d", RTP_PORT_MIN, RTP_PORT_MAX)
+}
+
+// Close gives the port back to the range, or the call's share of the
+// shared port back, ending the readers of the call's media and its
+// reports. It may be called more than once, or on a nil port.
+func (p *mediaPort) Close() {
+	if p == nil {
+		return
+	}
+	p.closeOnce.Do(func() {
+		if p.stop != nil {
+			p.stop()
+		}
+		if p.shared != nil {
+			p.shared.remove(p)
+			close(p.closed)
+			return
+		}
+		p.conn.Close()
+		p.rtcp.Close()
+		close(p.closed)
+
+		rtpPortsMu.Lock()
+		delete(rtpPortsInUse, p.port)
+		rtpPortsMu.Unlock()
+	})
+}
+
+// read reads the call's next packet, from its own port or as routed to it
+// from the shared one
+func (p *mediaPort) read(buffer []byte) (int, *net.UDPAddr, error) {
+	if p.shared == nil {
+		return p.conn.ReadFromUDP(buffer)
+	}
+	select {
+	case packet := <-p.inbox:
+		n := copy(buffer, packet.data[:packet.n])
+		from := net.UDPAddrFromAddrPort(packet.from)
+		mediaPacketPool.Put(packet)
+		return n, from, nil
+	case <-p.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// sharedMedia is the one UDP port that carries every call's RTP and RTCP
+// when media_port is set, for where forwarding the RTP range is a burden,
+// as for a container. Each packet goes to the call its source has been
+// routed to. A source not yet routed goes to the call whose media goes to
+// it, or else to the first call yet to hear from its phone whose phone
+// signals, or said in its SDP it would send, from the source's address;
+// phones behind one NAT whose calls are starting together are told apart
+// by the order the calls began. The port is opened by the first server to
+// use it and kept while the process runs.
+type sharedMedia struct {
+	port int
+	conn *net.UDPConn
+
+	mu      sync.Mutex
+	calls   []*mediaPort // In the order they were opened
+	sources map[netip.AddrPort]*mediaPort
+}
+
+// mediaClaim is how surely a packet from a source not yet routed belongs
+// to a call
+type mediaClaim int
+
+const (
+	claimNone    mediaClaim = iota
+	claimLikely             // From the phone's address, before its media has arrived
+	claimCertain            // From where the call's media goes
+)
+
+// mediaPacket is a packet read from the shared port, for the call it was
+// routed to
+type mediaPacket struct {
+	data [1500]byte
+	n    int
+	from netip.AddrPort
+}
+
+var (
+	sharedMediaMu    sync.Mutex
+	sharedMediaPorts = make(map[int]*sharedMedia)
+
+	// mediaPacketPool keeps the shared port's packets from making garbage
+	mediaPacketPool = sync.Pool{New: func() any { return new(mediaPacket) }}
+)
+
+// openSharedMedia opens the shared media port, or finds it already open,
+// and starts routing its packets
+func openSharedMedia(port int, opts SocketConfig, dscp int) (*sharedMedia, error) {
+	sharedMediaMu.Lock()
+	defer sharedMediaMu.Unlock()
+
+	if m := sharedMediaPorts[port]; m != nil {
+		return m, nil
+	}
+	conn, err := listenUDP(fmt.Sprintf(":%d", port), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open media port %d: %v", port, err)
+	}
+	if err := setDSCP(conn, dscp); err != nil {
+		rtpMarkingWarning.Do(func() { log.Printf("⚠️  Could not mark RTP packets: %v", err) })
+	}
+	m := &sharedMedia{port: port, conn: conn, sources: make(map[netip.AddrPort]*mediaPort)}
+	sharedMediaPorts[port] = m
+	go m.serve()
+	return m, nil
+}
+
+// open gives the call callID its share of the port, claiming packets
+// with claim
+func (m *sharedMedia) open(callID string, claim func(p *mediaPort, callID string, from netip.AddrPort) mediaClaim) *mediaPort {
+	p := &mediaPort{
+		port:    m.port,
+		conn:    m.conn,
+		session: newRTPSession(),
+		shared:  m,
+		inbox:   make(chan *mediaPacket, SHARED_MEDIA_QUEUE),
+		closed:  make(chan struct{}),
+	}
+	p.claim = func(from netip.AddrPort) mediaClaim { return claim(p, callID, from) }
+	m.mu.Lock()
+	m.calls = append(m.calls, p)
+	m.mu.Unlock()
+	return p
+}
+
+// remove forgets a call and the sources routed to it
+func (m *sharedMedia) remove(p *mediaPort) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calls = slices.DeleteFunc(m.calls, func(call *mediaPort) bool { return call == p })
+	maps.DeleteFunc(m.sources, func(_ netip.AddrPort, call *mediaPort) bool { return call == p })
+}
+
+// serve reads the port, handing each packet to its call, or dropping it
+// if it has none or the call has fallen behind
+func (m *sharedMedia) serve() {
+	for {
+		packet := mediaPacketPool.Get().(*mediaPacket)
+		n, from, err := m.conn.ReadFromUDPAddrPort(packet.data[:])
+		if err != nil {
+			mediaPacketPool.Put(packet)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error reading RTP packet: %v", err)
+			continue
+		}
+		packet.n, packet.from = n, netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		p := m.route(packet.from)
+		if p == nil {
+			mediaPacketPool.Put(packet)
+			continue
+		}
+		select {
+		case p.inbox <- packet:
+		default:
+			mediaPacketPool.Put(packet)
+		}
+	}
+}
+
+// route finds the call a packet from a source is for. The calls are asked
+// without holding the lock, as asking looks up their sessions.
+func (m *sharedMedia) route(from netip.AddrPort) *mediaPort {
+	m.mu.Lock()
+	if p := m.sources[from]; p != nil {
+		m.mu.Unlock()
+		return p
+	}
+	calls := slices.Clone(m.calls)
+	m.mu.Unlock()
+
+	var routed *mediaPort
+	var likely []*mediaPort
+	for _, p := range calls {
+		claim := p.claim(from)
+		if claim == claimCertain {
+			routed = p
+			break
+		}
+		if claim == claimLikely {
+			likely = append(likely, p)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if routed == nil {
+		if i := slices.IndexFunc(likely, func(p *mediaPort) bool { return !p.routed }); i >= 0 {
+			routed = likely[i]
+		}
+	}
+	if routed == nil || !slices.Contains(m.calls, routed) {
+		return nil
+	}
+	routed.routed = true
+	m.sources[from] = routed
+	return routed
+}
+
+// claimMedia is how surely a packet from a source not yet routed on the
+// shared port is for the call callID on p: certain from where its media
+// goes, likely from its phone's address before any media has come
+func (s *SIPServer) claimMedia(p *mediaPort, callID string, from netip.AddrPort) mediaClaim {
+	session := s.sessionForMedia(p, callID)
+	if session == nil {
+		return claimNone
+	}
+	sameIP := func(addr *net.UDPAddr) bool {
+		ip, ok := netip.AddrFromSlice(addr.IP)
+		return ok && ip.Unmap() == from.Addr()
+	}
+	rtp := session.RemoteRTPAddr()
+	switch {
+	case rtp != nil && sameIP(rtp) && rtp.Port == int(from.Port()):
+		return claimCertain
+	case session.latched.Load():
+		return claimNone
+	case (rtp != nil && sameIP(rtp)) || (session.RemoteAddr != nil && sameIP(session.RemoteAddr)):
+		return claimLikely
+	}
+	return claimNone
+}
+
+// watchMedia hangs up the call callID on the port p once the phone has
+// gone: nothing from it for the media timeout, counted from when the call
+// was answered or came off hold at the earliest, or nothing more for
+// MEDIA_BYE_GRACE after an RTCP BYE. Without it a phone that lost power
+// mid-call would leave the call running until its session timer ran out.
+func (s *SIPServer) watchMedia(p *mediaPort, callID string) {
+	timeout := time.Duration(s.config.MediaTimeoutSeconds) * time.Second
+	if timeout == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var since time.Time // When the call was answered or last came off hold
+	for {
+		var now time.Time
+		select {
+		case <-p.closed:
+			return
+		case now = <-ticker.C:
+		}
+
+		session := s.sessionForMedia(p, callID)
+		if session == nil || session.held.Load() {
+			since = time.Time{}
+			continue
+		}
+		if since.IsZero() {
+			since = now
+		}
+
+		heard, left := p.session.quiet()
+		if heard.Before(since) {
+			heard = since
+		}
+		switch {
+		case !left.IsZero() && now.Sub(left) >= MEDIA_BYE_GRACE:
+			log.Printf("⏰ %s stopped its audio with RTCP BYE; hanging up call %s", session.RemoteRTPAddr(), callID)
+		case now.Sub(heard) >= timeout:
+			log.Printf("⏰ No media from %s for %v; hanging up call %s", session.RemoteRTPAddr(), timeout, callID)
+		default:
+			continue
+		}
+		s.hangupCall(session)
+		return
+	}
+}
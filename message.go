@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MESSAGE_MAX_LENGTH caps the text of a MESSAGE; longer ones are
+	// refused rather than read out for minutes
+	MESSAGE_MAX_LENGTH = 500
+
+	// MESSAGE_MEMORY is how long a MESSAGE is remembered so that its
+	// retransmissions are answered without handling it again (64*T1)
+	MESSAGE_MEMORY = 32 * time.Second
+
+	// MESSAGE_BEEP_FREQ announces a message spoken into a call, or stands
+	// in for it without a speech synthesizer
+	MESSAGE_BEEP_FREQ = 1000.0 // Hz
+)
+
+// messageEvent is what the message webhook receives
+type messageEvent struct {
+	Exchange string    `json:"exchange"`
+	From     string    `json:"from"` // SIP user of the sender, if it has one
+	To       string    `json:"to"`   // SIP user the message is addressed to
+	Text     string    `json:"text"`
+	Time     time.Time `json:"time"`
+}
+
+// recentMessages remembers the MESSAGEs handled lately and how they were
+// answered, by Call-ID and CSeq
+type recentMessages struct {
+	mu        sync.Mutex
+	responses map[string]string
+	times     map[string]time.Time
+}
+
+// seen returns the status a MESSAGE was answered with, if it is a
+// retransmission, forgetting old ones
+func (r *recentMessages) seen(key string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, at := range r.times {
+		if time.Since(at) > MESSAGE_MEMORY {
+			delete(r.times, k)
+			delete(r.responses, k)
+		}
+	}
+	status, ok := r.responses[key]
+	return status, ok
+}
+
+// remember keeps the status a MESSAGE was answered with
+func (r *recentMessages) remember(key, status string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.responses == nil {
+		r.responses = make(map[string]string)
+		r.times = make(map[string]time.Time)
+	}
+	if len(r.responses) >= MAX_TRACKED_SOURCES {
+		clear(r.responses)
+		clear(r.times)
+	}
+	r.responses[key] = status
+	r.times[key] = time.Now()
+}
+
+// handleMessage processes SIP MESSAGE requests: short texts from other SIP
+// clients, handled as messages.handler says
+func (s *SIPServer) handleMessage(message string, remoteAddr *net.UDPAddr) {
+	headers := parseHeaders(message)
+	key := headers["Call-ID"] + " " + headers["CSeq"]
+	if status, ok := s.messages.seen(key); ok {
+		s.sendResponse(dialogResponse(headers, status), remoteAddr)
+		return
+	}
+
+	ex := s.exchangeFor(message)
+	from := contactUser(headers["From"])
+	if ex.auth != nil && !s.authorize(ex, "MESSAGE", headers, from, remoteAddr) {
+		return
+	}
+	if contentType, _, _ := strings.Cut(headers["Content-Type"], ";"); !strings.EqualFold(strings.TrimSpace(contentType), "text/plain") {
+		s.sendResponse(registerResponse(headers, "415 Unsupported Media Type", "Accept: text/plain"), remoteAddr)
+		return
+	}
+
+	status := s.deliverMessage(ex, headers, message, from)
+	s.messages.remember(key, status)
+	s.sendResponse(dialogResponse(headers, status), remoteAddr)
+}
+
+// deliverMessage hands a MESSAGE's text to the configured handler and
+// returns the status to answer with
+func (s *SIPServer) deliverMessage(ex *exchange, headers map[string]string, message, from string) string {
+	_, text, _ := strings.Cut(message, "\r\n\r\n")
+	text = strings.TrimSpace(text)
+	if len(text) > MESSAGE_MAX_LENGTH {
+		return "413 Request Entity Too Large"
+	}
+
+	to := ""
+	if fields := strings.Fields(splitLines(message)[0]); len(fields) > 1 {
+		to = contactUser(fields[1]) // The Request-URI
+	}
+	if to == "" {
+		to = contactUser(headers["To"])
+	}
+	fmt.Printf("💬 Message from %s to %s: %q\n", from, to, text)
+
+	cfg := ex.config.Messages
+	switch cfg.Handler {
+	case "webhook":
+		event := messageEvent{Exchange: ex.name, From: from, To: to, Text: text, Time: time.Now()}
+		s.spawn(func() { s.postMessage(cfg.Webhook, event) })
+		return "202 Accepted"
+
+	case "speak":
+		session := s.callOf(ex, to)
+		if session == nil {
+			return "480 Temporarily Unavailable"
+		}
+		s.spawn(func() {
+			announcement := newSequenceSource(newBeeps(1, MESSAGE_BEEP_FREQ), speech(session, text, newBeeps(2, MESSAGE_BEEP_FREQ)))
+			session.interrupt(announcement)
+		})
+		return "200 OK"
+
+	default:
+		return "200 OK"
+	}
+}
+
+// callOf is the call a phone on an exchange is on, placed or answered,
+// or nil if it isn't on one
+func (s *SIPServer) callOf(ex *exchange, user string) *CallSession {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	for _, session := range s.calls {
+		if session.exchange.name == ex.name && session.dialog != nil && contactUser(session.dialog.to) == user {
+			return session
+		}
+	}
+	return nil
+}
+
+// postMessage sends a message to the webhook as JSON
+func (s *SIPServer) postMessage(webhook string, event messageEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("❌ Failed to encode message: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, ACTION_TIMEOUT)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("❌ Message webhook failed: %v", err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		log.Printf("❌ Message webhook failed: %v", err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		log.Printf("❌ Message webhook answered %s", response.Status)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MWI_EVENT is the event package phones subscribe to for message
+	// waiting indication (RFC 3842), and MWI_CONTENT_TYPE its NOTIFY body
+	MWI_EVENT        = "message-summary"
+	MWI_CONTENT_TYPE = "application/simple-message-summary"
+
+	// A subscription lasts as long as the phone asks, up to
+	// MAX_SUBSCRIBE_EXPIRES, or DEFAULT_SUBSCRIBE_EXPIRES if it doesn't say
+	DEFAULT_SUBSCRIBE_EXPIRES = 3600
+	MAX_SUBSCRIBE_EXPIRES     = 86400
+
+	// Stutter dial tone tells a caller who goes off hook that messages are
+	// waiting: STUTTER_BURSTS quick bursts of dial tone, then steady tone,
+	// two seconds of stutter as Telcordia GR-506 has it
+	STUTTER_ON     = 100 * time.Millisecond
+	STUTTER_OFF    = 100 * time.Millisecond
+	STUTTER_BURSTS = 10
+)
+
+// Mailbox is what a user's voice mailbox holds
+type Mailbox struct {
+	New int `json:"new"`
+	Old int `json:"old"`
+}
+
+// mailboxTable holds the message counts of each user on an exchange, in
+// the state store so they survive restarts. The API sets them for now; a
+// voicemail system would.
+type mailboxTable struct {
+	mu    sync.Mutex
+	store *stateStore
+	key   string
+	boxes map[string]Mailbox
+}
+
+// newMailboxTable loads an exchange's mailboxes from the store
+func newMailboxTable(store *stateStore, exchange string) (*mailboxTable, error) {
+	t := &mailboxTable{store: store, key: "mailboxes/" + exchange}
+	if _, err := store.Load(t.key, &t.boxes); err != nil {
+		return nil, err
+	}
+	if t.boxes == nil {
+		t.boxes = make(map[string]Mailbox)
+	}
+	return t, nil
+}
+
+// Get returns a user's mailbox; the zero value is empty
+func (t *mailboxTable) Get(user string) Mailbox {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.boxes[user]
+}
+
+// Set replaces a user's message counts, forgetting an empty mailbox
+func (t *mailboxTable) Set(user string, box Mailbox) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if box == (Mailbox{}) {
+		delete(t.boxes, user)
+	} else {
+		t.boxes[user] = box
+	}
+	return t.store.Save(t.key, t.boxes)
+}
+
+// Snapshot returns a copy of every user's mailbox
+func (t *mailboxTable) Snapshot() map[string]Mailbox {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return maps.Clone(t.boxes)
+}
+
+// subscription is a phone watching a mailbox for waiting messages
+type subscription struct {
+	d        *dialog
+	exchange string // By name, since a reload replaces the exchange
+	user     string // Whose mailbox
+	account  string // The mailbox's URI, as the phone addressed it
+
+	mu      sync.Mutex // Held for a NOTIFY transaction, one at a time
+	expires time.Time
+	timer   *time.Timer
+}
+
+// handleSubscribe processes SIP SUBSCRIBE requests for message waiting
+// indication. A new subscription gets its own dialog and a NOTIFY with the
+// mailbox as it is now; a refresh within that dialog extends it, and
+// Expires: 0 ends it.
+func (s *SIPServer) handleSubscribe(message string, remoteAddr *net.UDPAddr) {
+	headers := parseHeaders(message)
+	if event, _, _ := strings.Cut(headers["Event"], ";"); strings.TrimSpace(event) != MWI_EVENT {
+		s.sendResponse(registerResponse(headers, "489 Bad Event", "Allow-Events: "+MWI_EVENT), remoteAddr)
+		return
+	}
+
+	expires := DEFAULT_SUBSCRIBE_EXPIRES
+	if value := strings.TrimSpace(headers["Expires"]); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			s.sendResponse(registerResponse(headers, "400 Bad Request"), remoteAddr)
+			return
+		}
+		expires = min(n, MAX_SUBSCRIBE_EXPIRES)
+	}
+
+	// A To tag means the phone is refreshing a subscription it has
+	if localTag := headerTag(headers["To"]); localTag != "" {
+		s.callsMu.Lock()
+		sub := s.subscriptions[dialogID{headers["Call-ID"], localTag, headerTag(headers["From"])}]
+		s.callsMu.Unlock()
+		if sub == nil {
+			s.sendResponse(dialogResponse(headers, "481 Call/Transaction Does Not Exist"), remoteAddr)
+			return
+		}
+		if isNew, retransmission := sub.d.checkCSeq(cseqNumber(headers["CSeq"])); !isNew && !retransmission {
+			s.sendResponse(dialogResponse(headers, "500 Server Internal Error"), remoteAddr)
+			return
+		}
+		s.subscribed(sub, headers, expires)
+		return
+	}
+
+	ex := s.exchangeFor(message)
+	user := contactUser(headers["To"])
+	if ex.auth != nil {
+		subscriber := contactUser(headers["From"])
+		if !s.authorize(ex, "SUBSCRIBE", headers, subscriber, remoteAddr) {
+			return
+		}
+		if subscriber != user {
+			log.Printf("🚫 %s may not watch the mailbox of %s", subscriber, user)
+			s.sendResponse(registerResponse(headers, "403 Forbidden"), remoteAddr)
+			return
+		}
+	}
+
+	account := ""
+	if fields := strings.Fields(splitLines(message)[0]); len(fields) > 1 {
+		account = fields[1]
+	}
+	d := dialogFromRequest(message, remoteAddr)
+	d.state = dialogEstablished
+	sub := &subscription{d: d, exchange: ex.name, user: user, account: account}
+
+	fmt.Printf("📬 %s subscribed to the mailbox of %s\n", remoteAddr, user)
+	s.callsMu.Lock()
+	s.subscriptions[d.id()] = sub
+	s.callsMu.Unlock()
+	s.subscribed(sub, headers, expires)
+}
+
+// subscribed accepts a SUBSCRIBE for sub and sends the NOTIFY it calls
+// for: the mailbox, or the end of the subscription if it expires now
+func (s *SIPServer) subscribed(sub *subscription, headers map[string]string, expires int) {
+	d := sub.d
+	d.mu.Lock()
+	to := d.from // Our side, with our tag
+	d.mu.Unlock()
+	s.sendResponse(fmt.Sprintf("SIP/2.0 200 OK\r\n"+
+		"Via: %s\r\n"+
+		"From: %s\r\n"+
+		"To: %s\r\n"+
+		"Call-ID: %s\r\n"+
+		"CSeq: %s\r\n"+
+		"Contact: <%s>\r\n"+
+		"Expires: %d\r\n"+
+		"Content-Length: 0\r\n"+
+		"\r\n", headers["Via"], headers["From"], to, headers["Call-ID"], headers["CSeq"],
+		s.contactURI(d.remoteAddr), expires), d.remoteAddr)
+
+	if expires == 0 {
+		s.unsubscribe(sub)
+		s.spawn(func() { s.notify(sub, "terminated") })
+		return
+	}
+
+	sub.mu.Lock()
+	sub.expires = time.Now().Add(time.Duration(expires) * time.Second)
+	if sub.timer != nil {
+		sub.timer.Stop()
+	}
+	sub.timer = time.AfterFunc(time.Duration(expires)*time.Second, func() {
+		fmt.Printf("⌛ Subscription to the mailbox of %s expired\n", sub.user)
+		s.unsubscribe(sub)
+		s.spawn(func() { s.notify(sub, "terminated;reason=timeout") })
+	})
+	sub.mu.Unlock()
+	s.spawn(func() { s.notify(sub, "") })
+}
+
+// unsubscribe forgets a subscription
+func (s *SIPServer) unsubscribe(sub *subscription) {
+	s.callsMu.Lock()
+	delete(s.subscriptions, sub.d.id())
+	s.callsMu.Unlock()
+
+	sub.mu.Lock()
+	if sub.timer != nil {
+		sub.timer.Stop()
+	}
+	sub.mu.Unlock()
+}
+
+// notifyMailbox tells every phone watching a user's mailbox on an
+// exchange what it now holds
+func (s *SIPServer) notifyMailbox(ex *exchange, user string) {
+	s.callsMu.Lock()
+	var watching []*subscription
+	for _, sub := range s.subscriptions {
+		if sub.exchange == ex.name && sub.user == user {
+			watching = append(watching, sub)
+		}
+	}
+	s.callsMu.Unlock()
+
+	for _, sub := range watching {
+		s.spawn(func() { s.notify(sub, "") })
+	}
+}
+
+// notify sends a subscription's phone a NOTIFY with the mailbox and
+// resends it until the phone responds. state ends the subscription if
+// given; otherwise it is active until it expires. A phone that doesn't
+// know the subscription any more, or never responds, loses it.
+func (s *SIPServer) notify(sub *subscription, state string) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if state == "" {
+		remaining := max(int(time.Until(sub.expires).Seconds()), 1)
+		state = fmt.Sprintf("active;expires=%d", remaining)
+	}
+
+	box := Mailbox{}
+	for _, ex := range s.Exchanges() {
+		if ex.name == sub.exchange {
+			box = ex.mailboxes.Get(sub.user)
+		}
+	}
+	waiting := "no"
+	if box.New > 0 {
+		waiting = "yes"
+	}
+	body := fmt.Sprintf("Messages-Waiting: %s\r\n"+
+		"Message-Account: %s\r\n"+
+		"Voice-Message: %d/%d (0/0)\r\n", waiting, sub.account, box.New, box.Old)
+	extra := []string{"Event: " + MWI_EVENT, "Subscription-State: " + state}
+
+	switch code := s.transactRequest(sub.d, "NOTIFY", MWI_CONTENT_TYPE, body, extra...); {
+	case code == 0 && s.ctx.Err() == nil:
+		log.Printf("⚠️  No response from %s to the mailbox NOTIFY; dropping its subscription", sub.d.remoteAddr)
+		s.dropSubscription(sub)
+	case code >= 300:
+		log.Printf("⚠️  %s refused the mailbox NOTIFY with %d; dropping its subscription", sub.d.remoteAddr, code)
+		s.dropSubscription(sub)
+	}
+}
+
+// dropSubscription forgets a subscription from within its NOTIFY, which
+// holds sub.mu
+func (s *SIPServer) dropSubscription(sub *subscription) {
+	s.callsMu.Lock()
+	delete(s.subscriptions, sub.d.id())
+	s.callsMu.Unlock()
+	if sub.timer != nil {
+		sub.timer.Stop()
+	}
+}
+
+// dialTone is the dial tone a call hears: stuttered at first when the
+// caller has new messages waiting, in the frequencies of the tone plan's
+// dial tone
+func dialTone(session *CallSession) MediaSource {
+	steady := session.progressTone(progressDial)
+	if caller := session.caller(); caller == "" || session.exchange.mailboxes.Get(caller).New == 0 {
+		return steady
+	}
+	cfg := session.exchange.config
+	dial := cfg.toneSteps(cfg.progressToneName(progressDial))
+	stutter := newCadenceSource(STUTTER_ON, STUTTER_OFF, dial[0].frequencies...)
+	return newSequenceSource(newLimitedSource(stutter, STUTTER_BURSTS*(STUTTER_ON+STUTTER_OFF)), steady)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// dialToneCadence goes off hook as ua and reads frames of dial tone,
+// reporting for each whether it was silent
+func dialToneCadence(t *testing.T, ua *testUA, frames int) []bool {
+	t.Helper()
+	if err := ua.Invite(); err != nil {
+		t.Fatalf("go off hook: %v", err)
+	}
+	defer ua.Bye()
+	var silent []bool
+	err := ua.ReadAudio(2*time.Duration(frames)*20*time.Millisecond, func(payload []byte) bool {
+		silent = append(silent, bytes.Count(payload, []byte{linearToUlaw(0)}) == len(payload))
+		return len(silent) == frames
+	})
+	if err != nil {
+		t.Fatalf("dial tone: %v", err)
+	}
+	return silent
+}
+
+func TestStutterDialTone(t *testing.T) {
+	cfg := selfTestConfig()
+	cfg.BindIP = "127.0.0.1"
+	cfg.SIPPort = 0
+	server, err := NewSIPServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go server.Run()
+
+	ua, err := newTestUA(server.SIPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ua.Close()
+	if err := ua.Register(); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	mailboxes := server.Exchanges()[0].mailboxes
+	burst := int(STUTTER_ON / (20 * time.Millisecond))
+	stutter := STUTTER_BURSTS * int((STUTTER_ON+STUTTER_OFF)/(20*time.Millisecond))
+
+	// Only old messages: steady tone from the start
+	mailboxes.Set(ua.user, Mailbox{Old: 2})
+	for i, silent := range dialToneCadence(t, ua, stutter) {
+		if silent {
+			t.Fatalf("old messages only: frame %d silent, want steady dial tone", i)
+		}
+	}
+
+	// New messages: bursts of tone and silence, then steady tone
+	mailboxes.Set(ua.user, Mailbox{New: 1})
+	cadence := dialToneCadence(t, ua, stutter+2*burst)
+	gaps := 0
+	for i := 1; i < stutter; i++ {
+		if cadence[i] && !cadence[i-1] {
+			gaps++
+		}
+	}
+	if gaps != STUTTER_BURSTS {
+		t.Errorf("%d gaps in the stutter, want %d: %v", gaps, STUTTER_BURSTS, cadence[:stutter])
+	}
+	for i, silent := range cadence[stutter:] {
+		if silent {
+			t.Errorf("frame %d after the stutter silent, want steady dial tone", stutter+i)
+		}
+	}
+}
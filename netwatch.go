@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// NETWORK_POLL_INTERVAL is how often the network interfaces are checked
+// for adapters plugged in or unplugged and addresses that change
+const NETWORK_POLL_INTERVAL = 5 * time.Second
+
+// networkSnapshot is the addresses of each interface that is up, by
+// interface name (see interfaceAddrs). Loopback is left out.
+type networkSnapshot map[string][]string
+
+// takeNetworkSnapshot looks at the network interfaces as they are now
+func takeNetworkSnapshot() (networkSnapshot, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network interfaces: %v", err)
+	}
+
+	snapshot := make(networkSnapshot)
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		snapshot[iface.Name] = interfaceAddrs(iface)
+	}
+	return snapshot, nil
+}
+
+// interfaceAddrs is the addresses of an interface, IPv4 first, then
+// IPv6. IPv6 link-local addresses are left out: they only mean something
+// with the interface named, which phones can't do in a SIP URI.
+func interfaceAddrs(iface net.Interface) []string {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var ips, ip6s []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			ips = append(ips, ipnet.IP.String())
+		} else {
+			ip6s = append(ip6s, ipnet.IP.String())
+		}
+	}
+	return append(ips, ip6s...)
+}
+
+// interfaceIP is the first address of the named interface, IPv4 if it has
+// one, or "" if it isn't there, isn't up or has no address yet
+func interfaceIP(name string) string {
+	iface, err := net.InterfaceByName(name)
+	if err != nil || iface.Flags&net.FlagUp == 0 {
+		return ""
+	}
+	if ips := interfaceAddrs(*iface); len(ips) > 0 {
+		return ips[0]
+	}
+	return ""
+}
+
+// logNetworkChanges prints what changed between two snapshots
+func logNetworkChanges(old, current networkSnapshot) {
+	for _, name := range slices.Sorted(maps.Keys(current)) {
+		ips, seen := old[name]
+		switch {
+		case !seen:
+			fmt.Printf("🔌 Interface %s up: %s\n", name, listAddrs(current[name]))
+		case !slices.Equal(ips, current[name]):
+			fmt.Printf("🔌 Interface %s now has %s\n", name, listAddrs(current[name]))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(old)) {
+		if _, ok := current[name]; !ok {
+			fmt.Printf("🔌 Interface %s down\n", name)
+		}
+	}
+}
+
+// listAddrs lists addresses, or says there are none
+func listAddrs(ips []string) string {
+	if len(ips) == 0 {
+		return "no address"
+	}
+	return strings.Join(ips, ", ")
+}
+
+// watchNetwork checks the network interfaces every NETWORK_POLL_INTERVAL
+// until ctx ends. When an adapter comes or goes or an address changes,
+// servers open and close SIP sockets to match (see syncListeners).
+// Contact and SDP always carry the address in use at the time, so calls
+// set up after the change use it.
+func watchNetwork(ctx context.Context, servers []*SIPServer) {
+	last, err := takeNetworkSnapshot()
+	if err != nil {
+		log.Printf("⚠️  Not watching the network: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(NETWORK_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		current, err := takeNetworkSnapshot()
+		if err != nil {
+			log.Printf("⚠️  %v", err)
+			continue
+		}
+		if maps.EqualFunc(last, current, slices.Equal) {
+			continue
+		}
+		logNetworkChanges(last, current)
+		last = current
+
+		for _, server := range servers {
+			if err := server.syncListeners(server.SIPAddr().Port); err != nil {
+				log.Printf("❌ %v", err)
+			}
+		}
+	}
+}
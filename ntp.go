@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	NTP_PORT = 123
+
+	// NTP_EPOCH_OFFSET is the seconds from 1900, where NTP time starts,
+	// to 1970
+	NTP_EPOCH_OFFSET = 2208988800
+
+	// The server answers as a primary reference: as far as the adapter
+	// patched into it knows, the machine's own clock is the time
+	NTP_STRATUM    = 1
+	NTP_PRECISION  = -20 // About a microsecond, as a power of two
+	NTP_PACKET_LEN = 48
+)
+
+// ntpTimestamp is t as NTP writes it: seconds since 1900 and a binary
+// fraction, in 32 bits each
+func ntpTimestamp(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + NTP_EPOCH_OFFSET)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// serveNTP answers SNTP clients, such as a phone adapter setting its
+// clock for caller ID and logs, with the time until conn is closed
+func serveNTP(conn *net.UDPConn) {
+	buffer := make([]byte, 512)
+	for {
+		n, remoteAddr, err := conn.ReadFromUDP(buffer)
+		received := time.Now()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("❌ NTP: %v", err)
+			continue
+		}
+		if n < NTP_PACKET_LEN || buffer[0]&0x7 != 3 { // Mode 3: client
+			continue
+		}
+
+		version := buffer[0] >> 3 & 0x7
+		reply := make([]byte, NTP_PACKET_LEN)
+		reply[0] = version<<3 | 4 // No leap second warning; mode 4: server
+		reply[1] = NTP_STRATUM
+		reply[2] = buffer[2]                 // Poll interval, as asked
+		reply[3] = byte(256 + NTP_PRECISION) // A signed byte
+		copy(reply[12:16], "LOCL")
+		binary.BigEndian.PutUint64(reply[16:24], ntpTimestamp(received)) // Reference: always in sync
+		copy(reply[24:32], buffer[40:48])                                // Originate: the client's transmit time
+		binary.BigEndian.PutUint64(reply[32:40], ntpTimestamp(received))
+		binary.BigEndian.PutUint64(reply[40:48], ntpTimestamp(time.Now()))
+
+		if _, err := conn.WriteToUDP(reply, remoteAddr); err != nil {
+			log.Printf("❌ NTP: failed to answer %s: %v", remoteAddr, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+//go:build opus && cgo
+
+package main
+
+/*
+#cgo pkg-config: opus
+#include <opus.h>
+
+// opus_encoder_ctl is variadic, which cgo can't call
+static int configure_opus_encoder(OpusEncoder *st, opus_int32 bitrate, opus_int32 loss) {
+	int err = opus_encoder_ctl(st, OPUS_SET_BITRATE(bitrate));
+	if (err != OPUS_OK) {
+		return err;
+	}
+	err = opus_encoder_ctl(st, OPUS_SET_INBAND_FEC(1));
+	if (err != OPUS_OK) {
+		return err;
+	}
+	return opus_encoder_ctl(st, OPUS_SET_PACKET_LOSS_PERC(loss));
+}
+*/
+import "C"
+
+import (
+	"log"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	// OPUS_PAYLOAD_TYPE is the dynamic payload type we offer Opus under,
+	// the one browsers use
+	OPUS_PAYLOAD_TYPE = 111
+
+	// OPUS_BITRATE is what the encoder aims for: ample for 16kHz voice and
+	// music, and well under the bytes a frame may take, as many as its
+	// 8kHz samples
+	OPUS_BITRATE = 32000
+
+	// OPUS_EXPECTED_LOSS is the packet loss, in percent, the encoder is
+	// told to expect; it only adds in-band FEC for a loss above none, and
+	// more of it the higher the loss
+	OPUS_EXPECTED_LOSS = 10
+
+	// OPUS_CLOCK_RATE is Opus's RTP clock, whatever the audio's bandwidth
+	// (RFC 7587 section 4.1)
+	OPUS_CLOCK_RATE = 48000
+)
+
+// opusCodec is Opus (RFC 6716) through libopus, built in with -tags opus.
+// It is handed the wideband path's 16kHz audio and resamples to and from
+// its 48kHz internally. The rtpmap always says two channels (RFC 7587
+// section 7); we send mono, and stereo we receive is mixed down.
+var opusCodec = &codec{
+	name:        "opus",
+	rtpmap:      "opus/48000/2",
+	fmtp:        "useinbandfec=1",
+	payloadType: OPUS_PAYLOAD_TYPE,
+	clockRate:   OPUS_CLOCK_RATE,
+	wideband:    true,
+	ptimes:      []int{10, 20, 40, 60}, // Opus has no 30ms frames
+	newEncoder:  newOpusEncoder,
+	newDecoder:  newOpusDecoder,
+}
+
+// Opus is the best codec we have, so it is preferred
+func init() {
+	codecs = append([]*codec{opusCodec}, codecs...)
+}
+
+// opusEncoder encodes one stream's audio; nil if libopus refused to make
+// one, when it encodes nothing
+type opusEncoder struct {
+	st *C.OpusEncoder
+}
+
+// opusDecoder decodes one call's audio; nil if libopus refused to make
+// one, when it decodes nothing
+type opusDecoder struct {
+	st *C.OpusDecoder
+}
+
+func newOpusEncoder() audioEncoder {
+	var err C.int
+	st := C.opus_encoder_create(WIDE_SAMPLE_RATE, 1, C.OPUS_APPLICATION_VOIP, &err)
+	if err != C.OPUS_OK {
+		log.Printf("❌ Failed to create Opus encoder: %s", C.GoString(C.opus_strerror(err)))
+		return &opusEncoder{}
+	}
+	if err := C.configure_opus_encoder(st, OPUS_BITRATE, OPUS_EXPECTED_LOSS); err != C.OPUS_OK {
+		log.Printf("⚠️  Failed to configure Opus encoder: %s", C.GoString(C.opus_strerror(err)))
+	}
+	e := &opusEncoder{st: st}
+	runtime.AddCleanup(e, func(st *C.OpusEncoder) { C.opus_encoder_destroy(st) }, st)
+	return e
+}
+
+func newOpusDecoder() audioDecoder {
+	var err C.int
+	st := C.opus_decoder_create(WIDE_SAMPLE_RATE, 1, &err)
+	if err != C.OPUS_OK {
+		log.Printf("❌ Failed to create Opus decoder: %s", C.GoString(C.opus_strerror(err)))
+		return &opusDecoder{}
+	}
+	d := &opusDecoder{st: st}
+	runtime.AddCleanup(d, func(st *C.OpusDecoder) { C.opus_decoder_destroy(st) }, st)
+	return d
+}
+
+// Encode encodes a frame of 16kHz samples into payload
+func (e *opusEncoder) Encode(payload []byte, samples []int16) int {
+	if e.st == nil || len(payload) == 0 || len(samples) == 0 {
+		return 0
+	}
+	n := C.opus_encode(e.st, (*C.opus_int16)(unsafe.Pointer(&samples[0])), C.int(len(samples)),
+		(*C.uchar)(unsafe.Pointer(&payload[0])), C.opus_int32(len(payload)))
+	if n < 0 {
+		return 0
+	}
+	return int(n)
+}
+
+// Decode decodes a packet into as many 16kHz samples as it holds, up to
+// len(pcm)
+func (d *opusDecoder) Decode(pcm []int16, payload []byte) int {
+	if d.st == nil || len(payload) == 0 || len(pcm) == 0 {
+		return 0
+	}
+	n := C.opus_decode(d.st, (*C.uchar)(unsafe.Pointer(&payload[0])), C.opus_int32(len(payload)),
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)), 0)
+	if n < 0 {
+		return 0
+	}
+	return int(n)
+}
+
+// DecodeFEC decodes the in-band FEC copy of the frame before payload, of
+// samples 16kHz samples; libopus conceals the frame itself if the packet
+// has no copy
+func (d *opusDecoder) DecodeFEC(pcm []int16, payload []byte, samples int) int {
+	if d.st == nil || len(payload) == 0 || samples <= 0 || samples > len(pcm) {
+		return 0
+	}
+	n := C.opus_decode(d.st, (*C.uchar)(unsafe.Pointer(&payload[0])), C.opus_int32(len(payload)),
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])), C.int(samples), 1)
+	if n < 0 {
+		return 0
+	}
+	return int(n)
+}
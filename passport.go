@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Without a speech synthesizer, the passport line beeps once per stamp,
+// or once low for an empty passport
+const (
+	PASSPORT_BEEP_FREQ  = 660.0 // Hz
+	PASSPORT_EMPTY_FREQ = 400.0 // Hz
+)
+
+// passportStamp records a caller's visits to one destination
+type passportStamp struct {
+	Destination string    `json:"destination"`
+	Place       string    `json:"place"` // City, description or name, for reading out
+	Country     string    `json:"country,omitempty"`
+	First       time.Time `json:"first"`
+	Last        time.Time `json:"last"`
+	Visits      int       `json:"visits"`
+}
+
+// passportBook holds every caller's passport, in the state store so it
+// survives restarts
+type passportBook struct {
+	mu       sync.Mutex
+	store    *stateStore
+	key      string
+	passport map[string][]passportStamp // Caller ID -> stamps, oldest first
+}
+
+// newPassportBook loads an exchange's passports from the store
+func newPassportBook(store *stateStore, exchange string) (*passportBook, error) {
+	book := &passportBook{store: store, key: "passports/" + exchange}
+	if _, err := store.Load(book.key, &book.passport); err != nil {
+		return nil, err
+	}
+	if book.passport == nil {
+		book.passport = make(map[string][]passportStamp)
+	}
+	return book, nil
+}
+
+// Stamp records a visit by caller to a destination, reporting whether it
+// earned a new stamp
+func (b *passportBook) Stamp(caller, name string, dest DestinationConfig, at time.Time) (passportStamp, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stamps := b.passport[caller]
+	i := slices.IndexFunc(stamps, func(s passportStamp) bool { return s.Destination == name })
+	first := i < 0
+	if first {
+		stamps = append(stamps, passportStamp{Destination: name, Place: placeName(name, dest), Country: dest.Country, First: at})
+		i = len(stamps) - 1
+	}
+	stamps[i].Last = at
+	stamps[i].Visits++
+	b.passport[caller] = stamps
+	return stamps[i], first, b.store.Save(b.key, b.passport)
+}
+
+// Stamps returns a copy of caller's stamps, oldest first
+func (b *passportBook) Stamps(caller string) []passportStamp {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.passport[caller])
+}
+
+// placeName is how a destination is named in a passport
+func placeName(name string, dest DestinationConfig) string {
+	return cmp.Or(dest.City, dest.Description, name)
+}
+
+// passportEvent is sent to the passport webhook, e.g. for a printer to
+// make a souvenir from
+type passportEvent struct {
+	Event    string          `json:"event"` // "stamp" or "reading"
+	Exchange string          `json:"exchange"`
+	Caller   string          `json:"caller"`
+	Stamp    *passportStamp  `json:"stamp,omitempty"` // The new stamp, for "stamp"
+	Stamps   []passportStamp `json:"stamps"`
+	Time     time.Time       `json:"time"`
+}
+
+// stampPassport records the caller's visit to a destination. Passport,
+// action and admin destinations aren't places, so they aren't stamped.
+func (s *SIPServer) stampPassport(session *CallSession, name string, dest DestinationConfig) {
+	ex := session.exchange
+	caller := session.caller()
+	if !ex.config.Passport.Enabled || caller == "" || dest.Type == "passport" || dest.Type == "action" || dest.Type == "admin" {
+		return
+	}
+
+	stamp, first, err := ex.passports.Stamp(caller, name, dest, time.Now())
+	if err != nil {
+		log.Printf("⚠️  Failed to save passport stamp: %v", err)
+	}
+	if !first {
+		return
+	}
+	stamps := ex.passports.Stamps(caller)
+	fmt.Printf("🛂 %s's passport stamped for %s (%d in all)\n", caller, stamp.Place, len(stamps))
+	s.sendPassportEvent(ex, passportEvent{Event: "stamp", Caller: caller, Stamp: &stamp, Stamps: stamps})
+}
+
+// sendPassportEvent posts an event to the passport webhook, if there is
+// one, without holding up the call
+func (s *SIPServer) sendPassportEvent(ex *exchange, event passportEvent) {
+	webhook := ex.config.Passport.Webhook
+	if webhook == "" {
+		return
+	}
+	event.Exchange = ex.name
+	event.Time = time.Now()
+	if event.Stamps == nil {
+		event.Stamps = []passportStamp{} // Sent as [], not null
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("❌ Failed to encode passport event: %v", err)
+		return
+	}
+
+	s.spawn(func() {
+		ctx, cancel := context.WithTimeout(s.ctx, ACTION_TIMEOUT)
+		defer cancel()
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("❌ Passport webhook failed: %v", err)
+			return
+		}
+		request.Header.Set("Content-Type", "application/json")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			log.Printf("❌ Passport webhook failed: %v", err)
+			return
+		}
+		response.Body.Close()
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			log.Printf("❌ Passport webhook answered %s", response.Status)
+		}
+	})
+}
+
+// passportText is what the passport line says
+func passportText(caller string, stamps []passportStamp) string {
+	if len(stamps) == 0 {
+		return fmt.Sprintf("Passport for %s. No stamps yet. Bon voyage!", caller)
+	}
+
+	var text strings.Builder
+	if len(stamps) == 1 {
+		fmt.Fprintf(&text, "Passport for %s. 1 stamp.", caller)
+	} else {
+		fmt.Fprintf(&text, "Passport for %s. %d stamps.", caller, len(stamps))
+	}
+	for _, stamp := range stamps {
+		fmt.Fprintf(&text, " %s, first visited %s", stamp.Place, stamp.First.Format("January 2"))
+		if stamp.Visits > 1 {
+			fmt.Fprintf(&text, ", %d visits", stamp.Visits)
+		}
+		text.WriteString(".")
+	}
+	return text.String()
+}
+
+// runPassport reads back the caller's travels: every stamp in their
+// passport, spoken by the speech synthesizer or, without one, a beep per
+// stamp. Each reading is also sent to the webhook.
+func (s *SIPServer) runPassport(session *CallSession, name string) {
+	ex := session.exchange
+	caller := session.caller()
+	if caller == "" {
+		fmt.Printf("🛂 Passport %q: anonymous callers have no passport\n", name)
+		s.playTone(session.ctx, session, defaultActionPrompt(false))
+		return
+	}
+
+	stamps := ex.passports.Stamps(caller)
+	fmt.Printf("🛂 Reading %s's passport: %d stamps\n", caller, len(stamps))
+	s.sendPassportEvent(ex, passportEvent{Event: "reading", Caller: caller, Stamps: stamps})
+
+	beeps := newBeeps(len(stamps), PASSPORT_BEEP_FREQ)
+	if len(stamps) == 0 {
+		beeps = newBeeps(1, PASSPORT_EMPTY_FREQ)
+	}
+	s.speak(session, passportText(caller, stamps), beeps)
+}
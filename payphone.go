@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// A red box plays 1700 and 2200 Hz together: one 66ms pulse for a
+	// nickel, two for a dime, five of 33ms for a quarter
+	COIN_FREQ1 = 1700.0 // Hz
+	COIN_FREQ2 = 2200.0 // Hz
+
+	// COIN_MAX_PULSE is the longest pulse that counts; anything longer is
+	// someone whistling, not a coin
+	COIN_MAX_PULSE = 120 * time.Millisecond
+
+	// COIN_GAP is the silence that ends a coin's pulses
+	COIN_GAP = 150 * time.Millisecond
+
+	// PAYPHONE_DEMAND_FREQ is the tone the operator's demands fall back to
+	// without a speech synthesizer
+	PAYPHONE_DEMAND_FREQ = 1400.0 // Hz
+
+	// PAYPHONE_GOODBYE_WAIT bounds the wait for the goodbye to play before
+	// a call that ran out of money is cut off
+	PAYPHONE_GOODBYE_WAIT = 10 * time.Second
+)
+
+// coinValues maps the number of pulses a coin sounds to its value in cents
+var coinValues = map[int]int{1: 5, 2: 10, 5: 25}
+
+// coinDetector turns red box tones in a call's audio into coins
+type coinDetector struct {
+	onCoin  func(cents int)
+	on      bool // In a pulse
+	blocks  int  // Blocks since the pulse started or ended
+	pulses  int  // Pulses of the current coin
+	invalid bool // A pulse was too long
+}
+
+// Block looks at the next block of received audio
+func (c *coinDetector) Block(block []float64) {
+	present := tonesPresent(block, COIN_FREQ1, COIN_FREQ2)
+	blockTime := time.Second / (SAMPLE_RATE / TONE_BLOCK)
+
+	if present != c.on {
+		if present {
+			c.pulses++
+		}
+		c.on, c.blocks = present, 0
+	}
+	c.blocks++
+	duration := time.Duration(c.blocks) * blockTime
+
+	if c.on && duration > COIN_MAX_PULSE {
+		c.invalid = true
+	}
+	if !c.on && c.pulses > 0 && duration >= COIN_GAP {
+		if cents, ok := coinValues[c.pulses]; ok && !c.invalid {
+			c.onCoin(cents)
+		} else {
+			fmt.Printf("🪙 Ignoring %d coin tone pulses\n", c.pulses)
+		}
+		c.pulses, c.invalid = 0, false
+	}
+}
+
+// coinBox holds the money deposited on a payphone call
+type coinBox struct {
+	mu        sync.Mutex
+	credit    int           // Cents deposited and not yet spent
+	deposited chan struct{} // Signalled on each coin
+
+	dialable  atomic.Bool // The deposit is in; dialing may start
+	demanding atomic.Bool // Asking for the deposit right now
+	metering  sync.Once
+}
+
+// newCoinBox creates an empty coin box
+func newCoinBox() *coinBox {
+	return &coinBox{deposited: make(chan struct{}, 1)}
+}
+
+// Deposit adds a coin, returning the credit
+func (b *coinBox) Deposit(cents int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.credit += cents
+	select {
+	case b.deposited <- struct{}{}:
+	default:
+	}
+	return b.credit
+}
+
+// Credit is the money deposited and not yet spent
+func (b *coinBox) Credit() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.credit
+}
+
+// Take spends cents of the credit, reporting false if there isn't enough
+func (b *coinBox) Take(cents int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.credit < cents {
+		return false
+	}
+	b.credit -= cents
+	return true
+}
+
+// Deposited is signalled when a coin goes in
+func (b *coinBox) Deposited() <-chan struct{} {
+	return b.deposited
+}
+
+// isPayphone reports whether a call comes from a payphone
+func isPayphone(cfg PayphoneConfig, session *CallSession) bool {
+	if !cfg.Enabled || session.dialog == nil {
+		return false
+	}
+	return len(cfg.Phones) == 0 || slices.Contains(cfg.Phones, session.caller())
+}
+
+// formatMoney says an amount of money, e.g. "1 dollar and 25 cents"
+func formatMoney(cents int) string {
+	var parts []string
+	if cents >= 100 {
+		parts = append(parts, countOf(cents/100, "dollar"))
+	}
+	if cents%100 != 0 || cents == 0 {
+		parts = append(parts, countOf(cents%100, "cent"))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// startPayphone sets up a payphone call: the line stays silent, as on a
+// coin-first payphone, until the deposit is in, then dial tone starts
+func (s *SIPServer) startPayphone(session *CallSession) {
+	cfg := session.exchange.config.Payphone
+	coins := newCoinBox()
+	session.coins = coins
+	detector := &coinDetector{onCoin: func(cents int) {
+		credit := coins.Deposit(cents)
+		fmt.Printf("🪙 %d¢ deposited (%d¢ in all)\n", cents, credit)
+	}}
+	session.tones.Watch(detector.Block)
+
+	s.spawn(func() {
+		fmt.Printf("🪙 Payphone %s: waiting for %s\n", session.caller(), formatMoney(cfg.Deposit))
+		for coins.Credit() < cfg.Deposit {
+			select {
+			case <-coins.Deposited():
+			case <-session.ctx.Done():
+				return
+			}
+		}
+		coins.dialable.Store(true)
+		session.DialToneActive.Store(true)
+		s.generateDialTone(session)
+	})
+}
+
+// demandDeposit has the operator ask for what is still owed on a payphone
+// before dialing
+func (s *SIPServer) demandDeposit(session *CallSession) {
+	coins := session.coins
+	if !coins.demanding.CompareAndSwap(false, true) {
+		return
+	}
+	owed := session.exchange.config.Payphone.Deposit - coins.Credit()
+	fmt.Printf("🪙 Dialing before paying; %d¢ owed\n", owed)
+	s.spawn(func() {
+		defer coins.demanding.Store(false)
+		s.speak(session, fmt.Sprintf("Please deposit %s.", formatMoney(owed)), newBeeps(2, PAYPHONE_DEMAND_FREQ))
+	})
+}
+
+// meterPayphone charges a payphone call for its time once it connects.
+// The deposit buys the first period; after each, the operator asks for
+// more, and the call is cut off if it doesn't come within the grace
+// period. Money deposited ahead pays for later periods without asking.
+func (s *SIPServer) meterPayphone(session *CallSession) {
+	cfg := session.exchange.config.Payphone
+	session.coins.Take(cfg.Deposit)
+	period := time.Duration(cfg.Minutes) * time.Minute
+	overtime := cfg.overtime()
+
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-session.ctx.Done():
+			return
+		}
+
+		if !session.coins.Take(overtime) {
+			fmt.Printf("🪙 Time's up on %s; asking for %s\n", session.CallID, formatMoney(overtime))
+			demand := fmt.Sprintf("Please deposit %s for the next %s.", formatMoney(overtime), countOf(cfg.Minutes, "minute"))
+			session.interrupt(speech(session, demand, newBeeps(2, PAYPHONE_DEMAND_FREQ)))
+
+			if !awaitPayment(session, overtime, time.Duration(cfg.GraceSeconds)*time.Second) {
+				if session.ctx.Err() != nil {
+					return
+				}
+				fmt.Printf("🪙 No money for %s; cutting it off\n", session.CallID)
+				goodbye := session.interrupt(speech(session, "Thank you for calling. Goodbye.", defaultActionPrompt(false)))
+				select {
+				case <-goodbye:
+				case <-time.After(PAYPHONE_GOODBYE_WAIT):
+				case <-session.ctx.Done():
+					return
+				}
+				s.hangupCall(session)
+				return
+			}
+		}
+		fmt.Printf("🪙 %s paid for another %s (%d¢ left)\n", session.CallID, countOf(cfg.Minutes, "minute"), session.coins.Credit())
+		timer.Reset(period)
+	}
+}
+
+// awaitPayment waits up to grace for enough coins to pay cents, and takes
+// them. It reports false if they don't come in time or the call ends.
+func awaitPayment(session *CallSession, cents int, grace time.Duration) bool {
+	deadline := time.After(grace)
+	for !session.coins.Take(cents) {
+		select {
+		case <-session.coins.Deposited():
+		case <-deadline:
+			return false
+		case <-session.ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// startMeter starts charging a payphone call for its time, once however
+// many destinations it goes on to
+func (s *SIPServer) startMeter(session *CallSession) {
+	if session.coins == nil {
+		return
+	}
+	session.coins.metering.Do(func() {
+		s.spawn(func() { s.meterPayphone(session) })
+	})
+}
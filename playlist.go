@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// parsePlaylist reads the entries of an M3U or PLS playlist. Relative
+// entries are resolved against the playlist's directory; streams (URLs)
+// are skipped, since only local WAV files can be played.
+func parsePlaylist(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open playlist: %v", err)
+	}
+	defer f.Close()
+
+	pls := strings.EqualFold(filepath.Ext(path), ".pls")
+	type plsEntry struct {
+		number int
+		path   string
+	}
+	var plsEntries []plsEntry
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for first := true; scanner.Scan(); first = false {
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff") // Byte order mark
+		}
+
+		if pls {
+			// PLS: an INI file with File1=..., File2=... under [playlist]
+			key, value, ok := strings.Cut(line, "=")
+			if !ok || !strings.HasPrefix(strings.ToLower(key), "file") {
+				continue
+			}
+			number, err := strconv.Atoi(key[len("file"):])
+			if err != nil {
+				continue
+			}
+			plsEntries = append(plsEntries, plsEntry{number, strings.TrimSpace(value)})
+			continue
+		}
+		// M3U: one path per line; #EXTM3U, #EXTINF and the like are comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read playlist: %v", err)
+	}
+	if pls {
+		slices.SortStableFunc(plsEntries, func(a, b plsEntry) int { return cmp.Compare(a.number, b.number) })
+		for _, entry := range plsEntries {
+			entries = append(entries, entry.path)
+		}
+	}
+
+	resolved := entries[:0]
+	for _, entry := range entries {
+		if strings.Contains(entry, "://") {
+			log.Printf("⚠️  Skipping stream %s in playlist %s", entry, path)
+			continue
+		}
+		if !filepath.IsAbs(entry) {
+			entry = filepath.Join(filepath.Dir(path), entry)
+		}
+		resolved = append(resolved, entry)
+	}
+	return resolved, nil
+}
+
+// playlistSource plays the files of a playlist back to back. Each entry is
+// decoded in the background while the one before it plays, and playback
+// runs straight from one into the next within the same frame, so there are
+// no gaps between entries.
+type playlistSource struct {
+	entries []string
+	shuffle bool
+	repeat  bool
+
+	order   []int        // Indices into entries for the current pass
+	next    int          // Position in order of the entry being loaded
+	loading chan []int16 // The next entry, decoded in the background
+	played  bool         // Whether any entry in this pass had audio
+
+	current []int16
+	pos     int
+	ended   bool
+}
+
+// newPlaylistSource plays entries in order, or shuffled, once or repeating.
+// A shuffled playlist is reshuffled on every pass.
+func newPlaylistSource(entries []string, shuffle, repeat bool) *playlistSource {
+	p := &playlistSource{entries: entries, shuffle: shuffle, repeat: repeat}
+	p.startPass()
+	p.load()
+	return p
+}
+
+// startPass sets up the order of the next pass through the playlist
+func (p *playlistSource) startPass() {
+	if p.shuffle {
+		last := -1
+		if len(p.order) > 0 {
+			last = p.order[len(p.order)-1]
+		}
+		p.order = rand.Perm(len(p.entries))
+		if p.order[0] == last && len(p.order) > 1 {
+			// Don't play the same entry twice running across passes
+			p.order[0], p.order[1] = p.order[1], p.order[0]
+		}
+	} else {
+		p.order = make([]int, len(p.entries))
+		for i := range p.order {
+			p.order[i] = i
+		}
+	}
+	p.next = 0
+	p.played = false
+}
+
+// load starts decoding the next entry. The channel is buffered, so the
+// loader never waits on a stream that has stopped reading.
+func (p *playlistSource) load() {
+	path := p.entries[p.order[p.next]]
+	p.next++
+	loading := make(chan []int16, 1)
+	p.loading = loading
+	go func() {
+		samples, err := loadWAV(path)
+		if err != nil {
+			log.Printf("⚠️  Skipping playlist entry %s: %v", path, err)
+		}
+		loading <- samples
+	}()
+}
+
+// advance moves on to the entry loaded in the background. It reports false
+// if it isn't ready yet, or the playlist has ended.
+func (p *playlistSource) advance() bool {
+	if p.loading == nil {
+		p.ended = true
+		return false
+	}
+
+	select {
+	case p.current = <-p.loading:
+	default:
+		return false // Still decoding; play silence meanwhile
+	}
+	p.pos = 0
+	p.played = p.played || len(p.current) > 0
+
+	p.loading = nil
+	if p.next == len(p.order) && p.repeat && p.played {
+		p.startPass()
+	}
+	if p.next < len(p.order) {
+		p.load()
+	}
+	return true
+}
+
+// ReadFrame fills the frame from the current entry, running on into the
+// next when it ends partway through
+func (p *playlistSource) ReadFrame(samples []int16) bool {
+	n := 0
+	for n < len(samples) && !p.ended {
+		if p.pos < len(p.current) {
+			copied := copy(samples[n:], p.current[p.pos:])
+			p.pos += copied
+			n += copied
+			continue
+		}
+		if !p.advance() {
+			break
+		}
+	}
+	if p.ended && n == 0 {
+		return false
+	}
+	clear(samples[n:])
+	return true
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	// Playout buffer configuration (all depths in samples at 8kHz)
+	PLAYOUT_MIN_DEPTH    = 2 * FRAME_SIZE   // 40ms
+	PLAYOUT_MAX_DEPTH    = 10 * FRAME_SIZE  // 200ms
+	PLAYOUT_CAPACITY     = 25 * FRAME_SIZE  // 500ms, hard limit before discarding
+	PLAYOUT_DEPTH_STEP   = FRAME_SIZE / 2   // 10ms target adjustment per underrun
+	PLAYOUT_DRIFT_SLACK  = FRAME_SIZE / 4   // 5ms tolerated before correcting
+	PLAYOUT_SHRINK_AFTER = 500 * FRAME_SIZE // 10s of clean playout before shrinking
+)
+
+// PlayoutStats is a snapshot of a playout buffer's state for diagnostics
+type PlayoutStats struct {
+	Depth       int     // Samples currently buffered
+	Target      int     // Current target depth
+	Underruns   int     // Pulls that ran out of audio
+	Overflows   int     // Pushes that exceeded capacity
+	Inserted    int     // Samples synthesized to compensate for a slow remote clock
+	Dropped     int     // Samples removed to compensate for a fast remote clock
+	DriftPPM    float64 // Estimated remote clock drift relative to ours
+	SamplesIn   int64   // Samples received from the network
+	SamplesOut  int64   // Samples handed to the consumer, including silence
+	PrimedPulls int64   // Pulls served from buffered audio
+	PrimedOut   int64   // Samples those pulls handed out
+}
+
+// playoutBuffer sits between an inbound 8kHz sample stream and a consumer
+// running on the server's own clock (a bridge leg, a recorder), a frame of
+// whatever packet time it sends at a time. The
+// ATA's clock and ours are never exactly the same, so on long calls the
+// buffer slowly fills or drains. The buffer tracks its smoothed depth and,
+// once it strays from the target, drops or duplicates a single sample at
+// the quietest point of a frame, which is inaudible at the rates involved.
+// The target depth itself grows on underruns and shrinks after long
+// stretches of clean playout to adapt to the network's jitter.
+type playoutBuffer struct {
+	mu sync.Mutex
+
+	ring []int16
+	head int // Index of the oldest sample
+	size int // Number of buffered samples
+
+	target   int
+	avgDepth float64
+	primed   bool
+	steer    int // +1 while dropping samples, -1 while inserting them, until back on target
+	clean    int // Samples played since the last underrun
+	last     int16
+
+	stats PlayoutStats
+}
+
+// newPlayoutBuffer creates an empty playout buffer at the minimum target depth
+func newPlayoutBuffer() *playoutBuffer {
+	return &playoutBuffer{
+		ring:   make([]int16, PLAYOUT_CAPACITY),
+		target: PLAYOUT_MIN_DEPTH,
+	}
+}
+
+// Push appends received samples to the buffer. If the buffer is full the
+// oldest audio is discarded so latency stays bounded.
+func (p *playoutBuffer) Push(samples []int16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, sample := range samples {
+		if p.size == len(p.ring) {
+			p.head = (p.head + 1) % len(p.ring)
+			p.size--
+			p.stats.Overflows++
+		}
+		p.ring[(p.head+p.size)%len(p.ring)] = sample
+		p.size++
+	}
+	p.stats.SamplesIn += int64(len(samples))
+
+	if !p.primed && p.size >= p.target {
+		p.primed = true
+		p.avgDepth = float64(p.size)
+	}
+}
+
+// Reset empties the buffer, as for a new consumer, which hears silence
+// until it fills to its target depth again. The target and statistics are
+// kept.
+func (p *playoutBuffer) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.head, p.size = 0, 0
+	p.avgDepth = 0
+	p.primed = false
+	p.steer = 0
+	p.clean = 0
+	p.last = 0
+}
+
+// Pull fills out with the next frame of audio. Until the buffer has reached
+// its target depth (initially, or after an underrun) it plays silence.
+func (p *playoutBuffer) Pull(out []int16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stats.SamplesOut += int64(len(out))
+
+	if !p.primed {
+		for i := range out {
+			out[i] = 0
+		}
+		return
+	}
+	p.stats.PrimedPulls++
+	p.stats.PrimedOut += int64(len(out))
+
+	// Smooth the depth so that jitter doesn't trigger corrections; only a
+	// sustained offset (i.e. clock drift) moves the average far enough. The
+	// average moves as fast in time whatever the frame size.
+	alpha := min(0.02*float64(len(out))/FRAME_SIZE, 1)
+	p.avgDepth = (1-alpha)*p.avgDepth + alpha*float64(p.size)
+	offset := p.avgDepth - float64(p.target)
+
+	// Correcting starts once the average strays past the slack and goes
+	// on until the depth itself is back on target, not just back within
+	// the slack, or the buffer would sit at the edge of it with less than
+	// its target's cushion against the next late packet. The average,
+	// which lags, starts afresh from there.
+	switch {
+	case p.steer > 0 && p.size <= p.target, p.steer < 0 && p.size >= p.target:
+		p.steer = 0
+		p.avgDepth = float64(p.size)
+	case offset > PLAYOUT_DRIFT_SLACK:
+		p.steer = 1
+	case offset < -PLAYOUT_DRIFT_SLACK:
+		p.steer = -1
+	}
+
+	switch {
+	case p.steer > 0 && p.size > len(out):
+		// Remote clock is fast: consume one extra sample this frame
+		p.readFrame(out, 1)
+		p.stats.Dropped++
+		p.avgDepth--
+	case p.steer < 0 && p.size >= len(out):
+		// Remote clock is slow: stretch this frame by one sample
+		p.readFrame(out, -1)
+		p.stats.Inserted++
+		p.avgDepth++
+	default:
+		p.readFrame(out, 0)
+	}
+
+	p.adaptTarget()
+	p.updateDrift()
+}
+
+// readFrame copies len(out) samples to out while consuming len(out)+adjust
+// samples from the ring. The sample dropped or duplicated is the one with
+// the smallest magnitude, where the discontinuity is least audible.
+func (p *playoutBuffer) readFrame(out []int16, adjust int) {
+	n := len(out)
+
+	if p.size < n+adjust {
+		// Underrun: play what we have, fade the remainder from the last
+		// sample, and wait for the buffer to refill to the target depth.
+		for i := 0; i < n; i++ {
+			if i < p.size {
+				out[i] = p.ring[(p.head+i)%len(p.ring)]
+				p.last = out[i]
+			} else {
+				p.last = p.last / 2
+				out[i] = p.last
+			}
+		}
+		p.head = (p.head + p.size) % len(p.ring)
+		p.size = 0
+		p.primed = false
+		p.steer = 0
+		p.clean = 0
+		p.stats.Underruns++
+		p.target = min(p.target+PLAYOUT_DEPTH_STEP, PLAYOUT_MAX_DEPTH)
+		return
+	}
+
+	pivot := -1
+	if adjust != 0 {
+		quietest := int32(1 << 16)
+		for i := 1; i < n-1; i++ {
+			sample := int32(p.ring[(p.head+i)%len(p.ring)])
+			if sample < 0 {
+				sample = -sample
+			}
+			if sample < quietest {
+				quietest = sample
+				pivot = i
+			}
+		}
+	}
+
+	src := 0
+	for i := 0; i < n; i++ {
+		if i == pivot && adjust > 0 {
+			src++ // Skip the quietest sample
+		}
+		out[i] = p.ring[(p.head+src)%len(p.ring)]
+		if i == pivot && adjust < 0 {
+			continue // Repeat the quietest sample by not advancing
+		}
+		src++
+	}
+	p.last = out[n-1]
+
+	consumed := n + adjust
+	p.head = (p.head + consumed) % len(p.ring)
+	p.size -= consumed
+	p.clean += n
+}
+
+// adaptTarget slowly lowers the target depth after a long run of clean
+// playout, reclaiming latency added by earlier jitter bursts.
+func (p *playoutBuffer) adaptTarget() {
+	if p.clean >= PLAYOUT_SHRINK_AFTER && p.target > PLAYOUT_MIN_DEPTH {
+		p.target = max(p.target-PLAYOUT_DEPTH_STEP, PLAYOUT_MIN_DEPTH)
+		p.clean = 0
+	}
+}
+
+// updateDrift estimates the remote clock's deviation from ours from the net
+// number of samples we had to insert or drop over the primed playout time.
+func (p *playoutBuffer) updateDrift() {
+	played := p.stats.PrimedOut
+	if played == 0 {
+		return
+	}
+	net := float64(p.stats.Dropped - p.stats.Inserted)
+	p.stats.DriftPPM = net / float64(played) * 1e6
+}
+
+// Stats returns a snapshot of the buffer's counters
+func (p *playoutBuffer) Stats() PlayoutStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Depth = p.size
+	stats.Target = p.target
+	return stats
+}
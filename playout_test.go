@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// PLAYOUT_TEST_SECONDS is how long each skewed stream is played for
+const PLAYOUT_TEST_SECONDS = 600
+
+// playSkewed pushes a tone into p as from a phone whose clock runs ppm
+// fast (or slow, if negative), a packet whenever a frame's worth of its
+// samples has accumulated, and pulls a frame on our clock every 20ms. It
+// returns the least and most the buffer held before each pull, once the
+// first minute has let it settle.
+func playSkewed(p *playoutBuffer, ppm float64, seconds int) (least, most int) {
+	least, most = math.MaxInt, 0
+	packet := make([]int16, FRAME_SIZE)
+	out := make([]int16, FRAME_SIZE)
+	phase, owed := 0.0, 0.0
+	ticks := seconds * 1000 / 20
+	for tick := range ticks {
+		for owed += FRAME_SIZE * (1 + ppm/1e6); owed >= FRAME_SIZE; owed -= FRAME_SIZE {
+			for i := range packet {
+				packet[i] = int16(8000 * math.Sin(phase))
+				phase += 2 * math.Pi * 1004 / SAMPLE_RATE
+			}
+			p.Push(packet)
+		}
+		if tick >= ticks/10 {
+			depth := p.Stats().Depth
+			least, most = min(least, depth), max(most, depth)
+		}
+		p.Pull(out)
+	}
+	return least, most
+}
+
+func TestPlayoutDriftCompensation(t *testing.T) {
+	for _, ppm := range []float64{-1000, -100, 100, 1000} {
+		p := newPlayoutBuffer()
+		least, most := playSkewed(p, ppm, PLAYOUT_TEST_SECONDS)
+		stats := p.Stats()
+
+		// The buffer holds its target, give or take a packet and the slack
+		// it tolerates, however long the clocks drift apart
+		if low := stats.Target - FRAME_SIZE - PLAYOUT_DRIFT_SLACK; least < low {
+			t.Errorf("%+g ppm: depth fell to %d, want at least %d", ppm, least, low)
+		}
+		if high := stats.Target + FRAME_SIZE + PLAYOUT_DRIFT_SLACK; most > high {
+			t.Errorf("%+g ppm: depth rose to %d, want at most %d", ppm, most, high)
+		}
+		if stats.Underruns != 0 || stats.Overflows != 0 {
+			t.Errorf("%+g ppm: %d underrun(s) and %d overflow(s), want none", ppm, stats.Underruns, stats.Overflows)
+		}
+
+		// by dropping or inserting a sample as often as the skew calls for
+		want := math.Abs(ppm) / 1e6 * SAMPLE_RATE * PLAYOUT_TEST_SECONDS
+		corrected, wrong := stats.Dropped, stats.Inserted
+		if ppm < 0 {
+			corrected, wrong = stats.Inserted, stats.Dropped
+		}
+		// Packets arrive whole, so the correction lags the skew by up to one
+		if math.Abs(float64(corrected)-want) > want/10+FRAME_SIZE || wrong > 0 {
+			t.Errorf("%+g ppm: %d dropped and %d inserted, want about %.0f %s", ppm, stats.Dropped, stats.Inserted, want, map[bool]string{true: "dropped", false: "inserted"}[ppm > 0])
+		}
+		if slack := math.Abs(ppm)/10 + FRAME_SIZE/float64(stats.PrimedOut)*1e6; math.Abs(stats.DriftPPM-ppm) > slack {
+			t.Errorf("%+g ppm: drift estimated at %.1f ppm", ppm, stats.DriftPPM)
+		}
+	}
+}
+
+func TestPlayoutReset(t *testing.T) {
+	p := newPlayoutBuffer()
+	playSkewed(p, 1000, 10)
+	before := p.Stats()
+	p.Reset()
+	after := p.Stats()
+
+	if after.Depth != 0 {
+		t.Errorf("depth %d after reset, want 0", after.Depth)
+	}
+	if after.Target != before.Target || after.Dropped != before.Dropped || after.SamplesIn != before.SamplesIn {
+		t.Errorf("reset changed the target or counters: %+v, was %+v", after, before)
+	}
+
+	// Until it fills to its target again, it plays silence
+	out := make([]int16, FRAME_SIZE)
+	p.Push(make([]int16, p.target-1))
+	for i := range out {
+		out[i] = 1
+	}
+	p.Pull(out)
+	for i, sample := range out {
+		if sample != 0 {
+			t.Fatalf("sample %d is %d before the buffer refilled, want silence", i, sample)
+		}
+	}
+	if p.Stats().PrimedPulls != before.PrimedPulls {
+		t.Errorf("pull before refilling was served from the buffer")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	// Packet loss concealment, after ITU-T G.711 Appendix I (all lengths
+	// in samples at 8kHz)
+	PLC_MIN_PITCH   = 40                        // 5ms, a 200 Hz voice
+	PLC_MAX_PITCH   = 120                       // 15ms, a 66 Hz voice
+	PLC_MATCH       = 160                       // 20ms of the latest audio the pitch is found from
+	PLC_HISTORY     = PLC_MATCH + PLC_MAX_PITCH // 35ms, enough to repeat up to three periods
+	PLC_FULL        = 80                        // 10ms concealed at full volume before fading
+	PLC_WIDEN       = 80                        // 10ms before each widening of what is repeated
+	PLC_MAX_PERIODS = 3                         // Periods repeated at most
+	PLC_MAX_CONCEAL = 480                       // 60ms, by when it has faded to silence
+	PLC_OVERLAP     = 32                        // 4ms blended into the audio after a loss
+)
+
+// lossConcealer fills the gaps lost packets leave in a call's received
+// audio. It finds the pitch period of the audio before a loss and repeats
+// it, widening to the last two and three periods as the loss goes on so
+// that the repetition doesn't buzz, and fading to silence over 60ms. When
+// audio arrives again, its start is blended with the concealment.
+type lossConcealer struct {
+	history [PLC_HISTORY]int16 // The latest audio, newest last
+	filled  int                // Samples of history received so far
+	frame   int                // Samples in the latest frame
+
+	pitch   int // Period being repeated
+	periods int // How many of the last periods are repeated
+	offset  int // Where in them the next sample comes from
+	lost    int // Samples concealed since the loss began; 0 with no loss
+}
+
+// Conceal fills out with audio to stand in for what was lost, returning
+// how many samples it made: none without enough audio before the loss to
+// go on, and no more than PLC_MAX_CONCEAL for one loss
+func (c *lossConcealer) Conceal(out []int16) int {
+	if c.filled < PLC_HISTORY {
+		return 0
+	}
+	if c.lost == 0 {
+		c.pitch, c.periods, c.offset = c.findPitch(), 1, 0
+	}
+	n := min(len(out), max(PLC_MAX_CONCEAL-c.lost, 0))
+	for i := range n {
+		out[i] = c.next()
+	}
+	return n
+}
+
+// Received takes a frame of audio that arrived, blending its start with
+// the concealment if it ends a loss
+func (c *lossConcealer) Received(frame []int16) {
+	if c.lost > 0 {
+		overlap := min(PLC_OVERLAP, len(frame))
+		for i := range overlap {
+			weight := float64(i+1) / float64(overlap+1)
+			frame[i] = int16(float64(c.next())*(1-weight) + float64(frame[i])*weight)
+		}
+		c.lost = 0
+	}
+
+	if len(frame) >= PLC_HISTORY {
+		copy(c.history[:], frame[len(frame)-PLC_HISTORY:])
+	} else {
+		copy(c.history[:], c.history[len(frame):])
+		copy(c.history[PLC_HISTORY-len(frame):], frame)
+	}
+	c.filled = min(c.filled+len(frame), PLC_HISTORY)
+	c.frame = len(frame)
+}
+
+// next is the next sample of the concealment: the repeated periods, at
+// full volume for PLC_FULL and then fading
+func (c *lossConcealer) next() int16 {
+	if c.lost > 0 && c.lost%PLC_WIDEN == 0 && c.periods < PLC_MAX_PERIODS {
+		c.periods++
+		c.offset += c.pitch // The same sample, a period further from the end
+	}
+	span := c.periods * c.pitch
+	sample := c.history[PLC_HISTORY-span+c.offset]
+	c.offset = (c.offset + 1) % span
+
+	gain := 1.0
+	if c.lost >= PLC_FULL {
+		gain = max(1-float64(c.lost-PLC_FULL)/float64(PLC_MAX_CONCEAL-PLC_FULL), 0)
+	}
+	c.lost++
+	return int16(float64(sample) * gain)
+}
+
+// findPitch finds the period that best matches the latest audio with the
+// audio before it, so that repeating it carries on smoothly from the end
+func (c *lossConcealer) findPitch() int {
+	latest := c.history[PLC_HISTORY-PLC_MATCH:]
+	best, bestScore := PLC_MIN_PITCH, math.Inf(-1)
+	for lag := PLC_MIN_PITCH; lag <= PLC_MAX_PITCH; lag++ {
+		earlier := c.history[PLC_HISTORY-PLC_MATCH-lag : PLC_HISTORY-lag]
+		var correlation, energy float64
+		for i, sample := range latest {
+			correlation += float64(sample) * float64(earlier[i])
+			energy += float64(earlier[i]) * float64(earlier[i])
+		}
+		if energy == 0 {
+			continue
+		}
+		if score := correlation / math.Sqrt(energy); score > bestScore {
+			best, bestScore = lag, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"cmp"
+	"time"
+)
+
+const (
+	// Special information tones (Telcordia SR-2275): three rising
+	// segments, each low or high and short or long, whose pattern tells
+	// why a call failed, ahead of the announcement explaining it
+	SIT_LOW1  = 913.8  // Hz
+	SIT_HIGH1 = 985.2  // Hz
+	SIT_LOW2  = 1370.6 // Hz
+	SIT_HIGH2 = 1428.5 // Hz
+	SIT_THIRD = 1776.7 // Hz
+	SIT_SHORT = 274 * time.Millisecond
+	SIT_LONG  = 380 * time.Millisecond
+
+	// SIT_PAUSE is the silence after each SIT, where the announcement
+	// would be, before it sounds again
+	SIT_PAUSE = 4 * time.Second
+)
+
+// progressTones are the call progress tones a caller can hear, by name
+var progressTones = map[string][]cadenceStep{
+	"dial":     {{[]float64{DIAL_TONE_FREQ1, DIAL_TONE_FREQ2}, time.Second}},
+	"ringback": {{[]float64{RINGBACK_FREQ1, RINGBACK_FREQ2}, RINGBACK_ON}, {nil, RINGBACK_OFF}},
+	"busy":     {{[]float64{BUSY_FREQ1, BUSY_FREQ2}, BUSY_ON}, {nil, BUSY_OFF}},
+	"reorder":  {{[]float64{BUSY_FREQ1, BUSY_FREQ2}, REORDER_ON}, {nil, REORDER_OFF}},
+	"silence":  {{nil, time.Second}},
+
+	"sit_intercept":   sitTone(SIT_LOW1, SIT_SHORT, SIT_LOW2, SIT_SHORT), // Number changed or disconnected
+	"sit_vacant":      sitTone(SIT_HIGH1, SIT_LONG, SIT_LOW2, SIT_SHORT), // Number not assigned
+	"sit_reorder":     sitTone(SIT_LOW1, SIT_SHORT, SIT_HIGH2, SIT_LONG), // Equipment busy
+	"sit_no_circuit":  sitTone(SIT_HIGH1, SIT_LONG, SIT_HIGH2, SIT_LONG), // All circuits busy
+	"sit_ineffective": sitTone(SIT_LOW1, SIT_LONG, SIT_HIGH2, SIT_SHORT), // Call failed otherwise
+}
+
+// tonePlans are the dial, ringback, busy and reorder tones of other
+// countries' networks, standing in for the North American ones of
+// progressTones, after ITU-T E.180 Supplement 2
+var tonePlans = map[string]map[string][]cadenceStep{
+	"north_america": {},
+	"uk": {
+		"dial":     {{[]float64{350, 440}, time.Second}},
+		"ringback": {{[]float64{400, 450}, 400 * time.Millisecond}, {nil, 200 * time.Millisecond}, {[]float64{400, 450}, 400 * time.Millisecond}, {nil, 2 * time.Second}},
+		"busy":     {{[]float64{400}, 375 * time.Millisecond}, {nil, 375 * time.Millisecond}},
+		"reorder":  {{[]float64{400}, 400 * time.Millisecond}, {nil, 350 * time.Millisecond}, {[]float64{400}, 225 * time.Millisecond}, {nil, 525 * time.Millisecond}},
+	},
+	"etsi": {
+		"dial":     {{[]float64{425}, time.Second}},
+		"ringback": {{[]float64{425}, time.Second}, {nil, 4 * time.Second}},
+		"busy":     {{[]float64{425}, 500 * time.Millisecond}, {nil, 500 * time.Millisecond}},
+		"reorder":  {{[]float64{425}, 200 * time.Millisecond}, {nil, 200 * time.Millisecond}},
+	},
+	"germany": {
+		"dial":     {{[]float64{425}, time.Second}},
+		"ringback": {{[]float64{425}, time.Second}, {nil, 4 * time.Second}},
+		"busy":     {{[]float64{425}, 480 * time.Millisecond}, {nil, 480 * time.Millisecond}},
+		"reorder":  {{[]float64{425}, 240 * time.Millisecond}, {nil, 240 * time.Millisecond}},
+	},
+	"france": {
+		"dial":     {{[]float64{440}, time.Second}},
+		"ringback": {{[]float64{440}, 1500 * time.Millisecond}, {nil, 3500 * time.Millisecond}},
+		"busy":     {{[]float64{440}, 500 * time.Millisecond}, {nil, 500 * time.Millisecond}},
+		"reorder":  {{[]float64{440}, 250 * time.Millisecond}, {nil, 250 * time.Millisecond}},
+	},
+	"japan": {
+		"dial": {{[]float64{400}, time.Second}},
+		// 400 Hz warbling at 16 Hz, as two tones 16 Hz apart beat
+		"ringback": {{[]float64{392, 408}, time.Second}, {nil, 2 * time.Second}},
+		"busy":     {{[]float64{400}, 500 * time.Millisecond}, {nil, 500 * time.Millisecond}},
+		"reorder":  {{[]float64{400}, 500 * time.Millisecond}, {nil, 500 * time.Millisecond}},
+	},
+}
+
+// sitTone is a special information tone with the given first two
+// segments, each a frequency and duration, repeating after SIT_PAUSE
+func sitTone(first float64, firstFor time.Duration, second float64, secondFor time.Duration) []cadenceStep {
+	return []cadenceStep{
+		{[]float64{first}, firstFor},
+		{[]float64{second}, secondFor},
+		{[]float64{SIT_THIRD}, SIT_LONG},
+		{nil, SIT_PAUSE},
+	}
+}
+
+// progressState is a point in a call that the caller hears a progress
+// tone for; the dial plan's tones pick which, by these names
+type progressState string
+
+const (
+	progressDial       progressState = "dial"       // Off hook, waiting for digits
+	progressRingback   progressState = "ringback"   // The called phone is ringing
+	progressBusy       progressState = "busy"       // The called phone is busy, unregistered or didn't answer
+	progressReorder    progressState = "reorder"    // The call couldn't be put through
+	progressUnassigned progressState = "unassigned" // Nothing answers to the number dialed
+	progressIncomplete progressState = "incomplete" // Dialing timed out before the number was complete
+)
+
+// defaultProgressTones is the tone each call state gets when the dial plan
+// doesn't say
+var defaultProgressTones = map[progressState]string{
+	progressDial:       "dial",
+	progressRingback:   "ringback",
+	progressBusy:       "busy",
+	progressReorder:    "reorder",
+	progressUnassigned: "reorder",
+	progressIncomplete: "reorder",
+}
+
+// progressToneName names the tone the dial plan gives a call state
+func (c *Config) progressToneName(state progressState) string {
+	return cmp.Or(c.DialPlan.Tones[string(state)], defaultProgressTones[state])
+}
+
+// toneSteps is the cadence of a tone, by name, in the dial plan's tone
+// plan
+func (c *Config) toneSteps(name string) []cadenceStep {
+	if steps, ok := tonePlans[c.DialPlan.TonePlan][name]; ok {
+		return steps
+	}
+	return progressTones[name]
+}
+
+// progressTone creates the tone a caller hears in a call state, playing
+// until stopped
+func (c *Config) progressTone(state progressState) MediaSource {
+	return newCadence(c.toneSteps(c.progressToneName(state)))
+}
+
+// progressTone creates the tone the caller hears in a call state, from
+// the dial plan of the call's exchange
+func (session *CallSession) progressTone(state progressState) MediaSource {
+	return session.exchange.config.progressTone(state)
+}
+
+// playProgress plays the tone of a call state to a caller whose dialing
+// led nowhere, until they hang up
+func (s *SIPServer) playProgress(session *CallSession, state progressState) {
+	s.spawn(func() { s.playTone(session.ctx, session, session.progressTone(state)) })
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PROXY_BRANCH_PREFIX starts the Via branch of every request forwarded
+	// in proxy mode, telling their responses apart from those to our own
+	// requests, whose branches are upper case after the cookie
+	PROXY_BRANCH_PREFIX = RFC3261_MAGIC_COOKIE + "-proxy-"
+
+	// PROXY_MAX_FORWARDS is the hop limit given a forwarded request that
+	// arrived without one
+	PROXY_MAX_FORWARDS = 70
+)
+
+// proxyRequest forwards a request in proxy mode, statelessly (RFC 3261
+// section 16.11): to the phone registered as its request-URI's user, or
+// along the route a call recorded through us, with our Via on top and, on
+// a new call, our Record-Route so the rest of the call comes back this
+// way. Media goes between the phones. Only requests from registered phones
+// are forwarded, and only to registered phones, so the server can't be
+// used to relay anyone else's calls. It reports false for requests the
+// server answers itself: registrations, subscriptions and OPTIONS to it.
+func (s *SIPServer) proxyRequest(message string, remoteAddr *net.UDPAddr) bool {
+	lines, body := splitMessage(message)
+	method := getMethod(lines[0])
+	if method == "REGISTER" || method == "SUBSCRIBE" {
+		return false
+	}
+	parts := strings.Fields(lines[0])
+	if len(parts) < 3 {
+		return true
+	}
+	requestURI := parts[1]
+	headers := parseHeaders(message)
+
+	ex := s.exchangeFor(message)
+	if !s.registeredAt(ex, remoteAddr) {
+		switch method {
+		case "OPTIONS":
+			return false
+		case "ACK":
+		default:
+			log.Printf("🚫 Not proxying %s from %s: no phone is registered there", method, remoteAddr)
+			s.sendResponse(proxyRefusal(headers, "403 Forbidden"), remoteAddr)
+		}
+		return true
+	}
+
+	// A Route to us, recorded when the call was set up, is used up here.
+	// The only route we follow is our own: the phone the request is for is
+	// the next hop after it.
+	routes := headerValues(message, "Route")
+	if len(routes) > 0 && s.isProxyURI(uriFromHeader(routes[0], remoteAddr), remoteAddr) {
+		routes = routes[1:]
+		lines = withoutHeader(lines, "Route")
+	}
+	if len(routes) > 0 {
+		log.Printf("🚫 Not proxying %s from %s along a route we didn't record: %s", method, remoteAddr, routes[0])
+		if method != "ACK" {
+			s.sendResponse(proxyRefusal(headers, "403 Forbidden"), remoteAddr)
+		}
+		return true
+	}
+
+	ua, registered := s.registeredPhone(ex, contactUser(requestURI))
+	binding := s.bindingAt(ex, requestURI)
+	var next string
+	switch {
+	case binding != nil:
+		next = binding.String()
+	case registered:
+		requestURI = ua.contactURI() // Retargeted to the phone
+		next = ua.RemoteAddr.String()
+	case method == "OPTIONS":
+		return false
+	case method == "ACK":
+		return true
+	case ex.config.SIPUsers()[contactUser(requestURI)] != "":
+		s.sendResponse(proxyRefusal(headers, "480 Temporarily Unavailable"), remoteAddr)
+		return true
+	default:
+		s.sendResponse(proxyRefusal(headers, "404 Not Found"), remoteAddr)
+		return true
+	}
+	target, err := net.ResolveUDPAddr("udp", next)
+	if next == "" || err != nil {
+		log.Printf("❌ Can't proxy %s to %s: %v", method, next, err)
+		if method != "ACK" {
+			s.sendResponse(proxyRefusal(headers, "404 Not Found"), remoteAddr)
+		}
+		return true
+	}
+
+	// Max-Forwards stops a request looping between misconfigured proxies
+	hops := PROXY_MAX_FORWARDS
+	if value, ok := headers["Max-Forwards"]; ok {
+		hops, _ = strconv.Atoi(strings.TrimSpace(value))
+		if hops <= 0 {
+			if method != "ACK" {
+				s.sendResponse(proxyRefusal(headers, "483 Too Many Hops"), remoteAddr)
+			}
+			return true
+		}
+		lines = withoutHeader(lines, "Max-Forwards")
+	}
+
+	transport, port := s.sentBy(target)
+	forwarded := []string{
+		strings.Join([]string{parts[0], requestURI, parts[2]}, " "),
+		fmt.Sprintf("Via: SIP/2.0/%s %s;branch=%s;rport", transport, net.JoinHostPort(sipHost(s.localIPFor(target)), strconv.Itoa(port)), proxyBranch(topVia(lines), headers)),
+	}
+	if method == "INVITE" && headerTag(headers["To"]) == "" {
+		forwarded = append(forwarded, "Record-Route: <"+s.contactURI(remoteAddr)+";lr>")
+	}
+	forwarded = append(forwarded, fmt.Sprintf("Max-Forwards: %d", hops-1))
+	forwarded = append(forwarded, lines[1:]...)
+
+	fmt.Printf("🔀 Proxying %s from %s to %s\n", method, remoteAddr, target)
+	s.send(joinMessage(forwarded, body), target)
+	return true
+}
+
+// proxyResponse relays a response to a request forwarded in proxy mode
+// back the way the request came, reporting false if the request wasn't
+// one of those
+func (s *SIPServer) proxyResponse(message string) bool {
+	lines, body := splitMessage(message)
+	if !strings.HasPrefix(headerParam(topVia(lines), "branch"), PROXY_BRANCH_PREFIX) {
+		return false
+	}
+
+	// Our Via comes off; the one below it says where the request came from
+	top := viaLine(lines)
+	name, value, _ := strings.Cut(lines[top], ":")
+	if _, rest, _ := strings.Cut(value, ","); strings.TrimSpace(rest) != "" {
+		lines[top] = name + ": " + strings.TrimSpace(rest)
+	} else {
+		lines = append(lines[:top], lines[top+1:]...)
+	}
+	via := topVia(lines)
+	if via == "" {
+		return true // Nowhere to send it
+	}
+	target, err := net.ResolveUDPAddr("udp", viaAddress(via))
+	if err != nil {
+		log.Printf("❌ Can't relay a response to %s: %v", via, err)
+		return true
+	}
+	s.send(joinMessage(lines, body), target)
+	return true
+}
+
+// proxyRefusal is the final response to a request the proxy can't forward
+func proxyRefusal(headers map[string]string, status string) string {
+	if headerTag(headers["To"]) == "" {
+		headers["To"] += ";tag=" + newTag()
+	}
+	return dialogResponse(headers, status)
+}
+
+// isProxyURI reports whether uri names this server as remote reaches it,
+// as our Record-Route does
+func (s *SIPServer) isProxyURI(uri string, remoteAddr *net.UDPAddr) bool {
+	host, port, err := net.SplitHostPort(uriAddress(uri))
+	if err != nil {
+		return false
+	}
+	_, ourPort := s.sentBy(remoteAddr)
+	return host == s.localIPFor(remoteAddr) && port == strconv.Itoa(ourPort)
+}
+
+// bindingAt is the address of the phone registered on the exchange with
+// uri as its Contact, or nil; requests within a call are sent to a phone's
+// Contact
+func (s *SIPServer) bindingAt(ex *exchange, uri string) *net.UDPAddr {
+	for _, ua := range ex.registrar.Snapshot() {
+		if ua.contactURI() == uri && s.reachable(ua) {
+			return ua.RemoteAddr
+		}
+	}
+	return nil
+}
+
+// proxyBranch is the Via branch for forwarding a request. It is the same
+// each time the request is, and for a CANCEL as for the INVITE it cancels,
+// as a stateless proxy's must be (RFC 3261 section 16.11).
+func proxyBranch(via string, headers map[string]string) string {
+	id := headerParam(via, "branch")
+	if !strings.HasPrefix(id, RFC3261_MAGIC_COOKIE) {
+		// From a pre-RFC 3261 phone: the transaction is what it sent
+		id = via + headers["Call-ID"] + headerTag(headers["From"]) + strconv.Itoa(cseqNumber(headers["CSeq"]))
+	}
+	sum := sha256.Sum256([]byte(id))
+	return PROXY_BRANCH_PREFIX + hex.EncodeToString(sum[:8])
+}
+
+// uriAddress is the host and port a SIP URI names (see sipURI.Address),
+// or "" if it isn't one
+func uriAddress(uri string) string {
+	u, err := parseSIPURI(uri)
+	if err != nil {
+		return ""
+	}
+	return u.Address()
+}
+
+// viaAddress is where responses go for a Via value: the address the
+// request was received from if the Via was stamped with it, else its
+// sent-by
+func viaAddress(via string) string {
+	sentBy, _, _ := strings.Cut(via, ";")
+	if fields := strings.Fields(sentBy); len(fields) == 2 {
+		sentBy = fields[1]
+	}
+	host, port, err := net.SplitHostPort(sentBy)
+	if err != nil {
+		host, port = strings.Trim(sentBy, "[]"), strconv.Itoa(SIP_PORT)
+	}
+	if received := headerParam(via, "received"); received != "" {
+		host = received
+	}
+	if rport := headerParam(via, "rport"); rport != "" {
+		port = rport
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// splitMessage splits a SIP message into its start and header lines, and
+// its body
+func splitMessage(message string) ([]string, string) {
+	head, body, found := strings.Cut(message, "\r\n\r\n")
+	if !found {
+		head, body, _ = strings.Cut(message, "\n\n")
+	}
+	return splitLines(head), body
+}
+
+// joinMessage puts a message split by splitMessage back together
+func joinMessage(lines []string, body string) string {
+	return strings.Join(lines, "\r\n") + "\r\n\r\n" + body
+}
+
+// withoutHeader is header lines without any of the named header
+func withoutHeader(lines []string, name string) []string {
+	kept := lines[:1]
+	for _, line := range lines[1:] {
+		if key, _, _ := strings.Cut(line, ":"); canonicalHeader(key) != canonicalHeader(name) {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
+
+// topVia is the top Via value among header lines, or ""
+func topVia(lines []string) string {
+	i := viaLine(lines)
+	if i < 0 {
+		return ""
+	}
+	_, value, _ := strings.Cut(lines[i], ":")
+	via, _, _ := strings.Cut(value, ",")
+	return strings.TrimSpace(via)
+}
+
+// viaLine is the index of the first Via line, in full or compact form,
+// or -1
+func viaLine(lines []string) int {
+	for i, line := range lines {
+		if key, _, found := strings.Cut(line, ":"); i > 0 && found {
+			if canonicalHeader(key) == "Via" {
+				return i
+			}
+		}
+	}
+	return -1
+}
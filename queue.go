@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// POSITION_ANNOUNCE_INTERVAL is how often a waiting caller is reminded
+	// of their place in the queue when it hasn't changed
+	POSITION_ANNOUNCE_INTERVAL = 30 * time.Second
+
+	// Position beeps: one per place in the queue
+	POSITION_BEEP_FREQ = 660.0                  // Hz
+	POSITION_BEEP      = 160 * time.Millisecond // On, then as long off
+	POSITION_PAUSE     = 500 * time.Millisecond // Silence around the beeps
+)
+
+// callQueue limits how many callers a destination takes at once; the rest
+// wait their turn in order
+type callQueue struct {
+	mu       sync.Mutex
+	capacity int
+	active   int
+	waiting  []*queuedCall
+}
+
+// queuedCall is a caller waiting for a slot
+type queuedCall struct {
+	ready    chan struct{} // Closed when the caller is handed a slot
+	position chan int      // Latest position; only the newest value matters
+}
+
+// newCallQueue creates a queue letting capacity callers in at once
+func newCallQueue(capacity int) *callQueue {
+	return &callQueue{capacity: capacity}
+}
+
+// Enter takes a slot if one is free. Otherwise the caller joins the end of
+// the queue and must wait on the returned queuedCall.
+func (q *callQueue) Enter() (*queuedCall, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.active < q.capacity && len(q.waiting) == 0 {
+		q.active++
+		return nil, true
+	}
+
+	call := &queuedCall{
+		ready:    make(chan struct{}),
+		position: make(chan int, 1),
+	}
+	q.waiting = append(q.waiting, call)
+	call.position <- len(q.waiting)
+	return call, false
+}
+
+// Leave gives up a place in the queue. It reports false if the caller was
+// handed a slot in the meantime, which they must then release.
+func (q *callQueue) Leave(call *queuedCall) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, waiting := range q.waiting {
+		if waiting == call {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.updatePositions(i)
+			return true
+		}
+	}
+	return false
+}
+
+// Release frees a slot, handing it straight to the first caller waiting
+func (q *callQueue) Release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiting) == 0 {
+		q.active--
+		return
+	}
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	close(next.ready)
+	q.updatePositions(0)
+}
+
+// updatePositions tells callers from index from onwards their new place.
+// Must be called with mu held.
+func (q *callQueue) updatePositions(from int) {
+	for i := from; i < len(q.waiting); i++ {
+		position := q.waiting[i].position
+		select {
+		case <-position: // Drop the stale value
+		default:
+		}
+		position <- i + 1
+	}
+}
+
+// holdSource plays hold audio, interrupted by beeps announcing the caller's
+// position in the queue: one beep per place
+type holdSource struct {
+	mu       sync.Mutex
+	hold     MediaSource // nil for silence
+	announce MediaSource // The announcement still playing, if any
+}
+
+// newHoldSource creates a hold source over hold, which may be nil
+func newHoldSource(hold MediaSource) *holdSource {
+	return &holdSource{hold: hold}
+}
+
+// Announce queues the beeps for a position, replacing any not yet played
+func (h *holdSource) Announce(position int) {
+	pause := func() MediaSource {
+		return newPCMSource(make([]int16, int(POSITION_PAUSE.Seconds()*SAMPLE_RATE)), false)
+	}
+	beeps := newLimitedSource(newCadenceSource(POSITION_BEEP, POSITION_BEEP, POSITION_BEEP_FREQ), time.Duration(position)*2*POSITION_BEEP)
+	announce := newSequenceSource(pause(), beeps, pause())
+
+	h.mu.Lock()
+	h.announce = announce
+	h.mu.Unlock()
+}
+
+// ReadFrame plays the announcement if there is one, otherwise hold audio.
+// It never ends; the caller stops it when the wait is over.
+func (h *holdSource) ReadFrame(samples []int16) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.announce != nil {
+		if h.announce.ReadFrame(samples) {
+			return true
+		}
+		h.announce = nil
+	}
+	if h.hold == nil || !h.hold.ReadFrame(samples) {
+		clear(samples)
+	}
+	return true
+}
+
+// waitForSlot holds the caller in a capacity-limited destination's queue
+// until a slot frees up, playing hold audio and announcing their position
+// as it changes. It reports false if the caller hung up while waiting.
+func (s *SIPServer) waitForSlot(session *CallSession, name string, queue *callQueue) bool {
+	call, admitted := queue.Enter()
+	if admitted {
+		return true
+	}
+
+	cfg := session.exchange.config
+	dest := cfg.Destinations[name]
+	var hold MediaSource
+	if dest.Hold != "" {
+		source, err := openDestination(cfg, cfg.Destinations[dest.Hold])
+		if err != nil {
+			log.Printf("⚠️  Hold audio %q unavailable: %v", dest.Hold, err)
+		} else {
+			hold = source
+		}
+	}
+	source := newHoldSource(hold)
+
+	holding, stopHolding := context.WithCancel(session.ctx)
+	defer stopHolding()
+	s.spawn(func() { s.playTone(holding, session, source) })
+
+	reminder := time.NewTicker(POSITION_ANNOUNCE_INTERVAL)
+	defer reminder.Stop()
+
+	position := 0
+	for {
+		select {
+		case <-call.ready:
+			fmt.Printf("🎟️  A slot for %q freed up; connecting %s\n", name, session.CallID)
+			return true
+		case position = <-call.position:
+			fmt.Printf("⏳ %s is number %d in the queue for %q\n", session.CallID, position, name)
+			source.Announce(position)
+			reminder.Reset(POSITION_ANNOUNCE_INTERVAL)
+		case <-reminder.C:
+			source.Announce(position)
+		case <-session.ctx.Done():
+			if !queue.Leave(call) {
+				queue.Release() // Handed a slot just as the caller hung up
+			}
+			return false
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RECORDING_KEPT_PAUSE is how much of each silence a recording that
+// trims them keeps, in samples: 500ms, on top of the 400ms it takes to
+// tell that the caller has stopped talking
+const RECORDING_KEPT_PAUSE = SAMPLE_RATE / 2
+
+// callRecorder writes what a caller says to a WAV file, until the call
+// ends or writing fails. When trimming silence, the audio while the
+// caller isn't talking is held back, only the last RECORDING_KEPT_PAUSE
+// of it written once they talk again.
+type callRecorder struct {
+	mu   sync.Mutex
+	wav  *wavWriter
+	path string
+	trim bool
+	held []int16 // Silence held back, when trimming
+}
+
+// record adds audio received on a call, decoded to 8kHz, to its
+// recording, starting one with the first audio if recording is enabled
+func (session *CallSession) record(pcm []int16) {
+	session.recordOnce.Do(session.startRecording)
+	if session.recorder != nil {
+		session.recorder.Write(pcm, session.talking.Load())
+	}
+}
+
+// startRecording creates the call's recording, named by the exchange's
+// template, and has it closed when the call ends
+func (session *CallSession) startRecording() {
+	if session.exchange == nil || !session.exchange.config.Recording.Enabled {
+		return
+	}
+	cfg := session.exchange.config
+	name := recordingName(cfg.Recording.Filename, session.CallID, session.caller(), time.Now())
+	path := filepath.Join(cfg.ResolvePath(cfg.Recording.Directory), name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		log.Printf("❌ Failed to record call %s: %v", session.CallID, err)
+		return
+	}
+	wav, err := createWAV(path)
+	if err != nil {
+		log.Printf("❌ Failed to record call %s: %v", session.CallID, err)
+		return
+	}
+
+	fmt.Printf("🎙️  Recording call %s to %s\n", session.CallID, path)
+	session.recorder = &callRecorder{wav: wav, path: path, trim: cfg.Recording.TrimSilence}
+	context.AfterFunc(session.ctx, session.recorder.Close)
+}
+
+// recordingName fills in a recording's file name template. Anything in
+// the call's details that could lead out of the recording directory, or
+// trouble a shell, becomes an underscore.
+func recordingName(template, callID, caller string, start time.Time) string {
+	if caller == "" {
+		caller = "unknown"
+	}
+	return strings.NewReplacer(
+		"{call_id}", safeFilename(callID),
+		"{caller}", safeFilename(caller),
+		"{timestamp}", start.Format("20060102-150405"),
+	).Replace(template)
+}
+
+// safeFilename keeps letters, digits and ._@+- of s, replacing the rest
+// with underscores, and never gives "." or ".."
+func safeFilename(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("._@+-", r):
+			return r
+		}
+		return '_'
+	}, s)
+	if strings.Trim(s, ".") == "" {
+		return strings.Repeat("_", max(len(s), 1))
+	}
+	return s
+}
+
+// Write adds samples to the recording, received while the caller was
+// talking or not
+func (r *callRecorder) Write(pcm []int16, talking bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.wav == nil {
+		return
+	}
+	if r.trim && !talking {
+		r.held = append(r.held, pcm...)
+		if over := len(r.held) - RECORDING_KEPT_PAUSE; over > 0 {
+			r.held = r.held[:copy(r.held, r.held[over:])]
+		}
+		return
+	}
+
+	err := r.wav.Write(r.held)
+	r.held = r.held[:0]
+	if err == nil {
+		err = r.wav.Write(pcm)
+	}
+	if err != nil {
+		log.Printf("❌ Recording %s stopped: %v", r.path, err)
+		r.wav.Close()
+		r.wav = nil
+	}
+}
+
+// Close finishes the recording
+func (r *callRecorder) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.wav == nil {
+		return
+	}
+	length := time.Duration(r.wav.samples) * time.Second / SAMPLE_RATE
+	if err := r.wav.Close(); err != nil {
+		log.Printf("❌ Failed to finish recording %s: %v", r.path, err)
+	} else {
+		fmt.Printf("💾 Saved %v recording to %s\n", length.Round(time.Second), r.path)
+	}
+	r.wav = nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import "sync"
+
+const (
+	// DEFAULT_RED_PAYLOAD_TYPE is offered for RFC 2198 redundant audio when
+	// we place a call; on calls we answer the phone's own choice is used
+	DEFAULT_RED_PAYLOAD_TYPE = 100
+
+	// RED_BLOCK_HEADER_SIZE is the size of a redundant block's header; the
+	// primary block's header is a single byte
+	RED_BLOCK_HEADER_SIZE = 4
+
+	// RED_PACKET_SIZE fits a header, one redundant and one primary frame
+	RED_PACKET_SIZE = RTP_HEADER_SIZE + RED_BLOCK_HEADER_SIZE + 1 + 2*MAX_FRAME_SIZE
+)
+
+// redPacketPool recycles the larger buffers of redundant streams
+var redPacketPool = sync.Pool{
+	New: func() any {
+		packet := make([]byte, RED_PACKET_SIZE, RED_PACKET_SIZE+SRTP_MAX_TAG_SIZE)
+		return &packet
+	},
+}
+
+// enableRedundancy makes the stream send RFC 2198 redundant audio: every
+// packet carries the previous frame as well as the current one, so a
+// single lost packet, the common case on Wi-Fi, costs no audio
+func (st *rtpStream) enableRedundancy(payloadType byte) {
+	rtpPacketPool.Put(st.packet)
+	st.packet = redPacketPool.Get().(*[]byte)
+	st.redundant = true
+	st.payloadType = payloadType
+	st.previous = make([]byte, 0, MAX_FRAME_SIZE)
+
+	packet := *st.packet
+	packet[0] = 0x80
+	packet[1] = payloadType
+}
+
+// writeRedundantPayload lays out the RED payload after the RTP header: a
+// block for the previous frame, if any, then the current frame. It
+// returns the packet length.
+func (st *rtpStream) writeRedundantPayload(packet []byte, frame []int16) int {
+	n := RTP_HEADER_SIZE
+	if st.havePrevious {
+		// F=1, block PT, 14-bit timestamp offset, 10-bit block length
+		packet[n] = 0x80 | st.codecPayloadType
+		header := st.codec.frameTicks(st.ptime)<<10 | uint32(len(st.previous))
+		packet[n+1] = byte(header >> 16)
+		packet[n+2] = byte(header >> 8)
+		packet[n+3] = byte(header)
+		n += RED_BLOCK_HEADER_SIZE
+	}
+	packet[n] = st.codecPayloadType // F=0, primary
+	n++
+
+	if st.havePrevious {
+		n += copy(packet[n:], st.previous)
+	}
+	size := st.encoder.Encode(packet[n:n+len(st.samples)], frame)
+	st.previous = append(st.previous[:0], packet[n:n+size]...)
+	st.havePrevious = true
+	return n + size
+}
+
+// decodeRedundant splits a RED payload into its primary frame and, if
+// present, the redundant frame sent one packet interval earlier, taking
+// only blocks in the call's audio payload type
+func decodeRedundant(payload []byte, audio byte, frameTicks uint32) (primary, redundant []byte, ok bool) {
+	type block struct {
+		payloadType byte
+		offset      uint32
+		length      int
+	}
+
+	var blocks []block
+	n := 0
+	for {
+		if n >= len(payload) {
+			return nil, nil, false
+		}
+		if payload[n]&0x80 == 0 {
+			blocks = append(blocks, block{payloadType: payload[n] & 0x7F})
+			n++
+			break
+		}
+		if n+RED_BLOCK_HEADER_SIZE > len(payload) {
+			return nil, nil, false
+		}
+		header := uint32(payload[n+1])<<16 | uint32(payload[n+2])<<8 | uint32(payload[n+3])
+		blocks = append(blocks, block{
+			payloadType: payload[n] & 0x7F,
+			offset:      header >> 10,
+			length:      int(header & 0x3FF),
+		})
+		n += RED_BLOCK_HEADER_SIZE
+	}
+
+	for i, b := range blocks {
+		length := b.length
+		if i == len(blocks)-1 {
+			length = len(payload) - n // The primary takes the rest
+		}
+		if length < 0 || n+length > len(payload) {
+			return nil, nil, false
+		}
+		data := payload[n : n+length]
+		n += length
+
+		if b.payloadType != audio {
+			continue
+		}
+		switch {
+		case i == len(blocks)-1:
+			primary = data
+		case b.offset == frameTicks:
+			redundant = data
+		}
+	}
+	return primary, redundant, primary != nil
+}
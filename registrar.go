@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_REGISTRATIONS = 64
+
+	// A binding lasts as long as the phone asks, within registrar.min_expires
+	// and max_expires, or DEFAULT_REGISTER_EXPIRES if it doesn't say
+	DEFAULT_REGISTER_EXPIRES     = 3600
+	DEFAULT_MIN_REGISTER_EXPIRES = 60
+	DEFAULT_MAX_REGISTER_EXPIRES = 86400
+
+	// REGISTRATION_REAP_INTERVAL is how often expired bindings are removed
+	REGISTRATION_REAP_INTERVAL = 30 * time.Second
+
+	// DEFAULT_Q is the preference of a binding registered without a
+	// q-value; higher is tried first
+	DEFAULT_Q = 1.0
+)
+
+// errRegistrarFull is returned when the table is at its limit and no
+// expired registration can be evicted to make room
+var errRegistrarFull = errors.New("registration table is full")
+
+// errStaleRegister is returned for a REGISTER older than the one that
+// last updated a binding, arriving out of order
+var errStaleRegister = errors.New("out of order REGISTER")
+
+// RegisteredUA is one Contact binding of an address of record: where a
+// registered user agent (like our PAP2) can be reached
+type RegisteredUA struct {
+	AOR        string // Address of record: the user registered, e.g. "1001"
+	Contact    string
+	Q          float64 // Preference among the AOR's bindings, 0 to 1
+	Expires    time.Time
+	CallID     string
+	CSeq       int
+	RemoteAddr *net.UDPAddr
+	Transport  string // How it reached us: "UDP", "TCP", "TLS", "WS" or "WSS"
+	Missed     int    // Keepalive probes left unanswered in a row; offline if any
+}
+
+// contactURI is the binding's Contact URI, which identifies it within its
+// AOR
+func (ua *RegisteredUA) contactURI() string {
+	return uriFromHeader(ua.Contact, ua.RemoteAddr)
+}
+
+// registrar is the table of bindings, by address of record; a user may
+// register several phones. SIP handlers run in their own goroutines, so
+// every access goes through the mutex; readers such as the dashboard and
+// metrics get copies via Snapshot.
+type registrar struct {
+	mu      sync.RWMutex
+	entries map[string][]*RegisteredUA
+	max     int // Bindings, across every AOR
+}
+
+// newRegistrar creates an empty registrar holding at most max bindings
+func newRegistrar(max int) *registrar {
+	return &registrar{
+		entries: make(map[string][]*RegisteredUA),
+		max:     max,
+	}
+}
+
+// Register adds or refreshes a binding, matched within its AOR by Contact
+// URI. A REGISTER with the same Call-ID but an older CSeq than the one
+// the binding came from is refused with errStaleRegister. When the table
+// is full, already-expired bindings are evicted oldest first; if none
+// have expired the binding is refused with errRegistrarFull.
+func (r *registrar) Register(ua *RegisteredUA) (evicted []RegisteredUA, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry := *ua
+	if i := r.find(ua.AOR, ua.contactURI()); i >= 0 {
+		existing := r.entries[ua.AOR][i]
+		if existing.CallID == ua.CallID && ua.CSeq <= existing.CSeq {
+			return nil, errStaleRegister
+		}
+		r.entries[ua.AOR][i] = &entry
+		return nil, nil
+	}
+
+	if r.count() >= r.max {
+		evicted = r.evictExpired(r.count() - r.max + 1)
+		if r.count() >= r.max {
+			return evicted, errRegistrarFull
+		}
+	}
+	r.entries[ua.AOR] = append(r.entries[ua.AOR], &entry)
+	return evicted, nil
+}
+
+// Unregister removes an AOR's binding to a Contact URI, or all of its
+// bindings if contact is "*", and returns those removed. A binding last
+// updated by a later request in the same Call-ID is kept: the removal
+// arrived out of order.
+func (r *registrar) Unregister(aor, contact, callID string, cseq int) []RegisteredUA {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var removed []RegisteredUA
+	for i := len(r.entries[aor]) - 1; i >= 0; i-- {
+		ua := r.entries[aor][i]
+		if contact != "*" && !strings.EqualFold(ua.contactURI(), contact) {
+			continue
+		}
+		if ua.CallID == callID && cseq <= ua.CSeq {
+			continue
+		}
+		r.remove(aor, i)
+		removed = append(removed, *ua)
+	}
+	return removed
+}
+
+// Probed records whether a binding answered a keepalive probe and returns
+// how many it has now missed in a row. A binding that has missed maxMissed
+// is removed. found is false if the binding had gone already.
+func (r *registrar) Probed(aor, contact string, answered bool, maxMissed int) (missed int, found bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.find(aor, contact)
+	if i < 0 {
+		return 0, false
+	}
+	ua := r.entries[aor][i]
+	if answered {
+		ua.Missed = 0
+	} else {
+		ua.Missed++
+	}
+	if ua.Missed >= maxMissed {
+		r.remove(aor, i)
+	}
+	return ua.Missed, true
+}
+
+// find is the index of an AOR's binding to a Contact URI, or -1. Must be
+// called with the lock held.
+func (r *registrar) find(aor, contact string) int {
+	for i, ua := range r.entries[aor] {
+		if strings.EqualFold(ua.contactURI(), contact) {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove deletes an AOR's i'th binding, and the AOR with its last. Must
+// be called with the lock held.
+func (r *registrar) remove(aor string, i int) {
+	bindings := append(r.entries[aor][:i:i], r.entries[aor][i+1:]...)
+	if len(bindings) == 0 {
+		delete(r.entries, aor)
+	} else {
+		r.entries[aor] = bindings
+	}
+}
+
+// count is the number of bindings. Must be called with the lock held.
+func (r *registrar) count() int {
+	n := 0
+	for _, bindings := range r.entries {
+		n += len(bindings)
+	}
+	return n
+}
+
+// evictExpired removes up to n expired bindings, those that expired
+// earliest first. Must be called with the lock held.
+func (r *registrar) evictExpired(n int) []RegisteredUA {
+	now := time.Now()
+
+	var expired []*RegisteredUA
+	for _, bindings := range r.entries {
+		for _, ua := range bindings {
+			if ua.Expires.Before(now) {
+				expired = append(expired, ua)
+			}
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Expires.Before(expired[j].Expires)
+	})
+
+	var evicted []RegisteredUA
+	for _, ua := range expired[:min(n, len(expired))] {
+		r.remove(ua.AOR, r.find(ua.AOR, ua.contactURI()))
+		evicted = append(evicted, *ua)
+	}
+	return evicted
+}
+
+// Reap removes every binding that has expired and returns them
+func (r *registrar) Reap() []RegisteredUA {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.evictExpired(r.count())
+}
+
+// Lookup returns copies of an AOR's bindings that haven't expired, most
+// preferred first: by q-value, then most recently registered
+func (r *registrar) Lookup(aor string) []RegisteredUA {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	var bindings []RegisteredUA
+	for _, ua := range r.entries[aor] {
+		if ua.Expires.After(now) {
+			bindings = append(bindings, *ua)
+		}
+	}
+	sort.SliceStable(bindings, func(i, j int) bool {
+		if bindings[i].Q != bindings[j].Q {
+			return bindings[i].Q > bindings[j].Q
+		}
+		return bindings[i].Expires.After(bindings[j].Expires)
+	})
+	return bindings
+}
+
+// Snapshot returns copies of all bindings ordered by AOR, then Contact,
+// safe to use without holding any lock
+func (r *registrar) Snapshot() []RegisteredUA {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var snapshot []RegisteredUA
+	for _, bindings := range r.entries {
+		for _, ua := range bindings {
+			snapshot = append(snapshot, *ua)
+		}
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		if snapshot[i].AOR != snapshot[j].AOR {
+			return snapshot[i].AOR < snapshot[j].AOR
+		}
+		return snapshot[i].Contact < snapshot[j].Contact
+	})
+	return snapshot
+}
+
+// Count returns the number of bindings, including expired ones not yet
+// evicted
+func (r *registrar) Count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.count()
+}
+
+// parseBindings reads the Contacts of a REGISTER as bindings with their
+// expiry and q-value, a zero Expires for those being removed. The
+// wildcard Contact "*" comes back as is. If anything is malformed, or asks
+// for less than cfg.MinExpires, it returns the status to refuse the
+// REGISTER with, before any binding is changed; longer than
+// cfg.MaxExpires is cut short.
+func parseBindings(message string, headers map[string]string, remoteAddr *net.UDPAddr, cfg RegistrarConfig) ([]RegisteredUA, string) {
+	expires := min(max(DEFAULT_REGISTER_EXPIRES, cfg.MinExpires), cfg.MaxExpires)
+	if value := strings.TrimSpace(headers["Expires"]); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, "400 Bad Request"
+		}
+		expires = n
+	}
+
+	contacts := headerValues(message, "Contact")
+	var bindings []RegisteredUA
+	for _, contact := range contacts {
+		if contact == "*" {
+			// Removing every binding; nothing else may be asked alongside
+			if expires != 0 || len(contacts) > 1 {
+				return nil, "400 Bad Request"
+			}
+			bindings = append(bindings, RegisteredUA{Contact: "*"})
+			continue
+		}
+
+		ua := RegisteredUA{Contact: contact, Q: DEFAULT_Q, RemoteAddr: remoteAddr}
+		seconds := expires
+		if value := headerParam(contact, "expires"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, "400 Bad Request"
+			}
+			seconds = n
+		}
+		if value := headerParam(contact, "q"); value != "" {
+			q, err := strconv.ParseFloat(value, 64)
+			if err != nil || q < 0 || q > 1 {
+				return nil, "400 Bad Request"
+			}
+			ua.Q = q
+		}
+		if seconds > 0 && seconds < cfg.MinExpires {
+			return nil, "423 Interval Too Brief"
+		}
+		if seconds > 0 {
+			ua.Expires = time.Now().Add(time.Duration(min(seconds, cfg.MaxExpires)) * time.Second)
+		}
+		bindings = append(bindings, ua)
+	}
+	return bindings, ""
+}
+
+// reapRegistrations removes expired bindings from every exchange each
+// REGISTRATION_REAP_INTERVAL until the server closes, logging the phones
+// that dropped off without refreshing
+func (s *SIPServer) reapRegistrations() {
+	ticker := time.NewTicker(REGISTRATION_REAP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+
+		for _, ex := range s.Exchanges() {
+			for _, ua := range ex.registrar.Reap() {
+				fmt.Printf("📴 %s dropped off: %s didn't renew its registration (exchange %s)\n", ua.AOR, ua.Contact, ex.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// configReloader re-reads the config file the servers were started with
+// and applies it while they run
+type configReloader struct {
+	mu      sync.Mutex // One reload at a time
+	load    func() (*Config, error)
+	servers []*SIPServer
+}
+
+// Reload loads the config again and swaps in fresh exchanges built from
+// it: dial plans, destinations, secrets, speech and the like. What callers
+// and the API have changed while running — registrations, forwarding,
+// screening lists, unlocks, passports and the day's stats — carries over.
+// Sockets, federation and the API are only set up at startup; moving an
+// exchange to a different address needs a restart.
+func (r *configReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	byAddr := make(map[string]*SIPServer)
+	for _, server := range r.servers {
+		byAddr[server.config.ListenAddr()] = server
+	}
+	fresh := make(map[*SIPServer][]*exchange)
+	for _, exCfg := range cfg.ExchangeConfigs() {
+		server, ok := byAddr[exCfg.ListenAddr()]
+		if !ok {
+			return fmt.Errorf("exchange %q moved to %s, which needs a restart", exCfg.Name, exCfg.ListenAddr())
+		}
+		ex, err := newExchange(exCfg)
+		if err != nil {
+			return err
+		}
+		if old := server.exchangeNamed(ex.name); old != nil {
+			ex.carryOver(old)
+		}
+		fresh[server] = append(fresh[server], ex)
+	}
+	for _, server := range r.servers {
+		if len(fresh[server]) == 0 {
+			return fmt.Errorf("no exchange is left on %s, which needs a restart", server.config.ListenAddr())
+		}
+	}
+
+	for server, exchanges := range fresh {
+		server.exchangesMu.Lock()
+		server.exchanges = exchanges
+		server.exchangesMu.Unlock()
+	}
+	applyRuntimeSettings(cfg)
+	fmt.Printf("🔄 Config reloaded: %d exchange(s)\n", len(cfg.ExchangeConfigs()))
+	return nil
+}
+
+// exchangeNamed finds one of the server's exchanges by name
+func (s *SIPServer) exchangeNamed(name string) *exchange {
+	for _, ex := range s.Exchanges() {
+		if ex.name == name {
+			return ex
+		}
+	}
+	return nil
+}
+
+// carryOver takes the state that changes while the server runs from the
+// exchange this one replaces. Calls in progress finish on the old one.
+func (ex *exchange) carryOver(old *exchange) {
+	ex.registrar = old.registrar
+	ex.forwarding = old.forwarding
+	ex.screen = old.screen
+	ex.unlocks = old.unlocks
+	ex.passports = old.passports
+	ex.stats = old.stats
+
+	// Callers already queued or connected still count against capacity
+	for name, queue := range old.queues {
+		if ex.config.Destinations[name].Capacity == old.config.Destinations[name].Capacity && ex.queues[name] != nil {
+			ex.queues[name] = queue
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build aix || darwin || dragonfly || freebsd || netbsd || openbsd || (linux && (mips || mipsle || mips64 || mips64le))
+
+package main
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
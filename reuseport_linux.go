@@ -0,0 +1,7 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package main
+
+// The syscall package only defines SO_REUSEPORT for some Linux
+// architectures; the value is the same on all non-MIPS ones.
+const soReusePort = 0xf
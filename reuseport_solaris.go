@@ -0,0 +1,6 @@
+//go:build solaris
+
+package main
+
+// Solaris has no SO_REUSEPORT equivalent with load-balancing semantics
+const soReusePort = -1
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errNotRegistered is returned for a call to a user with no phone that
+// can be reached
+var errNotRegistered = errors.New("no phone registered")
+
+// RingPhone calls user's phone from the exchange, as a wake-up call or a
+// doorbell does, and once it is picked up connects it to destination,
+// which may be anything a dialed number can lead to; the call is hung up
+// when the destination finishes. It returns as soon as the phone is being
+// rung, with an error if the destination doesn't exist or the user has no
+// phone to ring. The phone rings for ringFor, or RING_TIMEOUT if 0.
+func (s *SIPServer) RingPhone(ex *exchange, user, destination string, ringFor time.Duration) error {
+	if _, ok := ex.config.Destinations[destination]; !ok {
+		return fmt.Errorf("no destination %q", destination)
+	}
+	ua, ok := s.registeredPhone(ex, user)
+	if !ok {
+		return fmt.Errorf("%w for %q", errNotRegistered, user)
+	}
+	if ringFor == 0 {
+		ringFor = RING_TIMEOUT
+	}
+
+	fmt.Printf("🛎️  Ringing %s for destination %q (exchange %s)\n", user, destination, ex.name)
+	s.spawn(func() {
+		session, err := s.ringPhone(s.ctx, ex, ua, ringFor)
+		if err != nil {
+			fmt.Printf("📵 %s: %v\n", ua.Contact, err)
+			return
+		}
+		s.playDestination(session, resolution{number: user, route: -1, destination: destination})
+		s.hangupCall(session)
+	})
+	return nil
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	mathrand "math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RTCP (RFC 3550 section 6) runs on the port above each call's RTP port,
+// or on the RTP port itself for a browser multiplexing them (RFC 5761).
+// We send sender reports tying our audio's timestamps to the wall clock,
+// with a report block on the phone's audio, and read the phone's reports
+// on ours for the round trip, jitter and loss it sees.
+
+const (
+	RTCP_SR   = 200
+	RTCP_RR   = 201
+	RTCP_SDES = 202
+	RTCP_BYE  = 203
+
+	RTCP_HEADER_SIZE       = 8  // The common header and the sender's SSRC
+	RTCP_SENDER_INFO_SIZE  = 20 // NTP and RTP timestamps, packet and octet counts
+	RTCP_REPORT_BLOCK_SIZE = 24
+	RTCP_SDES_CNAME        = 1
+
+	// RTCP_INTERVAL is the mean time between our reports; each is sent at
+	// a random point from half to one and a half times it (section 6.3.1)
+	RTCP_INTERVAL = 5 * time.Second
+
+	// A sequence number this far ahead of the highest is taken for a
+	// restart rather than loss, unless it is this close behind (appendix
+	// A.1)
+	RTP_MAX_DROPOUT  = 3000
+	RTP_MAX_MISORDER = 100
+)
+
+// RTCPStats is a snapshot of what a call's RTCP has counted and been told,
+// for diagnostics
+type RTCPStats struct {
+	PacketsSent     uint32        // Of our audio, under its current SSRC
+	OctetsSent      uint32        // Of its payloads
+	LastSent        time.Time     // When its last packet went
+	PacketsReceived uint32        // Of the phone's audio, from its current source
+	OctetsReceived  uint64        // Of its payloads
+	LastReceived    time.Time     // When its last packet arrived
+	Lost            int32         // Of the phone's packets, that never arrived
+	Jitter          time.Duration // Of the phone's packets arriving
+	Reports         int           // Reports from the phone on our audio
+
+	// From the phone's last report on our audio
+	RoundTrip    time.Duration // Zero until a report answers one of ours
+	RemoteJitter time.Duration
+	RemoteLost   int32   // Cumulative
+	FractionLost float64 // Since its report before
+}
+
+// CallStats describes a call in progress and how its audio is faring
+// each way, for the API; times are in milliseconds. The phone's figures
+// come from its RTCP reports, and are zero until one arrives.
+type CallStats struct {
+	CallID       string `json:"call_id"`
+	Exchange     string `json:"exchange"`
+	Caller       string `json:"caller,omitempty"`
+	Codec        string `json:"codec,omitempty"`
+	LocalRTPPort int    `json:"local_rtp_port,omitempty"`
+	RemoteRTP    string `json:"remote_rtp,omitempty"` // Where our audio goes
+	Latched      bool   `json:"latched"`              // To where the phone's audio comes from
+	Held         bool   `json:"held"`
+	Secure       bool   `json:"secure"`
+
+	PacketsSent     uint32    `json:"packets_sent"`
+	BytesSent       uint32    `json:"bytes_sent"`
+	LastSent        time.Time `json:"last_sent,omitzero"`
+	PacketsReceived uint32    `json:"packets_received"`
+	BytesReceived   uint64    `json:"bytes_received"`
+	LastReceived    time.Time `json:"last_received,omitzero"`
+	Lost            int32     `json:"lost"`
+	Jitter          float64   `json:"jitter"`
+
+	Reports      int     `json:"phone_reports"`
+	RemoteLost   int32   `json:"phone_lost"`
+	FractionLost float64 `json:"phone_fraction_lost"`
+	RemoteJitter float64 `json:"phone_jitter"`
+	RoundTrip    float64 `json:"round_trip"`
+}
+
+// CallStats describes every call in progress, ordered by Call-ID
+func (s *SIPServer) CallStats() []CallStats {
+	s.callsMu.Lock()
+	sessions := slices.Collect(maps.Values(s.calls))
+	s.callsMu.Unlock()
+
+	all := make([]CallStats, 0, len(sessions))
+	for _, session := range sessions {
+		all = append(all, session.stats())
+	}
+	slices.SortFunc(all, func(a, b CallStats) int { return strings.Compare(a.CallID, b.CallID) })
+	return all
+}
+
+// stats describes the call and its audio
+func (session *CallSession) stats() CallStats {
+	stats := CallStats{
+		CallID:  session.CallID,
+		Caller:  session.caller(),
+		Latched: session.latched.Load(),
+		Held:    session.held.Load(),
+		Secure:  session.secure(),
+	}
+	if session.exchange != nil {
+		stats.Exchange = session.exchange.name
+	}
+	if c := session.formats.codec; c != nil {
+		stats.Codec = c.name
+	}
+	if addr := session.RemoteRTPAddr(); addr != nil {
+		stats.RemoteRTP = addr.String()
+	}
+	p := session.media()
+	if p == nil {
+		return stats
+	}
+
+	milliseconds := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	rtcp := p.session.Stats()
+	stats.LocalRTPPort = p.port
+	stats.PacketsSent, stats.BytesSent, stats.LastSent = rtcp.PacketsSent, rtcp.OctetsSent, rtcp.LastSent
+	stats.PacketsReceived, stats.BytesReceived, stats.LastReceived = rtcp.PacketsReceived, rtcp.OctetsReceived, rtcp.LastReceived
+	stats.Lost, stats.Jitter = max(rtcp.Lost, 0), milliseconds(rtcp.Jitter)
+	stats.Reports, stats.RemoteLost, stats.FractionLost = rtcp.Reports, max(rtcp.RemoteLost, 0), rtcp.FractionLost
+	stats.RemoteJitter, stats.RoundTrip = milliseconds(rtcp.RemoteJitter), milliseconds(rtcp.RoundTrip)
+	return stats
+}
+
+// receivedRTP counts an RTP packet of the phone's arriving at arrival;
+// jitter is only measured if timed, as telephone events repeat their
+// timestamp
+func (r *rtpSession) receivedRTP(packet []byte, arrival time.Time, clockRate int, timed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ssrc := binary.BigEndian.Uint32(packet[8:12])
+	seq := binary.BigEndian.Uint16(packet[2:4])
+	if ssrc == r.ssrc {
+		r.collide()
+	}
+	r.heard, r.left = arrival, time.Time{}
+	if !r.receiving || ssrc != r.remoteSSRC {
+		r.receiving, r.remoteSSRC = true, ssrc
+		r.restart(seq)
+		r.firstArrival, r.haveTransit, r.jitter = arrival, false, 0
+	}
+
+	switch delta := seq - r.maxSeq; {
+	case delta < RTP_MAX_DROPOUT:
+		if seq < r.maxSeq {
+			r.cycles += 1 << 16 // Wrapped
+		}
+		r.maxSeq = seq
+	case delta <= 1<<16-RTP_MAX_MISORDER:
+		r.restart(seq) // The phone started its sequence again
+	}
+	r.received++
+	r.octetsReceived += uint64(len(packet) - RTP_HEADER_SIZE)
+	r.arrival = arrival
+
+	if !timed || clockRate == 0 {
+		return
+	}
+	r.remoteClockRate = clockRate
+	transit := arrival.Sub(r.firstArrival).Seconds()*float64(clockRate) - float64(binary.BigEndian.Uint32(packet[4:8]))
+	if r.haveTransit {
+		d := transit - r.transit
+		if d < 0 {
+			d = -d
+		}
+		r.jitter += (d - r.jitter) / 16
+	}
+	r.transit, r.haveTransit = transit, true
+}
+
+// restart counts the phone's audio from sequence number seq
+func (r *rtpSession) restart(seq uint16) {
+	r.maxSeq = seq
+	r.cycles = 0
+	r.baseSeq = uint32(seq)
+	r.received, r.expectedPrior, r.receivedPrior = 0, 0, 0
+	r.octetsReceived = 0
+}
+
+// report builds our next compound RTCP packet at now: a sender report if
+// we have sent audio lately, a receiver report otherwise, either with a
+// block on the phone's audio if it sends any, and our CNAME
+func (r *rtpSession) report(now time.Time) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var blocks byte
+	if r.receiving {
+		blocks = 1
+	}
+	packet := make([]byte, 0, RTCP_HEADER_SIZE+RTCP_SENDER_INFO_SIZE+RTCP_REPORT_BLOCK_SIZE+12+len(r.cname)+4)
+	if !r.sentAt.IsZero() && now.Sub(r.sentAt) < 2*RTCP_INTERVAL {
+		words := (RTCP_HEADER_SIZE+RTCP_SENDER_INFO_SIZE+int(blocks)*RTCP_REPORT_BLOCK_SIZE)/4 - 1
+		packet = append(packet, 0x80|blocks, RTCP_SR)
+		packet = binary.BigEndian.AppendUint16(packet, uint16(words))
+		packet = binary.BigEndian.AppendUint32(packet, r.ssrc)
+		packet = binary.BigEndian.AppendUint64(packet, ntpTimestamp(now))
+		elapsed := now.Sub(r.sentAt).Seconds() * float64(r.clockRate)
+		packet = binary.BigEndian.AppendUint32(packet, r.timestamp+uint32(elapsed))
+		packet = binary.BigEndian.AppendUint32(packet, r.packets)
+		packet = binary.BigEndian.AppendUint32(packet, r.octets)
+	} else {
+		words := (RTCP_HEADER_SIZE+int(blocks)*RTCP_REPORT_BLOCK_SIZE)/4 - 1
+		packet = append(packet, 0x80|blocks, RTCP_RR)
+		packet = binary.BigEndian.AppendUint16(packet, uint16(words))
+		packet = binary.BigEndian.AppendUint32(packet, r.ssrc)
+	}
+	if r.receiving {
+		packet = r.appendReportBlock(packet, now)
+	}
+
+	// SDES with a single chunk: our CNAME, then null octets to the end of
+	// the word, of which there must be at least one
+	chunk := 4 + 2 + len(r.cname)
+	padding := 4 - chunk%4
+	packet = append(packet, 0x81, RTCP_SDES)
+	packet = binary.BigEndian.AppendUint16(packet, uint16((4+chunk+padding)/4-1))
+	packet = binary.BigEndian.AppendUint32(packet, r.ssrc)
+	packet = append(packet, RTCP_SDES_CNAME, byte(len(r.cname)))
+	packet = append(packet, r.cname...)
+	return append(packet, make([]byte, padding)...)
+}
+
+// appendReportBlock appends a report block on the phone's audio (appendix
+// A.3): its loss since the last report and in all, the highest sequence
+// number, jitter, and when its last sender report arrived
+func (r *rtpSession) appendReportBlock(packet []byte, now time.Time) []byte {
+	extendedMax := r.cycles + uint32(r.maxSeq)
+	expected := extendedMax - r.baseSeq + 1
+	lost := min(max(int64(expected)-int64(r.received), -1<<23), 1<<23-1)
+	expectedInterval := expected - r.expectedPrior
+	receivedInterval := r.received - r.receivedPrior
+	r.expectedPrior, r.receivedPrior = expected, r.received
+	var fraction uint32
+	if expectedInterval > 0 && expectedInterval > receivedInterval {
+		fraction = (expectedInterval - receivedInterval) << 8 / expectedInterval
+	}
+
+	var dlsr uint32
+	if r.lastSR != 0 {
+		dlsr = uint32(now.Sub(r.lastSRAt).Seconds() * 65536)
+	}
+
+	packet = binary.BigEndian.AppendUint32(packet, r.remoteSSRC)
+	packet = binary.BigEndian.AppendUint32(packet, min(fraction, 255)<<24|uint32(lost)&0xFFFFFF)
+	packet = binary.BigEndian.AppendUint32(packet, extendedMax)
+	packet = binary.BigEndian.AppendUint32(packet, uint32(r.jitter))
+	packet = binary.BigEndian.AppendUint32(packet, r.lastSR)
+	return binary.BigEndian.AppendUint32(packet, dlsr)
+}
+
+// receivedRTCP takes in a compound RTCP packet from the phone, arriving at
+// now: the time of its sender report, for the block on its audio in ours,
+// any block it has on our audio, and a BYE ending its audio
+func (r *rtpSession) receivedRTCP(packet []byte, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.heard = now
+	for len(packet) >= RTCP_HEADER_SIZE && packet[0]>>6 == 2 {
+		length := 4 * (int(binary.BigEndian.Uint16(packet[2:4])) + 1)
+		if length > len(packet) {
+			return
+		}
+		blocks := int(packet[0] & 0x1F)
+		body := packet[:length]
+		packet = packet[length:]
+		if (body[1] == RTCP_SR || body[1] == RTCP_RR) && binary.BigEndian.Uint32(body[4:8]) == r.ssrc {
+			r.collide()
+		}
+
+		offset := RTCP_HEADER_SIZE
+		switch body[1] {
+		case RTCP_SR:
+			if len(body) < RTCP_HEADER_SIZE+RTCP_SENDER_INFO_SIZE {
+				continue
+			}
+			r.lastSR = uint32(binary.BigEndian.Uint64(body[8:16]) >> 16)
+			r.lastSRAt = now
+			offset += RTCP_SENDER_INFO_SIZE
+		case RTCP_RR:
+		case RTCP_BYE:
+			r.bye(body[4:], blocks, now)
+			continue
+		default:
+			continue
+		}
+		for i := range blocks {
+			block := body[min(offset+i*RTCP_REPORT_BLOCK_SIZE, len(body)):]
+			if len(block) < RTCP_REPORT_BLOCK_SIZE {
+				break
+			}
+			if binary.BigEndian.Uint32(block[0:4]) == r.ssrc {
+				r.takeReportBlock(block, now)
+			}
+		}
+	}
+}
+
+// bye notes the phone's audio stopping at now if its SSRC is among the
+// count in a BYE's list (section 6.6)
+func (r *rtpSession) bye(ssrcs []byte, count int, now time.Time) {
+	for i := range min(count, len(ssrcs)/4) {
+		if binary.BigEndian.Uint32(ssrcs[4*i:]) == r.remoteSSRC || !r.receiving {
+			r.left = now
+			return
+		}
+	}
+}
+
+// quiet reports when the phone's RTP or RTCP last arrived, and when it
+// said with RTCP BYE that its audio had stopped; each is zero if it
+// hasn't
+func (r *rtpSession) quiet() (heard, left time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.heard, r.left
+}
+
+// takeReportBlock records a report block from the phone on our audio
+func (r *rtpSession) takeReportBlock(block []byte, now time.Time) {
+	lost := binary.BigEndian.Uint32(block[4:8])
+	r.stats.Reports++
+	r.stats.FractionLost = float64(lost>>24) / 256
+	r.stats.RemoteLost = int32(lost<<8) >> 8 // 24 bits, signed
+	if r.clockRate > 0 {
+		jitter := float64(binary.BigEndian.Uint32(block[12:16])) / float64(r.clockRate)
+		r.stats.RemoteJitter = time.Duration(jitter * float64(time.Second))
+	}
+
+	// The round trip is now, less when our report left and how long the
+	// phone held it, all in 1/65536 seconds (section 6.4.1)
+	lsr, dlsr := binary.BigEndian.Uint32(block[16:20]), binary.BigEndian.Uint32(block[20:24])
+	if lsr == 0 {
+		return
+	}
+	if rtt := uint32(ntpTimestamp(now)>>16) - lsr - dlsr; rtt < 1<<31 {
+		r.stats.RoundTrip = time.Duration(rtt) * time.Second / 65536
+	}
+}
+
+// Stats returns a snapshot of the call's RTCP
+func (r *rtpSession) Stats() RTCPStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.stats
+	stats.PacketsSent, stats.OctetsSent, stats.LastSent = r.packets, r.octets, r.sentAt
+	stats.PacketsReceived, stats.OctetsReceived, stats.LastReceived = r.received, r.octetsReceived, r.arrival
+	if r.receiving {
+		expected := r.cycles + uint32(r.maxSeq) - r.baseSeq + 1
+		stats.Lost = int32(int64(expected) - int64(r.received))
+		if r.remoteClockRate > 0 {
+			stats.Jitter = time.Duration(r.jitter / float64(r.remoteClockRate) * float64(time.Second))
+		}
+	}
+	return stats
+}
+
+// protect encrypts a report of ours with the local master key of a secure
+// call, keying SRTCP afresh if it has changed
+func (r *rtpSession) protect(packet []byte, keys *srtpKeys) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.srtcpOut == nil || string(r.outMaster) != string(keys.local) {
+		out, err := newSRTCPContext(keys.suite, keys.local)
+		if err != nil {
+			return nil, err
+		}
+		r.srtcpOut, r.outMaster = out, keys.local
+	}
+	return r.srtcpOut.protect(packet), nil
+}
+
+// unprotect decrypts a report from the phone with the master key its RTP
+// is decrypted with
+func (r *rtpSession) unprotect(packet []byte, in *srtpContext) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.srtcpIn == nil || string(r.srtcpIn.master) != string(in.master) {
+		srtcp, err := newSRTCPContext(in.suite, in.master)
+		if err != nil {
+			return nil, err
+		}
+		r.srtcpIn = srtcp
+	}
+	return r.srtcpIn.unprotect(packet)
+}
+
+// heardFrom notes where the phone's reports come from, which ours then go
+// back to
+func (r *rtpSession) heardFrom(from *net.UDPAddr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.from = from
+}
+
+// source is where the phone's reports come from; nil until one has
+func (r *rtpSession) source() *net.UDPAddr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.from
+}
+
+// isRTCP reports whether a packet on a call's RTP port is RTCP multiplexed
+// onto it, by its packet type (RFC 5761 section 4)
+func isRTCP(packet []byte) bool {
+	return len(packet) >= RTCP_HEADER_SIZE && packet[1] >= 192 && packet[1] <= 223
+}
+
+// rtcpMuxed reports whether a call's RTCP shares its RTP port, as a
+// browser's does and other phones' may
+func (session *CallSession) rtcpMuxed() bool {
+	return session.formats.webrtc != nil || session.formats.rtcpMux
+}
+
+// sendRTCP sends reports on the call callID from its RTP port p until the
+// port is given back, then logs what the call's RTCP found
+func (s *SIPServer) sendRTCP(p *mediaPort, callID string) {
+	for {
+		interval := time.Duration(float64(RTCP_INTERVAL) * (0.5 + mathrand.Float64()))
+		select {
+		case <-p.closed:
+			logRTCPStats(callID, p.session.Stats())
+			return
+		case <-time.After(interval):
+		}
+
+		session := s.sessionForMedia(p, callID)
+		if session == nil {
+			continue // Not answered yet
+		}
+		s.sendReport(session, p)
+	}
+}
+
+// sendReport sends the phone our next report, to the port above its RTP
+// port or wherever its own reports come from, from our RTCP port unless
+// the call has none
+func (s *SIPServer) sendReport(session *CallSession, p *mediaPort) {
+	conn, addr := p.rtcp, session.RemoteRTPAddr()
+	if conn == nil {
+		conn = p.conn // The shared media port
+	}
+	if session.rtcpMuxed() {
+		conn = p.conn
+	} else if from := p.session.source(); from != nil {
+		addr = from
+	} else if addr != nil {
+		addr = &net.UDPAddr{IP: addr.IP, Port: addr.Port + 1, Zone: addr.Zone}
+	}
+	if addr == nil {
+		return
+	}
+
+	packet := p.session.report(time.Now())
+	if keys := session.srtpOut.Load(); keys != nil {
+		protected, err := p.session.protect(packet, keys)
+		if err != nil {
+			log.Printf("❌ Failed to key SRTCP for call %s: %v", session.CallID, err)
+			return
+		}
+		packet = protected
+	} else if session.secure() {
+		return // Not keyed yet
+	}
+	if _, err := conn.WriteToUDP(packet, addr); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Error sending RTCP report: %v", err)
+	}
+	captureDatagram(conn, addr.AddrPort(), packet, true)
+}
+
+// receiveRTCP reads the phone's reports on the call callID from the RTCP
+// port of p until the port is given back
+func (s *SIPServer) receiveRTCP(p *mediaPort, callID string) {
+	buffer := make([]byte, 1500)
+	for {
+		n, remoteAddr, err := p.rtcp.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error reading RTCP packet: %v", err)
+			continue
+		}
+		captureDatagram(p.rtcp, remoteAddr.AddrPort(), buffer[:n], false)
+		if session := s.sessionForMedia(p, callID); session != nil {
+			s.handleRTCP(session, p, buffer[:n], remoteAddr)
+		}
+	}
+}
+
+// handleRTCP takes in a report from the phone, from either of the call's
+// ports; a secure call's must be SRTCP
+func (s *SIPServer) handleRTCP(session *CallSession, p *mediaPort, packet []byte, from *net.UDPAddr) {
+	now := time.Now()
+	if in := session.srtpIn.Load(); in != nil {
+		var err error
+		if packet, err = p.session.unprotect(packet, in); err != nil {
+			return
+		}
+	} else if session.secure() {
+		return
+	}
+	if !session.rtcpMuxed() {
+		p.session.heardFrom(from)
+	}
+	p.session.receivedRTCP(packet, now)
+}
+
+// logRTCPStats logs how a call's audio fared each way, if RTCP learned
+// anything of it
+func logRTCPStats(callID string, stats RTCPStats) {
+	if stats.PacketsReceived > 0 {
+		fmt.Printf("📊 Call %s: received %d packets, %d lost, jitter %v\n",
+			callID, stats.PacketsReceived, max(stats.Lost, 0), stats.Jitter.Round(100*time.Microsecond))
+	}
+	if stats.Reports > 0 {
+		fmt.Printf("📊 Call %s: the phone lost %d of our %d packets, jitter %v, round trip %v\n",
+			callID, max(stats.RemoteLost, 0), stats.PacketsSent, stats.RemoteJitter.Round(100*time.Microsecond), stats.RoundTrip.Round(100*time.Microsecond))
+	}
+}
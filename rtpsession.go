@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	mathrand "math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// RTCP_CNAME_BYTES are the random bytes of a call's CNAME
+const RTCP_CNAME_BYTES = 12
+
+// rtpSession is the RTP session (RFC 3550) on a call's RTP port. Our audio
+// goes out as a single source, whichever stream is playing: one random
+// SSRC for the call, with sequence numbers and timestamps starting at
+// random and carrying on from stream to stream, so the phone never sees
+// its audio restart. It also keeps what RTCP reports on each way. The
+// media scheduler, the RTP and RTCP readers and the reporter all use it.
+type rtpSession struct {
+	mu    sync.Mutex
+	cname string
+
+	// Our source: its SSRC, the sequence number and timestamp of its next
+	// packet and when that is due, and the SRTP it is encrypted with, which
+	// only the media scheduler uses
+	ssrc uint32
+	seq  uint16
+	next uint32
+	due  time.Time
+	srtp *srtpContext
+
+	// Our audio as sent: its clock, the timestamp and time of its last
+	// packet, and what has gone under the SSRC
+	clockRate int
+	timestamp uint32
+	sentAt    time.Time
+	packets   uint32
+	octets    uint32
+
+	// The phone's audio, tracked as RFC 3550 appendix A.1 and A.8 do, and
+	// the middle of the NTP timestamp of its last sender report, with when
+	// it arrived
+	receiving                    bool
+	remoteSSRC                   uint32
+	maxSeq                       uint16
+	cycles, baseSeq              uint32
+	received                     uint32
+	octetsReceived               uint64
+	arrival                      time.Time // Of its last packet
+	expectedPrior, receivedPrior uint32
+	firstArrival                 time.Time
+	transit                      float64
+	haveTransit                  bool
+	jitter                       float64 // In the phone's timestamp units
+	remoteClockRate              int
+	lastSR                       uint32
+	lastSRAt                     time.Time
+
+	// When the phone's RTP or RTCP last arrived, and when it said with
+	// RTCP BYE that its audio had stopped, unless more has come since
+	heard time.Time
+	left  time.Time
+
+	// Where the phone's reports come from, once one has, and the SRTCP of
+	// a secure call each way
+	from      *net.UDPAddr
+	srtcpOut  *srtcpContext
+	srtcpIn   *srtcpContext
+	outMaster []byte
+
+	stats RTCPStats
+}
+
+// newRTPSession starts a call's RTP session with a random SSRC, sequence
+// number and timestamp (RFC 3550 section 5.1), and a random CNAME, as RFC
+// 7022 suggests, so calls can't be tied to one another
+func newRTPSession() *rtpSession {
+	b := make([]byte, RTCP_CNAME_BYTES)
+	rand.Read(b)
+	return &rtpSession{
+		cname: base64.RawStdEncoding.EncodeToString(b),
+		ssrc:  mathrand.Uint32(),
+		seq:   uint16(mathrand.Uint32()),
+		next:  mathrand.Uint32(),
+	}
+}
+
+// number gives the SSRC, sequence number and timestamp of our next packet,
+// ptime milliseconds of audio on a clock of clockRate, due at now by the
+// media scheduler's clock. After a pause longer than any packet time,
+// between streams or while none was sending, the timestamp moves on by the
+// time that has passed.
+func (r *rtpSession) number(clockRate, ptime int, now time.Time) (ssrc uint32, seq uint16, timestamp uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if late := now.Sub(r.due); !r.due.IsZero() && late > MAX_PTIME*time.Millisecond {
+		r.next += uint32(late.Seconds() * float64(clockRate))
+	}
+	ssrc, seq, timestamp = r.ssrc, r.seq, r.next
+	r.seq++
+	r.next += uint32(clockRate * ptime / 1000)
+	r.due = now.Add(time.Duration(ptime) * time.Millisecond)
+	return ssrc, seq, timestamp
+}
+
+// encryption is the SRTP our audio is sent with under keys: one context
+// for the call, since its streams share an SSRC and sequence numbers, and
+// so the rollover counter carries on from one to the next
+func (r *rtpSession) encryption(keys *srtpKeys) (*srtpContext, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.srtp == nil || !bytes.Equal(r.srtp.master, keys.local) {
+		srtp, err := newSRTPContext(keys.suite, keys.local)
+		if err != nil {
+			return nil, err
+		}
+		r.srtp = srtp
+	}
+	return r.srtp, nil
+}
+
+// sent counts an RTP packet of ours going out, due at at: payloadOctets of
+// audio with timestamp, on a clock of clockRate
+func (r *rtpSession) sent(timestamp uint32, clockRate, payloadOctets int, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.clockRate = clockRate
+	r.timestamp = timestamp
+	r.sentAt = at
+	r.packets++
+	r.octets += uint32(payloadOctets)
+}
+
+// collide takes a new SSRC when the phone turns out to be sending with
+// ours (RFC 3550 section 8.2), starting our counts again, and logs it.
+// Must be called with mu held.
+func (r *rtpSession) collide() {
+	previous := r.ssrc
+	for r.ssrc == previous || r.ssrc == r.remoteSSRC {
+		r.ssrc = mathrand.Uint32()
+	}
+	r.packets, r.octets = 0, 0
+	log.Printf("⚠️  SSRC %08x collides with the phone's; now sending as %08x", previous, r.ssrc)
+}
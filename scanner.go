@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Scanner defense defaults
+	DEFAULT_TARPIT_DELAY_MS      = 15000
+	DEFAULT_REGISTER_STORM_USERS = 5
+	REGISTER_STORM_WINDOW        = time.Minute
+	SCANNER_BLOCK_DURATION       = time.Hour
+	MAX_TRACKED_SOURCES          = 4096 // Sources remembered at once
+	MAX_TARPIT_PENDING           = 256  // Delayed answers in flight; beyond this they're dropped
+)
+
+// scannerUserAgents are User-Agent fragments of common SIP scanning tools
+var scannerUserAgents = []string{
+	"friendly-scanner",
+	"sipvicious",
+	"sipcli",
+	"sip-scan",
+	"sundayddr",
+	"iwar",
+	"vaxsipuseragent",
+	"pplsip",
+	"smap",
+}
+
+// sourceState is what the scanner guard knows about one source address
+type sourceState struct {
+	users       map[string]bool // Users REGISTERed in the current window
+	windowStart time.Time
+	blocked     time.Time // When the source was flagged; zero if it wasn't
+}
+
+// scannerGuard spots the background scanning every internet-facing SIP
+// server gets: known scanning tools by their User-Agent, and REGISTER
+// storms that try many users from one address. A flagged source is
+// remembered for SCANNER_BLOCK_DURATION and none of its requests reach
+// the registrar or the dial plan.
+type scannerGuard struct {
+	mu      sync.Mutex
+	sources map[string]*sourceState // By IP
+	pending atomic.Int32            // Tarpit answers waiting to be sent
+	config  SecurityConfig
+}
+
+// newScannerGuard creates a guard with the given settings
+func newScannerGuard(cfg SecurityConfig) *scannerGuard {
+	return &scannerGuard{
+		sources: make(map[string]*sourceState),
+		config:  cfg,
+	}
+}
+
+// Check reports whether a request comes from a scanner, flagging its
+// source if this request gives it away. The reason is set only when the
+// source is newly flagged, so it is logged once.
+func (g *scannerGuard) Check(method string, headers map[string]string, from *net.UDPAddr) (scanner bool, reason string) {
+	if g.config.ScannerAction == "off" {
+		return false, ""
+	}
+
+	now := time.Now()
+	ip := from.IP.String()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	state := g.sources[ip]
+	if state != nil && !state.blocked.IsZero() {
+		if now.Sub(state.blocked) < SCANNER_BLOCK_DURATION {
+			return true, ""
+		}
+		delete(g.sources, ip) // Block expired; start over
+		state = nil
+	}
+
+	if agent := strings.ToLower(headers["User-Agent"]); agent != "" {
+		for _, signature := range scannerUserAgents {
+			if strings.Contains(agent, signature) {
+				return true, g.flag(ip, state, now, fmt.Sprintf("scanner User-Agent %q", headers["User-Agent"]))
+			}
+		}
+	}
+
+	if method != "REGISTER" {
+		return false, ""
+	}
+
+	if state == nil || now.Sub(state.windowStart) > REGISTER_STORM_WINDOW {
+		if state == nil {
+			g.makeRoom()
+		}
+		state = &sourceState{users: make(map[string]bool), windowStart: now}
+		g.sources[ip] = state
+	}
+	state.users[contactUser(headers["To"])] = true
+	if len(state.users) > g.config.RegisterStormUsers {
+		return true, g.flag(ip, state, now, fmt.Sprintf("REGISTER storm for %d users in %s", len(state.users), REGISTER_STORM_WINDOW))
+	}
+	return false, ""
+}
+
+// flag marks a source as a scanner. Must be called with mu held.
+func (g *scannerGuard) flag(ip string, state *sourceState, now time.Time, reason string) string {
+	if state == nil {
+		g.makeRoom()
+		state = &sourceState{}
+		g.sources[ip] = state
+	}
+	state.users = nil
+	state.blocked = now
+	return reason
+}
+
+// makeRoom forgets the oldest source if the table is full, so a scan from
+// many addresses can't grow it without bound. Must be called with mu held.
+func (g *scannerGuard) makeRoom() {
+	if len(g.sources) < MAX_TRACKED_SOURCES {
+		return
+	}
+	var oldestIP string
+	var oldest time.Time
+	for ip, state := range g.sources {
+		seen := state.windowStart
+		if !state.blocked.IsZero() {
+			seen = state.blocked
+		}
+		if oldestIP == "" || seen.Before(oldest) {
+			oldestIP, oldest = ip, seen
+		}
+	}
+	delete(g.sources, oldestIP)
+}
+
+// tarpit answers a scanner's request, if the configured action calls for
+// an answer: after a long delay, with a response that looks like progress
+// but leads nowhere, so scanning tools wait on us instead of moving on
+// quickly. Nothing the scanner sends has any effect.
+func (s *SIPServer) tarpit(method string, headers map[string]string, remoteAddr *net.UDPAddr) {
+	if s.scanners.config.ScannerAction != "tarpit" || method == "ACK" {
+		return
+	}
+	if s.scanners.pending.Add(1) > MAX_TARPIT_PENDING {
+		s.scanners.pending.Add(-1)
+		return
+	}
+
+	status := "200 OK"
+	if method == "INVITE" {
+		status = "180 Ringing" // The final answer never comes
+	}
+	response := fmt.Sprintf("SIP/2.0 %s\r\n"+
+		"Via: %s\r\n"+
+		"From: %s\r\n"+
+		"To: %s\r\n"+
+		"Call-ID: %s\r\n"+
+		"CSeq: %s\r\n"+
+		"Content-Length: 0\r\n"+
+		"\r\n", status, headers["Via"], headers["From"], withTag(headers["To"]),
+		headers["Call-ID"], headers["CSeq"])
+
+	delay := time.Duration(s.scanners.config.TarpitDelayMs) * time.Millisecond
+	s.spawn(func() {
+		defer s.scanners.pending.Add(-1)
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			// Sent quietly; the whole point is to not spend log lines on it
+			if conn := s.connFor(remoteAddr); conn != nil {
+				conn.WriteToUDP([]byte(response), remoteAddr)
+				captureDatagram(conn, remoteAddr.AddrPort(), []byte(response), true)
+			}
+		case <-s.ctx.Done():
+		}
+	})
+}
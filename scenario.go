@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"time"
+)
+
+const (
+	// SELFTEST_NUMBER is dialed when selftest runs without a config
+	SELFTEST_NUMBER = "1004"
+
+	// SELFTEST_FRAMES consecutive frames must match to pass an audio check
+	SELFTEST_FRAMES = 5
+)
+
+// selfTestConfig is the configuration used when selftest runs without a
+// config file: one route to a 1004Hz test tone
+func selfTestConfig() *Config {
+	cfg := defaultConfig()
+	cfg.DialPlan.DigitMap = "(1xxx)"
+	cfg.DialPlan.Routes = []RouteConfig{{Pattern: "1xxx", Destination: "milliwatt"}}
+	cfg.Destinations = map[string]DestinationConfig{
+		"milliwatt": {Type: "tone", Frequencies: []float64{1004}, Description: "Test tone"},
+	}
+	return cfg
+}
+
+// runSelfTest runs a complete call against an in-process server on
+// loopback: register, go off hook, hear dial tone, dial number, hear the
+// destination it routes to, hang up and check the call is torn down.
+// Audio is compared frame for frame with what the sources produce.
+func runSelfTest(cfg *Config, number string) error {
+	cfg.BindIP = "127.0.0.1"
+	cfg.SIPPort = 0
+
+	plan, err := newDialPlan(cfg)
+	if err != nil {
+		return err
+	}
+	res, ok := plan.Resolve(number)
+	if !ok {
+		return fmt.Errorf("%s has no route", res.number)
+	}
+	if res.extension != "" {
+		return fmt.Errorf("%s is an extension, which has no audio to compare", res.number)
+	}
+	name := res.destination
+	source, err := openDestination(cfg, cfg.Destinations[name])
+	if err != nil {
+		return fmt.Errorf("failed to open destination %q: %v", name, err)
+	}
+	if res.announcement != "" {
+		announcement, err := openDestination(cfg, cfg.Destinations[res.announcement])
+		if err != nil {
+			return fmt.Errorf("failed to open announcement %q: %v", res.announcement, err)
+		}
+		source = newSequenceSource(announcement, source)
+	}
+	destinationFrames := expectedFrames(source, SELFTEST_FRAMES)
+	dialToneFrames := expectedFrames(cfg.progressTone(progressDial), SELFTEST_FRAMES)
+
+	server, err := NewSIPServer(cfg)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	go server.Run()
+
+	ua, err := newTestUA(server.SIPAddr())
+	if err != nil {
+		return err
+	}
+	defer ua.Close()
+	sipUsers := cfg.SIPUsers()
+	if users := slices.Sorted(maps.Keys(sipUsers)); len(users) > 0 {
+		ua.user, ua.password = users[0], sipUsers[users[0]]
+	}
+
+	// Dialing ends at the latest when the short timer runs out
+	routeTimeout := time.Duration(cfg.DialPlan.ShortTimeoutMs)*time.Millisecond + time.Second
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"Register", ua.Register},
+		{"Go off hook", ua.Invite},
+		{"Hear dial tone", func() error {
+			return awaitFrames(ua, dialToneFrames, time.Second)
+		}},
+		{fmt.Sprintf("Dial %s", number), func() error {
+			for i := 0; i < len(number); i++ {
+				if err := ua.SendDigit(number[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{fmt.Sprintf("Hear destination %q", name), func() error {
+			return awaitFrames(ua, destinationFrames, routeTimeout)
+		}},
+		{"Hang up", ua.Bye},
+		{"Check the call is torn down", func() error {
+			return checkTornDown(server, ua)
+		}},
+	}
+
+	for i, step := range steps {
+		fmt.Printf("\n🧪 Step %d/%d: %s\n", i+1, len(steps), step.name)
+		if err := step.run(); err != nil {
+			return fmt.Errorf("%s: %v", step.name, err)
+		}
+		fmt.Printf("✅ %s\n", step.name)
+	}
+	return nil
+}
+
+// expectedFrames encodes up to n frames from source as they would appear
+// on the wire
+func expectedFrames(source MediaSource, n int) [][]byte {
+	samples := make([]int16, FRAME_SIZE)
+	var frames [][]byte
+	for len(frames) < n && source.ReadFrame(samples) {
+		frame := make([]byte, FRAME_SIZE)
+		for i, sample := range samples {
+			frame[i] = linearToUlaw(sample)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// awaitFrames waits until the UA receives frames back to back
+func awaitFrames(ua *testUA, frames [][]byte, timeout time.Duration) error {
+	if len(frames) == 0 {
+		return fmt.Errorf("source produced no audio")
+	}
+
+	matched := 0
+	err := ua.ReadAudio(timeout, func(payload []byte) bool {
+		switch {
+		case bytes.Equal(payload, frames[matched]):
+			matched++
+		case bytes.Equal(payload, frames[0]):
+			matched = 1
+		default:
+			matched = 0
+		}
+		return matched == len(frames)
+	})
+	if err != nil {
+		return fmt.Errorf("expected audio not received: %v", err)
+	}
+	return nil
+}
+
+// checkTornDown verifies the server forgot the call and stopped sending
+// media for it
+func checkTornDown(server *SIPServer, ua *testUA) error {
+	server.callsMu.Lock()
+	active, dialogs := len(server.calls), len(server.dialogs)
+	server.callsMu.Unlock()
+	if active != 0 {
+		return fmt.Errorf("%d call(s) still active", active)
+	}
+	if dialogs != 0 {
+		return fmt.Errorf("%d dialog(s) still open", dialogs)
+	}
+
+	// Let frames already in flight arrive, then expect silence
+	ua.ReadAudio(100*time.Millisecond, func([]byte) bool { return false })
+	err := ua.ReadAudio(300*time.Millisecond, func([]byte) bool { return true })
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("audio still arriving after BYE")
+}
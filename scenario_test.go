@@ -0,0 +1,11 @@
+package main
+
+import "testing"
+
+// TestSelfTest runs the selftest command's scripted call, so that go test
+// places it too
+func TestSelfTest(t *testing.T) {
+	if err := runSelfTest(selfTestConfig(), SELFTEST_NUMBER); err != nil {
+		t.Fatal(err)
+	}
+}
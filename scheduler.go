@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	RTP_HEADER_SIZE = 12
+
+	// MAX_CATCHUP_TICKS is how far the media clock may fall behind, from a
+	// stall of the process or the machine, and still make up the ticks it
+	// missed; beyond it the missed audio is skipped
+	MAX_CATCHUP_TICKS = 20
+)
+
+// rtpPacketPool recycles packet buffers between streams so that calls
+// starting and ending don't churn the heap
+var rtpPacketPool = sync.Pool{
+	New: func() any {
+		packet := make([]byte, RTP_HEADER_SIZE+MAX_FRAME_SIZE, RTP_HEADER_SIZE+MAX_FRAME_SIZE+SRTP_MAX_TAG_SIZE)
+		return &packet
+	},
+}
+
+// outgoingPacket is a datagram queued for batched transmission
+type outgoingPacket struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// batchSender transmits a batch of packets on one socket. Implementations
+// are platform specific (sendmmsg on Linux, a write loop elsewhere) and may
+// keep scratch space between calls; they are not safe for concurrent use.
+type batchSender interface {
+	Send(packets []outgoingPacket) error
+}
+
+// sendQueue collects one tick's packets for a socket. The packet slice and
+// the platform sender's scratch space are reused from tick to tick.
+type sendQueue struct {
+	packets []outgoingPacket
+	sender  batchSender
+	idle    int // Ticks in a row without a packet
+}
+
+// rtpStream is an outgoing RTP stream driven by the media scheduler. Every
+// packet time it asks fill for the next frame of linear samples; the
+// stream ends when fill returns false.
+type rtpStream struct {
+	conn        *net.UDPConn
+	remoteAddr  *net.UDPAddr
+	fill        func(samples []int16) bool
+	sink        func(packet []byte) // If set, takes packets instead of conn
+	target      func() *net.UDPAddr // If set, replaces remoteAddr, asked every frame
+	payloadType byte
+
+	// The codec the audio is encoded in, and its payload type, which RED
+	// blocks carry when payloadType is RED's
+	codec            *codec
+	codecPayloadType byte
+	encoder          audioEncoder
+
+	// A wideband codec's 16kHz frames are read from fillWide whenever
+	// wideband says they can be, and otherwise upsampled from fill's
+	wideband    func() bool
+	fillWide    func(samples []int16) bool
+	wideSamples []int16
+	upsampler   upsampler
+
+	sequenceNumber uint16
+	timestamp      uint32
+	ssrc           uint32
+
+	// The first packet, the first after a frame of silence, and any whose
+	// frame talkspurt says begins one carry the marker bit
+	talkspurt func() bool
+	begun     bool
+	silent    bool
+
+	// Milliseconds of audio in each packet, and scheduler ticks to wait
+	// before the next
+	ptime int
+	wait  int
+
+	samples []int16
+	packet  *[]byte // Pooled; the header is rewritten in place every frame
+	done    chan struct{}
+
+	// RFC 2198 redundancy: the previous frame is resent with each packet
+	redundant    bool
+	previous     []byte
+	havePrevious bool
+
+	// SRTP: packets are encrypted once keys gives keys, and until then
+	// not sent
+	keys func() *srtpKeys
+	srtp *srtpContext
+
+	// The RTP session of the call's port, if it has one: the stream's
+	// packets are numbered and encrypted as part of it, and counted for
+	// its sender reports. Without one the stream numbers its own.
+	session *rtpSession
+}
+
+// newRTPStream creates a PCMU stream sending to remoteAddr over conn, with
+// a random SSRC, sequence number and timestamp; useCodec changes the codec.
+// A nil remoteAddr keeps the stream running without sending anything.
+func newRTPStream(conn *net.UDPConn, remoteAddr *net.UDPAddr, fill func(samples []int16) bool) *rtpStream {
+	stream := &rtpStream{
+		conn:           conn,
+		remoteAddr:     remoteAddr,
+		fill:           fill,
+		payloadType:    PCMU_PAYLOAD_TYPE,
+		codec:          pcmuCodec,
+		encoder:        pcmuCodec.newEncoder(),
+		ssrc:           rand.Uint32(),
+		sequenceNumber: uint16(rand.Uint32()),
+		timestamp:      rand.Uint32(),
+		ptime:          DEFAULT_PTIME,
+		samples:        make([]int16, FRAME_SIZE),
+		packet:         rtpPacketPool.Get().(*[]byte),
+		done:           make(chan struct{}),
+	}
+
+	// The fixed part of the header never changes during the stream
+	packet := *stream.packet
+	packet[0] = 0x80 // Version 2, no padding, no extension, no CSRC
+	packet[1] = stream.payloadType
+
+	return stream
+}
+
+// useCodec makes the stream send audio in c under payload type pt; it
+// must come before enableRedundancy
+func (st *rtpStream) useCodec(c *codec, pt byte) {
+	st.codec = c
+	st.codecPayloadType = pt
+	st.encoder = c.newEncoder()
+	if c.wideband {
+		st.wideSamples = make([]int16, 2*len(st.samples))
+	}
+	st.payloadType = pt
+	(*st.packet)[1] = pt
+}
+
+// usePacketTime makes the stream send ptime milliseconds of audio in each
+// packet, rather than DEFAULT_PTIME; it must come after useCodec, and ptime
+// be one the codec can send (see codec.packetTime)
+func (st *rtpStream) usePacketTime(ptime int) {
+	st.ptime = ptime
+	st.samples = make([]int16, ptime*SAMPLE_RATE/1000)
+	if st.wideSamples != nil {
+		st.wideSamples = make([]int16, 2*len(st.samples))
+	}
+}
+
+// Done is closed once the stream has sent its last frame
+func (st *rtpStream) Done() <-chan struct{} {
+	return st.done
+}
+
+// nextPacket produces the stream's next RTP packet, due at the scheduler's
+// time at, or ok=false when the stream has finished. The returned slice is
+// only valid until the next call.
+func (st *rtpStream) nextPacket(at time.Time) (packet []byte, ok bool) {
+	frame, ok := st.nextFrame()
+	if !ok {
+		return nil, false
+	}
+
+	packet = *st.packet
+	ssrc, seq, timestamp := st.ssrc, st.sequenceNumber, st.timestamp
+	if st.session != nil {
+		ssrc, seq, timestamp = st.session.number(st.codec.clockRate, st.ptime, at)
+	} else {
+		st.sequenceNumber++
+		st.timestamp += st.codec.frameTicks(st.ptime)
+	}
+	packet[1] = st.payloadType
+	if st.beginsTalkspurt(frame) {
+		packet[1] |= 0x80 // Marker
+	}
+	binary.BigEndian.PutUint16(packet[2:4], seq)
+	binary.BigEndian.PutUint32(packet[4:8], timestamp)
+	binary.BigEndian.PutUint32(packet[8:12], ssrc)
+
+	if st.redundant {
+		packet = packet[:st.writeRedundantPayload(packet, frame)]
+	} else {
+		packet = packet[:RTP_HEADER_SIZE+st.encoder.Encode(packet[RTP_HEADER_SIZE:], frame)]
+	}
+	if st.keys != nil && st.srtp == nil {
+		if keys := st.keys(); keys != nil {
+			st.encrypt(keys)
+		}
+	}
+	if st.srtp != nil {
+		packet = st.srtp.protect(packet)
+	}
+	return packet, true
+}
+
+// beginsTalkspurt reports whether frame, just read, starts a talkspurt. A
+// source saying one begins on a silent frame is taken at its word when the
+// silence ends.
+func (st *rtpStream) beginsTalkspurt(frame []int16) bool {
+	silent := !slices.ContainsFunc(frame, func(sample int16) bool { return sample != 0 })
+	began := !st.begun || (!silent && (st.silent || (st.talkspurt != nil && st.talkspurt())))
+	st.begun, st.silent = true, silent
+	return began
+}
+
+// markTalkspurts marks the packets where source says a talkspurt begins,
+// as well as those the stream finds itself
+func (st *rtpStream) markTalkspurts(source MediaSource) {
+	t, ok := source.(TalkspurtSource)
+	if !ok {
+		return
+	}
+	previous := st.talkspurt
+	st.talkspurt = func() bool {
+		began := t.Talkspurt()
+		return (previous != nil && previous()) || began
+	}
+}
+
+// encrypt makes the stream send SRTP with our key, in its call's context
+// if it has an RTP session, since a new context for each stream would
+// start its rollover counter again under the same SSRC
+func (st *rtpStream) encrypt(keys *srtpKeys) {
+	var srtp *srtpContext
+	var err error
+	if st.session != nil {
+		srtp, err = st.session.encryption(keys)
+	} else {
+		srtp, err = newSRTPContext(keys.suite, keys.local)
+	}
+	if err != nil {
+		log.Printf("❌ Failed to key SRTP stream: %v", err)
+		return
+	}
+	st.srtp = srtp
+}
+
+// sendable reports whether the stream's packets may go out: not while
+// they should be encrypted and can't be yet
+func (st *rtpStream) sendable() bool {
+	return st.keys == nil || st.srtp != nil
+}
+
+// count tells the stream's RTCP of a packet it sent, due at at
+func (st *rtpStream) count(packet []byte, at time.Time) {
+	if st.session == nil {
+		return
+	}
+	octets := len(packet) - RTP_HEADER_SIZE
+	if st.srtp != nil {
+		octets -= st.srtp.tagSize
+	}
+	st.session.sent(binary.BigEndian.Uint32(packet[4:8]), st.codec.clockRate, octets, at)
+}
+
+// nextFrame reads the stream's next frame of audio at its codec's rate,
+// reporting false when the stream has finished
+func (st *rtpStream) nextFrame() ([]int16, bool) {
+	if !st.codec.wideband {
+		return st.samples, st.fill(st.samples)
+	}
+	if st.fillWide != nil && st.wideband() {
+		return st.wideSamples, st.fillWide(st.wideSamples)
+	}
+	if !st.fill(st.samples) {
+		return nil, false
+	}
+	st.upsampler.upsample(st.wideSamples, st.samples)
+	return st.wideSamples, true
+}
+
+// finish returns the stream's buffer to the pool and signals completion
+func (st *rtpStream) finish() {
+	if st.redundant {
+		redPacketPool.Put(st.packet)
+	} else {
+		rtpPacketPool.Put(st.packet)
+	}
+	st.packet = nil
+	close(st.done)
+}
+
+// mediaScheduler drives every outgoing RTP stream from a single clock,
+// ticking every PTIME_STEP; a stream sends on the ticks its packet time
+// falls due. Frames for all streams are produced together and handed to the
+// platform's batch writer, one batch per socket; each call sends from its
+// own RTP port. In steady state a tick allocates nothing: packets are
+// built in each stream's pooled buffer and queued in per-socket slices
+// that are reused.
+type mediaScheduler struct {
+	mu      sync.Mutex
+	streams []*rtpStream
+	queues  map[*net.UDPConn]*sendQueue
+	stop    chan struct{}
+	stopped sync.Once
+}
+
+// newMediaScheduler creates an idle scheduler; call Run to start the clock
+func newMediaScheduler() *mediaScheduler {
+	return &mediaScheduler{
+		queues: make(map[*net.UDPConn]*sendQueue),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Add registers a stream; it starts sending on the next tick
+func (m *mediaScheduler) Add(stream *rtpStream) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.streams = append(m.streams, stream)
+}
+
+// Run ticks every PTIME_STEP until Stop is called. Each tick is due at a
+// fixed point of a schedule counted on the monotonic clock from when Run
+// started, rather than timed from the last, so however late a tick is
+// woken the next is still due on time, and the streams' timestamps, which
+// move on a frame a packet, keep to the wall clock however long they run.
+// Ticks missed while the process was stalled are made up at once, up to
+// MAX_CATCHUP_TICKS of them.
+func (m *mediaScheduler) Run() {
+	start := time.Now()
+	step := PTIME_STEP * time.Millisecond
+	timer := time.NewTimer(step)
+	defer timer.Stop()
+
+	var ticks int64 // Run so far; tick n is due at start + n*step
+	for {
+		select {
+		case <-timer.C:
+		case <-m.stop:
+			return
+		}
+
+		due := int64(time.Since(start) / step)
+		if behind := due - ticks; behind > MAX_CATCHUP_TICKS {
+			log.Printf("⚠️  Media clock fell %v behind; skipping the audio missed", time.Duration(behind)*step)
+			ticks = due - 1
+		}
+		for ; ticks < due; ticks++ {
+			m.tick(start.Add(time.Duration(ticks+1) * step))
+		}
+		timer.Reset(time.Until(start.Add(time.Duration(ticks+1) * step)))
+	}
+}
+
+// Stop halts the clock; streams still registered are abandoned
+func (m *mediaScheduler) Stop() {
+	m.stopped.Do(func() { close(m.stop) })
+}
+
+// tick produces one frame for every stream whose packet is due at at and
+// sends them in batches grouped by socket
+func (m *mediaScheduler) tick(at time.Time) {
+	m.mu.Lock()
+	active := m.streams[:0]
+	for _, stream := range m.streams {
+		if stream.wait > 0 {
+			stream.wait--
+			active = append(active, stream)
+			continue
+		}
+		stream.wait = stream.ptime/PTIME_STEP - 1
+
+		packet, ok := stream.nextPacket(at)
+		if !ok {
+			stream.finish()
+			continue
+		}
+		active = append(active, stream)
+
+		addr := stream.remoteAddr
+		if stream.target != nil {
+			addr = stream.target()
+		}
+		if !stream.sendable() {
+			addr = nil
+		}
+		if stream.sink != nil {
+			stream.sink(packet)
+		} else if addr != nil {
+			queue := m.queues[stream.conn]
+			if queue == nil {
+				queue = &sendQueue{sender: newBatchSender(stream.conn)}
+				m.queues[stream.conn] = queue
+			}
+			queue.packets = append(queue.packets, outgoingPacket{
+				data: packet,
+				addr: addr,
+			})
+			stream.count(packet, at)
+		}
+	}
+	for i := len(active); i < len(m.streams); i++ {
+		m.streams[i] = nil
+	}
+	m.streams = active
+
+	// Packets point into stream buffers, so send before releasing the lock
+	for conn, queue := range m.queues {
+		if len(queue.packets) == 0 {
+			// No stream used this socket for the longest packet time;
+			// forget it, as its call has most likely ended
+			if queue.idle++; queue.idle >= MAX_PTIME/PTIME_STEP {
+				delete(m.queues, conn)
+			}
+			continue
+		}
+		queue.idle = 0
+		if err := queue.sender.Send(queue.packets); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Error sending RTP packets: %v", err)
+		}
+		if packetCapture.Load() != nil {
+			for _, packet := range queue.packets {
+				captureDatagram(conn, packet.addr.AddrPort(), packet.data, true)
+			}
+		}
+		clear(queue.packets)
+		queue.packets = queue.packets[:0]
+	}
+	m.mu.Unlock()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// BENCH_BATCH is how many packets go out on one socket in each send of
+// the send path benchmarks, as many calls' streams would in one tick
+const BENCH_BATCH = 64
+
+// benchSockets opens a socket to send from and one to send to on loopback.
+// Nothing reads the receiver; what overflows its buffer is dropped, which
+// the sender never sees.
+func benchSockets(b *testing.B) (conn *net.UDPConn, to *net.UDPAddr) {
+	b.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		conn.Close()
+		receiver.Close()
+	})
+	return conn, receiver.LocalAddr().(*net.UDPAddr)
+}
+
+// benchPackets is a batch of 20ms PCMU packets to to
+func benchPackets(to *net.UDPAddr) []outgoingPacket {
+	packets := make([]outgoingPacket, BENCH_BATCH)
+	for i := range packets {
+		packets[i] = outgoingPacket{data: make([]byte, RTP_HEADER_SIZE+FRAME_SIZE), addr: to}
+	}
+	return packets
+}
+
+// BenchmarkSendBatched sends with the platform's batch sender, sendmmsg(2)
+// on Linux
+func BenchmarkSendBatched(b *testing.B) {
+	conn, to := benchSockets(b)
+	packets := benchPackets(to)
+	sender := newBatchSender(conn)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		sender.Send(packets)
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*BENCH_BATCH), "ns/packet")
+}
+
+// BenchmarkSendUnbatched writes the same packets one at a time, for
+// comparison
+func BenchmarkSendUnbatched(b *testing.B) {
+	conn, to := benchSockets(b)
+	packets := benchPackets(to)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, packet := range packets {
+			conn.WriteToUDP(packet.data, packet.addr)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*BENCH_BATCH), "ns/packet")
+}
+
+// BenchmarkSchedulerTick runs the scheduler's ticks for calls each sending
+// a tone from their own port, from encoding the frames to sending them
+func BenchmarkSchedulerTick(b *testing.B) {
+	for _, calls := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("calls=%d", calls), func(b *testing.B) {
+			m := newMediaScheduler()
+			for range calls {
+				conn, to := benchSockets(b)
+				tone := newToneSource(1004)
+				m.Add(newRTPStream(conn, to, tone.ReadFrame))
+			}
+
+			b.ReportAllocs()
+			at := time.Now()
+			for b.Loop() {
+				at = at.Add(PTIME_STEP * time.Millisecond)
+				m.tick(at)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SCREEN_REJECT_DURATION is how long a rejected caller hears reorder
+	// tone before the call is hung up
+	SCREEN_REJECT_DURATION = 3 * time.Second
+
+	// SCREEN_DROP_TIMEOUT bounds how long a dropped call is held in
+	// silence when the caller doesn't give up
+	SCREEN_DROP_TIMEOUT = 2 * time.Minute
+)
+
+// screenVerdict is what happens to a call coming in from outside
+type screenVerdict int
+
+const (
+	screenAccept   screenVerdict = iota
+	screenReject                 // Reorder tone, then hang up
+	screenDrop                   // Dead air until the caller gives up
+	screenHoneypot               // Connected to the honeypot destination
+)
+
+func (v screenVerdict) String() string {
+	switch v {
+	case screenReject:
+		return "rejected"
+	case screenDrop:
+		return "dropped"
+	case screenHoneypot:
+		return "sent to the honeypot"
+	default:
+		return "accepted"
+	}
+}
+
+// callScreen decides which inbound callers get through, by caller ID. The
+// config sets up its lists; the API changes them while the server runs.
+type callScreen struct {
+	mu     sync.Mutex
+	config ScreeningConfig
+	allow  []*digitPattern
+	block  []*digitPattern
+}
+
+// newCallScreen compiles the configured lists
+func newCallScreen(cfg ScreeningConfig) (*callScreen, error) {
+	screen := &callScreen{config: cfg}
+	var err error
+	if screen.allow, err = compileScreenList(cfg.Allow); err != nil {
+		return nil, fmt.Errorf("screening.allow: %v", err)
+	}
+	if screen.block, err = compileScreenList(cfg.Block); err != nil {
+		return nil, fmt.Errorf("screening.block: %v", err)
+	}
+	return screen, nil
+}
+
+// compileScreenList compiles caller ID patterns, written like digit map
+// patterns: "1800x." blocks every number starting with 1800
+func compileScreenList(sources []string) ([]*digitPattern, error) {
+	patterns := make([]*digitPattern, len(sources))
+	for i, source := range sources {
+		pattern, err := compileDigitPattern(source)
+		if err != nil {
+			return nil, err
+		}
+		patterns[i] = pattern
+	}
+	return patterns, nil
+}
+
+// Check decides what happens to a call from callerID, empty if the caller
+// is anonymous. Callers on the allowlist always get through; callers on
+// the blocklist never do; everyone else gets through only if there is no
+// allowlist.
+func (c *callScreen) Check(callerID string) (screenVerdict, string) {
+	callerID = strings.TrimPrefix(callerID, "+")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if callerID == "" {
+		if c.config.BlockAnonymous {
+			return c.blocked(), "anonymous"
+		}
+		return screenAccept, ""
+	}
+	if pattern := matchScreenList(c.allow, callerID); pattern != nil {
+		return screenAccept, ""
+	}
+	if pattern := matchScreenList(c.block, callerID); pattern != nil {
+		return c.blocked(), "on the blocklist as " + pattern.source
+	}
+	if len(c.allow) > 0 {
+		return c.blocked(), "not on the allowlist"
+	}
+	return screenAccept, ""
+}
+
+// blocked is the verdict for a blocked caller. Must be called with mu held.
+func (c *callScreen) blocked() screenVerdict {
+	switch c.config.Action {
+	case "drop":
+		return screenDrop
+	case "honeypot":
+		return screenHoneypot
+	default:
+		return screenReject
+	}
+}
+
+// matchScreenList returns the first pattern matching callerID in full
+func matchScreenList(patterns []*digitPattern, callerID string) *digitPattern {
+	for _, pattern := range patterns {
+		if result := pattern.Match(callerID); result == matchComplete || result == matchExtendable {
+			return pattern
+		}
+	}
+	return nil
+}
+
+// Config returns the current settings and lists
+func (c *callScreen) Config() ScreeningConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cfg := c.config
+	cfg.Allow = slices.Clone(cfg.Allow)
+	cfg.Block = slices.Clone(cfg.Block)
+	return cfg
+}
+
+// Add puts a pattern on the "allow" or "block" list
+func (c *callScreen) Add(list, source string) error {
+	pattern, err := compileDigitPattern(source)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sources, patterns := c.list(list)
+	if slices.Contains(*sources, source) {
+		return nil
+	}
+	*sources = append(*sources, source)
+	*patterns = append(*patterns, pattern)
+	return nil
+}
+
+// Remove takes a pattern off the "allow" or "block" list, reporting
+// whether it was there
+func (c *callScreen) Remove(list, source string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sources, patterns := c.list(list)
+	i := slices.Index(*sources, source)
+	if i < 0 {
+		return false
+	}
+	*sources = slices.Delete(*sources, i, i+1)
+	*patterns = slices.Delete(*patterns, i, i+1)
+	return true
+}
+
+// list returns the sources and compiled patterns of a list. Must be called
+// with mu held.
+func (c *callScreen) list(name string) (*[]string, *[]*digitPattern) {
+	if name == "allow" {
+		return &c.config.Allow, &c.allow
+	}
+	return &c.config.Block, &c.block
+}
+
+// screenIncomingCall applies the exchange's screening to a call for number
+// from outside, via a peer or trunk. It reports false if the caller was
+// turned away, in which case the call leg has been dealt with.
+func (s *SIPServer) screenIncomingCall(session *CallSession, via, number string) bool {
+	ex := session.exchange
+	verdict, reason := ex.screen.Check(session.caller())
+	if verdict == screenAccept {
+		return true
+	}
+
+	caller := session.caller()
+	if caller == "" {
+		caller = "anonymous caller"
+	}
+	fmt.Printf("🚫 Call from %s via %s for %q %s: %s\n", caller, via, number, verdict, reason)
+
+	// Nothing the caller dials from here on is routed
+	session.digitsMu.Lock()
+	session.routed = true
+	session.digitsMu.Unlock()
+
+	switch verdict {
+	case screenDrop:
+		s.spawn(func() {
+			timer := time.NewTimer(SCREEN_DROP_TIMEOUT)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				s.hangupCall(session)
+			case <-session.ctx.Done():
+			}
+		})
+	case screenHoneypot:
+		res := resolution{number: number, route: -1, destination: ex.screen.Config().Honeypot}
+		s.spawn(func() { s.playDestination(session, res) })
+	default:
+		s.spawn(func() {
+			reorder := session.progressTone(progressReorder)
+			s.playTone(session.ctx, session, newLimitedSource(reorder, SCREEN_REJECT_DURATION))
+			s.hangupCall(session)
+		})
+	}
+	return false
+}
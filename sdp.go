@@ -0,0 +1,638 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PCMU_PAYLOAD_TYPE is the static payload type of μ-law audio, the
+	// codec used when nothing else has been negotiated
+	PCMU_PAYLOAD_TYPE = 0
+
+	// DEFAULT_DTMF_PAYLOAD_TYPE is offered for RFC 2833 telephone events
+	// when we make the offer; answering, the phone's own choice is used
+	DEFAULT_DTMF_PAYLOAD_TYPE = 101
+)
+
+// audioFormats are the codec and payload types offer/answer settled on
+// for a call's audio: the codec and its payload type, and RFC 2198
+// redundant audio and RFC 2833 telephone events, each 0 if the call
+// doesn't use it. Until a codec is settled, an offer lists the choices.
+// ptime is the packet time we send, if the other side asked for one.
+// We send in these; what we may receive is in received. crypto is set
+// for audio encrypted with SRTP keyed in the SDP, and webrtc for a
+// browser's, reached by ICE and keyed with DTLS.
+type audioFormats struct {
+	codec    *codec
+	audio    byte
+	choices  []*codec
+	red      byte
+	dtmf     byte
+	ptime    int
+	received payloadTable
+	crypto   *sdesCrypto
+	webrtc   *webrtcMedia
+	rtcpMux  bool // RTCP shares the RTP port (RFC 5761)
+}
+
+// payloadKind is what a payload type received on a call carries
+type payloadKind int
+
+const (
+	payloadUnknown   payloadKind = iota // Ignored
+	payloadAudio                        // The call's codec
+	payloadRedundant                    // RFC 2198 redundant audio in it
+	payloadEvent                        // RFC 2833 telephone events
+)
+
+// payloadTable is what each payload type received on a call carries.
+// Phones number dynamic payload types as they like, so telephone events
+// may come as 96 or 100 rather than our 101.
+type payloadTable map[byte]payloadKind
+
+// offeredFormats are what we offer: the exchange's codecs, telephone
+// events, and redundant audio if the exchange allows it
+func offeredFormats(qos QoSConfig) audioFormats {
+	formats := audioFormats{choices: qos.preferredCodecs(), dtmf: DEFAULT_DTMF_PAYLOAD_TYPE}
+	narrowClock := slices.ContainsFunc(formats.choices, func(c *codec) bool { return c.clockRate == SAMPLE_RATE })
+	if qos.Redundancy && narrowClock {
+		formats.red = DEFAULT_RED_PAYLOAD_TYPE
+	}
+	formats.received = formats.payloadTypes(nil)
+	return formats
+}
+
+// primary is the codec audio is sent and received in, and its payload
+// type: the negotiated one, or PCMU, which every phone takes, if there
+// hasn't been a negotiation
+func (f audioFormats) primary() (*codec, byte) {
+	if f.codec != nil {
+		return f.codec, f.audio
+	}
+	return pcmuCodec, PCMU_PAYLOAD_TYPE
+}
+
+// packetTime is how many milliseconds of audio each packet we send
+// carries
+func (f audioFormats) packetTime() int {
+	return cmp.Or(f.ptime, DEFAULT_PTIME)
+}
+
+// payloadTypes is the table of what may be received in the formats,
+// from the rtpmap attributes of the other side's stream m, if any, and
+// otherwise our own payload types. Telephone events are also taken under
+// 101, which nearly every phone uses, unless m gives it to something else.
+func (f audioFormats) payloadTypes(m *mediaDescription) payloadTable {
+	c, audio := f.primary()
+	table := payloadTable{audio: payloadAudio, DEFAULT_DTMF_PAYLOAD_TYPE: payloadEvent}
+	if f.red != 0 {
+		table[f.red] = payloadRedundant
+	}
+	if f.dtmf != 0 {
+		table[f.dtmf] = payloadEvent
+	}
+	if m == nil {
+		return table
+	}
+	for _, format := range m.Formats {
+		n, err := strconv.Atoi(format)
+		if err != nil || n < 0 || n > 127 {
+			continue
+		}
+		// Digits are read from telephone events at any clock rate
+		switch encoding := m.encoding(format); {
+		case encoding == strings.ToLower(c.rtpmap):
+			table[byte(n)] = payloadAudio
+		case encoding == "red/8000" && f.red != 0:
+			table[byte(n)] = payloadRedundant
+		case strings.HasPrefix(encoding, "telephone-event/"):
+			table[byte(n)] = payloadEvent
+		default:
+			delete(table, byte(n))
+		}
+	}
+	return table
+}
+
+// candidates are the codecs an answer may pick from: the one already
+// negotiated for the call, or else the choices
+func (f audioFormats) candidates() []*codec {
+	if f.codec != nil {
+		return []*codec{f.codec}
+	}
+	return f.choices
+}
+
+// codecAt is the codec sent under payload type pt, or nil
+func (f audioFormats) codecAt(pt byte) *codec {
+	if f.codec != nil {
+		if pt == f.audio {
+			return f.codec
+		}
+		return nil
+	}
+	for _, c := range f.choices {
+		if c.payloadType == pt {
+			return c
+		}
+	}
+	return nil
+}
+
+// accepts reports whether an offer has an audio stream in a codec the
+// call can use, encrypted if the call's audio is and plain if not, and
+// from a browser if the call is
+func (f audioFormats) accepts(sd *sessionDescription) bool {
+	audio := sd.audio()
+	if audio == nil {
+		return false
+	}
+	_, ok := negotiateFormats(audio, f.candidates(), false)
+	crypto, secure := negotiateCrypto(audio)
+	webrtc, connectable := negotiateWebRTC(sd, audio)
+	return ok && secure && connectable && (crypto != nil) == (f.crypto != nil) && (webrtc != nil) == (f.webrtc != nil)
+}
+
+// sessionDescription is an SDP body (RFC 4566) taken apart. Lines the
+// server has no use for, such as b= and k=, are dropped.
+type sessionDescription struct {
+	Origin     string   // After "o=", e.g. "- 1 1 IN IP4 192.168.1.5"
+	Name       string   // After "s="
+	Connection string   // Session-level, after "c=", e.g. "IN IP4 192.168.1.5"; "" if none
+	Time       string   // After "t="
+	Attributes []string // Session-level, after "a=", e.g. "sendonly"
+	Media      []mediaDescription
+}
+
+// mediaDescription is one m= section of an SDP body
+type mediaDescription struct {
+	Type       string   // "audio", "video" and so on
+	Port       int      // 0 for a stream that is rejected or disabled
+	Proto      string   // "RTP/AVP"
+	Formats    []string // Payload types, most preferred first
+	Connection string   // After "c=", overriding the session's; "" if none
+	Attributes []string // After "a=", e.g. "rtpmap:0 PCMU/8000"
+}
+
+// errNoSDP is returned for a message without an SDP body
+var errNoSDP = errors.New("no SDP")
+
+// parseSDP parses an SDP body
+func parseSDP(body string) (*sessionDescription, error) {
+	sd := &sessionDescription{}
+	var m *mediaDescription
+	started := false
+	for _, line := range splitLines(body) {
+		if line == "" {
+			continue
+		}
+		kind, value, found := strings.Cut(line, "=")
+		if !found || len(kind) != 1 {
+			return nil, fmt.Errorf("bad SDP line %q", line)
+		}
+		if !started && line != "v=0" {
+			return nil, fmt.Errorf("SDP starts with %q, not v=0", line)
+		}
+		started = true
+
+		switch kind {
+		case "o":
+			sd.Origin = value
+		case "s":
+			sd.Name = value
+		case "t":
+			sd.Time = value
+		case "c":
+			if m != nil {
+				m.Connection = value
+			} else {
+				sd.Connection = value
+			}
+		case "a":
+			if m != nil {
+				m.Attributes = append(m.Attributes, value)
+			} else {
+				sd.Attributes = append(sd.Attributes, value)
+			}
+		case "m":
+			fields := strings.Fields(value)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("bad SDP media line %q", line)
+			}
+			portSpec, _, _ := strings.Cut(fields[1], "/") // A port count is ignored
+			port, err := strconv.Atoi(portSpec)
+			if err != nil || port < 0 || port > 65535 {
+				return nil, fmt.Errorf("bad SDP media port in %q", line)
+			}
+			sd.Media = append(sd.Media, mediaDescription{Type: fields[0], Port: port, Proto: fields[2], Formats: fields[3:]})
+			m = &sd.Media[len(sd.Media)-1]
+		}
+	}
+	if sd.Origin == "" && len(sd.Media) == 0 {
+		return nil, errNoSDP
+	}
+	return sd, nil
+}
+
+// messageSDP parses the SDP body of a SIP message, or is nil if it has
+// none or it can't be parsed
+func messageSDP(message string) *sessionDescription {
+	_, body := splitMessage(message)
+	if strings.TrimSpace(body) == "" {
+		return nil
+	}
+	sd, err := parseSDP(body)
+	if err != nil {
+		return nil
+	}
+	return sd
+}
+
+// isSDP reports whether a message's Content-Type says its body is SDP
+func isSDP(headers map[string]string) bool {
+	contentType, _, _ := strings.Cut(headers["Content-Type"], ";")
+	return strings.EqualFold(strings.TrimSpace(contentType), "application/sdp")
+}
+
+// String puts the description back together
+func (sd *sessionDescription) String() string {
+	var b strings.Builder
+	b.WriteString("v=0\r\n")
+	fmt.Fprintf(&b, "o=%s\r\n", sd.Origin)
+	fmt.Fprintf(&b, "s=%s\r\n", cmp.Or(sd.Name, "-"))
+	if sd.Connection != "" {
+		fmt.Fprintf(&b, "c=%s\r\n", sd.Connection)
+	}
+	fmt.Fprintf(&b, "t=%s\r\n", cmp.Or(sd.Time, "0 0"))
+	for _, attribute := range sd.Attributes {
+		fmt.Fprintf(&b, "a=%s\r\n", attribute)
+	}
+	for _, m := range sd.Media {
+		fmt.Fprintf(&b, "m=%s %d %s %s\r\n", m.Type, m.Port, m.Proto, strings.Join(m.Formats, " "))
+		if m.Connection != "" {
+			fmt.Fprintf(&b, "c=%s\r\n", m.Connection)
+		}
+		for _, attribute := range m.Attributes {
+			fmt.Fprintf(&b, "a=%s\r\n", attribute)
+		}
+	}
+	return b.String()
+}
+
+// audio is the description's audio stream the server can take part in:
+// the first that is RTP, over DTLS (UDP/TLS/RTP/SAVPF) or not, not
+// rejected, and carries a codec the server speaks. It is nil if there is
+// none.
+func (sd *sessionDescription) audio() *mediaDescription {
+	for i := range sd.Media {
+		m := &sd.Media[i]
+		if m.Type != "audio" || m.Port == 0 || !strings.HasPrefix(strings.TrimPrefix(m.Proto, "UDP/TLS/"), "RTP/") {
+			continue
+		}
+		for _, c := range codecs {
+			if _, ok := m.payloadType(c.rtpmap); ok {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// payloadType is the payload type a stream gives encoding, such as
+// "telephone-event/8000", in its rtpmap attributes. The codecs the server
+// speaks have static payload types, which need no rtpmap.
+func (m *mediaDescription) payloadType(encoding string) (byte, bool) {
+	for _, format := range m.Formats {
+		n, err := strconv.Atoi(format)
+		if err != nil || n < 0 || n > 127 {
+			continue
+		}
+		if m.encoding(format) == strings.ToLower(encoding) {
+			return byte(n), true
+		}
+	}
+	return 0, false
+}
+
+// encoding is the lower-case encoding name and clock rate a stream's
+// rtpmap gives a payload type, without any channel count
+func (m *mediaDescription) encoding(format string) string {
+	for _, attribute := range m.Attributes {
+		rest, ok := strings.CutPrefix(attribute, "rtpmap:")
+		if !ok {
+			continue
+		}
+		if pt, encoding, _ := strings.Cut(rest, " "); pt == format {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			return strings.TrimSuffix(encoding, "/1")
+		}
+	}
+	for _, c := range codecs {
+		if c.payloadType < 96 && format == strconv.Itoa(int(c.payloadType)) {
+			return strings.ToLower(c.rtpmap)
+		}
+	}
+	return ""
+}
+
+// fmtp is the format parameters a stream's fmtp attribute gives a
+// payload type, or "" if it has none
+func (m *mediaDescription) fmtp(pt byte) string {
+	format := strconv.Itoa(int(pt))
+	for _, attribute := range m.Attributes {
+		rest, ok := strings.CutPrefix(attribute, "fmtp:")
+		if !ok {
+			continue
+		}
+		if f, parameters, _ := strings.Cut(rest, " "); f == format {
+			return strings.TrimSpace(parameters)
+		}
+	}
+	return ""
+}
+
+// attribute is the value of a stream's attribute called name, as
+// "actpass" for "setup:actpass", or "" if it has none
+func (m *mediaDescription) attribute(name string) string {
+	return attributeValue(m.Attributes, name)
+}
+
+// attribute is the value of an attribute called name on a stream, or
+// else for the whole session
+func (sd *sessionDescription) attribute(m *mediaDescription, name string) string {
+	return cmp.Or(m.attribute(name), attributeValue(sd.Attributes, name))
+}
+
+// attributeValue is the value of the first of attributes called name
+func attributeValue(attributes []string, name string) string {
+	for _, attribute := range attributes {
+		if value, ok := strings.CutPrefix(attribute, name+":"); ok {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// direction is a stream's direction (RFC 3264): an attribute on the
+// stream overrides one for the whole session, and a connection address
+// of 0.0.0.0, how older phones hold a call (RFC 2543), counts as
+// sendonly, unless ICE finds the stream's address, when it is a
+// placeholder. The default is sendrecv.
+func (sd *sessionDescription) direction(m *mediaDescription) string {
+	for _, attributes := range [][]string{m.Attributes, sd.Attributes} {
+		for _, attribute := range attributes {
+			switch attribute {
+			case SDP_SENDRECV, SDP_SENDONLY, SDP_RECVONLY, SDP_INACTIVE:
+				return attribute
+			}
+		}
+	}
+	if ip := sd.connectionIP(m); ip != nil && ip.IsUnspecified() && ip.To4() != nil && sd.attribute(m, "ice-ufrag") == "" {
+		return SDP_SENDONLY
+	}
+	return SDP_SENDRECV
+}
+
+// connectionIP is the address a stream's media goes to, from its own c=
+// line or the session's, or nil if neither gives one
+func (sd *sessionDescription) connectionIP(m *mediaDescription) net.IP {
+	connection := cmp.Or(m.Connection, sd.Connection)
+	fields := strings.Fields(connection)
+	if len(fields) < 3 || fields[0] != "IN" || (fields[1] != "IP4" && fields[1] != "IP6") {
+		return nil
+	}
+	address, _, _ := strings.Cut(fields[2], "/") // Multicast TTL
+	return net.ParseIP(address)
+}
+
+// rtpAddr is where a stream's RTP goes, defaultIP standing in for a
+// missing connection address
+func (sd *sessionDescription) rtpAddr(m *mediaDescription, defaultIP net.IP) *net.UDPAddr {
+	ip := sd.connectionIP(m)
+	if ip == nil {
+		ip = defaultIP
+	}
+	return &net.UDPAddr{IP: ip, Port: m.Port}
+}
+
+// negotiateFormats reads what the other side's offer or answer gives an
+// audio stream: the first of choices it carries is the call's codec, and
+// it reports false if it carries none of them. Redundant audio is only
+// taken up if the exchange allows it, and a packet time if it asks for
+// one.
+func negotiateFormats(m *mediaDescription, choices []*codec, redundancy bool) (audioFormats, bool) {
+	var formats audioFormats
+	for _, c := range choices {
+		if pt, ok := m.payloadType(c.rtpmap); ok {
+			formats.codec, formats.audio = c, pt
+			break
+		}
+	}
+	if formats.codec == nil {
+		return formats, false
+	}
+
+	// Both run at the codec's clock. Redundant audio is only sent in the
+	// 8kHz codecs; Opus has its own forward error correction. Its fmtp, if
+	// any, must say the redundant blocks are in the codec (RFC 2198 section
+	// 5).
+	if pt, ok := m.payloadType("red/8000"); ok && redundancy && pt >= 96 && formats.codec.clockRate == SAMPLE_RATE && redundantIn(m.fmtp(pt), formats.audio) {
+		formats.red = pt
+	}
+	if pt, ok := m.payloadType(fmt.Sprintf("telephone-event/%d", formats.codec.clockRate)); ok && pt >= 96 {
+		formats.dtmf = pt
+	}
+	formats.ptime = negotiatePtime(m, formats.codec)
+	formats.received = formats.payloadTypes(m)
+	formats.rtcpMux = slices.Contains(m.Attributes, "rtcp-mux")
+	return formats, true
+}
+
+// negotiatePtime is the packet time c can send that comes nearest to what
+// a stream's ptime and maxptime attributes ask for without going over, or
+// 0 if they don't ask for anything but our default
+func negotiatePtime(m *mediaDescription, c *codec) int {
+	ptime, _ := strconv.ParseFloat(m.attribute("ptime"), 64)
+	maxptime, _ := strconv.ParseFloat(m.attribute("maxptime"), 64)
+	if ptime <= 0 && (maxptime <= 0 || maxptime >= DEFAULT_PTIME) {
+		return 0
+	}
+	if ptime <= 0 {
+		ptime = DEFAULT_PTIME
+	}
+	if maxptime > 0 {
+		ptime = min(ptime, maxptime)
+	}
+	return c.packetTime(int(ptime))
+}
+
+// redundantIn reports whether a red fmtp, such as "0/0", has its blocks
+// all in payload type audio; an empty one doesn't say
+func redundantIn(fmtp string, audio byte) bool {
+	if fmtp == "" {
+		return true
+	}
+	for _, block := range strings.Split(fmtp, "/") {
+		if pt, err := strconv.Atoi(strings.TrimSpace(block)); err != nil || pt != int(audio) {
+			return false
+		}
+	}
+	return true
+}
+
+// localSDP is our offer of audio to the phone of dialog d, on the call's
+// RTP port, in the formats given; direction is sendrecv unless a call is
+// on hold
+func (s *SIPServer) localSDP(formats audioFormats, direction string, d *dialog) string {
+	sd := s.localDescription(d.remoteAddr)
+	var order []string
+	if formats.red != 0 {
+		order = append(order, strconv.Itoa(int(formats.red)))
+	}
+	if formats.codec != nil {
+		order = append(order, strconv.Itoa(int(formats.audio)))
+	} else {
+		for _, c := range formats.choices {
+			order = append(order, strconv.Itoa(int(c.payloadType)))
+		}
+	}
+	if formats.dtmf != 0 {
+		order = append(order, strconv.Itoa(int(formats.dtmf)))
+	}
+	sd.Media = []mediaDescription{s.localAudio(order, formats, direction, d.media.port)}
+	return sd.String()
+}
+
+// answerSDP is our answer to an offer (RFC 3264 section 6): a stream for
+// each offered, in the same order and with the same media ID, with the
+// audio stream accepted in the formats both sides have, in the offer's
+// order of preference, and the others rejected with port 0. The codec is
+// the call's, or the first of the choices the offer has, on the call's RTP
+// port. An offer formats doesn't accept can't be answered; it is refused
+// with 488 instead.
+func (s *SIPServer) answerSDP(offer *sessionDescription, formats audioFormats, direction string, d *dialog) string {
+	sd := s.localDescription(d.remoteAddr)
+	audio := offer.audio()
+	for i := range offer.Media {
+		m := &offer.Media[i]
+		if m != audio {
+			rejected := mediaDescription{Type: m.Type, Proto: m.Proto, Formats: m.Formats[:min(1, len(m.Formats))]}
+			if mid := m.attribute("mid"); mid != "" {
+				rejected.Attributes = []string{"mid:" + mid}
+			}
+			sd.Media = append(sd.Media, rejected)
+			continue
+		}
+
+		// Only formats the offer has go in the answer, under its payload
+		// types
+		answered, _ := negotiateFormats(m, formats.candidates(), formats.red != 0)
+		answered.ptime = formats.ptime // The call's streams keep theirs
+		if formats.crypto != nil {
+			// Our key, under the tag of the attribute this offer has
+			if offered, _ := negotiateCrypto(m); offered != nil {
+				offered.local = formats.crypto.local
+				answered.crypto = offered
+			}
+		}
+		var order []string
+		for _, format := range m.Formats {
+			pt, err := strconv.Atoi(format)
+			if err != nil || slices.Contains(order, format) {
+				continue
+			}
+			if (answered.codec != nil && pt == int(answered.audio)) || (pt != 0 && (pt == int(answered.red) || pt == int(answered.dtmf))) {
+				order = append(order, format)
+			}
+		}
+		local := s.localAudio(order, answered, direction, d.media.port)
+		if answered.crypto != nil {
+			local.Proto = m.Proto // Some phones offer keys under RTP/AVP
+		}
+		if formats.webrtc != nil {
+			s.answerWebRTC(sd, offer, &local, m, formats.webrtc, d.remoteAddr, d.media.port)
+		}
+		if mid := m.attribute("mid"); mid != "" {
+			local.Attributes = append(local.Attributes, "mid:"+mid)
+		}
+		sd.Media = append(sd.Media, local)
+	}
+	return sd.String()
+}
+
+// localDescription is the session part of our SDP to remote
+func (s *SIPServer) localDescription(remote *net.UDPAddr) *sessionDescription {
+	localIP := s.localIPFor(remote)
+	addrType := "IP4"
+	if isIPv6(localIP) {
+		addrType = "IP6"
+	}
+	return &sessionDescription{
+		Origin:     fmt.Sprintf("- 123456 654321 IN %s %s", addrType, localIP),
+		Name:       "Travel by Telephone",
+		Connection: fmt.Sprintf("IN %s %s", addrType, localIP),
+		Time:       "0 0",
+	}
+}
+
+// localAudio is our audio stream on port, listing the payload types in
+// order with an rtpmap for each
+func (s *SIPServer) localAudio(order []string, formats audioFormats, direction string, port int) mediaDescription {
+	m := mediaDescription{Type: "audio", Port: port, Proto: "RTP/AVP", Formats: order}
+	// Redundant audio is offered in the first 8kHz codec, and telephone
+	// events at the clock of the codec settled on
+	_, primary := formats.primary()
+	clock := SAMPLE_RATE
+	if formats.codec != nil {
+		clock = formats.codec.clockRate
+	} else if i := slices.IndexFunc(formats.choices, func(c *codec) bool { return c.clockRate == SAMPLE_RATE }); i >= 0 {
+		primary = formats.choices[i].payloadType
+	}
+	for _, format := range order {
+		pt, _ := strconv.Atoi(format)
+		switch c := formats.codecAt(byte(pt)); {
+		case c != nil:
+			m.Attributes = append(m.Attributes, "rtpmap:"+format+" "+c.rtpmap)
+			if c.fmtp != "" {
+				m.Attributes = append(m.Attributes, "fmtp:"+format+" "+c.fmtp)
+			}
+		case pt == int(formats.red):
+			m.Attributes = append(m.Attributes, "rtpmap:"+format+" red/8000", fmt.Sprintf("fmtp:%s %d/%d", format, primary, primary))
+		case pt == int(formats.dtmf):
+			m.Attributes = append(m.Attributes, fmt.Sprintf("rtpmap:%s telephone-event/%d", format, clock), "fmtp:"+format+" 0-15")
+		}
+	}
+	if formats.ptime != 0 {
+		m.Attributes = append(m.Attributes, "ptime:"+strconv.Itoa(formats.ptime))
+	}
+	if formats.crypto != nil {
+		m.Proto = "RTP/SAVP"
+		m.Attributes = append(m.Attributes, formats.crypto.attribute())
+	}
+	if formats.rtcpMux {
+		m.Attributes = append(m.Attributes, "rtcp-mux")
+	}
+	m.Attributes = append(m.Attributes, direction)
+	return m
+}
+
+// parseSDPForRTP finds where the audio stream of a message's SDP body
+// goes, defaultIP standing in for a missing connection address; nil if it
+// has no audio the server can take part in
+func parseSDPForRTP(message string, defaultIP net.IP) *net.UDPAddr {
+	sd := messageSDP(message)
+	if sd == nil {
+		return nil
+	}
+	m := sd.audio()
+	if m == nil {
+		return nil
+	}
+	return sd.rtpAddr(m, defaultIP)
+}
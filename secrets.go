@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SECRET_RHYTHM_TOLERANCE is how far each gap between the keys of a
+// rhythmic secret code may be off
+const SECRET_RHYTHM_TOLERANCE = 150 * time.Millisecond
+
+// secretCode is a compiled secret: a key sequence that unlocks a hidden
+// destination
+type secretCode struct {
+	code        string
+	destination string
+	rhythm      []time.Duration // Gaps between keys; empty if timing doesn't matter
+}
+
+// compileSecrets checks the configured secret codes
+func compileSecrets(cfg *Config) ([]secretCode, error) {
+	var secrets []secretCode
+	for i, secret := range cfg.Secrets {
+		if secret.Code == "" || strings.Trim(secret.Code, DIGIT_SYMBOLS) != "" {
+			return nil, fmt.Errorf("secrets[%d]: code %q may only contain 0-9, * and #", i, secret.Code)
+		}
+		if _, ok := cfg.Destinations[secret.Destination]; !ok {
+			return nil, fmt.Errorf("secrets[%d]: unknown destination %q", i, secret.Destination)
+		}
+		for _, other := range secrets {
+			if other.code == secret.Code {
+				return nil, fmt.Errorf("secrets[%d]: code %s is used twice", i, secret.Code)
+			}
+		}
+
+		compiled := secretCode{code: secret.Code, destination: secret.Destination}
+		if len(secret.RhythmMs) > 0 {
+			if len(secret.RhythmMs) != len(secret.Code)-1 {
+				return nil, fmt.Errorf("secrets[%d]: rhythm_ms needs one gap between each pair of keys, %d for %s", i, len(secret.Code)-1, secret.Code)
+			}
+			for _, gap := range secret.RhythmMs {
+				if gap <= 0 {
+					return nil, fmt.Errorf("secrets[%d]: rhythm_ms gaps must be positive", i)
+				}
+				compiled.rhythm = append(compiled.rhythm, time.Duration(gap)*time.Millisecond)
+			}
+		}
+		secrets = append(secrets, compiled)
+	}
+	return secrets, nil
+}
+
+// inRhythm reports whether keys pressed at times (the code's keys, in
+// order) kept to the secret's rhythm
+func (s secretCode) inRhythm(times []time.Time) bool {
+	if len(times) != len(s.code) {
+		return false
+	}
+	for i, want := range s.rhythm {
+		gap := times[i+1].Sub(times[i])
+		if gap < want-SECRET_RHYTHM_TOLERANCE || gap > want+SECRET_RHYTHM_TOLERANCE {
+			return false
+		}
+	}
+	return true
+}
+
+// unlockTable remembers which hidden destinations each caller has
+// unlocked, in the state store so it survives restarts
+type unlockTable struct {
+	mu       sync.Mutex
+	store    *stateStore
+	key      string
+	unlocked map[string][]string // Caller ID -> destinations
+}
+
+// newUnlockTable loads an exchange's unlocks from the store
+func newUnlockTable(store *stateStore, exchange string) (*unlockTable, error) {
+	table := &unlockTable{store: store, key: "unlocks/" + exchange}
+	if _, err := store.Load(table.key, &table.unlocked); err != nil {
+		return nil, err
+	}
+	if table.unlocked == nil {
+		table.unlocked = make(map[string][]string)
+	}
+	return table, nil
+}
+
+// Unlocked reports whether caller has unlocked destination. Anonymous
+// callers never have.
+func (u *unlockTable) Unlocked(caller, destination string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return caller != "" && slices.Contains(u.unlocked[caller], destination)
+}
+
+// Unlock records that caller has unlocked destination, reporting whether
+// it is the first time
+func (u *unlockTable) Unlock(caller, destination string) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if caller == "" || slices.Contains(u.unlocked[caller], destination) {
+		return false, nil
+	}
+	u.unlocked[caller] = append(u.unlocked[caller], destination)
+	return true, u.store.Save(u.key, u.unlocked)
+}
+
+// collectSecretCode takes secret codes ahead of the dial plan. It reports
+// whether the digits dialed so far are a secret code, or the start of one
+// the digit map would otherwise reject. Must be called with digitsMu held.
+func (s *SIPServer) collectSecretCode(session *CallSession) bool {
+	plan := session.exchange.dialPlan
+	digits := session.digits
+
+	partial := false
+	for _, secret := range plan.secrets {
+		if digits == secret.code {
+			if !secret.inRhythm(session.digitTimes) {
+				fmt.Printf("🤫 %s dialed out of rhythm\n", digits)
+				continue
+			}
+			session.routed = true
+			s.spawn(func() { s.openSecret(session, secret) })
+			return true
+		}
+		if strings.HasPrefix(secret.code, digits) {
+			partial = true
+		}
+	}
+
+	// Codes the digit map also accepts are left to it until they're complete
+	if !partial {
+		return false
+	}
+	if result, _ := plan.Collect(digits); result != matchNone {
+		return false
+	}
+	session.digitTimer = s.startStarCodeTimer(session)
+	return true
+}
+
+// openSecret unlocks a secret's destination for the caller and connects
+// them to it
+func (s *SIPServer) openSecret(session *CallSession, secret secretCode) {
+	caller := session.caller()
+	first, err := session.exchange.unlocks.Unlock(caller, secret.destination)
+	if err != nil {
+		log.Printf("⚠️  Failed to save unlock of %q: %v", secret.destination, err)
+	}
+	if first {
+		fmt.Printf("🗝️  %s unlocked %q\n", caller, secret.destination)
+	}
+
+	fmt.Printf("🤫 Secret code dialed; connecting to %q\n", secret.destination)
+	s.playDestination(session, resolution{number: secret.code, route: -1, destination: secret.destination})
+}
@@ -0,0 +1,4 @@
+package main
+
+// The syscall package doesn't define SYS_SENDMMSG for linux/amd64
+const sysSendmmsg = 307
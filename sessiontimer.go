@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DEFAULT_SESSION_EXPIRES is the session interval, in seconds, asked
+	// for on calls to phones and given to phones that place a call without
+	// asking for one (RFC 4028). A call not refreshed within it is hung up.
+	DEFAULT_SESSION_EXPIRES = 1800
+
+	// MIN_SESSION_EXPIRES is our Min-SE, the shortest session interval we
+	// accept, and the least RFC 4028 allows
+	MIN_SESSION_EXPIRES = 90
+
+	// SESSION_EXPIRES_GRACE caps how long before the session expires the
+	// refresher's refresh must have arrived by
+	SESSION_EXPIRES_GRACE = 32 * time.Second
+)
+
+// sessionExpires reads a Session-Expires header ("1800;refresher=uac") as
+// its interval in seconds and refresher, "uac" or "uas"; 0 without one
+func sessionExpires(headers map[string]string) (int, string) {
+	value := headers["Session-Expires"]
+	interval, _, _ := strings.Cut(value, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(interval))
+	if err != nil || n < 0 {
+		return 0, ""
+	}
+	return n, strings.ToLower(headerParam(value, "refresher"))
+}
+
+// minSE reads a Min-SE header, which defaults to MIN_SESSION_EXPIRES
+func minSE(headers map[string]string) int {
+	value, _, _ := strings.Cut(headers["Min-SE"], ";")
+	if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && n > MIN_SESSION_EXPIRES {
+		return n
+	}
+	return MIN_SESSION_EXPIRES
+}
+
+// hasOption reports whether a header listing tokens, such as Supported or
+// Allow, holds option
+func hasOption(message, header, option string) bool {
+	for _, value := range headerValues(message, header) {
+		if strings.EqualFold(value, option) {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsTimer reports whether a message says its sender supports
+// session timers
+func supportsTimer(message string) bool {
+	return hasOption(message, "Supported", "timer") || hasOption(message, "Require", "timer")
+}
+
+// acceptSessionTimer settles the session interval of the phone's request
+// starting or refreshing its call, an INVITE, re-INVITE or UPDATE, and
+// counts as a refresh. The phone refreshes if it asks to, or if it
+// supports session timers and leaves the choice to us; otherwise we do.
+// It reports false, changing nothing, if the phone asked for an interval
+// under MIN_SESSION_EXPIRES, to be refused with 422.
+func (d *dialog) acceptSessionTimer(message string) bool {
+	headers := parseHeaders(message)
+	expires, refresher := sessionExpires(headers)
+	if expires > 0 && expires < MIN_SESSION_EXPIRES {
+		return false
+	}
+	supported := supportsTimer(message)
+	if expires == 0 {
+		expires = max(DEFAULT_SESSION_EXPIRES, minSE(headers))
+	}
+	if refresher == "" {
+		refresher = "uas"
+		if supported {
+			refresher = "uac"
+		}
+	}
+
+	d.mu.Lock()
+	d.sessionExpires = expires
+	d.refreshing = refresher == "uas"
+	d.timerSupported = supported
+	if headerValues(message, "Allow") != nil {
+		d.allowsUpdate = hasOption(message, "Allow", "UPDATE")
+	}
+	d.mu.Unlock()
+	d.noteRefresh()
+	return true
+}
+
+// adoptSessionTimer records the session interval settled by the phone's
+// 2xx to an INVITE or refresh of ours that asked for asked seconds. If
+// the phone doesn't do session timers we keep the session going
+// ourselves (RFC 4028 section 7.2).
+func (d *dialog) adoptSessionTimer(response string, asked int) {
+	expires, refresher := sessionExpires(parseHeaders(response))
+	if expires == 0 {
+		expires, refresher = asked, "uac"
+	}
+
+	d.mu.Lock()
+	d.sessionExpires = expires
+	d.refreshing = refresher != "uas"
+	d.timerSupported = supportsTimer(response)
+	if headerValues(response, "Allow") != nil {
+		d.allowsUpdate = hasOption(response, "Allow", "UPDATE")
+	}
+	d.mu.Unlock()
+	d.noteRefresh()
+}
+
+// noteRefresh restarts the wait for the next refresh
+func (d *dialog) noteRefresh() {
+	select {
+	case d.refreshed <- struct{}{}:
+	default:
+	}
+}
+
+// sessionTimerHeaders are the header lines of our 2xx to the phone's
+// request starting or refreshing the call, giving the interval and which
+// side refreshes
+func (d *dialog) sessionTimerHeaders() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sessionExpires == 0 {
+		return nil
+	}
+	refresher := "uac"
+	if d.refreshing {
+		refresher = "uas"
+	}
+	headers := []string{supportedHeader(), fmt.Sprintf("Session-Expires: %d;refresher=%s", d.sessionExpires, refresher)}
+	if d.timerSupported {
+		headers = append(headers, "Require: timer")
+	}
+	return headers
+}
+
+// sessionTimerOffer are the header lines asking for a session interval in
+// a request of ours that starts or refreshes a call, with us as refresher
+func sessionTimerOffer(expires int) []string {
+	return []string{
+		supportedHeader(),
+		fmt.Sprintf("Session-Expires: %d;refresher=uac", expires),
+		fmt.Sprintf("Min-SE: %d", MIN_SESSION_EXPIRES),
+	}
+}
+
+// watchSessionTimer keeps a call's session timer until the call ends
+// (RFC 4028 section 10). When we are the refresher the session is
+// refreshed halfway through each interval; otherwise a phone whose
+// refresh doesn't come before the interval is nearly up has gone, and
+// the call is hung up rather than left to run forever.
+func (s *SIPServer) watchSessionTimer(session *CallSession) {
+	d := session.dialog
+	for {
+		d.mu.Lock()
+		expires, refreshing := time.Duration(d.sessionExpires)*time.Second, d.refreshing
+		d.mu.Unlock()
+		if expires == 0 {
+			return
+		}
+
+		wait := expires - min(SESSION_EXPIRES_GRACE, expires/3)
+		if refreshing {
+			wait = expires / 2
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-d.refreshed:
+			timer.Stop()
+			continue
+		case <-session.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if !refreshing {
+			log.Printf("⏰ No session refresh from %s for %s; hanging up call %s", d.remoteAddr, expires, session.CallID)
+			s.hangupCall(session)
+			return
+		}
+		if !s.refreshSession(session) {
+			log.Printf("⏰ %s didn't answer a session refresh; hanging up call %s", d.remoteAddr, session.CallID)
+			s.hangupCall(session)
+			return
+		}
+	}
+}
+
+// refreshSession refreshes a call's session from our side: with UPDATE if
+// the phone allows it, as it needs no SDP, otherwise with a re-INVITE
+// offering the media already in use. It reports false if the phone has
+// gone: the refresh timed out or the phone no longer knows the call.
+func (s *SIPServer) refreshSession(session *CallSession) bool {
+	d := session.dialog
+	d.mu.Lock()
+	expires, update := d.sessionExpires, d.allowsUpdate
+	d.mu.Unlock()
+
+	for {
+		var response string
+		if update {
+			response = s.transact(d, "UPDATE", "", "", sessionTimerOffer(expires)...)
+		} else {
+			direction := SDP_SENDRECV
+			if session.held.Load() {
+				direction = SDP_RECVONLY
+			}
+			sdp := s.localSDP(session.formats, direction, d)
+			response = s.transact(d, "INVITE", "application/sdp", sdp, sessionTimerOffer(expires)...)
+		}
+
+		switch code := parseStatusCode(response); {
+		case code >= 200 && code < 300:
+			fmt.Printf("⏱️  Refreshed session of call %s\n", session.CallID)
+			if answer := messageSDP(response); answer != nil && !update {
+				session.renegotiate(answer) // The phone may answer with a new key
+			}
+			d.adoptSessionTimer(response, expires)
+			return true
+		case code == 422 && minSE(parseHeaders(response)) > expires:
+			expires = minSE(parseHeaders(response))
+		case (code == 405 || code == 501) && update:
+			update = false
+		case code == 0 || code == 408 || code == 481:
+			return false
+		default:
+			return true // The phone is there, whatever it made of the refresh
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"cmp"
+	"net"
+	"slices"
+	"strings"
+)
+
+// DEFAULT_USER_AGENT names the server in the Server and User-Agent headers
+// of its messages unless the config names it otherwise
+const DEFAULT_USER_AGENT = "Travel-by-Telephone/1.0"
+
+// supportedOptions are the SIP extensions the server implements, for the
+// Supported header: RFC 4028 session timers
+var supportedOptions = []string{"timer"}
+
+// sipHandler handles the requests of one SIP method
+type sipHandler struct {
+	method string
+	handle func(message string, remoteAddr *net.UDPAddr)
+}
+
+// handlers are the SIP methods the server implements, in the order the
+// Allow header lists them
+func (s *SIPServer) handlers() []sipHandler {
+	return []sipHandler{
+		{"INVITE", s.handleInvite},
+		{"ACK", s.handleAck},
+		{"BYE", s.handleBye},
+		{"CANCEL", s.handleCancel},
+		{"OPTIONS", s.handleOptions},
+		{"REGISTER", s.handleRegister},
+		{"SUBSCRIBE", s.handleSubscribe},
+		{"MESSAGE", s.handleMessage},
+		{"REFER", s.handleRefer},
+		{"UPDATE", s.handleUpdate},
+	}
+}
+
+// allowHeader is the Allow header line listing the methods the server
+// implements
+func (s *SIPServer) allowHeader() string {
+	var methods []string
+	for _, h := range s.handlers() {
+		methods = append(methods, h.method)
+	}
+	return "Allow: " + strings.Join(methods, ", ")
+}
+
+// supportedHeader is the Supported header line listing the extensions the
+// server implements
+func supportedHeader() string {
+	return "Supported: " + strings.Join(supportedOptions, ", ")
+}
+
+// userAgent is the name the server gives itself in Server and User-Agent
+func (s *SIPServer) userAgent() string {
+	return cmp.Or(s.config.UserAgent, DEFAULT_USER_AGENT)
+}
+
+// withOwnHeaders adds the headers describing the server to a message of
+// ours that its builder left out: Server on responses and User-Agent on
+// requests, and Allow and Supported on INVITEs, OPTIONS and their 2xx
+// responses, as RFC 3261 recommends
+func (s *SIPServer) withOwnHeaders(message string) string {
+	head, body, found := strings.Cut(message, "\r\n\r\n")
+	if !found {
+		return message
+	}
+	startLine, _, _ := strings.Cut(head, "\r\n")
+
+	var method string
+	var lines []string
+	if isRequest(startLine) {
+		method = getMethod(startLine)
+		lines = append(lines, "User-Agent: "+s.userAgent())
+	} else {
+		if code := parseStatusCode(startLine); code >= 200 && code < 300 {
+			method = cseqMethod(parseHeaders(head)["CSeq"])
+		}
+		lines = append(lines, "Server: "+s.userAgent())
+	}
+	if method == "INVITE" || method == "OPTIONS" {
+		lines = append(lines, s.allowHeader(), supportedHeader())
+	}
+
+	var added []string
+	for _, line := range lines {
+		if name, _, _ := strings.Cut(line, ":"); !hasHeader(head, name) {
+			added = append(added, line)
+		}
+	}
+
+	// Content-Length stays last, where the builders put it
+	headers := strings.Split(head, "\r\n")
+	at := len(headers)
+	if key, _, _ := strings.Cut(headers[at-1], ":"); canonicalHeader(key) == "Content-Length" {
+		at--
+	}
+	headers = slices.Insert(headers, at, added...)
+	return strings.Join(headers, "\r\n") + "\r\n\r\n" + body
+}
+
+// cseqMethod is the method of a CSeq header
+func cseqMethod(header string) string {
+	_, method, _ := strings.Cut(strings.TrimSpace(header), " ")
+	return strings.TrimSpace(method)
+}
+
+// hasHeader reports whether a message's header lines include name, in
+// full or compact form
+func hasHeader(head, name string) bool {
+	for _, line := range strings.Split(head, "\r\n")[1:] {
+		if key, _, _ := strings.Cut(line, ":"); canonicalHeader(key) == canonicalHeader(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_TRUNK_EXPIRES is the registration interval, in seconds, asked
+	// of a SIP trunk's provider
+	DEFAULT_TRUNK_EXPIRES = 600
+
+	// TRUNK_RETRY_INTERVAL is how long after a failed registration with a
+	// provider it is tried again
+	TRUNK_RETRY_INTERVAL = time.Minute
+
+	// TRUNK_CALL_TIMEOUT is how long a call out through a trunk may take to
+	// be answered
+	TRUNK_CALL_TIMEOUT = time.Minute
+
+	// MAX_TRUNK_REGISTER_ATTEMPTS bounds the REGISTERs sent for one
+	// registration, answering challenges and Min-Expires along the way
+	MAX_TRUNK_REGISTER_ATTEMPTS = 4
+)
+
+// sipTrunk is a provider account the server keeps registered
+type sipTrunk struct {
+	config SIPTrunkConfig
+
+	mu         sync.Mutex
+	addr       *net.UDPAddr // The provider's registrar, as last resolved
+	registered bool
+}
+
+// RegisterTrunks registers with each trunk's provider and keeps the
+// registrations fresh until the server closes. Calls from the providers
+// are handled by the server's default exchange. Call it before Run.
+func (s *SIPServer) RegisterTrunks(trunks []SIPTrunkConfig) {
+	for _, cfg := range trunks {
+		s.trunks = append(s.trunks, &sipTrunk{config: cfg})
+	}
+	for _, t := range s.trunks {
+		s.spawn(func() { s.keepTrunkRegistered(t) })
+	}
+}
+
+// keepTrunkRegistered registers with a trunk's provider, then refreshes
+// the registration halfway through each interval the provider grants. A
+// registration that fails is tried again after TRUNK_RETRY_INTERVAL.
+func (s *SIPServer) keepTrunkRegistered(t *sipTrunk) {
+	d := newTrunkDialog(t.config, "sip:"+t.config.domain())
+	d.to = fmt.Sprintf("<sip:%s@%s>", t.config.Username, t.config.domain()) // The account being registered
+
+	for {
+		wait := TRUNK_RETRY_INTERVAL
+		granted, err := s.registerTrunk(t, d)
+		t.mu.Lock()
+		wasRegistered := t.registered
+		t.registered = err == nil
+		t.mu.Unlock()
+
+		switch {
+		case err != nil:
+			log.Printf("❌ Trunk %q: %v; trying again in %s", t.config.Name, err, wait)
+		case !wasRegistered:
+			fmt.Printf("☎️  Registered with trunk %q as %s for %ds\n", t.config.Name, t.config.Username, granted)
+		}
+		if err == nil {
+			wait = time.Duration(granted) * time.Second / 2
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// registerTrunk sends the provider a REGISTER, answering its digest
+// challenge and raising the interval if it asks for a longer one, and
+// returns the interval it granted in seconds
+func (s *SIPServer) registerTrunk(t *sipTrunk, d *dialog) (int, error) {
+	addr, err := net.ResolveUDPAddr("udp", t.config.address())
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve %s: %v", t.config.Server, err)
+	}
+	t.mu.Lock()
+	t.addr = addr
+	t.mu.Unlock()
+	d.remoteAddr = addr // Only this goroutine sends in the dialog
+
+	expires := cmp.Or(t.config.Expires, DEFAULT_TRUNK_EXPIRES)
+	var authorization string
+	for range MAX_TRUNK_REGISTER_ATTEMPTS {
+		extra := []string{fmt.Sprintf("Expires: %d", expires)}
+		if authorization != "" {
+			extra = append(extra, authorization)
+		}
+		response := s.transact(d, "REGISTER", "", "", extra...)
+
+		switch code := parseStatusCode(response); {
+		case code == 0:
+			return 0, errors.New("the provider didn't answer")
+		case code >= 200 && code < 300:
+			return grantedExpiry(response, s.contactURI(addr), expires), nil
+		case code == 401 || code == 407:
+			answered := authorization != ""
+			line, stale, err := trunkAuthorization(t.config, response, "REGISTER", d.requestURI)
+			if err != nil {
+				return 0, err
+			}
+			if answered && !stale {
+				return 0, errors.New("the provider refused the username or password")
+			}
+			authorization = line
+		case code == 423:
+			least, err := strconv.Atoi(strings.TrimSpace(parseHeaders(response)["Min-Expires"]))
+			if err != nil || least <= expires {
+				return 0, errors.New("the provider wants a longer interval but didn't say how long")
+			}
+			expires = least
+		default:
+			return 0, fmt.Errorf("registration refused with %d", code)
+		}
+	}
+	return 0, errors.New("the provider kept challenging the registration")
+}
+
+// newTrunkDialog starts a dialog with a trunk's provider from the account,
+// for a request to requestURI
+func newTrunkDialog(trunk SIPTrunkConfig, requestURI string) *dialog {
+	d := &dialog{
+		callID:     newTag(),
+		localTag:   newTag(),
+		requestURI: requestURI,
+		state:      dialogRinging,
+		refreshed:  make(chan struct{}, 1),
+	}
+	d.from = fmt.Sprintf("<sip:%s@%s>;tag=%s", trunk.Username, trunk.domain(), d.localTag)
+	d.to = "<" + requestURI + ">"
+	return d
+}
+
+// trunkAuthorization answers the digest challenge in a provider's 401 or
+// 407 to a request of ours with the trunk's credentials, as the header
+// line to send the request again with. stale reports whether the
+// challenge says only that an earlier answer's nonce had expired.
+func trunkAuthorization(trunk SIPTrunkConfig, response, method, uri string) (line string, stale bool, err error) {
+	headers := parseHeaders(response)
+	name, challenge := "Authorization", headers["WWW-Authenticate"]
+	if parseStatusCode(response) == 407 {
+		name, challenge = "Proxy-Authorization", headers["Proxy-Authenticate"]
+	}
+	params, _ := parseDigestParams(challenge)
+	answer, err := digestAnswer(params, method, uri, cmp.Or(trunk.AuthUsername, trunk.Username), trunk.Password)
+	if err != nil {
+		return "", false, err
+	}
+	return name + ": " + answer, strings.EqualFold(params["stale"], "true"), nil
+}
+
+// grantedExpiry reads the interval a 2xx to a REGISTER granted our
+// contact: its expires parameter, else the Expires header, else what was
+// asked for
+func grantedExpiry(response, contact string, asked int) int {
+	for _, value := range headerValues(response, "Contact") {
+		if uriFromHeader(value, &net.UDPAddr{}) != contact {
+			continue
+		}
+		if n, err := strconv.Atoi(headerParam(value, "expires")); err == nil && n > 0 {
+			return n
+		}
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(parseHeaders(response)["Expires"])); err == nil && n > 0 {
+		return n
+	}
+	return asked
+}
+
+// digestAnswer answers a digest challenge to a request of ours (RFC 2617
+// and RFC 8760), for the value of an Authorization header
+func digestAnswer(challenge map[string]string, method, uri, user, password string) (string, error) {
+	if challenge == nil || challenge["nonce"] == "" {
+		return "", errors.New("the provider's challenge isn't a digest challenge")
+	}
+	var h func() hash.Hash
+	switch strings.ToUpper(challenge["algorithm"]) {
+	case "", "MD5":
+		h = md5.New
+	case "SHA-256":
+		h = sha256.New
+	default:
+		return "", fmt.Errorf("the provider's digest algorithm %s isn't supported", challenge["algorithm"])
+	}
+	digest := func(parts ...string) string {
+		sum := h()
+		sum.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	ha1 := digest(user, challenge["realm"], password)
+	ha2 := digest(method, uri)
+	answer := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, user, challenge["realm"], challenge["nonce"], uri)
+	if algorithm := challenge["algorithm"]; algorithm != "" {
+		answer += ", algorithm=" + algorithm
+	}
+	if qop := strings.Split(challenge["qop"], ","); slices.ContainsFunc(qop, func(q string) bool { return strings.TrimSpace(q) == "auth" }) {
+		cnonce := newTag()
+		answer += fmt.Sprintf(`, response="%s", qop=auth, nc=00000001, cnonce="%s"`, digest(ha1, challenge["nonce"], "00000001", cnonce, "auth", ha2), cnonce)
+	} else {
+		answer += fmt.Sprintf(`, response="%s"`, digest(ha1, challenge["nonce"], ha2))
+	}
+	if opaque := challenge["opaque"]; opaque != "" {
+		answer += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return answer, nil
+}
+
+// trunkFrom is the trunk whose provider a request came from, or nil
+func (s *SIPServer) trunkFrom(remoteAddr *net.UDPAddr) *sipTrunk {
+	for _, t := range s.trunks {
+		t.mu.Lock()
+		addr := t.addr
+		t.mu.Unlock()
+		if addr != nil && addr.IP.Equal(remoteAddr.IP) {
+			return t
+		}
+	}
+	return nil
+}
+
+// putThroughTrunkCall connects an answered call from a trunk's provider to
+// the trunk's destination, or with none to any registered phone, once
+// the exchange's screening lets the caller through. The call is hung up
+// when the destination finishes.
+func (s *SIPServer) putThroughTrunkCall(session *CallSession, t *sipTrunk) {
+	fmt.Printf("☎️  Call from %s on trunk %q\n", cmp.Or(session.caller(), "anonymous caller"), t.config.Name)
+	if !s.screenIncomingCall(session, "trunk "+t.config.Name, t.config.Username) {
+		return
+	}
+	if t.config.Destination == "" {
+		s.connectPhone(session, DestinationConfig{Type: "phone"})
+	} else {
+		s.playDestination(session, resolution{number: t.config.Username, route: -1, destination: t.config.Destination})
+	}
+	s.hangupCall(session)
+}
+
+// callTrunk calls number through a sip_trunk destination's provider, with
+// ringback to the caller, and bridges the two once it answers. The
+// provider's digest challenge is answered with the trunk's credentials.
+// A number that is busy, turned the call down or didn't answer gives busy
+// tone; a call that couldn't be placed at all gives reorder. Only
+// registered phones may call out, so nobody else can run up the
+// provider's bill; anyone else gets reorder.
+func (s *SIPServer) callTrunk(session *CallSession, dest DestinationConfig, number string) {
+	trunk, _ := session.exchange.config.SIPTrunk(dest.Trunk)
+	reorder := session.progressTone(progressReorder)
+	if !s.registeredAt(session.exchange, session.RemoteAddr) {
+		log.Printf("🚫 Not calling %s through trunk %q for %s: not a registered phone", number, trunk.Name, session.RemoteAddr)
+		s.playTone(session.ctx, session, reorder)
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", trunk.address())
+	if err != nil {
+		log.Printf("❌ Trunk %q: failed to resolve %s: %v", trunk.Name, trunk.Server, err)
+		s.playTone(session.ctx, session, reorder)
+		return
+	}
+	d := newTrunkDialog(trunk, fmt.Sprintf("sip:%s@%s", number, trunk.domain()))
+	d.remoteAddr = addr
+
+	ringing, stopRinging := context.WithCancel(session.ctx)
+	defer stopRinging()
+	s.spawn(func() {
+		s.playTone(ringing, session, session.progressTone(progressRingback))
+	})
+
+	fmt.Printf("☎️  Calling %s through trunk %q\n", number, trunk.Name)
+	called, err := s.invite(session.ctx, session.exchange, d, TRUNK_CALL_TIMEOUT, func(response string) (string, error) {
+		line, _, err := trunkAuthorization(trunk, response, "INVITE", d.requestURI)
+		return line, err
+	})
+	stopRinging()
+	switch {
+	case err == nil:
+		s.bridge(session, called)
+	case session.ctx.Err() != nil:
+	case errors.Is(err, errDeclined) || errors.Is(err, errNoAnswer):
+		fmt.Printf("📵 %s through trunk %q: %v\n", number, trunk.Name, err)
+		s.playTone(session.ctx, session, session.progressTone(progressBusy))
+	default:
+		log.Printf("❌ Call to %s through trunk %q failed: %v", number, trunk.Name, err)
+		s.playTone(session.ctx, session, reorder)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+// UA_RESPONSE_TIMEOUT bounds how long the test UA waits for a response
+const UA_RESPONSE_TIMEOUT = 2 * time.Second
+
+// testUA is a minimal SIP user agent that behaves like a PAP2 line: it
+// registers, places one call at a time, sends RFC 2833 digits and reads
+// the audio it is sent. It is used to drive the server end to end.
+type testUA struct {
+	sipConn *net.UDPConn
+	rtpConn *net.UDPConn
+	server  *net.UDPAddr
+
+	user      string
+	password  string // Answers digest challenges, if set
+	callID    string
+	tag       string
+	remoteTag string // The server's tag once it answers, for requests within the call
+	cseq      int
+
+	// Media state for the current call
+	serverRTP      *net.UDPAddr
+	sequenceNumber uint16
+	timestamp      uint32
+}
+
+// newTestUA opens SIP and RTP sockets on loopback for talking to server
+func newTestUA(server *net.UDPAddr) (*testUA, error) {
+	sipConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UA SIP socket: %v", err)
+	}
+	rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		sipConn.Close()
+		return nil, fmt.Errorf("failed to open UA RTP socket: %v", err)
+	}
+
+	return &testUA{
+		sipConn: sipConn,
+		rtpConn: rtpConn,
+		server:  server,
+		user:    "selftest",
+		tag:     newTag(),
+	}, nil
+}
+
+// Close releases the UA's sockets
+func (ua *testUA) Close() {
+	ua.sipConn.Close()
+	ua.rtpConn.Close()
+}
+
+// localSIP and localRTP are the UA's own addresses
+func (ua *testUA) localSIP() *net.UDPAddr {
+	return ua.sipConn.LocalAddr().(*net.UDPAddr)
+}
+
+func (ua *testUA) localRTP() *net.UDPAddr {
+	return ua.rtpConn.LocalAddr().(*net.UDPAddr)
+}
+
+// send builds and transmits a request within the current Call-ID
+func (ua *testUA) send(method, contentType, body string) error {
+	return ua.sendAuthorized(method, contentType, body, "")
+}
+
+// sendAuthorized sends a request with credentials
+func (ua *testUA) sendAuthorized(method, contentType, body, authorization string) error {
+	if method != "ACK" {
+		ua.cseq++
+	}
+
+	local := ua.localSIP()
+	var request strings.Builder
+	fmt.Fprintf(&request, "%s sip:%s SIP/2.0\r\n", method, ua.server)
+	fmt.Fprintf(&request, "Via: SIP/2.0/UDP %s;branch=%s\r\n", local, newBranch())
+	fmt.Fprintf(&request, "From: <sip:%s@%s>;tag=%s\r\n", ua.user, local.IP, ua.tag)
+	fmt.Fprintf(&request, "To: <sip:%s@%s>", ua.user, ua.server.IP)
+	if ua.remoteTag != "" {
+		fmt.Fprintf(&request, ";tag=%s", ua.remoteTag)
+	}
+	fmt.Fprintf(&request, "\r\n")
+	fmt.Fprintf(&request, "Call-ID: %s\r\n", ua.callID)
+	fmt.Fprintf(&request, "CSeq: %d %s\r\n", ua.cseq, method)
+	fmt.Fprintf(&request, "Contact: <sip:%s@%s>\r\n", ua.user, local)
+	fmt.Fprintf(&request, "Max-Forwards: 70\r\n")
+	if authorization != "" {
+		fmt.Fprintf(&request, "Authorization: %s\r\n", authorization)
+	}
+	if contentType != "" {
+		fmt.Fprintf(&request, "Content-Type: %s\r\n", contentType)
+	}
+	fmt.Fprintf(&request, "Content-Length: %d\r\n\r\n%s", len(body), body)
+
+	_, err := ua.sipConn.WriteToUDP([]byte(request.String()), ua.server)
+	return err
+}
+
+// transact sends a request and waits for its final response, returning
+// the status code and the full message
+func (ua *testUA) transact(method, contentType, body string) (int, string, error) {
+	return ua.transactAuthorized(method, contentType, body, "")
+}
+
+// transactAuthorized is transact with credentials
+func (ua *testUA) transactAuthorized(method, contentType, body, authorization string) (int, string, error) {
+	if err := ua.sendAuthorized(method, contentType, body, authorization); err != nil {
+		return 0, "", fmt.Errorf("failed to send %s: %v", method, err)
+	}
+
+	buffer := make([]byte, SIP_UDP_MAX_MESSAGE)
+	deadline := time.Now().Add(UA_RESPONSE_TIMEOUT)
+	for {
+		ua.sipConn.SetReadDeadline(deadline)
+		n, _, err := ua.sipConn.ReadFromUDP(buffer)
+		if err != nil {
+			return 0, "", fmt.Errorf("no response to %s: %v", method, err)
+		}
+
+		message := string(buffer[:n])
+		code := parseStatusCode(message)
+		headers := parseHeaders(message)
+		if code == 0 || headers["Call-ID"] != ua.callID || !strings.HasSuffix(headers["CSeq"], method) {
+			continue // A request or a stray response
+		}
+		if code >= 200 {
+			return code, message, nil
+		}
+	}
+}
+
+// parseStatusCode returns the status code of a SIP response, or 0 if the
+// message is a request
+func parseStatusCode(message string) int {
+	lines := splitLines(message)
+	if len(lines) == 0 {
+		return 0
+	}
+
+	var code int
+	if _, err := fmt.Sscanf(lines[0], "SIP/2.0 %d", &code); err != nil {
+		return 0
+	}
+	return code
+}
+
+// Register registers the UA, answering a digest challenge with its
+// password, and expects 200 OK
+func (ua *testUA) Register() error {
+	ua.callID = fmt.Sprintf("%08x@selftest", rand.Uint32())
+	ua.remoteTag = ""
+	code, message, err := ua.transact("REGISTER", "", "")
+	if err != nil {
+		return err
+	}
+	if code == 401 && ua.password != "" {
+		challenge := parseHeaders(message)["WWW-Authenticate"]
+		code, _, err = ua.transactAuthorized("REGISTER", "", "", ua.digestResponse("REGISTER", challenge))
+		if err != nil {
+			return err
+		}
+	}
+	if code != 200 {
+		return fmt.Errorf("REGISTER answered with %d", code)
+	}
+	return nil
+}
+
+// digestResponse answers an MD5 digest challenge for a request, as a
+// phone would
+func (ua *testUA) digestResponse(method, challenge string) string {
+	params, _ := parseDigestParams(challenge) // Parsed like credentials, lacking their answer
+	uri := fmt.Sprintf("sip:%s", ua.server)
+	cnonce := fmt.Sprintf("%08x", rand.Uint32())
+	hexMD5 := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := hexMD5(ua.user + ":" + params["realm"] + ":" + ua.password)
+	ha2 := hexMD5(method + ":" + uri)
+	response := hexMD5(ha1 + ":" + params["nonce"] + ":00000001:" + cnonce + ":auth:" + ha2)
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=MD5, response="%s", qop=auth, nc=00000001, cnonce="%s"`,
+		ua.user, params["realm"], params["nonce"], uri, response, cnonce)
+}
+
+// Invite takes the phone off hook: it places a call offering PCMU and
+// telephone events, acknowledges the answer and remembers where to send
+// media
+func (ua *testUA) Invite() error {
+	ua.callID = fmt.Sprintf("%08x@selftest", rand.Uint32())
+	ua.cseq = 0
+	ua.remoteTag = ""
+
+	rtp := ua.localRTP()
+	sdp := fmt.Sprintf("v=0\r\n"+
+		"o=- 1 1 IN IP4 %s\r\n"+
+		"s=selftest\r\n"+
+		"c=IN IP4 %s\r\n"+
+		"t=0 0\r\n"+
+		"m=audio %d RTP/AVP 0 101\r\n"+
+		"a=rtpmap:0 PCMU/8000\r\n"+
+		"a=rtpmap:101 telephone-event/8000\r\n"+
+		"a=fmtp:101 0-15\r\n", rtp.IP, rtp.IP, rtp.Port)
+
+	code, response, err := ua.transact("INVITE", "application/sdp", sdp)
+	if err != nil {
+		return err
+	}
+	if code != 200 {
+		return fmt.Errorf("INVITE answered with %d", code)
+	}
+
+	ua.remoteTag = headerTag(parseHeaders(response)["To"])
+	ua.serverRTP = parseSDPForRTP(response, ua.server.IP)
+	if ua.serverRTP == nil {
+		return errors.New("answer carried no usable SDP")
+	}
+	return ua.send("ACK", "", "")
+}
+
+// Bye hangs up the current call and expects 200 OK
+func (ua *testUA) Bye() error {
+	code, _, err := ua.transact("BYE", "", "")
+	if err != nil {
+		return err
+	}
+	if code != 200 {
+		return fmt.Errorf("BYE answered with %d", code)
+	}
+	return nil
+}
+
+// SendDigit sends one key press as RFC 2833 telephone events: a few
+// updates with a growing duration followed by the end packet, all sharing
+// one timestamp as a phone does
+func (ua *testUA) SendDigit(digit byte) error {
+	event := strings.IndexByte("0123456789*#", digit)
+	if event < 0 {
+		return fmt.Errorf("cannot send key %q", digit)
+	}
+
+	packet := make([]byte, RTP_HEADER_SIZE+4)
+	packet[0] = 0x80
+	packet[1] = 101 | 0x80 // Marker on the first packet of the event
+	binary.BigEndian.PutUint32(packet[4:8], ua.timestamp)
+	binary.BigEndian.PutUint32(packet[8:12], 0x5e1f7e57)
+	packet[12] = byte(event)
+	packet[13] = 10 // Volume -10 dBm0
+
+	for i := 1; i <= 4; i++ {
+		binary.BigEndian.PutUint16(packet[2:4], ua.sequenceNumber)
+		binary.BigEndian.PutUint16(packet[14:16], uint16(i*FRAME_SIZE))
+		if i == 4 {
+			packet[13] |= 0x80 // End of event
+		}
+		if _, err := ua.rtpConn.WriteToUDP(packet, ua.serverRTP); err != nil {
+			return fmt.Errorf("failed to send DTMF: %v", err)
+		}
+		packet[1] &^= 0x80
+		ua.sequenceNumber++
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	ua.timestamp += 4 * FRAME_SIZE
+	return nil
+}
+
+// ReadAudio passes the payload of each PCMU packet received to handle
+// until it returns true, or fails once timeout passes
+func (ua *testUA) ReadAudio(timeout time.Duration, handle func(payload []byte) bool) error {
+	buffer := make([]byte, 1500)
+	ua.rtpConn.SetReadDeadline(time.Now().Add(timeout))
+
+	for {
+		n, _, err := ua.rtpConn.ReadFromUDP(buffer)
+		if err != nil {
+			return err
+		}
+		if n < RTP_HEADER_SIZE || buffer[1]&0x7F != 0 {
+			continue
+		}
+		if handle(buffer[RTP_HEADER_SIZE:n]) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// listenUDP opens a UDP socket on addr and applies the configured socket
+// tuning options. Buffer sizes are requests; the OS may clamp them (see
+// net.core.rmem_max/wmem_max on Linux).
+func listenUDP(addr string, opts SocketConfig) (*net.UDPConn, error) {
+	lc := net.ListenConfig{}
+	if opts.ReusePort {
+		lc.Control = reusePortControl
+	}
+
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+
+	if opts.RecvBuffer > 0 {
+		if err := conn.SetReadBuffer(opts.RecvBuffer); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to set receive buffer size: %v", err)
+		}
+	}
+	if opts.SendBuffer > 0 {
+		if err := conn.SetWriteBuffer(opts.SendBuffer); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to set send buffer size: %v", err)
+		}
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// setDSCP is not supported on this platform; packets keep default marking
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	if dscp == 0 {
+		return nil
+	}
+	return fmt.Errorf("DSCP marking is not supported on this platform")
+}
+
+// reusePortControl is not supported on this platform
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+}
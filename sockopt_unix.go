@@ -0,0 +1,60 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// setDSCP marks all packets sent on conn with the given DSCP value. The
+// code point occupies the upper six bits of the IPv4 TOS / IPv6 traffic
+// class byte. Listeners bound to all interfaces are usually dual-stack IPv6
+// sockets, so both options are attempted and either succeeding is enough.
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	if dscp == 0 {
+		return nil
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to access socket: %v", err)
+	}
+
+	tos := dscp << 2
+	var err4, err6 error
+	ctrlErr := raw.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	})
+	if ctrlErr != nil {
+		return fmt.Errorf("failed to access socket: %v", ctrlErr)
+	}
+	if err4 != nil && err6 != nil {
+		return fmt.Errorf("failed to set DSCP %d: %v", dscp, err4)
+	}
+
+	return nil
+}
+
+// reusePortControl enables SO_REUSEPORT on a socket before it is bound, so
+// a restarted server (or a second instance) can bind while the old socket
+// is still lingering.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	if soReusePort < 0 {
+		return fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+	}
+
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("failed to set SO_REUSEPORT: %v", sockErr)
+	}
+	return nil
+}
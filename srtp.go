@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// SRTP (RFC 3711) keeps a call's audio from being read or altered by
+// anyone else on the network. Keys are exchanged in the SDP with SDES
+// (RFC 4568), so they are only as private as the signalling: over TLS
+// they stay secret, over plain UDP they merely stop casual sniffing of
+// the media. Browsers agree keys with DTLS instead (see dtls.go).
+
+const (
+	SRTP_MASTER_KEY_SIZE  = 16
+	SRTP_MASTER_SALT_SIZE = 14
+	SRTP_AUTH_KEY_SIZE    = 20 // HMAC-SHA1's
+	SRTP_MAX_TAG_SIZE     = 10 // The longest authentication tag of our suites
+
+	// SRTCP_TAG_SIZE is the authentication tag of SRTCP in both our suites
+	// (RFC 4568 section 6.2), and SRTCP_INDEX_SIZE that of the E flag and
+	// index before it
+	SRTCP_TAG_SIZE   = 10
+	SRTCP_INDEX_SIZE = 4
+
+	// SRTP_REPLAY_WINDOW is how many packets behind the newest one may
+	// still arrive late without being taken for replays
+	SRTP_REPLAY_WINDOW = 64
+)
+
+// Labels of the keys derived from a master key (RFC 3711 section 4.3.1),
+// for RTP and for RTCP
+const (
+	srtpLabelEncryption  = 0
+	srtpLabelAuth        = 1
+	srtpLabelSalt        = 2
+	srtcpLabelEncryption = 3
+	srtcpLabelAuth       = 4
+	srtcpLabelSalt       = 5
+)
+
+// errSRTPAuth means a received packet's authentication tag is wrong: it
+// was altered, or sent with another key
+var errSRTPAuth = errors.New("SRTP authentication failed")
+
+// errSRTPReplay means a received packet has been seen before, or is too
+// old to tell
+var errSRTPReplay = errors.New("SRTP packet replayed")
+
+// srtpSuite is a crypto suite (RFC 4568 section 6.2): AES in counter mode
+// with a 128-bit key, and HMAC-SHA1 authentication with a tag of tagSize
+// bytes
+type srtpSuite struct {
+	name    string
+	tagSize int
+}
+
+// srtpSuites are the suites we accept, most preferred first
+var srtpSuites = []*srtpSuite{
+	{name: "AES_CM_128_HMAC_SHA1_80", tagSize: 10},
+	{name: "AES_CM_128_HMAC_SHA1_32", tagSize: 4},
+}
+
+// srtpKeys are the suite of a call's SRTP and the master key and salt
+// each side sends with
+type srtpKeys struct {
+	suite  *srtpSuite
+	remote []byte
+	local  []byte
+}
+
+// sdesCrypto is the SDES keying of a call's audio: the keys, and the tag
+// of the crypto attribute taken up
+type sdesCrypto struct {
+	tag string
+	srtpKeys
+}
+
+// newSDESCrypto takes up an offered crypto attribute with a fresh master
+// key and salt of our own
+func newSDESCrypto(offered *sdesCrypto) *sdesCrypto {
+	c := *offered
+	c.local = make([]byte, SRTP_MASTER_KEY_SIZE+SRTP_MASTER_SALT_SIZE)
+	rand.Read(c.local)
+	return &c
+}
+
+// attribute is our crypto attribute for SDP
+func (c *sdesCrypto) attribute() string {
+	return fmt.Sprintf("crypto:%s %s inline:%s", c.tag, c.suite.name, base64.StdEncoding.EncodeToString(c.local))
+}
+
+// negotiateCrypto reads the first crypto attribute of a stream in a suite
+// we support; nil if there is none, when the audio is plain RTP or keyed
+// by DTLS. It reports false for a stream whose profile demands SRTP
+// (RTP/SAVP) if there is none. Attributes with several keys, an MKI or
+// session parameters are passed over.
+func negotiateCrypto(m *mediaDescription) (*sdesCrypto, bool) {
+	if strings.HasPrefix(m.Proto, "UDP/TLS/") {
+		return nil, true // See negotiateWebRTC
+	}
+	for _, attribute := range m.Attributes {
+		rest, ok := strings.CutPrefix(attribute, "crypto:")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) != 3 {
+			continue
+		}
+		var suite *srtpSuite
+		for _, s := range srtpSuites {
+			if s.name == fields[1] {
+				suite = s
+			}
+		}
+		inline, ok := strings.CutPrefix(fields[2], "inline:")
+		if suite == nil || !ok || strings.Contains(inline, ";") {
+			continue
+		}
+
+		// A lifetime may follow the key, and an MKI after that
+		parts := strings.Split(inline, "|")
+		if len(parts) > 2 || (len(parts) == 2 && strings.Contains(parts[1], ":")) {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil {
+			key, err = base64.RawStdEncoding.DecodeString(parts[0])
+		}
+		if err != nil || len(key) != SRTP_MASTER_KEY_SIZE+SRTP_MASTER_SALT_SIZE {
+			continue
+		}
+		return &sdesCrypto{tag: fields[0], srtpKeys: srtpKeys{suite: suite, remote: key}}, true
+	}
+	return nil, !strings.Contains(m.Proto, "SAVP")
+}
+
+// srtpContext protects or unprotects one direction of a call's RTP with
+// the session keys derived from a master key. Sending, it is used by one
+// stream; receiving, only by the RTP reader. It is not safe for
+// concurrent use.
+type srtpContext struct {
+	suite   *srtpSuite
+	master  []byte // The master key and salt it was made from
+	block   cipher.Block
+	salt    [SRTP_MASTER_SALT_SIZE]byte
+	mac     hash.Hash
+	tagSize int
+
+	// The rollover counter, the highest sequence number seen with it, and
+	// for receiving, the newest packet index and those within the replay
+	// window before it that have arrived
+	roc      uint32
+	seq      uint16
+	started  bool
+	newest   uint64
+	received uint64
+
+	// Scratch space, so that protecting a packet allocates nothing
+	iv        [aes.BlockSize]byte
+	keystream [aes.BlockSize]byte
+	rocBytes  [4]byte
+	tag       []byte
+}
+
+// newSRTPContext derives the session keys from a master key and salt
+// (RFC 3711 section 4.3, with no key derivation rate)
+func newSRTPContext(suite *srtpSuite, master []byte) (*srtpContext, error) {
+	return deriveSRTPContext(suite, master, suite.tagSize, srtpLabelEncryption, srtpLabelAuth, srtpLabelSalt)
+}
+
+// deriveSRTPContext derives the session keys with the labels given, for
+// tags of tagSize bytes
+func deriveSRTPContext(suite *srtpSuite, master []byte, tagSize int, encryption, auth, salt byte) (*srtpContext, error) {
+	key, masterSalt := master[:SRTP_MASTER_KEY_SIZE], master[SRTP_MASTER_KEY_SIZE:]
+	prf, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SRTP cipher: %v", err)
+	}
+	derive := func(label byte, out []byte) {
+		var x [aes.BlockSize]byte
+		copy(x[:], masterSalt)
+		x[7] ^= label
+		cipher.NewCTR(prf, x[:]).XORKeyStream(out, out)
+	}
+
+	c := &srtpContext{suite: suite, master: master, tagSize: tagSize, tag: make([]byte, 0, sha1.Size)}
+	sessionKey := make([]byte, SRTP_MASTER_KEY_SIZE)
+	authKey := make([]byte, SRTP_AUTH_KEY_SIZE)
+	derive(encryption, sessionKey)
+	derive(auth, authKey)
+	derive(salt, c.salt[:])
+	if c.block, err = aes.NewCipher(sessionKey); err != nil {
+		return nil, fmt.Errorf("failed to create SRTP cipher: %v", err)
+	}
+	c.mac = hmac.New(sha1.New, authKey)
+	return c, nil
+}
+
+// protect encrypts a packet's payload in place and appends its
+// authentication tag, returning the longer packet; the packet's capacity
+// must leave room for the tag
+func (c *srtpContext) protect(packet []byte) []byte {
+	seq := binary.BigEndian.Uint16(packet[2:4])
+	if c.started && seq < c.seq && c.seq-seq > 0x8000 {
+		c.roc++ // The sequence number wrapped
+	}
+	if !c.started || seq > c.seq || c.seq-seq > 0x8000 {
+		c.seq = seq
+	}
+	c.started = true
+
+	index := uint64(c.roc)<<16 | uint64(seq)
+	c.crypt(packet[rtpHeaderLength(packet):], packet[8:12], index)
+	return append(packet, c.authenticate(packet, c.roc)...)
+}
+
+// unprotect authenticates and decrypts a received packet in place,
+// returning it without its tag
+func (c *srtpContext) unprotect(packet []byte) ([]byte, error) {
+	header := rtpHeaderLength(packet)
+	if header < 0 || len(packet) < header+c.tagSize {
+		return nil, errSRTPAuth
+	}
+	seq := binary.BigEndian.Uint16(packet[2:4])
+	roc := c.estimateROC(seq)
+	index := uint64(roc)<<16 | uint64(seq)
+	if c.replayed(index) {
+		return nil, errSRTPReplay
+	}
+
+	body, tag := packet[:len(packet)-c.tagSize], packet[len(packet)-c.tagSize:]
+	if !hmac.Equal(tag, c.authenticate(body, roc)) {
+		return nil, errSRTPAuth
+	}
+	c.crypt(body[header:], body[8:12], index)
+
+	// Only now the packet is known to be genuine does it move the window
+	c.accept(index)
+	if !c.started || roc > c.roc || (roc == c.roc && seq > c.seq) {
+		c.roc, c.seq = roc, seq
+	}
+	c.started = true
+	return body, nil
+}
+
+// replayed reports whether a received packet index has been seen before,
+// or is too old to tell
+func (c *srtpContext) replayed(index uint64) bool {
+	if !c.started || index > c.newest {
+		return false
+	}
+	return c.newest-index >= SRTP_REPLAY_WINDOW || c.received&(1<<(c.newest-index)) != 0
+}
+
+// accept moves the replay window on for the index of a genuine packet
+func (c *srtpContext) accept(index uint64) {
+	switch {
+	case !c.started:
+		c.newest, c.received = index, 1
+	case index > c.newest:
+		shift := index - c.newest
+		c.received = c.received<<min(shift, SRTP_REPLAY_WINDOW) | 1
+		c.newest = index
+	default:
+		c.received |= 1 << (c.newest - index)
+	}
+}
+
+// estimateROC guesses the rollover counter a received sequence number was
+// sent with, from the highest seen so far (RFC 3711 section 3.3.1)
+func (c *srtpContext) estimateROC(seq uint16) uint32 {
+	switch {
+	case !c.started:
+		return c.roc
+	case c.seq < 0x8000 && seq > c.seq && seq-c.seq > 0x8000 && c.roc > 0:
+		return c.roc - 1
+	case c.seq >= 0x8000 && seq < c.seq && c.seq-seq > 0x8000:
+		return c.roc + 1
+	}
+	return c.roc
+}
+
+// crypt encrypts or decrypts a packet's payload in place with AES in
+// counter mode, keyed by the packet's SSRC and index (RFC 3711 section
+// 4.1.1)
+func (c *srtpContext) crypt(payload []byte, ssrc []byte, index uint64) {
+	copy(c.iv[:], c.salt[:])
+	c.iv[14], c.iv[15] = 0, 0
+	for i := range 4 {
+		c.iv[4+i] ^= ssrc[i]
+	}
+	for i := range 6 {
+		c.iv[8+i] ^= byte(index >> (8 * (5 - i)))
+	}
+
+	for len(payload) > 0 {
+		c.block.Encrypt(c.keystream[:], c.iv[:])
+		payload = payload[subtle.XORBytes(payload, payload, c.keystream[:]):]
+		binary.BigEndian.PutUint16(c.iv[14:], binary.BigEndian.Uint16(c.iv[14:])+1)
+	}
+}
+
+// authenticate is the tag of a packet sent with rollover counter roc;
+// valid until the next call
+func (c *srtpContext) authenticate(packet []byte, roc uint32) []byte {
+	c.mac.Reset()
+	c.mac.Write(packet)
+	binary.BigEndian.PutUint32(c.rocBytes[:], roc)
+	c.mac.Write(c.rocBytes[:])
+	c.tag = c.mac.Sum(c.tag[:0])
+	return c.tag[:c.tagSize]
+}
+
+// srtcpContext protects or unprotects one direction of a call's RTCP
+// (RFC 3711 section 3.4). Each packet carries its own index, so unlike
+// RTP no rollover counter is kept; the replay window is the same.
+type srtcpContext struct {
+	*srtpContext
+	index uint32 // Of the next packet sent
+}
+
+// newSRTCPContext derives the RTCP session keys from a master key and salt
+func newSRTCPContext(suite *srtpSuite, master []byte) (*srtcpContext, error) {
+	c, err := deriveSRTPContext(suite, master, SRTCP_TAG_SIZE, srtcpLabelEncryption, srtcpLabelAuth, srtcpLabelSalt)
+	if err != nil {
+		return nil, err
+	}
+	return &srtcpContext{srtpContext: c}, nil
+}
+
+// protect encrypts a compound RTCP packet after its first header and SSRC,
+// appending the E flag, the packet's index and its authentication tag
+func (c *srtcpContext) protect(packet []byte) []byte {
+	index := c.index
+	c.index = (c.index + 1) & 0x7FFFFFFF
+	c.crypt(packet[8:], packet[4:8], uint64(index))
+	packet = binary.BigEndian.AppendUint32(packet, 1<<31|index)
+	return append(packet, c.authenticateRTCP(packet)...)
+}
+
+// unprotect authenticates and decrypts a received compound RTCP packet in
+// place, returning it without its index and tag
+func (c *srtcpContext) unprotect(packet []byte) ([]byte, error) {
+	if len(packet) < 8+SRTCP_INDEX_SIZE+c.tagSize {
+		return nil, errSRTPAuth
+	}
+	body, tag := packet[:len(packet)-c.tagSize], packet[len(packet)-c.tagSize:]
+	if !hmac.Equal(tag, c.authenticateRTCP(body)) {
+		return nil, errSRTPAuth
+	}
+	trailer := binary.BigEndian.Uint32(body[len(body)-SRTCP_INDEX_SIZE:])
+	body = body[:len(body)-SRTCP_INDEX_SIZE]
+	index := uint64(trailer & 0x7FFFFFFF)
+	if c.replayed(index) {
+		return nil, errSRTPReplay
+	}
+	if trailer>>31 != 0 { // Encrypted
+		c.crypt(body[8:], body[4:8], index)
+	}
+	c.accept(index)
+	c.started = true
+	return body, nil
+}
+
+// authenticateRTCP is the tag of an SRTCP packet, which carries its index
+// itself; valid until the next call
+func (c *srtpContext) authenticateRTCP(packet []byte) []byte {
+	c.mac.Reset()
+	c.mac.Write(packet)
+	c.tag = c.mac.Sum(c.tag[:0])
+	return c.tag[:c.tagSize]
+}
+
+// rtpHeaderLength is the length of an RTP packet's header, with its CSRCs
+// and any extension, or -1 if the packet is too short to hold it
+func rtpHeaderLength(packet []byte) int {
+	if len(packet) < RTP_HEADER_SIZE {
+		return -1
+	}
+	n := RTP_HEADER_SIZE + 4*int(packet[0]&0x0F)
+	if packet[0]&0x10 != 0 {
+		if len(packet) < n+4 {
+			return -1
+		}
+		n += 4 + 4*int(binary.BigEndian.Uint16(packet[n+2:n+4]))
+	}
+	if len(packet) < n {
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// unhex decodes hex, which may be split by spaces
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// testRTPPacket is an RTP packet with sequence number seq and a payload
+// of n bytes, with room for a tag
+func testRTPPacket(seq uint16, n int) []byte {
+	packet := make([]byte, RTP_HEADER_SIZE+n, RTP_HEADER_SIZE+n+SRTP_MAX_TAG_SIZE)
+	packet[0], packet[1] = 0x80, 0
+	binary.BigEndian.PutUint16(packet[2:4], seq)
+	binary.BigEndian.PutUint32(packet[4:8], uint32(seq)*FRAME_SIZE)
+	binary.BigEndian.PutUint32(packet[8:12], 0xCAFEF00D)
+	for i := range n {
+		packet[RTP_HEADER_SIZE+i] = byte(i)
+	}
+	return packet
+}
+
+// testSRTPPair is a sending and a receiving context with the same keys
+func testSRTPPair(t *testing.T) (send, receive *srtpContext) {
+	master := unhex("E1F97A0D3E018BE0D64FA32C06DE4139 0EC675AD498AFEEBB6960B3AABE6")
+	send, err := newSRTPContext(srtpSuites[0], master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive, err = newSRTPContext(srtpSuites[0], master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return send, receive
+}
+
+func TestSRTPKeyDerivation(t *testing.T) {
+	// RFC 3711 appendix B.3
+	master := unhex("E1F97A0D3E018BE0D64FA32C06DE4139 0EC675AD498AFEEBB6960B3AABE6")
+	c, err := newSRTPContext(srtpSuites[0], master)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := unhex("30CBBC08863D8C85D49DB34A9AE1"); !bytes.Equal(c.salt[:], want) {
+		t.Errorf("session salt %X, want %X", c.salt, want)
+	}
+
+	// The session keys aren't kept, only what they make, so check they
+	// make the same as the RFC's
+	block, _ := aes.NewCipher(unhex("C61E7A93744F39EE10734AFE3FF7A087"))
+	var got, want [aes.BlockSize]byte
+	c.block.Encrypt(got[:], make([]byte, aes.BlockSize))
+	block.Encrypt(want[:], make([]byte, aes.BlockSize))
+	if got != want {
+		t.Error("session encryption key isn't C61E7A93744F39EE10734AFE3FF7A087")
+	}
+	mac := hmac.New(sha1.New, unhex("CEBE321F6FF7716B6FD4AB49AF256A156D38BAA4"))
+	c.mac.Write([]byte("travel by telephone"))
+	mac.Write([]byte("travel by telephone"))
+	if !hmac.Equal(c.mac.Sum(nil), mac.Sum(nil)) {
+		t.Error("session authentication key isn't CEBE321F6FF7716B6FD4AB49AF256A156D38BAA4")
+	}
+}
+
+func TestSRTPKeystream(t *testing.T) {
+	// RFC 3711 appendix B.2: with SSRC and index 0, the IV is the salt
+	block, _ := aes.NewCipher(unhex("2B7E151628AED2A6ABF7158809CF4F3C"))
+	c := &srtpContext{block: block}
+	copy(c.salt[:], unhex("F0F1F2F3F4F5F6F7F8F9FAFBFCFD"))
+
+	keystream := make([]byte, 0xFF02*aes.BlockSize)
+	c.crypt(keystream, make([]byte, 4), 0)
+	for _, block := range []struct {
+		counter int
+		want    string
+	}{
+		{0x0000, "E03EAD0935C95E80E166B16DD92B4EB4"},
+		{0x0001, "D23513162B02D0F72A43A2FE4A5F97AB"},
+		{0x0002, "41E95B3BB0A2E8DD477901E4FCA894C0"},
+		{0xFEFF, "EC8CDF7398607CB0F2D21675EA9EA1E4"},
+		{0xFF00, "362B7C3C6773516318A077D7FC5073AE"},
+		{0xFF01, "6A2CC3787889374FBEB4C81B17BA6C44"},
+	} {
+		got := keystream[block.counter*aes.BlockSize : (block.counter+1)*aes.BlockSize]
+		if !bytes.Equal(got, unhex(block.want)) {
+			t.Errorf("keystream block %04X = %X, want %s", block.counter, got, block.want)
+		}
+	}
+}
+
+func TestSRTPRoundTrip(t *testing.T) {
+	send, receive := testSRTPPair(t)
+	plain := testRTPPacket(1000, FRAME_SIZE)
+
+	packet := send.protect(bytes.Clone(plain))
+	if len(packet) != len(plain)+srtpSuites[0].tagSize {
+		t.Fatalf("protected packet is %d bytes, want %d", len(packet), len(plain)+srtpSuites[0].tagSize)
+	}
+	if !bytes.Equal(packet[:RTP_HEADER_SIZE], plain[:RTP_HEADER_SIZE]) || bytes.Equal(packet[RTP_HEADER_SIZE:len(plain)], plain[RTP_HEADER_SIZE:]) {
+		t.Fatal("protect should encrypt the payload and leave the header")
+	}
+
+	forged := bytes.Clone(packet)
+	forged[RTP_HEADER_SIZE] ^= 1
+	if _, err := receive.unprotect(forged); !errors.Is(err, errSRTPAuth) {
+		t.Errorf("altered packet: %v, want %v", err, errSRTPAuth)
+	}
+	got, err := receive.unprotect(bytes.Clone(packet))
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("unprotect = %X, %v; want the packet sent", got, err)
+	}
+	if _, err := receive.unprotect(bytes.Clone(packet)); !errors.Is(err, errSRTPReplay) {
+		t.Errorf("same packet again: %v, want %v", err, errSRTPReplay)
+	}
+}
+
+func TestSRTPReplayWindow(t *testing.T) {
+	send, receive := testSRTPPair(t)
+	packets := make(map[uint16][]byte)
+	for seq := uint16(100); seq <= 100+SRTP_REPLAY_WINDOW+1; seq++ {
+		packets[seq] = send.protect(testRTPPacket(seq, 20))
+	}
+
+	// The newest comes first; the others are late, some too late
+	newest := uint16(100 + SRTP_REPLAY_WINDOW + 1)
+	if _, err := receive.unprotect(bytes.Clone(packets[newest])); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		seq  uint16
+		want error
+	}{
+		{newest - 1, nil},
+		{newest - SRTP_REPLAY_WINDOW + 1, nil},
+		{newest - SRTP_REPLAY_WINDOW + 1, errSRTPReplay},
+		{newest - SRTP_REPLAY_WINDOW, errSRTPReplay}, // Out of the window
+		{newest, errSRTPReplay},
+	} {
+		if _, err := receive.unprotect(bytes.Clone(packets[test.seq])); !errors.Is(err, test.want) {
+			t.Errorf("packet %d: %v, want %v", test.seq, err, test.want)
+		}
+	}
+}
+
+func TestSRTPRollover(t *testing.T) {
+	send, receive := testSRTPPair(t)
+	sequence := []uint16{0xFFFD, 0xFFFE, 0xFFFF, 0x0000, 0x0001}
+	packets := make([][]byte, len(sequence))
+	for i, seq := range sequence {
+		packets[i] = send.protect(testRTPPacket(seq, 20))
+	}
+	if send.roc != 1 {
+		t.Fatalf("sender's rollover counter is %d after wrapping, want 1", send.roc)
+	}
+
+	// The authentication tag covers the rollover counter, so a packet is
+	// only accepted if the receiver guessed the one it was sent with: the
+	// new one after the wrap, and the old one for the packet that comes
+	// late from before it
+	for _, i := range []int{1, 2, 3, 4, 0} {
+		got, err := receive.unprotect(bytes.Clone(packets[i]))
+		if err != nil || !bytes.Equal(got, testRTPPacket(sequence[i], 20)) {
+			t.Errorf("packet %04X: %v", sequence[i], err)
+		}
+	}
+	if receive.roc != 1 || receive.seq != 0x0001 {
+		t.Errorf("receiver is at rollover %d, sequence %04X; want 1, 0001", receive.roc, receive.seq)
+	}
+}
+
+func TestSRTCPRoundTrip(t *testing.T) {
+	master := unhex("E1F97A0D3E018BE0D64FA32C06DE4139 0EC675AD498AFEEBB6960B3AABE6")
+	send, _ := newSRTCPContext(srtpSuites[0], master)
+	receive, _ := newSRTCPContext(srtpSuites[0], master)
+
+	// A receiver report with one report block
+	plain := make([]byte, 32)
+	plain[0], plain[1] = 0x81, 201
+	binary.BigEndian.PutUint16(plain[2:4], 7)
+	binary.BigEndian.PutUint32(plain[4:8], 0xCAFEF00D)
+	for i := 8; i < len(plain); i++ {
+		plain[i] = byte(i)
+	}
+
+	for index := range 2 {
+		packet := send.protect(bytes.Clone(plain))
+		if len(packet) != len(plain)+SRTCP_INDEX_SIZE+SRTCP_TAG_SIZE {
+			t.Fatalf("protected packet is %d bytes, want %d", len(packet), len(plain)+SRTCP_INDEX_SIZE+SRTCP_TAG_SIZE)
+		}
+		if trailer := binary.BigEndian.Uint32(packet[len(plain):]); trailer != 1<<31|uint32(index) {
+			t.Errorf("E flag and index %08X, want %08X", trailer, 1<<31|index)
+		}
+		if bytes.Equal(packet[8:len(plain)], plain[8:]) {
+			t.Error("protect left the report unencrypted")
+		}
+
+		got, err := receive.unprotect(bytes.Clone(packet))
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("unprotect = %X, %v; want the packet sent", got, err)
+		}
+		if _, err := receive.unprotect(bytes.Clone(packet)); !errors.Is(err, errSRTPReplay) {
+			t.Errorf("same packet again: %v, want %v", err, errSRTPReplay)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// STATS_BEEP_FREQ is the beep played per registered phone when the stats
+// line has no speech synthesizer
+const STATS_BEEP_FREQ = 880.0 // Hz
+
+// callStats counts an exchange's calls by day, for the stats line. The
+// counts start over at midnight and when the server restarts.
+type callStats struct {
+	mu     sync.Mutex
+	day    string         // Local date the counts are for
+	calls  int            // Calls that reached a destination
+	places map[string]int // Calls by place, as named in passports
+}
+
+// newCallStats starts counting from nothing
+func newCallStats() *callStats {
+	return &callStats{places: make(map[string]int)}
+}
+
+// Record counts a call reaching a destination
+func (c *callStats) Record(name string, dest DestinationConfig, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rollOver(at)
+	c.calls++
+	c.places[placeName(name, dest)]++
+}
+
+// Today returns the day's call count and its most dialed place, with its
+// count; ties go to the first place alphabetically
+func (c *callStats) Today(at time.Time) (calls int, top string, topCalls int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rollOver(at)
+	for _, place := range slices.Sorted(maps.Keys(c.places)) {
+		if c.places[place] > topCalls {
+			top, topCalls = place, c.places[place]
+		}
+	}
+	return c.calls, top, topCalls
+}
+
+// rollOver starts the counts over on a new day. Must be called with mu
+// held.
+func (c *callStats) rollOver(at time.Time) {
+	if day := at.Format(time.DateOnly); day != c.day {
+		c.day, c.calls = day, 0
+		clear(c.places)
+	}
+}
+
+// formatUptime says how long the server has been running, to the minute
+func formatUptime(d time.Duration) string {
+	if d < time.Minute {
+		return "less than a minute"
+	}
+	days := int(d / (24 * time.Hour))
+	hours := int(d/time.Hour) % 24
+	minutes := int(d/time.Minute) % 60
+
+	var parts []string
+	if days > 0 {
+		parts = append(parts, countOf(days, "day"))
+	}
+	if hours > 0 {
+		parts = append(parts, countOf(hours, "hour"))
+	}
+	if days == 0 && minutes > 0 {
+		parts = append(parts, countOf(minutes, "minute"))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// countOf says n of something, e.g. "1 call" or "3 calls"
+func countOf(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// statsText is what the stats line says about an exchange
+func (s *SIPServer) statsText(ex *exchange) string {
+	now := time.Now()
+	calls, top, topCalls := ex.stats.Today(now)
+
+	active := 0
+	s.callsMu.Lock()
+	for _, session := range s.calls {
+		if session.exchange == ex {
+			active++
+		}
+	}
+	s.callsMu.Unlock()
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "Up %s. %s today.", formatUptime(now.Sub(s.started)), countOf(calls, "call"))
+	if top != "" {
+		fmt.Fprintf(&text, " Most dialed: %s, %s.", top, countOf(topCalls, "call"))
+	}
+	fmt.Fprintf(&text, " %s registered. %s in progress.", countOf(ex.registrar.Count(), "phone"), countOf(active, "call"))
+	return text.String()
+}
+
+// runStats reads the server's health out to the caller: uptime, the day's
+// calls, the most dialed place and the phones registered. Without a speech
+// synthesizer the line beeps once per registered phone.
+func (s *SIPServer) runStats(session *CallSession) {
+	text := s.statsText(session.exchange)
+	fmt.Printf("📊 %s\n", text)
+	s.speak(session, text, newBeeps(session.exchange.registrar.Count(), STATS_BEEP_FREQ))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// stateStore keeps what the server learns about callers across restarts,
+// such as the secrets they have unlocked, in a JSON file. Values are kept
+// by key, each feature under its own. Without a file the store only lasts
+// as long as the process.
+type stateStore struct {
+	mu   sync.Mutex
+	path string
+	data map[string]json.RawMessage
+}
+
+// stateStores shares one store between every exchange that uses the same
+// file, so their writes don't overwrite each other
+var (
+	stateStoresMu sync.Mutex
+	stateStores   = make(map[string]*stateStore)
+)
+
+// openStateStore loads the store kept in path, or starts an empty one if
+// the file doesn't exist yet. An empty path gives a store kept in memory.
+func openStateStore(path string) (*stateStore, error) {
+	if path == "" {
+		return &stateStore{data: make(map[string]json.RawMessage)}, nil
+	}
+
+	stateStoresMu.Lock()
+	defer stateStoresMu.Unlock()
+
+	if store, ok := stateStores[path]; ok {
+		return store, nil
+	}
+	store := &stateStore{path: path, data: make(map[string]json.RawMessage)}
+	contents, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+	if len(contents) > 0 {
+		if err := json.Unmarshal(contents, &store.data); err != nil {
+			return nil, fmt.Errorf("failed to parse state file %s: %v", path, err)
+		}
+	}
+	stateStores[path] = store
+	return store, nil
+}
+
+// Load decodes the value kept under key into v, reporting whether there
+// was one
+func (s *stateStore) Load(key string, v any) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	raw, ok := s.data[key]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return false, fmt.Errorf("failed to decode %s from state file: %v", key, err)
+	}
+	return true, nil
+}
+
+// Save keeps v under key and writes the store out. The file is replaced in
+// one step, so a crash leaves either the old state or the new.
+func (s *stateStore) Save(key string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %v", key, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data[key] = raw
+	if s.path == "" {
+		return nil
+	}
+	contents, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // Gone already once renamed
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+)
+
+// STUN (RFC 5389) shares the RTP socket with media: browsers check that
+// they can reach us with it before ICE lets them send audio, and a STUN
+// server tells us the address our RTP port has outside the NAT.
+
+const (
+	STUN_HEADER_SIZE  = 20
+	STUN_MAGIC_COOKIE = 0x2112A442
+
+	STUN_BINDING_REQUEST = 0x0001
+	STUN_BINDING_SUCCESS = 0x0101
+
+	STUN_ATTR_USERNAME          = 0x0006
+	STUN_ATTR_MESSAGE_INTEGRITY = 0x0008
+	STUN_ATTR_XOR_MAPPED        = 0x0020
+	STUN_ATTR_USE_CANDIDATE     = 0x0025
+	STUN_ATTR_FINGERPRINT       = 0x8028
+
+	// STUN_FINGERPRINT_XOR is mixed into FINGERPRINT's CRC-32, so it can't
+	// be mistaken for one carried by another protocol
+	STUN_FINGERPRINT_XOR = 0x5354554E
+)
+
+// stunMessage is a STUN message taken apart
+type stunMessage struct {
+	kind        uint16
+	transaction [12]byte
+	attributes  map[uint16][]byte // The first of each type
+	integrity   int               // Offset of MESSAGE-INTEGRITY, or 0 if it has none
+	raw         []byte
+}
+
+// isSTUN reports whether a packet on the RTP socket is STUN rather than
+// RTP or DTLS, by its first byte (RFC 7983)
+func isSTUN(packet []byte) bool {
+	return len(packet) >= STUN_HEADER_SIZE && packet[0] < 4
+}
+
+// parseSTUN takes a STUN message apart; ok is false if it isn't one
+func parseSTUN(packet []byte) (m *stunMessage, ok bool) {
+	if !isSTUN(packet) || binary.BigEndian.Uint32(packet[4:8]) != STUN_MAGIC_COOKIE {
+		return nil, false
+	}
+	length := int(binary.BigEndian.Uint16(packet[2:4]))
+	if length%4 != 0 || STUN_HEADER_SIZE+length != len(packet) {
+		return nil, false
+	}
+	m = &stunMessage{kind: binary.BigEndian.Uint16(packet[0:2]), attributes: make(map[uint16][]byte), raw: packet}
+	copy(m.transaction[:], packet[8:20])
+
+	for n := STUN_HEADER_SIZE; n < len(packet); {
+		if n+4 > len(packet) {
+			return nil, false
+		}
+		kind := binary.BigEndian.Uint16(packet[n : n+2])
+		size := int(binary.BigEndian.Uint16(packet[n+2 : n+4]))
+		if n+4+size > len(packet) {
+			return nil, false
+		}
+		if _, seen := m.attributes[kind]; !seen {
+			m.attributes[kind] = packet[n+4 : n+4+size]
+		}
+		if kind == STUN_ATTR_MESSAGE_INTEGRITY && m.integrity == 0 {
+			m.integrity = n
+		}
+		n += 4 + (size+3)&^3
+	}
+	return m, true
+}
+
+// authentic reports whether the message's MESSAGE-INTEGRITY was made with
+// key: the HMAC of everything before it, with the length in the header
+// counting up to its end (RFC 5389 section 15.4)
+func (m *stunMessage) authentic(key []byte) bool {
+	if m.integrity == 0 || len(m.attributes[STUN_ATTR_MESSAGE_INTEGRITY]) != sha1.Size {
+		return false
+	}
+	mac := hmac.New(sha1.New, key)
+	var header [STUN_HEADER_SIZE]byte
+	copy(header[:], m.raw)
+	binary.BigEndian.PutUint16(header[2:4], uint16(m.integrity-STUN_HEADER_SIZE+4+sha1.Size))
+	mac.Write(header[:])
+	mac.Write(m.raw[STUN_HEADER_SIZE:m.integrity])
+	return hmac.Equal(mac.Sum(nil), m.attributes[STUN_ATTR_MESSAGE_INTEGRITY])
+}
+
+// mappedAddress is the XOR-MAPPED-ADDRESS of a message, or nil
+func (m *stunMessage) mappedAddress() *net.UDPAddr {
+	value := m.attributes[STUN_ATTR_XOR_MAPPED]
+	if len(value) < 8 {
+		return nil
+	}
+	addr := &net.UDPAddr{Port: int(binary.BigEndian.Uint16(value[2:4]) ^ STUN_MAGIC_COOKIE>>16)}
+	var mask [16]byte
+	binary.BigEndian.PutUint32(mask[:4], STUN_MAGIC_COOKIE)
+	copy(mask[4:], m.transaction[:])
+	switch {
+	case value[1] == 1:
+		addr.IP = make(net.IP, net.IPv4len)
+	case value[1] == 2 && len(value) >= 20:
+		addr.IP = make(net.IP, net.IPv6len)
+	default:
+		return nil
+	}
+	for i := range addr.IP {
+		addr.IP[i] = value[4+i] ^ mask[i]
+	}
+	return addr
+}
+
+// newSTUNMessage starts a message of a kind; add attributes with
+// appendSTUNAttribute
+func newSTUNMessage(kind uint16, transaction [12]byte) []byte {
+	message := make([]byte, STUN_HEADER_SIZE, 128)
+	binary.BigEndian.PutUint16(message[0:2], kind)
+	binary.BigEndian.PutUint32(message[4:8], STUN_MAGIC_COOKIE)
+	copy(message[8:20], transaction[:])
+	return message
+}
+
+// newSTUNTransaction is a random transaction ID
+func newSTUNTransaction() (transaction [12]byte) {
+	rand.Read(transaction[:])
+	return transaction
+}
+
+// appendSTUNAttribute adds an attribute, padded to four bytes, and
+// counts it in the header's length
+func appendSTUNAttribute(message []byte, kind uint16, value []byte) []byte {
+	message = binary.BigEndian.AppendUint16(message, kind)
+	message = binary.BigEndian.AppendUint16(message, uint16(len(value)))
+	message = append(message, value...)
+	for len(message)%4 != 0 {
+		message = append(message, 0)
+	}
+	binary.BigEndian.PutUint16(message[2:4], uint16(len(message)-STUN_HEADER_SIZE))
+	return message
+}
+
+// appendXORMappedAddress adds addr as XOR-MAPPED-ADDRESS
+func appendXORMappedAddress(message []byte, addr *net.UDPAddr) []byte {
+	var mask [16]byte
+	binary.BigEndian.PutUint32(mask[:4], STUN_MAGIC_COOKIE)
+	copy(mask[4:], message[8:20])
+
+	ip, family := addr.IP.To4(), byte(1)
+	if ip == nil {
+		ip, family = addr.IP.To16(), 2
+	}
+	value := []byte{0, family, 0, 0}
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port)^STUN_MAGIC_COOKIE>>16)
+	for i, b := range ip {
+		value = append(value, b^mask[i])
+	}
+	return appendSTUNAttribute(message, STUN_ATTR_XOR_MAPPED, value)
+}
+
+// appendSTUNIntegrity adds MESSAGE-INTEGRITY keyed with key, then
+// FINGERPRINT, which ICE requires on every check
+func appendSTUNIntegrity(message []byte, key []byte) []byte {
+	binary.BigEndian.PutUint16(message[2:4], uint16(len(message)-STUN_HEADER_SIZE+4+sha1.Size))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	message = appendSTUNAttribute(message, STUN_ATTR_MESSAGE_INTEGRITY, mac.Sum(nil))
+
+	binary.BigEndian.PutUint16(message[2:4], uint16(len(message)-STUN_HEADER_SIZE+8))
+	fingerprint := binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(message)^STUN_FINGERPRINT_XOR)
+	return appendSTUNAttribute(message, STUN_ATTR_FINGERPRINT, fingerprint)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SIP_TCP_MAX_MESSAGE caps a message read from a TCP connection, head
+	// and body; a peer that sends more is disconnected
+	SIP_TCP_MAX_MESSAGE = 65535
+
+	// SIP_TCP_IDLE_TIMEOUT closes a TCP connection nothing has arrived on
+	// for longer than phones wait between registrations
+	SIP_TCP_IDLE_TIMEOUT = 2 * time.Hour
+)
+
+// errMessageTooLarge is returned for a message over SIP_TCP_MAX_MESSAGE
+var errMessageTooLarge = errors.New("SIP message too large")
+
+// streamConn is a phone's or trunk's TCP, TLS or WebSocket connection.
+// Everything sent to the address it comes from goes back over it.
+type streamConn struct {
+	conn      net.Conn
+	transport string     // "TCP", "TLS", "WS" or "WSS", as named in Via
+	mu        sync.Mutex // One message written at a time
+}
+
+// write sends one SIP message on the connection, in a frame of its own
+// over WebSocket
+func (c *streamConn) write(message string) error {
+	if c.isWebSocket() {
+		return c.writeFrame(WS_OP_TEXT, []byte(message))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := io.WriteString(c.conn, message)
+	return err
+}
+
+// listenTCP opens the TCP listener for SIP, on the same port as the UDP
+// sockets. Devices that find a message too big for UDP fall back to it;
+// without it the server still works over UDP alone.
+func (s *SIPServer) listenTCP(port int) {
+	addr := net.JoinHostPort(s.config.BindIP, strconv.Itoa(port))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("⚠️  Failed to listen for SIP over TCP on %s: %v", addr, err)
+		return
+	}
+	s.tcpListener = listener
+	fmt.Printf("🔗 Listening for SIP over TCP on %s\n", listener.Addr())
+}
+
+// acceptTCP takes connections on a TCP or TLS listener until it is closed
+func (s *SIPServer) acceptTCP(listener net.Listener, transport string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("❌ Error accepting SIP connection: %v", err)
+			continue
+		}
+		s.spawn(func() { s.readTCP(conn, transport) })
+	}
+}
+
+// readTCP handles the SIP messages arriving on one TCP or TLS connection
+// until the peer closes it or goes quiet, and answers them over it
+func (s *SIPServer) readTCP(conn net.Conn, transport string) {
+	reader := bufio.NewReader(conn)
+	s.serveStream(&streamConn{conn: conn, transport: transport}, func() (string, error) {
+		return readStreamMessage(reader)
+	})
+}
+
+// serveStream handles the SIP messages read from a connection until it
+// ends, routing everything sent to its peer back over it meanwhile
+func (s *SIPServer) serveStream(c *streamConn, read func() (string, error)) {
+	tcpAddr := c.conn.RemoteAddr().(*net.TCPAddr)
+	remoteAddr := &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone}
+	key := remoteAddr.String()
+
+	s.connMu.Lock()
+	if s.tcpConns == nil {
+		s.connMu.Unlock()
+		c.conn.Close() // The server is closing
+		return
+	}
+	s.tcpConns[key] = c
+	s.connMu.Unlock()
+	defer func() {
+		s.connMu.Lock()
+		delete(s.tcpConns, key)
+		s.connMu.Unlock()
+		c.conn.Close()
+	}()
+
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(SIP_TCP_IDLE_TIMEOUT))
+		message, err := read()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("⚠️  Closing SIP connection from %s: %v", remoteAddr, err)
+			}
+			return
+		}
+		captureStream(c, message, false)
+
+		if s.isScanner(message, remoteAddr) {
+			continue
+		}
+		if sipTrace.Load() {
+			fmt.Printf("\n📨 Received SIP Message from %s over %s (%d bytes)\n", remoteAddr, c.transport, len(message))
+			fmt.Printf("--- Message Content ---\n")
+			fmt.Print(message)
+			fmt.Printf("--- End Message ---\n")
+		}
+		s.spawn(func() { s.handleSIPMessage(message, remoteAddr) })
+	}
+}
+
+// readStreamMessage reads one SIP message from a stream: the start line
+// and headers up to the blank line, then as many bytes of body as
+// Content-Length gives (RFC 3261 section 18.3). CRLF keep-alives between
+// messages are skipped.
+func readStreamMessage(reader *bufio.Reader) (string, error) {
+	var head strings.Builder
+	length := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if head.Len()+len(line) > SIP_TCP_MAX_MESSAGE {
+			return "", errMessageTooLarge
+		}
+
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			if head.Len() == 0 {
+				continue // Keep-alive
+			}
+			head.WriteString("\r\n")
+			break
+		}
+		head.WriteString(trimmed + "\r\n")
+
+		name, value, ok := strings.Cut(trimmed, ":")
+		if name = strings.TrimSpace(name); ok && (strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "l")) {
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || n < 0 {
+				return "", fmt.Errorf("bad Content-Length %q", strings.TrimSpace(value))
+			}
+			length = n
+		}
+	}
+
+	if head.Len()+length > SIP_TCP_MAX_MESSAGE {
+		return "", errMessageTooLarge
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return "", err
+	}
+	return head.String() + string(body), nil
+}
+
+// streamFor is the TCP, TLS or WebSocket connection remote sent its
+// messages over, or nil if it uses UDP
+func (s *SIPServer) streamFor(remote *net.UDPAddr) *streamConn {
+	if remote == nil {
+		return nil
+	}
+	s.connMu.RLock()
+	defer s.connMu.RUnlock()
+	return s.tcpConns[remote.String()]
+}
+
+// transportFor is the transport remote reaches us over
+func (s *SIPServer) transportFor(remote *net.UDPAddr) string {
+	if stream := s.streamFor(remote); stream != nil {
+		return stream.transport
+	}
+	return "UDP"
+}
+
+// closeTCP stops the TCP, TLS and WebSocket listeners and closes every
+// connection
+func (s *SIPServer) closeTCP() {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+	if s.tlsListener != nil {
+		s.tlsListener.Close()
+	}
+	if s.wsServer != nil {
+		s.wsServer.Close()
+	}
+	for _, c := range s.tcpConns {
+		c.conn.Close()
+	}
+	s.tcpConns = nil
+}
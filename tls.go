@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// listenTLS opens the SIP over TLS listener if a certificate is
+// configured, on tls.port or the port after the SIP port. Phones that use
+// it are given sips: URIs, and nothing sent to them goes in the clear.
+func (s *SIPServer) listenTLS(sipPort int) error {
+	if s.config.TLS.CertFile == "" {
+		return nil
+	}
+	tlsConfig, err := loadTLSConfig(s.config)
+	if err != nil {
+		return err
+	}
+
+	port := s.config.TLS.Port
+	if port == 0 {
+		port = sipPort + 1
+	}
+	addr := net.JoinHostPort(s.config.BindIP, strconv.Itoa(port))
+	listener, err := tls.Listen("tcp", addr, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("failed to listen for SIP over TLS on %s: %v", addr, err)
+	}
+	s.tlsListener = listener
+	fmt.Printf("🔒 Listening for SIP over TLS on %s\n", listener.Addr())
+	return nil
+}
+
+// loadTLSConfig loads the configured certificate for serving TLS
+func loadTLSConfig(cfg *Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.ResolvePath(cfg.TLS.CertFile), cfg.ResolvePath(cfg.TLS.KeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// TLSPort is the port of the TLS listener, or 0 without one
+func (s *SIPServer) TLSPort() int {
+	if s.tlsListener == nil {
+		return 0
+	}
+	return s.tlsListener.Addr().(*net.TCPAddr).Port
+}
+
+// sentBy is the transport and port to name in the Via of requests to
+// remote, matching how it reaches us
+func (s *SIPServer) sentBy(remote *net.UDPAddr) (string, int) {
+	switch transport := s.transportFor(remote); transport {
+	case "TLS":
+		return transport, s.TLSPort()
+	case "WS", "WSS":
+		s.connMu.RLock()
+		defer s.connMu.RUnlock()
+		return transport, s.wsPort
+	default:
+		return transport, s.SIPAddr().Port
+	}
+}
+
+// contactURI is the URI remote should send its requests to, in our
+// Contact: sips: if it reached us over TLS, naming the transport over TCP
+// and WebSocket
+func (s *SIPServer) contactURI(remote *net.UDPAddr) string {
+	transport, port := s.sentBy(remote)
+	host := net.JoinHostPort(s.localIPFor(remote), strconv.Itoa(port))
+	switch transport {
+	case "TLS":
+		return "sips:server@" + host
+	case "UDP":
+		return "sip:server@" + host
+	default:
+		return "sip:server@" + host + ";transport=" + strings.ToLower(transport)
+	}
+}
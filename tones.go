@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"sync"
+)
+
+const (
+	// TONE_BLOCK is how much received audio the tone detector looks at
+	// once: 10ms, enough to tell apart tones 100 Hz or more apart
+	TONE_BLOCK = SAMPLE_RATE / 100
+
+	// TONE_MIN_LEVEL is the quietest block, as RMS, that can hold a tone;
+	// anything quieter is silence
+	TONE_MIN_LEVEL = 0.01
+
+	// TONE_MIN_SHARE is how much of a block's energy a frequency needs to
+	// count as present. A pair of tones played together gets about half
+	// each.
+	TONE_MIN_SHARE = 0.3
+)
+
+// toneDetector watches the audio a caller sends for in-band tones that no
+// telephone event announces, such as a red box's coin tones. Received
+// audio is cut into blocks of TONE_BLOCK samples for the watchers.
+type toneDetector struct {
+	mu       sync.Mutex
+	pending  []float64
+	watchers []*toneWatcher
+}
+
+// toneWatcher is one watcher of a call's audio
+type toneWatcher struct {
+	block func(block []float64)
+}
+
+// newToneDetector creates a detector with no watchers
+func newToneDetector() *toneDetector {
+	return &toneDetector{pending: make([]float64, 0, TONE_BLOCK)}
+}
+
+// Watch has f look at each block of received audio, scaled to ±1, until
+// the returned function is called
+func (d *toneDetector) Watch(f func(block []float64)) (stop func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	watcher := &toneWatcher{block: f}
+	d.watchers = append(d.watchers, watcher)
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.watchers = slices.DeleteFunc(d.watchers, func(w *toneWatcher) bool { return w == watcher })
+	}
+}
+
+// Push adds received audio, handing each completed block to the watchers.
+// Audio nothing watches is dropped.
+func (d *toneDetector) Push(pcm []int16) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.watchers) == 0 {
+		d.pending = d.pending[:0]
+		return
+	}
+	for _, sample := range pcm {
+		d.pending = append(d.pending, float64(sample)/32768)
+		if len(d.pending) == TONE_BLOCK {
+			for _, watcher := range d.watchers {
+				watcher.block(d.pending)
+			}
+			d.pending = d.pending[:0]
+		}
+	}
+}
+
+// blockLevel is the RMS level of a block
+func blockLevel(block []float64) float64 {
+	sum := 0.0
+	for _, x := range block {
+		sum += x * x
+	}
+	return math.Sqrt(sum / float64(len(block)))
+}
+
+// toneShare is the share of a block's energy at freq, from 0 to 1,
+// measured with the Goertzel algorithm
+func toneShare(block []float64, freq float64) float64 {
+	coeff := 2 * math.Cos(2*math.Pi*freq/SAMPLE_RATE)
+	var s1, s2, energy float64
+	for _, x := range block {
+		s1, s2 = x+coeff*s1-s2, s1
+		energy += x * x
+	}
+	if energy == 0 {
+		return 0
+	}
+	power := s1*s1 + s2*s2 - coeff*s1*s2
+	return 2 * power / (float64(len(block)) * energy)
+}
+
+// tonesPresent reports whether a block holds every one of the frequencies
+// and is loud enough to be more than line noise
+func tonesPresent(block []float64, frequencies ...float64) bool {
+	if blockLevel(block) < TONE_MIN_LEVEL {
+		return false
+	}
+	for _, freq := range frequencies {
+		if toneShare(block, freq) < TONE_MIN_SHARE {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// REFER_CONTENT_TYPE is the body of a NOTIFY reporting a transfer's
+// progress: the status line of the transferred call (RFC 3515)
+const REFER_CONTENT_TYPE = "message/sipfrag;version=2.0"
+
+// handleRefer processes SIP REFER requests: a phone on a call bridged to
+// another leg asks for that leg to be sent to another number, a blind
+// transfer. The REFER is accepted once the number is known to lead
+// somewhere; NOTIFYs then tell the phone how the transfer went, and the
+// phone hangs up.
+func (s *SIPServer) handleRefer(message string, remoteAddr *net.UDPAddr) {
+	headers := parseHeaders(message)
+	callID := headers["Call-ID"]
+
+	d := s.findDialog(callID, headerTag(headers["To"]), headerTag(headers["From"]))
+	s.callsMu.Lock()
+	session := s.calls[callID]
+	s.callsMu.Unlock()
+	if d == nil || session == nil || session.dialog != d || d.State() != dialogEstablished {
+		s.sendResponse(dialogResponse(headers, "481 Call/Transaction Does Not Exist"), remoteAddr)
+		return
+	}
+	if isNew, _ := d.checkCSeq(cseqNumber(headers["CSeq"])); !isNew {
+		return // A retransmission; the first copy is being handled
+	}
+
+	referTo := headers["Refer-To"]
+	target := uriFromHeader(referTo, remoteAddr)
+	number := contactUser(target)
+	transferee := session.bridgedTo()
+	switch {
+	case referTo == "" || number == "":
+		s.sendResponse(dialogResponse(headers, "400 Bad Request"), remoteAddr)
+		return
+	case strings.Contains(target, "Replaces="):
+		log.Printf("⚠️  %s asked for an attended transfer; only blind transfers are supported", remoteAddr)
+		s.sendResponse(dialogResponse(headers, "501 Not Implemented"), remoteAddr)
+		return
+	case transferee == nil:
+		log.Printf("⚠️  %s asked to transfer a call that isn't connected to anyone", remoteAddr)
+		s.sendResponse(dialogResponse(headers, "403 Forbidden"), remoteAddr)
+		return
+	}
+	res, ok := s.resolveRoute(transferee, number)
+	if !ok {
+		s.sendResponse(dialogResponse(headers, "404 Not Found"), remoteAddr)
+		return
+	}
+	if transferee.forwards >= MAX_FORWARDS {
+		log.Printf("❌ Not transferring %s to %s: passed on %d times already", transferee.CallID, number, transferee.forwards)
+		s.sendResponse(dialogResponse(headers, "482 Loop Detected"), remoteAddr)
+		return
+	}
+
+	fmt.Printf("🔀 Transferring %s to %s for %s\n", transferee.CallID, res.number, callID)
+	s.sendResponse(dialogResponse(headers, "202 Accepted"), remoteAddr)
+
+	s.spawn(func() {
+		if session.detach() != transferee {
+			// The call ended or was taken apart meanwhile
+			s.notifyRefer(d, "SIP/2.0 487 Request Terminated", "terminated;reason=noresource")
+			return
+		}
+		transferee.forwards++
+		s.spawn(func() { s.playDestination(transferee, res) })
+		s.notifyRefer(d, "SIP/2.0 100 Trying", "active")
+		s.notifyRefer(d, "SIP/2.0 200 OK", "terminated;reason=noresource")
+	})
+}
+
+// notifyRefer reports a transfer's progress to the phone that asked for
+// it
+func (s *SIPServer) notifyRefer(d *dialog, status, state string) {
+	body := status + "\r\n"
+	if code := s.transactRequest(d, "NOTIFY", REFER_CONTENT_TYPE, body, "Event: refer", "Subscription-State: "+state); code != 200 && code != 0 {
+		log.Printf("⚠️  %s answered the transfer NOTIFY with %d", d.remoteAddr, code)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TTS_TIMEOUT bounds how long the speech synthesizer may take
+const TTS_TIMEOUT = 30 * time.Second
+
+// ttsData is what the synthesizer's arguments can refer to
+type ttsData struct {
+	Text string // What to say
+	File string // A WAV file to write, for synthesizers that can't use stdout
+}
+
+// checkTTSTemplates parses the synthesizer's argument templates
+func checkTTSTemplates(cfg TTSConfig) error {
+	for _, arg := range cfg.Command {
+		if _, err := template.New("").Parse(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// synthesizeSpeech has the configured synthesizer say text. The text is
+// passed in {{.Text}} or, if no argument uses it, on stdin; the WAV comes
+// back in {{.File}} or, if no argument uses that, on stdout. Text starting
+// with "-" goes on stdin too, leaving out the arguments that would carry
+// it, so the synthesizer can't take it for an option.
+func synthesizeSpeech(ctx context.Context, cfg TTSConfig, text string) ([]int16, error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("no speech synthesizer configured")
+	}
+
+	out, err := os.CreateTemp("", "tts-*.wav")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create speech file: %v", err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	command := cfg.Command
+	if strings.HasPrefix(text, "-") {
+		command = []string{command[0]}
+		for _, arg := range cfg.Command[1:] {
+			if !strings.Contains(arg, ".Text") {
+				command = append(command, arg)
+			}
+		}
+	}
+	data := ttsData{Text: text, File: out.Name()}
+	args, err := renderCommand(command, data)
+	if err != nil {
+		return nil, err
+	}
+	textInArgs, fileInArgs := false, false
+	for _, arg := range command {
+		textInArgs = textInArgs || strings.Contains(arg, ".Text")
+		fileInArgs = fileInArgs || strings.Contains(arg, ".File")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, TTS_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if !textInArgs {
+		cmd.Stdin = strings.NewReader(text)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("speech synthesizer failed: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if fileInArgs {
+		return loadWAV(out.Name())
+	}
+	samples, err := decodeWAV(&stdout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode synthesized speech: %v", err)
+	}
+	return samples, nil
+}
+
+// speech is text spoken by the configured speech synthesizer, or fallback
+// without one or if it fails. TTY callers get the text itself.
+func speech(session *CallSession, text string, fallback MediaSource) MediaSource {
+	if session.tty.Load() {
+		return newBaudotSource(text)
+	}
+	tts := session.exchange.config.TTS
+	if len(tts.Command) == 0 {
+		return fallback
+	}
+	samples, err := synthesizeSpeech(session.ctx, tts, text)
+	if err != nil {
+		log.Printf("⚠️  %v", err)
+		return fallback
+	}
+	return newPCMSource(samples, false)
+}
+
+// speak says text to the caller with the configured speech synthesizer.
+// Without one, or if it fails, the caller hears fallback instead.
+func (s *SIPServer) speak(session *CallSession, text string, fallback MediaSource) {
+	s.playTone(session.ctx, session, speech(session, text, fallback))
+}
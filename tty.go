@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// TTYs (TDDs) type at 45.45 baud in Baudot, one frequency for a 1
+	// (mark) and another for a 0 (space)
+	TTY_BAUD       = 45.45
+	TTY_MARK_FREQ  = 1400.0 // Hz
+	TTY_SPACE_FREQ = 1800.0 // Hz
+
+	// TTY_LEVEL is how loud text is sent, as a fraction of full scale
+	TTY_LEVEL = 0.3
+
+	// TTY_LEAD_IN is the mark tone sent ahead of the first character so the
+	// far end's receiver has locked on when it starts
+	TTY_LEAD_IN = 150 * time.Millisecond
+
+	// TTY_WINDOW is how many samples the receiver looks at to tell mark
+	// from space: 5ms, under a quarter of a bit
+	TTY_WINDOW = 40
+
+	// TTY_MIN_SHARE is how much of the audio's energy mark or space must
+	// carry to count, so speech isn't taken for typing
+	TTY_MIN_SHARE = 0.5
+
+	// TTY_DETECT_CHARS is how many characters a caller must type before
+	// the call switches to text
+	TTY_DETECT_CHARS = 2
+)
+
+// ttySamplesPerBit is the length of one Baudot bit
+const ttySamplesPerBit = SAMPLE_RATE / TTY_BAUD
+
+// Baudot codes that aren't characters of their own
+const (
+	BAUDOT_LF    = 0x02
+	BAUDOT_SPACE = 0x04
+	BAUDOT_CR    = 0x08
+	BAUDOT_FIGS  = 0x1B
+	BAUDOT_LTRS  = 0x1F
+)
+
+// baudotLetters and baudotFigures are the characters of each code in the
+// letters and figures shifts, as US TTYs print them; NUL marks codes
+// with no character
+const (
+	baudotLetters = "\x00E\nA SIU\rDRJNFCKTZLWHYPQOBG\x00MXV\x00"
+	baudotFigures = "\x003\n- \a87\r$4',!:(5\")2=6019?+\x00./;\x00"
+)
+
+// isTTYPhone reports whether a call comes from a phone that is always a
+// TTY, so text is sent from the start rather than once the caller types
+func isTTYPhone(cfg TTYConfig, session *CallSession) bool {
+	return cfg.Enabled && session.dialog != nil && slices.Contains(cfg.Phones, session.caller())
+}
+
+// encodeBaudot turns text into Baudot codes, shifting between letters and
+// figures as needed and ending the line. Characters a TTY can't print are
+// left out. The shift is sent again after each space, for TTYs that drop
+// back to letters on a space and for those that don't.
+func encodeBaudot(text string) []byte {
+	var codes []byte
+	shift := byte(0) // BAUDOT_LTRS or BAUDOT_FIGS, 0 if unsure
+	put := func(table string, to byte, c rune) {
+		if shift != to {
+			codes = append(codes, to)
+			shift = to
+		}
+		codes = append(codes, byte(strings.IndexRune(table, c)))
+	}
+	for _, c := range strings.ToUpper(text) {
+		switch {
+		case c == '\n':
+			codes = append(codes, BAUDOT_CR, BAUDOT_LF)
+		case c == ' ':
+			codes = append(codes, BAUDOT_SPACE)
+			shift = 0
+		case c < ' ' || c > '~':
+		case strings.ContainsRune(baudotLetters, c):
+			put(baudotLetters, BAUDOT_LTRS, c)
+		case strings.ContainsRune(baudotFigures, c):
+			put(baudotFigures, BAUDOT_FIGS, c)
+		}
+	}
+	return append(codes, BAUDOT_CR, BAUDOT_LF)
+}
+
+// newBaudotSource sends text to a TTY: each character is a space start
+// bit, five data bits (least significant first) and one and a half mark
+// stop bits, with the tone's phase kept continuous throughout
+func newBaudotSource(text string) MediaSource {
+	var samples []int16
+	phase, bits := 0.0, 0.0
+	tone := func(mark bool, length float64) {
+		freq := TTY_SPACE_FREQ
+		if mark {
+			freq = TTY_MARK_FREQ
+		}
+		bits += length
+		for float64(len(samples)) < bits*ttySamplesPerBit {
+			samples = append(samples, int16(math.Sin(phase)*TTY_LEVEL*32767))
+			phase = math.Mod(phase+2*math.Pi*freq/SAMPLE_RATE, 2*math.Pi)
+		}
+	}
+
+	tone(true, TTY_LEAD_IN.Seconds()*TTY_BAUD)
+	for _, code := range encodeBaudot(text) {
+		tone(false, 1)
+		for bit := range 5 {
+			tone(code>>bit&1 == 1, 1)
+		}
+		tone(true, 1.5)
+	}
+	return newPCMSource(samples, false)
+}
+
+// baudotDemodulator reads what a TTY types from a call's audio. A sliding
+// window measures how much of the audio is at the mark and space
+// frequencies; a space after idle starts a character, whose bits are
+// read in their middles.
+type baudotDemodulator struct {
+	chars chan rune // Characters typed
+
+	ring       [TTY_WINDOW][5]float64 // Mark and space I/Q and energy per sample
+	sums       [5]float64             // Their sums over the window
+	pos        int
+	markPhase  float64
+	spacePhase float64
+
+	receiving bool
+	clock     float64 // Samples into the character
+	bits      int     // Bits of it read
+	code      byte
+	figures   bool
+}
+
+// newBaudotDemodulator creates a demodulator with room for a burst of
+// typing
+func newBaudotDemodulator() *baudotDemodulator {
+	return &baudotDemodulator{chars: make(chan rune, 64)}
+}
+
+// Block looks at the next block of received audio
+func (d *baudotDemodulator) Block(block []float64) {
+	for _, x := range block {
+		d.sample(x)
+	}
+}
+
+// sample moves the window on by one sample and advances the character
+// being received
+func (d *baudotDemodulator) sample(x float64) {
+	entry := [5]float64{
+		x * math.Cos(d.markPhase), x * math.Sin(d.markPhase),
+		x * math.Cos(d.spacePhase), x * math.Sin(d.spacePhase),
+		x * x,
+	}
+	for k := range entry {
+		d.sums[k] += entry[k] - d.ring[d.pos][k]
+	}
+	d.ring[d.pos] = entry
+	d.pos = (d.pos + 1) % TTY_WINDOW
+	if d.pos == 0 {
+		// Start the sums afresh now and then so rounding can't build up
+		d.sums = [5]float64{}
+		for _, e := range d.ring {
+			for k := range e {
+				d.sums[k] += e[k]
+			}
+		}
+	}
+	d.markPhase = math.Mod(d.markPhase+2*math.Pi*TTY_MARK_FREQ/SAMPLE_RATE, 2*math.Pi)
+	d.spacePhase = math.Mod(d.spacePhase+2*math.Pi*TTY_SPACE_FREQ/SAMPLE_RATE, 2*math.Pi)
+
+	mark := d.sums[0]*d.sums[0] + d.sums[1]*d.sums[1]
+	space := d.sums[2]*d.sums[2] + d.sums[3]*d.sums[3]
+	energy := d.sums[4]
+	present := energy/TTY_WINDOW >= TONE_MIN_LEVEL*TONE_MIN_LEVEL &&
+		2*max(mark, space)/(TTY_WINDOW*energy) >= TTY_MIN_SHARE
+	isMark, isSpace := present && mark > space, present && space >= mark
+
+	if !d.receiving {
+		if isSpace {
+			d.receiving, d.clock, d.bits, d.code = true, 0, 0, 0
+		}
+		return
+	}
+	d.clock++
+	if d.clock < (float64(d.bits)+0.5)*ttySamplesPerBit {
+		return
+	}
+	switch {
+	case d.bits == 0 && !isSpace:
+		d.receiving = false // A glitch, not a start bit
+		return
+	case d.bits >= 1 && d.bits <= 5:
+		if !isMark && !isSpace {
+			d.receiving = false // Lost the carrier
+			return
+		}
+		if isMark {
+			d.code |= 1 << (d.bits - 1)
+		}
+	case d.bits == 6:
+		d.receiving = false
+		if isMark {
+			d.decode(d.code)
+		}
+		return
+	}
+	d.bits++
+}
+
+// decode turns a received code into a character, following the shifts
+func (d *baudotDemodulator) decode(code byte) {
+	switch code {
+	case BAUDOT_LTRS:
+		d.figures = false
+		return
+	case BAUDOT_FIGS:
+		d.figures = true
+		return
+	}
+	table := baudotLetters
+	if d.figures {
+		table = baudotFigures
+	}
+	if c := table[code]; c != 0 {
+		select {
+		case d.chars <- rune(c):
+		default:
+		}
+	}
+}
+
+// startTTY listens for a TTY on a call. Once the caller has typed enough
+// to be sure, the call switches to text: prompts are sent in Baudot
+// instead of spoken, and destinations with text send it. Digits typed
+// dial like keys pressed, and Enter like #.
+func (s *SIPServer) startTTY(session *CallSession) {
+	demodulator := newBaudotDemodulator()
+	session.tones.Watch(demodulator.Block)
+
+	if isTTYPhone(session.exchange.config.TTY, session) {
+		session.tty.Store(true)
+	}
+
+	s.spawn(func() {
+		typed := 0
+		var line strings.Builder
+		var pending []string // Keys typed before the TTY was detected
+		press := func(key string) {
+			if session.tty.Load() {
+				s.handleDigit(session, key)
+			} else {
+				pending = append(pending, key)
+			}
+		}
+
+		for {
+			select {
+			case c := <-demodulator.chars:
+				typed++
+				if typed == TTY_DETECT_CHARS && session.tty.CompareAndSwap(false, true) {
+					fmt.Printf("⌨️  TTY detected on %s; switching to text\n", session.CallID)
+					for _, key := range pending {
+						s.handleDigit(session, key)
+					}
+				}
+				switch {
+				case c == '\r' || c == '\n':
+					if line.Len() > 0 {
+						fmt.Printf("⌨️  TTY %s typed %q\n", session.CallID, line.String())
+						line.Reset()
+					}
+					if c == '\r' {
+						press("#")
+					}
+				case c >= '0' && c <= '9':
+					line.WriteRune(c)
+					press(string(c))
+				case c != '\a':
+					line.WriteRune(c)
+				}
+			case <-session.ctx.Done():
+				return
+			}
+		}
+	})
+}
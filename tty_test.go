@@ -0,0 +1,59 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// demodulateBaudot plays source into a demodulator, returning what it
+// read
+func demodulateBaudot(source MediaSource) string {
+	d := newBaudotDemodulator()
+	frame := make([]int16, FRAME_SIZE)
+	block := make([]float64, FRAME_SIZE)
+	var text strings.Builder
+	for source.ReadFrame(frame) {
+		for i, sample := range frame {
+			block[i] = float64(sample) / 32768
+		}
+		d.Block(block)
+		for len(d.chars) > 0 {
+			text.WriteRune(<-d.chars)
+		}
+	}
+	return text.String()
+}
+
+func TestBaudotRoundTrip(t *testing.T) {
+	for _, text := range []string{
+		"hello",
+		"call 911",
+		"room12b", // Figures straight after letters, and back, with no space
+		"ga 4 u?", // Figures and letters each after a space
+		"$5.00, ok!",
+		"line one\nline 2",
+	} {
+		if got, want := demodulateBaudot(newBaudotSource(text)), strings.ReplaceAll(strings.ToUpper(text), "\n", "\r\n")+"\r\n"; got != want {
+			t.Errorf("%q came back as %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestEncodeBaudotShifts(t *testing.T) {
+	code := func(table string, c byte) byte { return byte(strings.IndexByte(table, c)) }
+
+	// A figure after letters needs FIGS though the text has no shift in it
+	got := encodeBaudot("A1")
+	want := []byte{BAUDOT_LTRS, code(baudotLetters, 'A'), BAUDOT_FIGS, code(baudotFigures, '1'), BAUDOT_CR, BAUDOT_LF}
+	if !slices.Equal(got, want) {
+		t.Errorf("encodeBaudot(%q) = %v, want %v", "A1", got, want)
+	}
+
+	// and after a space the shift is sent again, even if unchanged
+	got = encodeBaudot("1 2")
+	want = []byte{BAUDOT_FIGS, code(baudotFigures, '1'), BAUDOT_SPACE, BAUDOT_FIGS, code(baudotFigures, '2'), BAUDOT_CR, BAUDOT_LF}
+	if !slices.Equal(got, want) {
+		t.Errorf("encodeBaudot(%q) = %v, want %v", "1 2", got, want)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Tunnel frame types
+	FRAME_HELLO     = 1  // Client nonce and name
+	FRAME_CHALLENGE = 2  // Server nonce and proof of the secret
+	FRAME_AUTH      = 3  // Client proof of the secret
+	FRAME_OK        = 4  // Handshake complete
+	FRAME_CALL      = 5  // Number to dial on the far side, possibly empty
+	FRAME_AUDIO     = 6  // One 20ms frame of μ-law audio
+	FRAME_DIGIT     = 7  // A key pressed after the call was set up
+	FRAME_HANGUP    = 8  // The call is over
+	FRAME_COMMIT    = 9  // Hash of the initiator's DH public key
+	FRAME_DHPART    = 10 // A DH public key
+	FRAME_CALLER    = 11 // Caller ID, sent before FRAME_CALL when known
+
+	TUNNEL_NONCE_SIZE        = 16
+	TUNNEL_MAX_FRAME         = 1024
+	TUNNEL_HANDSHAKE_TIMEOUT = 5 * time.Second
+	TUNNEL_SEND_QUEUE        = 50 // Frames; a full second of audio
+)
+
+// errTunnelAuth is returned when a peer fails the shared secret handshake
+var errTunnelAuth = errors.New("peer failed authentication")
+
+// tunnelFrame is one message on a tunnel
+type tunnelFrame struct {
+	kind    byte
+	payload []byte
+}
+
+// tunnel carries one federated call between two installations over TCP.
+// Frames are a type byte and a 16-bit length followed by the payload.
+// Both sides prove they know the peer's shared secret with HMAC-SHA256
+// over fresh nonces before anything else is sent, then agree on media keys
+// bound to that handshake, and every frame after that, hangups included,
+// is sealed with them so nobody on the path can read or forge any of it.
+type tunnel struct {
+	conn net.Conn
+	peer string // Name of the installation on the other end
+	keys *mediaKeys
+
+	writeMu sync.Mutex // Held while sealing and writing a frame
+	sendSeq uint64     // Frames sealed so far; guarded by writeMu
+	recvSeq uint64     // Frames opened so far; owned by the reader
+
+	send      chan tunnelFrame
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newTunnel agrees on media keys over a connection authenticated with
+// authSecret and starts the tunnel's writer
+func newTunnel(conn net.Conn, peer string, initiator bool, authSecret []byte) (*tunnel, error) {
+	keys, err := agreeMediaKeys(conn, initiator, authSecret)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s: key agreement failed: %v", peer, err)
+	}
+	conn.SetDeadline(time.Time{})
+	fmt.Printf("🔐 Media with peer %s is encrypted; SAS %s (read it out to the other end)\n", peer, keys.sas)
+
+	t := &tunnel{
+		conn: conn,
+		peer: peer,
+		keys: keys,
+		send: make(chan tunnelFrame, TUNNEL_SEND_QUEUE),
+		done: make(chan struct{}),
+	}
+	go t.writeLoop()
+	return t, nil
+}
+
+// SAS returns the short authentication string for the call. If both ends
+// see the same one, nobody is in the middle.
+func (t *tunnel) SAS() string {
+	return t.keys.sas
+}
+
+// writeFrame writes a single frame to w
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	if len(payload) > TUNNEL_MAX_FRAME {
+		return fmt.Errorf("frame too large: %d bytes", len(payload))
+	}
+	frame := make([]byte, 3+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint16(frame[1:3], uint16(len(payload)))
+	copy(frame[3:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads a single frame from r
+func readFrame(r io.Reader) (tunnelFrame, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return tunnelFrame{}, err
+	}
+	size := binary.BigEndian.Uint16(header[1:3])
+	if size > TUNNEL_MAX_FRAME {
+		return tunnelFrame{}, fmt.Errorf("frame too large: %d bytes", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return tunnelFrame{}, err
+	}
+	return tunnelFrame{kind: header[0], payload: payload}, nil
+}
+
+// tunnelProof computes the HMAC a side sends to show it knows the secret
+func tunnelProof(secret, role string, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(role))
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// tunnelAuthSecret is what binds a tunnel's media keys to its handshake:
+// an HMAC over both nonces and the client's name, keyed by the shared
+// secret
+func tunnelAuthSecret(secret string, clientNonce, serverNonce []byte, name string) []byte {
+	return tunnelProof(secret, "media", clientNonce, serverNonce, []byte(name))
+}
+
+// newNonce returns random bytes for the handshake
+func newNonce() []byte {
+	nonce := make([]byte, TUNNEL_NONCE_SIZE)
+	rand.Read(nonce)
+	return nonce
+}
+
+// dialTunnel connects to a peer and authenticates as localName
+func dialTunnel(peer PeerConfig, localName string) (*tunnel, error) {
+	conn, err := net.DialTimeout("tcp", peer.Address, TUNNEL_HANDSHAKE_TIMEOUT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to peer %s: %v", peer.Name, err)
+	}
+	conn.SetDeadline(time.Now().Add(TUNNEL_HANDSHAKE_TIMEOUT))
+
+	clientNonce := newNonce()
+	if err := writeFrame(conn, FRAME_HELLO, append(clientNonce, localName...)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	challenge, err := readFrame(conn)
+	if err != nil || challenge.kind != FRAME_CHALLENGE || len(challenge.payload) != TUNNEL_NONCE_SIZE+sha256.Size {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s: bad challenge: %v", peer.Name, err)
+	}
+	serverNonce := challenge.payload[:TUNNEL_NONCE_SIZE]
+	expected := tunnelProof(peer.Secret, "server", clientNonce, serverNonce)
+	if !hmac.Equal(challenge.payload[TUNNEL_NONCE_SIZE:], expected) {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s: %v", peer.Name, errTunnelAuth)
+	}
+
+	proof := tunnelProof(peer.Secret, "client", serverNonce, clientNonce, []byte(localName))
+	if err := writeFrame(conn, FRAME_AUTH, proof); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ok, err := readFrame(conn); err != nil || ok.kind != FRAME_OK {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s rejected us: %v", peer.Name, err)
+	}
+
+	return newTunnel(conn, peer.Name, true, tunnelAuthSecret(peer.Secret, clientNonce, serverNonce, localName))
+}
+
+// acceptTunnel authenticates an incoming connection, looking up the
+// caller's secret by the name it presents
+func acceptTunnel(conn net.Conn, lookup func(name string) (PeerConfig, bool)) (*tunnel, error) {
+	conn.SetDeadline(time.Now().Add(TUNNEL_HANDSHAKE_TIMEOUT))
+
+	hello, err := readFrame(conn)
+	if err != nil || hello.kind != FRAME_HELLO || len(hello.payload) <= TUNNEL_NONCE_SIZE {
+		return nil, fmt.Errorf("bad hello: %v", err)
+	}
+	clientNonce := hello.payload[:TUNNEL_NONCE_SIZE]
+	name := string(hello.payload[TUNNEL_NONCE_SIZE:])
+
+	peer, ok := lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown peer %q", name)
+	}
+
+	serverNonce := newNonce()
+	proof := tunnelProof(peer.Secret, "server", clientNonce, serverNonce)
+	if err := writeFrame(conn, FRAME_CHALLENGE, append(serverNonce, proof...)); err != nil {
+		return nil, err
+	}
+
+	auth, err := readFrame(conn)
+	if err != nil || auth.kind != FRAME_AUTH {
+		return nil, fmt.Errorf("peer %s: bad auth: %v", name, err)
+	}
+	expected := tunnelProof(peer.Secret, "client", serverNonce, clientNonce, []byte(name))
+	if !hmac.Equal(auth.payload, expected) {
+		return nil, fmt.Errorf("peer %s: %v", name, errTunnelAuth)
+	}
+	if err := writeFrame(conn, FRAME_OK, nil); err != nil {
+		return nil, err
+	}
+
+	return newTunnel(conn, peer.Name, false, tunnelAuthSecret(peer.Secret, clientNonce, serverNonce, name))
+}
+
+// writeLoop sends queued frames until the tunnel closes
+func (t *tunnel) writeLoop() {
+	for {
+		select {
+		case frame := <-t.send:
+			if err := t.write(frame); err != nil {
+				t.Close()
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// write seals a frame with the next sequence number and writes it
+func (t *tunnel) write(frame tunnelFrame) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	sealed := t.keys.send.Seal(nil, mediaNonce(t.sendSeq), frame.payload, []byte{frame.kind})
+	t.sendSeq++
+	return writeFrame(t.conn, frame.kind, sealed)
+}
+
+// Send queues a frame without blocking. Audio is dropped rather than
+// delayed if the connection can't keep up.
+func (t *tunnel) Send(kind byte, payload []byte) {
+	select {
+	case t.send <- tunnelFrame{kind: kind, payload: payload}:
+	case <-t.done:
+	default:
+	}
+}
+
+// Receive reads and decrypts the next frame from the peer
+func (t *tunnel) Receive() (tunnelFrame, error) {
+	frame, err := readFrame(t.conn)
+	if err != nil {
+		return frame, err
+	}
+	frame.payload, err = t.keys.recv.Open(nil, mediaNonce(t.recvSeq), frame.payload, []byte{frame.kind})
+	if err != nil {
+		return tunnelFrame{}, fmt.Errorf("peer %s: frame failed decryption: %v", t.peer, err)
+	}
+	t.recvSeq++
+	return frame, nil
+}
+
+// Hangup tells the peer the call is over and closes the tunnel. The frame
+// is written directly so it isn't lost behind queued audio.
+func (t *tunnel) Hangup() {
+	select {
+	case <-t.done:
+		return
+	default:
+	}
+	t.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	t.write(tunnelFrame{kind: FRAME_HANGUP})
+	t.Close()
+}
+
+// Close closes the tunnel without notifying the peer
+func (t *tunnel) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.conn.Close()
+	})
+}
+
+// Done is closed when the tunnel closes
+func (t *tunnel) Done() <-chan struct{} {
+	return t.done
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RING_TIMEOUT is how long a phone rings before the call gives up
+	RING_TIMEOUT = 30 * time.Second
+
+	// INVITE_RETRANSMIT is the interval between INVITE retransmissions
+	// until the phone responds (RFC 3261 timer A)
+	INVITE_RETRANSMIT = 500 * time.Millisecond
+
+	// REQUEST_TIMEOUT is how long another request within a dialog, such as
+	// a NOTIFY, is resent before the phone is given up on (timer F)
+	REQUEST_TIMEOUT = 32 * time.Second
+
+	// INVITE_LINGER is how long a finished INVITE of ours stays ready to
+	// acknowledge its final response again, should the phone resend it
+	// because our ACK was lost (RFC 3261 timer D, and 64*T1 for a 2xx)
+	INVITE_LINGER = 32 * time.Second
+)
+
+// errNoAnswer is returned when a rung phone doesn't answer in time
+var errNoAnswer = errors.New("no answer")
+
+// errDeclined is returned when a rung phone turns the call down, as a
+// phone set to do not disturb does
+var errDeclined = errors.New("phone declined the call")
+
+// uriFromHeader extracts the URI from a header such as Contact, falling
+// back to the sender's address
+func uriFromHeader(header string, remoteAddr *net.UDPAddr) string {
+	if start := strings.IndexByte(header, '<'); start >= 0 {
+		if end := strings.IndexByte(header[start:], '>'); end > 0 {
+			return header[start+1 : start+end]
+		}
+	}
+	if uri, _, _ := strings.Cut(header, ";"); strings.HasPrefix(uri, "sip:") || strings.HasPrefix(uri, "sips:") {
+		return strings.TrimSpace(uri)
+	}
+	return "sip:" + remoteAddr.String()
+}
+
+// contactUser returns the user part of a Contact header, "1000" for
+// "<sip:1000@192.168.1.5:5060>" or "<sips:1000@example.com>", unescaped
+// (see sipURI)
+func contactUser(contact string) string {
+	uri, err := headerURI(contact)
+	if err != nil {
+		return ""
+	}
+	return uri.User
+}
+
+// sipHost is an address as the host of a SIP URI, bracketed if IPv6
+func sipHost(ip string) string {
+	if isIPv6(ip) {
+		return "[" + ip + "]"
+	}
+	return ip
+}
+
+// sendRequest sends a request within a dialog, with any extra header lines
+// given, and returns the Via branch used, which a CANCEL must repeat
+func (s *SIPServer) sendRequest(d *dialog, method, branch, contentType, body string, extra ...string) string {
+	if branch == "" {
+		branch = newBranch()
+	}
+	d.mu.Lock()
+	cseq := d.cseq
+	if method != "ACK" && method != "CANCEL" {
+		d.cseq++
+		cseq = d.cseq
+	}
+	if method == "BYE" {
+		d.state = dialogTerminating
+	}
+	requestURI, from, to, routeSet := d.requestURI, d.from, d.to, d.routeSet
+	d.mu.Unlock()
+
+	localIP := s.localIPFor(d.remoteAddr)
+	transport, port := s.sentBy(d.remoteAddr)
+
+	var request strings.Builder
+	fmt.Fprintf(&request, "%s %s SIP/2.0\r\n", method, requestURI)
+	fmt.Fprintf(&request, "Via: SIP/2.0/%s %s;branch=%s;rport\r\n", transport, net.JoinHostPort(localIP, strconv.Itoa(port)), branch)
+	for _, route := range routeSet {
+		fmt.Fprintf(&request, "Route: %s\r\n", route)
+	}
+	fmt.Fprintf(&request, "From: %s\r\n", from)
+	fmt.Fprintf(&request, "To: %s\r\n", to)
+	fmt.Fprintf(&request, "Call-ID: %s\r\n", d.callID)
+	fmt.Fprintf(&request, "CSeq: %d %s\r\n", cseq, method)
+	fmt.Fprintf(&request, "Contact: <%s>\r\n", s.contactURI(d.remoteAddr))
+	fmt.Fprintf(&request, "Max-Forwards: 70\r\n")
+	for _, header := range extra {
+		request.WriteString(header + "\r\n")
+	}
+	if contentType != "" {
+		fmt.Fprintf(&request, "Content-Type: %s\r\n", contentType)
+	}
+	fmt.Fprintf(&request, "Content-Length: %d\r\n\r\n%s", len(body), body)
+
+	s.sendResponse(request.String(), d.remoteAddr)
+	return branch
+}
+
+// transactRequest sends a request other than INVITE within a dialog and
+// resends it, the intervals doubling, until the phone's final response;
+// over TCP it is sent once. It returns the response's status code, or 0
+// if none came in time.
+func (s *SIPServer) transactRequest(d *dialog, method, contentType, body string, extra ...string) int {
+	return parseStatusCode(s.transact(d, method, contentType, body, extra...))
+}
+
+// transact sends a request within a dialog and returns the phone's final
+// response to it, or "" if none came in time. Over UDP the request is
+// resent, the intervals doubling, until a response arrives; a re-INVITE
+// stops once the phone says it is working on it, and its final response
+// is acknowledged.
+func (s *SIPServer) transact(d *dialog, method, contentType, body string, extra ...string) string {
+	branch := newBranch()
+	responses := make(chan string, 8)
+	defer s.awaitResponses(responses, branch, method)()
+	s.sendRequest(d, method, branch, contentType, body, extra...)
+	resend := s.streamFor(d.remoteAddr) == nil
+
+	interval := INVITE_RETRANSMIT
+	deadline := time.NewTimer(REQUEST_TIMEOUT)
+	defer deadline.Stop()
+	for {
+		var retransmit <-chan time.Time
+		if resend {
+			retransmit = time.After(interval)
+		}
+		select {
+		case <-retransmit:
+			d.mu.Lock()
+			d.cseq-- // A retransmission reuses the CSeq and branch
+			d.mu.Unlock()
+			s.sendRequest(d, method, branch, contentType, body, extra...)
+			interval = min(2*interval, ANSWER_RETRANSMIT_MAX)
+
+		case response := <-responses:
+			code := parseStatusCode(response)
+			switch {
+			case code < 200 && method == "INVITE":
+				resend = false // The phone has it
+			case code < 200:
+			case method != "INVITE":
+				return response
+			default:
+				s.acknowledge(d, branch, response)
+				s.lingerInvite(d, branch, response)
+				return response
+			}
+
+		case <-deadline.C:
+			return ""
+
+		case <-s.ctx.Done():
+			return ""
+		}
+	}
+}
+
+// transactionKey identifies a client transaction of ours by the branch of
+// the Via we sent and the method, which its responses repeat in their top
+// Via and CSeq (RFC 3261 section 17.1.3)
+func transactionKey(branch, method string) string {
+	return branch + " " + method
+}
+
+// awaitResponses registers responses to receive the responses to our
+// request sent with branch; deliverResponse hands them over until the
+// returned func is called
+func (s *SIPServer) awaitResponses(responses chan string, branch, method string) func() {
+	key := transactionKey(branch, method)
+	s.callsMu.Lock()
+	s.pending[key] = responses
+	s.callsMu.Unlock()
+
+	return func() {
+		s.callsMu.Lock()
+		if s.pending[key] == responses { // Not since taken over by lingerInvite
+			delete(s.pending, key)
+		}
+		s.callsMu.Unlock()
+	}
+}
+
+// deliverResponse hands a response to the client transaction it answers.
+// It reports false if no transaction of ours is waiting for it.
+func (s *SIPServer) deliverResponse(message string) bool {
+	headers := readHeaders(message)
+	vias := headers.Values("Via")
+	if len(vias) == 0 {
+		return false
+	}
+	key := transactionKey(headerParam(vias[0], "branch"), cseqMethod(headers.Get("CSeq")))
+
+	s.callsMu.Lock()
+	responses, ok := s.pending[key]
+	s.callsMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case responses <- message:
+	default:
+	}
+	return true
+}
+
+// acknowledge sends the ACK for a final response to our INVITE: a 2xx is
+// acknowledged end to end, in a transaction of its own; any other within
+// the INVITE's transaction, with the To tag the response gave
+func (s *SIPServer) acknowledge(d *dialog, branch, response string) {
+	if code := parseStatusCode(response); code < 300 {
+		s.sendRequest(d, "ACK", "", "", "")
+		return
+	}
+	d.mu.Lock()
+	to := d.to
+	d.to = parseHeaders(response)["To"]
+	d.mu.Unlock()
+	s.sendRequest(d, "ACK", branch, "", "")
+	d.mu.Lock()
+	d.to = to
+	d.mu.Unlock()
+}
+
+// lingerInvite keeps a finished INVITE transaction of ours for
+// INVITE_LINGER, acknowledging its final response again each time the
+// phone resends it, as it does until an ACK reaches it. Over TCP nothing
+// is resent.
+func (s *SIPServer) lingerInvite(d *dialog, branch, final string) {
+	if s.streamFor(d.remoteAddr) != nil {
+		return
+	}
+	responses := make(chan string, 8)
+	done := s.awaitResponses(responses, branch, "INVITE")
+	s.spawn(func() {
+		defer done()
+		timer := time.NewTimer(INVITE_LINGER)
+		defer timer.Stop()
+		for {
+			select {
+			case response := <-responses:
+				if parseStatusCode(response) == parseStatusCode(final) {
+					s.acknowledge(d, branch, response)
+				}
+			case <-timer.C:
+				return
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// dialogTo starts a dialog, or just a transaction such as a keepalive
+// probe, with a registered phone, from the exchange
+func (s *SIPServer) dialogTo(ex *exchange, ua RegisteredUA) *dialog {
+	localIP := s.localIPFor(ua.RemoteAddr)
+	d := &dialog{
+		callID:     fmt.Sprintf("%08x@%s", rand.Uint64(), localIP),
+		localTag:   newTag(),
+		remoteAddr: ua.RemoteAddr,
+		requestURI: uriFromHeader(ua.Contact, ua.RemoteAddr),
+		state:      dialogRinging,
+		refreshed:  make(chan struct{}, 1),
+	}
+	d.from = fmt.Sprintf("<sip:%s@%s>;tag=%s", ex.name, sipHost(localIP), d.localTag)
+	d.to = "<" + d.requestURI + ">"
+	return d
+}
+
+// ringPhone calls a registered phone and waits until it answers, gives up
+// after ringFor, or ctx ends (the caller hung up), in which case the
+// INVITE is cancelled. The answered call is registered like any other, so
+// the phone's audio lands in its Playout once bridged and its BYE ends it.
+func (s *SIPServer) ringPhone(ctx context.Context, ex *exchange, ua RegisteredUA, ringFor time.Duration) (*CallSession, error) {
+	fmt.Printf("📲 Ringing %s\n", ua.Contact)
+	return s.invite(ctx, ex, s.dialogTo(ex, ua), ringFor, nil)
+}
+
+// invite places a call in a new dialog d, as ringPhone describes. If
+// authorize is given, a digest challenge is answered once with the header
+// line it returns for it, and the INVITE sent again. The call's RTP port
+// is given back if it isn't answered.
+func (s *SIPServer) invite(ctx context.Context, ex *exchange, d *dialog, ringFor time.Duration, authorize func(response string) (string, error)) (session *CallSession, err error) {
+	d.media, err = s.openMediaPort(d.callID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if session == nil {
+			d.media.Close()
+		}
+	}()
+
+	// RTCP on the RTP port is offered, and used if the answer takes it up
+	offered := offeredFormats(ex.config.QoS)
+	offered.rtcpMux = true
+	sdp := s.localSDP(offered, SDP_SENDRECV, d)
+	extra := sessionTimerOffer(DEFAULT_SESSION_EXPIRES)
+	branch := newBranch()
+	responses := make(chan string, 8)
+	done := s.awaitResponses(responses, branch, "INVITE")
+	defer func() { done() }()
+	s.sendRequest(d, "INVITE", branch, "application/sdp", sdp, extra...)
+
+	retransmit := time.NewTicker(INVITE_RETRANSMIT)
+	defer retransmit.Stop()
+	timeout := time.NewTimer(ringFor)
+	defer timeout.Stop()
+
+	provisional := false
+	for {
+		select {
+		case <-retransmit.C:
+			if !provisional {
+				d.mu.Lock()
+				d.cseq-- // A retransmission reuses the CSeq and branch
+				d.mu.Unlock()
+				s.sendRequest(d, "INVITE", branch, "application/sdp", sdp, extra...)
+			}
+
+		case response := <-responses:
+			code := parseStatusCode(response)
+			if code >= 200 {
+				s.lingerInvite(d, branch, response)
+			}
+			switch {
+			case code < 200:
+				provisional = true
+				if code == 180 || code == 183 {
+					fmt.Printf("🔔 %s is ringing\n", d.requestURI)
+				}
+			case code < 300:
+				return s.answered(ex, d, response)
+			case (code == 401 || code == 407) && authorize != nil:
+				// The ACK carries the challenge's To tag; the retry doesn't
+				s.acknowledge(d, branch, response)
+				authorization, err := authorize(response)
+				if err != nil {
+					return nil, err
+				}
+				authorize = nil // A second challenge means the answer was wrong
+				extra = append(extra, authorization)
+				done()
+				branch = newBranch()
+				done = s.awaitResponses(responses, branch, "INVITE")
+				s.sendRequest(d, "INVITE", branch, "application/sdp", sdp, extra...)
+				provisional = false
+			default:
+				s.acknowledge(d, branch, response)
+				return nil, fmt.Errorf("%w with %d", errDeclined, code)
+			}
+
+		case <-timeout.C:
+			s.cancelInvite(d, branch, responses)
+			return nil, errNoAnswer
+
+		case <-ctx.Done():
+			s.cancelInvite(d, branch, responses)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// answered completes an outgoing call on a 2xx: it acknowledges the
+// answer and registers the call session and its dialog
+func (s *SIPServer) answered(ex *exchange, d *dialog, response string) (*CallSession, error) {
+	d.confirm(response)
+	s.acknowledge(d, "", response)
+
+	answer := messageSDP(response)
+	var audio *mediaDescription
+	var formats audioFormats
+	ok := false
+	if answer != nil {
+		if audio = answer.audio(); audio != nil {
+			formats, ok = negotiateFormats(audio, ex.config.QoS.preferredCodecs(), ex.config.QoS.Redundancy)
+		}
+	}
+	if !ok {
+		s.sendRequest(d, "BYE", "", "", "")
+		return nil, errors.New("answer carried no usable SDP")
+	}
+
+	fmt.Printf("📞 %s answered\n", d.requestURI)
+	session := s.newCallSession(ex, d.callID, d.remoteAddr, answer.rtpAddr(audio, d.remoteAddr.IP))
+	session.dialog = d
+	session.setFormats(formats)
+	session.routed = true // The called phone doesn't dial
+	s.addDialog(d)
+	s.addCallSession(session)
+	d.adoptSessionTimer(response, DEFAULT_SESSION_EXPIRES)
+	s.spawn(func() { s.watchSessionTimer(session) })
+	return session, nil
+}
+
+// cancelInvite cancels an unanswered INVITE. If the phone answers anyway
+// before the CANCEL lands, the call is acknowledged and hung up.
+func (s *SIPServer) cancelInvite(d *dialog, branch string, responses chan string) {
+	cancelled := make(chan string, 8) // The 200 to the CANCEL itself, unused
+	defer s.awaitResponses(cancelled, branch, "CANCEL")()
+	s.sendRequest(d, "CANCEL", branch, "", "")
+
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case response := <-responses:
+			code := parseStatusCode(response)
+			if code < 200 {
+				continue
+			}
+			s.lingerInvite(d, branch, response)
+			if code < 300 {
+				d.confirm(response)
+				s.acknowledge(d, branch, response)
+				s.sendRequest(d, "BYE", "", "", "")
+			} else {
+				s.acknowledge(d, branch, response)
+			}
+			return
+		case <-deadline:
+			return
+		}
+	}
+}
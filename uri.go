@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// sipURI is a SIP or SIPS URI (RFC 3261 section 19.1), such as
+// "sip:1001@192.168.1.5:5060;transport=udp", taken apart
+type sipURI struct {
+	Scheme   string // "sip" or "sips"
+	User     string // Unescaped, so a dialed "%23" is "#"; "" if none
+	Password string
+	Host     string // Without the brackets of an IPv6 address
+	Port     int    // 0 if not given
+	Params   []uriParam
+	Headers  []uriParam // After the "?"
+}
+
+// uriParam is one parameter of a SIP URI; a flag such as lr has no value
+type uriParam struct {
+	Name  string
+	Value string
+}
+
+// parseSIPURI parses a SIP or SIPS URI, as found in a Request-URI or
+// between the <> of a From, To or Contact header
+func parseSIPURI(uri string) (sipURI, error) {
+	var u sipURI
+	scheme, rest, found := strings.Cut(strings.TrimSpace(uri), ":")
+	u.Scheme = strings.ToLower(scheme)
+	if !found || (u.Scheme != "sip" && u.Scheme != "sips") {
+		return sipURI{}, fmt.Errorf("%q isn't a SIP URI", uri)
+	}
+
+	rest, headers, _ := strings.Cut(rest, "?")
+	if at := strings.LastIndexByte(rest, '@'); at >= 0 {
+		userinfo := rest[:at]
+		rest = rest[at+1:]
+		user, password, _ := strings.Cut(userinfo, ":")
+		u.User = unescapeURIPart(user)
+		u.Password = unescapeURIPart(password)
+	}
+	hostport, params, _ := strings.Cut(rest, ";")
+
+	if strings.HasPrefix(hostport, "[") {
+		end := strings.IndexByte(hostport, ']')
+		if end < 0 {
+			return sipURI{}, fmt.Errorf("%q has an unclosed IPv6 address", uri)
+		}
+		u.Host, hostport = hostport[1:end], hostport[end+1:]
+		if hostport != "" && !strings.HasPrefix(hostport, ":") {
+			return sipURI{}, fmt.Errorf("%q has junk after its IPv6 address", uri)
+		}
+		hostport = strings.TrimPrefix(hostport, ":")
+	} else {
+		u.Host, hostport, _ = strings.Cut(hostport, ":")
+	}
+	if u.Host == "" {
+		return sipURI{}, fmt.Errorf("%q has no host", uri)
+	}
+	if hostport != "" {
+		port, err := strconv.Atoi(hostport)
+		if err != nil || port < 1 || port > 65535 {
+			return sipURI{}, fmt.Errorf("%q has a bad port", uri)
+		}
+		u.Port = port
+	}
+
+	u.Params = parseURIParams(params, ";")
+	u.Headers = parseURIParams(headers, "&")
+	return u, nil
+}
+
+// parseURIParams splits "name=value" pairs by sep, unescaping them
+func parseURIParams(s, sep string) []uriParam {
+	var params []uriParam
+	for _, param := range strings.Split(s, sep) {
+		if param == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(param, "=")
+		params = append(params, uriParam{Name: unescapeURIPart(name), Value: unescapeURIPart(value)})
+	}
+	return params
+}
+
+// unescapeURIPart undoes a URI's percent escapes, leaving a malformed one
+// as sent
+func unescapeURIPart(s string) string {
+	if unescaped, err := url.PathUnescape(s); err == nil {
+		return unescaped
+	}
+	return s
+}
+
+// Param is the value of a URI parameter, matched regardless of case, and
+// whether the URI has it at all
+func (u sipURI) Param(name string) (string, bool) {
+	for _, param := range u.Params {
+		if strings.EqualFold(param.Name, name) {
+			return param.Value, true
+		}
+	}
+	return "", false
+}
+
+// Address is the host and port the URI names, with the scheme's default
+// port if it gives none: 5060, or 5061 for SIPS
+func (u sipURI) Address() string {
+	port := u.Port
+	if port == 0 {
+		port = SIP_PORT
+		if u.Scheme == "sips" {
+			port = SIP_PORT + 1
+		}
+	}
+	return net.JoinHostPort(u.Host, strconv.Itoa(port))
+}
+
+// String puts the URI back together, escaping what needs it
+func (u sipURI) String() string {
+	var b strings.Builder
+	b.WriteString(u.Scheme + ":")
+	if u.User != "" {
+		b.WriteString(escapeURIUser(u.User))
+		if u.Password != "" {
+			b.WriteString(":" + url.PathEscape(u.Password))
+		}
+		b.WriteString("@")
+	}
+	b.WriteString(sipHost(u.Host))
+	if u.Port != 0 {
+		b.WriteString(":" + strconv.Itoa(u.Port))
+	}
+	for _, param := range u.Params {
+		b.WriteString(";" + param.Name)
+		if param.Value != "" {
+			b.WriteString("=" + param.Value)
+		}
+	}
+	sep := "?"
+	for _, header := range u.Headers {
+		b.WriteString(sep + escapeURIHeader(header.Name) + "=" + escapeURIHeader(header.Value))
+		sep = "&"
+	}
+	return b.String()
+}
+
+// escapeURIUser escapes the user part of a URI; digits, letters and the
+// characters a dialed number or a phone's user name use are left alone,
+// but "#" becomes "%23" (RFC 3261 section 25.1)
+func escapeURIUser(user string) string {
+	var b strings.Builder
+	for _, c := range []byte(user) {
+		if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.IndexByte("-_.!~*'()&=+$,;?/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// escapeURIHeader escapes a name or value among a URI's headers
+func escapeURIHeader(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// errNoURI is returned for a header with no SIP URI in it
+var errNoURI = errors.New("no SIP URI")
+
+// headerURI parses the URI of a name-addr header such as From, To or
+// Contact ("Alice" <sip:1001@host>;tag=x), or of a bare addr-spec
+// (sip:1001@host;tag=x, whose parameters are the header's)
+func headerURI(header string) (sipURI, error) {
+	if start := strings.IndexByte(header, '<'); start >= 0 {
+		if end := strings.IndexByte(header[start:], '>'); end > 0 {
+			return parseSIPURI(header[start+1 : start+end])
+		}
+	}
+	uri, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+	if !strings.HasPrefix(strings.ToLower(uri), "sip") {
+		return sipURI{}, errNoURI
+	}
+	return parseSIPURI(uri)
+}
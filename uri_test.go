@@ -0,0 +1,157 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSIPURI(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want sipURI
+	}{
+		{"sip:1001@192.168.1.5", sipURI{Scheme: "sip", User: "1001", Host: "192.168.1.5"}},
+		{"SIP:1001@192.168.1.5:5070", sipURI{Scheme: "sip", User: "1001", Host: "192.168.1.5", Port: 5070}},
+		{"sips:alice@example.com", sipURI{Scheme: "sips", User: "alice", Host: "example.com"}},
+		{"sip:example.com", sipURI{Scheme: "sip", Host: "example.com"}},
+		{"sip:alice:secret@example.com", sipURI{Scheme: "sip", User: "alice", Password: "secret", Host: "example.com"}},
+		{" sip:1001@host ", sipURI{Scheme: "sip", User: "1001", Host: "host"}},
+
+		// User parameters, such as a phone number's, stay in the user
+		{"sip:+15551234567;npdi;rn=+15550000000@gw.example.com;user=phone", sipURI{
+			Scheme: "sip", User: "+15551234567;npdi;rn=+15550000000", Host: "gw.example.com",
+			Params: []uriParam{{"user", "phone"}},
+		}},
+
+		// Escaped users are unescaped, and a malformed escape kept as sent
+		{"sip:%2A69@host", sipURI{Scheme: "sip", User: "*69", Host: "host"}},
+		{"sip:1%23@host", sipURI{Scheme: "sip", User: "1#", Host: "host"}},
+		{"sip:ali%20ce@host", sipURI{Scheme: "sip", User: "ali ce", Host: "host"}},
+		{"sip:100%zz@host", sipURI{Scheme: "sip", User: "100%zz", Host: "host"}},
+
+		// IPv6 hosts lose their brackets
+		{"sip:1001@[2001:db8::1]", sipURI{Scheme: "sip", User: "1001", Host: "2001:db8::1"}},
+		{"sip:1001@[2001:db8::1]:5080;transport=tcp", sipURI{
+			Scheme: "sip", User: "1001", Host: "2001:db8::1", Port: 5080,
+			Params: []uriParam{{"transport", "tcp"}},
+		}},
+		{"sip:[::1]", sipURI{Scheme: "sip", Host: "::1"}},
+
+		// Parameters and headers
+		{"sip:proxy.example.com;lr;transport=UDP", sipURI{
+			Scheme: "sip", Host: "proxy.example.com",
+			Params: []uriParam{{"lr", ""}, {"transport", "UDP"}},
+		}},
+		{"sip:1001@host?Subject=hello%20there&Priority=urgent", sipURI{
+			Scheme: "sip", User: "1001", Host: "host",
+			Headers: []uriParam{{"Subject", "hello there"}, {"Priority", "urgent"}},
+		}},
+	}
+	for _, test := range tests {
+		got, err := parseSIPURI(test.uri)
+		if err != nil {
+			t.Errorf("parseSIPURI(%q): %v", test.uri, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseSIPURI(%q) = %+v, want %+v", test.uri, got, test.want)
+		}
+	}
+}
+
+func TestParseSIPURIMalformed(t *testing.T) {
+	for _, uri := range []string{
+		"",
+		"1001@host",
+		"tel:+15551234567",
+		"tel:+1-555-123-4567;phone-context=example.com",
+		"http://example.com",
+		"sip:",
+		"sip:1001@",
+		"sip:1001@:5060",
+		"sip:1001@[2001:db8::1",
+		"sip:1001@[2001:db8::1]5060",
+		"sip:1001@host:port",
+		"sip:1001@host:0",
+		"sip:1001@host:65536",
+		"sip:1001@host:-1",
+	} {
+		if got, err := parseSIPURI(uri); err == nil {
+			t.Errorf("parseSIPURI(%q) = %+v, want an error", uri, got)
+		}
+	}
+}
+
+func TestSIPURIString(t *testing.T) {
+	tests := []struct {
+		uri  sipURI
+		want string
+	}{
+		{sipURI{Scheme: "sip", User: "1001", Host: "192.168.1.5", Port: 5060}, "sip:1001@192.168.1.5:5060"},
+		{sipURI{Scheme: "sips", Host: "example.com"}, "sips:example.com"},
+		{sipURI{Scheme: "sip", User: "*69#", Host: "host"}, "sip:*69%23@host"},
+		{sipURI{Scheme: "sip", User: "ali ce", Password: "p@ss", Host: "host"}, "sip:ali%20ce:p@ss@host"},
+		{sipURI{Scheme: "sip", User: "1001", Host: "2001:db8::1", Port: 5080}, "sip:1001@[2001:db8::1]:5080"},
+		{sipURI{Scheme: "sip", Host: "proxy", Params: []uriParam{{"lr", ""}, {"transport", "tcp"}}}, "sip:proxy;lr;transport=tcp"},
+		{sipURI{Scheme: "sip", Host: "host", Headers: []uriParam{{"Subject", "hello there"}, {"Priority", "urgent"}}}, "sip:host?Subject=hello%20there&Priority=urgent"},
+	}
+	for _, test := range tests {
+		if got := test.uri.String(); got != test.want {
+			t.Errorf("%+v.String() = %q, want %q", test.uri, got, test.want)
+		}
+	}
+
+	// What String writes parses back the same
+	for _, test := range tests {
+		got, err := parseSIPURI(test.want)
+		if err != nil || !reflect.DeepEqual(got, test.uri) {
+			t.Errorf("parseSIPURI(%q) = %+v, %v, want %+v", test.want, got, err, test.uri)
+		}
+	}
+}
+
+func TestSIPURIAddress(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"sip:1001@host", "host:5060"},
+		{"sips:1001@host", "host:5061"},
+		{"sip:1001@host:5080", "host:5080"},
+		{"sip:1001@[2001:db8::1]", "[2001:db8::1]:5060"},
+	}
+	for _, test := range tests {
+		u, err := parseSIPURI(test.uri)
+		if err != nil {
+			t.Fatalf("parseSIPURI(%q): %v", test.uri, err)
+		}
+		if got := u.Address(); got != test.want {
+			t.Errorf("parseSIPURI(%q).Address() = %q, want %q", test.uri, got, test.want)
+		}
+	}
+}
+
+func TestHeaderURI(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string // The URI's user@host, or "" for none
+	}{
+		{`"Alice" <sip:1001@host>;tag=abc`, "1001@host"},
+		{`<sips:bob@example.com;transport=tls>`, "bob@example.com"},
+		{`sip:1001@host;tag=abc`, "1001@host"},
+		{`<sip:1001@[2001:db8::1]:5060>`, "1001@2001:db8::1"},
+		{`<tel:+15551234567>`, ""},
+		{`tel:+15551234567`, ""},
+		{`"Alice"`, ""},
+	}
+	for _, test := range tests {
+		u, err := headerURI(test.header)
+		got := ""
+		if err == nil {
+			got = u.User + "@" + u.Host
+		}
+		if got != test.want {
+			t.Errorf("headerURI(%q) = %q (%v), want %q", test.header, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"slices"
+)
+
+const (
+	// VAD_MIN_LEVEL is the quietest block, as RMS, that can be speech:
+	// -46 dBFS, well under a caller talking at a normal level
+	VAD_MIN_LEVEL = 0.005
+
+	// VAD_SNR is how much louder than the line's background noise a
+	// block must be to be speech, 10 dB
+	VAD_SNR = 3.2
+
+	// The background noise is followed down quickly, so that a pause in
+	// speech finds it, and up slowly, over about five seconds, so that
+	// talking doesn't raise it but a noisy line soon does
+	VAD_NOISE_FALL  = 0.2
+	VAD_NOISE_RISE  = 0.002
+	VAD_NOISE_START = 0.001 // -60 dBFS, before anything has been heard
+
+	// VAD_ONSET is how many blocks of speech in a row start the caller
+	// talking, 50ms, so that a click or a pop doesn't
+	VAD_ONSET = 5
+
+	// VAD_HANGOVER is how many blocks without speech stop them, 400ms,
+	// so that the gaps between words don't
+	VAD_HANGOVER = 40
+)
+
+// voiceDetector tells when a caller is talking from the level of their
+// audio, against the line's background noise as it has been since the
+// call began. Talking starts after VAD_ONSET blocks of speech and stops
+// after VAD_HANGOVER blocks of anything else.
+type voiceDetector struct {
+	noise   float64 // Level of the background noise
+	talking bool
+	heard   int // Blocks of speech in a row
+	quiet   int // Blocks since speech was last heard
+}
+
+// newVoiceDetector creates a detector for a call that hasn't yet been
+// heard
+func newVoiceDetector() *voiceDetector {
+	return &voiceDetector{noise: VAD_NOISE_START}
+}
+
+// Block looks at the next block of received audio, reporting whether the
+// caller started or stopped talking with it
+func (d *voiceDetector) Block(block []float64) (changed bool) {
+	level := blockLevel(block)
+	speech := level >= max(VAD_MIN_LEVEL, d.noise*VAD_SNR)
+	if level < d.noise {
+		d.noise += (level - d.noise) * VAD_NOISE_FALL
+	} else {
+		d.noise += (level - d.noise) * VAD_NOISE_RISE
+	}
+
+	if speech {
+		d.heard++
+		d.quiet = 0
+	} else {
+		d.heard = 0
+		d.quiet++
+	}
+	switch {
+	case !d.talking && d.heard >= VAD_ONSET:
+		d.talking = true
+		return true
+	case d.talking && d.quiet >= VAD_HANGOVER:
+		d.talking = false
+		return true
+	}
+	return false
+}
+
+// detectVoice follows whether the caller is talking, for prompts that
+// stop when they do and recordings that leave out silence
+func (session *CallSession) detectVoice() {
+	detector := newVoiceDetector()
+	session.tones.Watch(func(block []float64) {
+		if detector.Block(block) {
+			session.setTalking(detector.talking)
+		}
+	})
+}
+
+// setTalking notes that the caller started or stopped talking and tells
+// whatever is watching
+func (session *CallSession) setTalking(talking bool) {
+	session.talking.Store(talking)
+
+	session.voiceMu.Lock()
+	defer session.voiceMu.Unlock()
+	for _, watcher := range session.voiceWatchers {
+		select {
+		case watcher <- talking:
+		default:
+		}
+	}
+}
+
+// watchVoice sends true each time the caller starts talking, and false
+// each time they stop, to the returned channel until release is called.
+// Changes that come faster than they're read are dropped.
+func (session *CallSession) watchVoice() (talking <-chan bool, release func()) {
+	ch := make(chan bool, 4)
+	session.voiceMu.Lock()
+	session.voiceWatchers = append(session.voiceWatchers, ch)
+	session.voiceMu.Unlock()
+
+	return ch, func() {
+		session.voiceMu.Lock()
+		defer session.voiceMu.Unlock()
+		session.voiceWatchers = slices.DeleteFunc(session.voiceWatchers, func(w chan bool) bool { return w == ch })
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// WAV format codes
+const (
+	WAV_FORMAT_PCM        = 1
+	WAV_FORMAT_FLOAT      = 3
+	WAV_FORMAT_ALAW       = 6
+	WAV_FORMAT_ULAW       = 7
+	WAV_FORMAT_EXTENSIBLE = 0xFFFE
+
+	// WAV_HEADER_SIZE is the size of the header wavWriter writes: the RIFF
+	// header, a 16-byte "fmt " chunk and the "data" chunk's header
+	WAV_HEADER_SIZE = 44
+)
+
+// wavFormat is the decoded "fmt " chunk of a WAV file
+type wavFormat struct {
+	Format        uint16
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+}
+
+// loadWAV decodes a WAV file into 8kHz mono samples
+func loadWAV(path string) ([]int16, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audio file: %v", err)
+	}
+	defer file.Close()
+
+	samples, err := decodeWAV(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return samples, nil
+}
+
+// loadWidebandWAV decodes a WAV file into 8kHz mono samples and, if it was
+// recorded at a higher rate, 16kHz ones for wideband calls as well
+func loadWidebandWAV(path string) (samples, wide []int16, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open audio file: %v", err)
+	}
+	defer file.Close()
+
+	mono, rate, err := readWAV(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if rate > SAMPLE_RATE {
+		wide = resample(mono, rate, WIDE_SAMPLE_RATE)
+	}
+	return resample(mono, rate, SAMPLE_RATE), wide, nil
+}
+
+// decodeWAV reads a RIFF/WAVE stream in PCM (8/16/24/32-bit), float, A-law
+// or μ-law format with any channel count and sample rate, and converts it
+// to the 8kHz mono audio the phone line carries
+func decodeWAV(r io.Reader) ([]int16, error) {
+	mono, rate, err := readWAV(r)
+	if err != nil {
+		return nil, err
+	}
+	return resample(mono, rate, SAMPLE_RATE), nil
+}
+
+// readWAV reads a RIFF/WAVE stream as decodeWAV does, returning its audio
+// mixed down to mono at its own sample rate
+func readWAV(r io.Reader) ([]float64, int, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return nil, 0, fmt.Errorf("not a WAV file: %v", err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, 0, fmt.Errorf("not a WAV file")
+	}
+
+	var format *wavFormat
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, 0, fmt.Errorf("no data chunk found")
+		}
+		id := string(header[0:4])
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		switch id {
+		case "fmt ":
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return nil, 0, fmt.Errorf("truncated fmt chunk: %v", err)
+			}
+			f, err := parseWAVFormat(chunk)
+			if err != nil {
+				return nil, 0, err
+			}
+			format = f
+		case "data":
+			if format == nil {
+				return nil, 0, fmt.Errorf("data chunk before fmt chunk")
+			}
+			data := make([]byte, size)
+			n, err := io.ReadFull(r, data)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return nil, 0, fmt.Errorf("failed to read audio data: %v", err)
+			}
+			mono, err := convertWAV(format, data[:n])
+			return mono, format.SampleRate, err
+		default:
+			if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+				return nil, 0, fmt.Errorf("no data chunk found")
+			}
+			continue
+		}
+
+		if size%2 == 1 { // Chunks are word aligned
+			io.CopyN(io.Discard, r, 1)
+		}
+	}
+}
+
+// parseWAVFormat validates a fmt chunk
+func parseWAVFormat(chunk []byte) (*wavFormat, error) {
+	if len(chunk) < 16 {
+		return nil, fmt.Errorf("fmt chunk too short")
+	}
+
+	f := &wavFormat{
+		Format:        binary.LittleEndian.Uint16(chunk[0:2]),
+		Channels:      int(binary.LittleEndian.Uint16(chunk[2:4])),
+		SampleRate:    int(binary.LittleEndian.Uint32(chunk[4:8])),
+		BitsPerSample: int(binary.LittleEndian.Uint16(chunk[14:16])),
+	}
+	if f.Format == WAV_FORMAT_EXTENSIBLE && len(chunk) >= 26 {
+		f.Format = binary.LittleEndian.Uint16(chunk[24:26]) // Sub-format GUID
+	}
+
+	if f.Channels < 1 || f.SampleRate < 1 {
+		return nil, fmt.Errorf("invalid channel count or sample rate")
+	}
+
+	switch {
+	case f.Format == WAV_FORMAT_PCM && (f.BitsPerSample == 8 || f.BitsPerSample == 16 || f.BitsPerSample == 24 || f.BitsPerSample == 32):
+	case f.Format == WAV_FORMAT_FLOAT && f.BitsPerSample == 32:
+	case (f.Format == WAV_FORMAT_ALAW || f.Format == WAV_FORMAT_ULAW) && f.BitsPerSample == 8:
+	default:
+		return nil, fmt.Errorf("unsupported WAV encoding (format %d, %d bits)", f.Format, f.BitsPerSample)
+	}
+	return f, nil
+}
+
+// convertWAV decodes raw sample data and mixes it down to mono
+func convertWAV(f *wavFormat, data []byte) ([]float64, error) {
+	bytesPerSample := f.BitsPerSample / 8
+	frameSize := bytesPerSample * f.Channels
+	frames := len(data) / frameSize
+	if frames == 0 {
+		return nil, fmt.Errorf("no audio samples")
+	}
+
+	mono := make([]float64, frames)
+	for i := 0; i < frames; i++ {
+		sum := 0.0
+		for ch := 0; ch < f.Channels; ch++ {
+			offset := i*frameSize + ch*bytesPerSample
+			sum += decodeWAVSample(f, data[offset:offset+bytesPerSample])
+		}
+		mono[i] = sum / float64(f.Channels)
+	}
+
+	return mono, nil
+}
+
+// decodeWAVSample converts one sample to the range [-1, 1)
+func decodeWAVSample(f *wavFormat, b []byte) float64 {
+	switch f.Format {
+	case WAV_FORMAT_ULAW:
+		return float64(ulawToLinear(b[0])) / 32768
+	case WAV_FORMAT_ALAW:
+		return float64(alawToLinear(b[0])) / 32768
+	case WAV_FORMAT_FLOAT:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	}
+
+	switch f.BitsPerSample {
+	case 8:
+		return (float64(b[0]) - 128) / 128 // 8-bit PCM is unsigned
+	case 16:
+		return float64(int16(binary.LittleEndian.Uint16(b))) / 32768
+	case 24:
+		v := int32(b[0]) | int32(b[1])<<8 | int32(int8(b[2]))<<16
+		return float64(v) / (1 << 23)
+	default:
+		return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31)
+	}
+}
+
+// resample converts audio at rate to outRate. When downsampling, each
+// output sample averages the input samples it covers, a crude low-pass
+// filter that keeps music from aliasing badly; upsampling interpolates
+// linearly.
+func resample(in []float64, rate, outRate int) []int16 {
+	ratio := float64(rate) / float64(outRate)
+	count := int(float64(len(in)) / ratio)
+	out := make([]int16, count)
+
+	for j := range out {
+		var value float64
+		if ratio > 1 {
+			start := int(float64(j) * ratio)
+			end := min(int(float64(j+1)*ratio), len(in))
+			sum := 0.0
+			for k := start; k < end; k++ {
+				sum += in[k]
+			}
+			value = sum / float64(max(end-start, 1))
+		} else {
+			pos := float64(j) * ratio
+			k := int(pos)
+			frac := pos - float64(k)
+			next := min(k+1, len(in)-1)
+			value = in[k]*(1-frac) + in[next]*frac
+		}
+		out[j] = clampSample(value * 32767)
+	}
+	return out
+}
+
+// clampSample converts to int16, saturating instead of wrapping
+func clampSample(v float64) int16 {
+	switch {
+	case v > math.MaxInt16:
+		return math.MaxInt16
+	case v < math.MinInt16:
+		return math.MinInt16
+	default:
+		return int16(v)
+	}
+}
+
+// wavTags is the metadata in a WAV file's LIST/INFO chunk, and its cue
+// points with their labels
+type wavTags struct {
+	Title  string
+	Artist string
+	Album  string
+	Track  int // 0 if not tagged
+	Cues   []wavCue
+}
+
+// wavCue is a marked position in a WAV file, such as a chapter start
+type wavCue struct {
+	Offset int // In samples at 8kHz, as loadWAV returns them
+	Label  string
+}
+
+// readWAVTags reads a WAV file's tags and cue points without decoding its
+// audio. A file without tags returns empty ones.
+func readWAVTags(path string) (tags wavTags, err error) {
+	rate := 0
+	labels := make(map[uint32]string)
+	var cueIDs []uint32
+	defer func() {
+		if rate == 0 {
+			tags.Cues = nil
+			return
+		}
+		for i := range tags.Cues {
+			tags.Cues[i].Offset = int(int64(tags.Cues[i].Offset) * SAMPLE_RATE / int64(rate))
+			tags.Cues[i].Label = labels[cueIDs[i]]
+		}
+		slices.SortStableFunc(tags.Cues, func(a, b wavCue) int { return a.Offset - b.Offset })
+	}()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return tags, fmt.Errorf("failed to open audio file: %v", err)
+	}
+	defer file.Close()
+
+	var riff [12]byte
+	if _, err := io.ReadFull(file, riff[:]); err != nil || string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return tags, fmt.Errorf("%s: not a WAV file", path)
+	}
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(file, header[:]); err != nil {
+			return tags, nil // End of file; the tags, if any, were seen
+		}
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		id := string(header[0:4])
+		if id != "LIST" && id != "fmt " && id != "cue " || size < 4 || size > 1<<20 {
+			// Skip other chunks, the audio data included
+			if _, err := file.Seek(size+size%2, io.SeekCurrent); err != nil {
+				return tags, nil
+			}
+			continue
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(file, chunk); err != nil {
+			return tags, nil
+		}
+		if size%2 == 1 {
+			file.Seek(1, io.SeekCurrent)
+		}
+		switch {
+		case id == "fmt " && size >= 8:
+			rate = int(binary.LittleEndian.Uint32(chunk[4:8]))
+		case id == "cue ":
+			// A count, then 24 bytes per point: the ID and the sample
+			// offset are what matter
+			for point := chunk[4:]; len(point) >= 24; point = point[24:] {
+				cueIDs = append(cueIDs, binary.LittleEndian.Uint32(point[0:4]))
+				tags.Cues = append(tags.Cues, wavCue{Offset: int(binary.LittleEndian.Uint32(point[20:24]))})
+			}
+		case string(chunk[0:4]) == "INFO":
+			parseWAVInfo(chunk[4:], &tags)
+		case string(chunk[0:4]) == "adtl":
+			parseWAVLabels(chunk[4:], labels)
+		}
+	}
+}
+
+// parseWAVLabels reads the cue point labels of an associated data list
+func parseWAVLabels(adtl []byte, labels map[uint32]string) {
+	for len(adtl) >= 8 {
+		size := int(binary.LittleEndian.Uint32(adtl[4:8]))
+		if size > len(adtl)-8 {
+			return
+		}
+		if string(adtl[0:4]) == "labl" && size >= 4 {
+			id := binary.LittleEndian.Uint32(adtl[8:12])
+			labels[id] = strings.TrimSpace(strings.TrimRight(string(adtl[12:8+size]), "\x00"))
+		}
+		adtl = adtl[min(8+size+size%2, len(adtl)):]
+	}
+}
+
+// parseWAVInfo reads the sub-chunks of an INFO list
+func parseWAVInfo(info []byte, tags *wavTags) {
+	for len(info) >= 8 {
+		id := string(info[0:4])
+		size := int(binary.LittleEndian.Uint32(info[4:8]))
+		if size > len(info)-8 {
+			return
+		}
+		value := strings.TrimSpace(strings.TrimRight(string(info[8:8+size]), "\x00"))
+
+		switch id {
+		case "INAM":
+			tags.Title = value
+		case "IART":
+			tags.Artist = value
+		case "IPRD":
+			tags.Album = value
+		case "ITRK", "IPRT": // Taggers disagree on which holds the track number
+			number, _, _ := strings.Cut(value, "/") // "3/12"
+			if track, err := strconv.Atoi(number); err == nil {
+				tags.Track = track
+			}
+		}
+		info = info[min(8+size+size%2, len(info)):]
+	}
+}
+
+// wavWriter writes 8kHz mono 16-bit PCM to a WAV file. The header's sizes
+// are filled in when it is closed.
+type wavWriter struct {
+	file    *os.File
+	w       *bufio.Writer
+	scratch []byte
+	samples int
+}
+
+// createWAV creates a WAV file at path, which must not already exist
+func createWAV(path string) (*wavWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audio file: %v", err)
+	}
+	w := &wavWriter{file: file, w: bufio.NewWriterSize(file, 32*1024)}
+	if err := w.writeHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(WAV_HEADER_SIZE, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create audio file: %v", err)
+	}
+	return w, nil
+}
+
+// writeHeader writes the header for the samples written so far
+func (w *wavWriter) writeHeader() error {
+	data := 2 * w.samples
+	header := make([]byte, 0, WAV_HEADER_SIZE)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(WAV_HEADER_SIZE-8+data))
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	header = binary.LittleEndian.AppendUint16(header, WAV_FORMAT_PCM)
+	header = binary.LittleEndian.AppendUint16(header, 1) // Mono
+	header = binary.LittleEndian.AppendUint32(header, SAMPLE_RATE)
+	header = binary.LittleEndian.AppendUint32(header, 2*SAMPLE_RATE) // Bytes a second
+	header = binary.LittleEndian.AppendUint16(header, 2)             // Bytes a sample
+	header = binary.LittleEndian.AppendUint16(header, 16)            // Bits a sample
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(data))
+	if _, err := w.file.WriteAt(header, 0); err != nil {
+		return fmt.Errorf("failed to write WAV header: %v", err)
+	}
+	return nil
+}
+
+// Write appends samples to the file
+func (w *wavWriter) Write(pcm []int16) error {
+	w.scratch = w.scratch[:0]
+	for _, sample := range pcm {
+		w.scratch = binary.LittleEndian.AppendUint16(w.scratch, uint16(sample))
+	}
+	if _, err := w.w.Write(w.scratch); err != nil {
+		return fmt.Errorf("failed to write audio: %v", err)
+	}
+	w.samples += len(pcm)
+	return nil
+}
+
+// Close flushes the samples written, fills in the header and closes the
+// file
+func (w *wavWriter) Close() error {
+	err := w.w.Flush()
+	if err == nil {
+		err = w.writeHeader()
+	}
+	if closeErr := w.file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close audio file: %v", closeErr)
+	}
+	return err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Browsers send their media the WebRTC way: ICE (RFC 8445) finds a path
+// to us, checking it with STUN, and DTLS-SRTP (RFC 5764) keys the audio.
+// We are an ICE lite agent (section 2.5): with an address of our own we
+// never check paths ourselves, only answer the browser's checks, and
+// offer it two candidates, the call's RTP port at our address on the
+// network and at the one a STUN server sees from outside. All of it shares
+// the call's RTP port.
+
+const (
+	// ICE_UFRAG_BYTES and ICE_PWD_BYTES are random bytes of our ICE
+	// credentials, base64 characters being ICE's; 24 characters of password
+	// are more than the 22 it asks for
+	ICE_UFRAG_BYTES = 6
+	ICE_PWD_BYTES   = 18
+
+	// Type preferences of our candidates (RFC 8445 section 5.1.2.2)
+	ICE_HOST_PREFERENCE      = 126
+	ICE_REFLEXIVE_PREFERENCE = 100
+
+	// STUN_REFRESH_INTERVAL is how often the STUN server is asked again,
+	// in case our address outside the NAT changes
+	STUN_REFRESH_INTERVAL = 30 * time.Second
+)
+
+// webrtcMedia is how a browser's audio reaches us and is keyed: our ICE
+// credentials, the browser's username fragment, and the fingerprint of
+// the certificate it will shake hands with. Being ICE lite, we never need
+// its password.
+type webrtcMedia struct {
+	localUfrag, localPwd string
+	remoteUfrag          string
+	fingerprint          string // e.g. "sha-256 AB:CD:..."
+}
+
+// negotiateWebRTC reads the ICE and DTLS attributes of a stream from a
+// browser, with fresh ICE credentials of our own; nil if it isn't one,
+// when the stream is plain RTP or keyed with SDES. It reports false for
+// a stream whose profile needs DTLS (UDP/TLS/RTP/SAVPF) without what we
+// need to connect: credentials, a fingerprint in a hash we know, and an
+// offer to be the DTLS client.
+func negotiateWebRTC(sd *sessionDescription, m *mediaDescription) (*webrtcMedia, bool) {
+	if !strings.HasPrefix(m.Proto, "UDP/TLS/") {
+		return nil, true
+	}
+	w := &webrtcMedia{
+		remoteUfrag: sd.attribute(m, "ice-ufrag"),
+		fingerprint: sd.attribute(m, "fingerprint"),
+	}
+	hash, _, _ := strings.Cut(w.fingerprint, " ")
+	_, known := fingerprintHashes[strings.ToLower(hash)]
+	setup := cmp.Or(sd.attribute(m, "setup"), "active") // RFC 4145 section 4
+	if w.remoteUfrag == "" || sd.attribute(m, "ice-pwd") == "" || !known || (setup != "actpass" && setup != "active") {
+		return nil, false
+	}
+	w.localUfrag, w.localPwd = randomICE(ICE_UFRAG_BYTES), randomICE(ICE_PWD_BYTES)
+	return w, true
+}
+
+// randomICE is a random ICE credential made of n bytes
+func randomICE(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// answerWebRTC adds to our answer's audio stream local, answering a
+// browser's offered stream m, what it needs to reach and key it: ICE lite
+// and the BUNDLE group for the whole session, and our credentials,
+// certificate fingerprint and candidates for the call's RTP port. The
+// browser is the DTLS client.
+func (s *SIPServer) answerWebRTC(sd *sessionDescription, offer *sessionDescription, local *mediaDescription, m *mediaDescription, w *webrtcMedia, remote *net.UDPAddr, port int) {
+	identity, err := ourDTLSIdentity()
+	if err != nil {
+		log.Printf("❌ %v", err)
+		return
+	}
+	sd.Attributes = append(sd.Attributes, "ice-lite")
+	if mid := m.attribute("mid"); mid != "" && slices.ContainsFunc(offer.Attributes, func(a string) bool {
+		group, ok := strings.CutPrefix(a, "group:BUNDLE ")
+		return ok && slices.Contains(strings.Fields(group), mid)
+	}) {
+		sd.Attributes = append(sd.Attributes, "group:BUNDLE "+mid) // The other streams are rejected
+	}
+
+	local.Proto = m.Proto
+	local.Attributes = append(local.Attributes,
+		"ice-ufrag:"+w.localUfrag,
+		"ice-pwd:"+w.localPwd,
+		"fingerprint:"+identity.fingerprint,
+		"setup:passive")
+	local.Attributes = append(local.Attributes, s.iceCandidates(remote, port)...)
+}
+
+// iceCandidates are our candidate attributes for remote: an RTP port on
+// the address we give it, and on the address a STUN server sees if we
+// know it. The port outside is taken to be the same, as it is with the
+// RTP range forwarded or a NAT that keeps port numbers.
+func (s *SIPServer) iceCandidates(remote *net.UDPAddr, port int) []string {
+	host := s.localIPFor(remote)
+	candidates := []string{fmt.Sprintf("candidate:1 1 udp %d %s %d typ host", icePriority(ICE_HOST_PREFERENCE), host, port)}
+	if addr := s.reflexive.Load(); addr != nil {
+		candidates = append(candidates, fmt.Sprintf("candidate:2 1 udp %d %s %d typ srflx raddr %s rport %d",
+			icePriority(ICE_REFLEXIVE_PREFERENCE), addr.IP, port, host, port))
+	}
+	return append(candidates, "end-of-candidates")
+}
+
+// icePriority is the priority of our RTP candidate of a type preference
+// (RFC 8445 section 5.1.2.1)
+func icePriority(typePreference int) int {
+	return typePreference<<24 | 65535<<8 | 255
+}
+
+// handleSTUN answers a browser's ICE check of a path to its call, signed
+// with our password for the call. Media goes by the path the browser
+// nominates, or until it does, by the first it checks.
+func (s *SIPServer) handleSTUN(session *CallSession, packet []byte, from *net.UDPAddr) {
+	m, ok := parseSTUN(packet)
+	w := session.formats.webrtc
+	if !ok || m.kind != STUN_BINDING_REQUEST || w == nil {
+		return
+	}
+	local, remote, _ := strings.Cut(string(m.attributes[STUN_ATTR_USERNAME]), ":")
+	key := []byte(w.localPwd)
+	if local != w.localUfrag || remote != w.remoteUfrag || !m.authentic(key) {
+		return
+	}
+	session.iceChecked.Store(from.String(), true)
+	response := appendSTUNIntegrity(appendXORMappedAddress(newSTUNMessage(STUN_BINDING_SUCCESS, m.transaction), from), key)
+	conn := session.media().conn
+	conn.WriteToUDP(response, from)
+	captureDatagram(conn, from.AddrPort(), response, true)
+
+	_, nominated := m.attributes[STUN_ATTR_USE_CANDIDATE]
+	if previous := session.RemoteRTPAddr(); previous == nil || (nominated && previous.String() != from.String()) {
+		fmt.Printf("🧊 Media for Call-ID %s goes by %s\n", session.CallID, from)
+		session.remoteRTPAddr.Store(from)
+	}
+}
+
+// handleDTLS passes a datagram to the DTLS handshake of a browser's call,
+// starting one for the first; the call's audio is encrypted with the keys
+// it agrees. Only datagrams from an address that has passed an ICE
+// connectivity check are taken, so no one else can start or disturb the
+// handshake.
+func (s *SIPServer) handleDTLS(session *CallSession, datagram []byte, from *net.UDPAddr) {
+	if session.formats.webrtc == nil {
+		return
+	}
+	if _, checked := session.iceChecked.Load(from.String()); !checked {
+		return
+	}
+	if session.dtls == nil {
+		identity, err := ourDTLSIdentity()
+		if err != nil {
+			log.Printf("❌ %v", err)
+			return
+		}
+		send := func(datagram []byte) {
+			conn := session.media().conn
+			conn.WriteToUDP(datagram, from)
+			captureDatagram(conn, from.AddrPort(), datagram, true)
+		}
+		session.dtls = newDTLSServer(identity, session.formats.webrtc.fingerprint, send, func(keys *srtpKeys) {
+			fmt.Printf("🔒 Audio of call %s encrypted with DTLS-SRTP (%s)\n", session.CallID, keys.suite.name)
+			session.useKeys(keys)
+		})
+	}
+	if err := session.dtls.handle(datagram); err != nil {
+		log.Printf("❌ DTLS handshake for call %s failed: %v", session.CallID, err)
+	}
+}
+
+// gatherReflexive asks a STUN server what address we have outside the
+// NAT, again every STUN_REFRESH_INTERVAL until the server closes, from a
+// socket of its own
+func (s *SIPServer) gatherReflexive(server string) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Printf("❌ Failed to open socket for STUN: %v", err)
+		return
+	}
+	stop := context.AfterFunc(s.ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	buffer := make([]byte, 1500)
+	for s.ctx.Err() == nil {
+		addr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			log.Printf("⚠️  Failed to resolve STUN server %s: %v", server, err)
+		}
+		transaction := newSTUNTransaction()
+		if addr != nil {
+			conn.WriteToUDP(newSTUNMessage(STUN_BINDING_REQUEST, transaction), addr)
+		}
+
+		// Wait out the interval for the answer
+		conn.SetReadDeadline(time.Now().Add(STUN_REFRESH_INTERVAL))
+		for {
+			n, _, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				break
+			}
+			m, ok := parseSTUN(buffer[:n])
+			if !ok || m.kind != STUN_BINDING_SUCCESS || m.transaction != transaction {
+				continue
+			}
+			if mapped := m.mappedAddress(); mapped != nil {
+				if previous := s.reflexive.Swap(mapped); previous == nil || !previous.IP.Equal(mapped.IP) {
+					fmt.Printf("🧭 Seen from outside the NAT as %s\n", mapped.IP)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// WS_GUID is appended to a client's key to prove the handshake was
+	// understood (RFC 6455 section 1.3)
+	WS_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// WS_PROTOCOL is the subprotocol browsers ask for to speak SIP
+	// (RFC 7118)
+	WS_PROTOCOL = "sip"
+
+	// WebSocket frame opcodes
+	WS_OP_CONTINUATION = 0x0
+	WS_OP_TEXT         = 0x1
+	WS_OP_BINARY       = 0x2
+	WS_OP_CLOSE        = 0x8
+	WS_OP_PING         = 0x9
+	WS_OP_PONG         = 0xA
+)
+
+// ListenWebSocket accepts SIP over WebSocket (RFC 7118) from browser
+// softphones, over TLS (wss:) if asked. They register and call like any
+// other phone.
+func (s *SIPServer) ListenWebSocket(cfg WebSocketConfig) error {
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen for WebSocket clients: %v", err)
+	}
+	transport, scheme := "WS", "ws"
+	if cfg.TLS {
+		tlsConfig, err := loadTLSConfig(s.config)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+		transport, scheme = "WSS", "wss"
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.upgradeWebSocket(w, r, transport, cfg.AllowedOrigins)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.connMu.Lock()
+	s.wsServer = server
+	s.wsPort = listener.Addr().(*net.TCPAddr).Port
+	s.connMu.Unlock()
+
+	fmt.Printf("🕸️  Listening for SIP over WebSocket on %s://%s\n", scheme, listener.Addr())
+	if cfg.STUNServer != "" {
+		s.spawn(func() { s.gatherReflexive(cfg.STUNServer) })
+	}
+	s.spawn(func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("❌ WebSocket listener stopped: %v", err)
+		}
+	})
+	return nil
+}
+
+// allowedOrigin reports whether a page at origin may connect to the
+// listener at host: one of allowed if any are given, else a page from the
+// same host. Clients other than browsers send no Origin and are let in,
+// as they can't be made to connect by someone else's page.
+func allowedOrigin(origin, host string, allowed []string) bool {
+	if origin == "" {
+		return true
+	}
+	if len(allowed) > 0 {
+		for _, o := range allowed {
+			if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+				return true
+			}
+		}
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.EqualFold(u.Hostname(), strings.Trim(host, "[]"))
+}
+
+// upgradeWebSocket completes a browser's WebSocket handshake for the sip
+// subprotocol and serves SIP over the connection. Browsers let any page
+// open a WebSocket anywhere, so one from a page that isn't allowed is
+// refused, lest any site a user visits register or call through us.
+func (s *SIPServer) upgradeWebSocket(w http.ResponseWriter, r *http.Request, transport string, allowedOrigins []string) {
+	if origin := r.Header.Get("Origin"); !allowedOrigin(origin, r.Host, allowedOrigins) {
+		log.Printf("🚫 Refusing WebSocket from %s: origin %q isn't allowed", r.RemoteAddr, origin)
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "SIP over WebSocket only", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusBadRequest)
+		return
+	}
+	if !headerHasToken(r.Header, "Sec-WebSocket-Protocol", WS_PROTOCOL) {
+		http.Error(w, "the sip subprotocol is required", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be upgraded", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("❌ Failed to upgrade WebSocket from %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	digest := sha1.Sum([]byte(key + WS_GUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n"+
+		"Sec-WebSocket-Protocol: %s\r\n"+
+		"\r\n", base64.StdEncoding.EncodeToString(digest[:]), WS_PROTOCOL)
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{}) // Lift the HTTP server's
+
+	fmt.Printf("🕸️  WebSocket client connected from %s\n", conn.RemoteAddr())
+	c := &streamConn{conn: conn, transport: transport}
+	s.spawn(func() {
+		s.serveStream(c, func() (string, error) { return c.readWebSocket(rw.Reader) })
+	})
+}
+
+// headerHasToken reports whether a comma-separated HTTP header holds
+// token, ignoring case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isWebSocket reports whether messages on the connection go in
+// WebSocket frames
+func (c *streamConn) isWebSocket() bool {
+	return c.transport == "WS" || c.transport == "WSS"
+}
+
+// readWebSocket reads the next SIP message from a WebSocket, one to a
+// message (RFC 7118), joining fragments and answering pings on the way. A
+// close frame is answered and ends the connection with io.EOF.
+func (c *streamConn) readWebSocket(reader *bufio.Reader) (string, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := readWebSocketFrame(reader, SIP_TCP_MAX_MESSAGE-len(message))
+		if err != nil {
+			return "", err
+		}
+
+		switch opcode {
+		case WS_OP_PING:
+			if err := c.writeFrame(WS_OP_PONG, payload); err != nil {
+				return "", err
+			}
+			continue
+		case WS_OP_PONG:
+			continue
+		case WS_OP_CLOSE:
+			c.writeFrame(WS_OP_CLOSE, payload)
+			return "", io.EOF
+		case WS_OP_TEXT, WS_OP_BINARY, WS_OP_CONTINUATION:
+			message = append(message, payload...)
+		default:
+			return "", fmt.Errorf("unknown WebSocket opcode %#x", opcode)
+		}
+		if fin {
+			return string(message), nil
+		}
+	}
+}
+
+// readWebSocketFrame reads one WebSocket frame from a client, unmasking
+// its payload. Clients must mask their frames; a payload over limit bytes
+// is refused.
+func readWebSocketFrame(reader *bufio.Reader, limit int) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("unmasked WebSocket frame from client")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > uint64(limit) {
+		return false, 0, nil, errMessageTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame sends one unfragmented, unmasked frame, as servers do
+func (c *streamConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import "math"
+
+const (
+	// WIDE_SAMPLE_RATE is the rate wideband codecs such as G.722 carry
+	WIDE_SAMPLE_RATE = 16000
+
+	// HALFBAND_TAPS is the number of taps on each side of the half-band
+	// filter that converts between 8kHz and 16kHz; each conversion delays
+	// the audio by this many 8kHz samples
+	HALFBAND_TAPS = 8
+)
+
+// WidebandSource is a MediaSource that can also play at 16kHz, for calls
+// in a wideband codec. Wideband reports whether the next frame can be read
+// with ReadWideFrame, which fills twice as many samples as ReadFrame would;
+// reading either way moves playback on by the same time.
+type WidebandSource interface {
+	MediaSource
+	Wideband() bool
+	ReadWideFrame(samples []int16) bool
+}
+
+// halfbandCoefficients are the odd taps of a Hann-windowed half-band
+// low-pass filter, nearest the centre first, scaled so the pairs sum to 1.
+// The even taps besides the centre are zero.
+var halfbandCoefficients = func() (c [HALFBAND_TAPS]float64) {
+	sum := 0.0
+	for k := range c {
+		m := float64(2*k + 1)
+		window := 0.5 + 0.5*math.Cos(math.Pi*m/(2*HALFBAND_TAPS))
+		c[k] = math.Sin(math.Pi*m/2) / (math.Pi * m / 2) * window
+		sum += 2 * c[k]
+	}
+	for k := range c {
+		c[k] /= sum
+	}
+	return c
+}()
+
+// upsampler converts 8kHz audio to 16kHz, keeping the samples its filter
+// needs from one frame to the next, in room enough for the longest frame
+type upsampler struct {
+	x []float64
+}
+
+// upsample fills out with twice as many samples as in
+func (u *upsampler) upsample(out, in []int16) {
+	if u.x == nil {
+		u.x = make([]float64, 2*HALFBAND_TAPS, 2*HALFBAND_TAPS+MAX_FRAME_SIZE)
+	}
+	history := len(u.x)
+	for _, sample := range in {
+		u.x = append(u.x, float64(sample))
+	}
+
+	// The original samples pass through; those between are interpolated
+	for i := range in {
+		j := HALFBAND_TAPS - 1 + i
+		sum := 0.0
+		for k, c := range halfbandCoefficients {
+			sum += c * (u.x[j-k] + u.x[j+1+k])
+		}
+		out[2*i] = int16(u.x[j])
+		out[2*i+1] = clampSample(sum)
+	}
+	u.x = append(u.x[:0], u.x[len(u.x)-history:]...)
+}
+
+// downsampler converts 16kHz audio to 8kHz, filtering out what 8kHz can't
+// carry first, and keeping the samples its filter needs from one frame to
+// the next, in room enough for the longest frame
+type downsampler struct {
+	x []float64
+}
+
+// downsample fills out with half as many samples as in
+func (d *downsampler) downsample(out, in []int16) {
+	if d.x == nil {
+		d.x = make([]float64, 4*HALFBAND_TAPS, 4*HALFBAND_TAPS+2*MAX_FRAME_SIZE)
+	}
+	history := len(d.x)
+	for _, sample := range in {
+		d.x = append(d.x, float64(sample))
+	}
+
+	for i := range len(in) / 2 {
+		j := 2*HALFBAND_TAPS + 2*i
+		sum := d.x[j]
+		for k, c := range halfbandCoefficients {
+			sum += c * (d.x[j-2*k-1] + d.x[j+2*k+1])
+		}
+		out[i] = clampSample(sum / 2)
+	}
+	d.x = append(d.x[:0], d.x[len(d.x)-history:]...)
+}
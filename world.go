@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// DEFAULT_INTERNATIONAL_PREFIX starts an international number once
+// normalized, as in most of the world
+const DEFAULT_INTERNATIONAL_PREFIX = "00"
+
+// worldLevel is how closely the content found matches the number dialed
+type worldLevel int
+
+const (
+	worldCity     worldLevel = iota // Tagged with the dialed country and area code
+	worldCountry                    // Tagged with the dialed country
+	worldNeighbor                   // From a neighboring country
+	worldZone                       // From a country in the same calling code zone
+	worldFallback                   // The configured fallback destination
+)
+
+// worldMatch is the outcome of resolving an international number
+type worldMatch struct {
+	level       worldLevel
+	dialed      *country // Country the number belongs to; nil if unknown
+	served      *country // Country the content is from; nil for the fallback
+	destination string
+}
+
+// String describes the match the way the caller would have it explained
+func (m *worldMatch) String() string {
+	switch m.level {
+	case worldCity:
+		return fmt.Sprintf("content from %s, matching the area code", m.served.name)
+	case worldCountry:
+		return fmt.Sprintf("content from %s", m.served.name)
+	case worldNeighbor:
+		return fmt.Sprintf("we have nothing from %s yet — here is its neighbor, %s", m.dialed.name, m.served.name)
+	case worldZone:
+		return fmt.Sprintf("we have nothing from %s yet — here is %s, in the same part of the world", m.dialed.name, m.served.name)
+	default:
+		if m.dialed == nil {
+			return "that country code doesn't exist — here is something else"
+		}
+		return fmt.Sprintf("we have nothing from anywhere near %s yet", m.dialed.name)
+	}
+}
+
+// taggedDestination is a destination in the world catalog
+type taggedDestination struct {
+	name     string
+	areaCode string
+}
+
+// worldPlan resolves international numbers to destinations tagged with the
+// country, and optionally the area code, they come from. When there is
+// nothing from the dialed country it falls back to a neighbor, then to a
+// country sharing the calling code zone (+975 Bhutan → +977 Nepal), then to
+// the configured fallback.
+type worldPlan struct {
+	prefix       string
+	pattern      *digitPattern // Numbers starting with prefix, for linting
+	fallback     string
+	announcement string
+	neighbors    map[string][]string
+	catalog      map[string][]taggedDestination // By ISO country code
+}
+
+// newWorldPlan builds the world plan from the dial plan config, or returns
+// nil if world numbering is disabled
+func newWorldPlan(cfg *Config) (*worldPlan, error) {
+	world := cfg.DialPlan.World
+	if !world.Enabled {
+		return nil, nil
+	}
+
+	plan := &worldPlan{
+		prefix:       world.Prefix,
+		fallback:     world.Fallback,
+		announcement: world.Announcement,
+		neighbors:    neighbors,
+		catalog:      make(map[string][]taggedDestination),
+	}
+	if plan.prefix == "" {
+		plan.prefix = DEFAULT_INTERNATIONAL_PREFIX
+	}
+	pattern, err := compileDigitPattern(plan.prefix + "x.")
+	if err != nil {
+		return nil, fmt.Errorf("dialplan.world.prefix: %v", err)
+	}
+	plan.pattern = pattern
+
+	for _, name := range []string{world.Fallback, world.Announcement} {
+		if _, ok := cfg.Destinations[name]; name != "" && !ok {
+			return nil, fmt.Errorf("dialplan.world: unknown destination %q", name)
+		}
+	}
+
+	if len(world.Neighbors) > 0 {
+		plan.neighbors = maps.Clone(neighbors)
+		for iso, list := range world.Neighbors {
+			codes := make([]string, 0, len(list))
+			for _, code := range append([]string{iso}, list...) {
+				if countryByISO(code) == nil {
+					return nil, fmt.Errorf("dialplan.world.neighbors: unknown country %q", code)
+				}
+				codes = append(codes, strings.ToUpper(code))
+			}
+			plan.neighbors[codes[0]] = codes[1:]
+		}
+	}
+
+	// Sorted so the choice for a given number is stable across restarts
+	for _, name := range slices.Sorted(maps.Keys(cfg.Destinations)) {
+		dest := cfg.Destinations[name]
+		if dest.Country == "" || dest.Hidden {
+			continue
+		}
+		iso := strings.ToUpper(dest.Country)
+		if countryByISO(iso) == nil {
+			return nil, fmt.Errorf("destination %q: unknown country %q", name, dest.Country)
+		}
+		plan.catalog[iso] = append(plan.catalog[iso], taggedDestination{name: name, areaCode: dest.AreaCode})
+	}
+
+	return plan, nil
+}
+
+// lookupCountry finds the country a number (without the international
+// prefix) belongs to, taking the longest matching code
+func lookupCountry(number string) *country {
+	var best *country
+	for i := range countries {
+		c := &countries[i]
+		if strings.HasPrefix(number, c.code) && (best == nil || len(c.code) > len(best.code)) {
+			best = c
+		}
+	}
+	return best
+}
+
+// countryByISO returns the first country entry with the given ISO code
+func countryByISO(iso string) *country {
+	iso = strings.ToUpper(iso)
+	for i := range countries {
+		if countries[i].iso == iso {
+			return &countries[i]
+		}
+	}
+	return nil
+}
+
+// Resolve finds content for a canonical number. It reports false if the
+// number isn't international or nothing, not even a fallback, applies.
+func (w *worldPlan) Resolve(number string) (*worldMatch, bool) {
+	if !strings.HasPrefix(number, w.prefix) || len(number) == len(w.prefix) {
+		return nil, false
+	}
+	international := number[len(w.prefix):]
+
+	dialed := lookupCountry(international)
+	if dialed == nil {
+		return w.resolveFallback(nil)
+	}
+
+	// The country's own content, preferring the dialed area code
+	if entries := w.catalog[dialed.iso]; len(entries) > 0 {
+		subscriber := strings.TrimPrefix(international, countryCallingCode(dialed))
+		if city := longestAreaCode(entries, subscriber); city != "" {
+			return &worldMatch{level: worldCity, dialed: dialed, served: dialed, destination: city}, true
+		}
+
+		var general []taggedDestination
+		for _, entry := range entries {
+			if entry.areaCode == "" {
+				general = append(general, entry)
+			}
+		}
+		if len(general) == 0 {
+			general = entries
+		}
+		return &worldMatch{level: worldCountry, dialed: dialed, served: dialed, destination: pick(general, number).name}, true
+	}
+
+	for _, iso := range w.neighbors[dialed.iso] {
+		if entries := w.catalog[iso]; len(entries) > 0 {
+			served := countryByISO(iso)
+			return &worldMatch{level: worldNeighbor, dialed: dialed, served: served, destination: pick(entries, number).name}, true
+		}
+	}
+
+	// Calling codes are assigned by region, so the longest shared prefix
+	// is a rough measure of distance
+	var nearest []string
+	longest := 0
+	for _, iso := range slices.Sorted(maps.Keys(w.catalog)) {
+		shared := commonPrefixLen(countryCallingCode(dialed), countryCallingCode(countryByISO(iso)))
+		if shared > longest {
+			nearest, longest = []string{iso}, shared
+		} else if shared == longest && shared > 0 {
+			nearest = append(nearest, iso)
+		}
+	}
+	if len(nearest) > 0 {
+		iso := nearest[hashNumber(number)%uint32(len(nearest))]
+		served := countryByISO(iso)
+		return &worldMatch{level: worldZone, dialed: dialed, served: served, destination: pick(w.catalog[iso], number).name}, true
+	}
+
+	return w.resolveFallback(dialed)
+}
+
+// resolveFallback returns the fallback destination, if one is configured
+func (w *worldPlan) resolveFallback(dialed *country) (*worldMatch, bool) {
+	if w.fallback == "" {
+		return nil, false
+	}
+	return &worldMatch{level: worldFallback, dialed: dialed, destination: w.fallback}, true
+}
+
+// countryCallingCode returns the calling code proper, dropping the area
+// code from split entries such as Canada's
+func countryCallingCode(c *country) string {
+	if len(c.code) == 4 && c.code[0] == '1' {
+		return "1"
+	}
+	if c.iso == "KZ" {
+		return "7"
+	}
+	return c.code
+}
+
+// longestAreaCode returns the entry whose area code is the longest prefix
+// of the subscriber number
+func longestAreaCode(entries []taggedDestination, subscriber string) string {
+	best := ""
+	bestLen := 0
+	for _, entry := range entries {
+		if entry.areaCode != "" && strings.HasPrefix(subscriber, entry.areaCode) && len(entry.areaCode) > bestLen {
+			best, bestLen = entry.name, len(entry.areaCode)
+		}
+	}
+	return best
+}
+
+// pick chooses one entry per number, so redialing a number gets the same
+// content while different numbers spread across the catalog
+func pick(entries []taggedDestination, number string) taggedDestination {
+	return entries[hashNumber(number)%uint32(len(entries))]
+}
+
+// hashNumber hashes a dialed number for pick
+func hashNumber(number string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(number))
+	return h.Sum32()
+}
+
+// commonPrefixLen returns the length of the common prefix of a and b
+func commonPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
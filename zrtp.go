@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SAS_ALPHABET is ZRTP's z-base-32, chosen to be easy to read aloud
+const SAS_ALPHABET = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// errCommitMismatch means the initiator's public key doesn't match the
+// hash it committed to, as when someone in the middle substitutes theirs
+var errCommitMismatch = errors.New("DH part does not match commitment")
+
+// mediaKeys protect a tunnel's media once key agreement is done
+type mediaKeys struct {
+	send cipher.AEAD
+	recv cipher.AEAD
+	sas  string // Short authentication string both ends read out to compare
+}
+
+// agreeMediaKeys runs a ZRTP-style key agreement (RFC 6189, Diffie-Hellman
+// mode) over an authenticated tunnel connection. The initiator commits to
+// its ephemeral X25519 public key by hash before seeing the responder's,
+// so an attacker in the middle gets a single guess at matching the short
+// authentication string, which the people at both ends compare by voice.
+// authSecret, which only the two authenticated ends of the tunnel can
+// compute, is mixed into the keys as ZRTP mixes in its auxsecret, so
+// someone who relays the handshake and swaps in their own DH keys ends up
+// with keys matching neither end even if nobody reads the SAS out. The
+// keys are ephemeral, so recorded calls stay private even if a peer's
+// shared secret later leaks.
+func agreeMediaKeys(conn io.ReadWriter, initiator bool, authSecret []byte) (*mediaKeys, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate DH key: %v", err)
+	}
+	public := private.PublicKey().Bytes()
+
+	var commit, initiatorPublic, responderPublic []byte
+	if initiator {
+		// Commit → DHPart1 ← DHPart2 →
+		hash := sha256.Sum256(public)
+		commit = hash[:]
+		if err := writeFrame(conn, FRAME_COMMIT, commit); err != nil {
+			return nil, err
+		}
+		part1, err := readFrame(conn)
+		if err != nil || part1.kind != FRAME_DHPART {
+			return nil, fmt.Errorf("expected DH part 1: %v", err)
+		}
+		if err := writeFrame(conn, FRAME_DHPART, public); err != nil {
+			return nil, err
+		}
+		initiatorPublic, responderPublic = public, part1.payload
+	} else {
+		frame, err := readFrame(conn)
+		if err != nil || frame.kind != FRAME_COMMIT || len(frame.payload) != sha256.Size {
+			return nil, fmt.Errorf("expected commit: %v", err)
+		}
+		commit = frame.payload
+		if err := writeFrame(conn, FRAME_DHPART, public); err != nil {
+			return nil, err
+		}
+		part2, err := readFrame(conn)
+		if err != nil || part2.kind != FRAME_DHPART {
+			return nil, fmt.Errorf("expected DH part 2: %v", err)
+		}
+		if hash := sha256.Sum256(part2.payload); !bytes.Equal(hash[:], commit) {
+			return nil, errCommitMismatch
+		}
+		initiatorPublic, responderPublic = part2.payload, public
+	}
+
+	theirs := responderPublic
+	if !initiator {
+		theirs = initiatorPublic
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(theirs)
+	if err != nil {
+		return nil, fmt.Errorf("bad DH public key: %v", err)
+	}
+	dhResult, err := private.ECDH(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("DH failed: %v", err)
+	}
+
+	// s0 = hash(counter || DHResult || "ZRTP-HMAC-KDF" || total_hash ||
+	// len(auxsecret) || auxsecret)
+	totalHash := sha256.New()
+	totalHash.Write(commit)
+	totalHash.Write(responderPublic)
+	totalHash.Write(initiatorPublic)
+	context := totalHash.Sum(nil)
+
+	s0 := sha256.New()
+	s0.Write([]byte{0, 0, 0, 1})
+	s0.Write(dhResult)
+	s0.Write([]byte("ZRTP-HMAC-KDF"))
+	s0.Write(context)
+	binary.Write(s0, binary.BigEndian, uint32(len(authSecret)))
+	s0.Write(authSecret)
+	secret := s0.Sum(nil)
+
+	initiatorKey, err := newMediaCipher(zrtpKDF(secret, "Initiator SRTP master key", context, 128))
+	if err != nil {
+		return nil, err
+	}
+	responderKey, err := newMediaCipher(zrtpKDF(secret, "Responder SRTP master key", context, 128))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &mediaKeys{
+		send: initiatorKey,
+		recv: responderKey,
+		sas:  sasString(zrtpKDF(secret, "SAS", context, 256)),
+	}
+	if !initiator {
+		keys.send, keys.recv = keys.recv, keys.send
+	}
+	return keys, nil
+}
+
+// zrtpKDF is the ZRTP key derivation function: HMAC-SHA256 over a
+// counter, label, context and output length, truncated to bits
+func zrtpKDF(key []byte, label string, context []byte, bits int) []byte {
+	mac := hmac.New(sha256.New, key)
+	binary.Write(mac, binary.BigEndian, uint32(1))
+	mac.Write([]byte(label))
+	mac.Write([]byte{0})
+	mac.Write(context)
+	binary.Write(mac, binary.BigEndian, uint32(bits))
+	return mac.Sum(nil)[:bits/8]
+}
+
+// sasString renders the leftmost 20 bits of the SAS value as four
+// z-base-32 characters (ZRTP's B32 rendering)
+func sasString(value []byte) string {
+	bits := binary.BigEndian.Uint32(value)
+	sas := make([]byte, 4)
+	for i := range sas {
+		sas[i] = SAS_ALPHABET[bits>>(27-5*i)&0x1F]
+	}
+	return string(sas)
+}
+
+// newMediaCipher creates the AES-GCM cipher for one direction of a tunnel
+func newMediaCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// mediaNonce builds the GCM nonce for the seq-th frame in a direction.
+// Frames arrive in order over TCP, so both ends count them rather than
+// sending the counter.
+func mediaNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}